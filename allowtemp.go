@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// newAllowTempCmd returns the command requesting temporary exceptions
+// through the admin API:
+//
+//	legion-router allow-temp <dest>[:port] --duration 1h --reason "..."
+//	legion-router allow-temp approve <id>
+func newAllowTempCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "allow-temp <dest>[:port]",
+		Short: "Request or approve a temporary exception",
+		Args:  cobra.ExactArgs(1),
+	}
+	fs := cmd.Flags()
+	port := fs.Uint("port", 0, "Destination port, unless given with the destination")
+	duration := fs.Duration("duration", time.Hour, "How long the exception lasts")
+	reason := fs.String("reason", "", "Why the exception is needed (required)")
+	user := fs.String("user", os.Getenv("USER"), "Name recorded as the requester with the shared token")
+	cmd.MarkFlagRequired("reason")
+	client := adminClientFlags(cmd.PersistentFlags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return requestGrant(client(), args[0], *port, *duration, *reason, *user)
+	}
+	cmd.AddCommand(newApproveCmd(client))
+	return cmd
+}
+
+// requestGrant requests an exception to dest, for each address of a host
+// name
+func requestGrant(client *admin.Client, dest string, port uint, duration time.Duration, reason, user string) error {
+	host := dest
+	if h, p, err := net.SplitHostPort(dest); err == nil {
+		parsed, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q: %w", p, err)
+		}
+		host, port = h, uint(parsed)
+	}
+	if port == 0 || port > 65535 {
+		return fmt.Errorf("a destination port between 1 and 65535 is required")
+	}
+
+	// Host names are granted for each of their current addresses
+	addresses := []string{host}
+	if net.ParseIP(host) == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", host, err)
+		}
+		addresses = addresses[:0]
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+	}
+
+	for _, address := range addresses {
+		grant, pending, err := client.RequestGrant(admin.GrantRequest{
+			Destination: address,
+			Port:        uint16(port),
+			TTL:         config.Duration(duration),
+			Reason:      reason,
+			RequestedBy: user,
+		})
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			fmt.Printf("Requested %s:%d, awaiting approval: legion-router allow-temp approve %s\n", address, port, pending.ID)
+			continue
+		}
+		fmt.Printf("Allowed %s:%d until %s\n", grant.Destination, grant.Port, grant.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// newApproveCmd returns the command approving a pending exception with the
+// admin API client of its parent, which must authenticate as an approver
+func newApproveCmd(client func() *admin.Client) *cobra.Command {
+	return &cobra.Command{
+		Use:   "approve <id>",
+		Short: "Approve a pending exception",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			grant, err := client().Approve(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Allowed %s:%d until %s\n", grant.Destination, grant.Port, grant.Expires.Format(time.RFC3339))
+			return nil
+		},
+	}
+}
+
+// adminClientFlags registers the admin API flags on fs and returns a
+// function creating the client once they are parsed
+func adminClientFlags(fs *pflag.FlagSet) func() *admin.Client {
+	url := fs.String("admin", admin.DefaultURL, "Admin API URL")
+	token := fs.String("token", os.Getenv("LEGION_ADMIN_TOKEN"), "Admin API token (default $LEGION_ADMIN_TOKEN)")
+	cert := fs.String("cert", "", "Client certificate for an HTTPS admin API")
+	key := fs.String("key", "", "Private key of the client certificate")
+	ca := fs.String("ca", "", "CA certificate verifying an HTTPS admin API (default system CAs)")
+	return func() *admin.Client {
+		client := admin.NewClient(*url, *token)
+		if *cert != "" || *key != "" || *ca != "" {
+			client.UseTLS(*cert, *key, *ca)
+		}
+		return client
+	}
+}
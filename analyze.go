@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
+)
+
+// newAnalyzeCmd returns the command replaying the decisions a router
+// recorded in its decision log against a candidate config, predicting
+// which flows it would decide otherwise before it is rolled out:
+//
+//	legion-router analyze --config candidate.yaml decisions.log [decisions.log.1 ...] [--show 20]
+func newAnalyzeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "analyze <decision log>...",
+		Short: "Replay recorded decisions against a candidate config",
+		Args:  cobra.MinimumNArgs(1),
+	}
+	configPath := cmd.Flags().String("config", "/etc/legion-router/config.yaml", "Path to the candidate configuration file")
+	show := cmd.Flags().Int("show", 20, "Changed flows to list per direction, the most frequent first; 0 lists all")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runAnalyze(*configPath, args, *show)
+	}
+	return cmd
+}
+
+// runAnalyze replays the decisions recorded in files against the config at
+// configPath
+func runAnalyze(configPath string, files []string, show int) error {
+	var decisions []decisionlog.Decision
+	for _, file := range files {
+		recorded, err := decisionlog.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		decisions = append(decisions, recorded...)
+	}
+	if len(decisions) == 0 {
+		return fmt.Errorf("no decisions recorded in %s", strings.Join(files, ", "))
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	resolver, err := dns.NewResolver(cfg.DNS.Servers)
+	if err != nil {
+		return err
+	}
+	flows := filter.Flows(decisions)
+	results, err := filter.Replay(cfg, resolver, flows)
+	if err != nil {
+		return err
+	}
+
+	first, last := flows[0].First, flows[0].Last
+	for _, flow := range flows {
+		if flow.First.Before(first) {
+			first = flow.First
+		}
+		if flow.Last.After(last) {
+			last = flow.Last
+		}
+	}
+	fmt.Printf("Replayed %d decisions (%d flows) recorded %s to %s against %s\n",
+		len(decisions), len(flows), first.Format(time.RFC3339), last.Format(time.RFC3339), configPath)
+	unchanged, failed, changes := replayChanges(results)
+	printChanges(unchanged, failed, changes, show)
+	return nil
+}
+
+// flowChange is a flow a config decides otherwise than before
+type flowChange struct {
+	flow filter.Flow
+	now  config.Action
+	// What decided the flow before and now
+	was, reason string
+}
+
+// replayChanges returns the decisions replayed unchanged, those that
+// couldn't be evaluated and the flows that change
+func replayChanges(results []filter.ReplayResult) (unchanged, failed int, changes []flowChange) {
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed += result.Flow.Count
+		case !result.Changed():
+			unchanged += result.Flow.Count
+		default:
+			was := result.Flow.Rule
+			if was == "" {
+				was = "no rule"
+			}
+			changes = append(changes, flowChange{flow: result.Flow, now: result.Verdict, was: was, reason: result.Reason})
+		}
+	}
+	return unchanged, failed, changes
+}
+
+// printChanges summarizes the decisions of flows that change, and lists
+// the changed flows per direction, at most show of each unless 0
+func printChanges(unchanged, failed int, changes []flowChange, show int) {
+	var denied, allowed []flowChange
+	for _, change := range changes {
+		if change.now == config.ActionDeny {
+			denied = append(denied, change)
+		} else {
+			allowed = append(allowed, change)
+		}
+	}
+	fmt.Printf("%8d unchanged\n", unchanged)
+	fmt.Printf("%8d allowed, now denied\n", decisionCount(denied))
+	fmt.Printf("%8d denied, now allowed\n", decisionCount(allowed))
+	if failed > 0 {
+		fmt.Printf("%8d not evaluated\n", failed)
+	}
+
+	for _, direction := range []struct {
+		title   string
+		changes []flowChange
+	}{
+		{"Allowed, now denied", denied},
+		{"Denied, now allowed", allowed},
+	} {
+		if len(direction.changes) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", direction.title)
+		for i, change := range direction.changes {
+			if show > 0 && i == show {
+				fmt.Printf("  ... %d more flows\n", len(direction.changes)-show)
+				break
+			}
+			fmt.Printf("%8d %s (was %s; now %s)\n", change.flow.Count, change.flow, change.was, change.reason)
+		}
+	}
+}
+
+// decisionCount returns the number of decisions of the changed flows
+func decisionCount(changes []flowChange) int {
+	n := 0
+	for _, change := range changes {
+		n += change.flow.Count
+	}
+	return n
+}
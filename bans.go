@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newBansCmd returns the command listing the sources a running router
+// banned for hitting deny rules too often, or lifting the ban of one,
+// through the admin API:
+//
+//	legion-router bans
+//	legion-router bans unban <ip>
+func newBansCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bans",
+		Short: "List the sources a running router banned, or unban one",
+		Args:  cobra.NoArgs,
+	}
+	client := adminClientFlags(cmd.PersistentFlags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		bans, err := client().Bans()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, ban := range bans {
+			fmt.Printf("%-40s expires in %s\n", ban.Source, ban.Expires.Sub(now).Round(time.Second))
+		}
+		fmt.Printf("%d sources banned\n", len(bans))
+		return nil
+	}
+
+	unban := &cobra.Command{
+		Use:   "unban <ip>",
+		Short: "Lift the ban of a source",
+		Args:  cobra.ExactArgs(1),
+	}
+	user := unban.Flags().String("user", os.Getenv("USER"), "Name recorded in the audit log")
+	unban.RunE = func(cmd *cobra.Command, args []string) error {
+		if err := client().Unban(args[0], *user); err != nil {
+			return err
+		}
+		fmt.Printf("Unbanned %s\n", args[0])
+		return nil
+	}
+	cmd.AddCommand(unban)
+	return cmd
+}
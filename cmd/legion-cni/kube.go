@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/skaegi/legion-router/pkg/kube"
+)
+
+// podAnnotations returns the annotations of a pod
+func podAnnotations(client *kube.Client, namespace, name string) (map[string]string, error) {
+	var pod struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if err := client.Get(context.Background(), path, &pod); err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+	return pod.Metadata.Annotations, nil
+}
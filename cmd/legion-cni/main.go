@@ -0,0 +1,241 @@
+// Command legion-cni is a chained CNI meta-plugin that programs the
+// legion-router policy named by a pod annotation into the pod's network
+// namespace:
+//
+//	{
+//	  "type": "legion-cni",
+//	  "kubeconfig": "/etc/cni/net.d/legion-cni.kubeconfig",
+//	  "policyDir": "/etc/legion-router/policies"
+//	}
+//
+// A pod annotated legion-router.io/policy=web gets the policy in
+// <policyDir>/web.yaml; pods without the annotation are left alone.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/skaegi/legion-router/pkg/kube"
+	"github.com/skaegi/legion-router/pkg/network"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+const (
+	defaultAnnotation = "legion-router.io/policy"
+	defaultPolicyDir  = "/etc/legion-router/policies"
+	cniVersion        = "1.0.0"
+)
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// Error codes of the CNI specification
+const (
+	codeInvalidEnv    = 4
+	codeIOFailure     = 5
+	codeDecodeFailure = 6
+	codeInvalidConfig = 7
+)
+
+// netConf is the plugin's network configuration
+type netConf struct {
+	CNIVersion string          `json:"cniVersion"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	PrevResult json.RawMessage `json:"prevResult,omitempty"`
+	// Kubeconfig is used to read pod annotations
+	Kubeconfig string `json:"kubeconfig"`
+	// PolicyDir holds the policies pods can name, as <name>.yaml
+	PolicyDir string `json:"policyDir,omitempty"`
+	// Annotation names the pod annotation holding the policy name
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// request is a plugin invocation, from the CNI_* environment variables
+type request struct {
+	command string
+	netns   string
+	args    map[string]string // CNI_ARGS, e.g. K8S_POD_NAME
+}
+
+// cniError is an error result as defined by the CNI specification
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *cniError) Error() string {
+	if e.Details != "" {
+		return e.Msg + ": " + e.Details
+	}
+	return e.Msg
+}
+
+func main() {
+	req := request{
+		command: os.Getenv("CNI_COMMAND"),
+		netns:   os.Getenv("CNI_NETNS"),
+		args:    parseArgs(os.Getenv("CNI_ARGS")),
+	}
+	if err := run(req, os.Stdin, os.Stdout); err != nil {
+		var cerr *cniError
+		if !errors.As(err, &cerr) {
+			cerr = &cniError{Code: codeIOFailure, Msg: err.Error()}
+		}
+		cerr.CNIVersion = cniVersion
+		json.NewEncoder(os.Stdout).Encode(cerr)
+		os.Exit(1)
+	}
+}
+
+// run handles a CNI command, writing its result to stdout; logs go to
+// stderr, which the runtime ignores
+func run(req request, stdin io.Reader, stdout io.Writer) error {
+	if req.command == "VERSION" {
+		return json.NewEncoder(stdout).Encode(map[string]interface{}{
+			"cniVersion":        cniVersion,
+			"supportedVersions": supportedVersions,
+		})
+	}
+
+	var conf netConf
+	if err := json.NewDecoder(stdin).Decode(&conf); err != nil {
+		return &cniError{Code: codeDecodeFailure, Msg: "failed to decode network configuration", Details: err.Error()}
+	}
+
+	switch req.command {
+	case "ADD":
+		if err := add(&conf, req); err != nil {
+			return err
+		}
+		// A chained plugin passes the previous result on unchanged
+		result := conf.PrevResult
+		if len(result) == 0 {
+			result, _ = json.Marshal(map[string]string{"cniVersion": conf.CNIVersion})
+		}
+		_, err := stdout.Write(append(result, '\n'))
+		return err
+	case "DEL":
+		return del(req)
+	case "CHECK":
+		return nil
+	default:
+		return &cniError{Code: codeInvalidEnv, Msg: fmt.Sprintf("unknown CNI_COMMAND %q", req.command)}
+	}
+}
+
+// add programs the pod's policy, if it names one
+func add(conf *netConf, req request) error {
+	namespace, name := req.args["K8S_POD_NAMESPACE"], req.args["K8S_POD_NAME"]
+	if namespace == "" || name == "" {
+		// Not a Kubernetes pod
+		return nil
+	}
+
+	if conf.Kubeconfig == "" {
+		return &cniError{Code: codeInvalidConfig, Msg: "kubeconfig is required"}
+	}
+	client, err := kube.Load(conf.Kubeconfig)
+	if err != nil {
+		return &cniError{Code: codeInvalidConfig, Msg: "failed to load kubeconfig", Details: err.Error()}
+	}
+	annotations, err := podAnnotations(client, namespace, name)
+	if err != nil {
+		return err
+	}
+	annotation := conf.Annotation
+	if annotation == "" {
+		annotation = defaultAnnotation
+	}
+	policy := annotations[annotation]
+	if policy == "" {
+		return nil
+	}
+
+	path, err := policyPath(conf.PolicyDir, policy)
+	if err != nil {
+		return &cniError{Code: codeInvalidConfig, Msg: "invalid policy annotation", Details: err.Error()}
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	if req.netns == "" {
+		return &cniError{Code: codeInvalidEnv, Msg: "CNI_NETNS is required"}
+	}
+	netns, err := network.OpenNetNS(req.netns)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	resolver, err := dns.NewResolver(cfg.DNS.Servers)
+	if err != nil {
+		return err
+	}
+	f, err := filter.New(cfg, path, resolver)
+	if err != nil {
+		return err
+	}
+	if err := f.SetNetNS(int(netns.Fd())); err != nil {
+		return err
+	}
+	if err := f.ApplyOnce(); err != nil {
+		return err
+	}
+	log.Printf("Applied policy %s to pod %s/%s", policy, namespace, name)
+	return nil
+}
+
+// del removes the ruleset from the pod's namespace, if it still exists
+func del(req request) error {
+	if req.netns == "" {
+		return nil
+	}
+	netns, err := network.OpenNetNS(req.netns)
+	if err != nil {
+		// The namespace and its ruleset are already gone
+		return nil
+	}
+	defer netns.Close()
+
+	m, err := nftables.NewManager(nftables.InNamespace(int(netns.Fd())))
+	if err != nil {
+		return err
+	}
+	return m.Remove()
+}
+
+// policyPath returns the file of a named policy; names can't leave the
+// policy directory
+func policyPath(dir, name string) (string, error) {
+	if dir == "" {
+		dir = defaultPolicyDir
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("policy name %q must not contain a path", name)
+	}
+	return filepath.Join(dir, name+".yaml"), nil
+}
+
+// parseArgs parses CNI_ARGS, e.g. "IgnoreUnknown=1;K8S_POD_NAME=web-0"
+func parseArgs(s string) map[string]string {
+	args := make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			args[key] = value
+		}
+	}
+	return args
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKubeconfig writes a kubeconfig for server with token
+func writeKubeconfig(t *testing.T, server, token string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	data := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: cni
+clusters:
+  - name: local
+    cluster:
+      server: %s
+contexts:
+  - name: cni
+    context:
+      cluster: local
+      user: legion-cni
+users:
+  - name: legion-cni
+    user:
+      token: %s
+`, server, token)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestRun tests the CNI commands that don't touch a namespace
+func TestRun(t *testing.T) {
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/pods/plain":
+			fmt.Fprint(w, `{"metadata": {"annotations": {"team": "web"}}}`)
+		case "/api/v1/namespaces/default/pods/escaping":
+			fmt.Fprint(w, `{"metadata": {"annotations": {"legion-router.io/policy": "../secrets"}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer apiserver.Close()
+	kubeconfig := writeKubeconfig(t, apiserver.URL, "secret")
+	prevResult := `{"cniVersion":"1.0.0","ips":[{"address":"10.1.0.5/24"}]}`
+	conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "k8s", "type": "legion-cni", "kubeconfig": %q, "prevResult": %s}`, kubeconfig, prevResult)
+
+	testCases := []struct {
+		name    string
+		req     request
+		want    string // Substring of the result
+		wantErr bool
+	}{
+		{
+			name: "version",
+			req:  request{command: "VERSION"},
+			want: `"supportedVersions"`,
+		},
+		{
+			name: "not a pod",
+			req:  request{command: "ADD", args: map[string]string{}},
+			want: prevResult,
+		},
+		{
+			name: "pod without policy",
+			req:  request{command: "ADD", args: parseArgs("K8S_POD_NAMESPACE=default;K8S_POD_NAME=plain")},
+			want: prevResult,
+		},
+		{
+			name:    "unknown pod",
+			req:     request{command: "ADD", args: parseArgs("K8S_POD_NAMESPACE=default;K8S_POD_NAME=missing")},
+			wantErr: true,
+		},
+		{
+			name:    "policy outside the policy directory",
+			req:     request{command: "ADD", args: parseArgs("K8S_POD_NAMESPACE=default;K8S_POD_NAME=escaping")},
+			wantErr: true,
+		},
+		{
+			name: "delete without namespace",
+			req:  request{command: "DEL"},
+		},
+		{
+			name:    "unknown command",
+			req:     request{command: "GC"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := run(tc.req, strings.NewReader(conf), &out)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !strings.Contains(out.String(), tc.want) {
+				t.Errorf("Expected result to contain %s, got %s", tc.want, out.String())
+			}
+			if out.Len() > 0 && !json.Valid(out.Bytes()) {
+				t.Errorf("Expected a JSON result, got %s", out.String())
+			}
+		})
+	}
+}
+
+// TestParseArgs tests parsing CNI_ARGS
+func TestParseArgs(t *testing.T) {
+	args := parseArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0;K8S_POD_INFRA_CONTAINER_ID=abc")
+	if args["K8S_POD_NAMESPACE"] != "default" || args["K8S_POD_NAME"] != "web-0" {
+		t.Errorf("Unexpected args: %v", args)
+	}
+	if len(parseArgs("")) != 0 {
+		t.Error("Expected no args from an empty string")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/skaegi/legion-router/pkg/cluster"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/credentials"
+)
+
+// controllerOptions are the flags of the controller
+type controllerOptions struct {
+	policyPath  string
+	listen      string
+	dashboard   string
+	token       string
+	certFile    string
+	keyFile     string
+	clientCA    string
+	trustDomain string
+}
+
+// newControllerCmd returns the command running the cluster controller,
+// pushing a policy file to the agents and serving their aggregated status:
+//
+//	legion-router controller --policy policy.yaml --listen :9443
+func newControllerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "controller",
+		Short: "Serve policy to cluster agents",
+		Args:  cobra.NoArgs,
+	}
+	var opts controllerOptions
+	fs := cmd.Flags()
+	fs.StringVar(&opts.policyPath, "policy", "/etc/legion-router/policy.yaml", "Policy pushed to the agents")
+	fs.StringVar(&opts.listen, "listen", ":9443", "gRPC address agents connect to")
+	fs.StringVar(&opts.dashboard, "dashboard", "127.0.0.1:9444", "Dashboard API address (empty to disable)")
+	fs.StringVar(&opts.token, "token", os.Getenv("LEGION_CLUSTER_TOKEN"), "Token agents must present (default $LEGION_CLUSTER_TOKEN)")
+	fs.StringVar(&opts.certFile, "cert", "", "TLS certificate for the gRPC listener")
+	fs.StringVar(&opts.keyFile, "key", "", "TLS key for the gRPC listener")
+	fs.StringVar(&opts.clientCA, "client-ca", "", "CA agents' client certificates must be issued by (mutual TLS)")
+	fs.StringVar(&opts.trustDomain, "trust-domain", "", "SPIFFE trust domain agents' certificates must be in")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runController(&opts)
+	}
+	return cmd
+}
+
+// runController runs the cluster controller until it is signalled to stop
+func runController(opts *controllerOptions) error {
+	controller := cluster.NewController(opts.token)
+	if err := controller.LoadPolicy(opts.policyPath); err != nil {
+		return err
+	}
+
+	if (opts.clientCA != "" || opts.trustDomain != "") && (opts.certFile == "" || opts.keyFile == "") {
+		return fmt.Errorf("--client-ca and --trust-domain need --cert and --key")
+	}
+	if opts.trustDomain != "" && opts.clientCA == "" {
+		return fmt.Errorf("--trust-domain needs --client-ca")
+	}
+	var creds credentials.TransportCredentials
+	if opts.certFile != "" || opts.keyFile != "" {
+		var err error
+		if creds, err = cluster.ServerCredentials(opts.certFile, opts.keyFile, opts.clientCA, opts.trustDomain); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", opts.listen, err)
+	}
+	server := controller.Server(creds)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Warning: controller stopped: %v", err)
+		}
+	}()
+	log.Printf("Controller listening on %s", listener.Addr())
+
+	if opts.dashboard != "" {
+		dashboardServer := &http.Server{
+			Addr:              opts.dashboard,
+			Handler:           controller.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := dashboardServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Warning: dashboard API stopped: %v", err)
+			}
+		}()
+		log.Printf("Dashboard API listening on %s", opts.dashboard)
+	}
+
+	// Watch the directory, since editors replace the file
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(opts.policyPath)); err != nil {
+		log.Printf("Warning: failed to watch policy file: %v", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != filepath.Clean(opts.policyPath) || !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+				continue
+			}
+			if err := controller.LoadPolicy(opts.policyPath); err != nil {
+				log.Printf("Error loading policy, keeping the current version: %v", err)
+			}
+		case err := <-watcher.Errors:
+			log.Printf("Policy file watcher error: %v", err)
+		case <-sigChan:
+			log.Println("Shutting down controller...")
+			server.GracefulStop()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/convert"
+	"github.com/spf13/cobra"
+)
+
+// newExportCmd returns the command printing the policy for management as
+// code, with a stable ID on every rule:
+//
+//	legion-router export --config config.yaml --format hcl
+func newExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Print a config as HCL or JSON for management as code",
+		Args:  cobra.NoArgs,
+	}
+	configPath := cmd.Flags().String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
+	format := cmd.Flags().String("format", convert.FormatHCL, "Output format: hcl or json")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runExport(*configPath, *format)
+	}
+	return cmd
+}
+
+// runExport prints the config at configPath in format
+func runExport(configPath, format string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	data, err := convert.Export(cfg, format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// newImportCmd returns the command converting a policy or an existing
+// firewall to the config file format and printing it:
+//
+//	legion-router import hcl policy.hcl > config.yaml
+//	legion-router import nft ruleset.nft > config.yaml
+func newImportCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "import <hcl|json|nft|iptables> <file>",
+		Short: "Convert HCL, JSON or an existing firewall into a config",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runImport(args[0], args[1])
+		},
+	}
+}
+
+// runImport prints the policy or firewall in file, of format, as a config
+func runImport(format, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	cfg, err := convert.Import(data, format)
+	if err != nil {
+		return err
+	}
+	out, err := convert.MarshalYAML(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
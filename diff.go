@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/skaegi/legion-router/pkg/flowlog"
+	"github.com/spf13/cobra"
+)
+
+// newDiffCmd returns the command evaluating recorded traffic against two
+// configs and reporting the flows the new one decides otherwise than the
+// old, as a safety check of a policy refactor:
+//
+//	legion-router diff old.yaml new.yaml --traffic connections.log[,decisions.log] [--show 20]
+func newDiffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff <old.yaml> <new.yaml>",
+		Short: "Show which recorded flows two configs decide differently",
+		Args:  cobra.ExactArgs(2),
+	}
+	traffic := cmd.Flags().String("traffic", "", "Comma-separated connection log files or decision logs of the traffic to compare (required)")
+	show := cmd.Flags().Int("show", 20, "Changed flows to list per direction, the most frequent first; 0 lists all")
+	cmd.MarkFlagRequired("traffic")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runDiff(args, *traffic, *show)
+	}
+	return cmd
+}
+
+// runDiff compares the decisions of the configs at paths, old and new, for
+// the traffic recorded in the comma-separated files of traffic
+func runDiff(paths []string, traffic string, show int) error {
+	var decisions []decisionlog.Decision
+	for _, file := range strings.Split(traffic, ",") {
+		recorded, err := readTraffic(file)
+		if err != nil {
+			return err
+		}
+		decisions = append(decisions, recorded...)
+	}
+	if len(decisions) == 0 {
+		return fmt.Errorf("no connections found in %s", traffic)
+	}
+	flows := filter.Flows(decisions)
+
+	var replays [2][]filter.ReplayResult
+	for i, path := range paths {
+		cfg, err := config.Load(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		resolver, err := dns.NewResolver(cfg.DNS.Servers)
+		if err != nil {
+			return err
+		}
+		if replays[i], err = filter.Replay(cfg, resolver, flows); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	fmt.Printf("Compared %d connections (%d flows) from %s under %s and %s\n", len(decisions), len(flows), traffic, paths[0], paths[1])
+	unchanged, failed, changes := diffChanges(replays[0], replays[1])
+	printChanges(unchanged, failed, changes, show)
+	return nil
+}
+
+// diffChanges returns the decisions both configs make alike, those either
+// couldn't evaluate and the flows the new config decides otherwise
+func diffChanges(old, new []filter.ReplayResult) (unchanged, failed int, changes []flowChange) {
+	for i := range old {
+		flow := old[i].Flow
+		switch {
+		case old[i].Err != nil || new[i].Err != nil:
+			failed += flow.Count
+		case old[i].Verdict == new[i].Verdict:
+			unchanged += flow.Count
+		default:
+			changes = append(changes, flowChange{flow: flow, now: new[i].Verdict, was: old[i].Reason, reason: new[i].Reason})
+		}
+	}
+	return unchanged, failed, changes
+}
+
+// readTraffic returns the connections of a decision log, or of a
+// connection log file or router log, whose other lines are skipped
+func readTraffic(path string) ([]decisionlog.Decision, error) {
+	decisions, err := decisionlog.ReadFile(path)
+	if !errors.Is(err, decisionlog.ErrFormat) {
+		return decisions, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry, err := flowlog.ParseLine(scanner.Text())
+		if err != nil {
+			continue
+		}
+		decisions = append(decisions, decisionlog.Decision{
+			Time:        entry.Time,
+			Verdict:     entry.Verdict,
+			Rule:        entry.Rule,
+			Protocol:    entry.Protocol,
+			Interface:   entry.Interface,
+			Source:      entry.Source,
+			SourcePort:  entry.SourcePort,
+			Destination: entry.Destination,
+			Port:        entry.Port,
+			Domain:      entry.Domain,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return decisions, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+)
+
+// TestReadTraffic tests reading the connections of decision logs,
+// connection log files and router logs
+func TestReadTraffic(t *testing.T) {
+	dir := t.TempDir()
+	decisionLog := filepath.Join(dir, "decisions.log")
+	w, err := decisionlog.Open(decisionLog, decisionlog.Options{})
+	if err != nil {
+		t.Fatalf("Failed to open decision log: %v", err)
+	}
+	w.Record(decisionlog.Decision{
+		Time: time.Now(), Verdict: "allow", Rule: "web", Protocol: "tcp",
+		Source: net.ParseIP("10.0.0.5"), SourcePort: 51234, Destination: net.ParseIP("192.0.2.1"), Port: 443,
+	})
+	w.Close()
+
+	testCases := []struct {
+		name    string
+		content string // Written as a text file unless empty
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "decision log",
+			want: []string{"allow 192.0.2.1:443"},
+		},
+		{
+			name: "connection log file",
+			content: "2026-10-16T12:00:00Z allow rule=web proto=tcp in=eth1 src=10.0.0.5:51234 dst=192.0.2.1:443\n" +
+				"2026-10-16T12:00:01Z deny proto=udp src=10.0.0.5:40000 dst=198.51.100.7:53\n",
+			want: []string{"allow 192.0.2.1:443", "deny 198.51.100.7:53"},
+		},
+		{
+			name: "router log",
+			content: "2026/10/16 12:00:00 Watching config file for changes: /etc/legion-router/config.yaml\n" +
+				"2026/10/16 12:00:02 Connection deny proto=tcp src=10.0.0.5:40000 dst=198.51.100.7:22\n",
+			want: []string{"deny 198.51.100.7:22"},
+		},
+		{
+			name:    "missing",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := decisionLog
+			switch {
+			case tc.content != "":
+				path = filepath.Join(dir, "connections.log")
+				if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+					t.Fatalf("Failed to write log: %v", err)
+				}
+			case tc.wantErr:
+				path = filepath.Join(dir, "missing.log")
+			}
+
+			decisions, err := readTraffic(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("readTraffic() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if len(decisions) != len(tc.want) {
+				t.Fatalf("Expected %d connections, got %d: %+v", len(tc.want), len(decisions), decisions)
+			}
+			for i, d := range decisions {
+				got := fmt.Sprintf("%s %s:%d", d.Verdict, d.Destination, d.Port)
+				if got != tc.want[i] {
+					t.Errorf("Expected %q, got %q", tc.want[i], got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/spf13/cobra"
+)
+
+// newDNSCacheCmd returns the command printing the domains in the DNS cache
+// of a running router, with their addresses and expiry, from the admin API:
+//
+//	legion-router dns-cache [--domain example.com]
+func newDNSCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dns-cache",
+		Short: "Show the DNS cache of a running router",
+		Args:  cobra.NoArgs,
+	}
+	domain := cmd.Flags().String("domain", "", "Only domains containing this")
+	asJSON := cmd.Flags().Bool("json", false, "Print the cache as JSON")
+	client := adminClientFlags(cmd.Flags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runDNSCache(client(), *domain, *asJSON)
+	}
+	return cmd
+}
+
+// runDNSCache prints the DNS cache, of domains containing domain if set
+func runDNSCache(client *admin.Client, domain string, asJSON bool) error {
+	cache, err := client.DNSCache()
+	if err != nil {
+		return err
+	}
+	cached := len(cache.Entries)
+	if domain != "" {
+		kept := cache.Entries[:0]
+		for _, entry := range cache.Entries {
+			if strings.Contains(entry.Domain, strings.ToLower(domain)) {
+				kept = append(kept, entry)
+			}
+		}
+		cache.Entries = kept
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cache)
+	}
+	now := time.Now()
+	for _, entry := range cache.Entries {
+		expires := "expired"
+		if entry.Expires.After(now) {
+			expires = "expires in " + entry.Expires.Sub(now).Round(time.Second).String()
+		}
+		addresses := append(append([]string(nil), entry.IPv4...), entry.IPv6...)
+		fmt.Printf("%-40s %-20s %s\n", entry.Domain, expires, strings.Join(addresses, " "))
+	}
+	fmt.Printf("%d domains cached of at most %d, %d evicted\n", cached, cache.Limit, cache.Evictions)
+	return nil
+}
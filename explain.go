@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
+)
+
+// newExplainCmd returns the command showing what a config does with a
+// connection and which rule decides it, as policy tests evaluate it; a host
+// name is explained for each of its addresses:
+//
+//	legion-router explain --config config.yaml <dest>[:port] [--src 10.0.0.5] [--proto udp] [--state established]
+func newExplainCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "explain <dest>[:port]",
+		Short: "Show which rule decides a connection under a config",
+		Args:  cobra.ExactArgs(1),
+	}
+	fs := cmd.Flags()
+	configPath := fs.String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
+	src := fs.String("src", "", "Source address of the connection")
+	proto := fs.String("proto", string(config.ProtocolTCP), "Protocol: tcp, udp or icmp")
+	port := fs.Uint("port", 0, "Destination port, unless given with the destination")
+	iface := fs.String("interface", "", "Interface the connection arrives on")
+	app := fs.String("app", "", "Application protocol, for traffic l7 rules inspect")
+	state := fs.String("state", "", "Conntrack state of the packet: new (default), established, related, invalid or untracked")
+	ttl := fs.Uint("ttl", 0, "TTL or hop limit of the packet (default 64)")
+	length := fs.Uint("length", 0, "Length of the packet in bytes (default 60)")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		dest := args[0]
+		host := dest
+		if h, p, err := net.SplitHostPort(dest); err == nil {
+			parsed, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port %q: %w", p, err)
+			}
+			host, *port = h, uint(parsed)
+		}
+		protocol := config.Protocol(*proto)
+		if protocol != config.ProtocolICMP && (*port == 0 || *port > 65535) {
+			return fmt.Errorf("a destination port between 1 and 65535 is required")
+		}
+		if *ttl > 255 {
+			return fmt.Errorf("the ttl must be at most 255")
+		}
+		if *length > 65535 {
+			return fmt.Errorf("the length must be at most 65535")
+		}
+
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		resolver, err := dns.NewResolver(cfg.DNS.Servers)
+		if err != nil {
+			return err
+		}
+
+		conn := config.PolicyTest{
+			Source:      *src,
+			Destination: host,
+			Protocol:    protocol,
+			Port:        uint16(*port),
+			Interface:   *iface,
+			App:         config.AppProtocol(*app),
+			State:       config.CtState(*state),
+			TTL:         uint8(*ttl),
+			Length:      uint16(*length),
+		}
+		conns := []config.PolicyTest{conn}
+		if net.ParseIP(host) == nil {
+			// The name is also the server name inspection sees
+			ips, err := resolver.Resolve(host)
+			if err != nil {
+				return fmt.Errorf("failed to resolve %s: %w", host, err)
+			}
+			conns = conns[:0]
+			for _, ip := range ips {
+				conn.Destination, conn.Domain = ip, host
+				conns = append(conns, conn)
+			}
+		}
+
+		results, err := filter.RunTests(cfg, resolver, conns)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			name := testName(result.Test)
+			if result.Err != nil {
+				fmt.Printf("%s: %v\n", name, result.Err)
+				continue
+			}
+			fmt.Printf("%s: %s (%s)\n", name, result.Verdict, result.Reason)
+		}
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/lint"
+	"github.com/spf13/cobra"
+)
+
+// newLintCmd returns the command checking a config for rules that are
+// likely mistakes, such as rules an earlier rule shadows, failing if any
+// check finds one:
+//
+//	legion-router lint --config config.yaml [--skip allow-all-ports,unused-group]
+func newLintCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check a config for rules that are likely mistakes",
+		Args:  cobra.NoArgs,
+	}
+	fs := cmd.Flags()
+	configPath := fs.String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
+	skip := fs.String("skip", "", "Comma-separated checks to skip: shadowed, deny-after-allow, overlapping-cidrs, allow-all-ports or unused-group")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		skipped, err := lint.ParseChecks(*skip)
+		if err != nil {
+			return err
+		}
+
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		found := 0
+		for _, finding := range lint.Check(cfg, time.Now()) {
+			if skipped[finding.Check] {
+				continue
+			}
+			fmt.Println(finding)
+			found++
+		}
+		switch {
+		case found == 1:
+			return fmt.Errorf("%s: 1 problem found", *configPath)
+		case found > 1:
+			return fmt.Errorf("%s: %d problems found", *configPath, found)
+		}
+		fmt.Printf("%s: no problems found\n", *configPath)
+		return nil
+	}
+	return cmd
+}
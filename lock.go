@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultPIDFile = "/run/legion-router.pid"
+	// handoverSignal asks the running instance to exit leaving its ruleset
+	// in place, for --replace
+	handoverSignal = unix.SIGUSR2
+	// How long --replace waits for the running instance to exit
+	replaceTimeout = 30 * time.Second
+)
+
+// pidFilePath returns the PID file of the instance filtering netns, or the
+// router's own namespace if nil, so that instances for different pods
+// don't lock each other out
+func pidFilePath(netns *os.File) (string, error) {
+	if netns == nil {
+		return defaultPIDFile, nil
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(netns.Fd()), &st); err != nil {
+		return "", fmt.Errorf("failed to identify the target namespace: %w", err)
+	}
+	return fmt.Sprintf("/run/legion-router-netns-%d.pid", st.Ino), nil
+}
+
+// lockInstance locks the PID file at path for the life of the process and
+// writes the process's PID to it, refusing to run while another instance
+// holds it. With replace, the other instance is asked to hand over, leaving
+// its ruleset in place for this one to replace, and the lock is taken once
+// it has exited.
+func lockInstance(path string, replace bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PID file: %w", err)
+	}
+
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		pid := readPID(file)
+		if !replace {
+			file.Close()
+			return nil, fmt.Errorf("another instance (pid %d) is running, see %s; stop it or start with --replace", pid, path)
+		}
+		if err := takeOver(file, pid); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write PID file: %w", err)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write PID file: %w", err)
+	}
+	return file, nil
+}
+
+// takeOver asks the instance holding file's lock to hand over and waits
+// for the lock
+func takeOver(file *os.File, pid int) error {
+	if pid <= 0 {
+		return fmt.Errorf("another instance is running, but its PID is unknown")
+	}
+	if err := unix.Kill(pid, handoverSignal); err != nil {
+		return fmt.Errorf("failed to signal the running instance (pid %d): %w", pid, err)
+	}
+
+	deadline := time.Now().Add(replaceTimeout)
+	for {
+		err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			return fmt.Errorf("failed to lock PID file: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the running instance (pid %d) did not exit within %s", pid, replaceTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readPID returns the PID in a PID file, or 0
+func readPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	return pid
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestLockInstance tests that a second instance is refused while the first
+// holds the PID file
+func TestLockInstance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legion-router.pid")
+
+	first, err := lockInstance(path, false)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected PID %d in the PID file, got %q", os.Getpid(), data)
+	}
+
+	if _, err := lockInstance(path, false); err == nil || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("Expected the second instance to be refused naming the first, got %v", err)
+	}
+
+	first.Close()
+	second, err := lockInstance(path, false)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free once the first instance exits: %v", err)
+	}
+	second.Close()
+}
@@ -1,58 +1,80 @@
 package main
 
 import (
-	"flag"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 
-	"github.com/skaegi/legion-router/pkg/config"
-	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
 )
 
 func main() {
-	configPath := flag.String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
-	flag.Parse()
-
-	// Enable IP forwarding
-	if err := enableIPForwarding(); err != nil {
-		log.Printf("Warning: failed to enable IP forwarding: %v", err)
-		log.Printf("You may need to run: echo 1 > /proc/sys/net/ipv4/ip_forward")
+	root := newRootCmd()
+	root.SetArgs(doubleDashed(root, os.Args[1:]))
+	if cmd, err := root.ExecuteC(); err != nil {
+		log.Fatalf("%s: %v", cmd.CommandPath(), err)
 	}
+}
 
-	// Load configuration
-	cfg, err := config.Load(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+// newRootCmd returns the CLI. Without a command, or with flags only, the
+// daemon runs, as `legion-router -config ...` always has.
+func newRootCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "legion-router",
+		Short:         "Egress firewall for containers and hosts",
+		SilenceErrors: true,
+		SilenceUsage:  true,
 	}
+	daemonFlags(root)
+	root.AddCommand(
+		newAllowTempCmd(),
+		newAnalyzeCmd(),
+		newBansCmd(),
+		newControllerCmd(),
+		newDiffCmd(),
+		newDNSCacheCmd(),
+		newExplainCmd(),
+		newExportCmd(),
+		newImportCmd(),
+		newLintCmd(),
+		newMaintenanceCmd(),
+		newQueryCmd(),
+		newReloadCmd(),
+		newRenderCmd(),
+		newRulesCmd(),
+		newRunCmd(),
+		newStatsCmd(),
+		newTagsCmd(),
+		newTestCmd(),
+		newValidateCmd(),
+		newVersionCmd(),
+	)
+	return root
+}
 
-	log.Printf("Loaded configuration version %s with %d rules", cfg.Version, len(cfg.Rules))
-
-	// Create and start the filter
-	f, err := filter.New(cfg, *configPath)
-	if err != nil {
-		log.Fatalf("Failed to create filter: %v", err)
+// doubleDashed rewrites the single-dash long flags the CLI took before its
+// commands, such as -config, to the double-dash ones of the command args
+// run, so that existing scripts keep working. Arguments that aren't one of
+// the command's flags are left alone.
+func doubleDashed(root *cobra.Command, args []string) []string {
+	// Find takes the value of a single-dash long flag for an argument and
+	// fails, but still returns the command
+	cmd, _, _ := root.Find(args)
+	if cmd == nil {
+		cmd = root
 	}
-
-	if err := f.Start(); err != nil {
-		log.Fatalf("Failed to start filter: %v", err)
+	rewritten := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(rewritten, args[i:]...)
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			name, _, _ := strings.Cut(arg[1:], "=")
+			if len(name) > 1 && (cmd.Flags().Lookup(name) != nil || cmd.InheritedFlags().Lookup(name) != nil) {
+				arg = "-" + arg
+			}
+		}
+		rewritten = append(rewritten, arg)
 	}
-
-	log.Println("Legion Router started successfully")
-
-	// Wait for shutdown signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	log.Println("Shutting down...")
-	if err := f.Stop(); err != nil {
-		log.Printf("Error during shutdown: %v", err)
-	}
-}
-
-// enableIPForwarding enables IP forwarding on Linux
-func enableIPForwarding() error {
-	return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644)
+	return rewritten
 }
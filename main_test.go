@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestDoubleDashed tests that the single-dash long flags of the command
+// run are rewritten, and nothing else
+func TestDoubleDashed(t *testing.T) {
+	testCases := []struct {
+		args string
+		want string
+	}{
+		{args: "-config c.yaml", want: "--config c.yaml"},
+		{args: "-config=c.yaml -oneshot", want: "--config=c.yaml --oneshot"},
+		{args: "validate -config c.yaml", want: "validate --config c.yaml"},
+		{args: "rules enable web -token t", want: "rules enable web --token t"},
+		{args: "test -v --config c.yaml", want: "test -v --config c.yaml"},
+		{args: "allow-temp 10.0.0.1:443 -reason -port", want: "allow-temp 10.0.0.1:443 --reason --port"},
+		{args: "render -unknown", want: "render -unknown"},
+		{args: "explain -- -config", want: "explain -- -config"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.args, func(t *testing.T) {
+			got := strings.Join(doubleDashed(newRootCmd(), strings.Fields(tc.args)), " ")
+			if got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
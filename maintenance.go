@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// newMaintenanceCmd returns the command switching maintenance mode through
+// the admin API:
+//
+//	legion-router maintenance on --duration 2h --reason "..."
+//	legion-router maintenance off
+//	legion-router maintenance status
+func newMaintenanceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Switch a running router in and out of maintenance mode",
+	}
+	client := adminClientFlags(cmd.PersistentFlags())
+
+	on := &cobra.Command{
+		Use:   "on",
+		Short: "Switch maintenance mode on",
+		Args:  cobra.NoArgs,
+	}
+	duration := on.Flags().Duration("duration", time.Hour, "How long maintenance mode stays on")
+	reason := on.Flags().String("reason", "", "Why maintenance mode is needed (required)")
+	onUser := on.Flags().String("user", os.Getenv("USER"), "Name recorded in the audit log")
+	on.MarkFlagRequired("reason")
+	on.RunE = func(cmd *cobra.Command, args []string) error {
+		status, err := client().EnterMaintenance(admin.MaintenanceRequest{
+			Duration:    config.Duration(*duration),
+			Reason:      *reason,
+			RequestedBy: *onUser,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Maintenance mode on until %s\n", status.Until.Format(time.RFC3339))
+		return nil
+	}
+
+	off := &cobra.Command{
+		Use:   "off",
+		Short: "Switch maintenance mode off",
+		Args:  cobra.NoArgs,
+	}
+	offUser := off.Flags().String("user", os.Getenv("USER"), "Name recorded in the audit log")
+	off.RunE = func(cmd *cobra.Command, args []string) error {
+		if err := client().ExitMaintenance(*offUser); err != nil {
+			return err
+		}
+		fmt.Println("Maintenance mode off")
+		return nil
+	}
+
+	status := &cobra.Command{
+		Use:   "status",
+		Short: "Show whether maintenance mode is on",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := client().Maintenance()
+			if err != nil {
+				return err
+			}
+			if status == nil {
+				fmt.Println("Maintenance mode off")
+				return nil
+			}
+			fmt.Printf("Maintenance mode on until %s: %s\n", status.Until.Format(time.RFC3339), status.Reason)
+			return nil
+		},
+	}
+
+	cmd.AddCommand(on, off, status)
+	return cmd
+}
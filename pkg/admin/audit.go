@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent records a runtime change to the policy
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"` // requested, approved, granted, revoked, maintenance-on, maintenance-off, rule-enabled, rule-disabled, tag-enabled, tag-disabled, mapped, unmapped, unbanned
+	ID          string    `json:"id,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Port        uint16    `json:"port,omitempty"`
+	TTL         string    `json:"ttl,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+	ApprovedBy  string    `json:"approved_by,omitempty"`
+	Tag         string    `json:"tag,omitempty"`
+	Rules       []string  `json:"rules,omitempty"`
+	Description string    `json:"description,omitempty"` // Of the rule an event is about
+	Reference   string    `json:"reference,omitempty"`   // Of the rule an event is about
+}
+
+// Auditor logs audit events and appends them to an optional file
+type Auditor struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewAuditor creates an Auditor appending to path, if set
+func NewAuditor(path string) *Auditor {
+	return &Auditor{path: path}
+}
+
+// Record logs an event
+func (a *Auditor) Record(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	target := ""
+	switch {
+	case event.Destination != "":
+		target = fmt.Sprintf(" %s:%d", event.Destination, event.Port)
+	case event.Tag != "":
+		target = fmt.Sprintf(" %s %v", event.Tag, event.Rules)
+	case len(event.Rules) > 0:
+		target = " " + strings.Join(event.Rules, ",")
+	}
+	if event.Reference != "" {
+		target += " (" + event.Reference + ")"
+	}
+	log.Printf("Audit: %s%s by %q (approved by %q): %s",
+		event.Action, target, event.RequestedBy, event.ApprovedBy, event.Reason)
+
+	if a.path == "" {
+		return
+	}
+	if err := a.append(event); err != nil {
+		log.Printf("Warning: failed to write audit log %s: %v", a.path, err)
+	}
+}
+
+func (a *Auditor) append(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,223 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// roleRanks orders the roles; each may do what lower ranks may
+var roleRanks = map[string]int{
+	config.AdminRoleViewer:   1,
+	config.AdminRoleOperator: 2,
+	config.AdminRoleAdmin:    3,
+}
+
+// Identity is who made a request and the role they have
+type Identity struct {
+	// Name of the user, "" for the shared token or without authentication
+	Name string `json:"name,omitempty"`
+	Role string `json:"role"`
+}
+
+type identityKey struct{}
+
+// identityOf returns the identity authenticate attached to r
+func identityOf(r *http.Request) Identity {
+	if id, ok := r.Context().Value(identityKey{}).(Identity); ok {
+		return id
+	}
+	return Identity{Role: config.AdminRoleAdmin}
+}
+
+// requester returns who a change is recorded as made by: the authenticated
+// user, or else the name the request claims
+func requester(r *http.Request, claimed string) string {
+	if name := identityOf(r).Name; name != "" {
+		return name
+	}
+	return claimed
+}
+
+// requireJSON rejects changes not declared as JSON. Browsers send forms
+// and plain text to any origin, while JSON needs a CORS preflight the API
+// never grants, so another site can't make changes through a browser that
+// reaches the API.
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%s %s needs Content-Type application/json", r.Method, r.URL.Path))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requiresAuth reports whether the API authenticates requests; without a
+// token or users anyone reaching it is an admin
+func (s *Server) requiresAuth() bool {
+	return s.config.Token != "" || len(s.config.Users) > 0
+}
+
+// authenticate identifies the caller by bearer token or client certificate
+// and requires the role the request needs
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if !s.requiresAuth() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := s.identify(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+			return
+		}
+		if need := requiredRole(r); roleRanks[id.Role] < roleRanks[need] {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s %s needs the %s role", r.Method, r.URL.Path, need))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// identify returns the identity of the bearer token or verified client
+// certificate of r
+func (s *Server) identify(r *http.Request) (Identity, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		if s.config.Token != "" && subtle.ConstantTimeCompare(token, []byte(s.config.Token)) == 1 {
+			return Identity{Role: config.AdminRoleAdmin}, true
+		}
+		for _, user := range s.config.Users {
+			if user.Token != "" && subtle.ConstantTimeCompare(token, []byte(user.Token)) == 1 {
+				return Identity{Name: user.Name, Role: user.Role}, true
+			}
+		}
+		return Identity{}, false
+	}
+
+	// Only certificates the TLS handshake verified against the client CA
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, user := range s.config.Users {
+		if user.ClientCert != "" && certificateNames(cert)[user.ClientCert] {
+			return Identity{Name: user.Name, Role: user.Role}, true
+		}
+	}
+	return Identity{}, false
+}
+
+// certificateNames returns the common name and SANs of a client certificate
+func certificateNames(cert *x509.Certificate) map[string]bool {
+	names := map[string]bool{}
+	if cert.Subject.CommonName != "" {
+		names[cert.Subject.CommonName] = true
+	}
+	for _, name := range cert.DNSNames {
+		names[name] = true
+	}
+	for _, email := range cert.EmailAddresses {
+		names[email] = true
+	}
+	for _, uri := range cert.URIs {
+		names[uri.String()] = true
+	}
+	return names
+}
+
+// requiredRole returns the role a request needs: reading needs a viewer,
+// grants and unbanning an operator and changing the policy an admin
+func requiredRole(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return config.AdminRoleViewer
+	case strings.HasPrefix(r.URL.Path, "/v1/grafana"):
+		// The datasource queries by POST
+		return config.AdminRoleViewer
+	case strings.HasPrefix(r.URL.Path, "/v1/grants"), r.URL.Path == "/v1/bans":
+		return config.AdminRoleOperator
+	default:
+		return config.AdminRoleAdmin
+	}
+}
+
+// handleWhoami returns the identity of the caller
+func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, identityOf(r))
+}
+
+// serverTLS returns the TLS settings of the API, verifying the client
+// certificates presented, if a client CA is configured, while still
+// accepting clients with tokens and none
+func serverTLS(cfg *config.AdminTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin API certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// ClientTLS returns the TLS settings of a client of an HTTPS admin API,
+// verifying it with caFile, if set, and presenting a client certificate,
+// if set
+func ClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads PEM certificates from path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in CA file %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleBans lists the banned sources, or lifts the ban of the source query
+// parameter on DELETE
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		bans, err := s.backend.Bans()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, bans)
+
+	case http.MethodDelete:
+		source := r.URL.Query().Get("source")
+		if err := s.backend.Unban(source); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		s.audit.Record(AuditEvent{
+			Action:      "unbanned",
+			Source:      source,
+			RequestedBy: requester(r, r.URL.Query().Get("by")),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
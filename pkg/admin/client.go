@@ -0,0 +1,378 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// DefaultURL is the admin API address used by the CLI
+const DefaultURL = "http://127.0.0.1:9090"
+
+// Client calls the admin API
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+	// err is why the client cannot make requests, returned by each
+	err error
+}
+
+// NewClient creates a client for the admin API at baseURL
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(baseURL, "/"),
+		token: token,
+		http:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// UseTLS verifies an HTTPS admin API with the CA certificates in caFile,
+// or the system's if unset, and presents the client certificate in
+// certFile and keyFile, if set. Requests fail if the files cannot be loaded.
+func (c *Client) UseTLS(certFile, keyFile, caFile string) {
+	tlsConfig, err := ClientTLS(certFile, keyFile, caFile)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.http.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+}
+
+// RequestGrant requests a temporary grant; the grant is returned if it was
+// applied, or the pending request if it awaits approval
+func (c *Client) RequestGrant(req GrantRequest) (*filter.Grant, *PendingGrant, error) {
+	resp, err := c.do(http.MethodPost, "/v1/grants", req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		var pending PendingGrant
+		if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		return nil, &pending, nil
+	}
+	var grant filter.Grant
+	if err := json.NewDecoder(resp.Body).Decode(&grant); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &grant, nil, nil
+}
+
+// Approve approves a pending grant request; the client must authenticate
+// as an approver
+func (c *Client) Approve(id string) (*filter.Grant, error) {
+	resp, err := c.do(http.MethodPost, "/v1/grants/approve?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var grant filter.Grant
+	if err := json.NewDecoder(resp.Body).Decode(&grant); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &grant, nil
+}
+
+// EnterMaintenance switches the router to its maintenance policy
+func (c *Client) EnterMaintenance(req MaintenanceRequest) (*filter.MaintenanceStatus, error) {
+	resp, err := c.do(http.MethodPost, "/v1/maintenance", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status filter.MaintenanceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// ExitMaintenance restores the normal policy; by is recorded in the audit log
+func (c *Client) ExitMaintenance(by string) error {
+	resp, err := c.do(http.MethodDelete, "/v1/maintenance?by="+url.QueryEscape(by), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Maintenance returns the active maintenance window, or nil
+func (c *Client) Maintenance() (*filter.MaintenanceStatus, error) {
+	resp, err := c.do(http.MethodGet, "/v1/maintenance", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status *filter.MaintenanceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return status, nil
+}
+
+// Status returns the policy status of the router
+func (c *Client) Status() (*filter.Status, error) {
+	resp, err := c.do(http.MethodGet, "/v1/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status filter.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// Rules lists the rules of the applied policy query selects
+func (c *Client) Rules(query filter.RuleQuery) (*filter.RulePage, error) {
+	params := url.Values{}
+	if query.Action != "" {
+		params.Set("action", string(query.Action))
+	}
+	if query.Destination != nil {
+		params.Set("destination", query.Destination.String())
+	}
+	if query.Domain != "" {
+		params.Set("domain", query.Domain)
+	}
+	if query.Tag != "" {
+		params.Set("tag", query.Tag)
+	}
+	if query.Offset > 0 {
+		params.Set("offset", strconv.Itoa(query.Offset))
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+	if query.Hits {
+		params.Set("hits", "true")
+	}
+	resp, err := c.do(http.MethodGet, "/v1/rules?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var page filter.RulePage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &page, nil
+}
+
+// ExpandRule returns a rule of the applied policy as programmed
+func (c *Client) ExpandRule(name string) (*filter.ExpandedRule, error) {
+	resp, err := c.do(http.MethodGet, "/v1/rules/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rule filter.ExpandedRule
+	if err := json.NewDecoder(resp.Body).Decode(&rule); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &rule, nil
+}
+
+// SetRuleEnabled enables or disables a rule of the applied policy and
+// returns it as programmed; by is recorded in the audit log
+func (c *Client) SetRuleEnabled(name string, enabled bool, by string) (*filter.ExpandedRule, error) {
+	op := "disable"
+	if enabled {
+		op = "enable"
+	}
+	resp, err := c.do(http.MethodPost, "/v1/rules/"+url.PathEscape(name)+"/"+op+"?by="+url.QueryEscape(by), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rule filter.ExpandedRule
+	if err := json.NewDecoder(resp.Body).Decode(&rule); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &rule, nil
+}
+
+// Tags lists the tags of the applied policy with their rules and hits
+func (c *Client) Tags() ([]filter.TagStatus, error) {
+	resp, err := c.do(http.MethodGet, "/v1/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tags []filter.TagStatus
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return tags, nil
+}
+
+// DNSCache returns the domains in the DNS cache of the router
+func (c *Client) DNSCache() (*filter.DNSCache, error) {
+	resp, err := c.do(http.MethodGet, "/v1/dns/cache", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var cache filter.DNSCache
+	if err := json.NewDecoder(resp.Body).Decode(&cache); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &cache, nil
+}
+
+// Bans returns the sources the router banned, the soonest to expire first
+func (c *Client) Bans() ([]filter.Ban, error) {
+	resp, err := c.do(http.MethodGet, "/v1/bans", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var bans []filter.Ban
+	if err := json.NewDecoder(resp.Body).Decode(&bans); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return bans, nil
+}
+
+// Unban lifts the ban of source; by is recorded in the audit log
+func (c *Client) Unban(source, by string) error {
+	resp, err := c.do(http.MethodDelete, "/v1/bans?source="+url.QueryEscape(source)+"&by="+url.QueryEscape(by), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SetTagEnabled enables or disables the rules carrying tag; by is recorded
+// in the audit log
+func (c *Client) SetTagEnabled(tag string, enabled bool, by string) (*TagChange, error) {
+	op := "disable"
+	if enabled {
+		op = "enable"
+	}
+	resp, err := c.do(http.MethodPost, "/v1/tags/"+url.PathEscape(tag)+"/"+op+"?by="+url.QueryEscape(by), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var change TagChange
+	if err := json.NewDecoder(resp.Body).Decode(&change); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &change, nil
+}
+
+// Events returns the stored events query selects, oldest first
+func (c *Client) Events(query events.Query) ([]events.Event, error) {
+	params := url.Values{}
+	if !query.Since.IsZero() {
+		params.Set("since", query.Since.Format(time.RFC3339Nano))
+	}
+	if !query.Until.IsZero() {
+		params.Set("until", query.Until.Format(time.RFC3339Nano))
+	}
+	if len(query.Types) > 0 {
+		params.Set("type", strings.Join(query.Types, ","))
+	}
+	if query.Rule != "" {
+		params.Set("rule", query.Rule)
+	}
+	if query.Source != nil {
+		params.Set("source", query.Source.String())
+	}
+	if query.Destination != nil {
+		params.Set("destination", query.Destination.String())
+	}
+	if query.Port != 0 {
+		params.Set("port", strconv.Itoa(int(query.Port)))
+	}
+	if query.Domain != "" {
+		params.Set("domain", query.Domain)
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+	resp, err := c.do(http.MethodGet, "/v1/events?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var found []events.Event
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return found, nil
+}
+
+// do sends a request with an optional JSON body and returns the response if
+// it succeeded
+func (c *Client) do(method, path string, body interface{}) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	// The API takes changes only as JSON, even those without a body
+	if body != nil || method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach admin API: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return nil, fmt.Errorf("admin API returned %s", resp.Status)
+		}
+		return nil, fmt.Errorf("admin API returned %s: %s", resp.Status, apiErr.Error)
+	}
+	return resp, nil
+}
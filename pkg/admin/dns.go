@@ -0,0 +1,61 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/skaegi/legion-router/pkg/dnsproxy"
+)
+
+// maxTopDomains bounds the domains per client a request can ask for
+const maxTopDomains = 1000
+
+// handleDNSStats returns the DNS queries of each client, or of the client
+// query parameter, with their top most queried and blocked domains, top of
+// each
+func (s *Server) handleDNSStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	params := r.URL.Query()
+	var client net.IP
+	if v := params.Get("client"); v != "" {
+		if client = net.ParseIP(v); client == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid client %q", v))
+			return
+		}
+	}
+	top := dnsproxy.DefaultTop
+	if v := params.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopDomains {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid top %q: between 1 and %d is required", v, maxTopDomains))
+			return
+		}
+		top = n
+	}
+
+	stats, err := s.backend.DNSStats(client, top)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleDNSCache returns the domains in the DNS cache with their addresses
+func (s *Server) handleDNSCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	cache, err := s.backend.DNSCache()
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cache)
+}
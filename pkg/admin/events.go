@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/events"
+)
+
+const (
+	// Events returned unless the request sets limit
+	defaultEventLimit = 100
+	maxEventLimit     = 10000
+)
+
+// handleEvents returns the stored events selected by the since, until,
+// type, rule, source, destination, port and domain query parameters, the
+// latest limit of them
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	query, err := parseEventQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	found, err := s.backend.Events(query)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// parseEventQuery reads an event query from the query parameters of r
+func parseEventQuery(r *http.Request) (events.Query, error) {
+	params := r.URL.Query()
+	query := events.Query{
+		Rule:   params.Get("rule"),
+		Domain: params.Get("domain"),
+		Limit:  defaultEventLimit,
+	}
+
+	var err error
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if v := params.Get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return query, fmt.Errorf("invalid %s %q: an RFC 3339 time is required", name, v)
+			}
+		}
+	}
+	if v := params.Get("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			switch t {
+			case events.TypeAllow, events.TypeDeny, events.TypeReload, events.TypeHoneypot:
+			default:
+				return query, fmt.Errorf("invalid type %q", t)
+			}
+			query.Types = append(query.Types, t)
+		}
+	}
+	if v := params.Get("source"); v != "" {
+		if query.Source, err = events.ParseNetwork(v); err != nil {
+			return query, fmt.Errorf("invalid source: %w", err)
+		}
+	}
+	if v := params.Get("destination"); v != "" {
+		if query.Destination, err = events.ParseNetwork(v); err != nil {
+			return query, fmt.Errorf("invalid destination: %w", err)
+		}
+	}
+	if v := params.Get("port"); v != "" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || port == 0 {
+			return query, fmt.Errorf("invalid port %q", v)
+		}
+		query.Port = uint16(port)
+	}
+	if v := params.Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit < 1 || query.Limit > maxEventLimit {
+			return query, fmt.Errorf("invalid limit %q: between 1 and %d is required", v, maxEventLimit)
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,127 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/metrics"
+)
+
+// The sampled counters are served under /v1/grafana/ in the protocol of the
+// Grafana JSON datasource: the root answers the connection test, search and
+// metrics list the series, and query returns their datapoints
+
+// grafanaQuery is the body of a query request
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+		Hide   bool   `json:"hide"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is a series of a query response, with datapoints of
+// [value, milliseconds since the epoch]
+type grafanaSeries struct {
+	Target     string      `json:"target"`
+	Datapoints [][2]uint64 `json:"datapoints"`
+}
+
+// grafanaMetric is a series listed for the query editor
+type grafanaMetric struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// handleGrafana serves the Grafana JSON datasource endpoints
+func (s *Server) handleGrafana(w http.ResponseWriter, r *http.Request) {
+	recorder := s.backend.Metrics()
+	if recorder == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no metrics are sampled; set metrics in the config"))
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/v1/grafana") {
+	case "", "/":
+		w.WriteHeader(http.StatusOK)
+
+	case "/search":
+		var req struct {
+			Target string `json:"target"`
+		}
+		if !decodeGrafanaRequest(w, r, &req) {
+			return
+		}
+		names := []string{}
+		for _, name := range recorder.Names() {
+			if strings.Contains(name, req.Target) {
+				names = append(names, name)
+			}
+		}
+		writeJSON(w, http.StatusOK, names)
+
+	case "/metrics":
+		var req struct {
+			Metric string `json:"metric"`
+		}
+		if !decodeGrafanaRequest(w, r, &req) {
+			return
+		}
+		list := []grafanaMetric{}
+		for _, name := range recorder.Names() {
+			if strings.Contains(name, req.Metric) {
+				list = append(list, grafanaMetric{Label: name, Value: name})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case "/query":
+		var req grafanaQuery
+		if !decodeGrafanaRequest(w, r, &req) {
+			return
+		}
+		writeJSON(w, http.StatusOK, queryRecorder(recorder, req))
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %s", r.URL.Path))
+	}
+}
+
+// decodeGrafanaRequest decodes the JSON body of a POST, writing an error
+// response and returning false if it can't
+func decodeGrafanaRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+	return true
+}
+
+// queryRecorder returns the datapoints of the targets of req
+func queryRecorder(recorder *metrics.Recorder, req grafanaQuery) []grafanaSeries {
+	step := time.Duration(req.IntervalMs) * time.Millisecond
+	series := []grafanaSeries{}
+	for _, target := range req.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		result := grafanaSeries{Target: target.Target, Datapoints: [][2]uint64{}}
+		for _, p := range recorder.Query(target.Target, req.Range.From, req.Range.To, step) {
+			result.Datapoints = append(result.Datapoints, [2]uint64{p.Value, uint64(p.Time.UnixMilli())})
+		}
+		series = append(series, result)
+	}
+	return series
+}
@@ -0,0 +1,234 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const defaultApprovalTimeout = time.Hour
+
+// GrantRequest is the body of a grant request
+type GrantRequest struct {
+	Destination string          `json:"destination"`
+	Port        uint16          `json:"port"`
+	TTL         config.Duration `json:"ttl"`
+	Reason      string          `json:"reason"`
+	RequestedBy string          `json:"requested_by,omitempty"`
+}
+
+// PendingGrant is a grant request awaiting approval
+type PendingGrant struct {
+	ID        string       `json:"id"`
+	Request   GrantRequest `json:"request"`
+	Requested time.Time    `json:"requested"`
+}
+
+func (s *Server) handleGrants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.backend.Grants())
+
+	case http.MethodPost:
+		var req GrantRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("a reason is required"))
+			return
+		}
+		req.RequestedBy = requester(r, req.RequestedBy)
+
+		if s.config.Approval != nil {
+			// The approver must be someone else, which only an
+			// authenticated requester can be checked against
+			if identityOf(r).Name == "" {
+				writeError(w, http.StatusForbidden, fmt.Errorf("grants needing approval must be requested by a named user"))
+				return
+			}
+			pending, err := s.addPending(req)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, pending)
+			return
+		}
+
+		grant, err := s.backend.Grant(req.Destination, req.Port, req.TTL.Std(), req.Reason)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.audit.Record(AuditEvent{
+			Action:      "granted",
+			Destination: grant.Destination,
+			Port:        grant.Port,
+			TTL:         req.TTL.String(),
+			Reason:      req.Reason,
+			RequestedBy: req.RequestedBy,
+		})
+		writeJSON(w, http.StatusCreated, grant)
+
+	case http.MethodDelete:
+		destination := r.URL.Query().Get("destination")
+		port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port: %w", err))
+			return
+		}
+		if err := s.backend.Revoke(destination, uint16(port)); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		s.audit.Record(AuditEvent{
+			Action:      "revoked",
+			Destination: destination,
+			Port:        uint16(port),
+			RequestedBy: requester(r, r.URL.Query().Get("by")),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handlePending lists grant requests awaiting approval
+func (s *Server) handlePending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	s.mu.Lock()
+	s.prunePendingLocked()
+	pending := make([]*PendingGrant, 0, len(s.pending))
+	for _, p := range s.pending {
+		pending = append(pending, p)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Requested.Before(pending[j].Requested)
+	})
+	writeJSON(w, http.StatusOK, pending)
+}
+
+// handleApprove applies a pending grant request; the caller must be a user
+// marked as an approver and not the user who requested it
+func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if s.config.Approval == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("approval is not enabled"))
+		return
+	}
+
+	approver := identityOf(r).Name
+	if !s.isApprover(approver) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("grants can only be approved by approvers"))
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	s.mu.Lock()
+	s.prunePendingLocked()
+	pending, ok := s.pending[id]
+	if ok && pending.Request.RequestedBy == approver {
+		s.mu.Unlock()
+		writeError(w, http.StatusForbidden, fmt.Errorf("requests cannot be approved by their requester"))
+		return
+	}
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pending request %s", id))
+		return
+	}
+
+	req := pending.Request
+	grant, err := s.backend.Grant(req.Destination, req.Port, req.TTL.Std(), req.Reason)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.audit.Record(AuditEvent{
+		Action:      "approved",
+		ID:          id,
+		Destination: grant.Destination,
+		Port:        grant.Port,
+		TTL:         req.TTL.String(),
+		Reason:      req.Reason,
+		RequestedBy: req.RequestedBy,
+		ApprovedBy:  approver,
+	})
+	writeJSON(w, http.StatusCreated, grant)
+}
+
+// addPending queues a grant request for approval
+func (s *Server) addPending(req GrantRequest) (*PendingGrant, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate request id: %w", err)
+	}
+	pending := &PendingGrant{
+		ID:        hex.EncodeToString(id[:]),
+		Request:   req,
+		Requested: time.Now(),
+	}
+
+	s.mu.Lock()
+	s.prunePendingLocked()
+	s.pending[pending.ID] = pending
+	s.mu.Unlock()
+
+	s.audit.Record(AuditEvent{
+		Action:      "requested",
+		ID:          pending.ID,
+		Destination: req.Destination,
+		Port:        req.Port,
+		TTL:         req.TTL.String(),
+		Reason:      req.Reason,
+		RequestedBy: req.RequestedBy,
+	})
+	return pending, nil
+}
+
+// isApprover reports whether name is a user allowed to approve grants
+func (s *Server) isApprover(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, user := range s.config.Users {
+		if user.Name == name && user.Approver {
+			return true
+		}
+	}
+	return false
+}
+
+// prunePendingLocked discards requests that were not approved in time
+// Must be called with mu held
+func (s *Server) prunePendingLocked() {
+	timeout := defaultApprovalTimeout
+	if s.config.Approval != nil && s.config.Approval.Timeout > 0 {
+		timeout = s.config.Approval.Timeout.Std()
+	}
+	for id, p := range s.pending {
+		if time.Since(p.Requested) > timeout {
+			delete(s.pending, id)
+		}
+	}
+}
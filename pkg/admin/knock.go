@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const defaultKnockWindow = 10 * time.Second
+
+// Knocker opens a predefined grant for sources that send UDP datagrams to
+// a sequence of ports in order, from those sources only
+type Knocker struct {
+	config  *config.KnockConfig
+	backend Backend
+	audit   *Auditor
+	window  time.Duration
+
+	mu       sync.Mutex
+	progress map[string]*knockProgress // Source address -> progress
+	conns    []*net.UDPConn
+}
+
+// knockProgress tracks how far a source got through the sequence
+type knockProgress struct {
+	next    int // Index of the next expected port
+	started time.Time
+}
+
+// NewKnocker creates a knock listener for cfg recording grants to audit
+func NewKnocker(cfg *config.KnockConfig, backend Backend, audit *Auditor) *Knocker {
+	window := cfg.Window.Std()
+	if window == 0 {
+		window = defaultKnockWindow
+	}
+	return &Knocker{
+		config:   cfg,
+		backend:  backend,
+		audit:    audit,
+		window:   window,
+		progress: make(map[string]*knockProgress),
+	}
+}
+
+// Start listens on every port of the sequence at the listen addresses
+func (k *Knocker) Start() error {
+	for _, addr := range k.config.Listen {
+		for _, port := range k.config.Sequence {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(addr), Port: int(port)})
+			if err != nil {
+				k.Stop()
+				return fmt.Errorf("failed to listen for knocks on %s: %w", net.JoinHostPort(addr, strconv.Itoa(int(port))), err)
+			}
+			k.conns = append(k.conns, conn)
+			go k.receive(conn, port)
+		}
+	}
+	log.Printf("Listening for knock sequence on %d ports of %s", len(k.config.Sequence), strings.Join(k.config.Listen, ", "))
+	return nil
+}
+
+// Stop closes the listeners
+func (k *Knocker) Stop() {
+	for _, conn := range k.conns {
+		conn.Close()
+	}
+	k.conns = nil
+}
+
+// receive handles knocks arriving on port until conn is closed
+func (k *Knocker) receive(conn *net.UDPConn, port uint16) {
+	buf := make([]byte, 64)
+	for {
+		_, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		source := addr.IP.String()
+		if !k.observe(source, port, time.Now()) {
+			continue
+		}
+
+		target := net.JoinHostPort(k.config.Destination, strconv.Itoa(int(k.config.Port)))
+		reason := fmt.Sprintf("knock sequence from %s", source)
+		if _, err := k.backend.GrantFrom(source, k.config.Destination, k.config.Port, k.config.TTL.Std(), reason); err != nil {
+			log.Printf("Failed to open %s for knock from %s: %v", target, source, err)
+			continue
+		}
+		k.audit.Record(AuditEvent{
+			Action:      "granted",
+			Destination: k.config.Destination,
+			Port:        k.config.Port,
+			TTL:         k.config.TTL.String(),
+			Reason:      reason,
+			RequestedBy: source,
+		})
+	}
+}
+
+// observe records a knock and reports whether it completed the sequence
+func (k *Knocker) observe(source string, port uint16, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for addr, p := range k.progress {
+		if now.Sub(p.started) > k.window {
+			delete(k.progress, addr)
+		}
+	}
+
+	sequence := k.config.Sequence
+	p, ok := k.progress[source]
+	switch {
+	case ok && sequence[p.next] == port:
+		p.next++
+	case port == sequence[0]:
+		// Knocking the first port (re)starts the sequence
+		p = &knockProgress{next: 1, started: now}
+		k.progress[source] = p
+	default:
+		delete(k.progress, source)
+		return false
+	}
+
+	if p.next < len(sequence) {
+		return false
+	}
+	delete(k.progress, source)
+	return true
+}
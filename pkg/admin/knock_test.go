@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// TestKnockSequence tests that only complete, in-order sequences within the
+// window open the grant
+func TestKnockSequence(t *testing.T) {
+	type knock struct {
+		source string
+		port   uint16
+		after  time.Duration // Since the first knock
+	}
+
+	testCases := []struct {
+		name   string
+		knocks []knock
+		want   bool // Whether the last knock completes the sequence
+	}{
+		{
+			name:   "in order",
+			knocks: []knock{{"10.0.0.5", 7000, 0}, {"10.0.0.5", 8000, time.Second}, {"10.0.0.5", 9000, 2 * time.Second}},
+			want:   true,
+		},
+		{
+			name:   "out of order",
+			knocks: []knock{{"10.0.0.5", 7000, 0}, {"10.0.0.5", 9000, time.Second}, {"10.0.0.5", 8000, 2 * time.Second}},
+			want:   false,
+		},
+		{
+			name:   "restarted",
+			knocks: []knock{{"10.0.0.5", 7000, 0}, {"10.0.0.5", 7000, time.Second}, {"10.0.0.5", 8000, 2 * time.Second}, {"10.0.0.5", 9000, 3 * time.Second}},
+			want:   true,
+		},
+		{
+			name:   "different sources",
+			knocks: []knock{{"10.0.0.5", 7000, 0}, {"10.0.0.6", 8000, time.Second}, {"10.0.0.5", 9000, 2 * time.Second}},
+			want:   false,
+		},
+		{
+			name:   "too slow",
+			knocks: []knock{{"10.0.0.5", 7000, 0}, {"10.0.0.5", 8000, 5 * time.Second}, {"10.0.0.5", 9000, 11 * time.Second}},
+			want:   false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			k := NewKnocker(&config.KnockConfig{
+				Sequence:    []uint16{7000, 8000, 9000},
+				Destination: "203.0.113.10",
+				Port:        22,
+				TTL:         config.Duration(time.Minute),
+			}, &fakeBackend{}, NewAuditor(""))
+
+			start := time.Now()
+			var got bool
+			for _, kn := range tc.knocks {
+				got = k.observe(kn.source, kn.port, start.Add(kn.after))
+			}
+			if got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// knockBackend reports the grants a knocker opens
+type knockBackend struct {
+	fakeBackend
+	granted chan filter.Grant
+}
+
+func (b *knockBackend) GrantFrom(source, destination string, port uint16, ttl time.Duration, reason string) (filter.Grant, error) {
+	grant := filter.Grant{Source: source, Destination: destination, Port: port, Expires: time.Now().Add(ttl), Reason: reason}
+	b.granted <- grant
+	return grant, nil
+}
+
+// TestKnockListener tests that knocks are only heard on the listen
+// addresses and open the grant from the knocking source alone
+func TestKnockListener(t *testing.T) {
+	// Free ports for the sequence
+	var sequence []uint16
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatalf("Failed to find a free port: %v", err)
+		}
+		sequence = append(sequence, uint16(conn.LocalAddr().(*net.UDPAddr).Port))
+		conn.Close()
+	}
+
+	backend := &knockBackend{granted: make(chan filter.Grant, 1)}
+	k := NewKnocker(&config.KnockConfig{
+		Listen:      []string{"127.0.0.1"},
+		Sequence:    sequence,
+		Destination: "203.0.113.10",
+		Port:        22,
+		TTL:         config.Duration(time.Minute),
+	}, backend, NewAuditor(""))
+	if err := k.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	defer k.Stop()
+
+	knock := func(source, target string) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(source)})
+		if err != nil {
+			t.Fatalf("Failed to open knocking socket: %v", err)
+		}
+		defer conn.Close()
+		for _, port := range sequence {
+			if _, err := conn.WriteToUDP([]byte("knock"), &net.UDPAddr{IP: net.ParseIP(target), Port: int(port)}); err != nil {
+				t.Fatalf("Failed to knock: %v", err)
+			}
+			// The ports are read concurrently
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// Another address of the host isn't listened on
+	knock("127.0.0.3", "127.0.0.2")
+	select {
+	case grant := <-backend.granted:
+		t.Fatalf("Expected no grant for a knock on another address, got %+v", grant)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	knock("127.0.0.3", "127.0.0.1")
+	select {
+	case grant := <-backend.granted:
+		if grant.Source != "127.0.0.3" || grant.Destination != "203.0.113.10" || grant.Port != 22 {
+			t.Errorf("Expected a grant from 127.0.0.3 only, got %+v", grant)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a grant for the knock sequence")
+	}
+}
@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+const (
+	// Rules listed per page unless the request sets limit
+	defaultRuleLimit = 100
+	maxRuleLimit     = 1000
+)
+
+// handleRules lists the rules of the applied policy, filtered by the action,
+// destination, domain and tag query parameters and paged by offset and
+// limit, with their hits if hits is true
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	query, err := parseRuleQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.backend.Rules(query))
+}
+
+// handleRule returns a rule of the applied policy as programmed, with the
+// addresses in its sets and its kernel rules, or enables or disables it on
+// POST to /v1/rules/<name>/enable or /v1/rules/<name>/disable
+func (s *Server) handleRule(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/rules/")
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("a rule name is required"))
+			return
+		}
+		rule, err := s.backend.ExpandRule(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+
+	case http.MethodPost:
+		var op string
+		if i := strings.LastIndex(name, "/"); i > 0 {
+			name, op = name[:i], name[i+1:]
+		}
+		if op != "enable" && op != "disable" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("POST /v1/rules/<name>/enable or /v1/rules/<name>/disable is required"))
+			return
+		}
+		if err := s.backend.SetRuleEnabled(name, op == "enable"); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		rule, err := s.backend.ExpandRule(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		s.audit.Record(AuditEvent{
+			Action:      "rule-" + op + "d",
+			Rules:       []string{name},
+			Description: rule.Rule.Description,
+			Reference:   rule.Rule.Reference,
+			RequestedBy: requester(r, r.URL.Query().Get("by")),
+		})
+		writeJSON(w, http.StatusOK, rule)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// parseRuleQuery reads a rule query from the query parameters of r
+func parseRuleQuery(r *http.Request) (filter.RuleQuery, error) {
+	params := r.URL.Query()
+	query := filter.RuleQuery{
+		Action: config.Action(params.Get("action")),
+		Domain: params.Get("domain"),
+		Tag:    params.Get("tag"),
+		Hits:   params.Get("hits") == "true",
+		Limit:  defaultRuleLimit,
+	}
+	switch query.Action {
+	case "", config.ActionAllow, config.ActionDeny:
+	default:
+		return query, fmt.Errorf("invalid action %q", query.Action)
+	}
+	if dst := params.Get("destination"); dst != "" {
+		if query.Destination = net.ParseIP(dst); query.Destination == nil {
+			return query, fmt.Errorf("invalid destination %q: an address is required", dst)
+		}
+	}
+
+	var err error
+	if v := params.Get("offset"); v != "" {
+		if query.Offset, err = strconv.Atoi(v); err != nil || query.Offset < 0 {
+			return query, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit < 1 || query.Limit > maxRuleLimit {
+			return query, fmt.Errorf("invalid limit %q: between 1 and %d is required", v, maxRuleLimit)
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,219 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dnsproxy"
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/skaegi/legion-router/pkg/metrics"
+)
+
+// Backend is the filter state operated on by the admin API
+type Backend interface {
+	Status() filter.Status
+	Grant(destination string, port uint16, ttl time.Duration, reason string) (filter.Grant, error)
+	GrantFrom(source, destination string, port uint16, ttl time.Duration, reason string) (filter.Grant, error)
+	Revoke(destination string, port uint16) error
+	Grants() []filter.Grant
+	EnterMaintenance(duration time.Duration, reason string) (filter.MaintenanceStatus, error)
+	ExitMaintenance() error
+	Rules(query filter.RuleQuery) filter.RulePage
+	ExpandRule(name string) (filter.ExpandedRule, error)
+	SetRuleEnabled(name string, enabled bool) error
+	Tags() ([]filter.TagStatus, error)
+	SetTagEnabled(tag string, enabled bool) ([]string, error)
+	Events(query events.Query) ([]events.Event, error)
+	Metrics() *metrics.Recorder
+	DNSStats(client net.IP, top int) ([]dnsproxy.ClientStats, error)
+	DNSCache() (*filter.DNSCache, error)
+	Bans() ([]filter.Ban, error)
+	Unban(source string) error
+}
+
+// Server serves the admin API
+type Server struct {
+	config  *config.AdminConfig
+	backend Backend
+	http    *http.Server
+	knocker *Knocker
+	audit   *Auditor
+
+	mu      sync.Mutex
+	pending map[string]*PendingGrant // Grant requests awaiting approval by ID
+}
+
+// NewServer creates an admin API server for backend
+func NewServer(cfg *config.AdminConfig, backend Backend) *Server {
+	s := &Server{
+		config:  cfg,
+		backend: backend,
+		audit:   NewAuditor(cfg.AuditLog),
+		pending: make(map[string]*PendingGrant),
+	}
+	s.http = &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if cfg.Knock != nil {
+		s.knocker = NewKnocker(cfg.Knock, backend, s.audit)
+	}
+	return s
+}
+
+// Handler returns the HTTP handler of the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", s.handleStatus)
+	mux.HandleFunc("/v1/grants", s.handleGrants)
+	mux.HandleFunc("/v1/grants/pending", s.handlePending)
+	mux.HandleFunc("/v1/grants/approve", s.handleApprove)
+	mux.HandleFunc("/v1/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/v1/rules", s.handleRules)
+	mux.HandleFunc("/v1/rules/", s.handleRule)
+	mux.HandleFunc("/v1/tags", s.handleTags)
+	mux.HandleFunc("/v1/tags/", s.handleTag)
+	mux.HandleFunc("/v1/events", s.handleEvents)
+	mux.HandleFunc("/v1/dns/stats", s.handleDNSStats)
+	mux.HandleFunc("/v1/dns/cache", s.handleDNSCache)
+	mux.HandleFunc("/v1/bans", s.handleBans)
+	mux.HandleFunc("/v1/grafana", s.handleGrafana)
+	mux.HandleFunc("/v1/grafana/", s.handleGrafana)
+	mux.HandleFunc("/v1/whoami", s.handleWhoami)
+	api := s.authenticate(requireJSON(mux))
+	if !s.config.UI {
+		return api
+	}
+
+	root := http.NewServeMux()
+	root.Handle("/", api)
+	ui := s.uiHandler()
+	root.Handle("/ui", ui)
+	root.Handle("/ui/", ui)
+	return root
+}
+
+// Start listens on the configured address and serves in the background
+func (s *Server) Start() error {
+	var tlsConfig *tls.Config
+	if s.config.TLS != nil {
+		var err error
+		if tlsConfig, err = serverTLS(s.config.TLS); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Listen, err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	go func() {
+		if err := s.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Warning: admin API stopped: %v", err)
+		}
+	}()
+	log.Printf("Admin API listening on %s", listener.Addr())
+
+	if s.knocker != nil {
+		if err := s.knocker.Start(); err != nil {
+			s.http.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop shuts the server down
+func (s *Server) Stop() error {
+	if s.knocker != nil {
+		s.knocker.Stop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.http.Shutdown(ctx)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.backend.Status())
+}
+
+// MaintenanceRequest is the body of a request to enter maintenance mode
+type MaintenanceRequest struct {
+	Duration    config.Duration `json:"duration"`
+	Reason      string          `json:"reason"`
+	RequestedBy string          `json:"requested_by,omitempty"`
+}
+
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.backend.Status().Maintenance)
+
+	case http.MethodPost:
+		var req MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("a reason is required"))
+			return
+		}
+		status, err := s.backend.EnterMaintenance(req.Duration.Std(), req.Reason)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.audit.Record(AuditEvent{
+			Action:      "maintenance-on",
+			TTL:         req.Duration.String(),
+			Reason:      req.Reason,
+			RequestedBy: requester(r, req.RequestedBy),
+		})
+		writeJSON(w, http.StatusOK, status)
+
+	case http.MethodDelete:
+		if err := s.backend.ExitMaintenance(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		s.audit.Record(AuditEvent{
+			Action:      "maintenance-off",
+			RequestedBy: requester(r, r.URL.Query().Get("by")),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin API response: %v", err)
+	}
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
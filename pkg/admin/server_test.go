@@ -0,0 +1,1025 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dnsproxy"
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/skaegi/legion-router/pkg/metrics"
+)
+
+// fakeBackend records grants without touching nftables
+type fakeBackend struct {
+	grants      []filter.Grant
+	maintenance *filter.MaintenanceStatus
+	query       filter.RuleQuery // Last rule query
+	eventQuery  events.Query     // Last event query
+	disabled    map[string]bool  // Disabled rules and tags
+	bans        []filter.Ban
+	metrics     *metrics.Recorder
+}
+
+func (b *fakeBackend) Status() filter.Status {
+	return filter.Status{Maintenance: b.maintenance}
+}
+
+func (b *fakeBackend) EnterMaintenance(duration time.Duration, reason string) (filter.MaintenanceStatus, error) {
+	if duration <= 0 {
+		return filter.MaintenanceStatus{}, fmt.Errorf("duration must be positive")
+	}
+	b.maintenance = &filter.MaintenanceStatus{Until: time.Now().Add(duration), Reason: reason}
+	return *b.maintenance, nil
+}
+
+func (b *fakeBackend) ExitMaintenance() error {
+	if b.maintenance == nil {
+		return fmt.Errorf("maintenance mode is not on")
+	}
+	b.maintenance = nil
+	return nil
+}
+
+func (b *fakeBackend) Grant(destination string, port uint16, ttl time.Duration, reason string) (filter.Grant, error) {
+	return b.GrantFrom("", destination, port, ttl, reason)
+}
+
+func (b *fakeBackend) GrantFrom(source, destination string, port uint16, ttl time.Duration, reason string) (filter.Grant, error) {
+	if ttl <= 0 {
+		return filter.Grant{}, fmt.Errorf("ttl must be positive")
+	}
+	grant := filter.Grant{Source: source, Destination: destination, Port: port, Expires: time.Now().Add(ttl), Reason: reason}
+	b.grants = append(b.grants, grant)
+	return grant, nil
+}
+
+func (b *fakeBackend) Revoke(destination string, port uint16) error {
+	for i, grant := range b.grants {
+		if grant.Destination == destination && grant.Port == port {
+			b.grants = append(b.grants[:i], b.grants[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no grant")
+}
+
+func (b *fakeBackend) Grants() []filter.Grant {
+	return b.grants
+}
+
+func (b *fakeBackend) Rules(query filter.RuleQuery) filter.RulePage {
+	b.query = query
+	return filter.RulePage{Rules: []config.Rule{}, Offset: query.Offset}
+}
+
+func (b *fakeBackend) ExpandRule(name string) (filter.ExpandedRule, error) {
+	if name != "allow-github" {
+		return filter.ExpandedRule{}, fmt.Errorf("no rule %s in the applied policy", name)
+	}
+	return filter.ExpandedRule{Rule: config.Rule{Name: name}}, nil
+}
+
+func (b *fakeBackend) SetRuleEnabled(name string, enabled bool) error {
+	if name != "allow-github" {
+		return fmt.Errorf("no rule %s in the applied policy", name)
+	}
+	if b.disabled == nil {
+		b.disabled = make(map[string]bool)
+	}
+	b.disabled[name] = !enabled
+	return nil
+}
+
+func (b *fakeBackend) Tags() ([]filter.TagStatus, error) {
+	return []filter.TagStatus{{Tag: "payments", Rules: []string{"allow-stripe"}, Hits: 7}}, nil
+}
+
+func (b *fakeBackend) SetTagEnabled(tag string, enabled bool) ([]string, error) {
+	if tag != "payments" {
+		return nil, fmt.Errorf("no rule of the applied policy is tagged %s", tag)
+	}
+	if b.disabled == nil {
+		b.disabled = make(map[string]bool)
+	}
+	b.disabled[tag] = !enabled
+	return []string{"allow-stripe"}, nil
+}
+
+func (b *fakeBackend) Events(query events.Query) ([]events.Event, error) {
+	b.eventQuery = query
+	return []events.Event{}, nil
+}
+
+func (b *fakeBackend) Metrics() *metrics.Recorder {
+	return b.metrics
+}
+
+func (b *fakeBackend) DNSStats(client net.IP, top int) ([]dnsproxy.ClientStats, error) {
+	return nil, fmt.Errorf("the DNS proxy is not enabled")
+}
+
+func (b *fakeBackend) DNSCache() (*filter.DNSCache, error) {
+	return &filter.DNSCache{Limit: 10000}, nil
+}
+
+func (b *fakeBackend) Bans() ([]filter.Ban, error) {
+	return b.bans, nil
+}
+
+func (b *fakeBackend) Unban(source string) error {
+	for i, ban := range b.bans {
+		if ban.Source == source {
+			b.bans = append(b.bans[:i], b.bans[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not banned", source)
+}
+
+// newRequest creates a request to the API, declaring changes as JSON as
+// the API requires
+func newRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+// TestJSONRequired tests that changes not declared as JSON are refused
+func TestJSONRequired(t *testing.T) {
+	testCases := []struct {
+		name        string
+		method      string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "json", method: http.MethodPost, contentType: "application/json", wantStatus: http.StatusCreated},
+		{name: "json with charset", method: http.MethodPost, contentType: "application/json; charset=utf-8", wantStatus: http.StatusCreated},
+		{name: "plain text", method: http.MethodPost, contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "form", method: http.MethodPost, contentType: "application/x-www-form-urlencoded", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "missing", method: http.MethodPost, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "read", method: http.MethodGet, wantStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &fakeBackend{}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+			req := httptest.NewRequest(tc.method, "/v1/grants", strings.NewReader(`{"destination": "203.0.113.10", "port": 22, "ttl": "15m", "reason": "incident"}`))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// TestGrantsAPI tests creating, listing and revoking grants
+func TestGrantsAPI(t *testing.T) {
+	testCases := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		token      string
+		wantStatus int
+		wantGrants int
+	}{
+		{
+			name:       "grant",
+			method:     http.MethodPost,
+			target:     "/v1/grants",
+			body:       `{"destination": "203.0.113.10", "port": 22, "ttl": "15m", "reason": "incident"}`,
+			token:      "secret",
+			wantStatus: http.StatusCreated,
+			wantGrants: 2,
+		},
+		{
+			name:       "invalid ttl",
+			method:     http.MethodPost,
+			target:     "/v1/grants",
+			body:       `{"destination": "203.0.113.10", "port": 22, "ttl": "15"}`,
+			token:      "secret",
+			wantStatus: http.StatusBadRequest,
+			wantGrants: 1,
+		},
+		{
+			name:       "missing token",
+			method:     http.MethodPost,
+			target:     "/v1/grants",
+			body:       `{"destination": "203.0.113.10", "port": 22, "ttl": "15m", "reason": "incident"}`,
+			wantStatus: http.StatusUnauthorized,
+			wantGrants: 1,
+		},
+		{
+			name:       "missing reason",
+			method:     http.MethodPost,
+			target:     "/v1/grants",
+			body:       `{"destination": "203.0.113.10", "port": 22, "ttl": "15m"}`,
+			token:      "secret",
+			wantStatus: http.StatusBadRequest,
+			wantGrants: 1,
+		},
+		{
+			name:       "revoke",
+			method:     http.MethodDelete,
+			target:     "/v1/grants?destination=198.51.100.1&port=443",
+			token:      "secret",
+			wantStatus: http.StatusNoContent,
+			wantGrants: 0,
+		},
+		{
+			name:       "revoke unknown",
+			method:     http.MethodDelete,
+			target:     "/v1/grants?destination=198.51.100.2&port=443",
+			token:      "secret",
+			wantStatus: http.StatusNotFound,
+			wantGrants: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &fakeBackend{grants: []filter.Grant{{Destination: "198.51.100.1", Port: 443}}}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0", Token: "secret"}, backend)
+
+			req := newRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if len(backend.grants) != tc.wantGrants {
+				t.Errorf("Expected %d grants, got %d", tc.wantGrants, len(backend.grants))
+			}
+		})
+	}
+}
+
+// TestListGrants tests that grants are returned as JSON
+func TestListGrants(t *testing.T) {
+	backend := &fakeBackend{grants: []filter.Grant{{Destination: "198.51.100.1", Port: 443, Reason: "vendor support"}}}
+	server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, newRequest(http.MethodGet, "/v1/grants", nil))
+
+	var grants []filter.Grant
+	if err := json.NewDecoder(rec.Body).Decode(&grants); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(grants) != 1 || grants[0].Reason != "vendor support" {
+		t.Errorf("Unexpected grants: %+v", grants)
+	}
+}
+
+// TestApproval tests that requests wait for an approver other than the
+// user who requested them
+func TestApproval(t *testing.T) {
+	backend := &fakeBackend{}
+	server := NewServer(&config.AdminConfig{
+		Listen: "127.0.0.1:0",
+		Token:  "secret",
+		Users: []config.AdminUser{
+			{Name: "alice", Token: "alice-token", Role: config.AdminRoleOperator, Approver: true},
+			{Name: "bob", Token: "bob-token", Role: config.AdminRoleOperator, Approver: true},
+			{Name: "carol", Token: "carol-token", Role: config.AdminRoleAdmin},
+		},
+		Approval: &config.ApprovalConfig{},
+	}, backend)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	request := GrantRequest{
+		Destination: "203.0.113.10",
+		Port:        443,
+		TTL:         config.Duration(time.Hour),
+		Reason:      "debugging",
+		RequestedBy: "bob",
+	}
+
+	// The shared token can claim to be anyone
+	if _, _, err := NewClient(ts.URL, "secret").RequestGrant(request); err == nil {
+		t.Errorf("Expected a request by the shared token to be refused")
+	}
+
+	grant, pending, err := NewClient(ts.URL, "alice-token").RequestGrant(request)
+	if err != nil {
+		t.Fatalf("Failed to request grant: %v", err)
+	}
+	if grant != nil || pending == nil {
+		t.Fatalf("Expected a pending request, got grant %+v", grant)
+	}
+	if pending.Request.RequestedBy != "alice" {
+		t.Errorf("Expected the request recorded as by alice, got %s", pending.Request.RequestedBy)
+	}
+	if len(backend.grants) != 0 {
+		t.Errorf("Expected no grant before approval, got %d", len(backend.grants))
+	}
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "unknown token", token: "mallory-token", wantErr: true},
+		{name: "shared token", token: "secret", wantErr: true},
+		{name: "not an approver", token: "carol-token", wantErr: true},
+		{name: "requester", token: "alice-token", wantErr: true},
+		{name: "second approver", token: "bob-token", wantErr: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewClient(ts.URL, tc.token).Approve(pending.ID)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Approve() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if len(backend.grants) != 1 || backend.grants[0].Reason != "debugging" {
+		t.Errorf("Expected the approved grant, got %+v", backend.grants)
+	}
+}
+
+// TestApprovalSamePerson tests that a person with a requesting and an
+// approving credential, both naming the same user, can't approve their own
+// request
+func TestApprovalSamePerson(t *testing.T) {
+	backend := &fakeBackend{}
+	server := NewServer(&config.AdminConfig{
+		Listen: "127.0.0.1:0",
+		Users: []config.AdminUser{
+			{Name: "alice", Token: "alice-ci-token", Role: config.AdminRoleOperator},
+			{Name: "alice", Token: "alice-approval-token", Role: config.AdminRoleOperator, Approver: true},
+		},
+		Approval: &config.ApprovalConfig{},
+	}, backend)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	_, pending, err := NewClient(ts.URL, "alice-ci-token").RequestGrant(GrantRequest{
+		Destination: "203.0.113.10",
+		Port:        443,
+		TTL:         config.Duration(time.Hour),
+		Reason:      "debugging",
+		RequestedBy: "bob",
+	})
+	if err != nil || pending == nil {
+		t.Fatalf("Expected a pending request, got error %v", err)
+	}
+	if _, err := NewClient(ts.URL, "alice-approval-token").Approve(pending.ID); err == nil {
+		t.Errorf("Expected the requester's approving token to be refused")
+	}
+	if len(backend.grants) != 0 {
+		t.Errorf("Expected no grant, got %+v", backend.grants)
+	}
+}
+
+// TestRoles tests that users reach the endpoints of their role
+func TestRoles(t *testing.T) {
+	testCases := []struct {
+		name       string
+		token      string
+		cert       string // Common name of a verified client certificate
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "no credentials",
+			method:     http.MethodGet,
+			target:     "/v1/status",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown token",
+			token:      "mallory-token",
+			method:     http.MethodGet,
+			target:     "/v1/status",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "viewer reads",
+			token:      "viewer-token",
+			method:     http.MethodGet,
+			target:     "/v1/rules",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "viewer queries grafana",
+			token:      "viewer-token",
+			method:     http.MethodPost,
+			target:     "/v1/grafana/search",
+			wantStatus: http.StatusNotFound, // No metrics configured
+		},
+		{
+			name:       "viewer cannot grant",
+			token:      "viewer-token",
+			method:     http.MethodPost,
+			target:     "/v1/grants",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "operator grants",
+			token:      "operator-token",
+			method:     http.MethodDelete,
+			target:     "/v1/grants?destination=203.0.113.10&port=443",
+			wantStatus: http.StatusNotFound, // No such grant
+		},
+		{
+			name:       "viewer cannot unban",
+			token:      "viewer-token",
+			method:     http.MethodDelete,
+			target:     "/v1/bans?source=10.0.0.5",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "operator unbans",
+			token:      "operator-token",
+			method:     http.MethodDelete,
+			target:     "/v1/bans?source=10.0.0.5",
+			wantStatus: http.StatusNotFound, // Not banned
+		},
+		{
+			name:       "operator cannot disable rules",
+			token:      "operator-token",
+			method:     http.MethodPost,
+			target:     "/v1/rules/allow-github/disable",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "operator cannot enter maintenance",
+			token:      "operator-token",
+			method:     http.MethodPost,
+			target:     "/v1/maintenance",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin disables rules",
+			token:      "admin-token",
+			method:     http.MethodPost,
+			target:     "/v1/rules/allow-github/disable",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "shared token is admin",
+			token:      "secret",
+			method:     http.MethodPost,
+			target:     "/v1/tags/payments/disable",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "whoami",
+			token:      "operator-token",
+			method:     http.MethodGet,
+			target:     "/v1/whoami",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"name":"olivia","role":"operator"}`,
+		},
+		{
+			name:       "client certificate",
+			cert:       "ci.example.com",
+			method:     http.MethodPost,
+			target:     "/v1/grants",
+			wantStatus: http.StatusBadRequest, // Authorized, but no body
+		},
+		{
+			name:       "unknown client certificate",
+			cert:       "laptop.example.com",
+			method:     http.MethodGet,
+			target:     "/v1/status",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	server := NewServer(&config.AdminConfig{
+		Listen: "127.0.0.1:0",
+		Token:  "secret",
+		Users: []config.AdminUser{
+			{Name: "victor", Token: "viewer-token", Role: config.AdminRoleViewer},
+			{Name: "olivia", Token: "operator-token", Role: config.AdminRoleOperator},
+			{Name: "ada", Token: "admin-token", Role: config.AdminRoleAdmin},
+			{Name: "ci", ClientCert: "ci.example.com", Role: config.AdminRoleOperator},
+		},
+	}, &fakeBackend{})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newRequest(tc.method, tc.target, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if tc.cert != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: tc.cert}}
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if tc.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tc.wantBody {
+				t.Errorf("Expected body %s, got %s", tc.wantBody, rec.Body)
+			}
+		})
+	}
+}
+
+// TestMaintenanceAPI tests switching maintenance mode on and off
+func TestMaintenanceAPI(t *testing.T) {
+	backend := &fakeBackend{}
+	ts := httptest.NewServer(NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend).Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, "")
+
+	if _, err := client.EnterMaintenance(MaintenanceRequest{Duration: config.Duration(time.Hour)}); err == nil {
+		t.Error("Expected error without a reason")
+	}
+
+	status, err := client.EnterMaintenance(MaintenanceRequest{Duration: config.Duration(time.Hour), Reason: "OS upgrades"})
+	if err != nil {
+		t.Fatalf("Failed to enter maintenance: %v", err)
+	}
+	if status.Reason != "OS upgrades" {
+		t.Errorf("Expected reason 'OS upgrades', got %q", status.Reason)
+	}
+	if current, err := client.Maintenance(); err != nil || current == nil {
+		t.Errorf("Expected active maintenance, got %v (%v)", current, err)
+	}
+
+	if err := client.ExitMaintenance("alice"); err != nil {
+		t.Fatalf("Failed to exit maintenance: %v", err)
+	}
+	if current, err := client.Maintenance(); err != nil || current != nil {
+		t.Errorf("Expected no maintenance, got %v (%v)", current, err)
+	}
+	if err := client.ExitMaintenance("alice"); err == nil {
+		t.Error("Expected error exiting maintenance twice")
+	}
+}
+
+// TestRulesAPI tests parsing rule queries and looking up rules
+func TestRulesAPI(t *testing.T) {
+	testCases := []struct {
+		name         string
+		method       string
+		target       string
+		wantStatus   int
+		wantQuery    filter.RuleQuery
+		wantDisabled map[string]bool
+	}{
+		{
+			name:       "default page",
+			target:     "/v1/rules",
+			wantStatus: http.StatusOK,
+			wantQuery:  filter.RuleQuery{Limit: defaultRuleLimit},
+		},
+		{
+			name:       "filtered",
+			target:     "/v1/rules?action=deny&domain=github&destination=203.0.113.10&tag=payments&offset=200&limit=50&hits=true",
+			wantStatus: http.StatusOK,
+			wantQuery: filter.RuleQuery{
+				Action:      config.ActionDeny,
+				Destination: net.ParseIP("203.0.113.10"),
+				Domain:      "github",
+				Tag:         "payments",
+				Offset:      200,
+				Limit:       50,
+				Hits:        true,
+			},
+		},
+		{
+			name:       "invalid action",
+			target:     "/v1/rules?action=reject",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid destination",
+			target:     "/v1/rules?destination=github.com",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "limit too large",
+			target:     "/v1/rules?limit=5000",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "expand",
+			target:     "/v1/rules/allow-github",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "expand unknown",
+			target:     "/v1/rules/allow-gitlab",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:         "disable",
+			method:       http.MethodPost,
+			target:       "/v1/rules/allow-github/disable?by=alice",
+			wantStatus:   http.StatusOK,
+			wantDisabled: map[string]bool{"allow-github": true},
+		},
+		{
+			name:         "enable",
+			method:       http.MethodPost,
+			target:       "/v1/rules/allow-github/enable",
+			wantStatus:   http.StatusOK,
+			wantDisabled: map[string]bool{"allow-github": false},
+		},
+		{
+			name:       "disable unknown",
+			method:     http.MethodPost,
+			target:     "/v1/rules/allow-gitlab/disable",
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "post without operation",
+			method:     http.MethodPost,
+			target:     "/v1/rules/allow-github",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			backend := &fakeBackend{}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, newRequest(method, tc.target, nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if !reflect.DeepEqual(backend.query, tc.wantQuery) {
+				t.Errorf("Expected query %+v, got %+v", tc.wantQuery, backend.query)
+			}
+			if !reflect.DeepEqual(backend.disabled, tc.wantDisabled) {
+				t.Errorf("Expected disabled rules %v, got %v", tc.wantDisabled, backend.disabled)
+			}
+		})
+	}
+}
+
+// TestTagsAPI tests listing tags and enabling or disabling the rules
+// carrying one
+func TestTagsAPI(t *testing.T) {
+	testCases := []struct {
+		name         string
+		method       string
+		target       string
+		wantStatus   int
+		wantDisabled map[string]bool
+	}{
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			target:     "/v1/tags",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:         "disable",
+			method:       http.MethodPost,
+			target:       "/v1/tags/payments/disable?by=alice",
+			wantStatus:   http.StatusOK,
+			wantDisabled: map[string]bool{"payments": true},
+		},
+		{
+			name:         "enable",
+			method:       http.MethodPost,
+			target:       "/v1/tags/payments/enable",
+			wantStatus:   http.StatusOK,
+			wantDisabled: map[string]bool{"payments": false},
+		},
+		{
+			name:       "unknown tag",
+			method:     http.MethodPost,
+			target:     "/v1/tags/billing/disable",
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "unknown operation",
+			method:     http.MethodPost,
+			target:     "/v1/tags/payments/toggle",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "get operation",
+			method:     http.MethodGet,
+			target:     "/v1/tags/payments/disable",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &fakeBackend{}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, newRequest(tc.method, tc.target, nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if !reflect.DeepEqual(backend.disabled, tc.wantDisabled) {
+				t.Errorf("Expected disabled tags %v, got %v", tc.wantDisabled, backend.disabled)
+			}
+		})
+	}
+}
+
+// TestBansAPI tests listing banned sources and lifting bans
+func TestBansAPI(t *testing.T) {
+	testCases := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantBans   int
+	}{
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			target:     "/v1/bans",
+			wantStatus: http.StatusOK,
+			wantBans:   1,
+		},
+		{
+			name:       "unban",
+			method:     http.MethodDelete,
+			target:     "/v1/bans?source=10.0.0.5&by=alice",
+			wantStatus: http.StatusNoContent,
+			wantBans:   0,
+		},
+		{
+			name:       "not banned",
+			method:     http.MethodDelete,
+			target:     "/v1/bans?source=10.0.0.6",
+			wantStatus: http.StatusNotFound,
+			wantBans:   1,
+		},
+		{
+			name:       "post",
+			method:     http.MethodPost,
+			target:     "/v1/bans",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBans:   1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &fakeBackend{bans: []filter.Ban{{Source: "10.0.0.5", Expires: time.Now().Add(time.Hour)}}}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, newRequest(tc.method, tc.target, nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if len(backend.bans) != tc.wantBans {
+				t.Errorf("Expected %d bans, got %d", tc.wantBans, len(backend.bans))
+			}
+		})
+	}
+}
+
+// TestEventsAPI tests querying the event store
+func TestEventsAPI(t *testing.T) {
+	testCases := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantQuery  events.Query
+	}{
+		{
+			name:       "default limit",
+			target:     "/v1/events",
+			wantStatus: http.StatusOK,
+			wantQuery:  events.Query{Limit: defaultEventLimit},
+		},
+		{
+			name:       "filtered",
+			target:     "/v1/events?since=2026-10-01T00:00:00Z&until=2026-10-02T00:00:00Z&type=deny,reload&rule=block-metadata&source=10.0.0.0/24&destination=169.254.169.254&port=80&domain=github&limit=20",
+			wantStatus: http.StatusOK,
+			wantQuery: events.Query{
+				Since:       time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+				Until:       time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC),
+				Types:       []string{events.TypeDeny, events.TypeReload},
+				Rule:        "block-metadata",
+				Source:      &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)},
+				Destination: &net.IPNet{IP: net.IPv4(169, 254, 169, 254).To4(), Mask: net.CIDRMask(32, 32)},
+				Port:        80,
+				Domain:      "github",
+				Limit:       20,
+			},
+		},
+		{
+			name:       "relative time",
+			target:     "/v1/events?since=1h",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid type",
+			target:     "/v1/events?type=drop",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid source",
+			target:     "/v1/events?source=github.com",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "limit too large",
+			target:     "/v1/events?limit=50000",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &fakeBackend{}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, newRequest(http.MethodGet, tc.target, nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if !reflect.DeepEqual(backend.eventQuery, tc.wantQuery) {
+				t.Errorf("Expected query %+v, got %+v", tc.wantQuery, backend.eventQuery)
+			}
+		})
+	}
+}
+
+// TestGrafanaAPI tests serving the sampled counters as a Grafana JSON
+// datasource
+func TestGrafanaAPI(t *testing.T) {
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	recorder := metrics.NewRecorder(time.Minute, time.Hour)
+	recorder.Add(metrics.Sample{Time: base, Counters: map[string]uint64{"denied:block-metadata": 1, "unmatched": 2}})
+	recorder.Add(metrics.Sample{Time: base.Add(time.Minute), Counters: map[string]uint64{"denied:block-metadata": 4, "unmatched": 2}})
+
+	testCases := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		noMetrics  bool
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "connection test",
+			method:     http.MethodGet,
+			target:     "/v1/grafana/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "not sampled",
+			method:     http.MethodGet,
+			target:     "/v1/grafana/",
+			noMetrics:  true,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "search",
+			method:     http.MethodPost,
+			target:     "/v1/grafana/search",
+			body:       `{"target": "denied"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `["denied","denied:block-metadata"]`,
+		},
+		{
+			name:       "metrics",
+			method:     http.MethodPost,
+			target:     "/v1/grafana/metrics",
+			body:       `{"metric": "unm"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"label":"unmatched","value":"unmatched"}]`,
+		},
+		{
+			name:       "query",
+			method:     http.MethodPost,
+			target:     "/v1/grafana/query",
+			body:       `{"range": {"from": "2026-10-01T12:00:00Z", "to": "2026-10-01T13:00:00Z"}, "intervalMs": 60000, "targets": [{"target": "denied", "refId": "A"}, {"target": "unmatched", "refId": "B", "hide": true}]}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"target":"denied","datapoints":[[3,1790856060000]]}]`,
+		},
+		{
+			name:       "query by GET",
+			method:     http.MethodGet,
+			target:     "/v1/grafana/query",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &fakeBackend{metrics: recorder}
+			if tc.noMetrics {
+				backend.metrics = nil
+			}
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0"}, backend)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, newRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if tc.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tc.wantBody {
+				t.Errorf("Expected body %s, got %s", tc.wantBody, rec.Body)
+			}
+		})
+	}
+}
+
+// TestUI tests serving the web UI without authentication, unlike the API
+func TestUI(t *testing.T) {
+	testCases := []struct {
+		name       string
+		ui         bool
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "page",
+			ui:         true,
+			target:     "/ui/",
+			wantStatus: http.StatusOK,
+			wantBody:   "<title>Legion Router</title>",
+		},
+		{
+			name:       "script",
+			ui:         true,
+			target:     "/ui/app.js",
+			wantStatus: http.StatusOK,
+			wantBody:   "async function api(",
+		},
+		{
+			name:       "settings",
+			ui:         true,
+			target:     "/ui/settings.json",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"auth":true}`,
+		},
+		{
+			name:       "api still authenticated",
+			ui:         true,
+			target:     "/v1/status",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "disabled",
+			target:     "/ui/",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(&config.AdminConfig{Listen: "127.0.0.1:0", Token: "secret", UI: tc.ui}, &fakeBackend{})
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, newRequest(http.MethodGet, tc.target, nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tc.wantBody) {
+				t.Errorf("Expected body containing %s, got %s", tc.wantBody, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TagChange reports the rules a tag operation enabled or disabled
+type TagChange struct {
+	Tag     string   `json:"tag"`
+	Enabled bool     `json:"enabled"`
+	Rules   []string `json:"rules"`
+}
+
+// handleTags lists the tags of the applied policy with their rules and hits
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	tags, err := s.backend.Tags()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// handleTag enables or disables the rules carrying a tag, on POST to
+// /v1/tags/<tag>/enable or /v1/tags/<tag>/disable
+func (s *Server) handleTag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	tag, op, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/tags/"), "/")
+	if tag == "" || (op != "enable" && op != "disable") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("POST /v1/tags/<tag>/enable or /v1/tags/<tag>/disable is required"))
+		return
+	}
+	enabled := op == "enable"
+	rules, err := s.backend.SetTagEnabled(tag, enabled)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	s.audit.Record(AuditEvent{
+		Action:      "tag-" + op + "d",
+		Tag:         tag,
+		Rules:       rules,
+		RequestedBy: requester(r, r.URL.Query().Get("by")),
+	})
+	writeJSON(w, http.StatusOK, TagChange{Tag: tag, Enabled: enabled, Rules: rules})
+}
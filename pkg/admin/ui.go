@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"embed"
+	"net/http"
+)
+
+// The web UI is static; it reads the policy from the API with the token the
+// user logs in with
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiSettings tells the web UI whether the API authenticates requests, which
+// is also what allows changes from the UI
+type uiSettings struct {
+	Auth bool `json:"auth"`
+}
+
+// uiHandler serves the web UI under /ui/, without authentication since the
+// files hold no data
+func (s *Server) uiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ui/settings.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, uiSettings{Auth: s.requiresAuth()})
+	})
+	// The files are embedded under ui/, as they are served
+	mux.Handle("/ui/", http.FileServer(http.FS(uiFiles)))
+	mux.Handle("/ui", http.RedirectHandler("ui/", http.StatusMovedPermanently))
+	return mux
+}
@@ -0,0 +1,237 @@
+// Read-only view of a running router's policy, from the admin API. Rules can
+// be enabled and disabled only by admins when the API authenticates requests,
+// so that every change is attributed in the audit log.
+"use strict";
+
+const refreshInterval = 15000;
+const state = {auth: false, role: "", selected: ""};
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function token() {
+  return sessionStorage.getItem("token") || "";
+}
+
+function user() {
+  return sessionStorage.getItem("user") || "web-ui";
+}
+
+// api calls the admin API, relative to the UI so that it works behind a
+// path prefix, and returns the decoded response
+async function api(path, options = {}) {
+  const headers = {};
+  if (token()) {
+    headers["Authorization"] = "Bearer " + token();
+  }
+  if (options.method && options.method !== "GET") {
+    // The API takes changes only as JSON
+    headers["Content-Type"] = "application/json";
+  }
+  const resp = await fetch("../v1/" + path, {...options, headers});
+  if (resp.status === 401) {
+    showLogin(token() ? "The token was not accepted." : "");
+    throw new Error("unauthorized");
+  }
+  const body = await resp.json().catch(() => null);
+  if (!resp.ok) {
+    throw new Error((body && body.error) || resp.statusText);
+  }
+  return body;
+}
+
+// cell appends a cell with text to row
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function showLogin(message) {
+  $("main").hidden = true;
+  $("logout").hidden = true;
+  $("login").hidden = false;
+  $("login-error").textContent = message || "";
+}
+
+function showMain() {
+  $("login").hidden = true;
+  $("main").hidden = false;
+  $("logout").hidden = !state.auth;
+}
+
+async function loadStatus() {
+  if (state.auth) {
+    const identity = await api("whoami");
+    state.role = identity.role;
+    $("identity").textContent = identity.name ? `${identity.name} (${identity.role})` : identity.role;
+  }
+  const status = await api("status");
+  let text = "policy " + (status.config_hash || "-");
+  if (status.build && status.build.version) {
+    text += " · " + status.build.version;
+  }
+  if (status.degraded) {
+    text += " · degraded";
+  }
+  if (status.maintenance) {
+    text += " · maintenance";
+  }
+  $("status").textContent = text;
+}
+
+async function loadRules() {
+  const params = new URLSearchParams({limit: "1000", hits: "true"});
+  for (const [name, id] of [["domain", "filter-domain"], ["action", "filter-action"], ["tag", "filter-tag"]]) {
+    if ($(id).value) {
+      params.set(name, $(id).value);
+    }
+  }
+  const page = await api("rules?" + params);
+  const disabled = new Set(page.disabled || []);
+  const hits = page.hits || {};
+
+  const body = $("rules").tBodies[0];
+  body.replaceChildren();
+  for (const rule of page.rules) {
+    const row = body.insertRow();
+    row.className = "selectable" + (disabled.has(rule.name) ? " disabled" : "");
+    row.onclick = () => loadRule(rule.name);
+    cell(row, rule.order || 0);
+    cell(row, rule.action, rule.action);
+    cell(row, rule.name);
+    const egress = rule.egress || {};
+    const destinations = (egress.domains || []).concat(egress.ips || []);
+    cell(row, destinations.length ? destinations.join(", ") : "*");
+    cell(row, rule.name in hits ? hits[rule.name] : "-");
+    cell(row, disabled.has(rule.name) ? "disabled" : "enabled");
+
+    const actions = row.insertCell();
+    if (state.auth && state.role === "admin") {
+      const button = document.createElement("button");
+      const op = disabled.has(rule.name) ? "enable" : "disable";
+      button.textContent = op;
+      button.onclick = (event) => {
+        event.stopPropagation();
+        setRuleEnabled(rule.name, op);
+      };
+      actions.appendChild(button);
+    }
+  }
+  const shown = page.offset + page.rules.length;
+  $("rules-more").textContent = shown < page.total ? `${page.total - shown} more rules; narrow the filters to see them.` : "";
+}
+
+async function loadRule(name) {
+  state.selected = name;
+  const rule = await api("rules/" + encodeURIComponent(name));
+  $("rule").hidden = false;
+  $("rule-name").textContent = name + (rule.disabled ? " (disabled)" : "");
+  const description = [rule.rule.description, rule.rule.reference].filter(Boolean).join(" · ");
+  $("rule-description").textContent = description;
+  $("rule-ips").textContent = (rule.ips || []).join("\n") || "-";
+  $("rule-unresolved").textContent = (rule.unresolved || []).join("\n") || "-";
+  $("rule-nftables").textContent = (rule.nftables || []).join("\n") || "-";
+}
+
+async function setRuleEnabled(name, op) {
+  try {
+    await api(`rules/${encodeURIComponent(name)}/${op}?by=${encodeURIComponent(user())}`, {method: "POST"});
+  } catch (err) {
+    alert(`Failed to ${op} ${name}: ${err.message}`);
+  }
+  refresh();
+}
+
+// formatEvent formats a stored event as legion-router query prints it
+function formatEvent(event) {
+  if (event.type === "reload") {
+    return event.error ? `reload failed: ${event.error}` : `reload policy=${event.policy || "-"}`;
+  }
+  const hostPort = (ip, port) => port ? (ip.includes(":") ? `[${ip}]:${port}` : `${ip}:${port}`) : ip;
+  let text = event.type;
+  if (event.rule) {
+    text += ` rule=${event.rule}`;
+  }
+  text += ` proto=${event.protocol}`;
+  if (event.interface) {
+    text += ` in=${event.interface}`;
+  }
+  text += ` src=${hostPort(event.source, event.source_port)} dst=${hostPort(event.destination, event.port)}`;
+  if (event.domain) {
+    text += ` domain=${event.domain}`;
+  }
+  return text;
+}
+
+async function loadEvents(type, tableID, noteID, limit) {
+  const body = $(tableID).tBodies[0];
+  let found;
+  try {
+    found = await api(`events?type=${type}&limit=${limit}`);
+  } catch (err) {
+    body.replaceChildren();
+    $(noteID).textContent = err.message === "unauthorized" ? "" : `Not available: ${err.message}.`;
+    return;
+  }
+  body.replaceChildren();
+  for (const event of found.reverse()) {
+    const row = body.insertRow();
+    cell(row, new Date(event.time).toLocaleString());
+    cell(row, formatEvent(event));
+  }
+  $(noteID).textContent = found.length ? "" : "None stored.";
+}
+
+async function refresh() {
+  try {
+    await loadStatus();
+    showMain();
+    await loadRules();
+    if (state.selected) {
+      await loadRule(state.selected);
+    }
+  } catch (err) {
+    if (err.message !== "unauthorized") {
+      $("status").textContent = `Error: ${err.message}`;
+    }
+    return;
+  }
+  await loadEvents("deny", "denies", "denies-note", 50);
+  await loadEvents("reload", "reloads", "reloads-note", 20);
+}
+
+async function start() {
+  const settings = await fetch("settings.json").then((resp) => resp.json());
+  state.auth = settings.auth;
+
+  $("login").onsubmit = (event) => {
+    event.preventDefault();
+    sessionStorage.setItem("token", $("token").value);
+    sessionStorage.setItem("user", $("user").value || "web-ui");
+    refresh();
+  };
+  $("logout").onclick = () => {
+    sessionStorage.clear();
+    state.role = "";
+    showLogin();
+  };
+  for (const id of ["filter-domain", "filter-action", "filter-tag"]) {
+    $(id).onchange = loadRules;
+  }
+
+  // Without a stored token the browser may still present a client
+  // certificate; the login shows if the API turns it away
+  refresh();
+  setInterval(() => {
+    if (!$("main").hidden) {
+      refresh();
+    }
+  }, refreshInterval);
+}
+
+start();
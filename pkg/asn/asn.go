@@ -0,0 +1,248 @@
+// Package asn looks up the prefixes announced by autonomous systems, from
+// RIPEstat or a prefix table extracted from MRT dumps, so that rules can
+// name an AS such as AS15169 instead of its prefixes.
+package asn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/internal/fileutil"
+)
+
+const (
+	defaultURL     = "https://stat.ripe.net/data/announced-prefixes/data.json"
+	defaultRefresh = 24 * time.Hour
+	// Large networks announce a few thousand prefixes
+	maxDocumentSize = 16 << 20
+)
+
+// Prefixes holds the last known prefixes of each AS
+type Prefixes struct {
+	url      string
+	file     string
+	refresh  time.Duration
+	cacheDir string
+	client   *http.Client
+
+	mu       sync.RWMutex
+	prefixes map[uint32][]string // AS -> sorted prefixes
+	digests  map[uint32][32]byte // AS -> digest of its prefixes
+}
+
+// New creates the prefix database for cfg, which may be nil
+func New(cfg *config.ASNPrefixesConfig) *Prefixes {
+	p := &Prefixes{
+		url:      defaultURL,
+		refresh:  defaultRefresh,
+		client:   &http.Client{Timeout: time.Minute},
+		prefixes: make(map[uint32][]string),
+		digests:  make(map[uint32][32]byte),
+	}
+	if cfg == nil {
+		return p
+	}
+
+	if cfg.Refresh > 0 {
+		p.refresh = cfg.Refresh.Std()
+	}
+	if cfg.URL != "" {
+		p.url = cfg.URL
+	}
+	p.file = cfg.File
+	p.cacheDir = cfg.CacheDir
+	return p
+}
+
+// Refresh returns the time between updates
+func (p *Prefixes) Refresh() time.Duration {
+	return p.refresh
+}
+
+// Fetch looks up the prefixes of asns and reports the ASes whose prefixes
+// changed. An AS that can't be looked up keeps its last prefixes, loaded
+// from the cache directory at first.
+func (p *Prefixes) Fetch(ctx context.Context, asns []uint32) (changed []uint32, err error) {
+	var table map[uint32][]string
+	if p.file != "" {
+		if table, err = readTable(p.file); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []string
+	for _, asn := range asns {
+		var prefixes []string
+		if table != nil {
+			prefixes = table[asn]
+		} else {
+			var fetchErr error
+			if prefixes, fetchErr = p.download(ctx, asn); fetchErr != nil {
+				errs = append(errs, fetchErr.Error())
+				if prefixes, fetchErr = p.loadCached(asn); fetchErr != nil {
+					continue
+				}
+			}
+		}
+		sort.Strings(prefixes)
+
+		digest := sha256.Sum256([]byte(strings.Join(prefixes, "\n")))
+		p.mu.Lock()
+		same := p.digests[asn] == digest
+		if !same {
+			p.prefixes[asn] = prefixes
+			p.digests[asn] = digest
+		}
+		p.mu.Unlock()
+		if same {
+			continue
+		}
+		changed = append(changed, asn)
+		log.Printf("Loaded %d prefixes of AS%d", len(prefixes), asn)
+	}
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// Loaded reports whether prefixes of asn are loaded
+func (p *Prefixes) Loaded(asn uint32) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.prefixes[asn]
+	return ok
+}
+
+// Expand returns the last known prefixes of asn
+func (p *Prefixes) Expand(asn uint32) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.prefixes[asn]...)
+}
+
+// download looks up the prefixes of asn in RIPEstat, keeping a copy of the
+// response in the cache directory
+func (p *Prefixes) download(ctx context.Context, asn uint32) ([]string, error) {
+	url := fmt.Sprintf("%s?resource=AS%d", p.url, asn)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up AS%d: %w", asn, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to look up AS%d: %s returned %s", asn, url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up AS%d: %w", asn, err)
+	}
+	prefixes, err := parseRIPEstat(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prefixes of AS%d: %w", asn, err)
+	}
+
+	if p.cacheDir != "" {
+		if err := fileutil.WriteAtomic(p.cachePath(asn), data); err != nil {
+			log.Printf("Warning: failed to cache prefixes of AS%d: %v", asn, err)
+		}
+	}
+	return prefixes, nil
+}
+
+// loadCached reads the cached prefixes of asn, unless they are already
+// loaded
+func (p *Prefixes) loadCached(asn uint32) ([]string, error) {
+	if p.Loaded(asn) || p.cacheDir == "" {
+		return nil, fmt.Errorf("no cached prefixes of AS%d", asn)
+	}
+	data, err := os.ReadFile(p.cachePath(asn))
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := parseRIPEstat(data)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using cached prefixes of AS%d from %s", asn, p.cachePath(asn))
+	return prefixes, nil
+}
+
+func (p *Prefixes) cachePath(asn uint32) string {
+	return filepath.Join(p.cacheDir, fmt.Sprintf("AS%d.json", asn))
+}
+
+// parseRIPEstat parses an announced-prefixes response
+func parseRIPEstat(data []byte) ([]string, error) {
+	var doc struct {
+		Status string `json:"status"`
+		Data   struct {
+			Prefixes []struct {
+				Prefix string `json:"prefix"`
+			} `json:"prefixes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Status != "ok" {
+		return nil, fmt.Errorf("status %q", doc.Status)
+	}
+	prefixes := make([]string, 0, len(doc.Data.Prefixes))
+	for _, p := range doc.Data.Prefixes {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	return prefixes, nil
+}
+
+// readTable reads a prefix table of "<prefix> <asn>" lines; comments start
+// with ; or #
+func readTable(path string) (map[uint32][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prefix table: %w", err)
+	}
+	table := make(map[uint32][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <prefix> <asn>", path, line)
+		}
+		if _, _, err := net.ParseCIDR(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid prefix %q", path, line, fields[0])
+		}
+		asn, err := config.ParseASN(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		table[asn] = append(table[asn], fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read prefix table: %w", err)
+	}
+	return table, nil
+}
@@ -0,0 +1,106 @@
+package asn
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const ripestatPrefixes = `{"status": "ok", "data": {"prefixes": [
+	{"prefix": "8.8.8.0/24", "timelines": []},
+	{"prefix": "2001:4860::/32", "timelines": []},
+	{"prefix": "8.8.4.0/24", "timelines": []}]}}`
+
+// TestFetchRIPEstat tests looking up prefixes in RIPEstat and falling back
+// to the cache
+func TestFetchRIPEstat(t *testing.T) {
+	var resources []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resources = append(resources, r.URL.Query().Get("resource"))
+		w.Write([]byte(ripestatPrefixes))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	p := New(&config.ASNPrefixesConfig{URL: server.URL, CacheDir: cacheDir})
+	changed, err := p.Fetch(context.Background(), []uint32{15169})
+	if err != nil || !reflect.DeepEqual(changed, []uint32{15169}) {
+		t.Fatalf("Expected AS15169 to change, got %v (%v)", changed, err)
+	}
+	if !reflect.DeepEqual(resources, []string{"AS15169"}) {
+		t.Errorf("Expected a lookup of AS15169, got %v", resources)
+	}
+	want := []string{"2001:4860::/32", "8.8.4.0/24", "8.8.8.0/24"}
+	if got := p.Expand(15169); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if changed, _ := p.Fetch(context.Background(), []uint32{15169}); len(changed) != 0 {
+		t.Errorf("Expected no change on a second fetch, got %v", changed)
+	}
+
+	// A restart while RIPEstat is unreachable uses the cached prefixes
+	server.Close()
+	p = New(&config.ASNPrefixesConfig{URL: server.URL, CacheDir: cacheDir})
+	if _, err := p.Fetch(context.Background(), []uint32{15169}); err == nil {
+		t.Error("Expected an error for an unreachable RIPEstat")
+	}
+	if got := p.Expand(15169); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected cached %v, got %v", want, got)
+	}
+}
+
+// TestReadTable tests reading prefix tables extracted from MRT dumps
+func TestReadTable(t *testing.T) {
+	testCases := []struct {
+		name    string
+		table   string
+		want    map[uint32][]string
+		wantErr bool
+	}{
+		{
+			name:  "ipasn",
+			table: "; IP-ASN32-DAT file\n8.8.8.0/24\t15169\n1.1.1.0/24\t13335\n2001:4860::/32\t15169\n",
+			want: map[uint32][]string{
+				15169: {"8.8.8.0/24", "2001:4860::/32"},
+				13335: {"1.1.1.0/24"},
+			},
+		},
+		{
+			name:  "as prefix",
+			table: "# comment\n192.0.2.0/24 AS64500\n",
+			want:  map[uint32][]string{64500: {"192.0.2.0/24"}},
+		},
+		{
+			name:    "invalid prefix",
+			table:   "192.0.2.0/33 64500\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing asn",
+			table:   "192.0.2.0/24\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ipasn.dat")
+			if err := os.WriteFile(path, []byte(tc.table), 0644); err != nil {
+				t.Fatalf("Failed to write table: %v", err)
+			}
+			got, err := readTable(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("readTable() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
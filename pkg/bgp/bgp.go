@@ -0,0 +1,232 @@
+// Package bgp learns prefixes from BGP peers such as a route server, so
+// that rules can allow the prefixes partners announce as @bgp groups
+// instead of lists maintained by hand. It only listens for the configured
+// neighbors, announces nothing and keeps the routes each one sends until
+// the session ends.
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// Changes are passed on once a burst of updates, such as the full table
+// sent when a session comes up, has settled
+const settleDelay = time.Second
+
+// route holds the attributes of a learned prefix that groups select by
+type route struct {
+	originAS    uint32 // 0 if the path ends in an AS_SET
+	communities []uint32
+}
+
+// Speaker accepts sessions from the configured neighbors and holds the
+// prefixes they announce
+type Speaker struct {
+	config   *config.BGPConfig
+	onChange func()
+	changed  chan struct{}
+
+	mu       sync.Mutex
+	ribs     map[string]map[string]route // Neighbor -> prefix -> route
+	sessions map[string]net.Conn         // Neighbor -> connection
+}
+
+// New creates a speaker for cfg; onChange is called after the learned
+// prefixes changed
+func New(cfg *config.BGPConfig, onChange func()) *Speaker {
+	return &Speaker{
+		config:   cfg,
+		onChange: onChange,
+		changed:  make(chan struct{}, 1),
+		ribs:     make(map[string]map[string]route),
+		sessions: make(map[string]net.Conn),
+	}
+}
+
+// Run accepts sessions until ctx is done
+func (s *Speaker) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.config.EffectiveListen())
+	if err != nil {
+		return fmt.Errorf("failed to listen for BGP on %s: %w", s.config.EffectiveListen(), err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go s.notifyChanges(ctx)
+	log.Printf("Listening for BGP neighbors on %s", s.config.EffectiveListen())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept BGP connection: %w", err)
+		}
+		go s.accept(ctx, conn)
+	}
+}
+
+// accept runs a session on conn if it comes from a neighbor
+func (s *Speaker) accept(ctx context.Context, conn net.Conn) {
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if addr == nil {
+		conn.Close()
+		return
+	}
+	neighbor, ok := s.config.Neighbor(addr.IP)
+	if !ok {
+		log.Printf("Warning: refused BGP connection from %s, which is not a neighbor", addr.IP)
+		conn.Close()
+		return
+	}
+	peer := addr.IP.String()
+
+	// A peer connecting again has lost the previous session
+	s.mu.Lock()
+	if previous, ok := s.sessions[peer]; ok {
+		previous.Close()
+	}
+	s.sessions[peer] = conn
+	s.mu.Unlock()
+
+	err := s.serve(ctx, conn, peer, neighbor)
+
+	s.mu.Lock()
+	if s.sessions[peer] == conn {
+		delete(s.sessions, peer)
+	}
+	dropped := len(s.ribs[peer])
+	delete(s.ribs, peer)
+	s.mu.Unlock()
+	if dropped > 0 {
+		s.signalChange()
+	}
+	if err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Warning: BGP session with %s ended, dropping its %d prefixes: %v", peer, dropped, err)
+	}
+}
+
+// update applies the prefixes a neighbor withdrew and announced
+func (s *Speaker) update(peer string, u update) {
+	s.mu.Lock()
+	rib := s.ribs[peer]
+	if rib == nil {
+		rib = make(map[string]route)
+		s.ribs[peer] = rib
+	}
+	for _, prefix := range u.withdrawn {
+		delete(rib, prefix)
+	}
+	for _, prefix := range u.announced {
+		rib[prefix] = u.route
+	}
+	s.mu.Unlock()
+
+	if len(u.withdrawn) > 0 || len(u.announced) > 0 {
+		s.signalChange()
+	}
+}
+
+// signalChange schedules a call of onChange
+func (s *Speaker) signalChange() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// notifyChanges calls onChange after changes settled, until ctx is done
+func (s *Speaker) notifyChanges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.changed:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(settleDelay):
+		}
+		// Changes during the delay are passed on with these
+		select {
+		case <-s.changed:
+		default:
+		}
+		s.onChange()
+	}
+}
+
+// Expand returns the learned prefixes group selects, sorted. Default
+// routes are left out: they would allow every destination.
+func (s *Speaker) Expand(group config.BGPGroupConfig) []string {
+	neighbors := make(map[string]bool)
+	for _, n := range group.Neighbors {
+		neighbors[net.ParseIP(n).String()] = true
+	}
+	communities := make(map[uint32]bool)
+	for _, c := range group.Communities {
+		// Communities are validated with the config
+		if community, err := config.ParseCommunity(c); err == nil {
+			communities[community] = true
+		}
+	}
+	origins := make(map[uint32]bool)
+	for _, a := range group.OriginASNs {
+		if asn, err := config.ParseASN(a); err == nil {
+			origins[asn] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var prefixes []string
+	for peer, rib := range s.ribs {
+		if len(neighbors) > 0 && !neighbors[peer] {
+			continue
+		}
+		for prefix, r := range rib {
+			if seen[prefix] || isDefault(prefix) {
+				continue
+			}
+			if len(origins) > 0 && !origins[r.originAS] {
+				continue
+			}
+			if len(communities) > 0 && !hasCommunity(r, communities) {
+				continue
+			}
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// hasCommunity reports whether r is tagged with any of communities
+func hasCommunity(r route, communities map[uint32]bool) bool {
+	for _, c := range r.communities {
+		if communities[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// isDefault reports whether prefix is a default route
+func isDefault(prefix string) bool {
+	return prefix == "0.0.0.0/0" || prefix == "::/0"
+}
@@ -0,0 +1,172 @@
+package bgp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// updateMessage returns the body of an UPDATE announcing prefixes with an
+// AS_PATH of 2-octet path and communities, and withdrawing withdrawn; IPv6
+// prefixes go in MP_REACH_NLRI
+func updateMessage(t *testing.T, withdrawn, prefixes []string, path []uint16, communities []uint32) []byte {
+	encode := func(prefixes []string, ipv6 bool) []byte {
+		var b []byte
+		for _, p := range prefixes {
+			_, network, err := net.ParseCIDR(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (network.IP.To4() == nil) != ipv6 {
+				continue
+			}
+			ip := network.IP.To4()
+			if ipv6 {
+				ip = network.IP.To16()
+			}
+			bits, _ := network.Mask.Size()
+			b = append(append(b, byte(bits)), ip[:(bits+7)/8]...)
+		}
+		return b
+	}
+
+	var attrs []byte
+	if len(path) > 0 {
+		segment := []byte{asSequence, byte(len(path))}
+		for _, as := range path {
+			segment = binary.BigEndian.AppendUint16(segment, as)
+		}
+		attrs = append(attrs, 0x40, attrASPath, byte(len(segment)))
+		attrs = append(attrs, segment...)
+	}
+	if len(communities) > 0 {
+		attrs = append(attrs, 0xc0, attrCommunities, byte(4*len(communities)))
+		for _, c := range communities {
+			attrs = binary.BigEndian.AppendUint32(attrs, c)
+		}
+	}
+	if nlri := encode(prefixes, true); len(nlri) > 0 {
+		reach := []byte{0, afiIPv6, safiUnicast, 16}
+		reach = append(reach, net.ParseIP("2001:db8::1").To16()...)
+		reach = append(append(reach, 0), nlri...)
+		attrs = append(attrs, 0x80, attrMPReach, byte(len(reach)))
+		attrs = append(attrs, reach...)
+	}
+
+	w := encode(withdrawn, false)
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(w)))
+	body = append(body, w...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	return append(body, encode(prefixes, false)...)
+}
+
+// TestSession tests that the prefixes a neighbor announces are learned
+// until withdrawn or the session ends
+func TestSession(t *testing.T) {
+	cfg := &config.BGPConfig{
+		LocalAS:   64512,
+		RouterID:  "10.0.0.1",
+		Neighbors: []config.BGPNeighborConfig{{Address: "10.0.0.2", PeerAS: 64513}},
+	}
+	partners := config.BGPGroupConfig{Name: "partners", Communities: []string{"64513:100"}}
+	s := New(cfg, func() {})
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(context.Background(), server, "10.0.0.2", cfg.Neighbors[0])
+	}()
+
+	open := []byte{4, 0xfc, 0x01, 0, 90, 10, 0, 0, 2, 0}
+	if err := writeMessage(client, msgOpen, open); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []byte{msgOpen, msgKeepalive} {
+		typ, _, err := readMessage(client)
+		if err != nil || typ != want {
+			t.Fatalf("Expected message type %d, got %d: %v", want, typ, err)
+		}
+	}
+	writeMessage(client, msgKeepalive, nil)
+
+	tagged := uint32(64513<<16 | 100)
+	writeMessage(client, msgUpdate, updateMessage(t, nil, []string{"203.0.113.0/24", "2001:db8::/32"}, []uint16{64513, 64500}, []uint32{tagged}))
+	writeMessage(client, msgUpdate, updateMessage(t, nil, []string{"198.51.100.0/24", "0.0.0.0/0"}, []uint16{64513}, []uint32{tagged}))
+	writeMessage(client, msgUpdate, updateMessage(t, []string{"198.51.100.0/24"}, nil, nil, nil))
+	// Once the next message is read, the updates were applied
+	writeMessage(client, msgKeepalive, nil)
+
+	want := []string{"2001:db8::/32", "203.0.113.0/24"}
+	if got := s.Expand(partners); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to end")
+	}
+}
+
+// TestExpand tests that groups select learned prefixes by neighbor,
+// community and origin AS
+func TestExpand(t *testing.T) {
+	s := New(&config.BGPConfig{}, func() {})
+	s.ribs = map[string]map[string]route{
+		"10.0.0.2": {
+			"203.0.113.0/24":  {originAS: 64500, communities: []uint32{64513<<16 | 100}},
+			"198.51.100.0/24": {originAS: 64501},
+		},
+		"10.0.0.3": {
+			"192.0.2.0/24": {originAS: 64500, communities: []uint32{64514<<16 | 100}},
+			"::/0":         {originAS: 64500},
+		},
+	}
+
+	testCases := []struct {
+		name  string
+		group config.BGPGroupConfig
+		want  []string
+	}{
+		{
+			name:  "all",
+			group: config.BGPGroupConfig{Name: "all"},
+			want:  []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"},
+		},
+		{
+			name:  "neighbor",
+			group: config.BGPGroupConfig{Name: "rs", Neighbors: []string{"10.0.0.3"}},
+			want:  []string{"192.0.2.0/24"},
+		},
+		{
+			name:  "community",
+			group: config.BGPGroupConfig{Name: "partner", Communities: []string{"64513:100"}},
+			want:  []string{"203.0.113.0/24"},
+		},
+		{
+			name:  "origin",
+			group: config.BGPGroupConfig{Name: "origin", OriginASNs: []string{"AS64500"}},
+			want:  []string{"192.0.2.0/24", "203.0.113.0/24"},
+		},
+		{
+			name:  "origin and community",
+			group: config.BGPGroupConfig{Name: "both", OriginASNs: []string{"AS64501"}, Communities: []string{"64513:100"}},
+			want:  nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := s.Expand(tc.group); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Message types (RFC 4271)
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+// NOTIFICATION error codes and subcodes
+const (
+	errOpen      = 2
+	errUpdate    = 3
+	errHoldTimer = 4
+	errFSM       = 5
+
+	errOpenVersion  = 1
+	errOpenPeerAS   = 2
+	errOpenHoldTime = 6
+
+	errUpdateAttributes = 1
+)
+
+// Path attributes
+const (
+	attrASPath      = 2
+	attrCommunities = 8
+	attrMPReach     = 14
+	attrMPUnreach   = 15
+	attrAS4Path     = 17
+
+	attrFlagExtendedLength = 0x10
+)
+
+const (
+	headerLen     = 19
+	maxMessageLen = 4096
+	// AS_TRANS stands in for 4-octet AS numbers in 2-octet fields (RFC 6793)
+	asTrans = 23456
+
+	capMultiprotocol = 1
+	capAS4           = 65
+
+	afiIPv4         = 1
+	afiIPv6         = 2
+	safiUnicast     = 1
+	asSequence      = 2
+	paramCapability = 2
+)
+
+// open is a received OPEN
+type open struct {
+	version  byte
+	as       uint32
+	holdTime uint16
+	as4      bool // 4-octet AS numbers in AS_PATH
+}
+
+// update is a received UPDATE
+type update struct {
+	withdrawn []string
+	announced []string
+	route     route
+}
+
+// readMessage reads the next message, returning its type and body
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return 0, nil, fmt.Errorf("invalid BGP message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMessageLen {
+		return 0, nil, fmt.Errorf("invalid BGP message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// writeMessage writes a message of typ with body
+func writeMessage(w io.Writer, typ byte, body []byte) error {
+	msg := bytes.Repeat([]byte{0xff}, 16)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(headerLen+len(body)))
+	msg = append(msg, typ)
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// openMessage returns the body of an OPEN for IPv4 and IPv6 unicast with
+// 4-octet AS numbers
+func openMessage(localAS uint32, holdTime uint16, routerID net.IP) []byte {
+	as := uint16(asTrans)
+	if localAS <= 0xffff {
+		as = uint16(localAS)
+	}
+	caps := []byte{
+		capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast,
+		capMultiprotocol, 4, 0, afiIPv6, 0, safiUnicast,
+		capAS4, 4,
+	}
+	caps = binary.BigEndian.AppendUint32(caps, localAS)
+
+	body := []byte{4}
+	body = binary.BigEndian.AppendUint16(body, as)
+	body = binary.BigEndian.AppendUint16(body, holdTime)
+	body = append(body, routerID.To4()...)
+	body = append(body, byte(len(caps)+2), paramCapability, byte(len(caps)))
+	return append(body, caps...)
+}
+
+// parseOpen parses the body of an OPEN
+func parseOpen(body []byte) (open, error) {
+	if len(body) < 10 || len(body) < 10+int(body[9]) {
+		return open{}, fmt.Errorf("malformed OPEN")
+	}
+	o := open{
+		version:  body[0],
+		as:       uint32(binary.BigEndian.Uint16(body[1:3])),
+		holdTime: binary.BigEndian.Uint16(body[3:5]),
+	}
+	params := body[10 : 10+int(body[9])]
+	for len(params) >= 2 {
+		typ, value := params[0], params[2:]
+		if len(value) < int(params[1]) {
+			return open{}, fmt.Errorf("malformed OPEN parameter")
+		}
+		value, params = value[:params[1]], value[params[1]:]
+		if typ != paramCapability {
+			continue
+		}
+		for len(value) >= 2 {
+			code, data := value[0], value[2:]
+			if len(data) < int(value[1]) {
+				return open{}, fmt.Errorf("malformed OPEN capability")
+			}
+			data, value = data[:value[1]], data[value[1]:]
+			if code == capAS4 && len(data) == 4 {
+				o.as4 = true
+				o.as = binary.BigEndian.Uint32(data)
+			}
+		}
+	}
+	return o, nil
+}
+
+// parseUpdate parses the body of an UPDATE; as4 is set when AS_PATH
+// carries 4-octet AS numbers
+func parseUpdate(body []byte, as4 bool) (update, error) {
+	var u update
+	if len(body) < 2 {
+		return u, fmt.Errorf("malformed UPDATE")
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+withdrawnLen+2 {
+		return u, fmt.Errorf("malformed UPDATE")
+	}
+	withdrawn, err := parsePrefixes(body[2:2+withdrawnLen], net.IPv4len)
+	if err != nil {
+		return u, err
+	}
+	u.withdrawn = withdrawn
+	rest := body[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+attrsLen {
+		return u, fmt.Errorf("malformed UPDATE")
+	}
+	attrs, nlri := rest[2:2+attrsLen], rest[2+attrsLen:]
+
+	var as4Origin uint32
+	for len(attrs) >= 3 {
+		flags, code := attrs[0], attrs[1]
+		var length int
+		if flags&attrFlagExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return u, fmt.Errorf("malformed path attribute")
+			}
+			length, attrs = int(binary.BigEndian.Uint16(attrs[2:4])), attrs[4:]
+		} else {
+			length, attrs = int(attrs[2]), attrs[3:]
+		}
+		if len(attrs) < length {
+			return u, fmt.Errorf("malformed path attribute %d", code)
+		}
+		value := attrs[:length]
+		attrs = attrs[length:]
+
+		switch code {
+		case attrASPath:
+			asLen := 2
+			if as4 {
+				asLen = 4
+			}
+			if u.route.originAS, err = pathOrigin(value, asLen); err != nil {
+				return u, err
+			}
+		case attrAS4Path:
+			if as4Origin, err = pathOrigin(value, 4); err != nil {
+				return u, err
+			}
+		case attrCommunities:
+			if len(value)%4 != 0 {
+				return u, fmt.Errorf("malformed COMMUNITIES")
+			}
+			for i := 0; i < len(value); i += 4 {
+				u.route.communities = append(u.route.communities, binary.BigEndian.Uint32(value[i:]))
+			}
+		case attrMPReach:
+			if len(value) < 5 || len(value) < 5+int(value[3]) {
+				return u, fmt.Errorf("malformed MP_REACH_NLRI")
+			}
+			ipLen, ok := unicastFamily(value)
+			if !ok {
+				continue
+			}
+			// Skip the next hop and the reserved octet
+			prefixes, err := parsePrefixes(value[5+int(value[3]):], ipLen)
+			if err != nil {
+				return u, err
+			}
+			u.announced = append(u.announced, prefixes...)
+		case attrMPUnreach:
+			if len(value) < 3 {
+				return u, fmt.Errorf("malformed MP_UNREACH_NLRI")
+			}
+			ipLen, ok := unicastFamily(value)
+			if !ok {
+				continue
+			}
+			prefixes, err := parsePrefixes(value[3:], ipLen)
+			if err != nil {
+				return u, err
+			}
+			u.withdrawn = append(u.withdrawn, prefixes...)
+		}
+	}
+	// 2-octet speakers pass 4-octet origins in AS4_PATH
+	if u.route.originAS == asTrans && as4Origin != 0 {
+		u.route.originAS = as4Origin
+	}
+
+	announced, err := parsePrefixes(nlri, net.IPv4len)
+	if err != nil {
+		return u, err
+	}
+	u.announced = append(u.announced, announced...)
+	return u, nil
+}
+
+// unicastFamily returns the address length of an MP attribute's AFI, if it
+// is for unicast
+func unicastFamily(value []byte) (int, bool) {
+	if value[2] != safiUnicast {
+		return 0, false
+	}
+	switch binary.BigEndian.Uint16(value) {
+	case afiIPv4:
+		return net.IPv4len, true
+	case afiIPv6:
+		return net.IPv6len, true
+	}
+	return 0, false
+}
+
+// pathOrigin returns the last AS of an AS_PATH ending in an AS_SEQUENCE,
+// 0 otherwise
+func pathOrigin(path []byte, asLen int) (uint32, error) {
+	var origin uint32
+	for len(path) > 0 {
+		if len(path) < 2 || len(path) < 2+int(path[1])*asLen {
+			return 0, fmt.Errorf("malformed AS_PATH")
+		}
+		typ, count := path[0], int(path[1])
+		segment := path[2 : 2+count*asLen]
+		path = path[2+count*asLen:]
+		origin = 0
+		if typ != asSequence || count == 0 {
+			continue
+		}
+		last := segment[(count-1)*asLen:]
+		if asLen == 4 {
+			origin = binary.BigEndian.Uint32(last)
+		} else {
+			origin = uint32(binary.BigEndian.Uint16(last))
+		}
+	}
+	return origin, nil
+}
+
+// parsePrefixes parses a list of length-prefixed prefixes of ipLen octet
+// addresses
+func parsePrefixes(b []byte, ipLen int) ([]string, error) {
+	var prefixes []string
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+		if bits > ipLen*8 || len(b) < 1+n {
+			return nil, fmt.Errorf("malformed prefix")
+		}
+		ip := make(net.IP, ipLen)
+		copy(ip, b[1:1+n])
+		mask := net.CIDRMask(bits, ipLen*8)
+		prefixes = append(prefixes, (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String())
+		b = b[1+n:]
+	}
+	return prefixes, nil
+}
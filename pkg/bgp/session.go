@@ -0,0 +1,157 @@
+package bgp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const defaultHoldTime = 90 * time.Second
+
+// session is an established connection with a neighbor
+type session struct {
+	conn net.Conn
+	// Keepalives and notifications are written from different goroutines
+	writeMu sync.Mutex
+}
+
+// send writes a message
+func (ss *session) send(typ byte, body []byte) error {
+	ss.writeMu.Lock()
+	defer ss.writeMu.Unlock()
+	return writeMessage(ss.conn, typ, body)
+}
+
+// notify sends a NOTIFICATION, after which the session ends
+func (ss *session) notify(code, subcode byte) {
+	ss.send(msgNotification, []byte{code, subcode})
+}
+
+// serve runs the session with neighbor, whose address is peer, on conn
+// until it ends
+func (s *Speaker) serve(ctx context.Context, conn net.Conn, peer string, neighbor config.BGPNeighborConfig) error {
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	ss := &session{conn: conn}
+	r := bufio.NewReader(conn)
+
+	holdTime := defaultHoldTime
+	if s.config.HoldTime > 0 {
+		holdTime = s.config.HoldTime.Std()
+	}
+	conn.SetReadDeadline(time.Now().Add(holdTime))
+	typ, body, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+	if typ != msgOpen {
+		ss.notify(errFSM, 0)
+		return fmt.Errorf("expected OPEN, got message type %d", typ)
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		ss.notify(errOpen, 0)
+		return err
+	}
+	if open.version != 4 {
+		ss.notify(errOpen, errOpenVersion)
+		return fmt.Errorf("unsupported BGP version %d", open.version)
+	}
+	if open.as != neighbor.PeerAS {
+		ss.notify(errOpen, errOpenPeerAS)
+		return fmt.Errorf("peer AS %d does not match peer_as %d", open.as, neighbor.PeerAS)
+	}
+	if open.holdTime > 0 && open.holdTime < 3 {
+		ss.notify(errOpen, errOpenHoldTime)
+		return fmt.Errorf("unacceptable hold time %ds", open.holdTime)
+	}
+	if proposed := time.Duration(open.holdTime) * time.Second; proposed < holdTime {
+		holdTime = proposed
+	}
+
+	routerID := net.ParseIP(s.config.RouterID).To4()
+	if err := ss.send(msgOpen, openMessage(s.config.LocalAS, uint16(holdTime/time.Second), routerID)); err != nil {
+		return err
+	}
+	if err := ss.send(msgKeepalive, nil); err != nil {
+		return err
+	}
+
+	// The session is established with the peer's KEEPALIVE
+	established := false
+	for {
+		if holdTime > 0 {
+			conn.SetReadDeadline(time.Now().Add(holdTime))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		typ, body, err := readMessage(r)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			ss.notify(errHoldTimer, 0)
+			return fmt.Errorf("hold timer expired")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case msgKeepalive:
+			if !established {
+				established = true
+				log.Printf("BGP session with %s (AS%d) established", peer, open.as)
+				if holdTime > 0 {
+					go ss.keepalive(holdTime/3, stop)
+				}
+			}
+		case msgUpdate:
+			if !established {
+				ss.notify(errFSM, 0)
+				return fmt.Errorf("UPDATE before the session was established")
+			}
+			u, err := parseUpdate(body, open.as4)
+			if err != nil {
+				ss.notify(errUpdate, errUpdateAttributes)
+				return err
+			}
+			s.update(peer, u)
+		case msgNotification:
+			if len(body) >= 2 {
+				return fmt.Errorf("peer sent NOTIFICATION %d/%d", body[0], body[1])
+			}
+			return fmt.Errorf("peer sent NOTIFICATION")
+		}
+		// ROUTE-REFRESH and unknown types are ignored
+	}
+}
+
+// keepalive sends a KEEPALIVE every interval until stop is closed
+func (ss *session) keepalive(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ss.send(msgKeepalive, nil); err != nil {
+				return
+			}
+		}
+	}
+}
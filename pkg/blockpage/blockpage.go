@@ -0,0 +1,172 @@
+// Package blockpage serves the page that denied HTTP connections are
+// redirected to. It looks up the rule that denied the connection by its
+// original destination and tells the user how to request an exception.
+package blockpage
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/network"
+)
+
+// Block is why a connection was denied
+type Block struct {
+	// Rule is the rule that denied the connection, "" if no rule allowed it
+	Rule        string
+	Description string
+	Reference   string
+}
+
+// Policy tells which rule denies a connection from src to dst
+type Policy interface {
+	BlockedBy(src, dst net.IP) (Block, error)
+}
+
+// Server serves the block page
+type Server struct {
+	port    uint16
+	contact string
+	policy  Policy
+	http    *http.Server
+}
+
+// NewServer creates a server of the block page on port, naming contact as
+// the way to request an exception
+func NewServer(port uint16, contact string, policy Policy) *Server {
+	s := &Server{port: port, contact: contact, policy: policy}
+	s.http = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext:       withOriginalDestination,
+	}
+	return s
+}
+
+// Start listens on the port on every address and serves in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	go func() {
+		if err := s.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Warning: block page stopped: %v", err)
+		}
+	}()
+	log.Printf("Block page listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop shuts the server down
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.http.Shutdown(ctx)
+}
+
+// page is what the block page shows
+type page struct {
+	Host        string
+	Block       Block
+	Known       bool // Whether the rule was looked up
+	Contact     string
+	ContactLink string // mailto: or http(s) URL of Contact, if it is one
+}
+
+var pageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Blocked by policy</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+dt { font-weight: bold; margin-top: 1em; }
+</style>
+</head>
+<body>
+<h1>Blocked by policy</h1>
+<p>The network policy does not allow connections to <strong>{{.Host}}</strong>.</p>
+{{if .Known}}<dl>
+<dt>Rule</dt>
+<dd>{{if .Block.Rule}}{{.Block.Rule}}{{else}}No rule allows this connection{{end}}</dd>
+{{if .Block.Description}}<dt>Why</dt>
+<dd>{{.Block.Description}}</dd>
+{{end}}{{if .Block.Reference}}<dt>Reference</dt>
+<dd>{{.Block.Reference}}</dd>
+{{end}}</dl>
+{{end}}{{if .Contact}}<p>If you need access, request an exception from
+{{if .ContactLink}}<a href="{{.ContactLink}}">{{.Contact}}</a>{{else}}{{.Contact}}{{end}}, naming the address above{{if .Block.Rule}} and the rule{{end}}.</p>
+{{end}}</body>
+</html>
+`))
+
+// Handler returns the HTTP handler of the page, answering every request
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.handle)
+}
+
+// handle answers a redirected request with the rule that denied it
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	p := page{Host: r.Host, Contact: s.contact, ContactLink: contactLink(s.contact)}
+	src := remoteIP(r.RemoteAddr)
+	if dst, ok := r.Context().Value(originalDestinationKey{}).(net.IP); ok && src != nil {
+		block, err := s.policy.BlockedBy(src, dst)
+		if err != nil {
+			log.Printf("Warning: failed to look up the rule blocking %s to %s: %v", src, dst, err)
+		} else {
+			p.Block, p.Known = block, true
+		}
+		if p.Host == "" {
+			p.Host = dst.String()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Browsers must not cache the page as the site
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := pageTemplate.Execute(w, p); err != nil {
+		log.Printf("Warning: failed to render the block page: %v", err)
+	}
+}
+
+// contactLink returns a link to contact if it is a mail address or URL
+func contactLink(contact string) string {
+	switch {
+	case strings.HasPrefix(contact, "http://"), strings.HasPrefix(contact, "https://"):
+		return contact
+	case strings.Contains(contact, "@") && !strings.ContainsAny(contact, " :/"):
+		return "mailto:" + contact
+	}
+	return ""
+}
+
+// remoteIP returns the address of host:port, or nil
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// originalDestinationKey keys the destination a connection was redirected
+// from in its context
+type originalDestinationKey struct{}
+
+// withOriginalDestination adds the destination the client connected to
+// before the redirect to the context of a connection, if it was redirected
+func withOriginalDestination(ctx context.Context, c net.Conn) context.Context {
+	dst := network.OriginalDestination(c)
+	if dst == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, originalDestinationKey{}, dst.IP)
+}
@@ -0,0 +1,100 @@
+package blockpage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakePolicy denies 192.0.2.0/24 by rule and everything else by default
+type fakePolicy struct{}
+
+func (fakePolicy) BlockedBy(src, dst net.IP) (Block, error) {
+	switch {
+	case dst.Equal(net.ParseIP("198.51.100.1")):
+		return Block{}, fmt.Errorf("no ruleset")
+	case dst.To4() != nil && dst.To4()[0] == 192:
+		return Block{Rule: "social", Description: "Social media is <not> allowed", Reference: "SEC-12"}, nil
+	}
+	return Block{}, nil
+}
+
+// TestHandler tests that the page names the rule denying the original
+// destination and how to request an exception
+func TestHandler(t *testing.T) {
+	testCases := []struct {
+		name     string
+		dst      string // Original destination, "" if not redirected
+		contact  string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:    "denied by a rule",
+			dst:     "192.0.2.10",
+			contact: "it@example.com",
+			want: []string{
+				"<dd>social</dd>",
+				"Social media is &lt;not&gt; allowed",
+				"SEC-12",
+				`<a href="mailto:it@example.com">it@example.com</a>`,
+			},
+		},
+		{
+			name:    "denied by default",
+			dst:     "203.0.113.5",
+			contact: "https://example.com/access",
+			want: []string{
+				"No rule allows this connection",
+				`<a href="https://example.com/access">`,
+			},
+		},
+		{
+			name:     "lookup failed",
+			dst:      "198.51.100.1",
+			want:     []string{"does not allow connections to <strong>blocked.example</strong>"},
+			dontWant: []string{"<dt>Rule</dt>", "request an exception"},
+		},
+		{
+			name:     "not redirected",
+			contact:  "the service desk",
+			want:     []string{"request an exception from\nthe service desk, naming the address above."},
+			dontWant: []string{"<dt>Rule</dt>", "<a href"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer(8081, tc.contact, fakePolicy{})
+			req := httptest.NewRequest(http.MethodGet, "http://blocked.example/path", nil)
+			req.RemoteAddr = "10.0.0.2:51234"
+			if tc.dst != "" {
+				req = req.WithContext(context.WithValue(req.Context(), originalDestinationKey{}, net.ParseIP(tc.dst)))
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("Expected status 403, got %d", rec.Code)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Expected Cache-Control no-store, got %q", got)
+			}
+			body := rec.Body.String()
+			for _, want := range tc.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("Expected page to contain %q:\n%s", want, body)
+				}
+			}
+			for _, dontWant := range tc.dontWant {
+				if strings.Contains(body, dontWant) {
+					t.Errorf("Expected page not to contain %q:\n%s", dontWant, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/cluster/clusterpb"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultReportInterval = 30 * time.Second
+	maxReconnectDelay     = time.Minute
+)
+
+// Backend is the filter an agent applies policies to
+type Backend interface {
+	Apply(cfg *config.Config) error
+	Status() filter.Status
+	Grants() []filter.Grant
+}
+
+// Agent receives the policy from the controller and reports its status
+type Agent struct {
+	config  *config.ClusterConfig
+	local   *config.Config // Source of the node-local sections
+	backend Backend
+	node    string
+	conn    *grpc.ClientConn
+	client  clusterpb.ControllerClient
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	applied  string // Version of the applied policy
+	applyErr error  // Why the latest policy could not be applied
+	rules    int
+}
+
+// NewAgent creates an agent for the cluster section of local
+func NewAgent(local *config.Config, backend Backend) (*Agent, error) {
+	cfg := local.Cluster
+	node := cfg.Node
+	if node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname for node name: %w", err)
+		}
+		node = hostname
+	}
+
+	creds := insecure.NewCredentials()
+	if cfg.CAFile != "" {
+		var err error
+		if creds, err = clientCredentials(cfg); err != nil {
+			return nil, err
+		}
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+	}
+	if cfg.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: cfg.Token, secure: cfg.CAFile != ""}))
+	}
+	conn, err := grpc.NewClient(cfg.Controller, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create controller client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Agent{
+		config:  cfg,
+		local:   local,
+		backend: backend,
+		node:    node,
+		conn:    conn,
+		client:  clusterpb.NewControllerClient(conn),
+		ctx:     ctx,
+		cancel:  cancel,
+		rules:   len(local.Rules),
+	}, nil
+}
+
+// Start follows the controller's policy and reports status in the
+// background; the local rules stay in effect until a policy arrives
+func (a *Agent) Start() {
+	go a.watch()
+	go a.reportLoop()
+	log.Printf("Cluster agent %s following controller %s", a.node, a.config.Controller)
+}
+
+// Stop disconnects from the controller
+func (a *Agent) Stop() error {
+	a.cancel()
+	return a.conn.Close()
+}
+
+// watch registers and applies policies from the controller, reconnecting
+// with backoff until stopped
+func (a *Agent) watch() {
+	delay := time.Second
+	for {
+		err := a.watchOnce()
+		if a.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Warning: lost controller %s: %v, reconnecting in %s", a.config.Controller, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-a.ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// watchOnce registers and applies policies until the stream ends
+func (a *Agent) watchOnce() error {
+	if _, err := a.client.Register(a.ctx, &clusterpb.RegisterRequest{Node: a.node}); err != nil {
+		return fmt.Errorf("failed to register: %w", err)
+	}
+
+	a.mu.Lock()
+	req := &clusterpb.WatchRequest{Node: a.node, Version: a.applied}
+	a.mu.Unlock()
+	stream, err := a.client.WatchPolicy(a.ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to watch policy: %w", err)
+	}
+
+	for {
+		policy, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		a.apply(policy)
+		a.report()
+	}
+}
+
+// apply applies a policy with the node-local sections of the local config
+func (a *Agent) apply(policy *clusterpb.Policy) {
+	err := func() error {
+		cfg, err := config.Parse(policy.Config)
+		if err != nil {
+			return err
+		}
+		cfg.Cluster, cfg.Admin, cfg.HA = a.local.Cluster, a.local.Admin, a.local.HA
+		if err := a.backend.Apply(cfg); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.rules = len(cfg.Rules)
+		a.mu.Unlock()
+		return nil
+	}()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applyErr = err
+	if err != nil {
+		log.Printf("Failed to apply policy version %s: %v", policy.Version, err)
+		return
+	}
+	a.applied = policy.Version
+	log.Printf("Applied policy version %s", policy.Version)
+}
+
+// reportLoop reports status periodically until stopped
+func (a *Agent) reportLoop() {
+	interval := a.config.ReportInterval.Std()
+	if interval == 0 {
+		interval = defaultReportInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.report()
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+// report sends the current status to the controller
+func (a *Agent) report() {
+	report := a.nodeReport()
+	ctx, cancel := context.WithTimeout(a.ctx, 10*time.Second)
+	defer cancel()
+	if _, err := a.client.Report(ctx, report); err != nil && a.ctx.Err() == nil {
+		log.Printf("Warning: failed to report status: %v", err)
+	}
+}
+
+// nodeReport builds the agent's status report
+func (a *Agent) nodeReport() *clusterpb.NodeReport {
+	status := a.backend.Status()
+	unresolved := 0
+	for _, domains := range status.Unresolved {
+		unresolved += len(domains)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := &clusterpb.NodeReport{
+		Node:           a.node,
+		AppliedVersion: a.applied,
+		Healthy:        a.applyErr == nil,
+		Degraded:       status.Degraded,
+		Counters: map[string]uint64{
+			"rules":              uint64(a.rules),
+			"grants":             uint64(len(a.backend.Grants())),
+			"unresolved_domains": uint64(unresolved),
+		},
+		Time: timestamppb.Now(),
+	}
+	if a.applyErr != nil {
+		report.Error = a.applyErr.Error()
+	}
+	return report
+}
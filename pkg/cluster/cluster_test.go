@@ -0,0 +1,345 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/cluster/clusterpb"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// fakeBackend records the applied policies
+type fakeBackend struct {
+	mu      sync.Mutex
+	applied []*config.Config
+}
+
+func (b *fakeBackend) Apply(cfg *config.Config) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.applied = append(b.applied, cfg)
+	return nil
+}
+
+func (b *fakeBackend) Status() filter.Status {
+	return filter.Status{}
+}
+
+func (b *fakeBackend) Grants() []filter.Grant {
+	return nil
+}
+
+func (b *fakeBackend) last() *config.Config {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.applied) == 0 {
+		return nil
+	}
+	return b.applied[len(b.applied)-1]
+}
+
+// startController serves a controller on a local port
+func startController(t *testing.T, token string) (*Controller, string) {
+	t.Helper()
+	controller := NewController(token)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := controller.Server(nil)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return controller, listener.Addr().String()
+}
+
+// policy returns a policy with a single rule
+func policy(name string) *config.Config {
+	return &config.Config{
+		Version: "1.0",
+		Rules:   []config.Rule{{Name: name, Action: config.ActionAllow, Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}}},
+	}
+}
+
+// waitFor polls cond until it holds or a timeout passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPolicyDistribution tests that agents apply pushed policies, keep
+// their local sections and are reported in sync
+func TestPolicyDistribution(t *testing.T) {
+	controller, addr := startController(t, "secret")
+	if err := controller.SetPolicy(policy("v1-rule"), "v1"); err != nil {
+		t.Fatalf("Failed to set policy: %v", err)
+	}
+
+	backend := &fakeBackend{}
+	local := policy("local-rule")
+	local.Cluster = &config.ClusterConfig{Controller: addr, Node: "edge-1", Token: "secret"}
+	local.Admin = &config.AdminConfig{Listen: "127.0.0.1:9090"}
+	agent, err := NewAgent(local, backend)
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.Start()
+	defer agent.Stop()
+
+	waitFor(t, "policy v1", func() bool {
+		cfg := backend.last()
+		return cfg != nil && cfg.Rules[0].Name == "v1-rule"
+	})
+	if cfg := backend.last(); cfg.Admin == nil || cfg.Cluster == nil {
+		t.Error("Expected the local admin and cluster sections to be kept")
+	}
+	waitFor(t, "node in sync", func() bool {
+		nodes := controller.Nodes()
+		return len(nodes) == 1 && nodes[0].InSync && nodes[0].Healthy
+	})
+
+	if err := controller.SetPolicy(policy("v2-rule"), "v2"); err != nil {
+		t.Fatalf("Failed to set policy: %v", err)
+	}
+	waitFor(t, "policy v2", func() bool {
+		return backend.last().Rules[0].Name == "v2-rule"
+	})
+	waitFor(t, "summary", func() bool {
+		summary := controller.Summary()
+		return summary.PolicyVersion == "v2" && summary.InSync == 1 && summary.Counters["rules"] == 1
+	})
+}
+
+// TestUnauthorizedAgent tests that agents without the token are refused
+func TestUnauthorizedAgent(t *testing.T) {
+	controller, addr := startController(t, "secret")
+	if err := controller.SetPolicy(policy("v1-rule"), "v1"); err != nil {
+		t.Fatalf("Failed to set policy: %v", err)
+	}
+
+	local := policy("local-rule")
+	local.Cluster = &config.ClusterConfig{Controller: addr, Node: "edge-1", Token: "guess"}
+	agent, err := NewAgent(local, &fakeBackend{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.Stop()
+
+	if err := agent.watchOnce(); err == nil {
+		t.Error("Expected registration to fail")
+	}
+	if nodes := controller.Nodes(); len(nodes) != 0 {
+		t.Errorf("Expected no nodes, got %+v", nodes)
+	}
+}
+
+// TestDashboard tests the dashboard API
+func TestDashboard(t *testing.T) {
+	controller := NewController("secret")
+
+	testCases := []struct {
+		name       string
+		target     string
+		token      string
+		wantStatus int
+	}{
+		{name: "nodes", target: "/v1/nodes", token: "secret", wantStatus: http.StatusOK},
+		{name: "summary", target: "/v1/summary", token: "secret", wantStatus: http.StatusOK},
+		{name: "missing token", target: "/v1/nodes", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			controller.Handler().ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("Expected status %d, got %d", tc.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for the SPIFFE ID, valid for 127.0.0.1, to
+// name.pem and name-key.pem and returns their paths
+func (ca *testCA) issue(t *testing.T, name, id string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	uri, _ := url.Parse(id)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// TestMutualTLS tests that agents are verified by their SPIFFE ID and that
+// rotated certificates are picked up without a restart
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	serverCert, serverKey := ca.issue(t, "controller", "spiffe://example.org/legion/controller")
+	creds, err := ServerCredentials(serverCert, serverKey, caFile, "example.org")
+	if err != nil {
+		t.Fatalf("Failed to load server credentials: %v", err)
+	}
+	controller := NewController("")
+	if err := controller.SetPolicy(policy("v1-rule"), "v1"); err != nil {
+		t.Fatalf("Failed to set policy: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := controller.Server(creds)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	testCases := []struct {
+		name         string
+		id           string // SPIFFE ID of the agent's certificate
+		controllerID string
+		wantErr      bool
+	}{
+		{name: "agent in trust domain", id: "spiffe://example.org/legion/edge-1", controllerID: "spiffe://example.org/legion/controller"},
+		{name: "verified by host name", id: "spiffe://example.org/legion/edge-1"},
+		{name: "agent in other trust domain", id: "spiffe://evil.example/legion/edge-1", wantErr: true},
+		{name: "unexpected controller", id: "spiffe://example.org/legion/edge-1", controllerID: "spiffe://example.org/other", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			certFile, keyFile := ca.issue(t, "agent", tc.id)
+			local := policy("local-rule")
+			local.Cluster = &config.ClusterConfig{
+				Controller:   listener.Addr().String(),
+				Node:         "edge-1",
+				CAFile:       caFile,
+				CertFile:     certFile,
+				KeyFile:      keyFile,
+				ControllerID: tc.controllerID,
+			}
+			agent, err := NewAgent(local, &fakeBackend{})
+			if err != nil {
+				t.Fatalf("Failed to create agent: %v", err)
+			}
+			defer agent.Stop()
+
+			_, err = agent.client.Register(agent.ctx, &clusterpb.RegisterRequest{Node: "edge-1"})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Register() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if nodes := controller.Nodes(); len(nodes) != 1 || nodes[0].Identity != tc.id {
+				t.Errorf("Expected node with identity %s, got %+v", tc.id, nodes)
+			}
+		})
+	}
+
+	// A certificate rewritten in place is used for the next connection
+	t.Run("rotation", func(t *testing.T) {
+		certFile, keyFile := ca.issue(t, "agent", "spiffe://example.org/legion/edge-1")
+		files, err := loadKeyPair(certFile, keyFile, caFile)
+		if err != nil {
+			t.Fatalf("Failed to load key pair: %v", err)
+		}
+		ca.issue(t, "agent", "spiffe://example.org/legion/edge-1-renewed")
+		later := time.Now().Add(time.Minute)
+		for _, path := range []string{certFile, keyFile} {
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatalf("Failed to touch %s: %v", path, err)
+			}
+		}
+		cert, _ := files.current()
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed to parse certificate: %v", err)
+		}
+		if id := spiffeID(leaf); id != "spiffe://example.org/legion/edge-1-renewed" {
+			t.Errorf("Expected the renewed certificate, got %s", id)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/cluster/clusterpb"
+	"github.com/skaegi/legion-router/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// staleAfter marks nodes that have not reported for this long
+const staleAfter = 2 * time.Minute
+
+// NodeStatus is the controller's view of an agent
+type NodeStatus struct {
+	Node           string            `json:"node"`
+	Address        string            `json:"address,omitempty"`
+	Identity       string            `json:"identity,omitempty"` // SPIFFE ID or name of the client certificate
+	Registered     time.Time         `json:"registered"`
+	LastReport     time.Time         `json:"last_report,omitempty"`
+	Connected      bool              `json:"connected"`
+	AppliedVersion string            `json:"applied_version,omitempty"`
+	InSync         bool              `json:"in_sync"`
+	Healthy        bool              `json:"healthy"`
+	Degraded       bool              `json:"degraded"`
+	Stale          bool              `json:"stale"`
+	Error          string            `json:"error,omitempty"`
+	Counters       map[string]uint64 `json:"counters,omitempty"`
+}
+
+// Summary aggregates the status of all agents
+type Summary struct {
+	PolicyVersion string            `json:"policy_version"`
+	Nodes         int               `json:"nodes"`
+	InSync        int               `json:"in_sync"`
+	Healthy       int               `json:"healthy"`
+	Stale         int               `json:"stale"`
+	Counters      map[string]uint64 `json:"counters"`
+}
+
+// Controller distributes the policy to agents and collects their status
+type Controller struct {
+	clusterpb.UnimplementedControllerServer
+
+	token string
+
+	mu      sync.Mutex
+	policy  *clusterpb.Policy
+	updated chan struct{} // Closed when the policy changes
+	nodes   map[string]*NodeStatus
+}
+
+// NewController creates a controller; agents must present token if set
+func NewController(token string) *Controller {
+	return &Controller{
+		token:   token,
+		updated: make(chan struct{}),
+		nodes:   make(map[string]*NodeStatus),
+	}
+}
+
+// LoadPolicy loads and validates the policy file at path and pushes it to
+// the agents; an invalid policy leaves the current one in place
+func (c *Controller) LoadPolicy(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read policy: %w", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	return c.SetPolicy(cfg, hex.EncodeToString(sum[:6]))
+}
+
+// SetPolicy pushes cfg to the agents as version
+func (c *Controller) SetPolicy(cfg *config.Config, version string) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode policy: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.policy != nil && c.policy.Version == version {
+		return nil
+	}
+	c.policy = &clusterpb.Policy{Version: version, Config: data}
+	close(c.updated)
+	c.updated = make(chan struct{})
+	log.Printf("Policy version %s ready for %d nodes", version, len(c.nodes))
+	return nil
+}
+
+// Server returns a gRPC server for the controller service, using creds for
+// TLS if set
+func (c *Controller) Server(creds credentials.TransportCredentials) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := c.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := c.authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(opts...)
+	clusterpb.RegisterControllerServer(server, c)
+	return server
+}
+
+// authorize checks the token of a call
+func (c *Controller) authorize(ctx context.Context) error {
+	if c.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), []byte("Bearer "+c.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing token")
+}
+
+// Register records an agent
+func (c *Controller) Register(ctx context.Context, req *clusterpb.RegisterRequest) (*clusterpb.RegisterResponse, error) {
+	if req.Node == "" {
+		return nil, status.Error(codes.InvalidArgument, "node name is required")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.nodeLocked(req.Node)
+	node.Registered = time.Now()
+	if p, ok := peer.FromContext(ctx); ok {
+		node.Address = p.Addr.String()
+	}
+	node.Identity = peerIdentity(ctx)
+	if node.Identity != "" {
+		log.Printf("Node %s registered from %s as %s", req.Node, node.Address, node.Identity)
+	} else {
+		log.Printf("Node %s registered from %s", req.Node, node.Address)
+	}
+	return &clusterpb.RegisterResponse{}, nil
+}
+
+// Report records an agent's status
+func (c *Controller) Report(ctx context.Context, report *clusterpb.NodeReport) (*clusterpb.ReportResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.nodes[report.Node]
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "node is not registered")
+	}
+	node.LastReport = time.Now()
+	node.AppliedVersion = report.AppliedVersion
+	node.Healthy = report.Healthy
+	node.Degraded = report.Degraded
+	node.Error = report.Error
+	node.Counters = report.Counters
+	return &clusterpb.ReportResponse{}, nil
+}
+
+// WatchPolicy streams the policy to an agent whenever it changes
+func (c *Controller) WatchPolicy(req *clusterpb.WatchRequest, stream clusterpb.Controller_WatchPolicyServer) error {
+	c.mu.Lock()
+	node, ok := c.nodes[req.Node]
+	if !ok {
+		c.mu.Unlock()
+		return status.Error(codes.FailedPrecondition, "node is not registered")
+	}
+	node.Connected = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		node.Connected = false
+		c.mu.Unlock()
+	}()
+
+	sent := req.Version
+	for {
+		c.mu.Lock()
+		policy, updated := c.policy, c.updated
+		c.mu.Unlock()
+
+		if policy != nil && policy.Version != sent {
+			if err := stream.Send(policy); err != nil {
+				return err
+			}
+			sent = policy.Version
+		}
+
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// nodeLocked returns the status of a node, adding it if new
+// Must be called with mu held
+func (c *Controller) nodeLocked(name string) *NodeStatus {
+	node, ok := c.nodes[name]
+	if !ok {
+		node = &NodeStatus{Node: name}
+		c.nodes[name] = node
+	}
+	return node
+}
+
+// Nodes returns the status of all agents ordered by name
+func (c *Controller) Nodes() []NodeStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	nodes := make([]NodeStatus, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		n := *node
+		n.InSync = c.policy != nil && n.AppliedVersion == c.policy.Version
+		n.Stale = n.LastReport.IsZero() || now.Sub(n.LastReport) > staleAfter
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node < nodes[j].Node
+	})
+	return nodes
+}
+
+// Summary aggregates the agents' status and counters
+func (c *Controller) Summary() Summary {
+	summary := Summary{Counters: make(map[string]uint64)}
+	for _, node := range c.Nodes() {
+		summary.Nodes++
+		if node.InSync {
+			summary.InSync++
+		}
+		if node.Healthy && !node.Stale {
+			summary.Healthy++
+		}
+		if node.Stale {
+			summary.Stale++
+		}
+		for name, value := range node.Counters {
+			summary.Counters[name] += value
+		}
+	}
+
+	c.mu.Lock()
+	if c.policy != nil {
+		summary.PolicyVersion = c.policy.Version
+	}
+	c.mu.Unlock()
+	return summary
+}
+
+// Handler returns the dashboard API
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+		c.serveJSON(w, r, c.Nodes())
+	})
+	mux.HandleFunc("/v1/summary", func(w http.ResponseWriter, r *http.Request) {
+		c.serveJSON(w, r, c.Summary())
+	})
+	return mux
+}
+
+// serveJSON writes v for authorized GET requests
+func (c *Controller) serveJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if c.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.token)) != 1 {
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: failed to write response: %v", err)
+	}
+}
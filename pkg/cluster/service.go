@@ -0,0 +1,24 @@
+// Package cluster splits legion-router into a controller holding the policy
+// and agents enforcing it. Agents register with the controller, receive
+// the policy over a gRPC stream and report what they applied.
+//
+// The service is defined in clusterpb/cluster.proto.
+package cluster
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative clusterpb/cluster.proto
+
+import "context"
+
+// tokenCredentials sends the cluster token with every call
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
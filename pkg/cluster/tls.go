@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// keyPair is a certificate and CA bundle read from files, read again when
+// the files change so that rotated certificates, such as SPIFFE SVIDs that
+// the SPIRE agent renews, are used for new connections without a restart
+type keyPair struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu    sync.Mutex
+	stamp string // Sizes and modification times of the loaded files
+	cert  *tls.Certificate
+	roots *x509.CertPool
+}
+
+// loadKeyPair reads the files that are set
+func loadKeyPair(certFile, keyFile, caFile string) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	stamp, err := k.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	if err := k.loadLocked(stamp); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// current returns the certificate and CA bundle, reading the files again
+// if they changed. Files that fail to load, as they may while being
+// rewritten, leave the previous ones in use.
+func (k *keyPair) current() (*tls.Certificate, *x509.CertPool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	stamp, err := k.fileStamp()
+	if err == nil && stamp != k.stamp {
+		err = k.loadLocked(stamp)
+		if err == nil {
+			log.Printf("Reloaded cluster TLS certificates")
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to reload cluster TLS certificates, keeping the current ones: %v", err)
+	}
+	return k.cert, k.roots
+}
+
+// fileStamp identifies the current content of the files
+func (k *keyPair) fileStamp() (string, error) {
+	var b strings.Builder
+	for _, path := range []string{k.certFile, k.keyFile, k.caFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// loadLocked reads the files
+// Must be called with mu held
+func (k *keyPair) loadLocked(stamp string) error {
+	var cert *tls.Certificate
+	if k.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		cert = &loaded
+	}
+	var roots *x509.CertPool
+	if k.caFile != "" {
+		data, err := os.ReadFile(k.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in CA file %s", k.caFile)
+		}
+	}
+	k.stamp, k.cert, k.roots = stamp, cert, roots
+	return nil
+}
+
+// ServerCredentials returns the TLS credentials of the controller. With
+// clientCAFile, agents must present a certificate it issued, and with
+// trustDomain also a SPIFFE ID in that trust domain. The files are read
+// again when they change.
+func ServerCredentials(certFile, keyFile, clientCAFile, trustDomain string) (credentials.TransportCredentials, error) {
+	files, err := loadKeyPair(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := files.current()
+			return cert, nil
+		},
+	}
+	if clientCAFile != "" {
+		// Verified in VerifyConnection, against the current CA bundle
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, roots := files.current()
+			leaf, err := verifyChain(cs.PeerCertificates, roots, x509.ExtKeyUsageClientAuth)
+			if err != nil {
+				return fmt.Errorf("invalid agent certificate: %w", err)
+			}
+			if trustDomain != "" && !strings.HasPrefix(spiffeID(leaf), "spiffe://"+trustDomain+"/") {
+				return fmt.Errorf("agent certificate has no SPIFFE ID in trust domain %s", trustDomain)
+			}
+			return nil
+		}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// clientCredentials returns the TLS credentials of an agent, verifying the
+// controller by its SPIFFE ID if configured, or else by its host name. The
+// files are read again when they change.
+func clientCredentials(cfg *config.ClusterConfig) (credentials.TransportCredentials, error) {
+	files, err := loadKeyPair(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(cfg.Controller)
+	if err != nil {
+		return nil, fmt.Errorf("invalid controller address %q: %w", cfg.Controller, err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		// Verified in VerifyConnection, against the current CA bundle
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, roots := files.current()
+			leaf, err := verifyChain(cs.PeerCertificates, roots, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return fmt.Errorf("invalid controller certificate: %w", err)
+			}
+			if cfg.ControllerID == "" {
+				return leaf.VerifyHostname(host)
+			}
+			if id := spiffeID(leaf); id != cfg.ControllerID {
+				return fmt.Errorf("controller certificate has SPIFFE ID %q, not %s", id, cfg.ControllerID)
+			}
+			return nil
+		},
+	}
+	if cfg.CertFile != "" {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := files.current()
+			return cert, nil
+		}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// verifyChain verifies the certificates a peer presented against roots and
+// returns the peer's own
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return certs[0], err
+}
+
+// spiffeID returns the SPIFFE ID of a certificate, "" if it has none
+func spiffeID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// peerIdentity returns the SPIFFE ID, or else the common name, of the
+// client certificate of a call, "" without one
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := info.State.PeerCertificates[0]
+	if id := spiffeID(cert); id != "" {
+		return id
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AdminConfig configures the admin API used for runtime operations such as
+// temporary access grants
+type AdminConfig struct {
+	// Listen is the address of the HTTP API, e.g. 127.0.0.1:9090
+	Listen string `yaml:"listen" json:"listen"`
+	// Token, if set, must be sent as a bearer token with every request
+	Token string `yaml:"token,omitempty" json:"token,omitempty"`
+	// MaxGrantTTL caps the lifetime of temporary grants (default 24h)
+	MaxGrantTTL Duration `yaml:"max_grant_ttl,omitempty" json:"max_grant_ttl,omitempty"`
+	// Knock opens a predefined grant when a knock sequence is received
+	Knock *KnockConfig `yaml:"knock,omitempty" json:"knock,omitempty"`
+	// Approval requires a second person to approve requested grants
+	Approval *ApprovalConfig `yaml:"approval,omitempty" json:"approval,omitempty"`
+	// AuditLog is a file that grant requests, approvals and revocations are
+	// appended to as JSON lines
+	AuditLog string `yaml:"audit_log,omitempty" json:"audit_log,omitempty"`
+	// UI serves a web UI showing the policy at /ui/; rules can be enabled
+	// and disabled from it only if Token is set
+	UI bool `yaml:"ui,omitempty" json:"ui,omitempty"`
+	// Users are the people and systems allowed to call the API, by token
+	// or client certificate, with the role each has. Token, if set, is an
+	// admin besides them.
+	Users []AdminUser `yaml:"users,omitempty" json:"users,omitempty"`
+	// TLS serves the API over HTTPS, verifying client certificates if
+	// configured
+	TLS *AdminTLSConfig `yaml:"tls,omitempty" json:"tls,omitempty"`
+}
+
+// Admin API roles; each may do what the previous ones may
+const (
+	// AdminRoleViewer reads the policy, status, events and metrics
+	AdminRoleViewer = "viewer"
+	// AdminRoleOperator also requests, approves and revokes grants
+	AdminRoleOperator = "operator"
+	// AdminRoleAdmin also enables and disables rules and tags and switches
+	// maintenance mode
+	AdminRoleAdmin = "admin"
+)
+
+// AdminUser is allowed to call the admin API with a role
+type AdminUser struct {
+	// Name is recorded in the audit log as who made a change
+	Name string `yaml:"name" json:"name"`
+	// Token identifies the user as a bearer token
+	Token string `yaml:"token,omitempty" json:"token,omitempty"`
+	// ClientCert identifies the user by the common name or a DNS, URI or
+	// email SAN of a client certificate signed by tls.client_ca_file
+	ClientCert string `yaml:"client_cert,omitempty" json:"client_cert,omitempty"`
+	Role       string `yaml:"role" json:"role"`
+	// Approver may approve grant requests made by other users; it needs
+	// the operator or admin role
+	Approver bool `yaml:"approver,omitempty" json:"approver,omitempty"`
+}
+
+// AdminTLSConfig configures HTTPS for the admin API
+type AdminTLSConfig struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// ClientCAFile verifies the client certificates users present
+	ClientCAFile string `yaml:"client_ca_file,omitempty" json:"client_ca_file,omitempty"`
+}
+
+// ApprovalConfig configures the approval of grant requests by the users
+// marked as approvers
+type ApprovalConfig struct {
+	// Timeout discards requests not approved in time (default 1h)
+	Timeout Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// KnockConfig configures a port knocking listener; a source that sends
+// datagrams to the Sequence of UDP ports in order within Window opens
+// a grant from itself to Destination and Port for TTL
+type KnockConfig struct {
+	// Listen are the internal addresses of the router the sequence ports
+	// are bound on, so that the upstream side can't knock
+	Listen      []string `yaml:"listen" json:"listen"`
+	Sequence    []uint16 `yaml:"sequence" json:"sequence"`
+	Window      Duration `yaml:"window,omitempty" json:"window,omitempty"`
+	Destination string   `yaml:"destination" json:"destination"`
+	Port        uint16   `yaml:"port" json:"port"`
+	TTL         Duration `yaml:"ttl" json:"ttl"`
+}
+
+// isLoopback reports whether the host of a listen address only accepts
+// local connections
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Validate checks if the admin configuration is valid
+func (a *AdminConfig) Validate() error {
+	host, _, err := net.SplitHostPort(a.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", a.Listen, err)
+	}
+	// Without authentication every caller is an admin, so only local ones
+	// may reach the API
+	if a.Token == "" && len(a.Users) == 0 && !isLoopback(host) {
+		return fmt.Errorf("a token or users are required unless listen is a loopback address")
+	}
+	if a.MaxGrantTTL < 0 {
+		return fmt.Errorf("max_grant_ttl must not be negative")
+	}
+
+	if t := a.TLS; t != nil && (t.CertFile == "" || t.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file are required")
+	}
+	tokens := make(map[string]bool)
+	for _, user := range a.Users {
+		if user.Name == "" {
+			return fmt.Errorf("users: a name is required")
+		}
+		switch user.Role {
+		case AdminRoleViewer, AdminRoleOperator, AdminRoleAdmin:
+		default:
+			return fmt.Errorf("users: %s: role must be 'viewer', 'operator' or 'admin'", user.Name)
+		}
+		if (user.Token == "") == (user.ClientCert == "") {
+			return fmt.Errorf("users: %s: either a token or a client_cert is required", user.Name)
+		}
+		if user.Approver && user.Role == AdminRoleViewer {
+			return fmt.Errorf("users: %s: approvers need the operator or admin role", user.Name)
+		}
+		if user.Approver && a.Approval == nil {
+			return fmt.Errorf("users: %s: approver needs approval to be configured", user.Name)
+		}
+		if user.ClientCert != "" && (a.TLS == nil || a.TLS.ClientCAFile == "") {
+			return fmt.Errorf("users: %s: a client_cert needs tls.client_ca_file", user.Name)
+		}
+		if user.Token != "" {
+			if tokens[user.Token] || user.Token == a.Token {
+				return fmt.Errorf("users: %s: tokens must be unique", user.Name)
+			}
+			tokens[user.Token] = true
+		}
+	}
+
+	if ap := a.Approval; ap != nil {
+		// Requesters and approvers are both users, so that the approver
+		// is checked against who authenticated the request rather than
+		// a name they claim
+		approvers := 0
+		for _, user := range a.Users {
+			if user.Approver {
+				approvers++
+			}
+		}
+		if approvers == 0 {
+			return fmt.Errorf("approval: at least one user must be an approver")
+		}
+		if ap.Timeout < 0 {
+			return fmt.Errorf("approval: timeout must not be negative")
+		}
+	}
+
+	if k := a.Knock; k != nil {
+		if len(k.Listen) == 0 {
+			return fmt.Errorf("knock: listen addresses are required")
+		}
+		for _, addr := range k.Listen {
+			if ip := net.ParseIP(addr); ip == nil || ip.IsUnspecified() {
+				return fmt.Errorf("knock: invalid listen address %q", addr)
+			}
+		}
+		if len(k.Sequence) < 2 {
+			return fmt.Errorf("knock: sequence needs at least two ports")
+		}
+		for _, port := range k.Sequence {
+			if port == 0 {
+				return fmt.Errorf("knock: invalid sequence port 0")
+			}
+		}
+		if net.ParseIP(k.Destination) == nil {
+			return fmt.Errorf("knock: invalid destination %q", k.Destination)
+		}
+		if k.Port == 0 {
+			return fmt.Errorf("knock: port is required")
+		}
+		if k.TTL <= 0 || k.Window < 0 {
+			return fmt.Errorf("knock: ttl must be positive and window not negative")
+		}
+	}
+	return nil
+}
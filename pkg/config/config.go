@@ -1,113 +1,3221 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the main configuration structure
 type Config struct {
-	Version string `yaml:"version" json:"version"`
-	Rules   []Rule `yaml:"rules" json:"rules"`
+	Version string    `yaml:"version" json:"version"`
+	DNS     DNSConfig `yaml:"dns,omitempty" json:"dns,omitempty"`
+	// Inspection enables inspection of TLS connections no address matched
+	Inspection *InspectionConfig `yaml:"inspection,omitempty" json:"inspection,omitempty"`
+	// InspectionExemptSources bypass SNI inspection and l7 rules, e.g.
+	// devices with pinned certificates or broken TLS stacks (IPs or
+	// CIDRs); their traffic is decided by the other rules alone
+	InspectionExemptSources []string `yaml:"inspection_exempt_sources,omitempty" json:"inspection_exempt_sources,omitempty"`
+	// Admin enables the admin API
+	Admin *AdminConfig `yaml:"admin,omitempty" json:"admin,omitempty"`
+	// Cluster makes the router an agent receiving its policy from a
+	// controller
+	Cluster *ClusterConfig `yaml:"cluster,omitempty" json:"cluster,omitempty"`
+	// HA pairs the router with a standby that takes over on failover
+	HA *HAConfig `yaml:"ha,omitempty" json:"ha,omitempty"`
+	// Maintenance is a policy the router can be switched to for a while
+	Maintenance *MaintenanceConfig `yaml:"maintenance,omitempty" json:"maintenance,omitempty"`
+	// Rollout applies changes to this config gradually when it is reloaded
+	Rollout *RolloutConfig `yaml:"rollout,omitempty" json:"rollout,omitempty"`
+	// VLANs are 802.1Q subinterfaces of downstream trunks that rules can
+	// be scoped to
+	VLANs []VLANConfig `yaml:"vlans,omitempty" json:"vlans,omitempty"`
+	// VRFs are routing domains that rules can be scoped to
+	VRFs []VRFConfig `yaml:"vrfs,omitempty" json:"vrfs,omitempty"`
+	// Routes are static routes installed while the router runs
+	Routes []RouteConfig `yaml:"routes,omitempty" json:"routes,omitempty"`
+	// Profiles are groups of sources, such as containers, that rules can
+	// be scoped to
+	Profiles []ProfileConfig `yaml:"profiles,omitempty" json:"profiles,omitempty"`
+	// PortGroups name lists of ports, of one protocol if prefixed with it
+	// such as tcp/80,443, that rules name in egress ports
+	PortGroups map[string]string `yaml:"port_groups,omitempty" json:"port_groups,omitempty"`
+	// Docker assigns running containers to profiles by label
+	Docker *DockerConfig `yaml:"docker,omitempty" json:"docker,omitempty"`
+	// Discovery configures the service registries rules can name services
+	// of as destinations
+	Discovery *DiscoveryConfig `yaml:"discovery,omitempty" json:"discovery,omitempty"`
+	// IPRanges configures the published cloud ranges named in egress ips
+	IPRanges *IPRangesConfig `yaml:"ip_ranges,omitempty" json:"ip_ranges,omitempty"`
+	// ASNPrefixes configures where the prefixes of egress asns come from
+	ASNPrefixes *ASNPrefixesConfig `yaml:"asn_prefixes,omitempty" json:"asn_prefixes,omitempty"`
+	// BGP learns the prefixes of @bgp groups in egress ips from peers such
+	// as a route server
+	BGP *BGPConfig `yaml:"bgp,omitempty" json:"bgp,omitempty"`
+	// Chain places the ruleset in netfilter, so that the router can run
+	// alongside other firewall managers such as firewalld or kube-proxy
+	Chain *ChainConfig `yaml:"chain,omitempty" json:"chain,omitempty"`
+	// Lenient skips the parts of a rule that fail to build, such as an
+	// invalid port or address, with a warning; by default such a rule
+	// fails the apply and the previous ruleset is kept
+	Lenient bool `yaml:"lenient,omitempty" json:"lenient,omitempty"`
+	// RejectShadowedRules fails validation of a policy with a rule that can
+	// never match, as an earlier rule with the same or a stronger verdict
+	// matches all its traffic
+	RejectShadowedRules bool `yaml:"reject_shadowed_rules,omitempty" json:"reject_shadowed_rules,omitempty"`
+	// OnShutdown is what happens to the ruleset when the router stops:
+	// open (default) removes it, closed replaces it with a deny-all and
+	// keep leaves it in place
+	OnShutdown ShutdownPolicy `yaml:"on_shutdown,omitempty" json:"on_shutdown,omitempty"`
+	// ConflictPolicy is which rule decides traffic both allow and deny
+	// rules match: first-match (default) lets the first in order decide,
+	// deny-overrides lets any deny rule deny it and allow-overrides any
+	// allow rule allow it
+	ConflictPolicy ConflictPolicy `yaml:"conflict_policy,omitempty" json:"conflict_policy,omitempty"`
+	// Persist also writes the ruleset to an nft script that the system's
+	// nftables service loads at boot, so that the policy survives a crash
+	// or reboot until the router starts again
+	Persist *PersistConfig `yaml:"persist,omitempty" json:"persist,omitempty"`
+	// MetadataProtection blocks the cloud instance metadata service
+	MetadataProtection *MetadataProtectionConfig `yaml:"metadata_protection,omitempty" json:"metadata_protection,omitempty"`
+	// Hardening drops invalid and spoofed packets ahead of rules and grants
+	Hardening *HardeningConfig `yaml:"hardening,omitempty" json:"hardening,omitempty"`
+	// RateLimit limits the rate of new connections ahead of rules and
+	// grants
+	RateLimit *RateLimitConfig `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	// Ban drops all traffic of the sources hitting deny rules too often,
+	// for a while
+	Ban *BanConfig `yaml:"ban,omitempty" json:"ban,omitempty"`
+	// NAT scopes the masquerading of forwarded traffic, by default all of
+	// it
+	NAT *NATConfig `yaml:"nat,omitempty" json:"nat,omitempty"`
+	// UPnP lets internal hosts forward ports to themselves through UPnP
+	// IGD and NAT-PMP, within the limits it sets
+	UPnP *UPnPConfig `yaml:"upnp,omitempty" json:"upnp,omitempty"`
+	// BlockPage redirects denied HTTP connections to a page explaining
+	// which rule denied them, instead of dropping them silently
+	BlockPage *BlockPageConfig `yaml:"block_page,omitempty" json:"block_page,omitempty"`
+	// Honeypot redirects TCP connections to denied targets, such as the
+	// metadata service, to a listener recording what they send
+	Honeypot *HoneypotConfig `yaml:"honeypot,omitempty" json:"honeypot,omitempty"`
+	// ConnectionLog logs every new connection an allow rule accepts, as
+	// an egress audit trail
+	ConnectionLog *ConnectionLogConfig `yaml:"connection_log,omitempty" json:"connection_log,omitempty"`
+	// Events stores the logged connections and the reloads in a database
+	// on the router, queried with `legion-router query`
+	Events *EventsConfig `yaml:"events,omitempty" json:"events,omitempty"`
+	// DecisionLog records a sample of the connection log's verdicts in a
+	// binary file, replayed with `legion-router analyze`
+	DecisionLog *DecisionLogConfig `yaml:"decision_log,omitempty" json:"decision_log,omitempty"`
+	// Metrics samples the rule counters for dashboards, served by the
+	// admin API as a Grafana JSON datasource
+	Metrics *MetricsConfig `yaml:"metrics,omitempty" json:"metrics,omitempty"`
+	Rules   []Rule         `yaml:"rules" json:"rules"`
+	// Tests are expected verdicts checked by `legion-router test`; the
+	// router ignores them
+	Tests []PolicyTest `yaml:"tests,omitempty" json:"tests,omitempty"`
+}
+
+// VLANConfig describes a VLAN subinterface
+type VLANConfig struct {
+	ID uint16 `yaml:"id" json:"id"`
+	// Parent is the trunk interface carrying the tagged traffic
+	Parent string `yaml:"parent" json:"parent"`
+	// Name of the subinterface (default <parent>.<id>)
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Create creates the subinterface if it does not exist; otherwise it
+	// must already be set up
+	Create bool `yaml:"create,omitempty" json:"create,omitempty"`
+	// Addresses are assigned to a created subinterface, e.g. the gateway
+	// address of the VLAN (CIDR notation)
+	Addresses []string `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+}
+
+// InterfaceName returns the name of the subinterface
+func (v VLANConfig) InterfaceName() string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return fmt.Sprintf("%s.%d", v.Parent, v.ID)
+}
+
+// VLANInterface returns the subinterface name of VLAN id
+func (c *Config) VLANInterface(id uint16) (string, bool) {
+	for _, v := range c.VLANs {
+		if v.ID == id {
+			return v.InterfaceName(), true
+		}
+	}
+	return "", false
+}
+
+// VRFConfig describes a VRF device
+type VRFConfig struct {
+	// Name of the VRF device
+	Name string `yaml:"name" json:"name"`
+	// Table is the routing table of a created VRF
+	Table uint32 `yaml:"table,omitempty" json:"table,omitempty"`
+	// Create creates the VRF if it does not exist; otherwise it must
+	// already be set up
+	Create bool `yaml:"create,omitempty" json:"create,omitempty"`
+	// Interfaces are enslaved to a created VRF
+	Interfaces []string `yaml:"interfaces,omitempty" json:"interfaces,omitempty"`
+}
+
+// VRF returns the VRF named name
+func (c *Config) VRF(name string) (VRFConfig, bool) {
+	for _, v := range c.VRFs {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return VRFConfig{}, false
+}
+
+// RouteConfig describes a static route
+type RouteConfig struct {
+	// Destination is a CIDR, an IP or "default"
+	Destination string `yaml:"destination" json:"destination"`
+	// Gateway is the next hop; routes without one are on-link
+	Gateway string `yaml:"gateway,omitempty" json:"gateway,omitempty"`
+	// Interface the route leaves through
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+	// Metric orders routes to the same destination, lowest first
+	Metric int `yaml:"metric,omitempty" json:"metric,omitempty"`
+	// VRF installs the route in the table of a VRF listed under vrfs
+	// instead of the main table
+	VRF string `yaml:"vrf,omitempty" json:"vrf,omitempty"`
+}
+
+// Network returns the destination of the route; "default" is the default
+// route of the gateway's address family
+func (r RouteConfig) Network() (*net.IPNet, error) {
+	if r.Destination == "default" {
+		if gw := net.ParseIP(r.Gateway); gw != nil && gw.To4() == nil {
+			return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, nil
+		}
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, nil
+	}
+	if ip := net.ParseIP(r.Destination); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %q: %w", r.Destination, err)
+	}
+	return network, nil
+}
+
+// ProfileConfig describes a group of sources
+type ProfileConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Sources are static source addresses (IPs or CIDRs) in the profile,
+	// in addition to the containers assigned to it
+	Sources []string `yaml:"sources,omitempty" json:"sources,omitempty"`
+	// Hosts are names in the DNS proxy's local zones, e.g. the hostnames
+	// of DHCP clients, whose addresses are sources of the profile
+	Hosts []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+// Profile returns the profile named name
+func (c *Config) Profile(name string) (ProfileConfig, bool) {
+	for _, p := range c.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ProfileConfig{}, false
+}
+
+// DockerConfig configures the Docker events watcher, which adds the
+// addresses of containers labeled with a profile name to that profile
+type DockerConfig struct {
+	// Socket is the Docker API socket (default /var/run/docker.sock)
+	Socket string `yaml:"socket,omitempty" json:"socket,omitempty"`
+	// Label holds the profile name (default legion.policy)
+	Label string `yaml:"label,omitempty" json:"label,omitempty"`
+}
+
+// DiscoveryConfig configures service discovery
+type DiscoveryConfig struct {
+	// Interval between refreshes of service endpoints (default 30s)
+	Interval Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// Consul is the Consul agent services are looked up in
+	Consul *ConsulDiscoveryConfig `yaml:"consul,omitempty" json:"consul,omitempty"`
+	// Kubernetes is the cluster whose EndpointSlices are followed
+	Kubernetes *KubernetesDiscoveryConfig `yaml:"kubernetes,omitempty" json:"kubernetes,omitempty"`
+}
+
+// ConsulDiscoveryConfig configures the Consul catalog
+type ConsulDiscoveryConfig struct {
+	// Address of the Consul HTTP API (default 127.0.0.1:8500)
+	Address string `yaml:"address,omitempty" json:"address,omitempty"`
+	// TLS connects over HTTPS
+	TLS bool `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// Token is the ACL token (default $CONSUL_HTTP_TOKEN)
+	Token string `yaml:"token,omitempty" json:"token,omitempty"`
+	// Datacenter to look services up in (default the agent's)
+	Datacenter string `yaml:"datacenter,omitempty" json:"datacenter,omitempty"`
+}
+
+// KubernetesDiscoveryConfig configures the Kubernetes API
+type KubernetesDiscoveryConfig struct {
+	// Kubeconfig to connect with; the pod's service account is used if
+	// empty
+	Kubeconfig string `yaml:"kubeconfig,omitempty" json:"kubeconfig,omitempty"`
+}
+
+// IPRangesConfig configures the download of published cloud IP ranges
+type IPRangesConfig struct {
+	// Refresh is the time between downloads (default 24h)
+	Refresh Duration `yaml:"refresh,omitempty" json:"refresh,omitempty"`
+	// CacheDir keeps the last downloaded ranges, so that they are available
+	// at startup while a provider can't be reached
+	CacheDir string `yaml:"cache_dir,omitempty" json:"cache_dir,omitempty"`
+	// AWSURL and GCPURL override the published locations
+	AWSURL string `yaml:"aws_url,omitempty" json:"aws_url,omitempty"`
+	GCPURL string `yaml:"gcp_url,omitempty" json:"gcp_url,omitempty"`
+	// AzureURL is the Service Tags file; its location changes with every
+	// weekly release, so it is required for @azure groups
+	AzureURL string `yaml:"azure_url,omitempty" json:"azure_url,omitempty"`
+	// FullBogons downloads Team Cymru's full bogons for @bogons, which adds
+	// the address space not yet allocated to DefaultBogons
+	FullBogons bool `yaml:"full_bogons,omitempty" json:"full_bogons,omitempty"`
+	// BogonsURLs override the locations of the full bogons, one list of
+	// prefixes per line each
+	BogonsURLs []string `yaml:"bogons_urls,omitempty" json:"bogons_urls,omitempty"`
+}
+
+// ASNPrefixesConfig configures the prefix database of autonomous systems
+type ASNPrefixesConfig struct {
+	// Refresh is the time between updates (default 24h)
+	Refresh Duration `yaml:"refresh,omitempty" json:"refresh,omitempty"`
+	// CacheDir keeps the last downloaded prefixes, so that they are
+	// available at startup while RIPEstat can't be reached
+	CacheDir string `yaml:"cache_dir,omitempty" json:"cache_dir,omitempty"`
+	// URL overrides the RIPEstat announced-prefixes endpoint
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// File is a prefix table, one "<prefix> <asn>" per line as extracted
+	// from MRT dumps (e.g. pyasn's ipasn files), read instead of RIPEstat
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+}
+
+// defaultBGPListen is the address peers connect to
+const defaultBGPListen = ":179"
+
+// BGPConfig configures the BGP sessions prefixes are learned from. The
+// router only listens: peers connect to it and it announces nothing.
+type BGPConfig struct {
+	// LocalAS is the autonomous system the router identifies as
+	LocalAS uint32 `yaml:"local_as" json:"local_as"`
+	// RouterID is the BGP identifier, an IPv4 address
+	RouterID string `yaml:"router_id" json:"router_id"`
+	// Listen is the address peers connect to (default :179)
+	Listen string `yaml:"listen,omitempty" json:"listen,omitempty"`
+	// HoldTime is proposed to peers (default 90s)
+	HoldTime Duration `yaml:"hold_time,omitempty" json:"hold_time,omitempty"`
+	// Neighbors are the peers allowed to connect
+	Neighbors []BGPNeighborConfig `yaml:"neighbors" json:"neighbors"`
+	// Groups select learned prefixes for @bgp:<name> in egress ips
+	Groups []BGPGroupConfig `yaml:"groups" json:"groups"`
+}
+
+// BGPNeighborConfig describes a peer
+type BGPNeighborConfig struct {
+	Address string `yaml:"address" json:"address"`
+	PeerAS  uint32 `yaml:"peer_as" json:"peer_as"`
+}
+
+// BGPGroupConfig selects the learned prefixes of a group; a prefix must
+// match every setting given
+type BGPGroupConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Neighbors limits the group to prefixes learned from these peers
+	Neighbors []string `yaml:"neighbors,omitempty" json:"neighbors,omitempty"`
+	// Communities limits the group to prefixes tagged with any of these
+	// communities, e.g. 64500:100
+	Communities []string `yaml:"communities,omitempty" json:"communities,omitempty"`
+	// OriginASNs limits the group to prefixes originated by any of these
+	// autonomous systems
+	OriginASNs []string `yaml:"origin_asns,omitempty" json:"origin_asns,omitempty"`
+}
+
+// EffectiveListen returns the address peers connect to
+func (c *BGPConfig) EffectiveListen() string {
+	if c.Listen != "" {
+		return c.Listen
+	}
+	return defaultBGPListen
+}
+
+// Group returns the group named name
+func (c *BGPConfig) Group(name string) (BGPGroupConfig, bool) {
+	for _, g := range c.Groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return BGPGroupConfig{}, false
+}
+
+// Neighbor returns the peer with address addr
+func (c *BGPConfig) Neighbor(addr net.IP) (BGPNeighborConfig, bool) {
+	for _, n := range c.Neighbors {
+		if net.ParseIP(n.Address).Equal(addr) {
+			return n, true
+		}
+	}
+	return BGPNeighborConfig{}, false
+}
+
+// Validate checks the BGP settings
+func (c *BGPConfig) Validate() error {
+	if c.LocalAS == 0 {
+		return fmt.Errorf("local_as is required")
+	}
+	if ip := net.ParseIP(c.RouterID); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("router_id must be an IPv4 address")
+	}
+	if _, _, err := net.SplitHostPort(c.EffectiveListen()); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", c.Listen, err)
+	}
+	// Peers may propose 0 for no keepalives, otherwise at least 3s
+	if c.HoldTime != 0 && (c.HoldTime.Std() < 3*time.Second || c.HoldTime.Std() > 65535*time.Second) {
+		return fmt.Errorf("hold_time must be between 3s and 65535s")
+	}
+	if len(c.Neighbors) == 0 {
+		return fmt.Errorf("at least one neighbor is required")
+	}
+	neighbors := make(map[string]bool)
+	for _, n := range c.Neighbors {
+		ip := net.ParseIP(n.Address)
+		if ip == nil {
+			return fmt.Errorf("invalid neighbor address %q", n.Address)
+		}
+		if neighbors[ip.String()] {
+			return fmt.Errorf("neighbor %s is defined twice", n.Address)
+		}
+		neighbors[ip.String()] = true
+		if n.PeerAS == 0 {
+			return fmt.Errorf("neighbor %s: peer_as is required", n.Address)
+		}
+	}
+	names := make(map[string]bool)
+	for _, g := range c.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("group name is required")
+		}
+		if names[g.Name] {
+			return fmt.Errorf("group %s is defined twice", g.Name)
+		}
+		names[g.Name] = true
+		for _, n := range g.Neighbors {
+			if ip := net.ParseIP(n); ip == nil || !neighbors[ip.String()] {
+				return fmt.Errorf("group %s: %s is not a neighbor", g.Name, n)
+			}
+		}
+		for _, community := range g.Communities {
+			if _, err := ParseCommunity(community); err != nil {
+				return fmt.Errorf("group %s: %w", g.Name, err)
+			}
+		}
+		for _, asn := range g.OriginASNs {
+			if _, err := ParseASN(asn); err != nil {
+				return fmt.Errorf("group %s: %w", g.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseCommunity parses a BGP community such as 64500:100
+func ParseCommunity(s string) (uint32, error) {
+	asn, value, ok := strings.Cut(s, ":")
+	high, err := strconv.ParseUint(asn, 10, 16)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid community %q", s)
+	}
+	low, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q", s)
+	}
+	return uint32(high)<<16 | uint32(low), nil
+}
+
+// ParseASN parses an autonomous system number such as AS15169 or 15169
+func ParseASN(s string) (uint32, error) {
+	digits := s
+	if len(s) > 2 && strings.EqualFold(s[:2], "as") {
+		digits = s[2:]
+	}
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid asn %q", s)
+	}
+	return uint32(n), nil
+}
+
+// ParsePortRange parses an egress port, a single port or a range such as
+// 8000-9000; a single port is returned as a range of one
+func ParsePortRange(s string) (start, end uint16, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err = parsePort(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return start, start, nil
+	}
+	end, err = parsePort(last)
+	if err != nil || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return start, end, nil
+}
+
+// ParseLength parses a packet length matcher into the lengths it matches,
+// in bytes: ">1400" for longer packets, "<100" for shorter ones, "1500" for
+// one length or "1400-1500" for a range
+func ParseLength(s string) (min, max uint16, err error) {
+	invalid := fmt.Errorf("invalid length %q: use >N, <N, N or N-M", s)
+	parse := func(n string) (uint16, error) {
+		v, err := strconv.ParseUint(strings.TrimSpace(n), 10, 16)
+		if err != nil {
+			return 0, invalid
+		}
+		return uint16(v), nil
+	}
+	switch {
+	case strings.HasPrefix(s, ">"):
+		n, err := parse(s[1:])
+		if err != nil || n == math.MaxUint16 {
+			return 0, 0, invalid
+		}
+		return n + 1, math.MaxUint16, nil
+	case strings.HasPrefix(s, "<"):
+		n, err := parse(s[1:])
+		if err != nil || n <= 1 {
+			return 0, 0, invalid
+		}
+		return 0, n - 1, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	if min, err = parse(first); err != nil || min == 0 {
+		return 0, 0, invalid
+	}
+	if !isRange {
+		return min, min, nil
+	}
+	if max, err = parse(last); err != nil || max < min {
+		return 0, 0, invalid
+	}
+	return min, max, nil
+}
+
+// rateUnits are the periods of a rate, as nft names them
+var rateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// ParseRate parses a rate such as "100/second" into the count and period
+func ParseRate(s string) (uint64, time.Duration, error) {
+	count, unit, ok := strings.Cut(s, "/")
+	per, known := rateUnits[strings.TrimSpace(unit)]
+	n, err := strconv.ParseUint(strings.TrimSpace(count), 10, 32)
+	if !ok || !known || err != nil || n == 0 {
+		return 0, 0, fmt.Errorf("invalid rate %q: use N/second, N/minute, N/hour or N/day", s)
+	}
+	return n, per, nil
+}
+
+// parsePort parses a port number from 1 to 65535
+func parsePort(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(n), nil
+}
+
+// PortGroup is a named list of ports, of one protocol if set
+type PortGroup struct {
+	Protocol Protocol
+	Ports    []string
+}
+
+// IsPortGroup reports whether an egress ports entry names a port group
+// rather than a port or range
+func IsPortGroup(s string) bool {
+	return s != "" && (s[0] < '0' || s[0] > '9')
+}
+
+// ParsePortGroup parses the definition of a port group: ports and ranges
+// separated by commas, optionally after a protocol such as tcp/80,443
+func ParsePortGroup(s string) (PortGroup, error) {
+	var group PortGroup
+	list := s
+	if proto, rest, ok := strings.Cut(s, "/"); ok {
+		group.Protocol, list = Protocol(strings.TrimSpace(proto)), rest
+		if group.Protocol != ProtocolTCP && group.Protocol != ProtocolUDP {
+			return PortGroup{}, fmt.Errorf("invalid port group %q: the protocol must be tcp or udp", s)
+		}
+	}
+	for _, port := range strings.Split(list, ",") {
+		port = strings.TrimSpace(port)
+		if _, _, err := ParsePortRange(port); err != nil {
+			return PortGroup{}, fmt.Errorf("invalid port group %q: %w", s, err)
+		}
+		group.Ports = append(group.Ports, port)
+	}
+	return group, nil
+}
+
+// DefaultMetadataDestinations are the link-local ranges and addresses
+// cloud providers serve instance metadata on
+var DefaultMetadataDestinations = []string{
+	"169.254.0.0/16",     // IPv4 link-local, incl. AWS, GCP, Azure and OCI
+	"100.100.100.200/32", // Alibaba Cloud
+	"fd00:ec2::254/128",  // AWS IPv6
+	"fd20:ce::254/128",   // GCP IPv6
+}
+
+// MetadataProtectionConfig blocks traffic to the instance metadata service
+// on every path, ahead of rules and grants
+type MetadataProtectionConfig struct {
+	// Destinations replaces the blocked ranges (default
+	// DefaultMetadataDestinations)
+	Destinations []string `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+	// ExemptSources may still reach the metadata service, e.g. hosts that
+	// need instance credentials (IPs or CIDRs)
+	ExemptSources []string `yaml:"exempt_sources,omitempty" json:"exempt_sources,omitempty"`
+}
+
+// EffectiveDestinations returns the blocked ranges
+func (m *MetadataProtectionConfig) EffectiveDestinations() []string {
+	if len(m.Destinations) == 0 {
+		return DefaultMetadataDestinations
+	}
+	return m.Destinations
+}
+
+// Validate checks that the destinations and exempt sources are addresses
+func (m *MetadataProtectionConfig) Validate() error {
+	for _, dst := range m.Destinations {
+		if !isAddress(dst) {
+			return fmt.Errorf("invalid destination %q", dst)
+		}
+	}
+	for _, src := range m.ExemptSources {
+		if !isAddress(src) {
+			return fmt.Errorf("invalid exempt source %q", src)
+		}
+	}
+	return nil
+}
+
+// NATConfig scopes masquerading, so that traffic between internal subnets
+// keeps its source address for the ACLs downstream
+type NATConfig struct {
+	// ExcludeDestinations are not masqueraded to (IPs or CIDRs), e.g. the
+	// RFC 1918 ranges
+	ExcludeDestinations []string `yaml:"exclude_destinations,omitempty" json:"exclude_destinations,omitempty"`
+	// Interfaces limits masquerading to traffic leaving these interfaces,
+	// e.g. the uplink (default all)
+	Interfaces []string `yaml:"interfaces,omitempty" json:"interfaces,omitempty"`
+	// Forwards forward connections to ports of the router to internal
+	// hosts
+	Forwards []PortForward `yaml:"forwards,omitempty" json:"forwards,omitempty"`
+}
+
+// PortForward forwards connections to a port of the router to an internal
+// host. The forwarded connections pass the rules with the internal host as
+// their destination.
+type PortForward struct {
+	// Protocol is tcp or udp (default tcp)
+	Protocol string `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	Port     uint16 `yaml:"port" json:"port"`
+	// Address limits the forward to one address of the router (default
+	// any)
+	Address string `yaml:"address,omitempty" json:"address,omitempty"`
+	// Interface limits the forward to connections arriving on it, e.g. the
+	// uplink
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+	// To is the internal host as an address, or address:port to change the
+	// port
+	To string `yaml:"to" json:"to"`
+	// Hairpin also forwards the connections internal clients make to the
+	// router's address, masquerading them so that the replies return
+	// through the router; it needs Interface to tell them apart
+	Hairpin bool `yaml:"hairpin,omitempty" json:"hairpin,omitempty"`
+}
+
+// Target returns the internal address and port connections are forwarded
+// to
+func (p PortForward) Target() (net.IP, uint16, error) {
+	host, port := p.To, p.Port
+	if h, ps, err := net.SplitHostPort(p.To); err == nil {
+		parsed, err := strconv.ParseUint(ps, 10, 16)
+		if err != nil || parsed == 0 {
+			return nil, 0, fmt.Errorf("invalid port in %q", p.To)
+		}
+		host, port = h, uint16(parsed)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid target %q: an address is required", p.To)
+	}
+	return ip, port, nil
+}
+
+// EffectiveProtocol returns the forwarded protocol
+func (p PortForward) EffectiveProtocol() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+// Validate checks a port forward
+func (p PortForward) Validate() error {
+	if p.Protocol != "" && p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("protocol must be 'tcp' or 'udp'")
+	}
+	if p.Port == 0 {
+		return fmt.Errorf("port is required")
+	}
+	to, _, err := p.Target()
+	if err != nil {
+		return err
+	}
+	if p.Address != "" {
+		address := net.ParseIP(p.Address)
+		if address == nil {
+			return fmt.Errorf("invalid address %q", p.Address)
+		}
+		if (address.To4() == nil) != (to.To4() == nil) {
+			return fmt.Errorf("address %s and target %s are of different families", p.Address, p.To)
+		}
+	}
+	if len(p.Interface) > 15 {
+		return fmt.Errorf("invalid interface name %q", p.Interface)
+	}
+	if p.Hairpin && p.Interface == "" {
+		return fmt.Errorf("hairpin needs the interface the forward is reached on from outside")
+	}
+	return nil
+}
+
+// DefaultBogons are the ranges no packet from the internet comes from:
+// reserved, private, documentation and multicast ranges
+var DefaultBogons = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/3", // Multicast and reserved
+	"::/128",
+	"::1/128",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"fec0::/10",
+	"ff00::/8",
+}
+
+// HardeningConfig drops invalid and spoofed packets ahead of rules and
+// grants. Each protection is on unless set to false, but bogon sources
+// are only dropped on the WAN interfaces listed.
+type HardeningConfig struct {
+	// DropInvalid drops packets conntrack can't tie to a connection
+	DropInvalid *bool `yaml:"drop_invalid,omitempty" json:"drop_invalid,omitempty"`
+	// ReversePath drops packets whose source isn't routed back through the
+	// interface they arrived on, as a strict rp_filter does
+	ReversePath *bool `yaml:"reverse_path,omitempty" json:"reverse_path,omitempty"`
+	// TCPFlags drops TCP packets with flags no stack sends together, such
+	// as SYN and FIN, and new connections not opened with a SYN
+	TCPFlags *bool `yaml:"tcp_flags,omitempty" json:"tcp_flags,omitempty"`
+	// WANInterfaces drops packets from bogon sources arriving on these
+	// interfaces, e.g. the uplink
+	WANInterfaces []string `yaml:"wan_interfaces,omitempty" json:"wan_interfaces,omitempty"`
+	// Bogons replaces the sources dropped on the WAN interfaces (default
+	// the @bogons group)
+	Bogons []string `yaml:"bogons,omitempty" json:"bogons,omitempty"`
+}
+
+// DropsInvalid reports whether packets in the invalid ct state are dropped
+func (h *HardeningConfig) DropsInvalid() bool {
+	return h.DropInvalid == nil || *h.DropInvalid
+}
+
+// ChecksReversePath reports whether spoofed sources are dropped
+func (h *HardeningConfig) ChecksReversePath() bool {
+	return h.ReversePath == nil || *h.ReversePath
+}
+
+// ChecksTCPFlags reports whether TCP packets with bogus flags are dropped
+func (h *HardeningConfig) ChecksTCPFlags() bool {
+	return h.TCPFlags == nil || *h.TCPFlags
+}
+
+// DropsBogonGroup reports whether the sources dropped on the WAN
+// interfaces are the @bogons group
+func (h *HardeningConfig) DropsBogonGroup() bool {
+	return len(h.WANInterfaces) > 0 && len(h.Bogons) == 0
+}
+
+// Validate checks that the WAN interfaces are names and the bogons are
+// addresses
+func (h *HardeningConfig) Validate() error {
+	for _, name := range h.WANInterfaces {
+		if name == "" || len(name) > 15 {
+			return fmt.Errorf("invalid interface name %q", name)
+		}
+	}
+	for _, bogon := range h.Bogons {
+		if !isAddress(bogon) {
+			return fmt.Errorf("invalid bogon %q", bogon)
+		}
+	}
+	return nil
+}
+
+// RateLimitConfig limits the rate of new connections through the router,
+// so that a runaway client, such as one under a SYN flood, can't exhaust
+// the router's connection tracking or the upstream links
+type RateLimitConfig struct {
+	// Global limits the new connections of all sources together, e.g.
+	// "2000/second"
+	Global string `yaml:"global,omitempty" json:"global,omitempty"`
+	// PerSource limits the new connections of each source, e.g.
+	// "100/second"
+	PerSource string `yaml:"per_source,omitempty" json:"per_source,omitempty"`
+	// Burst is the number of connections allowed beyond the rate at once
+	// (default 5)
+	Burst uint32 `yaml:"burst,omitempty" json:"burst,omitempty"`
+	// ExemptSources are not limited, e.g. servers behind the router
+	// (IPs or CIDRs)
+	ExemptSources []string `yaml:"exempt_sources,omitempty" json:"exempt_sources,omitempty"`
+}
+
+// Validate checks that a rate is set, the rates are valid and the exempt
+// sources are addresses
+func (r *RateLimitConfig) Validate() error {
+	if r.Global == "" && r.PerSource == "" {
+		return fmt.Errorf("global or per_source is required")
+	}
+	for _, rate := range []string{r.Global, r.PerSource} {
+		if rate == "" {
+			continue
+		}
+		if _, _, err := ParseRate(rate); err != nil {
+			return err
+		}
+	}
+	for _, src := range r.ExemptSources {
+		if !isAddress(src) {
+			return fmt.Errorf("invalid exempt source %q", src)
+		}
+	}
+	return nil
+}
+
+const (
+	defaultBanThreshold = 20
+	defaultBanWindow    = time.Minute
+	defaultBanDuration  = time.Hour
+)
+
+// BanConfig bans the sources whose packets hit deny rules more than
+// Threshold times within Window, as fail2ban does: all their traffic is
+// dropped until the ban expires
+type BanConfig struct {
+	// Threshold is the number of denied packets a source may send within
+	// the window (default 20)
+	Threshold uint32 `yaml:"threshold,omitempty" json:"threshold,omitempty"`
+	// Window is the period the denied packets are counted over (default 1m)
+	Window Duration `yaml:"window,omitempty" json:"window,omitempty"`
+	// Duration is how long a source stays banned (default 1h)
+	Duration Duration `yaml:"duration,omitempty" json:"duration,omitempty"`
+	// ExemptSources are never banned, e.g. monitoring hosts (IPs or CIDRs)
+	ExemptSources []string `yaml:"exempt_sources,omitempty" json:"exempt_sources,omitempty"`
+}
+
+// EffectiveThreshold returns the denied packets allowed per window
+func (b *BanConfig) EffectiveThreshold() uint32 {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return defaultBanThreshold
+}
+
+// EffectiveWindow returns the period denied packets are counted over
+func (b *BanConfig) EffectiveWindow() time.Duration {
+	if b.Window > 0 {
+		return b.Window.Std()
+	}
+	return defaultBanWindow
+}
+
+// EffectiveDuration returns how long a source stays banned
+func (b *BanConfig) EffectiveDuration() time.Duration {
+	if b.Duration > 0 {
+		return b.Duration.Std()
+	}
+	return defaultBanDuration
+}
+
+// Validate checks that the window is at least a second, the duration
+// isn't negative and the exempt sources are addresses
+func (b *BanConfig) Validate() error {
+	if b.Window != 0 && b.Window.Std() < time.Second {
+		return fmt.Errorf("window must be at least 1s")
+	}
+	if b.Duration < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	for _, src := range b.ExemptSources {
+		if !isAddress(src) {
+			return fmt.Errorf("invalid exempt source %q", src)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the excluded destinations are addresses, the
+// interfaces are names and the forwards are valid
+func (n *NATConfig) Validate() error {
+	for _, dst := range n.ExcludeDestinations {
+		if !isAddress(dst) {
+			return fmt.Errorf("invalid excluded destination %q", dst)
+		}
+	}
+	for _, name := range n.Interfaces {
+		if name == "" || len(name) > 15 {
+			return fmt.Errorf("invalid interface name %q", name)
+		}
+	}
+	for i, forward := range n.Forwards {
+		if err := forward.Validate(); err != nil {
+			return fmt.Errorf("forwards[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Port mapping protocols a UPnP responder serves
+const (
+	UPnPProtocolIGD    = "upnp"
+	UPnPProtocolNATPMP = "nat-pmp"
+)
+
+const defaultUPnPMaxLease = time.Hour
+
+// UPnPConfig configures a UPnP IGD and NAT-PMP responder. Clients on the
+// internal interfaces may forward ports of the external interface to
+// themselves; requests for other hosts or ports are refused.
+type UPnPConfig struct {
+	// ExternalInterface is the uplink whose ports are forwarded
+	ExternalInterface string `yaml:"external_interface" json:"external_interface"`
+	// Interfaces are the internal interfaces clients are served on
+	Interfaces []string `yaml:"interfaces" json:"interfaces"`
+	// AllowedHosts may map ports to themselves (IPv4 addresses or CIDRs)
+	AllowedHosts []string `yaml:"allowed_hosts" json:"allowed_hosts"`
+	// Ports are the ports and ranges, e.g. 1024-65535, that may be mapped,
+	// both on the router and on the host
+	Ports []string `yaml:"ports" json:"ports"`
+	// MaxLease caps the lifetime of a mapping, which clients must renew
+	// (default 1h)
+	MaxLease Duration `yaml:"max_lease,omitempty" json:"max_lease,omitempty"`
+	// Protocols served, upnp and nat-pmp (default both)
+	Protocols []string `yaml:"protocols,omitempty" json:"protocols,omitempty"`
+}
+
+// EffectiveMaxLease returns the longest lifetime of a mapping
+func (u *UPnPConfig) EffectiveMaxLease() time.Duration {
+	if u.MaxLease > 0 {
+		return u.MaxLease.Std()
+	}
+	return defaultUPnPMaxLease
+}
+
+// Serves reports whether protocol is served
+func (u *UPnPConfig) Serves(protocol string) bool {
+	if len(u.Protocols) == 0 {
+		return true
+	}
+	for _, p := range u.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits reports whether host may map externalPort to internalPort on
+// itself
+func (u *UPnPConfig) Permits(host net.IP, externalPort, internalPort uint16) bool {
+	allowed := false
+	for _, entry := range u.AllowedHosts {
+		if ip := net.ParseIP(entry); ip != nil {
+			allowed = ip.Equal(host)
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			allowed = network.Contains(host)
+		}
+		if allowed {
+			break
+		}
+	}
+	return allowed && u.permitsPort(externalPort) && u.permitsPort(internalPort)
+}
+
+// permitsPort reports whether port is in Ports
+func (u *UPnPConfig) permitsPort(port uint16) bool {
+	for _, entry := range u.Ports {
+		if start, end, err := ParsePortRange(entry); err == nil && port >= start && port <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the interfaces, hosts, ports and protocols
+func (u *UPnPConfig) Validate() error {
+	if u.ExternalInterface == "" || len(u.ExternalInterface) > 15 {
+		return fmt.Errorf("invalid external interface name %q", u.ExternalInterface)
+	}
+	if len(u.Interfaces) == 0 {
+		return fmt.Errorf("interfaces are required")
+	}
+	for _, name := range u.Interfaces {
+		if name == "" || len(name) > 15 || name == u.ExternalInterface {
+			return fmt.Errorf("invalid interface name %q", name)
+		}
+	}
+	if len(u.AllowedHosts) == 0 {
+		return fmt.Errorf("allowed_hosts are required")
+	}
+	for _, host := range u.AllowedHosts {
+		// The protocols map IPv4 addresses only
+		ip, _, err := net.ParseCIDR(host)
+		if err != nil {
+			ip = net.ParseIP(host)
+		}
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid allowed host %q: an IPv4 address or CIDR is required", host)
+		}
+	}
+	if len(u.Ports) == 0 {
+		return fmt.Errorf("ports are required")
+	}
+	for _, port := range u.Ports {
+		if _, _, err := ParsePortRange(port); err != nil {
+			return err
+		}
+	}
+	for _, protocol := range u.Protocols {
+		if protocol != UPnPProtocolIGD && protocol != UPnPProtocolNATPMP {
+			return fmt.Errorf("protocol must be '%s' or '%s'", UPnPProtocolIGD, UPnPProtocolNATPMP)
+		}
+	}
+	return nil
+}
+
+const defaultBlockPagePort = 8081
+
+// BlockPageConfig redirects denied HTTP (TCP port 80) connections to a page
+// served by the router, which names the rule that denied them and how to
+// ask for an exception. The first packet of a denied connection is dropped
+// as usual; the client's retry is redirected.
+type BlockPageConfig struct {
+	// Port the page is served on, on every address of the router (default
+	// 8081)
+	Port uint16 `yaml:"port,omitempty" json:"port,omitempty"`
+	// Contact tells users how to request an exception, e.g. a mail address
+	// or the URL of a request form
+	Contact string `yaml:"contact,omitempty" json:"contact,omitempty"`
+}
+
+// EffectivePort returns the port the page is served on
+func (b *BlockPageConfig) EffectivePort() uint16 {
+	if b.Port != 0 {
+		return b.Port
+	}
+	return defaultBlockPagePort
+}
+
+const (
+	defaultHoneypotPort     = 8082
+	defaultHoneypotMaxBytes = 16 * 1024
+)
+
+// HoneypotConfig redirects TCP connections to targets the policy denies to
+// a listener on the router, which records what the client sends for
+// investigation instead of dropping the connection silently
+type HoneypotConfig struct {
+	// Port the listener accepts the redirected connections on, on every
+	// address of the router (default 8082)
+	Port uint16 `yaml:"port,omitempty" json:"port,omitempty"`
+	// Targets are the destinations redirected (IPs or CIDRs)
+	Targets []string `yaml:"targets" json:"targets"`
+	// Ports limits the redirect to these destination ports or ranges,
+	// by default all
+	Ports []string `yaml:"ports,omitempty" json:"ports,omitempty"`
+	// ExemptSources keep reaching the targets, e.g. hosts allowed to the
+	// metadata service (IPs or CIDRs)
+	ExemptSources []string `yaml:"exempt_sources,omitempty" json:"exempt_sources,omitempty"`
+	// MaxBytes bounds what is recorded of a connection (default 16384)
+	MaxBytes int `yaml:"max_bytes,omitempty" json:"max_bytes,omitempty"`
+}
+
+// EffectivePort returns the port the listener accepts connections on
+func (h *HoneypotConfig) EffectivePort() uint16 {
+	if h.Port != 0 {
+		return h.Port
+	}
+	return defaultHoneypotPort
+}
+
+// EffectiveMaxBytes returns the bytes recorded of a connection at most
+func (h *HoneypotConfig) EffectiveMaxBytes() int {
+	if h.MaxBytes > 0 {
+		return h.MaxBytes
+	}
+	return defaultHoneypotMaxBytes
+}
+
+// Validate checks that there are targets, the targets and exempt sources
+// are addresses and the ports are valid
+func (h *HoneypotConfig) Validate() error {
+	if len(h.Targets) == 0 {
+		return fmt.Errorf("targets are required")
+	}
+	for _, target := range h.Targets {
+		if !isAddress(target) {
+			return fmt.Errorf("invalid target %q", target)
+		}
+	}
+	for _, port := range h.Ports {
+		if _, _, err := ParsePortRange(port); err != nil {
+			return err
+		}
+	}
+	for _, src := range h.ExemptSources {
+		if !isAddress(src) {
+			return fmt.Errorf("invalid exempt source %q", src)
+		}
+	}
+	if h.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative")
+	}
+	return nil
+}
+
+// isAddress reports whether s is an IP address or CIDR
+func isAddress(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// Cloud providers publishing IP ranges
+const (
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderAzure = "azure"
+	// ProviderBGP names a group of prefixes learned over BGP
+	ProviderBGP = "bgp"
+	// ProviderBogons names the bogons, DefaultBogons unless the full
+	// bogons are downloaded
+	ProviderBogons = "bogons"
+)
+
+// IPGroup names the published ranges of a cloud provider in egress ips:
+// @aws:<service>[:<region>], @gcp[:<region>] or @azure:<service tag>,
+// prefixes learned over BGP: @bgp:<group>, or the bogons: @bogons
+type IPGroup struct {
+	Provider string
+	Service  string // Service, service tag or BGP group
+	Region   string
+}
+
+// IsIPGroup reports whether an egress ips entry names a group
+func IsIPGroup(s string) bool {
+	return strings.HasPrefix(s, "@")
+}
+
+// ParseIPGroup parses a group such as @aws:s3:us-east-1
+func ParseIPGroup(s string) (IPGroup, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "@"), ":")
+	g := IPGroup{Provider: parts[0]}
+	switch {
+	case g.Provider == ProviderAWS && (len(parts) == 2 || len(parts) == 3):
+		g.Service = parts[1]
+		if len(parts) == 3 {
+			g.Region = parts[2]
+		}
+	case g.Provider == ProviderGCP && len(parts) <= 2:
+		if len(parts) == 2 {
+			g.Region = parts[1]
+		}
+	case (g.Provider == ProviderAzure || g.Provider == ProviderBGP) && len(parts) == 2:
+		g.Service = parts[1]
+	case g.Provider == ProviderBogons && len(parts) == 1:
+	default:
+		return IPGroup{}, fmt.Errorf("invalid ip group %q: use @aws:<service>[:<region>], @gcp[:<region>], @azure:<service tag>, @bgp:<group> or @bogons", s)
+	}
+	for _, part := range parts[1:] {
+		if part == "" {
+			return IPGroup{}, fmt.Errorf("invalid ip group %q", s)
+		}
+	}
+	return g, nil
+}
+
+// String returns the group as written in egress ips
+func (g IPGroup) String() string {
+	s := "@" + g.Provider
+	for _, part := range []string{g.Service, g.Region} {
+		if part != "" {
+			s += ":" + part
+		}
+	}
+	return s
+}
+
+// MaintenanceConfig is a predefined policy for maintenance windows, such as
+// allowing package mirrors and vendor support endpoints
+type MaintenanceConfig struct {
+	// Rules replace the normal rules while maintenance mode is on
+	Rules []Rule `yaml:"rules" json:"rules"`
+	// Extend keeps the normal rules in effect after the maintenance rules
+	Extend bool `yaml:"extend,omitempty" json:"extend,omitempty"`
+	// MaxDuration caps how long maintenance mode stays on (default 4h)
+	MaxDuration Duration `yaml:"max_duration,omitempty" json:"max_duration,omitempty"`
+}
+
+// RolloutConfig rolls a reloaded policy out as a canary, to a share of the
+// sources or without enforcing it, before it applies to all traffic
+type RolloutConfig struct {
+	// Percent of the sources, picked by a hash of their address, the new
+	// policy applies to; the others keep the running policy
+	Percent int `yaml:"percent,omitempty" json:"percent,omitempty"`
+	// LogOnly evaluates the new policy for all traffic alongside the running
+	// one, logging what it would deny instead of dropping it
+	LogOnly bool `yaml:"log_only,omitempty" json:"log_only,omitempty"`
+	// Duration of the canary before the new policy is enforced everywhere
+	Duration Duration `yaml:"duration" json:"duration"`
+	// AbortRatio aborts the rollout when the new policy denies more than
+	// this many times as much traffic per source as the running policy
+	// (default 2)
+	AbortRatio float64 `yaml:"abort_ratio,omitempty" json:"abort_ratio,omitempty"`
+	// MinDenies is the number of packets the new policy must deny before
+	// the rollout can be aborted (default 100)
+	MinDenies uint64 `yaml:"min_denies,omitempty" json:"min_denies,omitempty"`
+}
+
+// ChainConfig places the ruleset's table and base chains
+type ChainConfig struct {
+	// Family of the table: inet (default) sees IPv4 and IPv6 traffic, ip
+	// and ip6 only their own
+	Family string `yaml:"family,omitempty" json:"family,omitempty"`
+	// Hook is forward (default), prerouting or output
+	Hook string `yaml:"hook,omitempty" json:"hook,omitempty"`
+	// Priority of the policy chain, lower running first (default 0, the
+	// filter priority); the metadata chain runs 10 ahead of it
+	Priority *int `yaml:"priority,omitempty" json:"priority,omitempty"`
+	// Coexistence is what the router does on finding other firewall
+	// managers at startup: warn (default), refuse to start, or integrate by
+	// running after their chains unless a priority is set
+	Coexistence Coexistence `yaml:"coexistence,omitempty" json:"coexistence,omitempty"`
+}
+
+// Coexistence selects how other firewall managers are handled at startup
+type Coexistence string
+
+const (
+	// CoexistWarn logs the other managers and their chains
+	CoexistWarn Coexistence = "warn"
+	// CoexistRefuse fails the startup unless forced
+	CoexistRefuse Coexistence = "refuse"
+	// CoexistIntegrate runs the policy chain after their chains on the
+	// same hook
+	CoexistIntegrate Coexistence = "integrate"
+)
+
+// EffectiveCoexistence returns the configured coexistence, defaulting to
+// warn; c may be nil
+func (c *ChainConfig) EffectiveCoexistence() Coexistence {
+	if c == nil || c.Coexistence == "" {
+		return CoexistWarn
+	}
+	return c.Coexistence
+}
+
+// PersistConfig configures the persisted ruleset
+type PersistConfig struct {
+	// Path of the script, such as /etc/nftables.d/legion-router.nft
+	Path string `yaml:"path" json:"path"`
+	// Interval between rewrites following DNS and service changes
+	// (default 5m); the script is also written after every apply
+	Interval Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+// Validate checks the persisted ruleset settings
+func (p *PersistConfig) Validate() error {
+	if !filepath.IsAbs(p.Path) {
+		return fmt.Errorf("path must be absolute")
+	}
+	if p.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	return nil
+}
+
+// ConnectionLogConfig configures the log of new allowed connections
+type ConnectionLogConfig struct {
+	// Group is the NFLOG group the ruleset sends the first packet of each
+	// connection to (default 100)
+	Group uint16 `yaml:"group,omitempty" json:"group,omitempty"`
+	// File appends the log to a file instead of the router's log
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+	// Denied also logs the new connections deny rules deny and no rule
+	// matched
+	Denied bool `yaml:"denied,omitempty" json:"denied,omitempty"`
+	// SnoopDNS reads the DNS answers the router forwards to clients, and
+	// those of the DNS proxy, so that each client's connections are
+	// attributed to the names it looked up
+	SnoopDNS bool `yaml:"snoop_dns,omitempty" json:"snoop_dns,omitempty"`
+	// Processes attributes the connections of the router host itself to
+	// the process, PID and cgroup owning their socket, as recorded by eBPF
+	// programs or else looked up in /proc; output hook only
+	Processes bool `yaml:"processes,omitempty" json:"processes,omitempty"`
+}
+
+// Validate checks the connection log settings
+func (l *ConnectionLogConfig) Validate() error {
+	if l.File != "" && !filepath.IsAbs(l.File) {
+		return fmt.Errorf("file must be absolute")
+	}
+	return nil
+}
+
+// EventsConfig configures the event store
+type EventsConfig struct {
+	// Path is the database file
+	Path string `yaml:"path" json:"path"`
+	// Retention drops events older than it (default 168h)
+	Retention Duration `yaml:"retention,omitempty" json:"retention,omitempty"`
+	// MaxEvents drops the oldest events beyond it (default 1000000)
+	MaxEvents int `yaml:"max_events,omitempty" json:"max_events,omitempty"`
+}
+
+// Validate checks the event store settings
+func (e *EventsConfig) Validate() error {
+	if e.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if !filepath.IsAbs(e.Path) {
+		return fmt.Errorf("path must be absolute")
+	}
+	if e.Retention < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	if e.MaxEvents < 0 {
+		return fmt.Errorf("max_events must not be negative")
+	}
+	return nil
+}
+
+// DecisionLogConfig configures the recording of verdicts for replay
+type DecisionLogConfig struct {
+	// Path is the file decisions are appended to
+	Path string `yaml:"path" json:"path"`
+	// SampleRate is the fraction of the logged connections recorded, from
+	// 0 to 1 (default 1, all)
+	SampleRate     float64 `yaml:"sample_rate,omitempty" json:"sample_rate,omitempty"`
+	RotationConfig `yaml:",inline"`
+}
+
+// Validate checks the decision log settings
+func (d *DecisionLogConfig) Validate() error {
+	if d.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if !filepath.IsAbs(d.Path) {
+		return fmt.Errorf("path must be absolute")
+	}
+	if d.SampleRate < 0 || d.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	return d.RotationConfig.Validate()
+}
+
+// MetricsConfig configures the sampling of counters for dashboards
+type MetricsConfig struct {
+	// Interval is how often counters are sampled (default 1m)
+	Interval Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// Retention is how long samples are kept in memory (default 24h)
+	Retention Duration `yaml:"retention,omitempty" json:"retention,omitempty"`
+}
+
+// Validate checks the metrics settings
+func (m *MetricsConfig) Validate() error {
+	if m.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if m.Interval > 0 && m.Interval.Std() < time.Second {
+		return fmt.Errorf("interval must be at least 1s")
+	}
+	if m.Retention < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	if m.Interval > 0 && m.Retention > 0 && m.Retention < m.Interval {
+		return fmt.Errorf("retention must be at least the interval")
+	}
+	return nil
+}
+
+// ShutdownPolicy selects what happens to the ruleset when the router stops
+type ShutdownPolicy string
+
+const (
+	// ShutdownOpen removes the ruleset, forwarding traffic unfiltered
+	ShutdownOpen ShutdownPolicy = "open"
+	// ShutdownClosed replaces the ruleset with one dropping all traffic
+	ShutdownClosed ShutdownPolicy = "closed"
+	// ShutdownKeep leaves the ruleset in place, frozen until the next start
+	ShutdownKeep ShutdownPolicy = "keep"
+)
+
+// EffectiveOnShutdown returns the configured shutdown policy, defaulting to
+// open
+func (c *Config) EffectiveOnShutdown() ShutdownPolicy {
+	if c.OnShutdown == "" {
+		return ShutdownOpen
+	}
+	return c.OnShutdown
+}
+
+// PolicyTest is the verdict expected for a connection
+type PolicyTest struct {
+	// Name describes the case (default src -> dst)
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Source address (default unspecified)
+	Source string `yaml:"src,omitempty" json:"src,omitempty"`
+	// Destination address; if empty, every address Domain resolves to is
+	// tested
+	Destination string `yaml:"dst,omitempty" json:"dst,omitempty"`
+	// Domain is the server name the client sends, for inspected traffic
+	Domain   string   `yaml:"domain,omitempty" json:"domain,omitempty"`
+	Protocol Protocol `yaml:"proto" json:"proto"`
+	Port     uint16   `yaml:"port,omitempty" json:"port,omitempty"`
+	// Interface the connection arrives on, for VLAN and VRF rules
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+	// App is the application protocol, for traffic l7 rules inspect
+	App AppProtocol `yaml:"app,omitempty" json:"app,omitempty"`
+	// State is the conntrack state of the packet (default new)
+	State CtState `yaml:"state,omitempty" json:"state,omitempty"`
+	// TTL is the IPv4 TTL or IPv6 hop limit of the packet (default 64)
+	TTL uint8 `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	// Length is the length of the packet in bytes (default 60)
+	Length uint16 `yaml:"length,omitempty" json:"length,omitempty"`
+	Expect Action `yaml:"expect" json:"expect"`
+}
+
+// ClusterConfig connects an agent to the cluster controller. The policy
+// pushed by the controller replaces everything in this file except the
+// node-local cluster, admin and ha sections.
+type ClusterConfig struct {
+	// Controller is the gRPC address of the controller
+	Controller string `yaml:"controller" json:"controller"`
+	// Node names this router (default hostname)
+	Node string `yaml:"node,omitempty" json:"node,omitempty"`
+	// Token authenticates the agent to the controller
+	Token string `yaml:"token,omitempty" json:"token,omitempty"`
+	// CAFile verifies the controller's TLS certificate; without it the
+	// connection is not encrypted
+	CAFile string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the agent's client certificate, such as an
+	// X.509-SVID written by the SPIRE agent. They and CAFile are read again
+	// when they change, so rotated certificates need no restart.
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	// ControllerID is the SPIFFE ID the controller's certificate must
+	// carry, checked instead of its host name
+	ControllerID string `yaml:"controller_id,omitempty" json:"controller_id,omitempty"`
+	// ReportInterval between status reports (default 30s)
+	ReportInterval Duration `yaml:"report_interval,omitempty" json:"report_interval,omitempty"`
+}
+
+// HA roles
+const (
+	RoleActive  = "active"
+	RoleStandby = "standby"
+)
+
+// HAConfig configures an active/standby pair. VRRP is left to keepalived,
+// whose state changes are read from NotifyFIFO.
+type HAConfig struct {
+	// Role is the role until keepalived reports one (default standby)
+	Role string `yaml:"role,omitempty" json:"role,omitempty"`
+	// NotifyFIFO is keepalived's notify_fifo
+	NotifyFIFO string `yaml:"notify_fifo,omitempty" json:"notify_fifo,omitempty"`
+	// Instance is the VRRP instance or sync group to follow (default all)
+	Instance string `yaml:"instance,omitempty" json:"instance,omitempty"`
+	// Sync replicates allowed addresses and grants to the peer
+	Sync *HASyncConfig `yaml:"sync,omitempty" json:"sync,omitempty"`
+	// Conntrackd drives conntrackd's caches on role changes so that
+	// established flows survive failover
+	Conntrackd bool `yaml:"conntrackd,omitempty" json:"conntrackd,omitempty"`
+}
+
+// HASyncConfig configures state replication between the pair
+type HASyncConfig struct {
+	// Listen is where the state pushed by the active router is received
+	Listen string `yaml:"listen" json:"listen"`
+	// Peer is the sync address of the other router
+	Peer string `yaml:"peer" json:"peer"`
+	// Key authenticates the pair to each other
+	Key string `yaml:"key" json:"key"`
+	// Interval between pushes from the active router (default 5s)
+	Interval Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+// InspectionConfig configures SNI inspection of TLS connections
+type InspectionConfig struct {
+	// SNI queues TLS connections not matched by any address to userspace
+	// and allows them when the server name matches a rule's domains, which
+	// also enforces wildcard domains
+	SNI bool `yaml:"sni" json:"sni"`
+	// Queue is the NFQUEUE number (default 100)
+	Queue uint16 `yaml:"queue,omitempty" json:"queue,omitempty"`
+	// VerifyCertificate requires the server to present a valid certificate
+	// for the server name before the connection is allowed
+	VerifyCertificate bool `yaml:"verify_certificate,omitempty" json:"verify_certificate,omitempty"`
+	// Fingerprints logs JA3 and JA4 fingerprints of inspected TLS clients
+	Fingerprints bool `yaml:"fingerprints,omitempty" json:"fingerprints,omitempty"`
+	// ReverseDNS adds the PTR names of destinations to the log lines of
+	// dropped connections
+	ReverseDNS *ReverseDNSConfig `yaml:"reverse_dns,omitempty" json:"reverse_dns,omitempty"`
+}
+
+// ReverseDNSConfig configures PTR lookups of dropped destinations
+type ReverseDNSConfig struct {
+	// CacheTTL is how long names are kept (default 1h)
+	CacheTTL Duration `yaml:"cache_ttl,omitempty" json:"cache_ttl,omitempty"`
+	// Rate limits lookups per second (default 5); drops over the limit are
+	// logged without a name
+	Rate int `yaml:"rate,omitempty" json:"rate,omitempty"`
+}
+
+// DNSConfig configures how domain rules are resolved
+type DNSConfig struct {
+	// Servers are the default upstream resolvers (host or host:port)
+	Servers []string `yaml:"servers,omitempty" json:"servers,omitempty"`
+	// Suffixes route domains under a suffix to dedicated resolvers
+	Suffixes []SuffixResolver `yaml:"suffixes,omitempty" json:"suffixes,omitempty"`
+	// WatchCNAMETargets also refreshes intermediate CNAME targets so that
+	// rotations at any level of a chain are tracked
+	WatchCNAMETargets bool `yaml:"watch_cname_targets,omitempty" json:"watch_cname_targets,omitempty"`
+	// Aggregation accumulates answers over several queries, for CDNs that
+	// return a random subset of their pool per query
+	Aggregation *AggregationConfig `yaml:"aggregation,omitempty" json:"aggregation,omitempty"`
+	// CacheFile persists the DNS cache across restarts, so that a restart
+	// during an upstream outage keeps domain rules working
+	CacheFile string `yaml:"cache_file,omitempty" json:"cache_file,omitempty"`
+	// Startup controls what happens when domains fail to resolve at startup
+	Startup StartupConfig `yaml:"startup,omitempty" json:"startup,omitempty"`
+	// Refresh tunes the periodic re-resolution of domains
+	Refresh RefreshConfig `yaml:"refresh,omitempty" json:"refresh,omitempty"`
+	// CacheTTL is how long resolved addresses are reused before a rule
+	// looks them up again (default 5m)
+	CacheTTL Duration `yaml:"cache_ttl,omitempty" json:"cache_ttl,omitempty"`
+	// CacheMaxEntries bounds the domains cached, evicting the least
+	// recently used beyond it (default 10000)
+	CacheMaxEntries int `yaml:"cache_max_entries,omitempty" json:"cache_max_entries,omitempty"`
+	// ClientSubnet is sent to upstreams as EDNS Client Subnet so CDN
+	// answers match what downstream clients would be given
+	ClientSubnet string `yaml:"client_subnet,omitempty" json:"client_subnet,omitempty"`
+	// Pool chooses the order upstreams are tried in and demotes failing
+	// ones
+	Pool PoolConfig `yaml:"pool,omitempty" json:"pool,omitempty"`
+	// Proxy answers the queries of downstream clients
+	Proxy *DNSProxyConfig `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+}
+
+// DNSProxyConfig configures the DNS proxy clients can use as their
+// resolver. Queries are forwarded to the upstreams of the domain rules.
+type DNSProxyConfig struct {
+	// Listen are the addresses answered on over UDP and TCP, e.g.
+	// 10.0.0.1:53
+	Listen []string `yaml:"listen" json:"listen"`
+	// QueryLog logs every query with its answer and verdict
+	QueryLog *DNSQueryLogConfig `yaml:"query_log,omitempty" json:"query_log,omitempty"`
+	// RPZ are Response Policy Zones applied to names no allow rule names,
+	// in order
+	RPZ []RPZConfig `yaml:"rpz,omitempty" json:"rpz,omitempty"`
+	// Zones are answered by the proxy itself instead of upstream
+	Zones []DNSZoneConfig `yaml:"zones,omitempty" json:"zones,omitempty"`
+	// AllowOnFirstUse adds the addresses answered for a domain of a rule to
+	// the rule's set before the client gets the answer, so that its first
+	// connection doesn't wait for the domain to be resolved by the router
+	AllowOnFirstUse bool `yaml:"allow_on_first_use,omitempty" json:"allow_on_first_use,omitempty"`
+}
+
+// Default TTL of local zone records without one
+const defaultZoneTTL = 5 * time.Minute
+
+// DNSZoneConfig configures a zone the DNS proxy answers authoritatively,
+// e.g. the hostnames of a LAN
+type DNSZoneConfig struct {
+	// Name is the zone's domain, e.g. lan or 0.0.10.in-addr.arpa
+	Name string `yaml:"name" json:"name"`
+	// Sources are the clients (IPs or CIDRs) the zone is answered for;
+	// others get a later zone of the same name, or the upstream answer.
+	// Default: every client
+	Sources []string `yaml:"sources,omitempty" json:"sources,omitempty"`
+	// TTL of records without one (default 5m)
+	TTL Duration `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	// Records are zone file lines, with names relative to the zone, e.g.
+	// "nas A 10.0.0.10"
+	Records []string `yaml:"records,omitempty" json:"records,omitempty"`
+	// File is a zone file read in addition to the records
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+	// Leases registers the hostnames of DHCP clients in the zone
+	Leases *DHCPLeasesConfig `yaml:"leases,omitempty" json:"leases,omitempty"`
+}
+
+// Formats of DHCP lease files
+const (
+	LeaseFormatDnsmasq = "dnsmasq"
+	LeaseFormatISC     = "isc"
+	LeaseFormatKea     = "kea"
+)
+
+// DHCPLeasesConfig reads the leases of a DHCP server running alongside the
+// router
+type DHCPLeasesConfig struct {
+	// File is the server's lease file, e.g. /var/lib/misc/dnsmasq.leases
+	File string `yaml:"file" json:"file"`
+	// Format is dnsmasq (default), isc for ISC dhcpd or kea for a Kea
+	// memfile
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+}
+
+// EffectiveFormat returns the format of the lease file
+func (l *DHCPLeasesConfig) EffectiveFormat() string {
+	if l.Format == "" {
+		return LeaseFormatDnsmasq
+	}
+	return l.Format
+}
+
+// EffectiveTTL returns the TTL of records without one
+func (z DNSZoneConfig) EffectiveTTL() time.Duration {
+	if z.TTL > 0 {
+		return z.TTL.Std()
+	}
+	return defaultZoneTTL
+}
+
+// Origin returns the zone's domain as a fully qualified, lower case name
+func (z DNSZoneConfig) Origin() string {
+	return dns.Fqdn(strings.ToLower(z.Name))
+}
+
+// ParseRecords parses the records of the zone
+func (z DNSZoneConfig) ParseRecords() ([]dns.RR, error) {
+	zp := dns.NewZoneParser(strings.NewReader(strings.Join(z.Records, "\n")), z.Origin(), "")
+	zp.SetDefaultTTL(uint32(z.EffectiveTTL().Seconds()))
+	var records []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if !dns.IsSubDomain(z.Origin(), rr.Header().Name) {
+			return nil, fmt.Errorf("record %s is outside the zone", rr.Header().Name)
+		}
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// RPZConfig configures a Response Policy Zone read from a zone file
+type RPZConfig struct {
+	// Name identifies the zone in the query log (default: the zone's
+	// origin, or the file's name)
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// File is the zone file, reloaded when it changes
+	File string `yaml:"file" json:"file"`
+}
+
+// DNSQueryLogConfig configures the DNS query log
+type DNSQueryLogConfig struct {
+	// File appends the log to a file instead of the router's log
+	File           string `yaml:"file,omitempty" json:"file,omitempty"`
+	RotationConfig `yaml:",inline"`
+}
+
+// Defaults of log file rotation
+const (
+	defaultRotationMaxSize    = 100 // MB
+	defaultRotationMaxBackups = 3
+)
+
+// RotationConfig rotates a log file by size: the file is renamed to
+// <file>.1 once it reaches MaxSize, whose predecessor becomes <file>.2 and
+// so on
+type RotationConfig struct {
+	// MaxSize rotates the file once it reaches this many megabytes
+	// (default 100)
+	MaxSize int `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+	// MaxBackups is the number of rotated files kept (default 3)
+	MaxBackups int `yaml:"max_backups,omitempty" json:"max_backups,omitempty"`
+}
+
+// EffectiveMaxSize returns the size in bytes the file is rotated at
+func (r RotationConfig) EffectiveMaxSize() int64 {
+	if r.MaxSize > 0 {
+		return int64(r.MaxSize) << 20
+	}
+	return defaultRotationMaxSize << 20
+}
+
+// EffectiveMaxBackups returns the number of rotated files kept
+func (r RotationConfig) EffectiveMaxBackups() int {
+	if r.MaxBackups > 0 {
+		return r.MaxBackups
+	}
+	return defaultRotationMaxBackups
+}
+
+// Validate checks the rotation settings
+func (r RotationConfig) Validate() error {
+	if r.MaxSize < 0 || r.MaxBackups < 0 {
+		return fmt.Errorf("max_size and max_backups must not be negative")
+	}
+	return nil
+}
+
+// inLocalZone reports whether name is in a zone of the DNS proxy
+func (d DNSConfig) inLocalZone(name string) bool {
+	if d.Proxy == nil {
+		return false
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+	for _, zone := range d.Proxy.Zones {
+		if dns.IsSubDomain(zone.Origin(), dns.Fqdn(strings.ToLower(name))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the DNS proxy settings
+func (p *DNSProxyConfig) Validate() error {
+	if len(p.Listen) == 0 {
+		return fmt.Errorf("at least one listen address is required")
+	}
+	for _, addr := range p.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+	}
+	if l := p.QueryLog; l != nil {
+		if l.File != "" && !filepath.IsAbs(l.File) {
+			return fmt.Errorf("query_log: file must be absolute")
+		}
+		if err := l.RotationConfig.Validate(); err != nil {
+			return fmt.Errorf("query_log: %w", err)
+		}
+	}
+	files := make(map[string]bool)
+	for i, zone := range p.RPZ {
+		if zone.File == "" || !filepath.IsAbs(zone.File) {
+			return fmt.Errorf("rpz %d: file must be absolute", i)
+		}
+		if files[zone.File] {
+			return fmt.Errorf("rpz %d: duplicate file %s", i, zone.File)
+		}
+		files[zone.File] = true
+	}
+	for i, zone := range p.Zones {
+		if _, ok := dns.IsDomainName(zone.Name); !ok || zone.Name == "" || zone.Name == "." {
+			return fmt.Errorf("zone %d: invalid name %q", i, zone.Name)
+		}
+		for _, src := range zone.Sources {
+			if !isAddress(src) {
+				return fmt.Errorf("zone %s: invalid source %q", zone.Name, src)
+			}
+		}
+		if zone.TTL < 0 {
+			return fmt.Errorf("zone %s: ttl must not be negative", zone.Name)
+		}
+		if len(zone.Records) == 0 && zone.File == "" && zone.Leases == nil {
+			return fmt.Errorf("zone %s: records, file or leases is required", zone.Name)
+		}
+		if l := zone.Leases; l != nil {
+			if l.File == "" || !filepath.IsAbs(l.File) {
+				return fmt.Errorf("zone %s: leases: file must be absolute", zone.Name)
+			}
+			switch l.EffectiveFormat() {
+			case LeaseFormatDnsmasq, LeaseFormatISC, LeaseFormatKea:
+			default:
+				return fmt.Errorf("zone %s: leases: unknown format %q", zone.Name, l.Format)
+			}
+		}
+		if zone.File != "" && !filepath.IsAbs(zone.File) {
+			return fmt.Errorf("zone %s: file must be absolute", zone.Name)
+		}
+		if _, err := zone.ParseRecords(); err != nil {
+			return fmt.Errorf("zone %s: %w", zone.Name, err)
+		}
+	}
+	return nil
+}
+
+// RefreshConfig tunes periodic DNS refresh for configs with many domains
+type RefreshConfig struct {
+	// Interval is how often domains are re-resolved (default 5m)
+	Interval Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// Concurrency is the number of parallel lookups (default 8)
+	Concurrency int `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	// Jitter delays each lookup by a random duration up to this value
+	Jitter Duration `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	// Deadline bounds a refresh cycle; domains not reached wait for the next
+	Deadline Duration `yaml:"deadline,omitempty" json:"deadline,omitempty"`
+}
+
+// Bounds of the refresh intervals and cache TTL of domains: more often
+// floods the upstreams, less often misses rotations for a day
+const (
+	minDNSInterval = 10 * time.Second
+	maxDNSInterval = 24 * time.Hour
+)
+
+// validateDNSInterval checks that a refresh interval or cache TTL is unset
+// or within bounds
+func validateDNSInterval(d Duration) error {
+	if d != 0 && (d.Std() < minDNSInterval || d.Std() > maxDNSInterval) {
+		return fmt.Errorf("must be between 10s and 24h")
+	}
+	return nil
+}
+
+// StartupPolicy selects how unresolved domains are handled at startup
+type StartupPolicy string
+
+const (
+	// StartupRetry installs the rule and keeps retrying in the background
+	StartupRetry StartupPolicy = "retry"
+	// StartupBlock waits until every domain resolves before starting
+	StartupBlock StartupPolicy = "block"
+	// StartupPersisted falls back to the last addresses in the cache file
+	// (even if expired) and keeps retrying in the background
+	StartupPersisted StartupPolicy = "persisted"
+	// StartupSkip skips unresolved domains until the config is reloaded
+	StartupSkip StartupPolicy = "skip"
+)
+
+// StartupConfig configures startup resolution of domain rules
+type StartupConfig struct {
+	// Policy is retry (default), block, persisted or skip
+	Policy StartupPolicy `yaml:"policy,omitempty" json:"policy,omitempty"`
+	// Timeout bounds how long the block policy waits; 0 waits forever
+	Timeout Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// MaxBackoff caps the delay between retries (default 1m)
+	MaxBackoff Duration `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+	// Lazy installs domain rules with empty sets and resolves their domains
+	// in the background, filling the sets in as each resolves
+	Lazy bool `yaml:"lazy,omitempty" json:"lazy,omitempty"`
+}
+
+// EffectivePolicy returns the configured policy, defaulting to retry
+func (s StartupConfig) EffectivePolicy() StartupPolicy {
+	if s.Policy == "" {
+		return StartupRetry
+	}
+	return s.Policy
+}
+
+// PoolStrategy selects the order the upstreams of a domain are tried in
+type PoolStrategy string
+
+const (
+	// PoolOrdered tries upstreams in the configured order
+	PoolOrdered PoolStrategy = "ordered"
+	// PoolRoundRobin starts each query at the next upstream
+	PoolRoundRobin PoolStrategy = "round_robin"
+	// PoolFastest tries upstreams by their average response time
+	PoolFastest PoolStrategy = "fastest"
+)
+
+// PoolConfig configures the upstream resolver pool. Healthy upstreams are
+// tried by the strategy, then demoted ones, in case all of them fail.
+type PoolConfig struct {
+	// Strategy is ordered (default), round_robin or fastest
+	Strategy PoolStrategy `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+	// FailureThreshold is the consecutive failures demoting an upstream
+	// (default 3)
+	FailureThreshold int `yaml:"failure_threshold,omitempty" json:"failure_threshold,omitempty"`
+	// ProbeInterval is how often every upstream is probed, to promote
+	// demoted ones once they answer again (default 30s)
+	ProbeInterval Duration `yaml:"probe_interval,omitempty" json:"probe_interval,omitempty"`
+	// ProbeDomain is the name probes query for NS records (default the
+	// root zone)
+	ProbeDomain string `yaml:"probe_domain,omitempty" json:"probe_domain,omitempty"`
+}
+
+// EffectiveStrategy returns the configured strategy, defaulting to ordered
+func (p PoolConfig) EffectiveStrategy() PoolStrategy {
+	if p.Strategy == "" {
+		return PoolOrdered
+	}
+	return p.Strategy
+}
+
+// AggregationConfig configures multi-answer aggregation
+type AggregationConfig struct {
+	// Rounds is the number of queries sent to every upstream per resolution
+	Rounds int `yaml:"rounds" json:"rounds"`
+	// IPTTL is how long an address stays allowed after it was last seen
+	IPTTL Duration `yaml:"ip_ttl" json:"ip_ttl"`
+}
+
+// SuffixResolver routes lookups for all domains under Suffix to Servers
+// e.g., corp.example.com -> internal corporate DNS
+type SuffixResolver struct {
+	Suffix  string   `yaml:"suffix" json:"suffix"`
+	Servers []string `yaml:"servers" json:"servers"`
 }
 
 // Rule represents a single filtering rule
 type Rule struct {
+	// ID identifies the rule across renames, e.g. for policies managed as
+	// code; export assigns one to rules without
+	ID     string `yaml:"id,omitempty" json:"id,omitempty"`
 	Name   string `yaml:"name" json:"name"`
 	Action Action `yaml:"action" json:"action"`
 	Order  int    `yaml:"order" json:"order"`
 	Egress Egress `yaml:"egress,omitempty" json:"egress,omitempty"`
+	// Description justifies the rule, and Reference points to the ticket or
+	// document behind it; both are carried into the nftables comments, the
+	// rule listings and the audit log
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	Reference   string `yaml:"reference,omitempty" json:"reference,omitempty"`
+	// Resolvers overrides the upstream DNS servers used for this rule's domains
+	Resolvers []string `yaml:"resolvers,omitempty" json:"resolvers,omitempty"`
+	// RefreshInterval re-resolves this rule's domains more or less often
+	// than dns.refresh.interval, and caches them no longer
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty" json:"refresh_interval,omitempty"`
+	// BlockQUIC rejects QUIC (UDP 443) to the rule's destinations so that
+	// clients fall back to TCP, where SNI inspection works
+	BlockQUIC bool `yaml:"block_quic,omitempty" json:"block_quic,omitempty"`
+	// DenyBehavior makes a deny rule reject connections, so that clients
+	// fail at once instead of timing out; by default they are dropped
+	DenyBehavior DenyBehavior `yaml:"deny_behavior,omitempty" json:"deny_behavior,omitempty"`
+	// RejectWith is the ICMP code rejects answer with: port-unreachable,
+	// the default, or admin-prohibited, which tells clients the connection
+	// was filtered rather than refused
+	RejectWith string `yaml:"reject_with,omitempty" json:"reject_with,omitempty"`
+	// Log logs the packets a deny rule drops or rejects to the kernel log,
+	// prefixed with the rule name
+	Log bool `yaml:"log,omitempty" json:"log,omitempty"`
+	// VLANID limits the rule to traffic from a VLAN listed under vlans
+	VLANID uint16 `yaml:"vlan_id,omitempty" json:"vlan_id,omitempty"`
+	// VRF limits the rule to traffic routed in a VRF listed under vrfs
+	VRF string `yaml:"vrf,omitempty" json:"vrf,omitempty"`
+	// Profile limits the rule to traffic from a profile listed under
+	// profiles
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+	// CtStates limits the rule to packets of connections in these conntrack
+	// states, e.g. new to match only the packets opening connections
+	CtStates []CtState `yaml:"ct_states,omitempty" json:"ct_states,omitempty"`
+	// TTLLessThan and TTLEqual limit the rule to packets whose IPv4 TTL or
+	// IPv6 hop limit is below or equal to a value, e.g. to tell tethered
+	// devices, whose packets arrive one hop lower, from the router's clients
+	TTLLessThan uint8 `yaml:"ttl_lt,omitempty" json:"ttl_lt,omitempty"`
+	TTLEqual    uint8 `yaml:"ttl_eq,omitempty" json:"ttl_eq,omitempty"`
+	// Length limits the rule to packets of some lengths in bytes, such as
+	// ">1400", "<100", "1500" or "1400-1500", see ParseLength
+	Length string `yaml:"length,omitempty" json:"length,omitempty"`
+	// Tags label the rule, e.g. with its team or purpose, for listing and
+	// switching rules by tag through the admin API
+	Tags []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	// Enabled set to false keeps the rule in the config but out of the
+	// ruleset, e.g. to bisect a policy problem
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	// Expires ends the rule, e.g. a temporary allowance; expired rules are
+	// left out of the ruleset
+	Expires *time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+}
+
+// IsEnabled reports whether the rule is programmed, which it is unless
+// enabled is false
+func (r *Rule) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// Expired reports whether the rule has expired by now
+func (r *Rule) Expired(now time.Time) bool {
+	return r.Expires != nil && !now.Before(*r.Expires)
+}
+
+// MatchesCtState reports whether the rule matches packets in state, which
+// it does for every state unless ct_states is set
+func (r *Rule) MatchesCtState(state CtState) bool {
+	if len(r.CtStates) == 0 {
+		return true
+	}
+	for _, s := range r.CtStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesPacket reports whether the rule matches what tells packets of a
+// connection apart, their TTL or length
+func (r *Rule) MatchesPacket() bool {
+	return r.TTLLessThan != 0 || r.TTLEqual != 0 || r.Length != ""
+}
+
+// HasTag reports whether the rule is tagged tag
+func (r *Rule) HasTag(tag string) bool {
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Action represents allow or deny
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+)
+
+// DenyBehavior is how a deny rule ends a connection
+type DenyBehavior string
+
+const (
+	DenyDrop   DenyBehavior = "drop"
+	DenyReject DenyBehavior = "reject"
+	// DenyRejectTCPRST resets TCP connections and rejects other protocols
+	DenyRejectTCPRST DenyBehavior = "reject-tcp-rst"
+)
+
+// ICMP codes rejects answer with
+const (
+	RejectPortUnreachable = "port-unreachable"
+	RejectAdminProhibited = "admin-prohibited"
+)
+
+// Egress represents egress filtering criteria
+type Egress struct {
+	Protocols []Protocol `yaml:"protocols,omitempty" json:"protocols,omitempty"`
+	Domains   []string   `yaml:"domains,omitempty" json:"domains,omitempty"`
+	IPs       []string   `yaml:"ips,omitempty" json:"ips,omitempty"`
+	// Ports are ports, ranges such as 8000-9000 or the names of port
+	// groups, expanded on parsing
+	Ports []string `yaml:"ports,omitempty" json:"ports,omitempty"`
+	// PortGroup is the group the ports were expanded from, if the rule
+	// named a single group and no other ports
+	PortGroup string `yaml:"-" json:"-"`
+	// PortGroups are all the groups the ports were expanded from
+	PortGroups []string `yaml:"-" json:"-"`
+	// L7 restricts the rule to flows whose first payload looks like one of
+	// these application protocols, on any port
+	L7 []AppProtocol `yaml:"l7,omitempty" json:"l7,omitempty"`
+	// Services are destinations whose addresses are discovered, kept in
+	// sync with the services' current endpoints
+	Services []ServiceRef `yaml:"services,omitempty" json:"services,omitempty"`
+	// ASNs are autonomous systems, e.g. AS15169, whose announced prefixes
+	// are destinations
+	ASNs []string `yaml:"asns,omitempty" json:"asns,omitempty"`
+	// NotIPs, NotPorts and NotDomains are destinations the rule doesn't
+	// match even if its other matchers do, e.g. any address but RFC1918
+	NotIPs     []string `yaml:"not_ips,omitempty" json:"not_ips,omitempty"`
+	NotPorts   []string `yaml:"not_ports,omitempty" json:"not_ports,omitempty"`
+	NotDomains []string `yaml:"not_domains,omitempty" json:"not_domains,omitempty"`
+	// AnyOf matches the traffic any of its entries matches and AllOf the
+	// traffic all of them match, along with the other matchers. Entries
+	// take protocols, domains, ips, ports and the not_ matchers, and can
+	// nest any_of and all_of.
+	AnyOf []Egress `yaml:"any_of,omitempty" json:"any_of,omitempty"`
+	AllOf []Egress `yaml:"all_of,omitempty" json:"all_of,omitempty"`
+}
+
+// maxBranches bounds the alternatives any_of and all_of expand to
+const maxBranches = 64
+
+// Excludes reports whether the rule has any negated matcher
+func (e Egress) Excludes() bool {
+	return len(e.NotIPs) > 0 || len(e.NotPorts) > 0 || len(e.NotDomains) > 0
+}
+
+// Compound reports whether the egress has any_of or all_of entries
+func (e Egress) Compound() bool {
+	return len(e.AnyOf) > 0 || len(e.AllOf) > 0
+}
+
+// hasDestinations reports whether the egress matches destinations
+func (e Egress) hasDestinations() bool {
+	return len(e.Domains) > 0 || len(e.IPs) > 0 || len(e.Services) > 0 || len(e.ASNs) > 0
+}
+
+// AllDomains returns the domains of the egress and of its any_of and
+// all_of entries
+func (e Egress) AllDomains() []string {
+	if !e.Compound() {
+		return e.Domains
+	}
+	domains := append([]string(nil), e.Domains...)
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		seen[domain] = true
+	}
+	for _, entry := range append(append([]Egress(nil), e.AnyOf...), e.AllOf...) {
+		for _, domain := range entry.AllDomains() {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains
+}
+
+// Branches returns the alternatives the egress matches, without any_of and
+// all_of: the egress itself unless compound, otherwise one for each any_of
+// entry and combination of the alternatives of the all_of entries, each
+// along with the egress's own matchers. Alternatives that match nothing,
+// such as of disjoint ports, are left out.
+func (e Egress) Branches() ([]Egress, error) {
+	base := e
+	base.AnyOf, base.AllOf = nil, nil
+	branches := []Egress{base}
+	for _, entry := range e.AllOf {
+		alternatives, err := entry.Branches()
+		if err != nil {
+			return nil, err
+		}
+		if branches, err = combineBranches(branches, alternatives); err != nil {
+			return nil, err
+		}
+	}
+	if len(e.AnyOf) == 0 {
+		return branches, nil
+	}
+	var alternatives []Egress
+	for _, entry := range e.AnyOf {
+		entryBranches, err := entry.Branches()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, entryBranches...)
+	}
+	return combineBranches(branches, alternatives)
+}
+
+// combineBranches returns the alternatives matching what one of a and one
+// of b both match
+func combineBranches(a, b []Egress) ([]Egress, error) {
+	var result []Egress
+	for _, x := range a {
+		for _, y := range b {
+			z, ok, err := intersectEgress(x, y)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if len(result) == maxBranches {
+				return nil, fmt.Errorf("any_of and all_of expand to more than %d alternatives", maxBranches)
+			}
+			result = append(result, z)
+		}
+	}
+	return result, nil
+}
+
+// intersectEgress returns the egress matching what both x and y match,
+// false if nothing does. Only one of them can have destinations, since the
+// addresses of domains can't be intersected ahead of time.
+func intersectEgress(x, y Egress) (Egress, bool, error) {
+	if x.hasDestinations() && y.hasDestinations() {
+		return Egress{}, false, fmt.Errorf("only one of the matchers any_of and all_of combine can have destinations")
+	}
+	z := x
+	if y.hasDestinations() {
+		z.Domains, z.IPs, z.Services, z.ASNs = y.Domains, y.IPs, y.Services, y.ASNs
+	}
+
+	switch {
+	case len(y.Protocols) == 0:
+	case len(x.Protocols) == 0:
+		z.Protocols = y.Protocols
+	default:
+		z.Protocols = nil
+		for _, proto := range x.Protocols {
+			for _, other := range y.Protocols {
+				if proto == other {
+					z.Protocols = append(z.Protocols, proto)
+					break
+				}
+			}
+		}
+		if len(z.Protocols) == 0 {
+			return Egress{}, false, nil
+		}
+	}
+
+	switch {
+	case len(y.Ports) == 0:
+	case len(x.Ports) == 0:
+		z.Ports, z.PortGroup = y.Ports, y.PortGroup
+	default:
+		z.Ports, z.PortGroup = intersectPorts(x.Ports, y.Ports), ""
+		if len(z.Ports) == 0 {
+			return Egress{}, false, nil
+		}
+	}
+
+	// Traffic excluded by either is excluded
+	z.NotIPs = append(append([]string(nil), x.NotIPs...), y.NotIPs...)
+	z.NotPorts = append(append([]string(nil), x.NotPorts...), y.NotPorts...)
+	z.NotDomains = append(append([]string(nil), x.NotDomains...), y.NotDomains...)
+	return z, true, nil
+}
+
+// intersectPorts returns the ports and ranges in both a and b; ports that
+// don't parse, such as port groups not yet expanded, are left out
+func intersectPorts(a, b []string) []string {
+	var ports []string
+	for _, p := range a {
+		start, end, err := ParsePortRange(p)
+		if err != nil {
+			continue
+		}
+		for _, q := range b {
+			otherStart, otherEnd, err := ParsePortRange(q)
+			if err != nil {
+				continue
+			}
+			from, to := max(start, otherStart), min(end, otherEnd)
+			switch {
+			case from > to:
+			case from == to:
+				ports = append(ports, strconv.Itoa(int(from)))
+			default:
+				ports = append(ports, fmt.Sprintf("%d-%d", from, to))
+			}
+		}
+	}
+	return ports
+}
+
+// ServiceRef names a service in one of the discovery sources
+type ServiceRef struct {
+	// Consul is the name of a service in the Consul catalog; only
+	// instances passing their health checks are allowed
+	Consul string `yaml:"consul,omitempty" json:"consul,omitempty"`
+	// Kubernetes is a service as namespace/name; its ready endpoints are
+	// allowed
+	Kubernetes string `yaml:"kubernetes,omitempty" json:"kubernetes,omitempty"`
+	// SRV is a DNS SRV name, e.g. _payments._tcp.example.com; the
+	// addresses of its targets are allowed
+	SRV string `yaml:"srv,omitempty" json:"srv,omitempty"`
+}
+
+// String identifies the service, e.g. consul:payments
+func (s ServiceRef) String() string {
+	switch {
+	case s.Consul != "":
+		return "consul:" + s.Consul
+	case s.Kubernetes != "":
+		return "kubernetes:" + s.Kubernetes
+	default:
+		return "srv:" + s.SRV
+	}
+}
+
+// Validate checks that exactly one source names the service
+func (s ServiceRef) Validate() error {
+	set := 0
+	for _, name := range []string{s.Consul, s.Kubernetes, s.SRV} {
+		if name != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("a service needs exactly one of consul, kubernetes and srv")
+	}
+	if s.Kubernetes != "" {
+		namespace, name, ok := strings.Cut(s.Kubernetes, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("kubernetes service %q must be namespace/name", s.Kubernetes)
+		}
+	}
+	return nil
+}
+
+// AppProtocol is an application protocol detected from payload
+type AppProtocol string
+
+const (
+	AppSSH  AppProtocol = "ssh"
+	AppTLS  AppProtocol = "tls"
+	AppHTTP AppProtocol = "http"
+	AppDNS  AppProtocol = "dns"
+)
+
+// Protocol represents network protocols
+type Protocol string
+
+const (
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolUDP  Protocol = "udp"
+	ProtocolICMP Protocol = "icmp"
+)
+
+// CtState is the conntrack state of a connection a packet belongs to
+type CtState string
+
+const (
+	CtStateNew         CtState = "new"
+	CtStateEstablished CtState = "established"
+	CtStateRelated     CtState = "related"
+	CtStateInvalid     CtState = "invalid"
+	CtStateUntracked   CtState = "untracked"
+)
+
+// validCtState reports whether state is a conntrack state
+func validCtState(state CtState) bool {
+	switch state {
+	case CtStateNew, CtStateEstablished, CtStateRelated, CtStateInvalid, CtStateUntracked:
+		return true
+	}
+	return false
+}
+
+// Load reads and parses the configuration file
+// Supports both YAML (.yaml, .yml) and JSON (.json) formats
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return parse(data, strings.ToLower(filepath.Ext(path)))
+}
+
+// LoadTests reads policy tests kept apart from the config, in a YAML or
+// JSON file with a tests list
+func LoadTests(path string) ([]PolicyTest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tests: %w", err)
+	}
+	var file struct {
+		Tests []PolicyTest `yaml:"tests" json:"tests"`
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tests: %w", err)
+	}
+	for i, test := range file.Tests {
+		if err := test.Validate(); err != nil {
+			return nil, fmt.Errorf("test %d (%s): %w", i, test.Name, err)
+		}
+	}
+	return file.Tests, nil
+}
+
+// Parse parses and validates a YAML or JSON configuration
+func Parse(data []byte) (*Config, error) {
+	return parse(data, "")
+}
+
+// parse parses a configuration in the format of a file extension, trying
+// YAML then JSON if the extension is unknown
+func parse(data []byte, ext string) (*Config, error) {
+	var cfg Config
+
+	switch ext {
+	case ".json":
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON config: %w", err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML config: %w", err)
+		}
+	default:
+		// Try YAML first (backward compatibility), then JSON
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			if jsonErr := json.Unmarshal(data, &cfg); jsonErr != nil {
+				return nil, fmt.Errorf("failed to parse config as YAML or JSON: %w", err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	cfg.ExpandPortGroups()
+
+	// Sort rules by order (lower number = higher priority), then by verdict
+	// if the conflict policy lets one override the other
+	sortRules(cfg.Rules)
+	cfg.EffectiveConflictPolicy().Arrange(cfg.Rules)
+	if cfg.Maintenance != nil {
+		sortRules(cfg.Maintenance.Rules)
+		cfg.EffectiveConflictPolicy().Arrange(cfg.Maintenance.Rules)
+	}
+
+	return &cfg, nil
+}
+
+// sortRules sorts rules by order (lower number = higher priority)
+func sortRules(rules []Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Order < rules[j].Order
+	})
+}
+
+// Hash identifies the policy of c: the first 12 hex digits of the SHA-256
+// of its JSON encoding
+func (c *Config) Hash() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// Validate checks if the configuration is valid
+func (c *Config) Validate() error {
+	if c.Version == "" {
+		return fmt.Errorf("version is required")
+	}
+
+	if len(c.Rules) == 0 {
+		return fmt.Errorf("at least one rule is required")
+	}
+
+	if err := c.DNS.Validate(); err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	if c.Inspection != nil && !c.Inspection.SNI &&
+		(c.Inspection.VerifyCertificate || c.Inspection.Fingerprints || c.Inspection.ReverseDNS != nil) {
+		return fmt.Errorf("inspection: verify_certificate, fingerprints and reverse_dns require sni")
+	}
+	if c.Inspection != nil && c.Inspection.ReverseDNS != nil &&
+		(c.Inspection.ReverseDNS.CacheTTL < 0 || c.Inspection.ReverseDNS.Rate < 0) {
+		return fmt.Errorf("inspection: reverse_dns cache_ttl and rate must not be negative")
+	}
+	for _, src := range c.InspectionExemptSources {
+		if !isAddress(src) {
+			return fmt.Errorf("inspection_exempt_sources: invalid address %q", src)
+		}
+	}
+
+	if c.Admin != nil {
+		if err := c.Admin.Validate(); err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+	}
+
+	if c.Cluster != nil {
+		if _, _, err := net.SplitHostPort(c.Cluster.Controller); err != nil {
+			return fmt.Errorf("cluster: invalid controller address %q: %w", c.Cluster.Controller, err)
+		}
+		if c.Cluster.ReportInterval < 0 {
+			return fmt.Errorf("cluster: report_interval must not be negative")
+		}
+		if (c.Cluster.CertFile == "") != (c.Cluster.KeyFile == "") {
+			return fmt.Errorf("cluster: cert_file and key_file must be set together")
+		}
+		if (c.Cluster.CertFile != "" || c.Cluster.ControllerID != "") && c.Cluster.CAFile == "" {
+			return fmt.Errorf("cluster: cert_file and controller_id need ca_file")
+		}
+		if id := c.Cluster.ControllerID; id != "" && !strings.HasPrefix(id, "spiffe://") {
+			return fmt.Errorf("cluster: controller_id %q is not a SPIFFE ID", id)
+		}
+	}
+
+	if c.HA != nil {
+		if err := c.HA.Validate(); err != nil {
+			return fmt.Errorf("ha: %w", err)
+		}
+	}
+
+	if c.Chain != nil {
+		if err := c.Chain.Validate(); err != nil {
+			return fmt.Errorf("chain: %w", err)
+		}
+	}
+
+	switch c.EffectiveOnShutdown() {
+	case ShutdownOpen, ShutdownClosed, ShutdownKeep:
+	default:
+		return fmt.Errorf("on_shutdown must be 'open', 'closed' or 'keep'")
+	}
+	switch c.EffectiveConflictPolicy() {
+	case ConflictFirstMatch, ConflictDenyOverrides, ConflictAllowOverrides:
+	default:
+		return fmt.Errorf("conflict_policy must be 'first-match', 'deny-overrides' or 'allow-overrides'")
+	}
+	if c.Persist != nil {
+		if err := c.Persist.Validate(); err != nil {
+			return fmt.Errorf("persist: %w", err)
+		}
+	}
+
+	if c.ConnectionLog != nil {
+		if err := c.ConnectionLog.Validate(); err != nil {
+			return fmt.Errorf("connection_log: %w", err)
+		}
+		if c.ConnectionLog.Processes && (c.Chain == nil || c.Chain.Hook != "output") {
+			return fmt.Errorf("connection_log: processes needs the output hook, as forwarded connections have no local process")
+		}
+	}
+	if c.Events != nil {
+		if err := c.Events.Validate(); err != nil {
+			return fmt.Errorf("events: %w", err)
+		}
+	}
+	if c.DecisionLog != nil {
+		if err := c.DecisionLog.Validate(); err != nil {
+			return fmt.Errorf("decision_log: %w", err)
+		}
+	}
+	if c.Metrics != nil {
+		if err := c.Metrics.Validate(); err != nil {
+			return fmt.Errorf("metrics: %w", err)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
+		}
+		if rule.ID != "" {
+			if ids[rule.ID] {
+				return fmt.Errorf("rule %d (%s): id %s is used twice", i, rule.Name, rule.ID)
+			}
+			ids[rule.ID] = true
+		}
+	}
+
+	if c.Maintenance != nil {
+		if err := c.Maintenance.Validate(c.Rules); err != nil {
+			return fmt.Errorf("maintenance: %w", err)
+		}
+	}
+
+	for i, test := range c.Tests {
+		if err := test.Validate(); err != nil {
+			return fmt.Errorf("test %d (%s): %w", i, test.Name, err)
+		}
+	}
+
+	if c.Rollout != nil {
+		if err := c.Rollout.Validate(); err != nil {
+			return fmt.Errorf("rollout: %w", err)
+		}
+	}
+
+	if err := c.validateVLANs(); err != nil {
+		return err
+	}
+	if err := c.validateVRFs(); err != nil {
+		return err
+	}
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+	if err := c.validateProfiles(); err != nil {
+		return err
+	}
+	if err := c.validateServices(); err != nil {
+		return err
+	}
+	if err := c.validateIPGroups(); err != nil {
+		return err
+	}
+	if err := c.validatePortGroups(); err != nil {
+		return err
+	}
+	if c.RejectShadowedRules {
+		if err := c.validateShadowedRules(); err != nil {
+			return err
+		}
+	}
+	if c.MetadataProtection != nil {
+		if err := c.MetadataProtection.Validate(); err != nil {
+			return fmt.Errorf("metadata_protection: %w", err)
+		}
+	}
+	if c.Hardening != nil {
+		if err := c.Hardening.Validate(); err != nil {
+			return fmt.Errorf("hardening: %w", err)
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("rate_limit: %w", err)
+		}
+	}
+	if c.Ban != nil {
+		if err := c.Ban.Validate(); err != nil {
+			return fmt.Errorf("ban: %w", err)
+		}
+	}
+	if c.NAT != nil {
+		if err := c.NAT.Validate(); err != nil {
+			return fmt.Errorf("nat: %w", err)
+		}
+	}
+	if c.UPnP != nil {
+		if err := c.UPnP.Validate(); err != nil {
+			return fmt.Errorf("upnp: %w", err)
+		}
+	}
+	if c.BlockPage != nil && c.Chain != nil && c.Chain.Hook == "output" {
+		return fmt.Errorf("block_page: the output hook sees no forwarded traffic to redirect")
+	}
+	if c.Honeypot != nil {
+		if err := c.Honeypot.Validate(); err != nil {
+			return fmt.Errorf("honeypot: %w", err)
+		}
+		if c.Chain != nil && c.Chain.Hook == "output" {
+			return fmt.Errorf("honeypot: the output hook sees no forwarded traffic to redirect")
+		}
+	}
+	if c.BGP != nil {
+		if err := c.BGP.Validate(); err != nil {
+			return fmt.Errorf("bgp: %w", err)
+		}
+	}
+
+	// A domain can only be resolved through one set of resolvers, since the
+	// resolver cache is shared between rules
+	domainResolvers := make(map[string]string)
+	for _, rule := range c.Rules {
+		if len(rule.Resolvers) == 0 {
+			continue
+		}
+		servers := strings.Join(rule.Resolvers, ",")
+		for _, domain := range rule.Egress.AllDomains() {
+			if prev, ok := domainResolvers[domain]; ok && prev != servers {
+				return fmt.Errorf("domain %s is assigned conflicting resolvers (%s and %s)", domain, prev, servers)
+			}
+			domainResolvers[domain] = servers
+		}
+	}
+
+	return nil
+}
+
+// addressLiteral returns what kind of address literal a domain is: an
+// address, a network or an address with a port; "" for a name
+func addressLiteral(domain string) string {
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		if net.ParseIP(h) != nil {
+			return "address with a port"
+		}
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if net.ParseIP(host) != nil {
+		return "address"
+	}
+	if _, _, err := net.ParseCIDR(host); err == nil {
+		return "network"
+	}
+	return ""
 }
 
-// Action represents allow or deny
-type Action string
+// Validate checks if the DNS configuration is valid
+func (d *DNSConfig) Validate() error {
+	for _, server := range d.Servers {
+		if err := validateServer(server); err != nil {
+			return err
+		}
+	}
+
+	if d.Aggregation != nil {
+		if d.Aggregation.Rounds < 1 {
+			return fmt.Errorf("aggregation: rounds must be at least 1")
+		}
+		if d.Aggregation.IPTTL <= 0 {
+			return fmt.Errorf("aggregation: ip_ttl must be positive")
+		}
+	}
+
+	switch d.Startup.EffectivePolicy() {
+	case StartupRetry, StartupBlock, StartupSkip:
+	case StartupPersisted:
+		if d.CacheFile == "" {
+			return fmt.Errorf("startup policy 'persisted' requires cache_file")
+		}
+	default:
+		return fmt.Errorf("startup policy must be 'retry', 'block', 'persisted' or 'skip'")
+	}
+	if d.Startup.Timeout < 0 || d.Startup.MaxBackoff < 0 {
+		return fmt.Errorf("startup timeout and max_backoff must not be negative")
+	}
+	if d.Startup.Lazy && d.Startup.EffectivePolicy() == StartupBlock {
+		return fmt.Errorf("lazy startup resolution can't be combined with startup policy 'block'")
+	}
+
+	if d.ClientSubnet != "" {
+		if _, _, err := net.ParseCIDR(d.ClientSubnet); err != nil {
+			return fmt.Errorf("invalid client subnet %q: %w", d.ClientSubnet, err)
+		}
+	}
+
+	if d.Refresh.Concurrency < 0 {
+		return fmt.Errorf("refresh concurrency must not be negative")
+	}
+	if d.Refresh.Jitter < 0 || d.Refresh.Deadline < 0 {
+		return fmt.Errorf("refresh jitter and deadline must not be negative")
+	}
+	if err := validateDNSInterval(d.Refresh.Interval); err != nil {
+		return fmt.Errorf("refresh interval %w", err)
+	}
+	if err := validateDNSInterval(d.CacheTTL); err != nil {
+		return fmt.Errorf("cache_ttl %w", err)
+	}
+	if d.CacheMaxEntries < 0 {
+		return fmt.Errorf("cache_max_entries must not be negative")
+	}
+
+	switch d.Pool.EffectiveStrategy() {
+	case PoolOrdered, PoolRoundRobin, PoolFastest:
+	default:
+		return fmt.Errorf("pool strategy must be 'ordered', 'round_robin' or 'fastest'")
+	}
+	if d.Pool.FailureThreshold < 0 {
+		return fmt.Errorf("pool failure_threshold must not be negative")
+	}
+	if d.Pool.ProbeInterval != 0 && d.Pool.ProbeInterval < Duration(time.Second) {
+		return fmt.Errorf("pool probe_interval must be at least 1s")
+	}
+
+	if d.Proxy != nil {
+		if err := d.Proxy.Validate(); err != nil {
+			return fmt.Errorf("proxy: %w", err)
+		}
+	}
+
+	for _, s := range d.Suffixes {
+		if s.Suffix == "" {
+			return fmt.Errorf("suffix is required")
+		}
+		if len(s.Servers) == 0 {
+			return fmt.Errorf("suffix %s: at least one server is required", s.Suffix)
+		}
+		for _, server := range s.Servers {
+			if err := validateServer(server); err != nil {
+				return fmt.Errorf("suffix %s: %w", s.Suffix, err)
+			}
+		}
+	}
+
+	return nil
+}
 
-const (
-	ActionAllow Action = "allow"
-	ActionDeny  Action = "deny"
-)
+// validateVLANs checks the VLAN subinterfaces and the VLANs rules refer to
+func (c *Config) validateVLANs() error {
+	ids := make(map[uint16]bool)
+	for _, v := range c.VLANs {
+		if v.ID < 1 || v.ID > 4094 {
+			return fmt.Errorf("vlan %d: id must be between 1 and 4094", v.ID)
+		}
+		if ids[v.ID] {
+			return fmt.Errorf("vlan %d is defined twice", v.ID)
+		}
+		ids[v.ID] = true
+		if v.Parent == "" {
+			return fmt.Errorf("vlan %d: parent is required", v.ID)
+		}
+		if len(v.InterfaceName()) > 15 {
+			return fmt.Errorf("vlan %d: interface name %s is longer than 15 characters", v.ID, v.InterfaceName())
+		}
+		for _, addr := range v.Addresses {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return fmt.Errorf("vlan %d: invalid address %q: %w", v.ID, addr, err)
+			}
+		}
+	}
 
-// Egress represents egress filtering criteria
-type Egress struct {
-	Protocols []Protocol `yaml:"protocols,omitempty" json:"protocols,omitempty"`
-	Domains   []string   `yaml:"domains,omitempty" json:"domains,omitempty"`
-	IPs       []string   `yaml:"ips,omitempty" json:"ips,omitempty"`
-	Ports     []string   `yaml:"ports,omitempty" json:"ports,omitempty"`
+	rules := c.Rules
+	if c.Maintenance != nil {
+		rules = append(append([]Rule(nil), rules...), c.Maintenance.Rules...)
+	}
+	for _, rule := range rules {
+		if rule.VLANID != 0 && !ids[rule.VLANID] {
+			return fmt.Errorf("rule %s: vlan %d is not defined under vlans", rule.Name, rule.VLANID)
+		}
+	}
+	return nil
 }
 
-// Protocol represents network protocols
-type Protocol string
+// validateVRFs checks the VRF devices and the VRFs rules refer to
+func (c *Config) validateVRFs() error {
+	names := make(map[string]bool)
+	for _, v := range c.VRFs {
+		if v.Name == "" {
+			return fmt.Errorf("vrf name is required")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("vrf %s is defined twice", v.Name)
+		}
+		names[v.Name] = true
+		if len(v.Name) > 15 {
+			return fmt.Errorf("vrf %s: name is longer than 15 characters", v.Name)
+		}
+		if v.Create && v.Table == 0 {
+			return fmt.Errorf("vrf %s: table is required to create it", v.Name)
+		}
+	}
 
-const (
-	ProtocolTCP  Protocol = "tcp"
-	ProtocolUDP  Protocol = "udp"
-	ProtocolICMP Protocol = "icmp"
-)
+	rules := c.Rules
+	if c.Maintenance != nil {
+		rules = append(append([]Rule(nil), rules...), c.Maintenance.Rules...)
+	}
+	for _, rule := range rules {
+		if rule.VRF == "" {
+			continue
+		}
+		if !names[rule.VRF] {
+			return fmt.Errorf("rule %s: vrf %s is not defined under vrfs", rule.Name, rule.VRF)
+		}
+		// VRF traffic is matched by the VRF device, not the interface it
+		// arrived on
+		if rule.VLANID != 0 {
+			return fmt.Errorf("rule %s: vlan_id and vrf cannot be combined", rule.Name)
+		}
+	}
+	return nil
+}
 
-// Load reads and parses the configuration file
-// Supports both YAML (.yaml, .yml) and JSON (.json) formats
-func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+// validateRoutes checks the static routes
+func (c *Config) validateRoutes() error {
+	for _, r := range c.Routes {
+		network, err := r.Network()
+		if err != nil {
+			return fmt.Errorf("route %s: %w", r.Destination, err)
+		}
+		if r.Gateway == "" && r.Interface == "" {
+			return fmt.Errorf("route %s: gateway or interface is required", r.Destination)
+		}
+		if r.Gateway != "" {
+			gw := net.ParseIP(r.Gateway)
+			if gw == nil {
+				return fmt.Errorf("route %s: invalid gateway %q", r.Destination, r.Gateway)
+			}
+			if (gw.To4() == nil) != (network.IP.To4() == nil) {
+				return fmt.Errorf("route %s: gateway %s is not in the address family of the destination", r.Destination, r.Gateway)
+			}
+		}
+		if r.Metric < 0 {
+			return fmt.Errorf("route %s: metric must not be negative", r.Destination)
+		}
+		if r.VRF != "" {
+			vrf, ok := c.VRF(r.VRF)
+			if !ok {
+				return fmt.Errorf("route %s: vrf %s is not defined under vrfs", r.Destination, r.VRF)
+			}
+			if vrf.Table == 0 {
+				return fmt.Errorf("route %s: vrf %s has no table", r.Destination, r.VRF)
+			}
+		}
 	}
+	return nil
+}
 
-	var cfg Config
+// validateProfiles checks the profiles and the profiles rules refer to
+func (c *Config) validateProfiles() error {
+	names := make(map[string]bool)
+	for _, p := range c.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile name is required")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("profile %s is defined twice", p.Name)
+		}
+		names[p.Name] = true
+		for _, source := range p.Sources {
+			if net.ParseIP(source) == nil {
+				if _, _, err := net.ParseCIDR(source); err != nil {
+					return fmt.Errorf("profile %s: invalid source %q", p.Name, source)
+				}
+			}
+		}
+		for _, host := range p.Hosts {
+			if !c.DNS.inLocalZone(host) {
+				return fmt.Errorf("profile %s: host %s is not in a local zone of dns.proxy", p.Name, host)
+			}
+		}
+	}
 
-	// Detect format based on file extension
-	ext := strings.ToLower(filepath.Ext(path))
-	switch ext {
-	case ".json":
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			return nil, fmt.Errorf("failed to parse JSON config: %w", err)
+	rules := c.Rules
+	if c.Maintenance != nil {
+		rules = append(append([]Rule(nil), rules...), c.Maintenance.Rules...)
+	}
+	for _, rule := range rules {
+		if rule.Profile == "" {
+			continue
 		}
-	case ".yaml", ".yml":
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return nil, fmt.Errorf("failed to parse YAML config: %w", err)
+		if !names[rule.Profile] {
+			return fmt.Errorf("rule %s: profile %s is not defined under profiles", rule.Name, rule.Profile)
 		}
-	default:
-		// Try YAML first (backward compatibility), then JSON
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			if jsonErr := json.Unmarshal(data, &cfg); jsonErr != nil {
-				return nil, fmt.Errorf("failed to parse config as YAML or JSON: %w", err)
+		// Both are evaluated in a chain of their own
+		if rule.VRF != "" {
+			return fmt.Errorf("rule %s: vrf and profile cannot be combined", rule.Name)
+		}
+	}
+	return nil
+}
+
+// validateServices checks that the discovery sources of the services rules
+// name are configured
+func (c *Config) validateServices() error {
+	d := c.Discovery
+	if d != nil && d.Interval < 0 {
+		return fmt.Errorf("discovery: interval must not be negative")
+	}
+
+	rules := c.Rules
+	if c.Maintenance != nil {
+		rules = append(append([]Rule(nil), rules...), c.Maintenance.Rules...)
+	}
+	for _, rule := range rules {
+		for _, service := range rule.Egress.Services {
+			if service.Consul != "" && (d == nil || d.Consul == nil) {
+				return fmt.Errorf("rule %s: service %s requires discovery.consul", rule.Name, service)
+			}
+			if service.Kubernetes != "" && (d == nil || d.Kubernetes == nil) {
+				return fmt.Errorf("rule %s: service %s requires discovery.kubernetes", rule.Name, service)
 			}
 		}
 	}
+	return nil
+}
 
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
+// validateIPGroups checks the cloud range groups rules name
+func (c *Config) validateIPGroups() error {
+	if r := c.IPRanges; r != nil && r.Refresh < 0 {
+		return fmt.Errorf("ip_ranges: refresh must not be negative")
+	}
+	if a := c.ASNPrefixes; a != nil && a.Refresh < 0 {
+		return fmt.Errorf("asn_prefixes: refresh must not be negative")
 	}
 
-	// Sort rules by order (lower number = higher priority)
-	sort.Slice(cfg.Rules, func(i, j int) bool {
-		return cfg.Rules[i].Order < cfg.Rules[j].Order
-	})
+	rules := c.Rules
+	if c.Maintenance != nil {
+		rules = append(append([]Rule(nil), rules...), c.Maintenance.Rules...)
+	}
+	for _, rule := range rules {
+		for _, ip := range rule.Egress.IPs {
+			if !IsIPGroup(ip) {
+				continue
+			}
+			group, err := ParseIPGroup(ip)
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			if group.Provider == ProviderAzure && (c.IPRanges == nil || c.IPRanges.AzureURL == "") {
+				return fmt.Errorf("rule %s: %s requires ip_ranges.azure_url", rule.Name, ip)
+			}
+			if group.Provider == ProviderBGP {
+				if c.BGP == nil {
+					return fmt.Errorf("rule %s: %s requires bgp", rule.Name, ip)
+				}
+				if _, ok := c.BGP.Group(group.Service); !ok {
+					return fmt.Errorf("rule %s: bgp group %s is not defined under bgp.groups", rule.Name, group.Service)
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	return &cfg, nil
+// validatePortGroups checks the port groups and the rules naming them
+func (c *Config) validatePortGroups() error {
+	for name, definition := range c.PortGroups {
+		if !IsPortGroup(name) || strings.ContainsAny(name, " \t,/") {
+			return fmt.Errorf("port_groups: invalid name %q: names can't start with a digit or contain spaces, commas or slashes", name)
+		}
+		if _, err := ParsePortGroup(definition); err != nil {
+			return fmt.Errorf("port_groups: %w", err)
+		}
+	}
+
+	rules := c.Rules
+	if c.Maintenance != nil {
+		rules = append(append([]Rule(nil), rules...), c.Maintenance.Rules...)
+	}
+	for _, rule := range rules {
+		if _, _, err := c.expandPorts(rule); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	return nil
 }
 
-// Validate checks if the configuration is valid
-func (c *Config) Validate() error {
-	if c.Version == "" {
-		return fmt.Errorf("version is required")
+// expandPorts returns the protocols and ports of a rule with the port
+// groups it names replaced by their ports; a group of one protocol limits
+// the rule to that protocol, so all of its groups must agree on it
+func (c *Config) expandPorts(rule Rule) ([]Protocol, []string, error) {
+	protocols := rule.Egress.Protocols
+	var ports []string
+	for _, port := range rule.Egress.Ports {
+		if !IsPortGroup(port) {
+			ports = append(ports, port)
+			continue
+		}
+		definition, ok := c.PortGroups[port]
+		if !ok {
+			return nil, nil, fmt.Errorf("port group %s is not defined under port_groups", port)
+		}
+		group, err := ParsePortGroup(definition)
+		if err != nil {
+			return nil, nil, err
+		}
+		ports = append(ports, group.Ports...)
+		if group.Protocol == "" {
+			continue
+		}
+		switch {
+		case len(protocols) == 0:
+			protocols = []Protocol{group.Protocol}
+		case len(protocols) != 1 || protocols[0] != group.Protocol:
+			return nil, nil, fmt.Errorf("port group %s is %s only, but the rule matches %s", port, group.Protocol, joinProtocols(protocols))
+		}
 	}
+	return protocols, ports, nil
+}
 
-	if len(c.Rules) == 0 {
+// joinProtocols lists protocols separated by commas
+func joinProtocols(protocols []Protocol) string {
+	names := make([]string, len(protocols))
+	for i, proto := range protocols {
+		names[i] = string(proto)
+	}
+	return strings.Join(names, ", ")
+}
+
+// ExpandPortGroups replaces the port groups rules name in egress ports by
+// their ports and protocol. Rules naming a single group and no other ports
+// keep its name in PortGroup, so that they can share the group's set.
+// Must be called on a valid config
+func (c *Config) ExpandPortGroups() {
+	if len(c.PortGroups) == 0 {
+		return
+	}
+	expand := func(rules []Rule) {
+		for i := range rules {
+			rule := &rules[i]
+			protocols, ports, err := c.expandPorts(*rule)
+			if err != nil {
+				continue
+			}
+			for _, port := range rule.Egress.Ports {
+				if IsPortGroup(port) {
+					rule.Egress.PortGroups = append(rule.Egress.PortGroups, port)
+				}
+			}
+			if len(rule.Egress.Ports) == 1 && len(rule.Egress.PortGroups) == 1 {
+				rule.Egress.PortGroup = rule.Egress.PortGroups[0]
+			}
+			rule.Egress.Protocols, rule.Egress.Ports = protocols, ports
+		}
+	}
+	expand(c.Rules)
+	if c.Maintenance != nil {
+		expand(c.Maintenance.Rules)
+	}
+}
+
+// Validate checks if a policy test is valid
+func (t *PolicyTest) Validate() error {
+	if t.Expect != ActionAllow && t.Expect != ActionDeny {
+		return fmt.Errorf("expect must be 'allow' or 'deny'")
+	}
+	if t.Protocol != ProtocolTCP && t.Protocol != ProtocolUDP && t.Protocol != ProtocolICMP {
+		return fmt.Errorf("invalid protocol: %s", t.Protocol)
+	}
+	if t.Protocol != ProtocolICMP && t.Port == 0 {
+		return fmt.Errorf("port is required for %s", t.Protocol)
+	}
+	if t.Destination == "" && t.Domain == "" {
+		return fmt.Errorf("dst or domain is required")
+	}
+	if t.Destination != "" && net.ParseIP(t.Destination) == nil {
+		return fmt.Errorf("invalid dst %q", t.Destination)
+	}
+	if t.Source != "" && net.ParseIP(t.Source) == nil {
+		return fmt.Errorf("invalid src %q", t.Source)
+	}
+	if t.App != "" && t.App != AppSSH && t.App != AppTLS && t.App != AppHTTP && t.App != AppDNS {
+		return fmt.Errorf("invalid app: %s", t.App)
+	}
+	if t.State != "" && !validCtState(t.State) {
+		return fmt.Errorf("invalid state: %s", t.State)
+	}
+	return nil
+}
+
+// Validate checks if the rollout settings are valid
+func (r *RolloutConfig) Validate() error {
+	if r.LogOnly == (r.Percent != 0) {
+		return fmt.Errorf("exactly one of percent and log_only is required")
+	}
+	if r.Percent < 0 || r.Percent > 99 {
+		return fmt.Errorf("percent must be between 1 and 99")
+	}
+	if r.Duration <= 0 {
+		return fmt.Errorf("duration is required")
+	}
+	if r.AbortRatio != 0 && r.AbortRatio < 1 {
+		return fmt.Errorf("abort_ratio must be at least 1")
+	}
+	return nil
+}
+
+// Validate checks if the chain placement names a known family, hook and
+// coexistence
+func (c *ChainConfig) Validate() error {
+	switch c.Family {
+	case "", "inet", "ip", "ip6":
+	default:
+		return fmt.Errorf("unsupported family %q", c.Family)
+	}
+	switch c.Hook {
+	case "", "forward", "prerouting", "output":
+	default:
+		return fmt.Errorf("unsupported hook %q", c.Hook)
+	}
+	if c.Priority != nil && (*c.Priority < -1<<31+10 || *c.Priority > 1<<31-1) {
+		return fmt.Errorf("priority must be a 32 bit integer")
+	}
+	switch c.Coexistence {
+	case "", CoexistWarn, CoexistRefuse, CoexistIntegrate:
+	default:
+		return fmt.Errorf("unsupported coexistence %q", c.Coexistence)
+	}
+	return nil
+}
+
+// Validate checks if the maintenance policy is valid; with Extend, its
+// rule names must not clash with the normal rules
+func (m *MaintenanceConfig) Validate(rules []Rule) error {
+	if len(m.Rules) == 0 {
 		return fmt.Errorf("at least one rule is required")
 	}
+	if m.MaxDuration < 0 {
+		return fmt.Errorf("max_duration must not be negative")
+	}
 
-	for i, rule := range c.Rules {
+	names := make(map[string]bool)
+	if m.Extend {
+		for _, rule := range rules {
+			names[rule.Name] = true
+		}
+	}
+	for i, rule := range m.Rules {
 		if err := rule.Validate(); err != nil {
 			return fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
 		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+// Validate checks if the HA configuration is valid
+func (h *HAConfig) Validate() error {
+	switch h.Role {
+	case "", RoleActive, RoleStandby:
+	default:
+		return fmt.Errorf("role must be 'active' or 'standby'")
+	}
+	if s := h.Sync; s != nil {
+		if _, _, err := net.SplitHostPort(s.Listen); err != nil {
+			return fmt.Errorf("sync: invalid listen address %q: %w", s.Listen, err)
+		}
+		if _, _, err := net.SplitHostPort(s.Peer); err != nil {
+			return fmt.Errorf("sync: invalid peer address %q: %w", s.Peer, err)
+		}
+		if s.Key == "" {
+			return fmt.Errorf("sync: key is required")
+		}
+		if s.Interval < 0 {
+			return fmt.Errorf("sync: interval must not be negative")
+		}
 	}
+	return nil
+}
 
+// validateServer checks that a resolver address is an IP with an optional port
+func validateServer(server string) error {
+	host := server
+	if h, _, err := net.SplitHostPort(server); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid resolver address: %s", server)
+	}
 	return nil
 }
 
@@ -120,6 +3228,26 @@ func (r *Rule) Validate() error {
 	if r.Action != ActionAllow && r.Action != ActionDeny {
 		return fmt.Errorf("action must be 'allow' or 'deny'")
 	}
+	switch r.DenyBehavior {
+	case "", DenyDrop, DenyReject, DenyRejectTCPRST:
+	default:
+		return fmt.Errorf("deny_behavior must be 'drop', 'reject' or 'reject-tcp-rst'")
+	}
+	if r.DenyBehavior != "" && r.Action != ActionDeny {
+		return fmt.Errorf("deny_behavior only applies to deny rules")
+	}
+	switch r.RejectWith {
+	case "":
+	case RejectPortUnreachable, RejectAdminProhibited:
+		if r.DenyBehavior != DenyReject && r.DenyBehavior != DenyRejectTCPRST {
+			return fmt.Errorf("reject_with needs deny_behavior 'reject' or 'reject-tcp-rst'")
+		}
+	default:
+		return fmt.Errorf("reject_with must be 'port-unreachable' or 'admin-prohibited'")
+	}
+	if r.Log && r.Action != ActionDeny {
+		return fmt.Errorf("log only applies to deny rules")
+	}
 
 	// Validate protocols
 	for _, proto := range r.Egress.Protocols {
@@ -128,7 +3256,165 @@ func (r *Rule) Validate() error {
 		}
 	}
 
-	// TODO: Add validation for IPs (CIDR notation), ports (ranges), etc.
+	for _, state := range r.CtStates {
+		if !validCtState(state) {
+			return fmt.Errorf("invalid ct state: %s", state)
+		}
+	}
+	if len(r.CtStates) > 0 && len(r.Egress.L7) > 0 {
+		return fmt.Errorf("ct_states can't be combined with l7, which classifies connections once they are established")
+	}
+	if r.TTLLessThan != 0 && r.TTLEqual != 0 {
+		return fmt.Errorf("only one of ttl_lt and ttl_eq can be set")
+	}
+	if r.Length != "" {
+		if _, _, err := ParseLength(r.Length); err != nil {
+			return err
+		}
+	}
+
+	for _, server := range r.Resolvers {
+		if err := validateServer(server); err != nil {
+			return err
+		}
+	}
+	for _, domain := range r.Egress.Domains {
+		if literal := addressLiteral(domain); literal != "" {
+			return fmt.Errorf("domain %q is an IP %s, not a name: list it under ips instead", domain, literal)
+		}
+	}
+	if r.RefreshInterval != 0 && len(r.Egress.AllDomains()) == 0 {
+		return fmt.Errorf("refresh_interval needs domains")
+	}
+	if err := validateDNSInterval(r.RefreshInterval); err != nil {
+		return fmt.Errorf("refresh_interval %w", err)
+	}
+
+	for _, app := range r.Egress.L7 {
+		if app != AppSSH && app != AppTLS && app != AppHTTP && app != AppDNS {
+			return fmt.Errorf("invalid l7 protocol: %s", app)
+		}
+	}
+	for _, service := range r.Egress.Services {
+		if err := service.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, asn := range r.Egress.ASNs {
+		if _, err := ParseASN(asn); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Egress.L7) > 0 {
+		for _, proto := range r.Egress.Protocols {
+			if proto == ProtocolICMP {
+				return fmt.Errorf("l7 rules only match tcp and udp")
+			}
+		}
+	}
+
+	// IP and port groups are checked against the config in Config.Validate
+	for _, ip := range r.Egress.IPs {
+		if !IsIPGroup(ip) && !isAddress(ip) {
+			return fmt.Errorf("invalid ip: %s", ip)
+		}
+	}
+	for _, port := range r.Egress.Ports {
+		if IsPortGroup(port) {
+			continue
+		}
+		if _, _, err := ParsePortRange(port); err != nil {
+			return err
+		}
+	}
+	if err := validateExclusions(r.Egress); err != nil {
+		return err
+	}
+	if r.Egress.Compound() {
+		if len(r.Egress.L7) > 0 {
+			return fmt.Errorf("l7 can't be combined with any_of or all_of")
+		}
+		if err := validateEntries(r.Egress); err != nil {
+			return err
+		}
+		if _, err := r.Egress.Branches(); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(r.Description+r.Reference, "\r\n") {
+		return fmt.Errorf("description and reference must be a single line")
+	}
+	for _, tag := range r.Tags {
+		if tag == "" || strings.ContainsAny(tag, " \t,/") {
+			return fmt.Errorf("invalid tag %q: tags can't be empty or contain spaces, commas or slashes", tag)
+		}
+	}
+
+	return nil
+}
+
+// validateExclusions checks the not_ matchers of an egress
+func validateExclusions(e Egress) error {
+	for _, ip := range e.NotIPs {
+		if !isAddress(ip) {
+			return fmt.Errorf("invalid not_ips entry: %s", ip)
+		}
+	}
+	for _, port := range e.NotPorts {
+		if _, _, err := ParsePortRange(port); err != nil {
+			return fmt.Errorf("invalid not_ports entry: %w", err)
+		}
+	}
+	for _, domain := range e.NotDomains {
+		if literal := addressLiteral(domain); literal != "" {
+			return fmt.Errorf("not_domains entry %q is an IP %s, not a name: list it under not_ips instead", domain, literal)
+		}
+		// Wildcards are matched by SNI inspection, which can only allow
+		if strings.HasPrefix(domain, "*") {
+			return fmt.Errorf("not_domains entry %s can't be a wildcard", domain)
+		}
+	}
+	return nil
+}
 
+// validateEntries checks the any_of and all_of entries of an egress, which
+// take protocols, domain names, addresses, ports and ranges, and the not_
+// matchers
+func validateEntries(e Egress) error {
+	for _, entry := range append(append([]Egress(nil), e.AnyOf...), e.AllOf...) {
+		if len(entry.L7) > 0 || len(entry.Services) > 0 || len(entry.ASNs) > 0 {
+			return fmt.Errorf("any_of and all_of entries can't have l7, services or asns")
+		}
+		for _, proto := range entry.Protocols {
+			if proto != ProtocolTCP && proto != ProtocolUDP && proto != ProtocolICMP {
+				return fmt.Errorf("invalid protocol: %s", proto)
+			}
+		}
+		for _, domain := range entry.Domains {
+			if literal := addressLiteral(domain); literal != "" {
+				return fmt.Errorf("domain %q is an IP %s, not a name: list it under ips instead", domain, literal)
+			}
+			if strings.HasPrefix(domain, "*") {
+				return fmt.Errorf("any_of and all_of entries can't have wildcard domains such as %s", domain)
+			}
+		}
+		for _, ip := range entry.IPs {
+			if !isAddress(ip) {
+				return fmt.Errorf("invalid ip: %s: any_of and all_of entries take addresses and networks only", ip)
+			}
+		}
+		for _, port := range entry.Ports {
+			if _, _, err := ParsePortRange(port); err != nil {
+				return fmt.Errorf("%w: any_of and all_of entries take ports and ranges only", err)
+			}
+		}
+		if err := validateExclusions(entry); err != nil {
+			return err
+		}
+		if err := validateEntries(entry); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadYAML(t *testing.T) {
@@ -111,6 +114,7 @@ func TestLoadJSON(t *testing.T) {
 }
 
 func TestValidation(t *testing.T) {
+	priority := -150
 	tests := []struct {
 		name    string
 		cfg     Config
@@ -165,6 +169,1344 @@ func TestValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid dns server",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{Servers: []string{"dns.example.com"}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "suffix resolver without servers",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{Suffixes: []SuffixResolver{{Suffix: "corp.example.com"}}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "dns proxy without listen",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{Proxy: &DNSProxyConfig{}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "relative rpz file",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{Proxy: &DNSProxyConfig{Listen: []string{":53"}, RPZ: []RPZConfig{{File: "malware.rpz"}}}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "zone record outside the zone",
+			cfg: Config{
+				Version: "1.0",
+				DNS: DNSConfig{Proxy: &DNSProxyConfig{
+					Listen: []string{":53"},
+					Zones:  []DNSZoneConfig{{Name: "lan", Records: []string{"nas.example.com. A 10.0.0.10"}}},
+				}},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "profile host outside the local zones",
+			cfg: Config{
+				Version: "1.0",
+				DNS: DNSConfig{Proxy: &DNSProxyConfig{
+					Listen: []string{":53"},
+					Zones:  []DNSZoneConfig{{Name: "lan", Leases: &DHCPLeasesConfig{File: "/var/lib/misc/dnsmasq.leases"}}},
+				}},
+				Profiles: []ProfileConfig{{Name: "kids", Hosts: []string{"tablet.home"}}},
+				Rules:    []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid client subnet",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{ClientSubnet: "203.0.113.0"},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "relative persist path",
+			cfg: Config{
+				Version: "1.0",
+				Persist: &PersistConfig{Path: "legion-router.nft"},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "relative connection log file",
+			cfg: Config{
+				Version:       "1.0",
+				ConnectionLog: &ConnectionLogConfig{File: "connections.log"},
+				Rules:         []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "connection log processes",
+			cfg: Config{
+				Version:       "1.0",
+				Chain:         &ChainConfig{Hook: "output"},
+				ConnectionLog: &ConnectionLogConfig{Processes: true},
+				Rules:         []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "connection log processes without the output hook",
+			cfg: Config{
+				Version:       "1.0",
+				ConnectionLog: &ConnectionLogConfig{Processes: true},
+				Rules:         []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "event store without path",
+			cfg: Config{
+				Version: "1.0",
+				Events:  &EventsConfig{Retention: Duration(time.Hour)},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "decision log sample rate above 1",
+			cfg: Config{
+				Version:     "1.0",
+				DecisionLog: &DecisionLogConfig{Path: "/var/lib/legion-router/decisions.log", SampleRate: 2},
+				Rules:       []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "metrics retention shorter than interval",
+			cfg: Config{
+				Version: "1.0",
+				Metrics: &MetricsConfig{Interval: Duration(time.Minute), Retention: Duration(time.Second)},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid shutdown policy",
+			cfg: Config{
+				Version:    "1.0",
+				OnShutdown: "drop",
+				Rules:      []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "lazy startup with block policy",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{Startup: StartupConfig{Policy: StartupBlock, Lazy: true}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin approval without users",
+			cfg: Config{
+				Version: "1.0",
+				Admin: &AdminConfig{
+					Listen:   "127.0.0.1:9090",
+					Token:    "secret",
+					Approval: &ApprovalConfig{},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin approver with the viewer role",
+			cfg: Config{
+				Version: "1.0",
+				Admin: &AdminConfig{
+					Listen:   "127.0.0.1:9090",
+					Users:    []AdminUser{{Name: "alice", Token: "alice-token", Role: AdminRoleViewer, Approver: true}},
+					Approval: &ApprovalConfig{},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin without authentication on all addresses",
+			cfg: Config{
+				Version: "1.0",
+				Admin:   &AdminConfig{Listen: "0.0.0.0:9090"},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin without authentication on loopback",
+			cfg: Config{
+				Version: "1.0",
+				Admin:   &AdminConfig{Listen: "[::1]:9090"},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+		},
+		{
+			name: "admin with token on all addresses",
+			cfg: Config{
+				Version: "1.0",
+				Admin:   &AdminConfig{Listen: ":9090", Token: "secret"},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+		},
+		{
+			name: "admin knock without destination",
+			cfg: Config{
+				Version: "1.0",
+				Admin: &AdminConfig{
+					Listen: "127.0.0.1:9090",
+					Knock:  &KnockConfig{Listen: []string{"10.0.0.1"}, Sequence: []uint16{7000, 8000}, Port: 22, TTL: Duration(time.Minute)},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin knock listening on all addresses",
+			cfg: Config{
+				Version: "1.0",
+				Admin: &AdminConfig{
+					Listen: "127.0.0.1:9090",
+					Knock:  &KnockConfig{Listen: []string{"0.0.0.0"}, Sequence: []uint16{7000, 8000}, Destination: "203.0.113.10", Port: 22, TTL: Duration(time.Minute)},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin user with client cert but no client ca",
+			cfg: Config{
+				Version: "1.0",
+				Admin: &AdminConfig{
+					Listen: "127.0.0.1:9090",
+					Users:  []AdminUser{{Name: "ci", ClientCert: "ci.example.com", Role: AdminRoleOperator}},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "cluster client certificate without ca",
+			cfg: Config{
+				Version: "1.0",
+				Cluster: &ClusterConfig{Controller: "controller.example.com:9443", CertFile: "/run/spire/svid.pem", KeyFile: "/run/spire/svid_key.pem"},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "nat exclusion not an address",
+			cfg: Config{
+				Version: "1.0",
+				NAT:     &NATConfig{ExcludeDestinations: []string{"internal"}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "hairpin forward without interface",
+			cfg: Config{
+				Version: "1.0",
+				NAT:     &NATConfig{Forwards: []PortForward{{Port: 443, To: "10.0.0.5:8443", Hairpin: true}}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "upnp allowed host not ipv4",
+			cfg: Config{
+				Version: "1.0",
+				UPnP: &UPnPConfig{
+					ExternalInterface: "eth0",
+					Interfaces:        []string{"eth1"},
+					AllowedHosts:      []string{"fd00::/64"},
+					Ports:             []string{"1024-65535"},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rule with undefined vlan",
+			cfg: Config{
+				Version: "1.0",
+				VLANs:   []VLANConfig{{ID: 100, Parent: "eth1"}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow, VLANID: 200}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "vlan id out of range",
+			cfg: Config{
+				Version: "1.0",
+				VLANs:   []VLANConfig{{ID: 4095, Parent: "eth1"}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "vlan rule",
+			cfg: Config{
+				Version: "1.0",
+				VLANs:   []VLANConfig{{ID: 100, Parent: "eth1", Create: true, Addresses: []string{"10.100.0.1/24"}}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow, VLANID: 100}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "ha sync without key",
+			cfg: Config{
+				Version: "1.0",
+				HA: &HAConfig{
+					NotifyFIFO: "/run/legion-router/keepalived.fifo",
+					Sync:       &HASyncConfig{Listen: "10.0.0.1:9091", Peer: "10.0.0.2:9091"},
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ha pair",
+			cfg: Config{
+				Version: "1.0",
+				HA: &HAConfig{
+					Role:       RoleActive,
+					Sync:       &HASyncConfig{Listen: "10.0.0.1:9091", Peer: "10.0.0.2:9091", Key: "secret"},
+					Conntrackd: true,
+				},
+				Rules: []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate rule id",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{ID: "r-1", Name: "first", Action: ActionAllow},
+					{ID: "r-1", Name: "second", Action: ActionAllow},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rule with undefined vrf",
+			cfg: Config{
+				Version: "1.0",
+				VRFs:    []VRFConfig{{Name: "blue"}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow, VRF: "red"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "created vrf without table",
+			cfg: Config{
+				Version: "1.0",
+				VRFs:    []VRFConfig{{Name: "blue", Create: true}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow, VRF: "blue"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "vrf rule",
+			cfg: Config{
+				Version: "1.0",
+				VRFs:    []VRFConfig{{Name: "blue", Table: 10, Create: true, Interfaces: []string{"eth2"}}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow, VRF: "blue"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "route gateway in another family",
+			cfg: Config{
+				Version: "1.0",
+				Routes:  []RouteConfig{{Destination: "10.20.0.0/16", Gateway: "fd00::1"}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "default route",
+			cfg: Config{
+				Version: "1.0",
+				Routes:  []RouteConfig{{Destination: "default", Gateway: "192.168.1.1", Interface: "eth0", Metric: 100}},
+				Rules:   []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "rule with undefined profile",
+			cfg: Config{
+				Version:  "1.0",
+				Profiles: []ProfileConfig{{Name: "ci-runner"}},
+				Rules:    []Rule{{Name: "test-rule", Action: ActionAllow, Profile: "web"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid profile source",
+			cfg: Config{
+				Version:  "1.0",
+				Profiles: []ProfileConfig{{Name: "ci-runner", Sources: []string{"10.0.0.0/33"}}},
+				Rules:    []Rule{{Name: "test-rule", Action: ActionAllow, Profile: "ci-runner"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "profile rule",
+			cfg: Config{
+				Version:  "1.0",
+				Profiles: []ProfileConfig{{Name: "ci-runner", Sources: []string{"10.0.5.0/24", "fd00::5"}}},
+				Docker:   &DockerConfig{},
+				Rules:    []Rule{{Name: "test-rule", Action: ActionAllow, Profile: "ci-runner"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "service without discovery source",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "payments", Action: ActionAllow, Egress: Egress{Services: []ServiceRef{{Consul: "payments"}}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "service naming two sources",
+			cfg: Config{
+				Version:   "1.0",
+				Discovery: &DiscoveryConfig{Consul: &ConsulDiscoveryConfig{}},
+				Rules: []Rule{
+					{Name: "payments", Action: ActionAllow, Egress: Egress{Services: []ServiceRef{{Consul: "payments", SRV: "_payments._tcp.example.com"}}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "kubernetes service without namespace",
+			cfg: Config{
+				Version:   "1.0",
+				Discovery: &DiscoveryConfig{Kubernetes: &KubernetesDiscoveryConfig{}},
+				Rules: []Rule{
+					{Name: "payments", Action: ActionAllow, Egress: Egress{Services: []ServiceRef{{Kubernetes: "payments"}}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "services",
+			cfg: Config{
+				Version: "1.0",
+				Discovery: &DiscoveryConfig{
+					Consul:     &ConsulDiscoveryConfig{},
+					Kubernetes: &KubernetesDiscoveryConfig{},
+				},
+				Rules: []Rule{
+					{Name: "payments", Action: ActionAllow, Egress: Egress{Services: []ServiceRef{
+						{Consul: "payments"},
+						{Kubernetes: "shop/payments"},
+						{SRV: "_payments._tcp.example.com"},
+					}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "cloud range groups",
+			cfg: Config{
+				Version:  "1.0",
+				IPRanges: &IPRangesConfig{AzureURL: "https://example.com/ServiceTags_Public.json"},
+				Rules: []Rule{
+					{Name: "clouds", Action: ActionAllow, Egress: Egress{IPs: []string{"@aws:s3:us-east-1", "@gcp", "@azure:Storage.WestEurope", "10.0.0.0/8"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid cloud range group",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "clouds", Action: ActionAllow, Egress: Egress{IPs: []string{"@aws"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "azure group without url",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "clouds", Action: ActionAllow, Egress: Egress{IPs: []string{"@azure:Storage"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bogons group",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "no-bogons", Action: ActionDeny, Egress: Egress{IPs: []string{"@bogons"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid bogons group",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "no-bogons", Action: ActionDeny, Egress: Egress{IPs: []string{"@bogons:ipv4"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bgp group",
+			cfg: Config{
+				Version: "1.0",
+				BGP: &BGPConfig{
+					LocalAS:   64512,
+					RouterID:  "10.0.0.1",
+					Neighbors: []BGPNeighborConfig{{Address: "10.0.0.2", PeerAS: 64513}},
+					Groups:    []BGPGroupConfig{{Name: "partners", Communities: []string{"64513:100"}}},
+				},
+				Rules: []Rule{
+					{Name: "partners", Action: ActionAllow, Egress: Egress{IPs: []string{"@bgp:partners"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "undefined bgp group",
+			cfg: Config{
+				Version: "1.0",
+				BGP: &BGPConfig{
+					LocalAS:   64512,
+					RouterID:  "10.0.0.1",
+					Neighbors: []BGPNeighborConfig{{Address: "10.0.0.2", PeerAS: 64513}},
+				},
+				Rules: []Rule{
+					{Name: "partners", Action: ActionAllow, Egress: Egress{IPs: []string{"@bgp:partners"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "asns",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "own-network", Action: ActionAllow, Egress: Egress{ASNs: []string{"AS64500", "64501"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid asn",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "own-network", Action: ActionAllow, Egress: Egress{ASNs: []string{"AS-GOOGLE"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "metadata protection",
+			cfg: Config{
+				Version:            "1.0",
+				MetadataProtection: &MetadataProtectionConfig{ExemptSources: []string{"10.0.0.5", "10.1.0.0/24"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid metadata exempt source",
+			cfg: Config{
+				Version:            "1.0",
+				MetadataProtection: &MetadataProtectionConfig{ExemptSources: []string{"ci-runner"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "hardening",
+			cfg: Config{
+				Version:   "1.0",
+				Hardening: &HardeningConfig{WANInterfaces: []string{"eth0"}, Bogons: []string{"10.0.0.0/8", "fc00::/7"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid hardening bogon",
+			cfg: Config{
+				Version:   "1.0",
+				Hardening: &HardeningConfig{WANInterfaces: []string{"eth0"}, Bogons: []string{"private"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rate limit",
+			cfg: Config{
+				Version:   "1.0",
+				RateLimit: &RateLimitConfig{Global: "2000/second", PerSource: "100/second", ExemptSources: []string{"10.0.5.0/24"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "rate limit without a rate",
+			cfg: Config{
+				Version:   "1.0",
+				RateLimit: &RateLimitConfig{Burst: 10},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ban",
+			cfg: Config{
+				Version: "1.0",
+				Ban:     &BanConfig{Threshold: 10, Window: Duration(5 * time.Minute), ExemptSources: []string{"10.0.9.0/24"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "honeypot",
+			cfg: Config{
+				Version:  "1.0",
+				Honeypot: &HoneypotConfig{Targets: []string{"169.254.169.254"}, Ports: []string{"80"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "honeypot without targets",
+			cfg: Config{
+				Version:  "1.0",
+				Honeypot: &HoneypotConfig{Ports: []string{"80"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ban window under a second",
+			cfg: Config{
+				Version: "1.0",
+				Ban:     &BanConfig{Window: Duration(time.Millisecond)},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rollout",
+			cfg: Config{
+				Version: "1.0",
+				Rollout: &RolloutConfig{Percent: 10, Duration: Duration(15 * time.Minute)},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "chain placement",
+			cfg: Config{
+				Version: "1.0",
+				Chain:   &ChainConfig{Family: "ip", Hook: "prerouting", Priority: &priority},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "chain with unknown hook",
+			cfg: Config{
+				Version: "1.0",
+				Chain:   &ChainConfig{Hook: "input"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "chain with unknown family",
+			cfg: Config{
+				Version: "1.0",
+				Chain:   &ChainConfig{Family: "bridge"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "block page on the output hook",
+			cfg: Config{
+				Version:   "1.0",
+				Chain:     &ChainConfig{Hook: "output"},
+				BlockPage: &BlockPageConfig{Contact: "it@example.com"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid inspection exempt source",
+			cfg: Config{
+				Version:                 "1.0",
+				InspectionExemptSources: []string{"10.0.0.5", "printer"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rollout with percent and log only",
+			cfg: Config{
+				Version: "1.0",
+				Rollout: &RolloutConfig{Percent: 10, LogOnly: true, Duration: Duration(15 * time.Minute)},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "policy tests",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+				Tests: []PolicyTest{
+					{Domain: "api.github.com", Protocol: ProtocolTCP, Port: 443, Expect: ActionAllow},
+					{Destination: "10.0.0.1", Protocol: ProtocolICMP, Expect: ActionDeny},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "policy test without port",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+				},
+				Tests: []PolicyTest{
+					{Destination: "10.0.0.1", Protocol: ProtocolTCP, Expect: ActionDeny},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid port",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Ports: []string{"443", "80x"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "reversed port range",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Ports: []string{"9000-8000"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid ip",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"10.0.0.0/33"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negated matchers",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{
+						Protocols:  []Protocol{ProtocolTCP},
+						Ports:      []string{"443"},
+						NotIPs:     []string{"10.0.0.0/8", "fc00::/7"},
+						NotPorts:   []string{"8000-8999"},
+						NotDomains: []string{"internal.example.com"},
+					}},
+				},
+			},
+		},
+		{
+			name: "invalid not_ips",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{NotIPs: []string{"aws:us-east-1"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid not_ports",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{NotPorts: []string{"web"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "wildcard not_domains",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{NotDomains: []string{"*.example.com"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "any_of",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{
+						Protocols: []Protocol{ProtocolTCP},
+						AnyOf: []Egress{
+							{IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}},
+							{Domains: []string{"api.example.com"}, Ports: []string{"8443"}},
+						},
+					}},
+				},
+			},
+		},
+		{
+			name: "ct states",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, CtStates: []CtState{CtStateEstablished, CtStateRelated}},
+				},
+			},
+		},
+		{
+			name: "invalid ct state",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, CtStates: []CtState{"open"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ct states with l7",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, CtStates: []CtState{CtStateNew}, Egress: Egress{L7: []AppProtocol{AppSSH}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ttl",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, TTLLessThan: 2},
+				},
+			},
+		},
+		{
+			name: "ttl_lt and ttl_eq",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, TTLLessThan: 2, TTLEqual: 63},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid length",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, Length: "=>1400"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "any_of with l7",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{L7: []AppProtocol{AppSSH}, AnyOf: []Egress{{Ports: []string{"22"}}}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "any_of entry with ip group",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{AnyOf: []Egress{{IPs: []string{"@aws:s3"}}}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "all_of with destinations twice",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{AllOf: []Egress{{IPs: []string{"192.0.2.0/24"}}, {Domains: []string{"api.example.com"}}}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid l7 protocol",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, Egress: Egress{L7: []AppProtocol{"smtp"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "tags",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Tags: []string{"team:payments", "vendor"}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "deny behavior",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, DenyBehavior: DenyRejectTCPRST},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "admin prohibited",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, DenyBehavior: DenyReject, RejectWith: RejectAdminProhibited, Log: true},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "reject_with without reject",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, RejectWith: RejectAdminProhibited},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "log on allow rule",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Log: true},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid deny behavior",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionDeny, DenyBehavior: "reset"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "deny behavior on allow rule",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, DenyBehavior: DenyReject},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "justified",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Description: "Vendor API", Reference: "https://tickets.example.com/SEC-142"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "multi-line description",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Description: "Vendor API\nfor invoicing"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid tag",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Tags: []string{"team payments"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "per-rule resolvers",
+			cfg: Config{
+				Version: "1.0",
+				DNS: DNSConfig{
+					Servers:  []string{"1.1.1.1", "8.8.8.8:53"},
+					Suffixes: []SuffixResolver{{Suffix: "corp.example.com", Servers: []string{"10.0.0.53"}}},
+				},
+				Rules: []Rule{
+					{
+						Name:      "internal",
+						Action:    ActionAllow,
+						Egress:    Egress{Domains: []string{"git.internal"}},
+						Resolvers: []string{"10.0.0.53"},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "conflicting per-rule resolvers",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{
+						Name:      "a",
+						Action:    ActionAllow,
+						Egress:    Egress{Domains: []string{"git.internal"}},
+						Resolvers: []string{"10.0.0.53"},
+					},
+					{
+						Name:      "b",
+						Action:    ActionAllow,
+						Egress:    Egress{Domains: []string{"git.internal"}},
+						Resolvers: []string{"10.9.0.53"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "refresh intervals",
+			cfg: Config{
+				Version: "1.0",
+				DNS: DNSConfig{
+					Refresh:  RefreshConfig{Interval: Duration(10 * time.Minute)},
+					CacheTTL: Duration(10 * time.Minute),
+				},
+				Rules: []Rule{
+					{
+						Name:            "cdn",
+						Action:          ActionAllow,
+						Egress:          Egress{Domains: []string{"api.fastly.com"}},
+						RefreshInterval: Duration(30 * time.Second),
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "refresh interval too short",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{
+						Name:            "cdn",
+						Action:          ActionAllow,
+						Egress:          Egress{Domains: []string{"api.fastly.com"}},
+						RefreshInterval: Duration(time.Second),
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "cache TTL too long",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{CacheTTL: Duration(48 * time.Hour)},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Domains: []string{"example.com"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "undefined port group",
+			cfg: Config{
+				Version:    "1.0",
+				PortGroups: map[string]string{"web": "tcp/80,443"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"192.0.2.0/24"}, Ports: []string{"mail"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid port group",
+			cfg: Config{
+				Version:    "1.0",
+				PortGroups: map[string]string{"web": "icmp/80"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{IPs: []string{"192.0.2.0/24"}, Ports: []string{"web"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "port group of another protocol",
+			cfg: Config{
+				Version:    "1.0",
+				PortGroups: map[string]string{"dns": "udp/53"},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.2.0/24"}, Ports: []string{"dns"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown pool strategy",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{Pool: PoolConfig{Strategy: "random"}},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Domains: []string{"example.com"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative cache max entries",
+			cfg: Config{
+				Version: "1.0",
+				DNS:     DNSConfig{CacheMaxEntries: -1},
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Domains: []string{"example.com"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "refresh interval without domains",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{
+						Name:            "net",
+						Action:          ActionAllow,
+						Egress:          Egress{IPs: []string{"192.0.2.0/24"}},
+						RefreshInterval: Duration(time.Minute),
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "IPv4 address in domains",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Domains: []string{"api.example.com", "203.0.113.10"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "IPv6 network in domains",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Domains: []string{"api.example.com", "2001:db8::/32"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "address with a port in domains",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "test-rule", Action: ActionAllow, Egress: Egress{Domains: []string{"api.example.com", "[2001:db8::1]:443"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "shadowed rule allowed by default",
+			cfg: Config{
+				Version: "1.0",
+				Rules: []Rule{
+					{Name: "web", Action: ActionAllow, Order: 10, Egress: Egress{IPs: []string{"192.0.2.0/24"}}},
+					{Name: "web-host", Action: ActionAllow, Order: 20, Egress: Egress{IPs: []string{"192.0.2.7"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "rule shadowed by a rule of the same verdict",
+			cfg: Config{
+				Version:             "1.0",
+				RejectShadowedRules: true,
+				Rules: []Rule{
+					{Name: "web", Action: ActionAllow, Order: 10, Egress: Egress{IPs: []string{"192.0.2.0/24"}}},
+					{Name: "web-host", Action: ActionAllow, Order: 20, Egress: Egress{IPs: []string{"192.0.2.7"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "allow rule shadowed by a deny rule ordered first",
+			cfg: Config{
+				Version:             "1.0",
+				RejectShadowedRules: true,
+				PortGroups:          map[string]string{"web": "tcp/80,443"},
+				Rules: []Rule{
+					{Name: "https", Action: ActionAllow, Order: 20, Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.2.7"}, Ports: []string{"443"}}},
+					{Name: "block-web", Action: ActionDeny, Order: 10, Egress: Egress{IPs: []string{"192.0.2.0/24"}, Ports: []string{"web"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "deny rule behind an allow rule",
+			cfg: Config{
+				Version:             "1.0",
+				RejectShadowedRules: true,
+				Rules: []Rule{
+					{Name: "web", Action: ActionAllow, Order: 10, Egress: Egress{IPs: []string{"192.0.2.0/24"}}},
+					{Name: "block-host", Action: ActionDeny, Order: 20, Egress: Egress{IPs: []string{"192.0.2.7"}}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid conflict policy",
+			cfg: Config{
+				Version:        "1.0",
+				ConflictPolicy: "last-match",
+				Rules:          []Rule{{Name: "test-rule", Action: ActionAllow}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "allow rule shadowed by a later deny rule overriding it",
+			cfg: Config{
+				Version:             "1.0",
+				RejectShadowedRules: true,
+				ConflictPolicy:      ConflictDenyOverrides,
+				Rules: []Rule{
+					{Name: "web-host", Action: ActionAllow, Order: 10, Egress: Egress{IPs: []string{"192.0.2.7"}}},
+					{Name: "block-web", Action: ActionDeny, Order: 20, Egress: Egress{IPs: []string{"192.0.2.0/24"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rule behind a rule that expires",
+			cfg: Config{
+				Version:             "1.0",
+				RejectShadowedRules: true,
+				Rules: []Rule{
+					{Name: "freeze", Action: ActionDeny, Order: 10, Egress: Egress{IPs: []string{"0.0.0.0/0"}}, Expires: &time.Time{}},
+					{Name: "web", Action: ActionAllow, Order: 20, Egress: Egress{IPs: []string{"192.0.2.0/24"}}},
+				},
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -176,3 +1518,354 @@ func TestValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadDNSAggregation(t *testing.T) {
+	yamlContent := `version: "1.0"
+dns:
+  aggregation:
+    rounds: 3
+    ip_ttl: 30m
+rules:
+  - name: allow-cdn
+    action: allow
+    egress:
+      domains: ["cdn.example.com"]
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(yamlContent)); err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+
+	cfg, err := Load(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	agg := cfg.DNS.Aggregation
+	if agg == nil {
+		t.Fatal("Expected aggregation config")
+	}
+	if agg.Rounds != 3 {
+		t.Errorf("Expected 3 rounds, got %d", agg.Rounds)
+	}
+	if agg.IPTTL.Std() != 30*time.Minute {
+		t.Errorf("Expected ip_ttl 30m, got %s", agg.IPTTL)
+	}
+}
+
+// TestLoadRotation tests that the logs read their rotation settings
+func TestLoadRotation(t *testing.T) {
+	cfg, err := Parse([]byte(`version: "1.0"
+decision_log:
+  path: /var/lib/legion-router/decisions.log
+  max_size: 10
+dns:
+  proxy:
+    listen: ["127.0.0.1:53"]
+    query_log:
+      file: /var/log/legion-router/queries.log
+      max_backups: 5
+rules:
+  - name: web
+    action: allow
+    egress:
+      domains: ["example.com"]
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	if got := cfg.DecisionLog.EffectiveMaxSize(); got != 10<<20 {
+		t.Errorf("Expected the decision log rotated at 10 MB, got %d bytes", got)
+	}
+	if got := cfg.DecisionLog.EffectiveMaxBackups(); got != 3 {
+		t.Errorf("Expected 3 decision log backups, got %d", got)
+	}
+	queryLog := cfg.DNS.Proxy.QueryLog
+	if got := queryLog.EffectiveMaxSize(); got != 100<<20 {
+		t.Errorf("Expected the query log rotated at 100 MB, got %d bytes", got)
+	}
+	if got := queryLog.EffectiveMaxBackups(); got != 5 {
+		t.Errorf("Expected 5 query log backups, got %d", got)
+	}
+
+	data, err := json.Marshal(queryLog)
+	if err != nil {
+		t.Fatalf("Failed to encode query log: %v", err)
+	}
+	if want := `{"file":"/var/log/legion-router/queries.log","max_backups":5}`; string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+}
+
+// TestHash tests that the hash identifies the policy
+func TestHash(t *testing.T) {
+	cfg := &Config{Version: "1.0", Rules: []Rule{{Name: "web", Action: ActionAllow}}}
+	same := &Config{Version: "1.0", Rules: []Rule{{Name: "web", Action: ActionAllow}}}
+	changed := &Config{Version: "1.0", Rules: []Rule{{Name: "web", Action: ActionDeny}}}
+
+	if len(cfg.Hash()) != 12 {
+		t.Errorf("Expected 12 hex digits, got %q", cfg.Hash())
+	}
+	if cfg.Hash() != same.Hash() {
+		t.Errorf("Expected equal configs to hash equally, got %s and %s", cfg.Hash(), same.Hash())
+	}
+	if cfg.Hash() == changed.Hash() {
+		t.Errorf("Expected a changed config to hash differently, got %s", cfg.Hash())
+	}
+}
+
+// TestLoadRuleExpiry tests loading rule expiry dates and disabled rules
+func TestLoadRuleExpiry(t *testing.T) {
+	yamlContent := `version: "1.0"
+rules:
+  - name: allow-vendor-trial
+    action: allow
+    expires: 2025-12-31T00:00:00Z
+    enabled: false
+    egress:
+      domains: ["trial.example.com"]
+  - name: allow-cdn
+    action: allow
+    egress:
+      domains: ["cdn.example.com"]
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(yamlContent)); err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+
+	cfg, err := Load(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	trial, cdn := cfg.Rules[0], cfg.Rules[1]
+	expires := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+	if trial.Expires == nil || !trial.Expires.Equal(expires) {
+		t.Fatalf("Expected expiry %s, got %v", expires, trial.Expires)
+	}
+	if trial.Expired(expires.Add(-time.Second)) || !trial.Expired(expires) {
+		t.Errorf("Expected the rule to expire at %s", expires)
+	}
+	if cdn.Expired(expires) {
+		t.Error("Expected a rule without expiry never to expire")
+	}
+	if trial.IsEnabled() || !cdn.IsEnabled() {
+		t.Errorf("Expected only allow-cdn enabled, got %v and %v", trial.IsEnabled(), cdn.IsEnabled())
+	}
+}
+
+// TestExpandPortGroups tests that the port groups rules name are replaced by
+// their ports and protocol
+func TestExpandPortGroups(t *testing.T) {
+	cfg, err := Parse([]byte(`version: "1.0"
+port_groups:
+  web: tcp/80,443
+  alt: 8080-8090
+rules:
+  - name: web
+    action: allow
+    egress:
+      ips: ["192.0.2.0/24"]
+      ports: [web]
+  - name: mixed
+    action: allow
+    egress:
+      ips: ["192.0.2.0/24"]
+      ports: [web, alt, "9000"]
+  - name: any
+    action: allow
+    egress:
+      protocols: [udp]
+      ips: ["192.0.2.0/24"]
+      ports: [alt]
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	testCases := []struct {
+		rule          string
+		wantProtocols string
+		wantPorts     string
+		wantGroup     string
+		wantGroups    string
+	}{
+		{rule: "web", wantProtocols: "tcp", wantPorts: "80,443", wantGroup: "web", wantGroups: "web"},
+		{rule: "mixed", wantProtocols: "tcp", wantPorts: "80,443,8080-8090,9000", wantGroups: "web,alt"},
+		{rule: "any", wantProtocols: "udp", wantPorts: "8080-8090", wantGroup: "alt", wantGroups: "alt"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rule, func(t *testing.T) {
+			var egress Egress
+			for _, rule := range cfg.Rules {
+				if rule.Name == tc.rule {
+					egress = rule.Egress
+				}
+			}
+			if got := joinProtocols(egress.Protocols); got != tc.wantProtocols {
+				t.Errorf("Expected protocols %s, got %s", tc.wantProtocols, got)
+			}
+			if got := strings.Join(egress.Ports, ","); got != tc.wantPorts {
+				t.Errorf("Expected ports %s, got %s", tc.wantPorts, got)
+			}
+			if egress.PortGroup != tc.wantGroup {
+				t.Errorf("Expected group %q, got %q", tc.wantGroup, egress.PortGroup)
+			}
+			if got := strings.Join(egress.PortGroups, ","); got != tc.wantGroups {
+				t.Errorf("Expected groups %s, got %s", tc.wantGroups, got)
+			}
+		})
+	}
+}
+
+// TestBranches tests expanding any_of and all_of into the alternatives a
+// rule matches
+func TestBranches(t *testing.T) {
+	testCases := []struct {
+		name    string
+		egress  Egress
+		want    []string // Protocols/ports/destinations/exclusions of each branch
+		wantErr bool
+	}{
+		{
+			name:   "plain",
+			egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}},
+			want:   []string{"tcp/443/192.0.2.0/24/"},
+		},
+		{
+			name: "any of",
+			egress: Egress{
+				Protocols: []Protocol{ProtocolTCP},
+				AnyOf: []Egress{
+					{IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}},
+					{Domains: []string{"api.example.com"}, Ports: []string{"8443"}},
+				},
+			},
+			want: []string{"tcp/443/192.0.2.0/24/", "tcp/8443/api.example.com/"},
+		},
+		{
+			name: "all of any of",
+			egress: Egress{
+				NotIPs: []string{"192.0.2.1"},
+				AllOf: []Egress{
+					{AnyOf: []Egress{{Protocols: []Protocol{ProtocolTCP}}, {Protocols: []Protocol{ProtocolUDP}}}},
+					{Ports: []string{"1-1024"}, NotPorts: []string{"25"}},
+				},
+				AnyOf: []Egress{{IPs: []string{"192.0.2.0/24"}, Ports: []string{"80", "1000-2000"}}},
+			},
+			want: []string{"tcp/80,1000-1024/192.0.2.0/24/192.0.2.1,25", "udp/80,1000-1024/192.0.2.0/24/192.0.2.1,25"},
+		},
+		{
+			name: "disjoint alternatives left out",
+			egress: Egress{
+				Protocols: []Protocol{ProtocolTCP},
+				Ports:     []string{"443"},
+				AnyOf:     []Egress{{Protocols: []Protocol{ProtocolUDP}}, {Ports: []string{"80"}}, {IPs: []string{"192.0.2.1"}}},
+			},
+			want: []string{"tcp/443/192.0.2.1/"},
+		},
+		{
+			name: "destinations on both sides",
+			egress: Egress{
+				Domains: []string{"example.com"},
+				AnyOf:   []Egress{{IPs: []string{"192.0.2.1"}}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			branches, err := tc.egress.Branches()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Branches() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			var got []string
+			for _, b := range branches {
+				got = append(got, strings.Join([]string{
+					strings.ReplaceAll(joinProtocols(b.Protocols), ", ", ","),
+					strings.Join(b.Ports, ","),
+					strings.Join(append(b.IPs, b.Domains...), ","),
+					strings.Join(append(b.NotIPs, b.NotPorts...), ","),
+				}, "/"))
+			}
+			if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestParseRate tests parsing connection rates into a count and period
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		rate      string
+		wantCount uint64
+		wantPer   time.Duration
+		wantErr   bool
+	}{
+		{rate: "100/second", wantCount: 100, wantPer: time.Second},
+		{rate: "10/minute", wantCount: 10, wantPer: time.Minute},
+		{rate: "5 / hour", wantCount: 5, wantPer: time.Hour},
+		{rate: "0/second", wantErr: true},
+		{rate: "100", wantErr: true},
+		{rate: "100/week", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rate, func(t *testing.T) {
+			count, per, err := ParseRate(tc.rate)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseRate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if count != tc.wantCount || per != tc.wantPer {
+				t.Errorf("Expected %d/%v, got %d/%v", tc.wantCount, tc.wantPer, count, per)
+			}
+		})
+	}
+}
+
+// TestParseLength tests parsing packet length matchers into the lengths
+// they match
+func TestParseLength(t *testing.T) {
+	testCases := []struct {
+		length  string
+		wantMin uint16
+		wantMax uint16
+		wantErr bool
+	}{
+		{length: ">1400", wantMin: 1401, wantMax: 65535},
+		{length: "<100", wantMin: 0, wantMax: 99},
+		{length: "1500", wantMin: 1500, wantMax: 1500},
+		{length: "1400-1500", wantMin: 1400, wantMax: 1500},
+		{length: ">65535", wantErr: true},
+		{length: "<1", wantErr: true},
+		{length: "1500-1400", wantErr: true},
+		{length: "0", wantErr: true},
+		{length: "big", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.length, func(t *testing.T) {
+			min, max, err := ParseLength(tc.length)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseLength() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if min != tc.wantMin || max != tc.wantMax {
+				t.Errorf("Expected %d-%d, got %d-%d", tc.wantMin, tc.wantMax, min, max)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import "sort"
+
+// ConflictPolicy selects which of the allow and deny rules matching
+// traffic decides it
+type ConflictPolicy string
+
+const (
+	// ConflictFirstMatch lets the first matching rule in order decide
+	ConflictFirstMatch ConflictPolicy = "first-match"
+	// ConflictDenyOverrides denies traffic any deny rule matches, whatever
+	// its order, and lets the allow rules decide the rest
+	ConflictDenyOverrides ConflictPolicy = "deny-overrides"
+	// ConflictAllowOverrides allows traffic any allow rule matches, whatever
+	// its order, and lets the deny rules decide the rest
+	ConflictAllowOverrides ConflictPolicy = "allow-overrides"
+)
+
+// EffectiveConflictPolicy returns the configured conflict policy,
+// defaulting to first-match
+func (c *Config) EffectiveConflictPolicy() ConflictPolicy {
+	if c.ConflictPolicy == "" {
+		return ConflictFirstMatch
+	}
+	return c.ConflictPolicy
+}
+
+// Arrange reorders rules sorted by order so that the first matching rule
+// decides as the policy does: deny-overrides moves the deny rules ahead of
+// the allow rules and allow-overrides the allow rules ahead of the deny
+// rules, each keeping their order, while first-match leaves them as they are
+func (p ConflictPolicy) Arrange(rules []Rule) {
+	var first Action
+	switch p {
+	case ConflictDenyOverrides:
+		first = ActionDeny
+	case ConflictAllowOverrides:
+		first = ActionAllow
+	default:
+		return
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Action == first && rules[j].Action != first
+	})
+}
@@ -0,0 +1,327 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Covers reports whether r matches all the traffic other matches, so that
+// other never matches behind it. The check is conservative: matchers it
+// can't compare, such as domains against addresses or different TTLs, count
+// as not covered, and rules matching nothing cover nothing. Ports must be
+// expanded, as by ExpandPortGroups.
+func (r *Rule) Covers(other *Rule) bool {
+	if !r.coversScope(other) {
+		return false
+	}
+	branches, err := r.Egress.Branches()
+	if err != nil {
+		return false
+	}
+	otherBranches, err := other.Egress.Branches()
+	if err != nil {
+		return false
+	}
+
+	covered := false
+	for _, b := range otherBranches {
+		// Branches that install nothing match no traffic
+		if !other.installs(b) {
+			continue
+		}
+		match := false
+		for _, a := range branches {
+			if r.installs(a) && egressCovers(a, b) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+		covered = true
+	}
+	return covered
+}
+
+// scoped reports whether the rule matches traffic by more than its egress
+func (r *Rule) scoped() bool {
+	return r.VLANID != 0 || r.VRF != "" || r.Profile != "" || len(r.CtStates) > 0 || r.MatchesPacket()
+}
+
+// installs reports whether a branch of the rule compiles to a ruleset rule,
+// which it does with destinations or anything else limiting it; a branch
+// of ports alone installs nothing
+func (r *Rule) installs(e Egress) bool {
+	return e.hasDestinations() || len(e.Protocols) > 0 || len(e.L7) > 0 || e.Excludes() || r.scoped()
+}
+
+// coversScope reports whether r matches the VLAN, VRF, profile, conntrack
+// states and packets other does
+func (r *Rule) coversScope(other *Rule) bool {
+	switch {
+	case r.VLANID != 0 && r.VLANID != other.VLANID,
+		r.VRF != "" && r.VRF != other.VRF,
+		r.Profile != "" && r.Profile != other.Profile:
+		return false
+	case r.MatchesPacket() && (r.TTLLessThan != other.TTLLessThan || r.TTLEqual != other.TTLEqual || r.Length != other.Length):
+		return false
+	}
+	if len(r.CtStates) == 0 {
+		return true
+	}
+	if len(other.CtStates) == 0 {
+		return false
+	}
+	for _, state := range other.CtStates {
+		if !r.MatchesCtState(state) {
+			return false
+		}
+	}
+	return true
+}
+
+// egressCovers reports whether a matches all the traffic b matches; both
+// must be branches, without any_of and all_of
+func egressCovers(a, b Egress) bool {
+	if len(a.Protocols) > 0 {
+		if len(b.Protocols) == 0 {
+			return false
+		}
+		for _, proto := range b.Protocols {
+			if !containsProtocol(a.Protocols, proto) {
+				return false
+			}
+		}
+	}
+	if len(a.L7) > 0 {
+		if len(b.L7) == 0 {
+			return false
+		}
+		for _, app := range b.L7 {
+			if !containsApp(a.L7, app) {
+				return false
+			}
+		}
+	}
+	if len(a.Ports) > 0 && (len(b.Ports) == 0 || !portsCover(a.Ports, b.Ports)) {
+		return false
+	}
+	if a.hasDestinations() && !destinationsCover(a, b) {
+		return false
+	}
+
+	// What a excludes, b must exclude or not match
+	for _, ip := range a.NotIPs {
+		if anyCovers(b.NotIPs, ip, NetworkContains) {
+			continue
+		}
+		onlyIPs := len(b.IPs) > 0 && len(b.Domains) == 0 && len(b.Services) == 0 && len(b.ASNs) == 0
+		if !onlyIPs {
+			return false
+		}
+		for _, dst := range b.IPs {
+			if NetworkContains(dst, ip) || NetworkContains(ip, dst) || IsIPGroup(dst) {
+				return false
+			}
+		}
+	}
+	for _, port := range a.NotPorts {
+		if !portsCover(b.NotPorts, []string{port}) && (len(b.Ports) == 0 || len(intersectPorts(b.Ports, []string{port})) > 0) {
+			return false
+		}
+	}
+	for _, domain := range a.NotDomains {
+		if !anyCovers(b.NotDomains, domain, domainCovers) {
+			return false
+		}
+	}
+	return true
+}
+
+// destinationsCover reports whether every destination of b is one of a's,
+// each of the same kind
+func destinationsCover(a, b Egress) bool {
+	if !b.hasDestinations() {
+		return false
+	}
+	for _, ip := range b.IPs {
+		if !anyCovers(a.IPs, ip, NetworkContains) {
+			return false
+		}
+	}
+	for _, domain := range b.Domains {
+		if !anyCovers(a.Domains, domain, domainCovers) {
+			return false
+		}
+	}
+	for _, service := range b.Services {
+		if !anyCovers(serviceNames(a.Services), service.String(), strings.EqualFold) {
+			return false
+		}
+	}
+	for _, asn := range b.ASNs {
+		if !anyCovers(a.ASNs, asn, strings.EqualFold) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyCovers reports whether one of list covers s
+func anyCovers(list []string, s string, covers func(outer, inner string) bool) bool {
+	for _, outer := range list {
+		if covers(outer, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkContains reports whether the egress ips entry outer, an address
+// or CIDR, contains all the addresses of inner. Groups such as @aws:s3
+// contain only themselves.
+func NetworkContains(outer, inner string) bool {
+	if outer == inner {
+		return true
+	}
+	o, i := parseNetwork(outer), parseNetwork(inner)
+	if o == nil || i == nil || len(o.IP) != len(i.IP) {
+		return false
+	}
+	outerOnes, _ := o.Mask.Size()
+	innerOnes, _ := i.Mask.Size()
+	return outerOnes <= innerOnes && o.Contains(i.IP)
+}
+
+// parseNetwork parses an address or CIDR, nil for anything else
+func parseNetwork(s string) *net.IPNet {
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	if ip4 := network.IP.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		network.IP = ip4
+	}
+	return network
+}
+
+// domainCovers reports whether the egress domain outer matches all the
+// names inner does: the same name, or a wildcard over it
+func domainCovers(outer, inner string) bool {
+	outer = strings.ToLower(strings.TrimSuffix(outer, "."))
+	inner = strings.ToLower(strings.TrimSuffix(inner, "."))
+	if outer == inner {
+		return true
+	}
+	return strings.HasPrefix(outer, "*.") && strings.HasSuffix(inner, outer[1:])
+}
+
+// portsCover reports whether the ports and ranges of a include all those
+// of b; ports that don't parse cover nothing
+func portsCover(a, b []string) bool {
+	type portRange struct{ start, end uint16 }
+	var ranges []portRange
+	for _, port := range a {
+		start, end, err := ParsePortRange(port)
+		if err != nil {
+			continue
+		}
+		ranges = append(ranges, portRange{start, end})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	// Merge overlapping and adjacent ranges, so that a range of b spanning
+	// several of a is found in one
+	var merged []portRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && uint32(r.start) <= uint32(merged[n-1].end)+1 {
+			merged[n-1].end = max(merged[n-1].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	for _, port := range b {
+		start, end, err := ParsePortRange(port)
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, r := range merged {
+			if r.start <= start && end <= r.end {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsProtocol(protocols []Protocol, proto Protocol) bool {
+	for _, p := range protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func containsApp(apps []AppProtocol, app AppProtocol) bool {
+	for _, a := range apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceNames returns the services as their String
+func serviceNames(services []ServiceRef) []string {
+	names := make([]string, len(services))
+	for i, service := range services {
+		names[i] = service.String()
+	}
+	return names
+}
+
+// validateShadowedRules checks that no rule is covered by an earlier one
+// with the same or a stronger verdict, deny being stronger than allow.
+// Disabled rules are left out, and rules that expire don't shadow the
+// rules behind them, which match once they have expired.
+func (c *Config) validateShadowedRules() error {
+	var rules []Rule
+	for _, rule := range c.Rules {
+		if !rule.IsEnabled() {
+			continue
+		}
+		if protocols, ports, err := c.expandPorts(rule); err == nil {
+			rule.Egress.Protocols, rule.Egress.Ports = protocols, ports
+		}
+		rules = append(rules, rule)
+	}
+	sortRules(rules)
+	c.EffectiveConflictPolicy().Arrange(rules)
+
+	for j, rule := range rules {
+		for _, earlier := range rules[:j] {
+			if earlier.Expires != nil || (earlier.Action == ActionAllow && rule.Action == ActionDeny) || !earlier.Covers(&rule) {
+				continue
+			}
+			return fmt.Errorf("rule %s: never matches, as rule %s (order %d) matches all its traffic first", rule.Name, earlier.Name, earlier.Order)
+		}
+	}
+	return nil
+}
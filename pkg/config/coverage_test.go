@@ -0,0 +1,133 @@
+package config
+
+import "testing"
+
+// TestRuleCovers tests finding whether a rule matches all the traffic of
+// another
+func TestRuleCovers(t *testing.T) {
+	web := Rule{Name: "web", Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.2.0/24"}, Ports: []string{"80", "443-444"}}}
+
+	testCases := []struct {
+		name  string
+		rule  Rule
+		other Rule
+		want  bool
+	}{
+		{
+			name:  "narrower address and port",
+			rule:  web,
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.2.7", "192.0.2.128/25"}, Ports: []string{"443"}}},
+			want:  true,
+		},
+		{
+			name:  "ports across merged ranges",
+			rule:  Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, Ports: []string{"1-1024", "1025-2000"}}},
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"10.0.0.1"}, Ports: []string{"1000-1100"}}},
+			want:  true,
+		},
+		{
+			name:  "other port",
+			rule:  web,
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.2.7"}, Ports: []string{"22"}}},
+		},
+		{
+			name:  "any protocol",
+			rule:  web,
+			other: Rule{Egress: Egress{IPs: []string{"192.0.2.7"}, Ports: []string{"443"}}},
+		},
+		{
+			name:  "wider address",
+			rule:  web,
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"192.0.0.0/16"}, Ports: []string{"443"}}},
+		},
+		{
+			name:  "ipv6 within ipv4",
+			rule:  Rule{Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+			other: Rule{Egress: Egress{IPs: []string{"2001:db8::1"}}},
+		},
+		{
+			name:  "subdomain of wildcard",
+			rule:  Rule{Egress: Egress{Domains: []string{"*.Example.com"}}},
+			other: Rule{Egress: Egress{Domains: []string{"api.example.com.", "*.cdn.example.com"}, Ports: []string{"443"}}},
+			want:  true,
+		},
+		{
+			name:  "wildcard and its apex",
+			rule:  Rule{Egress: Egress{Domains: []string{"*.example.com"}}},
+			other: Rule{Egress: Egress{Domains: []string{"example.com"}}},
+		},
+		{
+			name:  "domain and address",
+			rule:  Rule{Egress: Egress{Domains: []string{"example.com"}}},
+			other: Rule{Egress: Egress{IPs: []string{"192.0.2.7"}}},
+		},
+		{
+			name:  "exclusion the other avoids",
+			rule:  Rule{Egress: Egress{IPs: []string{"0.0.0.0/0"}, NotIPs: []string{"10.0.0.0/8"}}},
+			other: Rule{Egress: Egress{IPs: []string{"192.0.2.0/24"}}},
+			want:  true,
+		},
+		{
+			name:  "exclusion the other overlaps",
+			rule:  Rule{Egress: Egress{IPs: []string{"0.0.0.0/0"}, NotIPs: []string{"10.0.0.0/8"}}},
+			other: Rule{Egress: Egress{IPs: []string{"10.1.0.0/16"}}},
+		},
+		{
+			name:  "exclusion the other shares",
+			rule:  Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, NotPorts: []string{"25"}}},
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, IPs: []string{"10.0.0.1"}, NotPorts: []string{"20-30"}}},
+			want:  true,
+		},
+		{
+			name:  "scoped to a profile",
+			rule:  Rule{Profile: "ci", Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+			other: Rule{Egress: Egress{IPs: []string{"192.0.2.7"}}},
+		},
+		{
+			name:  "within the same profile and states",
+			rule:  Rule{Profile: "ci", Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+			other: Rule{Profile: "ci", CtStates: []CtState{CtStateNew}, Egress: Egress{IPs: []string{"192.0.2.7"}}},
+			want:  true,
+		},
+		{
+			name:  "fewer states",
+			rule:  Rule{CtStates: []CtState{CtStateNew}, Egress: Egress{IPs: []string{"0.0.0.0/0"}}},
+			other: Rule{Egress: Egress{IPs: []string{"192.0.2.7"}}},
+		},
+		{
+			name: "every branch covered",
+			rule: web,
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, AnyOf: []Egress{
+				{IPs: []string{"192.0.2.1"}, Ports: []string{"80"}},
+				{IPs: []string{"192.0.2.2"}, Ports: []string{"444"}},
+			}}},
+			want: true,
+		},
+		{
+			name: "a branch not covered",
+			rule: web,
+			other: Rule{Egress: Egress{Protocols: []Protocol{ProtocolTCP}, AnyOf: []Egress{
+				{IPs: []string{"192.0.2.1"}, Ports: []string{"80"}},
+				{IPs: []string{"198.51.100.1"}, Ports: []string{"80"}},
+			}}},
+		},
+		{
+			name:  "rule installing nothing",
+			rule:  Rule{Egress: Egress{Ports: []string{"443"}}},
+			other: Rule{Egress: Egress{IPs: []string{"192.0.2.7"}, Ports: []string{"443"}}},
+		},
+		{
+			name:  "other installing nothing",
+			rule:  web,
+			other: Rule{Egress: Egress{Ports: []string{"443"}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.rule.Covers(&tc.other); got != tc.want {
+				t.Errorf("Covers() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
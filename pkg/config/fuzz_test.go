@@ -0,0 +1,44 @@
+package config
+
+import "testing"
+
+// FuzzParse tests that parsing never panics and that a parsed config stays
+// valid
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("version: \"1.0\"\nrules:\n  - name: allow-dns\n    action: allow\n    egress:\n      protocols: [udp]\n      ports: [\"53\"]\n"), ".yaml")
+	f.Add([]byte(`{"version": "1.0", "rules": [{"name": "web", "action": "allow", "egress": {"ips": ["10.0.0.0/8"], "ports": ["8000-9000"]}}]}`), ".json")
+	f.Add([]byte("version: \"1.0\"\nrules:\n  - name: bad\n    action: allow\n    egress:\n      ports: [\"80x\"]\n"), "")
+
+	f.Fuzz(func(t *testing.T, data []byte, ext string) {
+		cfg, err := parse(data, ext)
+		if err != nil {
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Parsed config is invalid: %v", err)
+		}
+	})
+}
+
+// FuzzParsePortRange tests that only ranges of valid ports written as plain
+// numbers are accepted
+func FuzzParsePortRange(f *testing.F) {
+	for _, seed := range []string{"443", "8000-9000", "0", "65536", "80-79", "-1", "+80", "80-", " 80", "1-65535"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		start, end, err := ParsePortRange(s)
+		if err != nil {
+			return
+		}
+		if start == 0 || start > end {
+			t.Fatalf("ParsePortRange(%q) = %d, %d", s, start, end)
+		}
+		for _, c := range s {
+			if (c < '0' || c > '9') && c != '-' {
+				t.Fatalf("ParsePortRange(%q) accepted %q", s, c)
+			}
+		}
+	})
+}
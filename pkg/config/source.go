@@ -0,0 +1,238 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWait is how long a Consul blocking query waits for a change
+const consulWait = 5 * time.Minute
+
+// Source is a key-value store holding the configuration
+type Source interface {
+	// Get returns the current configuration and its revision
+	Get(ctx context.Context) ([]byte, uint64, error)
+	// Wait blocks until the configuration changes from revision and
+	// returns the new data and revision
+	Wait(ctx context.Context, revision uint64) ([]byte, uint64, error)
+	String() string
+}
+
+// OpenSource returns the source of a consul:// or etcd:// location, such as
+// consul://127.0.0.1:8500/legion/config, or nil for a file path. Adding
+// ?tls=true connects over HTTPS.
+func OpenSource(location string) (Source, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "consul" && u.Scheme != "etcd") {
+		return nil, nil
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("config location %s needs a host and a key", location)
+	}
+	base := "http://" + u.Host
+	if u.Query().Get("tls") == "true" {
+		base = "https://" + u.Host
+	}
+
+	client := &http.Client{}
+	if u.Scheme == "consul" {
+		return &consulSource{base: base, key: key, token: os.Getenv("CONSUL_HTTP_TOKEN"), client: client}, nil
+	}
+	return &etcdSource{base: base, key: key, client: client}, nil
+}
+
+// LoadSource reads, parses and validates the configuration from src
+func LoadSource(ctx context.Context, src Source) (*Config, uint64, error) {
+	data, revision, err := src.Get(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cfg, revision, nil
+}
+
+// consulSource reads a Consul KV key, watching it with blocking queries
+type consulSource struct {
+	base   string
+	key    string
+	token  string
+	client *http.Client
+}
+
+func (s *consulSource) String() string {
+	return "consul key " + s.key
+}
+
+func (s *consulSource) Get(ctx context.Context) ([]byte, uint64, error) {
+	return s.query(ctx, 0)
+}
+
+func (s *consulSource) Wait(ctx context.Context, revision uint64) ([]byte, uint64, error) {
+	for {
+		data, index, err := s.query(ctx, revision)
+		if err != nil {
+			return nil, 0, err
+		}
+		// The index only stays the same when the query timed out; it may
+		// also go backwards when Consul's state is reset
+		if index != revision {
+			return data, index, nil
+		}
+	}
+}
+
+// query reads the key, blocking until its index passes index if non-zero
+func (s *consulSource) query(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	target := fmt.Sprintf("%s/v1/kv/%s?raw", s.base, s.key)
+	if index > 0 {
+		target += fmt.Sprintf("&index=%d&wait=%ds", index, int(consulWait.Seconds()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", s, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to read %s: consul returned %s", s, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", s, err)
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: invalid X-Consul-Index: %w", s, err)
+	}
+	return data, newIndex, nil
+}
+
+// etcdSource reads an etcd v3 key through the JSON gateway
+type etcdSource struct {
+	base   string
+	key    string
+	client *http.Client
+}
+
+// etcdKV is a key-value pair as returned by the gateway
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+func (s *etcdSource) String() string {
+	return "etcd key " + s.key
+}
+
+func (s *etcdSource) Get(ctx context.Context) ([]byte, uint64, error) {
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := s.post(ctx, "/v3/kv/range", map[string]interface{}{"key": []byte(s.key)}, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&resp)
+	}); err != nil {
+		return nil, 0, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, 0, fmt.Errorf("%s not found", s)
+	}
+	return s.value(resp.KVs[0])
+}
+
+func (s *etcdSource) Wait(ctx context.Context, revision uint64) ([]byte, uint64, error) {
+	request := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(s.key),
+			"start_revision": strconv.FormatUint(revision+1, 10),
+		},
+	}
+	var kv *etcdKV
+	if err := s.post(ctx, "/v3/watch", request, func(body io.Reader) error {
+		// The response is a stream of watch results; the first only
+		// confirms the watch
+		decoder := json.NewDecoder(body)
+		for {
+			var message struct {
+				Result struct {
+					Events []struct {
+						Type string `json:"type"`
+						KV   etcdKV `json:"kv"`
+					} `json:"events"`
+				} `json:"result"`
+			}
+			if err := decoder.Decode(&message); err != nil {
+				return fmt.Errorf("watch ended: %w", err)
+			}
+			for _, event := range message.Result.Events {
+				if event.Type == "DELETE" {
+					log.Printf("Warning: %s was deleted, keeping the current config", s)
+					continue
+				}
+				v := event.KV
+				kv = &v
+			}
+			if kv != nil {
+				return nil
+			}
+		}
+	}); err != nil {
+		return nil, 0, err
+	}
+	return s.value(*kv)
+}
+
+// value returns the data and revision of kv
+func (s *etcdSource) value(kv etcdKV) ([]byte, uint64, error) {
+	revision, err := strconv.ParseUint(kv.ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid revision of %s: %w", s, err)
+	}
+	return kv.Value, revision, nil
+}
+
+// post sends a JSON request to the gateway and hands the body to read
+func (s *etcdSource) post(ctx context.Context, path string, request interface{}, read func(io.Reader) error) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", s, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to read %s: etcd returned %s", s, resp.Status)
+	}
+	if err := read(resp.Body); err != nil {
+		return fmt.Errorf("failed to read %s: %w", s, err)
+	}
+	return nil
+}
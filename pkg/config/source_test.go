@@ -0,0 +1,172 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sourceConfig = `
+version: "1.0"
+rules:
+  - name: allow-internal
+    action: allow
+    order: 10
+    egress:
+      ips: ["10.0.0.0/8"]
+`
+
+// TestOpenSource tests parsing config locations
+func TestOpenSource(t *testing.T) {
+	testCases := []struct {
+		name     string
+		location string
+		want     string // Source description, empty for files
+		wantErr  bool
+	}{
+		{name: "file", location: "/etc/legion-router/config.yaml"},
+		{name: "consul", location: "consul://127.0.0.1:8500/legion/config", want: "consul key legion/config"},
+		{name: "etcd", location: "etcd://127.0.0.1:2379/legion/config?tls=true", want: "etcd key legion/config"},
+		{name: "missing key", location: "consul://127.0.0.1:8500/", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := OpenSource(tc.location)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("OpenSource() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			got := ""
+			if src != nil {
+				got = src.String()
+			}
+			if got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestConsulSource tests reading and watching a Consul key
+func TestConsulSource(t *testing.T) {
+	updated := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/legion/config" {
+			http.NotFound(w, r)
+			return
+		}
+		// Blocking queries return once the key changes
+		if r.URL.Query().Get("index") == "7" {
+			<-updated
+			w.Header().Set("X-Consul-Index", "9")
+			fmt.Fprint(w, strings.Replace(sourceConfig, "allow-internal", "allow-private", 1))
+			return
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		fmt.Fprint(w, sourceConfig)
+	}))
+	defer server.Close()
+
+	src, err := OpenSource("consul://" + strings.TrimPrefix(server.URL, "http://") + "/legion/config")
+	if err != nil {
+		t.Fatalf("OpenSource() error = %v", err)
+	}
+	cfg, revision, err := LoadSource(context.Background(), src)
+	if err != nil {
+		t.Fatalf("LoadSource() error = %v", err)
+	}
+	if revision != 7 || cfg.Rules[0].Name != "allow-internal" {
+		t.Errorf("Unexpected revision %d or rules %+v", revision, cfg.Rules)
+	}
+
+	close(updated)
+	data, revision, err := src.Wait(context.Background(), revision)
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if revision != 9 || !strings.Contains(string(data), "allow-private") {
+		t.Errorf("Unexpected revision %d or data %s", revision, data)
+	}
+}
+
+// TestEtcdSource tests reading and watching an etcd key via the gateway
+func TestEtcdSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"kvs": []map[string]interface{}{{"value": []byte(sourceConfig), "mod_revision": "12"}},
+			})
+		case "/v3/watch":
+			// The watch is confirmed before events arrive
+			encoder := json.NewEncoder(w)
+			encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+			encoder.Encode(map[string]interface{}{"result": map[string]interface{}{
+				"events": []map[string]interface{}{{"kv": map[string]interface{}{"value": []byte("updated"), "mod_revision": "15"}}},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	src, err := OpenSource("etcd://" + strings.TrimPrefix(server.URL, "http://") + "/legion/config")
+	if err != nil {
+		t.Fatalf("OpenSource() error = %v", err)
+	}
+	cfg, revision, err := LoadSource(context.Background(), src)
+	if err != nil {
+		t.Fatalf("LoadSource() error = %v", err)
+	}
+	if revision != 12 || len(cfg.Rules) != 1 {
+		t.Errorf("Unexpected revision %d or rules %+v", revision, cfg.Rules)
+	}
+
+	data, revision, err := src.Wait(context.Background(), revision)
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if revision != 15 || string(data) != "updated" {
+		t.Errorf("Unexpected revision %d or data %s", revision, data)
+	}
+}
+
+// TestEtcdSourcePutDelete tests that a watch result putting and then
+// deleting the key yields the put value
+func TestEtcdSourcePutDelete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+		encoder.Encode(map[string]interface{}{"result": map[string]interface{}{
+			"events": []map[string]interface{}{
+				{"kv": map[string]interface{}{"value": []byte("updated"), "mod_revision": "15"}},
+				{"type": "DELETE", "kv": map[string]interface{}{"mod_revision": "16"}},
+			},
+		}})
+	}))
+	defer server.Close()
+
+	src, err := OpenSource("etcd://" + strings.TrimPrefix(server.URL, "http://") + "/legion/config")
+	if err != nil {
+		t.Fatalf("OpenSource() error = %v", err)
+	}
+	data, revision, err := src.Wait(context.Background(), 12)
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if revision != 15 || string(data) != "updated" {
+		t.Errorf("Unexpected revision %d or data %s", revision, data)
+	}
+}
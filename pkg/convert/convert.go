@@ -0,0 +1,82 @@
+// Package convert translates policies between the config format and other
+// representations, for managing them as code or migrating from other
+// firewalls.
+package convert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats understood by Export and Import; nft and iptables dumps can
+// only be imported
+const (
+	FormatHCL      = "hcl"
+	FormatJSON     = "json"
+	FormatNFT      = "nft"
+	FormatIPTables = "iptables"
+)
+
+// AssignIDs gives rules without an ID one derived from their current name,
+// so that the ID stays when the rule is renamed later
+func AssignIDs(cfg *config.Config) {
+	for i := range cfg.Rules {
+		if cfg.Rules[i].ID == "" {
+			cfg.Rules[i].ID = ruleID(cfg.Rules[i].Name)
+		}
+	}
+}
+
+// ruleID derives an ID from a rule name
+func ruleID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "r-" + hex.EncodeToString(sum[:5])
+}
+
+// Export writes cfg in format, assigning missing rule IDs
+func Export(cfg *config.Config, format string) ([]byte, error) {
+	AssignIDs(cfg)
+	switch format {
+	case FormatHCL:
+		return exportHCL(cfg)
+	case FormatJSON:
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode policy: %w", err)
+		}
+		return append(data, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// Import reads a policy in format and validates it as a config. Firewall
+// dumps are converted to a skeleton, reporting what could not be converted.
+func Import(data []byte, format string) (*config.Config, error) {
+	switch format {
+	case FormatHCL:
+		return importHCL(data)
+	case FormatJSON:
+		return config.Parse(data)
+	case FormatNFT:
+		return importNFT(data)
+	case FormatIPTables:
+		return importIPTables(data)
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+}
+
+// MarshalYAML writes cfg in the config file format
+func MarshalYAML(cfg *config.Config) ([]byte, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,152 @@
+package convert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const testPolicy = `version: "1.0"
+dns:
+  servers: ["10.0.0.2"]
+vlans:
+  - id: 20
+    parent: eth1
+rules:
+  - name: allow-github
+    action: allow
+    order: 100
+    egress:
+      protocols: [tcp]
+      domains: ["github.com", "*.github.com"]
+      ports: ["443", "22"]
+  - id: legacy-ssh
+    name: allow-ssh
+    action: allow
+    order: 50
+    vlan_id: 20
+    egress:
+      protocols: [tcp]
+      ports: ["22"]
+`
+
+// TestRoundTrip tests that exported policies import to the same config
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatHCL, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			cfg, err := config.Parse([]byte(testPolicy))
+			if err != nil {
+				t.Fatalf("Failed to parse policy: %v", err)
+			}
+			data, err := Export(cfg, format)
+			if err != nil {
+				t.Fatalf("Failed to export: %v", err)
+			}
+			imported, err := Import(data, format)
+			if err != nil {
+				t.Fatalf("Failed to import: %v\n%s", err, data)
+			}
+			if !reflect.DeepEqual(imported, cfg) {
+				t.Errorf("Expected %+v, got %+v", cfg, imported)
+			}
+		})
+	}
+}
+
+// TestAssignIDs tests that assigned IDs survive renames and existing IDs
+// are kept
+func TestAssignIDs(t *testing.T) {
+	cfg, err := config.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	AssignIDs(cfg)
+	ids := map[string]string{}
+	for _, rule := range cfg.Rules {
+		ids[rule.Name] = rule.ID
+	}
+	if ids["allow-ssh"] != "legacy-ssh" {
+		t.Errorf("Expected the existing ID to be kept, got %s", ids["allow-ssh"])
+	}
+	id := ids["allow-github"]
+	if !strings.HasPrefix(id, "r-") {
+		t.Fatalf("Expected an assigned ID, got %q", id)
+	}
+
+	// Rename, then export again
+	for i := range cfg.Rules {
+		if cfg.Rules[i].Name == "allow-github" {
+			cfg.Rules[i].Name = "allow-github-enterprise"
+		}
+	}
+	data, err := Export(cfg, FormatHCL)
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if !strings.Contains(string(data), `"`+id+`"`) {
+		t.Errorf("Expected the renamed rule to keep ID %s:\n%s", id, data)
+	}
+}
+
+// TestImportHCL tests that invalid HCL policies are rejected
+func TestImportHCL(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			policy: `version = "1.0"
+rule "allow-dns" {
+  id     = "dns"
+  action = "allow"
+  order  = 50
+  egress = {
+    protocols = ["udp"]
+    ports     = ["53"]
+  }
+}
+`,
+			wantErr: false,
+		},
+		{
+			name:    "syntax error",
+			policy:  `rule "allow-dns" {`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown block",
+			policy:  `route "default" {}`,
+			wantErr: true,
+		},
+		{
+			name:    "variables",
+			policy:  `version = var.version`,
+			wantErr: true,
+		},
+		{
+			name: "invalid rule",
+			policy: `version = "1.0"
+rule "allow-dns" {
+  action = "maybe"
+  egress = {
+    ports = ["53"]
+  }
+}
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Import([]byte(tc.policy), FormatHCL)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Import() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
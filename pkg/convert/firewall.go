@@ -0,0 +1,131 @@
+package convert
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// firewallImporter collects the rules converted from a firewall dump. The
+// result is a skeleton: matches legion-router cannot express are reported
+// and their rules left out, to be reviewed by hand.
+type firewallImporter struct {
+	format string
+	rules  []config.Rule
+	names  map[string]bool
+}
+
+func newFirewallImporter(format string) *firewallImporter {
+	return &firewallImporter{format: format, names: map[string]bool{}}
+}
+
+// add appends a rule, naming it after its comment if any, else its chain
+// and position
+func (im *firewallImporter) add(rule config.Rule, comment, chain string) {
+	name := ruleName(comment)
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", ruleName(chain), len(im.rules)+1)
+	}
+	base := name
+	for i := 2; im.names[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	im.names[name] = true
+
+	rule.Name = name
+	rule.Order = (len(im.rules) + 1) * 10
+	im.rules = append(im.rules, rule)
+}
+
+// skip reports a rule that was left out
+func (im *firewallImporter) skip(line, reason string) {
+	log.Printf("Warning: %s: skipped %q: %s", im.format, strings.TrimSpace(line), reason)
+}
+
+// config returns the converted rules as a validated config
+func (im *firewallImporter) config() (*config.Config, error) {
+	if len(im.rules) == 0 {
+		return nil, fmt.Errorf("no %s forward rules could be converted", im.format)
+	}
+	cfg := &config.Config{Version: "1.0", Rules: im.rules}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("converted rules are invalid: %w", err)
+	}
+	return cfg, nil
+}
+
+// ruleName turns a comment or chain name into a rule name
+func ruleName(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// addProtocol adds a protocol to a rule once, mapping names to the ones
+// legion-router knows
+func addProtocol(egress *config.Egress, name string) error {
+	var proto config.Protocol
+	switch strings.ToLower(name) {
+	case "tcp", "6":
+		proto = config.ProtocolTCP
+	case "udp", "17":
+		proto = config.ProtocolUDP
+	case "icmp", "icmpv6", "ipv6-icmp", "1", "58":
+		proto = config.ProtocolICMP
+	default:
+		return fmt.Errorf("protocol %s is not supported", name)
+	}
+	for _, p := range egress.Protocols {
+		if p == proto {
+			return nil
+		}
+	}
+	egress.Protocols = append(egress.Protocols, proto)
+	return nil
+}
+
+// addPort adds a port or range, given with - or : between the bounds
+func addPort(egress *config.Egress, proto, port string) error {
+	bounds := strings.FieldsFunc(port, func(r rune) bool { return r == '-' || r == ':' })
+	if len(bounds) == 0 || len(bounds) > 2 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	for i, bound := range bounds {
+		if _, err := strconv.ParseUint(bound, 10, 16); err == nil {
+			continue
+		}
+		number, err := net.LookupPort(proto, bound)
+		if err != nil {
+			return fmt.Errorf("unknown service %q", bound)
+		}
+		bounds[i] = strconv.Itoa(number)
+	}
+	egress.Ports = append(egress.Ports, strings.Join(bounds, "-"))
+	return nil
+}
+
+// addAddress adds a destination address or network
+func addAddress(egress *config.Egress, address string) error {
+	if net.ParseIP(address) == nil {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+	egress.IPs = append(egress.IPs, address)
+	return nil
+}
@@ -0,0 +1,132 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const testRuleset = `table inet filter {
+	set blocked {
+		type ipv4_addr
+		elements = { 192.0.2.1, 192.0.2.2 }
+	}
+
+	chain input {
+		type filter hook input priority filter; policy drop;
+		tcp dport 22 accept
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy drop;
+		ct state established,related accept
+		ip daddr 169.254.169.254 counter packets 3 bytes 180 drop comment "Block metadata"
+		ip daddr @blocked drop
+		ip daddr 10.0.0.0/8 tcp dport { 22, 443, 8000-8080 } accept
+		meta l4proto { tcp, udp } th dport 53 accept
+		iifname "eth1" accept
+		icmp type echo-request accept
+		ip daddr 192.0.2.10 tcp dport 25 reject with tcp reset
+	}
+}
+`
+
+const testIPTables = `# Generated by iptables-save
+*nat
+:POSTROUTING ACCEPT [0:0]
+-A POSTROUTING -o eth0 -j MASQUERADE
+COMMIT
+*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A FORWARD -d 169.254.169.254/32 -m comment --comment "Block metadata" -j REJECT --reject-with icmp-admin-prohibited
+-A FORWARD -d 10.0.0.0/8 -p tcp -m multiport --dports 22,443,8000:8080 -j ACCEPT
+-A FORWARD -p udp -m udp --dport 53 -j ACCEPT
+-A FORWARD ! -d 10.0.0.0/8 -j DROP
+-A FORWARD -p icmp -m icmp --icmp-type 8 -j ACCEPT
+-A FORWARD -d 192.0.2.10/32 -p tcp -m tcp --dport 25 -j REJECT --reject-with tcp-reset
+COMMIT
+`
+
+// TestImportFirewall tests converting nft and iptables dumps, leaving out
+// the rules that cannot be expressed
+func TestImportFirewall(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format string
+		dump   string
+		want   []config.Rule
+	}{
+		{
+			name:   "nft",
+			format: FormatNFT,
+			dump:   testRuleset,
+			want: []config.Rule{
+				{Name: "block-metadata", Action: config.ActionDeny, Order: 10, Egress: config.Egress{IPs: []string{"169.254.169.254"}}},
+				{Name: "forward-2", Action: config.ActionAllow, Order: 20, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolTCP},
+					IPs:       []string{"10.0.0.0/8"},
+					Ports:     []string{"22", "443", "8000-8080"},
+				}},
+				{Name: "forward-3", Action: config.ActionAllow, Order: 30, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolTCP, config.ProtocolUDP},
+					Ports:     []string{"53"},
+				}},
+				{Name: "forward-4", Action: config.ActionAllow, Order: 40, Egress: config.Egress{Protocols: []config.Protocol{config.ProtocolICMP}}},
+				{Name: "forward-5", Action: config.ActionDeny, DenyBehavior: config.DenyRejectTCPRST, Order: 50, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolTCP},
+					IPs:       []string{"192.0.2.10"},
+					Ports:     []string{"25"},
+				}},
+			},
+		},
+		{
+			name:   "iptables",
+			format: FormatIPTables,
+			dump:   testIPTables,
+			want: []config.Rule{
+				{Name: "block-metadata", Action: config.ActionDeny, DenyBehavior: config.DenyReject, RejectWith: config.RejectAdminProhibited, Order: 10, Egress: config.Egress{IPs: []string{"169.254.169.254/32"}}},
+				{Name: "forward-2", Action: config.ActionAllow, Order: 20, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolTCP},
+					IPs:       []string{"10.0.0.0/8"},
+					Ports:     []string{"22", "443", "8000-8080"},
+				}},
+				{Name: "forward-3", Action: config.ActionAllow, Order: 30, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolUDP},
+					Ports:     []string{"53"},
+				}},
+				{Name: "forward-4", Action: config.ActionAllow, Order: 40, Egress: config.Egress{Protocols: []config.Protocol{config.ProtocolICMP}}},
+				{Name: "forward-5", Action: config.ActionDeny, DenyBehavior: config.DenyRejectTCPRST, Order: 50, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolTCP},
+					IPs:       []string{"192.0.2.10/32"},
+					Ports:     []string{"25"},
+				}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := Import([]byte(tc.dump), tc.format)
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Rules, tc.want) {
+				t.Errorf("Expected rules\n%+v\ngot\n%+v", tc.want, cfg.Rules)
+			}
+		})
+	}
+}
+
+// TestImportFirewallNothingConverted tests that a dump without convertible
+// forward rules is an error rather than an empty policy
+func TestImportFirewallNothingConverted(t *testing.T) {
+	dump := "*filter\n:FORWARD ACCEPT [0:0]\n-A FORWARD -i eth1 -j ACCEPT\nCOMMIT\n"
+	if _, err := Import([]byte(dump), FormatIPTables); err == nil {
+		t.Error("Expected error without convertible rules")
+	}
+}
@@ -0,0 +1,184 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/skaegi/legion-router/pkg/config"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// ruleBlock is the HCL block type of rules, labelled with the rule name
+const ruleBlock = "rule"
+
+// exportHCL writes the top-level config sections as attributes and each
+// rule as a block:
+//
+//	version = "1.0"
+//
+//	rule "allow-github" {
+//	  id     = "r-..."
+//	  action = "allow"
+//	  egress = {
+//	    domains = ["github.com"]
+//	  }
+//	}
+func exportHCL(cfg *config.Config) ([]byte, error) {
+	sections, err := jsonFields(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rules := sections["rules"]
+	delete(sections, "rules")
+
+	file := hclwrite.NewEmptyFile()
+	body := file.Body()
+	if err := setAttributes(body, sections); err != nil {
+		return nil, err
+	}
+
+	var ruleFields []map[string]json.RawMessage
+	if err := json.Unmarshal(rules, &ruleFields); err != nil {
+		return nil, fmt.Errorf("failed to encode rules: %w", err)
+	}
+	for i, fields := range ruleFields {
+		body.AppendNewline()
+		block := body.AppendNewBlock(ruleBlock, []string{cfg.Rules[i].Name})
+		delete(fields, "name")
+		// The ID leads so that renames show up next to it in diffs
+		if err := setAttributes(block.Body(), map[string]json.RawMessage{"id": fields["id"]}); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", cfg.Rules[i].Name, err)
+		}
+		delete(fields, "id")
+		if err := setAttributes(block.Body(), fields); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", cfg.Rules[i].Name, err)
+		}
+	}
+	return file.Bytes(), nil
+}
+
+// importHCL reads a policy written by exportHCL
+func importHCL(data []byte) (*config.Config, error) {
+	file, diags := hclsyntax.ParseConfig(data, "policy.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to parse HCL: %w", diags)
+	}
+	body := file.Body.(*hclsyntax.Body)
+
+	sections, err := attributeValues(body.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	rules := []map[string]json.RawMessage{}
+	for _, block := range body.Blocks {
+		if block.Type != ruleBlock || len(block.Labels) != 1 {
+			return nil, fmt.Errorf("%s: unexpected block %s", block.DefRange(), block.Type)
+		}
+		if len(block.Body.Blocks) > 0 {
+			return nil, fmt.Errorf("%s: rule %s: nested blocks are not supported, use attributes", block.DefRange(), block.Labels[0])
+		}
+		fields, err := attributeValues(block.Body.Attributes)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", block.Labels[0], err)
+		}
+		fields["name"], _ = json.Marshal(block.Labels[0])
+		rules = append(rules, fields)
+	}
+	if sections["rules"], err = json.Marshal(rules); err != nil {
+		return nil, fmt.Errorf("failed to encode rules: %w", err)
+	}
+
+	converted, err := json.Marshal(sections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode policy: %w", err)
+	}
+	return config.Parse(converted)
+}
+
+// jsonFields returns the JSON encoding of each field of v, leaving out
+// empty sections
+func jsonFields(v interface{}) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode policy: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to encode policy: %w", err)
+	}
+	prune(value)
+
+	fields := map[string]json.RawMessage{}
+	for name, field := range value.(map[string]interface{}) {
+		if fields[name], err = json.Marshal(field); err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+	}
+	return fields, nil
+}
+
+// prune removes empty objects, which structs without omitempty support
+// leave behind
+func prune(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if prune(field) {
+				delete(v, name)
+			}
+		}
+		return len(v) == 0
+	case []interface{}:
+		for _, item := range v {
+			prune(item)
+		}
+	}
+	return false
+}
+
+// setAttributes sets JSON encoded fields as attributes, in name order
+func setAttributes(body *hclwrite.Body, fields map[string]json.RawMessage) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ty, err := ctyjson.ImpliedType(fields[name])
+		if err != nil {
+			return fmt.Errorf("failed to convert %s: %w", name, err)
+		}
+		value, err := ctyjson.Unmarshal(fields[name], ty)
+		if err != nil {
+			return fmt.Errorf("failed to convert %s: %w", name, err)
+		}
+		body.SetAttributeValue(name, value)
+	}
+	return nil
+}
+
+// attributeValues evaluates attributes to JSON; expressions may only use
+// literals, since there are no variables or functions
+func attributeValues(attributes hclsyntax.Attributes) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage, len(attributes))
+	for name, attr := range attributes {
+		value, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("failed to evaluate %s: %w", name, diags)
+		}
+		data, err := ctyjson.Marshal(value, value.Type())
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s: %w", name, err)
+		}
+		fields[name] = data
+	}
+	return fields, nil
+}
@@ -0,0 +1,170 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// importIPTables converts the FORWARD chain of an iptables-save or
+// ip6tables-save dump
+func importIPTables(data []byte) (*config.Config, error) {
+	im := newFirewallImporter(FormatIPTables)
+
+	var table string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || line == "COMMIT":
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case table != "filter":
+			// Only filter rules are converted
+		case strings.HasPrefix(line, ":FORWARD ACCEPT"):
+			log.Printf("Warning: %s: FORWARD accepts by default, legion-router denies unmatched traffic", FormatIPTables)
+		case strings.HasPrefix(line, "-A FORWARD "):
+			rule, comment, err := iptablesRule(iptablesTokens(line)[2:])
+			if err != nil {
+				im.skip(line, err.Error())
+				break
+			}
+			im.add(rule, comment, "forward")
+		case strings.HasPrefix(line, "-A "):
+			im.skip(line, "only the FORWARD chain is converted")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	return im.config()
+}
+
+// iptablesRule converts the options of a rule
+func iptablesRule(args []string) (config.Rule, string, error) {
+	var (
+		rule     config.Rule
+		comment  string
+		protocol string
+		ports    []string
+	)
+	for i := 0; i < len(args); i++ {
+		option := args[i]
+		if option == "!" {
+			return rule, "", fmt.Errorf("negated matches are not supported")
+		}
+		if option == "-m" || option == "--match" {
+			if i+1 < len(args) && (args[i+1] == "conntrack" || args[i+1] == "state") {
+				return rule, "", fmt.Errorf("connection tracking matches are not supported")
+			}
+			// Matches are recognized by their options
+			i++
+			continue
+		}
+
+		if i+1 >= len(args) || args[i+1] == "!" {
+			return rule, "", fmt.Errorf("%s is not supported", option)
+		}
+		i++
+		value := args[i]
+		switch option {
+		case "-p", "--protocol":
+			if value == "all" {
+				break
+			}
+			if err := addProtocol(&rule.Egress, value); err != nil {
+				return rule, "", err
+			}
+			protocol = value
+		case "-d", "--destination":
+			for _, address := range strings.Split(value, ",") {
+				if err := addAddress(&rule.Egress, address); err != nil {
+					return rule, "", err
+				}
+			}
+		case "--dport", "--destination-port", "--dports", "--destination-ports":
+			ports = append(ports, strings.Split(value, ",")...)
+		case "--icmp-type", "--icmpv6-type":
+			// legion-router matches all ICMP types
+		case "--comment":
+			comment = value
+		case "-j", "--jump":
+			switch value {
+			case "ACCEPT":
+				rule.Action = config.ActionAllow
+			case "DROP":
+				rule.Action = config.ActionDeny
+			case "REJECT":
+				rule.Action, rule.DenyBehavior = config.ActionDeny, config.DenyReject
+			default:
+				return rule, "", fmt.Errorf("target %s is not supported", value)
+			}
+			// Skip target options such as --reject-with, telling TCP
+			// resets and administratively prohibited apart from the other
+			// ICMP types
+			for i+1 < len(args) && strings.HasPrefix(args[i+1], "--") && args[i+1] != "--comment" {
+				if args[i+1] == "--reject-with" && i+2 < len(args) {
+					switch args[i+2] {
+					case "tcp-reset":
+						rule.DenyBehavior = config.DenyRejectTCPRST
+					case "icmp-admin-prohibited", "icmp6-adm-prohibited":
+						rule.RejectWith = config.RejectAdminProhibited
+					}
+				}
+				i += 2
+			}
+		default:
+			return rule, "", fmt.Errorf("%s is not supported", option)
+		}
+	}
+
+	if len(ports) > 0 && protocol != "tcp" && protocol != "udp" {
+		return rule, "", fmt.Errorf("ports need -p tcp or -p udp")
+	}
+	for _, port := range ports {
+		if err := addPort(&rule.Egress, protocol, port); err != nil {
+			return rule, "", err
+		}
+	}
+	if rule.Action == "" {
+		return rule, "", fmt.Errorf("no ACCEPT, DROP or REJECT target")
+	}
+	return rule, comment, nil
+}
+
+// iptablesTokens splits a rule into arguments, keeping quoted strings
+// together
+func iptablesTokens(line string) []string {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
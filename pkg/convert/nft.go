@@ -0,0 +1,245 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// importNFT converts the forward chains of an `nft list ruleset` dump
+func importNFT(data []byte) (*config.Config, error) {
+	im := newFirewallImporter(FormatNFT)
+
+	var (
+		table, chain string
+		forward      bool
+		warned       bool // Whether a chain that is not converted was reported
+		skipDepth    int  // Depth of a set, map or other block being skipped
+		depth        int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		opened := strings.Count(line, "{") - strings.Count(line, "}")
+
+		switch {
+		case skipDepth > 0:
+			// Inside a block without rules
+		case depth == 0 && strings.HasPrefix(line, "table "):
+			table = strings.Fields(line)[len(strings.Fields(line))-2]
+		case depth == 1 && strings.HasPrefix(line, "chain "):
+			chain = strings.Fields(line)[1]
+			forward, warned = false, false
+		case depth == 1 && strings.HasSuffix(line, "{"):
+			skipDepth = depth + 1
+		case depth == 2 && chain != "" && strings.HasPrefix(line, "type "):
+			forward = strings.Contains(line, " hook forward ")
+			if forward && strings.Contains(line, "policy accept") {
+				log.Printf("Warning: %s: chain %s %s accepts by default, legion-router denies unmatched traffic", FormatNFT, table, chain)
+			}
+		case depth == 2 && chain != "" && line != "}":
+			if !forward {
+				if !warned {
+					log.Printf("Warning: %s: skipped chain %s %s: not a forward base chain", FormatNFT, table, chain)
+					warned = true
+				}
+				break
+			}
+			rule, comment, err := nftRule(line)
+			if err != nil {
+				im.skip(line, err.Error())
+				break
+			}
+			im.add(rule, comment, chain)
+		}
+
+		depth += opened
+		if skipDepth > 0 && depth < skipDepth {
+			skipDepth = 0
+		}
+		if depth < 2 {
+			chain = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ruleset: %w", err)
+	}
+	return im.config()
+}
+
+// nftRule converts the statements of a rule
+func nftRule(line string) (config.Rule, string, error) {
+	var (
+		rule    config.Rule
+		comment string
+	)
+	tokens := nftTokens(line)
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		next := func() (string, error) {
+			if i+1 >= len(tokens) {
+				return "", fmt.Errorf("%s needs a value", token)
+			}
+			i++
+			if tokens[i] == "!=" {
+				return "", fmt.Errorf("negated matches are not supported")
+			}
+			if tokens[i] == "==" && i+1 < len(tokens) {
+				i++
+			}
+			return tokens[i], nil
+		}
+
+		switch token {
+		case "ip", "ip6", "tcp", "udp", "th", "meta", "ct", "icmp", "icmpv6":
+			if i+1 >= len(tokens) {
+				return rule, "", fmt.Errorf("%s needs a field", token)
+			}
+			i++
+			field := tokens[i]
+			value, err := next()
+			if err != nil {
+				return rule, "", err
+			}
+			if err := nftMatch(&rule.Egress, token, field, value); err != nil {
+				return rule, "", err
+			}
+		case "counter":
+			// Skip the counter values of a live ruleset
+			for i+2 < len(tokens) && (tokens[i+1] == "packets" || tokens[i+1] == "bytes") {
+				i += 2
+			}
+		case "comment":
+			value, err := next()
+			if err != nil {
+				return rule, "", err
+			}
+			comment = strings.Trim(value, `"`)
+		case "accept":
+			rule.Action = config.ActionAllow
+		case "drop":
+			rule.Action = config.ActionDeny
+		case "reject":
+			rule.Action, rule.DenyBehavior = config.ActionDeny, config.DenyReject
+			// Only TCP resets and administratively prohibited are told
+			// apart from the other ICMP types
+			for i+1 < len(tokens) && tokens[i+1] != "comment" {
+				i++
+				switch tokens[i] {
+				case "reset":
+					rule.DenyBehavior = config.DenyRejectTCPRST
+				case "admin-prohibited":
+					rule.RejectWith = config.RejectAdminProhibited
+				}
+			}
+		default:
+			return rule, "", fmt.Errorf("%s is not supported", token)
+		}
+	}
+	if rule.Action == "" {
+		return rule, "", fmt.Errorf("no accept, drop or reject verdict")
+	}
+	return rule, comment, nil
+}
+
+// nftMatch converts a payload or meta match
+func nftMatch(egress *config.Egress, protocol, field, value string) error {
+	if strings.HasPrefix(value, "@") {
+		return fmt.Errorf("named sets are not supported")
+	}
+	values := nftValues(value)
+	switch {
+	case (protocol == "ip" || protocol == "ip6") && field == "daddr":
+		for _, v := range values {
+			if err := addAddress(egress, v); err != nil {
+				return err
+			}
+		}
+	case protocol == "ip" && field == "protocol",
+		protocol == "ip6" && field == "nexthdr",
+		protocol == "meta" && field == "l4proto":
+		for _, v := range values {
+			if err := addProtocol(egress, v); err != nil {
+				return err
+			}
+		}
+	case (protocol == "tcp" || protocol == "udp") && field == "dport":
+		if err := addProtocol(egress, protocol); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if err := addPort(egress, protocol, v); err != nil {
+				return err
+			}
+		}
+	case protocol == "th" && field == "dport":
+		for _, v := range values {
+			if err := addPort(egress, "tcp", v); err != nil {
+				return err
+			}
+		}
+	case protocol == "icmp" || protocol == "icmpv6":
+		// legion-router matches all ICMP types
+		return addProtocol(egress, protocol)
+	case protocol == "ct":
+		return fmt.Errorf("connection tracking matches are not supported")
+	default:
+		return fmt.Errorf("%s %s is not supported", protocol, field)
+	}
+	return nil
+}
+
+// nftTokens splits a rule into words, keeping quoted strings and anonymous
+// sets together
+func nftTokens(line string) []string {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+		braces  int
+	)
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '{':
+			braces++
+		case r == '}':
+			braces--
+		case unicode.IsSpace(r) && braces == 0:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// nftValues returns the elements of an anonymous set, or the single value
+func nftValues(value string) []string {
+	if !strings.HasPrefix(value, "{") {
+		return []string{value}
+	}
+	var values []string
+	for _, v := range strings.Split(strings.Trim(value, "{}"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
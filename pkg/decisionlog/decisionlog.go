@@ -0,0 +1,274 @@
+// Package decisionlog records a sample of the verdicts the router decides in
+// a compact binary file, so that they can be replayed against a candidate
+// policy to predict its impact. A file starts with a magic and a version
+// and holds a record per decision, each prefixed with its length so that a
+// reader skips fields it doesn't know and stops at a record cut short.
+package decisionlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/internal/logfile"
+)
+
+const (
+	magic   = "LRDL"
+	version = 1
+
+	// maxRecord bounds the length of a record a reader accepts
+	maxRecord = 4096
+)
+
+// Decision is a recorded verdict and what it was decided on
+type Decision struct {
+	Time    time.Time
+	Verdict string // allow or deny
+	// Rule deciding the connection, "" for connections no rule matched
+	Rule     string
+	Protocol string // tcp, udp, icmp, icmpv6 or the protocol number
+	// Interface the connection arrived on, "" if unknown
+	Interface   string
+	Source      net.IP
+	SourcePort  uint16
+	Destination net.IP
+	Port        uint16
+	// Domain the destination was attributed to, "" if unknown
+	Domain string
+}
+
+// protocolNumbers are the protocols recorded by number
+var protocolNumbers = map[string]byte{"icmp": 1, "tcp": 6, "udp": 17, "icmpv6": 58}
+
+// marshal encodes d as a record, without its length
+func (d Decision) marshal() ([]byte, error) {
+	proto, ok := protocolNumbers[d.Protocol]
+	if !ok {
+		n, err := strconv.ParseUint(d.Protocol, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol: %s", d.Protocol)
+		}
+		proto = byte(n)
+	}
+	verdict := byte(0)
+	if d.Verdict == "allow" {
+		verdict = 1
+	}
+
+	b := binary.AppendVarint(nil, d.Time.UnixNano())
+	b = append(b, verdict, proto)
+	b = binary.BigEndian.AppendUint16(b, d.SourcePort)
+	b = binary.BigEndian.AppendUint16(b, d.Port)
+	for _, ip := range []net.IP{d.Source, d.Destination} {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		b = append(b, byte(len(ip)))
+		b = append(b, ip...)
+	}
+	for _, s := range []string{d.Rule, d.Interface, d.Domain} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+// unmarshal decodes a record
+func unmarshal(b []byte) (Decision, error) {
+	var d Decision
+	r := &recordReader{b: b}
+	d.Time = time.Unix(0, r.varint()).UTC()
+	d.Verdict = "deny"
+	if r.byte() == 1 {
+		d.Verdict = "allow"
+	}
+	proto := r.byte()
+	d.Protocol = strconv.Itoa(int(proto))
+	for name, n := range protocolNumbers {
+		if n == proto {
+			d.Protocol = name
+		}
+	}
+	d.SourcePort, d.Port = r.uint16(), r.uint16()
+	d.Source, d.Destination = net.IP(r.bytes(uint64(r.byte()))), net.IP(r.bytes(uint64(r.byte())))
+	d.Rule, d.Interface, d.Domain = string(r.bytes(r.uvarint())), string(r.bytes(r.uvarint())), string(r.bytes(r.uvarint()))
+	if r.err != nil {
+		return Decision{}, r.err
+	}
+	return d, nil
+}
+
+// recordReader reads the fields of a record, keeping the first error
+type recordReader struct {
+	b   []byte
+	err error
+}
+
+var errShortRecord = errors.New("record cut short")
+
+// ErrFormat is returned for a file that is not a decision log
+var ErrFormat = errors.New("not a decision log")
+
+func (r *recordReader) bytes(n uint64) []byte {
+	if r.err != nil || uint64(len(r.b)) < n {
+		r.err = errShortRecord
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *recordReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *recordReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *recordReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errShortRecord
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *recordReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShortRecord
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// Options configures a Writer
+type Options struct {
+	// SampleRate is the fraction of decisions recorded, all if 0
+	SampleRate float64
+	// MaxSize rotates the file once it reaches this many bytes, and
+	// MaxBackups rotated files are kept
+	MaxSize    int64
+	MaxBackups int
+}
+
+// Writer appends decisions to a file that is rotated once it reaches its
+// maximum size, each file starting with the header
+type Writer struct {
+	options Options
+	file    *logfile.File
+}
+
+// Open opens the file at path for appending decisions, starting it if it
+// is new
+func Open(path string, options Options) (*Writer, error) {
+	file, err := logfile.Open(path, options.MaxSize, options.MaxBackups, append([]byte(magic), version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open decision log: %w", err)
+	}
+	return &Writer{options: options, file: file}, nil
+}
+
+// Record appends d, unless it is left out of the sample
+func (w *Writer) Record(d Decision) {
+	if w.options.SampleRate > 0 && w.options.SampleRate < 1 && rand.Float64() >= w.options.SampleRate {
+		return
+	}
+	body, err := d.marshal()
+	if err != nil {
+		log.Printf("Warning: failed to record decision: %v", err)
+		return
+	}
+	record := append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+	if err := w.file.Write(record); err != nil {
+		log.Printf("Warning: failed to write decision log: %v", err)
+	}
+}
+
+// Close closes the file
+func (w *Writer) Close() error {
+	return w.file.Close()
+}
+
+// Reader reads the decisions of a file in the order they were recorded
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader reads decisions from r, checking its header
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported decision log version %d", header[len(magic)])
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next decision, or io.EOF after the last. A record cut
+// short, as by a crash while writing it, ends the file.
+func (r *Reader) Next() (Decision, error) {
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Decision{}, io.EOF
+		}
+		return Decision{}, err
+	}
+	if length > maxRecord {
+		return Decision{}, fmt.Errorf("invalid record length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return Decision{}, io.EOF
+	}
+	return unmarshal(body)
+}
+
+// ReadFile returns the decisions recorded in the file at path
+func ReadFile(path string) ([]Decision, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var decisions []Decision
+	for {
+		d, err := r.Next()
+		if err == io.EOF {
+			return decisions, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		decisions = append(decisions, d)
+	}
+}
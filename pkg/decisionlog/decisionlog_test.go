@@ -0,0 +1,91 @@
+package decisionlog
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	decisions := []Decision{
+		{
+			Time: now, Verdict: "allow", Rule: "allow-github", Protocol: "tcp", Interface: "eth1",
+			Source: net.ParseIP("10.0.0.5").To4(), SourcePort: 51234,
+			Destination: net.ParseIP("140.82.112.3").To4(), Port: 443, Domain: "github.com",
+		},
+		{
+			Time: now.Add(time.Second), Verdict: "deny", Protocol: "icmpv6",
+			Source: net.ParseIP("fd00::5"), Destination: net.ParseIP("2001:db8::1"),
+		},
+		{
+			Time: now.Add(2 * time.Second), Verdict: "deny", Rule: "no-gre", Protocol: "47",
+			Source: net.ParseIP("10.0.0.5").To4(), Destination: net.ParseIP("192.0.2.1").To4(),
+		},
+	}
+
+	w, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	for _, d := range decisions {
+		w.Record(d)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// A record cut short by a crash ends the file
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{40, 1, 2})
+	f.Close()
+
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !reflect.DeepEqual(got, decisions) {
+		t.Errorf("Expected %+v, got %+v", decisions, got)
+	}
+
+	notLog := filepath.Join(t.TempDir(), "not.log")
+	os.WriteFile(notLog, []byte("allow rule=web\n"), 0644)
+	if _, err := ReadFile(notLog); err == nil {
+		t.Errorf("Expected reading a text file to fail")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	w, err := Open(path, Options{MaxSize: 100, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	d := Decision{Time: time.Now(), Verdict: "allow", Protocol: "tcp", Source: net.ParseIP("10.0.0.5"), Destination: net.ParseIP("192.0.2.1"), Port: 443}
+	for i := 0; i < 20; i++ {
+		w.Record(d)
+	}
+	w.Close()
+
+	total := 0
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		decisions, err := ReadFile(p)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", p, err)
+		}
+		total += len(decisions)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("Expected at most 2 backups")
+	}
+	if total == 0 || total >= 20 {
+		t.Errorf("Expected the oldest decisions dropped, got %d of 20", total)
+	}
+}
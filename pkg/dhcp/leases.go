@@ -0,0 +1,244 @@
+// Package dhcp reads the lease files of DHCP servers running alongside the
+// router, so that the hostnames clients announce can be resolved and used
+// in the policy.
+package dhcp
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// Lease is an address leased to a client announcing a hostname
+type Lease struct {
+	Hostname string // Lower case, without domain
+	IP       net.IP
+	Expires  time.Time // Zero if the lease never expires
+}
+
+// ReadLeases returns the leases in a lease file that are active at now
+// and carry a hostname
+func ReadLeases(path, format string, now time.Time) ([]Lease, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var leases []Lease
+	switch format {
+	case config.LeaseFormatISC:
+		leases, err = parseISC(file)
+	case config.LeaseFormatKea:
+		leases, err = parseKea(file)
+	default:
+		leases, err = parseDnsmasq(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s leases: %w", format, err)
+	}
+
+	active := leases[:0]
+	for _, lease := range leases {
+		if !lease.Expires.IsZero() && !lease.Expires.After(now) {
+			continue
+		}
+		if lease.Hostname = hostname(lease.Hostname); lease.Hostname == "" {
+			continue
+		}
+		active = append(active, lease)
+	}
+	return active, nil
+}
+
+// hostname returns the first label of a hostname, lower case, or "" if it
+// is not a valid label
+func hostname(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || name == "*" {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return ""
+	}
+	return name
+}
+
+// parseDnsmasq parses a dnsmasq lease file: one lease per line as
+// "<expiry> <mac or iaid> <address> <hostname> <client id>", with IPv6
+// leases after a "duid" line
+func parseDnsmasq(r io.Reader) ([]Lease, error) {
+	var leases []Lease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", fields[0])
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", fields[2])
+		}
+		lease := Lease{Hostname: fields[3], IP: ip}
+		if expiry > 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseISC parses the IPv4 leases of an ISC dhcpd lease file, where later
+// declarations of an address replace earlier ones
+func parseISC(r io.Reader) ([]Lease, error) {
+	var (
+		leases  []Lease
+		index   = make(map[string]int) // Address -> position in leases
+		current *Lease
+		active  bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Statements end at ";", possibly followed by a comment
+		statement, _, _ := strings.Cut(line, ";")
+		switch {
+		case strings.HasPrefix(line, "lease "):
+			fields := strings.Fields(line)
+			ip := net.ParseIP(fields[1]).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", fields[1])
+			}
+			current, active = &Lease{IP: ip}, true
+		case current == nil:
+			continue
+		case strings.HasPrefix(statement, "ends "):
+			// "<weekday> yyyy/mm/dd hh:mm:ss" in UTC, "epoch <seconds>" or
+			// "never"
+			fields := strings.Fields(strings.TrimPrefix(statement, "ends "))
+			switch {
+			case len(fields) == 2 && fields[0] == "epoch":
+				seconds, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid lease end %q", statement)
+				}
+				current.Expires = time.Unix(seconds, 0)
+			case len(fields) == 3:
+				expires, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+				if err != nil {
+					return nil, fmt.Errorf("invalid lease end %q", statement)
+				}
+				current.Expires = expires
+			}
+		case strings.HasPrefix(statement, "binding state "):
+			active = strings.TrimPrefix(statement, "binding state ") == "active"
+		case strings.HasPrefix(statement, "client-hostname "):
+			current.Hostname = strings.Trim(strings.TrimPrefix(statement, "client-hostname "), `"`)
+		case line == "}":
+			key := current.IP.String()
+			if i, ok := index[key]; ok {
+				leases[i] = Lease{}
+			}
+			if active {
+				index[key] = len(leases)
+				leases = append(leases, *current)
+			} else {
+				delete(index, key)
+			}
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	kept := leases[:0]
+	for _, lease := range leases {
+		if lease.IP != nil {
+			kept = append(kept, lease)
+		}
+	}
+	return kept, nil
+}
+
+// parseKea parses a Kea memfile lease file, a CSV file whose header names
+// the columns
+func parseKea(r io.Reader) ([]Lease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	var leases []Lease
+	index := make(map[string]int) // Address -> position in leases
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < len(header) {
+			continue
+		}
+		ip := net.ParseIP(record[columns["address"]])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", record[columns["address"]])
+		}
+		expire, err := strconv.ParseInt(record[columns["expire"]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expire %q", record[columns["expire"]])
+		}
+		// Kea appends updates, so the last line of an address is current;
+		// state 0 is an assigned lease
+		lease := Lease{Hostname: record[columns["hostname"]], IP: ip, Expires: time.Unix(expire, 0)}
+		if record[columns["state"]] != "0" {
+			lease = Lease{}
+		}
+		if i, ok := index[ip.String()]; ok {
+			leases[i] = lease
+			continue
+		}
+		index[ip.String()] = len(leases)
+		leases = append(leases, lease)
+	}
+
+	kept := leases[:0]
+	for _, lease := range leases {
+		if lease.IP != nil {
+			kept = append(kept, lease)
+		}
+	}
+	return kept, nil
+}
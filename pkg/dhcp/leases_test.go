@@ -0,0 +1,100 @@
+package dhcp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestReadLeases tests that the active leases with hostnames are read from
+// each lease file format
+func TestReadLeases(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	future := now.Add(time.Hour).Unix()
+	past := now.Add(-time.Hour).Unix()
+
+	testCases := []struct {
+		name   string
+		format string
+		data   string
+		want   []string
+	}{
+		{
+			name:   "dnsmasq",
+			format: config.LeaseFormatDnsmasq,
+			data: strconv.FormatInt(future, 10) + " 52:54:00:12:34:56 10.0.0.10 Laptop 01:52:54:00:12:34:56\n" +
+				strconv.FormatInt(past, 10) + " 52:54:00:12:34:57 10.0.0.11 old *\n" +
+				"0 52:54:00:12:34:58 10.0.0.12 nas.lan *\n" +
+				strconv.FormatInt(future, 10) + " 52:54:00:12:34:59 10.0.0.13 * *\n" +
+				"duid 00:01:00:01:2c:00:00:00:52:54:00:12:34:56\n" +
+				strconv.FormatInt(future, 10) + " 1234 fd00::10 laptop *\n",
+			want: []string{"laptop 10.0.0.10", "nas 10.0.0.12", "laptop fd00::10"},
+		},
+		{
+			name:   "isc",
+			format: config.LeaseFormatISC,
+			data: `lease 10.0.0.10 {
+  starts 4 2026/10/15 12:00:00;
+  ends 5 2026/10/16 13:00:00;
+  binding state active;
+  client-hostname "laptop";
+}
+lease 10.0.0.11 {
+  ends epoch 1792148400; # Fri Oct 16 11:00:00 2026
+  binding state active;
+  client-hostname "old";
+}
+lease 10.0.0.12 {
+  ends never;
+  binding state active;
+  client-hostname "printer";
+}
+lease 10.0.0.12 {
+  ends never;
+  binding state free;
+}
+lease 10.0.0.13 {
+  ends never;
+  binding state active;
+  client-hostname "nas";
+}
+`,
+			want: []string{"laptop 10.0.0.10", "nas 10.0.0.13"},
+		},
+		{
+			name:   "kea",
+			format: config.LeaseFormatKea,
+			data: "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id\n" +
+				"10.0.0.10,52:54:00:12:34:56,,3600," + strconv.FormatInt(future, 10) + ",1,0,0,laptop.example.org.,0,,0\n" +
+				"10.0.0.11,52:54:00:12:34:57,,3600," + strconv.FormatInt(future, 10) + ",1,0,0,old,0,,0\n" +
+				"10.0.0.11,52:54:00:12:34:57,,0," + strconv.FormatInt(future, 10) + ",1,0,0,old,2,,0\n" +
+				"10.0.0.12,52:54:00:12:34:58,,3600," + strconv.FormatInt(past, 10) + ",1,0,0,gone,0,,0\n",
+			want: []string{"laptop 10.0.0.10"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "leases")
+			if err := os.WriteFile(path, []byte(tc.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			leases, err := ReadLeases(path, tc.format, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, lease := range leases {
+				got = append(got, lease.Hostname+" "+lease.IP.String())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const defaultConsulAddress = "127.0.0.1:8500"
+
+// consulCatalog looks up healthy service instances in Consul
+type consulCatalog struct {
+	base       string
+	token      string
+	datacenter string
+	client     *http.Client
+}
+
+func newConsulCatalog(cfg *config.ConsulDiscoveryConfig) *consulCatalog {
+	address := cfg.Address
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	scheme := "http"
+	if cfg.TLS {
+		scheme = "https"
+	}
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	return &consulCatalog{
+		base:       scheme + "://" + address,
+		token:      token,
+		datacenter: cfg.Datacenter,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// endpoints returns the addresses of the instances of service passing
+// their health checks
+func (c *consulCatalog) endpoints(ctx context.Context, service string) ([]string, error) {
+	query := url.Values{"passing": {"true"}}
+	if c.datacenter != "" {
+		query.Set("dc", c.datacenter)
+	}
+	target := fmt.Sprintf("%s/v1/health/service/%s?%s", c.base, url.PathEscape(service), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach consul: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string `json:"Address"`
+		} `json:"Node"`
+		Service struct {
+			Address string `json:"Address"`
+		} `json:"Service"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var addrs []string
+	for _, entry := range entries {
+		// Instances without an address of their own use their node's
+		addr := entry.Service.Address
+		if addr == "" {
+			addr = entry.Node.Address
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
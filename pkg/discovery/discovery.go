@@ -0,0 +1,99 @@
+// Package discovery looks up the current endpoints of services in the
+// Consul catalog, Kubernetes EndpointSlices and DNS SRV records, so that
+// rules can allow egress to a service instead of static addresses.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/kube"
+)
+
+const defaultInterval = 30 * time.Second
+
+// Discovery looks up service endpoints in the configured sources
+type Discovery struct {
+	interval time.Duration
+	consul   *consulCatalog
+	kube     *kube.Client
+	srv      *srvLookup
+}
+
+// New creates a discovery for cfg, which may be nil if only SRV records are
+// used. SRV records are queried from servers, or the system resolver if
+// there are none, and their targets are resolved with resolve.
+func New(cfg *config.DiscoveryConfig, servers []string, resolve func(string) ([]string, error)) (*Discovery, error) {
+	d := &Discovery{
+		interval: defaultInterval,
+		srv:      newSRVLookup(servers, resolve),
+	}
+	if cfg == nil {
+		return d, nil
+	}
+
+	if cfg.Interval > 0 {
+		d.interval = cfg.Interval.Std()
+	}
+	if cfg.Consul != nil {
+		d.consul = newConsulCatalog(cfg.Consul)
+	}
+	if cfg.Kubernetes != nil {
+		client, err := kube.Load(cfg.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Kubernetes: %w", err)
+		}
+		d.kube = client
+	}
+	return d, nil
+}
+
+// Interval returns the time between refreshes of service endpoints
+func (d *Discovery) Interval() time.Duration {
+	return d.interval
+}
+
+// Endpoints returns the addresses of a service's current endpoints, sorted
+func (d *Discovery) Endpoints(ctx context.Context, service config.ServiceRef) ([]string, error) {
+	var addrs []string
+	var err error
+	switch {
+	case service.Consul != "":
+		if d.consul == nil {
+			return nil, fmt.Errorf("consul discovery is not configured")
+		}
+		addrs, err = d.consul.endpoints(ctx, service.Consul)
+	case service.Kubernetes != "":
+		if d.kube == nil {
+			return nil, fmt.Errorf("kubernetes discovery is not configured")
+		}
+		addrs, err = kubernetesEndpoints(ctx, d.kube, service.Kubernetes)
+	default:
+		addrs, err = d.srv.endpoints(ctx, service.SRV)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", service, err)
+	}
+	return normalize(addrs), nil
+}
+
+// normalize returns the valid addresses in canonical form, sorted and
+// without duplicates
+func normalize(addrs []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		result = append(result, ip.String())
+	}
+	sort.Strings(result)
+	return result
+}
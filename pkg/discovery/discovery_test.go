@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestEndpoints tests looking up services in each source
+func TestEndpoints(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/payments" || r.URL.Query().Get("passing") != "true" || r.Header.Get("X-Consul-Token") != "acl" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `[{"Node": {"Address": "10.0.1.5"}, "Service": {"Address": ""}},
+			{"Node": {"Address": "10.0.1.6"}, "Service": {"Address": "10.0.2.6"}}]`)
+	}))
+	defer consul.Close()
+
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/shop/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=payments" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"endpoints": [{"addresses": ["10.244.1.7"], "conditions": {"ready": true}},
+			               {"addresses": ["10.244.2.8"], "conditions": {"ready": false}}]},
+			{"endpoints": [{"addresses": ["fd00::9"], "conditions": {}}]}]}`)
+	}))
+	defer apiserver.Close()
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	data := fmt.Sprintf("clusters: [{name: c, cluster: {server: %s}}]\ncontexts: [{name: c, context: {cluster: c, user: u}}]\ncurrent-context: c\nusers: [{name: u, user: {token: t}}]\n", apiserver.URL)
+	if err := os.WriteFile(kubeconfig, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(host string) ([]string, error) {
+		if host == "pay-1.example.com" {
+			return []string{"192.0.2.10", "2001:db8::10"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	d, err := New(&config.DiscoveryConfig{
+		Consul:     &config.ConsulDiscoveryConfig{Address: strings.TrimPrefix(consul.URL, "http://"), Token: "acl"},
+		Kubernetes: &config.KubernetesDiscoveryConfig{Kubeconfig: kubeconfig},
+	}, nil, resolve)
+	if err != nil {
+		t.Fatalf("Failed to create discovery: %v", err)
+	}
+	d.srv.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		if name != "_payments._tcp.example.com" {
+			return nil, fmt.Errorf("no such host")
+		}
+		return []*net.SRV{{Target: "pay-1.example.com.", Port: 443}, {Target: "pay-2.example.com.", Port: 443}}, nil
+	}
+
+	testCases := []struct {
+		name    string
+		service config.ServiceRef
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "consul",
+			service: config.ServiceRef{Consul: "payments"},
+			want:    []string{"10.0.1.5", "10.0.2.6"},
+		},
+		{
+			name:    "unknown consul service",
+			service: config.ServiceRef{Consul: "billing"},
+			wantErr: true,
+		},
+		{
+			name:    "kubernetes",
+			service: config.ServiceRef{Kubernetes: "shop/payments"},
+			want:    []string{"10.244.1.7", "fd00::9"},
+		},
+		{
+			name:    "srv",
+			service: config.ServiceRef{SRV: "_payments._tcp.example.com"},
+			want:    []string{"192.0.2.10", "2001:db8::10"},
+		},
+		{
+			name:    "unknown srv",
+			service: config.ServiceRef{SRV: "_billing._tcp.example.com"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := d.Endpoints(context.Background(), tc.service)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Endpoints() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/kube"
+)
+
+// kubernetesEndpoints returns the addresses of the ready endpoints of a
+// service, given as namespace/name, from its EndpointSlices
+func kubernetesEndpoints(ctx context.Context, client *kube.Client, service string) ([]string, error) {
+	namespace, name, _ := strings.Cut(service, "/")
+	query := url.Values{"labelSelector": {"kubernetes.io/service-name=" + name}}
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", url.PathEscape(namespace), query.Encode())
+
+	var slices struct {
+		Items []struct {
+			Endpoints []struct {
+				Addresses  []string `json:"addresses"`
+				Conditions struct {
+					Ready *bool `json:"ready"`
+				} `json:"conditions"`
+			} `json:"endpoints"`
+		} `json:"items"`
+	}
+	if err := client.Get(ctx, path, &slices); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			// An unknown condition is interpreted as ready
+			if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+				continue
+			}
+			addrs = append(addrs, endpoint.Addresses...)
+		}
+	}
+	return addrs, nil
+}
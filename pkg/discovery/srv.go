@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// srvLookup resolves DNS SRV records to the addresses of their targets
+type srvLookup struct {
+	lookupSRV func(ctx context.Context, name string) ([]*net.SRV, error)
+	resolve   func(host string) ([]string, error)
+}
+
+func newSRVLookup(servers []string, resolve func(string) ([]string, error)) *srvLookup {
+	resolver := net.DefaultResolver
+	if len(servers) > 0 {
+		// Query the configured upstreams in order, like domain rules
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				var lastErr error
+				for _, server := range servers {
+					if _, _, err := net.SplitHostPort(server); err != nil {
+						server = net.JoinHostPort(server, "53")
+					}
+					conn, err := d.DialContext(ctx, network, server)
+					if err == nil {
+						return conn, nil
+					}
+					lastErr = err
+				}
+				return nil, lastErr
+			},
+		}
+	}
+	return &srvLookup{
+		lookupSRV: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, records, err := resolver.LookupSRV(ctx, "", "", name)
+			return records, err
+		},
+		resolve: resolve,
+	}
+}
+
+// endpoints returns the addresses of the targets of the SRV records of name
+func (s *srvLookup) endpoints(ctx context.Context, name string) ([]string, error) {
+	records, err := s.lookupSRV(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		// "." means the service is decidedly not available
+		if target == "" {
+			continue
+		}
+		targetAddrs, err := s.resolve(target)
+		if err != nil {
+			log.Printf("Warning: failed to resolve target %s of %s: %v", target, name, err)
+			continue
+		}
+		addrs = append(addrs, targetAddrs...)
+	}
+	if len(addrs) == 0 && len(records) > 0 {
+		return nil, fmt.Errorf("no target of %s resolved", name)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,90 @@
+// Package dnstest provides a fake dns.Resolver for tests
+package dnstest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/skaegi/legion-router/pkg/dns"
+)
+
+// FakeResolver resolves domains from a static table without network access
+type FakeResolver struct {
+	mu       sync.Mutex
+	answers  map[string][]string
+	settings dns.Settings
+	lookups  map[string]int
+	callback func(string, []string)
+}
+
+// NewFakeResolver creates a fake resolver with no known domains
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		answers: make(map[string][]string),
+		lookups: make(map[string]int),
+	}
+}
+
+// Set sets the addresses returned for a domain
+func (f *FakeResolver) Set(domain string, ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers[domain] = ips
+}
+
+// Resolve returns the configured addresses of a domain, or an error if the
+// domain is unknown
+func (f *FakeResolver) Resolve(domain string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups[domain]++
+	ips, ok := f.answers[domain]
+	if !ok {
+		return nil, fmt.Errorf("no IPs found for domain %s", domain)
+	}
+	return append([]string(nil), ips...), nil
+}
+
+// Configure records the settings
+func (f *FakeResolver) Configure(settings dns.Settings) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.settings = settings
+}
+
+// Settings returns the last applied settings
+func (f *FakeResolver) Settings() dns.Settings {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.settings
+}
+
+// Lookups returns how often a domain was resolved
+func (f *FakeResolver) Lookups(domain string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups[domain]
+}
+
+// StartPeriodicRefresh records the callback and blocks until stopChan is
+// closed. Use Refresh to trigger the callback.
+func (f *FakeResolver) StartPeriodicRefresh(stopChan <-chan struct{}, callback func(string, []string)) {
+	f.mu.Lock()
+	f.callback = callback
+	f.mu.Unlock()
+	<-stopChan
+}
+
+// Refresh invokes the refresh callback for a domain with its current
+// addresses, as a periodic refresh would
+func (f *FakeResolver) Refresh(domain string) {
+	f.mu.Lock()
+	callback := f.callback
+	ips := append([]string(nil), f.answers[domain]...)
+	f.mu.Unlock()
+	if callback != nil {
+		callback(domain, ips)
+	}
+}
+
+var _ dns.Resolver = (*FakeResolver)(nil)
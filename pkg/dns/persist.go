@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/internal/fileutil"
+)
+
+const cacheFileVersion = 1
+
+// Persister is implemented by resolvers whose cache can be saved across
+// restarts
+type Persister interface {
+	SaveCache(path string) error
+	LoadCache(path string) (int, error)
+}
+
+// cacheFile is the on-disk format of the resolver cache
+type cacheFile struct {
+	Version int                        `json:"version"`
+	SavedAt time.Time                  `json:"saved_at"`
+	Entries map[string]persistedRecord `json:"entries"`
+}
+
+type persistedRecord struct {
+	IPv4      []string             `json:"ipv4,omitempty"`
+	IPv6      []string             `json:"ipv6,omitempty"`
+	Servers   []string             `json:"servers"`
+	Chain     []string             `json:"chain,omitempty"`
+	Seen      map[string]time.Time `json:"seen,omitempty"`
+	ExpiresAt time.Time            `json:"expires_at"`
+}
+
+// SaveCache writes the cache to path
+// The file is replaced atomically so a crash never leaves a partial cache
+func (r *CachingResolver) SaveCache(path string) error {
+	r.cacheMu.RLock()
+	file := cacheFile{
+		Version: cacheFileVersion,
+		SavedAt: r.clock.Now(),
+		Entries: make(map[string]persistedRecord, len(r.cache)),
+	}
+	for domain, entry := range r.cache {
+		file.Entries[domain] = persistedRecord{
+			IPv4:      entry.ipv4,
+			IPv6:      entry.ipv6,
+			Servers:   entry.servers,
+			Chain:     entry.chain,
+			Seen:      entry.seen,
+			ExpiresAt: entry.expiresAt,
+		}
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	r.cacheMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode DNS cache: %w", err)
+	}
+
+	if err := fileutil.WriteAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	return nil
+}
+
+// LoadCache loads unexpired entries from a cache written by SaveCache and
+// returns how many were loaded. Entries already in memory are kept, and
+// loaded entries are the first evicted until they are used.
+func (r *CachingResolver) LoadCache(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("failed to parse DNS cache: %w", err)
+	}
+	if file.Version != cacheFileVersion {
+		return 0, fmt.Errorf("unsupported DNS cache version %d", file.Version)
+	}
+
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+
+	now := r.clock.Now()
+	loaded := 0
+	for domain, record := range file.Entries {
+		if !now.Before(record.ExpiresAt) {
+			continue
+		}
+		if _, ok := r.cache[domain]; ok {
+			continue
+		}
+		r.cache[domain] = &cacheEntry{
+			ipv4:      record.IPv4,
+			ipv6:      record.IPv6,
+			servers:   record.Servers,
+			chain:     record.Chain,
+			seen:      record.Seen,
+			expiresAt: record.ExpiresAt,
+		}
+		loaded++
+	}
+	r.evictLocked()
+
+	return loaded, nil
+}
+
+var _ Persister = (*CachingResolver)(nil)
+
+// ReadCacheFile returns the addresses of every entry in a cache file written
+// by SaveCache, including expired ones. It is meant as a last resort when
+// upstream resolution fails.
+func ReadCacheFile(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS cache: %w", err)
+	}
+	if file.Version != cacheFileVersion {
+		return nil, fmt.Errorf("unsupported DNS cache version %d", file.Version)
+	}
+
+	result := make(map[string][]string, len(file.Entries))
+	for domain, record := range file.Entries {
+		result[domain] = append(append([]string(nil), record.IPv4...), record.IPv6...)
+	}
+	return result, nil
+}
@@ -0,0 +1,285 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy selects the order the upstreams of a domain are tried in
+type Strategy string
+
+const (
+	// StrategyOrdered tries upstreams in the configured order
+	StrategyOrdered Strategy = "ordered"
+	// StrategyRoundRobin starts each query at the next upstream
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyFastest tries upstreams by their average response time
+	StrategyFastest Strategy = "fastest"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultProbeInterval    = 30 * time.Second
+	defaultProbeDomain      = "."
+)
+
+// UpstreamStatus is the health of an upstream resolver
+type UpstreamStatus struct {
+	Server  string `json:"server"`
+	Healthy bool   `json:"healthy"`
+	// ConsecutiveFailures counts the failures since the last answer
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	// RTTMillis is the moving average of the response time
+	RTTMillis float64 `json:"rtt_ms,omitempty"`
+	// Queries and Failures count lookups, forwarded queries and probes
+	Queries   uint64     `json:"queries"`
+	Failures  uint64     `json:"failures"`
+	LastError string     `json:"last_error,omitempty"`
+	DemotedAt *time.Time `json:"demoted_at,omitempty"`
+}
+
+// upstream is the health of an upstream resolver
+type upstream struct {
+	failures  int // Consecutive
+	demotedAt time.Time
+	rtt       time.Duration
+	queries   uint64
+	failed    uint64
+	lastError string
+}
+
+func (u *upstream) demoted() bool {
+	return !u.demotedAt.IsZero()
+}
+
+// pool orders the upstreams of a query by health and strategy, and demotes
+// upstreams failing failure threshold times in a row until they answer again
+type pool struct {
+	mu        sync.Mutex
+	clock     Clock
+	strategy  Strategy
+	threshold int
+	upstreams map[string]*upstream
+	next      int // Round robin position
+}
+
+func newPool(clock Clock) *pool {
+	return &pool{
+		clock:     clock,
+		strategy:  StrategyOrdered,
+		threshold: defaultFailureThreshold,
+		upstreams: make(map[string]*upstream),
+	}
+}
+
+// configure sets the strategy and threshold, and forgets the upstreams no
+// longer configured
+func (p *pool) configure(strategy Strategy, threshold int, servers []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if strategy == "" {
+		strategy = StrategyOrdered
+	}
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+	p.strategy, p.threshold = strategy, threshold
+	for server := range p.upstreams {
+		if !containsString(servers, server) {
+			delete(p.upstreams, server)
+		}
+	}
+}
+
+// order returns servers in the order a query tries them: the healthy ones
+// by strategy, then the demoted ones in case all of them fail
+func (p *pool) order(servers []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var healthy, demoted []string
+	for _, server := range servers {
+		if u, ok := p.upstreams[server]; ok && u.demoted() {
+			demoted = append(demoted, server)
+		} else {
+			healthy = append(healthy, server)
+		}
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(healthy) > 1 {
+			start := p.next % len(healthy)
+			p.next++
+			healthy = append(append([]string(nil), healthy[start:]...), healthy[:start]...)
+		}
+	case StrategyFastest:
+		// Upstreams not yet measured go first, so that they get measured
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return p.rttLocked(healthy[i]) < p.rttLocked(healthy[j])
+		})
+	}
+	return append(healthy, demoted...)
+}
+
+// rttLocked returns the average response time of server, 0 if unknown
+// Must be called with mu held
+func (p *pool) rttLocked(server string) time.Duration {
+	if u, ok := p.upstreams[server]; ok {
+		return u.rtt
+	}
+	return 0
+}
+
+// record records the outcome of a query to server, demoting it on too many
+// failures in a row and promoting it again on an answer
+func (p *pool) record(server string, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.upstreams[server]
+	if !ok {
+		u = &upstream{}
+		p.upstreams[server] = u
+	}
+	u.queries++
+	if err != nil {
+		u.failed++
+		u.failures++
+		u.lastError = err.Error()
+		if !u.demoted() && u.failures >= p.threshold {
+			u.demotedAt = p.clock.Now()
+			log.Printf("Warning: demoted DNS upstream %s after %d failures in a row: %v", server, u.failures, err)
+		}
+		return
+	}
+
+	u.failures = 0
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (7*u.rtt + rtt) / 8
+	}
+	if u.demoted() {
+		u.demotedAt = time.Time{}
+		log.Printf("DNS upstream %s answers again, promoted", server)
+	}
+}
+
+// status returns the health of servers
+func (p *pool) status(servers []string) []UpstreamStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make([]UpstreamStatus, 0, len(servers))
+	for _, server := range servers {
+		status := UpstreamStatus{Server: server, Healthy: true}
+		if u, ok := p.upstreams[server]; ok {
+			status.Healthy = !u.demoted()
+			status.ConsecutiveFailures = u.failures
+			status.RTTMillis = float64(u.rtt.Microseconds()) / 1000
+			status.Queries, status.Failures = u.queries, u.failed
+			status.LastError = u.lastError
+			if u.demoted() {
+				demotedAt := u.demotedAt
+				status.DemotedAt = &demotedAt
+			}
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// exchange sends msg to server and records the outcome; an upstream
+// failing or refusing the query is a failure, its response still returned
+func (r *CachingResolver) exchange(msg *dns.Msg, server string) (*dns.Msg, error) {
+	resp, rtt, err := r.client.Exchange(msg, server)
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+	}
+	r.pool.record(server, rtt, err)
+	return resp, err
+}
+
+// upstreamServers returns every configured upstream, sorted
+func (r *CachingResolver) upstreamServers() []string {
+	r.routesMu.RLock()
+	defer r.routesMu.RUnlock()
+
+	var servers []string
+	add := func(list []string) {
+		for _, server := range list {
+			if !containsString(servers, server) {
+				servers = append(servers, server)
+			}
+		}
+	}
+	add(r.servers)
+	for _, list := range r.suffixes {
+		add(list)
+	}
+	for _, list := range r.domains {
+		add(list)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// Upstreams returns the health of every configured upstream
+func (r *CachingResolver) Upstreams() []UpstreamStatus {
+	return r.pool.status(r.upstreamServers())
+}
+
+// StartHealthChecks probes every upstream until stopChan is closed, so that
+// demoted upstreams are promoted once they answer again and response times
+// stay current. Changes to the probe interval apply from the next probe.
+func (r *CachingResolver) StartHealthChecks(stopChan <-chan struct{}) {
+	for {
+		r.cacheMu.RLock()
+		interval := r.probeInterval
+		r.cacheMu.RUnlock()
+		if interval <= 0 {
+			interval = defaultProbeInterval
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			r.probe()
+		case <-stopChan:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// probe queries every upstream for the NS records of the probe domain in
+// parallel
+func (r *CachingResolver) probe() {
+	r.cacheMu.RLock()
+	domain := r.probeDomain
+	r.cacheMu.RUnlock()
+	if domain == "" {
+		domain = defaultProbeDomain
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range r.upstreamServers() {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(domain), dns.TypeNS)
+			if _, err := r.exchange(msg, server); err != nil {
+				log.Printf("DNS probe to %s failed: %v", server, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
@@ -1,52 +1,322 @@
 package dns
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 const (
-	refreshInterval = 5 * time.Minute
-	dnsCacheTTL     = 5 * time.Minute
+	defaultRefreshInterval = 5 * time.Minute
+	defaultCacheTTL        = 5 * time.Minute
+	defaultCacheMaxEntries = 10000
+	maxCNAMEDepth          = 8 // Maximum CNAME chain length followed
+
+	defaultRefreshConcurrency = 8
 )
 
-// Resolver handles DNS resolution and caching
-type Resolver struct {
-	cache    map[string]*cacheEntry
-	cacheMu  sync.RWMutex
-	client   *dns.Client
+var defaultServers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+// Resolver resolves the domains of filtering rules and keeps them fresh
+type Resolver interface {
+	// Resolve returns the IPv4 then IPv6 addresses of a domain
+	Resolve(domain string) ([]string, error)
+	// Configure applies upstream routing and caching settings
+	Configure(settings Settings)
+	// StartPeriodicRefresh re-resolves known domains until stopChan is
+	// closed, invoking callback with the fresh addresses of each domain
+	StartPeriodicRefresh(stopChan <-chan struct{}, callback func(string, []string))
+}
+
+// Settings configures upstream selection and caching behaviour
+type Settings struct {
+	// Servers are the default upstreams; public resolvers if empty
+	Servers []string
+	// Suffixes routes domains under a suffix to dedicated upstreams
+	Suffixes map[string][]string
+	// Domains routes single domains to dedicated upstreams
+	Domains map[string][]string
+	// WatchCNAMETargets refreshes intermediate CNAME targets on their own
+	WatchCNAMETargets bool
+	// AggregationRounds queries every upstream this many times per lookup
+	AggregationRounds int
+	// AggregationIPTTL keeps addresses until this long after last seen
+	AggregationIPTTL time.Duration
+	// RefreshConcurrency bounds parallel lookups per refresh cycle
+	RefreshConcurrency int
+	// RefreshJitter delays each lookup by a random duration up to this
+	RefreshJitter time.Duration
+	// RefreshDeadline bounds a refresh cycle; 0 means no deadline
+	RefreshDeadline time.Duration
+	// RefreshInterval is how often domains are re-resolved; 5m if 0
+	RefreshInterval time.Duration
+	// CacheTTL is how long answers are reused; 5m if 0
+	CacheTTL time.Duration
+	// CacheMaxEntries bounds the cache, evicting the least recently used
+	// domains beyond it; 10000 if 0
+	CacheMaxEntries int
+	// DomainRefreshIntervals re-resolve single domains at their own
+	// interval, and cache them no longer
+	DomainRefreshIntervals map[string]time.Duration
+	// ClientSubnet is a CIDR sent as EDNS Client Subnet so geo-aware
+	// upstreams answer as they would for downstream clients
+	ClientSubnet string
+	// Strategy orders the healthy upstreams of a query; ordered if empty
+	Strategy Strategy
+	// FailureThreshold is the failures in a row demoting an upstream; 3
+	// if 0
+	FailureThreshold int
+	// ProbeInterval is how often upstreams are probed; 30s if 0
+	ProbeInterval time.Duration
+	// ProbeDomain is the name probes query NS records of; the root if
+	// empty
+	ProbeDomain string
+}
+
+// Clock provides the current time, so that expiry can be tested
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Exchanger sends a DNS query to an upstream server
+// *dns.Client satisfies this interface
+type Exchanger interface {
+	Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error)
+}
+
+// Option customizes a CachingResolver
+type Option func(*CachingResolver)
+
+// WithClock replaces the clock used for cache expiry
+func WithClock(clock Clock) Option {
+	return func(r *CachingResolver) {
+		r.clock = clock
+	}
+}
+
+// WithExchanger replaces the client used to query upstream servers
+func WithExchanger(client Exchanger) Option {
+	return func(r *CachingResolver) {
+		r.client = client
+	}
+}
+
+// WithSystemLookup replaces the system resolver fallback
+// A nil function disables the fallback
+func WithSystemLookup(lookup func(host string) ([]string, error)) Option {
+	return func(r *CachingResolver) {
+		r.systemLookup = lookup
+	}
+}
+
+// CachingResolver handles DNS resolution and caching
+type CachingResolver struct {
+	cache        map[string]*cacheEntry
+	cacheMu      sync.RWMutex
+	client       Exchanger
+	clock        Clock
+	systemLookup func(host string) ([]string, error)
+
+	// Upstream selection: exact domain routes win over the longest
+	// matching suffix route, which wins over the default servers
+	routesMu sync.RWMutex
 	servers  []string
+	suffixes map[string][]string
+	domains  map[string][]string
+
+	// EDNS Client Subnet sent with every query, nil when disabled
+	clientSubnet *net.IPNet
+
+	// Upstream health, ordering the upstreams of each query, and probes
+	pool          *pool
+	probeInterval time.Duration
+	probeDomain   string
+
+	// CNAME target watching: target -> domains aliasing it
+	watchTargets bool
+	aliases      map[string][]string
+
+	// Multi-answer aggregation: every upstream is queried rounds times and
+	// addresses stay in the answer until ipTTL after they were last seen
+	rounds int
+	ipTTL  time.Duration
+
+	// Periodic refresh: bounded parallelism, per-domain random delay and
+	// an overall deadline after which remaining domains wait for next cycle
+	concurrency int
+	jitter      time.Duration
+	deadline    time.Duration
+
+	// Refresh interval and cache TTL, and their overrides by domain
+	interval  time.Duration
+	cacheTTL  time.Duration
+	intervals map[string]time.Duration
+
+	// Cache bound, beyond which the least recently used domains are evicted
+	maxEntries int
+
+	// Lookups that failed, on resolving or refreshing, and domains evicted
+	failures  atomic.Uint64
+	evictions atomic.Uint64
 }
 
 type cacheEntry struct {
-	ips       []string
+	ipv4      []string
+	ipv6      []string
+	servers   []string             // Upstreams the entry was resolved against
+	chain     []string             // CNAME targets followed, in order
+	seen      map[string]time.Time // Aggregation mode: address -> last seen
+	resolved  time.Time            // Last lookup, to tell when a refresh is due
 	expiresAt time.Time
+	used      atomic.Int64 // Last resolved or answered, in Unix nanoseconds
 }
 
-// NewResolver creates a new DNS resolver
-func NewResolver() (*Resolver, error) {
-	return &Resolver{
+// NewResolver creates a new DNS resolver using the given upstream servers
+// If no servers are given, public resolvers are used
+func NewResolver(servers []string, opts ...Option) (*CachingResolver, error) {
+	if len(servers) == 0 {
+		servers = defaultServers
+	}
+
+	r := &CachingResolver{
 		cache: make(map[string]*cacheEntry),
 		client: &dns.Client{
 			Timeout: 5 * time.Second,
 		},
-		servers: []string{"8.8.8.8:53", "1.1.1.1:53"},
-	}, nil
+		clock:        systemClock{},
+		systemLookup: net.LookupHost,
+		servers:      normalizeServers(servers),
+		suffixes:     make(map[string][]string),
+		domains:      make(map[string][]string),
+		aliases:      make(map[string][]string),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.pool = newPool(r.clock)
+
+	return r, nil
+}
+
+// Configure applies upstream routing and caching settings
+// Cached entries resolved against a different upstream are re-resolved on
+// next use
+func (r *CachingResolver) Configure(settings Settings) {
+	servers := settings.Servers
+	if len(servers) == 0 {
+		servers = defaultServers
+	}
+
+	r.routesMu.Lock()
+	r.servers = normalizeServers(servers)
+	r.suffixes = make(map[string][]string)
+	for suffix, upstreams := range settings.Suffixes {
+		r.suffixes[strings.ToLower(strings.Trim(suffix, "."))] = normalizeServers(upstreams)
+	}
+	r.domains = make(map[string][]string)
+	for domain, upstreams := range settings.Domains {
+		r.domains[strings.ToLower(domain)] = normalizeServers(upstreams)
+	}
+	r.clientSubnet = nil
+	if settings.ClientSubnet != "" {
+		_, subnet, err := net.ParseCIDR(settings.ClientSubnet)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid client subnet %q: %v", settings.ClientSubnet, err)
+		} else {
+			r.clientSubnet = subnet
+		}
+	}
+	r.routesMu.Unlock()
+	r.pool.configure(settings.Strategy, settings.FailureThreshold, r.upstreamServers())
+
+	r.cacheMu.Lock()
+	r.probeInterval = settings.ProbeInterval
+	r.probeDomain = settings.ProbeDomain
+	r.watchTargets = settings.WatchCNAMETargets
+	if !r.watchTargets {
+		for target := range r.aliases {
+			delete(r.cache, target)
+		}
+		r.aliases = make(map[string][]string)
+	}
+	r.rounds = settings.AggregationRounds
+	r.ipTTL = settings.AggregationIPTTL
+	r.concurrency = settings.RefreshConcurrency
+	r.jitter = settings.RefreshJitter
+	r.deadline = settings.RefreshDeadline
+	r.interval = settings.RefreshInterval
+	r.cacheTTL = settings.CacheTTL
+	r.maxEntries = settings.CacheMaxEntries
+	r.evictLocked()
+	r.intervals = make(map[string]time.Duration)
+	for domain, interval := range settings.DomainRefreshIntervals {
+		r.intervals[strings.ToLower(domain)] = interval
+	}
+	r.cacheMu.Unlock()
+}
+
+// serversFor returns the upstream servers responsible for a domain
+func (r *CachingResolver) serversFor(domain string) []string {
+	r.routesMu.RLock()
+	defer r.routesMu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(domain, "."))
+	if servers, ok := r.domains[name]; ok {
+		return servers
+	}
+
+	// Walk up the labels so the longest suffix wins
+	for label := name; label != ""; {
+		if servers, ok := r.suffixes[label]; ok {
+			return servers
+		}
+		idx := strings.Index(label, ".")
+		if idx < 0 {
+			break
+		}
+		label = label[idx+1:]
+	}
+
+	return r.servers
+}
+
+// defaultServers returns the current default upstream servers
+func (r *CachingResolver) defaultServers() []string {
+	r.routesMu.RLock()
+	defer r.routesMu.RUnlock()
+	return r.servers
+}
+
+// aggregating reports whether multi-answer aggregation is enabled
+func (r *CachingResolver) aggregating() bool {
+	r.cacheMu.RLock()
+	defer r.cacheMu.RUnlock()
+	return r.rounds > 1 || r.ipTTL > 0
 }
 
 // Resolve resolves a domain name to IP addresses
-func (r *Resolver) Resolve(domain string) ([]string, error) {
+// IPv4 addresses are returned first, followed by IPv6 addresses
+func (r *CachingResolver) Resolve(domain string) ([]string, error) {
+	servers := r.serversFor(domain)
+
 	// Check cache first
 	r.cacheMu.RLock()
-	if entry, ok := r.cache[domain]; ok && time.Now().Before(entry.expiresAt) {
-		ips := make([]string, len(entry.ips))
-		copy(ips, entry.ips)
+	if entry, ok := r.cache[domain]; ok && r.clock.Now().Before(entry.expiresAt) && sameServers(entry.servers, servers) {
+		entry.touch(r.clock.Now())
+		ips := entry.addresses()
 		r.cacheMu.RUnlock()
 		return ips, nil
 	}
@@ -61,106 +331,748 @@ func (r *Resolver) Resolve(domain string) ([]string, error) {
 	}
 
 	// Perform DNS lookup
-	ips, err := r.lookup(domain)
+	result, err := r.lookup(domain, servers)
 	if err != nil {
+		r.failures.Add(1)
 		return nil, err
 	}
 
 	// Update cache
 	r.cacheMu.Lock()
-	r.cache[domain] = &cacheEntry{
-		ips:       ips,
-		expiresAt: time.Now().Add(dnsCacheTTL),
-	}
+	entry := r.storeLocked(domain, result, servers)
+	entry.touch(r.clock.Now())
+	r.watchChainLocked(domain, entry)
+	ips := entry.addresses()
+	r.evictLocked()
 	r.cacheMu.Unlock()
 
 	return ips, nil
 }
 
-// lookup performs the actual DNS query
-func (r *Resolver) lookup(domain string) ([]string, error) {
+// Failures returns the number of lookups that failed since the resolver was
+// created
+func (r *CachingResolver) Failures() uint64 {
+	return r.failures.Load()
+}
+
+// Evictions returns the number of domains evicted from the cache since the
+// resolver was created
+func (r *CachingResolver) Evictions() uint64 {
+	return r.evictions.Load()
+}
+
+// touch marks the entry used at now
+func (e *cacheEntry) touch(now time.Time) {
+	e.used.Store(now.UnixNano())
+}
+
+// addresses returns a copy of the entry's IPv4 then IPv6 addresses
+func (e *cacheEntry) addresses() []string {
+	ips := make([]string, 0, len(e.ipv4)+len(e.ipv6))
+	ips = append(ips, e.ipv4...)
+	return append(ips, e.ipv6...)
+}
+
+// storeLocked caches a lookup result and returns the new entry
+// In aggregation mode, previously seen addresses that have not expired are
+// kept alongside the new answer. A refresh doesn't count as a use.
+// Must be called with cacheMu held
+func (r *CachingResolver) storeLocked(domain string, result *lookupResult, servers []string) *cacheEntry {
+	now := r.clock.Now()
+	entry := &cacheEntry{
+		ipv4:      result.ipv4,
+		ipv6:      result.ipv6,
+		servers:   servers,
+		chain:     result.chain,
+		resolved:  now,
+		expiresAt: now.Add(r.cacheTTLLocked(domain)),
+	}
+	if prev, ok := r.cache[domain]; ok {
+		entry.used.Store(prev.used.Load())
+	}
+
+	if r.ipTTL > 0 {
+		entry.seen = make(map[string]time.Time)
+		if prev, ok := r.cache[domain]; ok && sameServers(prev.servers, servers) {
+			for ip, lastSeen := range prev.seen {
+				if now.Sub(lastSeen) < r.ipTTL {
+					entry.seen[ip] = lastSeen
+				}
+			}
+		}
+		for _, ip := range append(append([]string(nil), result.ipv4...), result.ipv6...) {
+			entry.seen[ip] = now
+		}
+		entry.aggregate()
+	}
+
+	r.cache[domain] = entry
+	return entry
+}
+
+// watchChainLocked registers the CNAME targets of domain on the watch list
+// Must be called with cacheMu held
+func (r *CachingResolver) watchChainLocked(domain string, entry *cacheEntry) {
+	if !r.watchTargets {
+		return
+	}
+
+	for _, target := range entry.chain {
+		if !containsString(r.aliases[target], domain) {
+			r.aliases[target] = append(r.aliases[target], domain)
+		}
+		if _, ok := r.cache[target]; !ok {
+			targetEntry := &cacheEntry{
+				ipv4:      entry.ipv4,
+				ipv6:      entry.ipv6,
+				servers:   entry.servers,
+				resolved:  entry.resolved,
+				expiresAt: entry.expiresAt,
+			}
+			targetEntry.used.Store(entry.used.Load())
+			r.cache[target] = targetEntry
+		}
+	}
+}
+
+// evictLocked evicts the least recently used domains beyond the cache bound
+// Evicted domains are no longer refreshed until they are resolved again
+// Must be called with cacheMu held
+func (r *CachingResolver) evictLocked() {
+	max := r.maxEntries
+	if max <= 0 {
+		max = defaultCacheMaxEntries
+	}
+	excess := len(r.cache) - max
+	if excess <= 0 {
+		return
+	}
+
+	domains := make([]string, 0, len(r.cache))
+	for domain := range r.cache {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		ui, uj := r.cache[domains[i]].used.Load(), r.cache[domains[j]].used.Load()
+		if ui != uj {
+			return ui < uj
+		}
+		return domains[i] < domains[j]
+	})
+	for _, domain := range domains[:excess] {
+		r.removeLocked(domain)
+	}
+	r.evictions.Add(uint64(excess))
+	log.Printf("Evicted %d least recently used domains from the DNS cache", excess)
+}
+
+// removeLocked removes a domain from the cache and the CNAME target watch
+// list
+// Must be called with cacheMu held
+func (r *CachingResolver) removeLocked(domain string) {
+	delete(r.cache, domain)
+	delete(r.aliases, domain)
+	for target, origins := range r.aliases {
+		kept := origins[:0]
+		for _, origin := range origins {
+			if origin != domain {
+				kept = append(kept, origin)
+			}
+		}
+		if len(kept) == 0 {
+			delete(r.aliases, target)
+		} else {
+			r.aliases[target] = kept
+		}
+	}
+}
+
+// CacheEntry describes a cached domain
+type CacheEntry struct {
+	Domain   string    `json:"domain"`
+	IPv4     []string  `json:"ipv4,omitempty"`
+	IPv6     []string  `json:"ipv6,omitempty"`
+	Servers  []string  `json:"servers"`
+	Chain    []string  `json:"chain,omitempty"`
+	Resolved time.Time `json:"resolved"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// CacheEntries returns the cached domains, sorted by name
+func (r *CachingResolver) CacheEntries() []CacheEntry {
+	r.cacheMu.RLock()
+	defer r.cacheMu.RUnlock()
+
+	entries := make([]CacheEntry, 0, len(r.cache))
+	for domain, entry := range r.cache {
+		e := CacheEntry{
+			Domain:   domain,
+			IPv4:     append([]string(nil), entry.ipv4...),
+			IPv6:     append([]string(nil), entry.ipv6...),
+			Servers:  append([]string(nil), entry.servers...),
+			Chain:    append([]string(nil), entry.chain...),
+			Resolved: entry.resolved,
+			Expires:  entry.expiresAt,
+		}
+		if used := entry.used.Load(); used != 0 {
+			e.LastUsed = time.Unix(0, used)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Domain < entries[j].Domain })
+	return entries
+}
+
+// CacheSize returns the number of domains cached
+func (r *CachingResolver) CacheSize() int {
+	r.cacheMu.RLock()
+	defer r.cacheMu.RUnlock()
+	return len(r.cache)
+}
+
+// CacheLimit returns the number of domains the cache is bounded to
+func (r *CachingResolver) CacheLimit() int {
+	r.cacheMu.RLock()
+	defer r.cacheMu.RUnlock()
+	if r.maxEntries > 0 {
+		return r.maxEntries
+	}
+	return defaultCacheMaxEntries
+}
+
+// lookupResult holds the flattened answer of an A and AAAA lookup
+type lookupResult struct {
+	ipv4  []string
+	ipv6  []string
+	chain []string // CNAME targets followed, in order
+}
+
+// lookup performs the actual DNS queries against the given upstream servers
+// A and AAAA records are queried in parallel. CNAME chains are flattened: the
+// addresses of the final target are returned along with the intermediate
+// target names
+func (r *CachingResolver) lookup(domain string, servers []string) (*lookupResult, error) {
+	type familyResult struct {
+		ips   []string
+		chain []string
+		err   error
+	}
+
+	var v4, v6 familyResult
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		v4.ips, v4.chain, v4.err = r.lookupType(domain, servers, dns.TypeA)
+	}()
+	go func() {
+		defer wg.Done()
+		v6.ips, v6.chain, v6.err = r.lookupType(domain, servers, dns.TypeAAAA)
+	}()
+	wg.Wait()
+
+	// A CNAME loop is a broken zone, not a missing record type
+	if v4.err != nil && v6.err != nil {
+		return nil, v4.err
+	}
+
+	result := &lookupResult{ipv4: v4.ips, ipv6: v6.ips, chain: v4.chain}
+	if len(result.chain) == 0 {
+		result.chain = v6.chain
+	}
+
+	// Fallback to system resolver, but only for domains using the default
+	// servers - routed domains (e.g., internal zones) must not leak to it
+	if len(result.ipv4) == 0 && len(result.ipv6) == 0 && r.systemLookup != nil && sameServers(servers, r.defaultServers()) {
+		addrs, err := r.systemLookup(domain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", domain, err)
+		}
+		for _, addr := range addrs {
+			if isIPv6(addr) {
+				result.ipv6 = append(result.ipv6, addr)
+			} else {
+				result.ipv4 = append(result.ipv4, addr)
+			}
+		}
+	}
+
+	if len(result.ipv4) == 0 && len(result.ipv6) == 0 {
+		return nil, fmt.Errorf("no IPs found for domain %s", domain)
+	}
+
+	return result, nil
+}
+
+// lookupType resolves a single record type (A or AAAA), following CNAMEs
+// across queries when the upstream does not chase them itself
+func (r *CachingResolver) lookupType(domain string, servers []string, qtype uint16) ([]string, []string, error) {
 	var allIPs []string
+	var chain []string
+
+	query := r.query
+	if r.aggregating() {
+		query = r.queryAll
+	}
+
+	name := dns.Fqdn(domain)
+	for depth := 0; depth < maxCNAMEDepth && len(allIPs) == 0; depth++ {
+		ips, targets, err := query(name, servers, qtype)
+		if err != nil {
+			break
+		}
+		allIPs = ips
 
-	// Try A records (IPv4)
+		for _, target := range targets {
+			if containsString(chain, target) {
+				return nil, nil, fmt.Errorf("CNAME loop detected resolving %s at %s", domain, target)
+			}
+			chain = append(chain, target)
+		}
+
+		// Upstreams that don't chase CNAMEs only return the alias, so
+		// continue the chain from its last target ourselves
+		if len(allIPs) == 0 {
+			if len(targets) == 0 {
+				break
+			}
+			name = dns.Fqdn(targets[len(targets)-1])
+		}
+	}
+
+	return allIPs, chain, nil
+}
+
+// query queries the upstream servers for records of name, in the order of
+// the pool
+// Returns the addresses at the end of the CNAME chain found in the answer and
+// the chain's target names in order
+func (r *CachingResolver) query(name string, servers []string, qtype uint16) ([]string, []string, error) {
 	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	msg.SetQuestion(name, qtype)
+	r.routesMu.RLock()
+	subnet := r.clientSubnet
+	r.routesMu.RUnlock()
+	if subnet != nil {
+		addClientSubnet(msg, subnet)
+	}
 
-	for _, server := range r.servers {
-		resp, _, err := r.client.Exchange(msg, server)
+	var lastErr error
+	for _, server := range r.pool.order(servers) {
+		resp, err := r.exchange(msg, server)
 		if err != nil {
 			log.Printf("DNS query to %s failed: %v", server, err)
+			lastErr = err
 			continue
 		}
 
-		for _, answer := range resp.Answer {
-			if a, ok := answer.(*dns.A); ok {
-				allIPs = append(allIPs, a.A.String())
+		ips, targets := flattenAnswer(name, resp.Answer)
+		if len(ips) > 0 || len(targets) > 0 {
+			return ips, targets, nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no answer for %s", name)
+	}
+	return nil, nil, lastErr
+}
+
+// Exchange forwards a client's query to the upstream servers responsible
+// for its name, in the order of the pool, and returns the first response
+// that is not a failure; the last failure if every upstream fails
+func (r *CachingResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		return nil, fmt.Errorf("query has no question")
+	}
+	var lastResp *dns.Msg
+	var lastErr error
+	for _, server := range r.pool.order(r.serversFor(msg.Question[0].Name)) {
+		resp, err := r.exchange(msg, server)
+		if err != nil {
+			log.Printf("DNS query to %s failed: %v", server, err)
+			lastErr = err
+			if resp != nil {
+				lastResp = resp
 			}
+			continue
 		}
+		return resp, nil
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream for %s", msg.Question[0].Name)
+	}
+	return nil, lastErr
+}
 
-		if len(allIPs) > 0 {
-			break // Success
+// queryAll queries every upstream server for records of name, repeated for
+// the configured number of rounds, and returns the union of the answers
+func (r *CachingResolver) queryAll(name string, servers []string, qtype uint16) ([]string, []string, error) {
+	r.cacheMu.RLock()
+	rounds := r.rounds
+	r.cacheMu.RUnlock()
+	if rounds < 1 {
+		rounds = 1
+	}
+
+	var allIPs []string
+	var chain []string
+	var lastErr error
+	for round := 0; round < rounds; round++ {
+		for _, server := range servers {
+			ips, targets, err := r.query(name, []string{server}, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			allIPs = mergeIPs(allIPs, ips)
+			if len(targets) > len(chain) {
+				chain = targets
+			}
 		}
 	}
 
-	// Fallback to system resolver
-	if len(allIPs) == 0 {
-		addrs, err := net.LookupHost(domain)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve %s: %w", domain, err)
+	if len(allIPs) == 0 && len(chain) == 0 {
+		return nil, nil, lastErr
+	}
+	return allIPs, chain, nil
+}
+
+// addClientSubnet attaches an EDNS Client Subnet option (RFC 7871) for
+// subnet to msg
+func addClientSubnet(msg *dns.Msg, subnet *net.IPNet) {
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+		ecs.Address = subnet.IP
+	}
+
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, ecs)
+}
+
+// flattenAnswer follows the CNAME chain for name through an answer section
+// and returns the A and AAAA records of the final owner plus the chain
+// target names
+func flattenAnswer(name string, answer []dns.RR) ([]string, []string) {
+	cnames := make(map[string]string)
+	addrs := make(map[string][]string)
+	for _, rr := range answer {
+		owner := strings.ToLower(rr.Header().Name)
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			cnames[owner] = strings.ToLower(v.Target)
+		case *dns.A:
+			addrs[owner] = append(addrs[owner], v.A.String())
+		case *dns.AAAA:
+			addrs[owner] = append(addrs[owner], v.AAAA.String())
 		}
-		allIPs = addrs
 	}
 
-	if len(allIPs) == 0 {
-		return nil, fmt.Errorf("no IPs found for domain %s", domain)
+	var targets []string
+	current := strings.ToLower(name)
+	for i := 0; i < maxCNAMEDepth; i++ {
+		next, ok := cnames[current]
+		if !ok || containsString(targets, strings.TrimSuffix(next, ".")) {
+			break
+		}
+		current = next
+		targets = append(targets, strings.TrimSuffix(current, "."))
+	}
+
+	return addrs[current], targets
+}
+
+// intervalLocked returns how often domain is re-resolved
+// Must be called with cacheMu held
+func (r *CachingResolver) intervalLocked(domain string) time.Duration {
+	if interval, ok := r.intervals[domain]; ok {
+		return interval
+	}
+	if r.interval > 0 {
+		return r.interval
 	}
+	return defaultRefreshInterval
+}
 
-	return allIPs, nil
+// cacheTTLLocked returns how long the answer for domain is reused, no
+// longer than its own refresh interval
+// Must be called with cacheMu held
+func (r *CachingResolver) cacheTTLLocked(domain string) time.Duration {
+	ttl := r.cacheTTL
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	if interval, ok := r.intervals[domain]; ok && interval < ttl {
+		return interval
+	}
+	return ttl
 }
 
-// StartPeriodicRefresh starts periodic DNS cache refresh
-func (r *Resolver) StartPeriodicRefresh(stopChan <-chan struct{}, callback func(string, []string)) {
-	ticker := time.NewTicker(refreshInterval)
-	defer ticker.Stop()
+// tick returns how often the cache is checked for domains due for a
+// refresh: the shortest refresh interval
+func (r *CachingResolver) tick() time.Duration {
+	r.cacheMu.RLock()
+	defer r.cacheMu.RUnlock()
 
+	tick := r.intervalLocked("")
+	for _, interval := range r.intervals {
+		if interval < tick {
+			tick = interval
+		}
+	}
+	return tick
+}
+
+// StartPeriodicRefresh starts periodic DNS cache refresh. Every tick, the
+// domains whose refresh interval has passed are re-resolved; changes to the
+// intervals apply from the next tick.
+func (r *CachingResolver) StartPeriodicRefresh(stopChan <-chan struct{}, callback func(string, []string)) {
 	for {
+		tick := r.tick()
+		timer := time.NewTimer(tick)
 		select {
-		case <-ticker.C:
-			r.refreshCache(callback)
+		case <-timer.C:
+			r.refreshDue(callback, tick)
 		case <-stopChan:
+			timer.Stop()
 			return
 		}
 	}
 }
 
+// refreshDue refreshes the cached DNS entries whose refresh interval
+// passes by the middle of the next tick
+func (r *CachingResolver) refreshDue(callback func(string, []string), tick time.Duration) {
+	now := r.clock.Now()
+	r.refresh(callback, func(domain string, entry *cacheEntry) bool {
+		return now.Add(tick/2).Sub(entry.resolved) >= r.intervalLocked(domain)
+	})
+}
+
 // refreshCache refreshes all cached DNS entries
-func (r *Resolver) refreshCache(callback func(string, []string)) {
+func (r *CachingResolver) refreshCache(callback func(string, []string)) {
+	r.refresh(callback, nil)
+}
+
+// refresh refreshes the cached DNS entries due is true for, or all of
+// them if due is nil; due is called with cacheMu held
+func (r *CachingResolver) refresh(callback func(string, []string), due func(string, *cacheEntry) bool) {
 	r.cacheMu.RLock()
 	domains := make([]string, 0, len(r.cache))
-	for domain := range r.cache {
+	targetServers := make(map[string][]string)
+	for domain, entry := range r.cache {
+		if due != nil && !due(domain, entry) {
+			continue
+		}
 		domains = append(domains, domain)
+		// Watched targets keep the upstreams of the domain that led to them
+		if _, ok := r.aliases[domain]; ok {
+			targetServers[domain] = entry.servers
+		}
 	}
+	concurrency, jitter, deadline := r.concurrency, r.jitter, r.deadline
 	r.cacheMu.RUnlock()
+	if len(domains) == 0 {
+		return
+	}
+
+	if concurrency < 1 {
+		concurrency = defaultRefreshConcurrency
+	}
+	ctx := context.Background()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	start := r.clock.Now()
+	var refreshed, failed, skipped int64
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				// Spread queries so upstreams don't see bursts
+				if jitter > 0 {
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+					}
+				}
+				if ctx.Err() != nil {
+					atomic.AddInt64(&skipped, 1)
+					continue
+				}
+
+				servers, ok := targetServers[domain]
+				if !ok {
+					servers = r.serversFor(domain)
+				}
+				if err := r.refreshDomain(domain, servers, callback); err != nil {
+					log.Printf("Failed to refresh DNS for %s: %v", domain, err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				atomic.AddInt64(&refreshed, 1)
+			}
+		}()
+	}
 
 	for _, domain := range domains {
-		ips, err := r.lookup(domain)
-		if err != nil {
-			log.Printf("Failed to refresh DNS for %s: %v", domain, err)
-			continue
+		jobs <- domain
+	}
+	close(jobs)
+	wg.Wait()
+
+	log.Printf("Refreshed %d DNS entries in %s (%d failed, %d skipped by deadline)",
+		refreshed, r.clock.Now().Sub(start).Round(time.Millisecond), failed, skipped)
+}
+
+// refreshDomain re-resolves a single cached domain and notifies callback of
+// its new addresses, and those of any domain aliasing it
+func (r *CachingResolver) refreshDomain(domain string, servers []string, callback func(string, []string)) error {
+	result, err := r.lookup(domain, servers)
+	if err != nil {
+		r.failures.Add(1)
+		return err
+	}
+
+	// Update cache
+	r.cacheMu.Lock()
+	entry := r.storeLocked(domain, result, servers)
+	r.watchChainLocked(domain, entry)
+	ips := entry.addresses()
+
+	// A watched CNAME target rotated: its addresses replace those of every
+	// domain still aliasing it
+	updates := map[string][]string{domain: ips}
+	if origins, ok := r.aliases[domain]; ok {
+		for _, origin := range origins {
+			originEntry, ok := r.cache[origin]
+			if !ok || !containsString(originEntry.chain, domain) {
+				continue
+			}
+			r.contributeLocked(originEntry, entry)
+			updates[origin] = originEntry.addresses()
 		}
+	}
+	r.evictLocked()
+	r.cacheMu.Unlock()
 
-		// Update cache
-		r.cacheMu.Lock()
-		r.cache[domain] = &cacheEntry{
-			ips:       ips,
-			expiresAt: time.Now().Add(dnsCacheTTL),
+	// Notify callback
+	if callback != nil {
+		for name, updated := range updates {
+			callback(name, updated)
 		}
-		r.cacheMu.Unlock()
+	}
+	return nil
+}
 
-		// Notify callback
-		if callback != nil {
-			callback(domain, ips)
+// contributeLocked replaces the addresses of entry with the current ones
+// of a refreshed target of its chain, which lead to the end of the chain,
+// keeping in aggregation mode those seen within the IP TTL
+// Must be called with cacheMu held
+func (r *CachingResolver) contributeLocked(entry, target *cacheEntry) {
+	if r.ipTTL <= 0 {
+		entry.ipv4 = append([]string(nil), target.ipv4...)
+		entry.ipv6 = append([]string(nil), target.ipv6...)
+		return
+	}
+
+	now := r.clock.Now()
+	if entry.seen == nil {
+		entry.seen = make(map[string]time.Time)
+	}
+	for ip, lastSeen := range entry.seen {
+		if now.Sub(lastSeen) >= r.ipTTL {
+			delete(entry.seen, ip)
 		}
 	}
+	for ip, lastSeen := range target.seen {
+		if lastSeen.After(entry.seen[ip]) {
+			entry.seen[ip] = lastSeen
+		}
+	}
+	entry.aggregate()
+}
+
+// aggregate sets the addresses of the entry to those it has seen
+func (e *cacheEntry) aggregate() {
+	e.ipv4, e.ipv6 = nil, nil
+	for ip := range e.seen {
+		if isIPv6(ip) {
+			e.ipv6 = append(e.ipv6, ip)
+		} else {
+			e.ipv4 = append(e.ipv4, ip)
+		}
+	}
+	sort.Strings(e.ipv4)
+	sort.Strings(e.ipv6)
+}
+
+// mergeIPs returns the union of two address lists
+func mergeIPs(a, b []string) []string {
+	result := append([]string(nil), a...)
+	for _, ip := range b {
+		if !containsString(result, ip) {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// containsString checks if a string is in a list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeServers adds the default DNS port to servers without one
+func normalizeServers(servers []string) []string {
+	result := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		result[i] = server
+	}
+	return result
+}
+
+// sameServers checks if two upstream server lists are identical
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isIPv6 checks if an address string is an IPv6 address
+func isIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
 }
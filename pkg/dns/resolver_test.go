@@ -0,0 +1,654 @@
+package dns
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestServersFor tests upstream selection for domain and suffix routes
+func TestServersFor(t *testing.T) {
+	r, err := NewResolver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Configure(Settings{
+		Servers: []string{"9.9.9.9"},
+		Suffixes: map[string][]string{
+			"corp.example.com":    {"10.0.0.53"},
+			"eu.corp.example.com": {"10.1.0.53:5353"},
+		},
+		Domains: map[string][]string{
+			"special.corp.example.com": {"10.2.0.53"},
+		},
+	})
+
+	testCases := []struct {
+		name   string
+		domain string
+		want   string
+	}{
+		{"default servers", "github.com", "9.9.9.9:53"},
+		{"suffix route", "git.corp.example.com", "10.0.0.53:53"},
+		{"suffix itself", "corp.example.com", "10.0.0.53:53"},
+		{"longest suffix wins", "wiki.eu.corp.example.com", "10.1.0.53:5353"},
+		{"domain route wins", "special.corp.example.com", "10.2.0.53:53"},
+		{"partial label no match", "notcorp.example.com", "9.9.9.9:53"},
+		{"case insensitive", "Git.CORP.example.com.", "10.0.0.53:53"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := r.serversFor(tc.domain)
+			if len(got) != 1 || got[0] != tc.want {
+				t.Errorf("serversFor(%q) = %v, want [%s]", tc.domain, got, tc.want)
+			}
+		})
+	}
+
+	r.Configure(Settings{Servers: []string{"9.9.9.9"}})
+	if got := r.serversFor("git.corp.example.com"); got[0] != "9.9.9.9:53" {
+		t.Errorf("Expected default servers after Configure without routes, got %v", got)
+	}
+}
+
+// TestFlattenAnswer tests CNAME chain flattening of answer sections
+func TestFlattenAnswer(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	testCases := []struct {
+		name        string
+		answer      []dns.RR
+		wantIPs     []string
+		wantTargets []string
+	}{
+		{
+			name:    "plain A records",
+			answer:  []dns.RR{mustRR("api.example.com. 60 IN A 192.0.2.1"), mustRR("api.example.com. 60 IN A 192.0.2.2")},
+			wantIPs: []string{"192.0.2.1", "192.0.2.2"},
+		},
+		{
+			name: "full chain",
+			answer: []dns.RR{
+				mustRR("api.example.com. 60 IN CNAME api.example.com.cdn.net."),
+				mustRR("api.example.com.cdn.net. 60 IN CNAME edge42.cdn.net."),
+				mustRR("edge42.cdn.net. 20 IN A 198.51.100.7"),
+			},
+			wantIPs:     []string{"198.51.100.7"},
+			wantTargets: []string{"api.example.com.cdn.net", "edge42.cdn.net"},
+		},
+		{
+			name:        "alias only",
+			answer:      []dns.RR{mustRR("api.example.com. 60 IN CNAME edge.cdn.net.")},
+			wantTargets: []string{"edge.cdn.net"},
+		},
+		{
+			name: "unrelated records ignored",
+			answer: []dns.RR{
+				mustRR("api.example.com. 60 IN CNAME edge.cdn.net."),
+				mustRR("other.cdn.net. 60 IN A 203.0.113.9"),
+			},
+			wantTargets: []string{"edge.cdn.net"},
+		},
+		{
+			name: "loop terminates",
+			answer: []dns.RR{
+				mustRR("api.example.com. 60 IN CNAME a.cdn.net."),
+				mustRR("a.cdn.net. 60 IN CNAME api.example.com."),
+			},
+			wantTargets: []string{"a.cdn.net", "api.example.com"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ips, targets := flattenAnswer("api.example.com.", tc.answer)
+			if strings.Join(ips, ",") != strings.Join(tc.wantIPs, ",") {
+				t.Errorf("IPs = %v, want %v", ips, tc.wantIPs)
+			}
+			if strings.Join(targets, ",") != strings.Join(tc.wantTargets, ",") {
+				t.Errorf("targets = %v, want %v", targets, tc.wantTargets)
+			}
+		})
+	}
+}
+
+// fakeExchanger answers queries from a static zone of records
+type fakeExchanger struct {
+	mu      sync.Mutex
+	records map[string][]string // "name type" -> RR strings
+	queries int
+	subnet  string          // EDNS Client Subnet of the last query
+	down    map[string]bool // Servers failing every query
+	servers []string        // Servers queried, in order
+}
+
+func (f *fakeExchanger) set(name string, qtype uint16, rrs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.records == nil {
+		f.records = make(map[string][]string)
+	}
+	f.records[name+" "+dns.TypeToString[qtype]] = rrs
+}
+
+func (f *fakeExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries++
+	f.servers = append(f.servers, address)
+	if f.down[address] {
+		return nil, 0, fmt.Errorf("%s timed out", address)
+	}
+	f.subnet = ""
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				f.subnet = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+			}
+		}
+	}
+
+	q := m.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	for _, s := range f.records[q.Name+" "+dns.TypeToString[q.Qtype]] {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp, 0, nil
+}
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestResolver(t *testing.T, client Exchanger, clock Clock) *CachingResolver {
+	t.Helper()
+	r, err := NewResolver(nil, WithExchanger(client), WithClock(clock), WithSystemLookup(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestResolveDualStack tests that A and AAAA answers are both returned
+func TestResolveDualStack(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("api.example.com.", dns.TypeA, "api.example.com. 60 IN A 192.0.2.1")
+	client.set("api.example.com.", dns.TypeAAAA, "api.example.com. 60 IN AAAA 2001:db8::1")
+
+	r := newTestResolver(t, client, &fakeClock{now: time.Unix(0, 0)})
+	ips, err := r.Resolve("api.example.com")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if strings.Join(ips, ",") != "192.0.2.1,2001:db8::1" {
+		t.Errorf("Expected IPv4 then IPv6 addresses, got %v", ips)
+	}
+
+	// Second lookup is served from the cache
+	queries := client.queries
+	if _, err := r.Resolve("api.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if client.queries != queries {
+		t.Errorf("Expected cached answer, got %d new queries", client.queries-queries)
+	}
+}
+
+// TestResolveFollowsAlias tests chasing a CNAME the upstream did not resolve
+func TestResolveFollowsAlias(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("www.example.com.", dns.TypeA, "www.example.com. 60 IN CNAME edge.cdn.net.")
+	client.set("edge.cdn.net.", dns.TypeA, "edge.cdn.net. 60 IN A 198.51.100.7")
+
+	r := newTestResolver(t, client, &fakeClock{now: time.Unix(0, 0)})
+	ips, err := r.Resolve("www.example.com")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if strings.Join(ips, ",") != "198.51.100.7" {
+		t.Errorf("Expected flattened address, got %v", ips)
+	}
+}
+
+// TestRefreshWatchedTarget tests that a refreshed CNAME target replaces the
+// addresses it led its aliases to, rather than adding to them
+func TestRefreshWatchedTarget(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("www.example.com.", dns.TypeA, "www.example.com. 60 IN CNAME edge.cdn.net.")
+	client.set("edge.cdn.net.", dns.TypeA, "edge.cdn.net. 60 IN A 198.51.100.7")
+
+	r := newTestResolver(t, client, &fakeClock{now: time.Unix(0, 0)})
+	r.Configure(Settings{WatchCNAMETargets: true})
+	if _, err := r.Resolve("www.example.com"); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	updated := make(map[string][]string)
+	callback := func(domain string, ips []string) {
+		updated[domain] = ips
+	}
+	for _, ip := range []string{"198.51.100.8", "198.51.100.9"} {
+		client.set("edge.cdn.net.", dns.TypeA, "edge.cdn.net. 60 IN A "+ip)
+		if err := r.refreshDomain("edge.cdn.net", r.serversFor("edge.cdn.net"), callback); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if got := strings.Join(updated["www.example.com"], ","); got != ip {
+			t.Errorf("Expected the alias to follow the target to %s, got %s", ip, got)
+		}
+	}
+}
+
+// TestRefreshWatchedChain tests that an alias follows the final target of
+// a longer chain to its current addresses only, including in aggregation
+// mode once the addresses it no longer leads to pass the IP TTL
+func TestRefreshWatchedChain(t *testing.T) {
+	testCases := []struct {
+		name     string
+		settings Settings
+		want     []string // Addresses of the alias after each rotation
+	}{
+		{
+			name:     "replaced",
+			settings: Settings{WatchCNAMETargets: true},
+			want:     []string{"198.51.100.8", "198.51.100.9"},
+		},
+		{
+			name:     "aggregated",
+			settings: Settings{WatchCNAMETargets: true, AggregationRounds: 1, AggregationIPTTL: 10 * time.Minute},
+			want:     []string{"198.51.100.7,198.51.100.8", "198.51.100.8,198.51.100.9"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeExchanger{}
+			client.set("www.example.com.", dns.TypeA, "www.example.com. 60 IN CNAME a.cdn.net.")
+			client.set("a.cdn.net.", dns.TypeA, "a.cdn.net. 60 IN CNAME b.cdn.net.")
+			client.set("b.cdn.net.", dns.TypeA, "b.cdn.net. 60 IN CNAME edge.cdn.net.")
+			client.set("edge.cdn.net.", dns.TypeA, "edge.cdn.net. 60 IN A 198.51.100.7")
+
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			r := newTestResolver(t, client, clock)
+			r.Configure(tc.settings)
+			if _, err := r.Resolve("www.example.com"); err != nil {
+				t.Fatalf("Resolve failed: %v", err)
+			}
+
+			updated := make(map[string][]string)
+			callback := func(domain string, ips []string) {
+				updated[domain] = ips
+			}
+			for i, ip := range []string{"198.51.100.8", "198.51.100.9"} {
+				clock.now = clock.now.Add(6 * time.Minute)
+				client.set("edge.cdn.net.", dns.TypeA, "edge.cdn.net. 60 IN A "+ip)
+				if err := r.refreshDomain("edge.cdn.net", r.serversFor("edge.cdn.net"), callback); err != nil {
+					t.Fatalf("Refresh failed: %v", err)
+				}
+				if got := strings.Join(updated["www.example.com"], ","); got != tc.want[i] {
+					t.Errorf("Expected the alias to lead to %s after rotating to %s, got %s", tc.want[i], ip, got)
+				}
+			}
+		})
+	}
+}
+
+// TestResolveNoAnswer tests that an empty answer is an error without
+// fallback, counted as a failure
+func TestResolveNoAnswer(t *testing.T) {
+	r := newTestResolver(t, &fakeExchanger{}, &fakeClock{now: time.Unix(0, 0)})
+	if _, err := r.Resolve("missing.example.com"); err == nil {
+		t.Error("Expected error for domain without records")
+	}
+	if got := r.Failures(); got != 1 {
+		t.Errorf("Expected 1 failure, got %d", got)
+	}
+}
+
+// TestAggregationExpiry tests that aggregated addresses expire after ip_ttl
+func TestAggregationExpiry(t *testing.T) {
+	client := &fakeExchanger{}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	r := newTestResolver(t, client, clock)
+	r.Configure(Settings{AggregationRounds: 2, AggregationIPTTL: 10 * time.Minute})
+
+	client.set("cdn.example.com.", dns.TypeA, "cdn.example.com. 60 IN A 192.0.2.1")
+	if _, err := r.Resolve("cdn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The CDN rotates; the old address is still within ip_ttl
+	clock.now = clock.now.Add(6 * time.Minute)
+	client.set("cdn.example.com.", dns.TypeA, "cdn.example.com. 60 IN A 192.0.2.2")
+	ips, err := r.Resolve("cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ips, ",") != "192.0.2.1,192.0.2.2" {
+		t.Errorf("Expected both addresses, got %v", ips)
+	}
+
+	// The first address was last seen 12 minutes ago
+	clock.now = clock.now.Add(6 * time.Minute)
+	ips, err = r.Resolve("cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ips, ",") != "192.0.2.2" {
+		t.Errorf("Expected expired address to be dropped, got %v", ips)
+	}
+}
+
+// TestCachePersistence tests saving and loading the cache across resolvers
+func TestCachePersistence(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("api.example.com.", dns.TypeA, "api.example.com. 60 IN A 192.0.2.1")
+	client.set("old.example.com.", dns.TypeA, "old.example.com. 60 IN A 192.0.2.9")
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := newTestResolver(t, client, clock)
+	if _, err := r.Resolve("old.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(3 * time.Minute)
+	if _, err := r.Resolve("api.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cache", "dns.json")
+	if err := r.SaveCache(path); err != nil {
+		t.Fatalf("SaveCache failed: %v", err)
+	}
+
+	// Restart during an upstream outage, after old.example.com expired
+	clock.now = clock.now.Add(3 * time.Minute)
+	restarted := newTestResolver(t, &fakeExchanger{}, clock)
+	loaded, err := restarted.LoadCache(path)
+	if err != nil {
+		t.Fatalf("LoadCache failed: %v", err)
+	}
+	if loaded != 1 {
+		t.Errorf("Expected 1 unexpired entry, got %d", loaded)
+	}
+
+	ips, err := restarted.Resolve("api.example.com")
+	if err != nil || strings.Join(ips, ",") != "192.0.2.1" {
+		t.Errorf("Expected persisted answer, got %v (%v)", ips, err)
+	}
+	if _, err := restarted.Resolve("old.example.com"); err == nil {
+		t.Error("Expected expired entry not to be loaded")
+	}
+}
+
+// TestRefreshCacheConcurrent tests that every cached domain is refreshed
+// by the worker pool and that the deadline skips remaining domains
+func TestRefreshCacheConcurrent(t *testing.T) {
+	client := &fakeExchanger{}
+	r := newTestResolver(t, client, &fakeClock{now: time.Unix(0, 0)})
+	r.Configure(Settings{RefreshConcurrency: 4})
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		client.set(name+".", dns.TypeA, fmt.Sprintf("%s. 60 IN A 192.0.2.%d", name, i+1))
+		if _, err := r.Resolve(name); err != nil {
+			t.Fatal(err)
+		}
+		client.set(name+".", dns.TypeA, fmt.Sprintf("%s. 60 IN A 198.51.100.%d", name, i+1))
+	}
+
+	var mu sync.Mutex
+	updated := make(map[string][]string)
+	callback := func(domain string, ips []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		updated[domain] = ips
+	}
+
+	r.refreshCache(callback)
+	if len(updated) != 20 {
+		t.Fatalf("Expected 20 refreshed domains, got %d", len(updated))
+	}
+	if got := strings.Join(updated["host3.example.com"], ","); got != "198.51.100.4" {
+		t.Errorf("Expected refreshed address, got %s", got)
+	}
+
+	// Jitter far beyond the deadline leaves every domain for the next cycle
+	updated = make(map[string][]string)
+	r.Configure(Settings{RefreshConcurrency: 4, RefreshJitter: time.Hour, RefreshDeadline: 10 * time.Millisecond})
+	r.refreshCache(callback)
+	if len(updated) != 0 {
+		t.Errorf("Expected no domains refreshed past the deadline, got %d", len(updated))
+	}
+}
+
+// TestRefreshDue tests that domains are refreshed at their own interval
+// and cached no longer
+func TestRefreshDue(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("api.fastly.com.", dns.TypeA, "api.fastly.com. 60 IN A 192.0.2.1")
+	client.set("www.example.com.", dns.TypeA, "www.example.com. 60 IN A 192.0.2.2")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	r := newTestResolver(t, client, clock)
+	r.Configure(Settings{
+		RefreshInterval:        10 * time.Minute,
+		DomainRefreshIntervals: map[string]time.Duration{"api.fastly.com": 30 * time.Second},
+	})
+	if tick := r.tick(); tick != 30*time.Second {
+		t.Fatalf("Expected a 30s tick, got %s", tick)
+	}
+	for _, name := range []string{"api.fastly.com", "www.example.com"} {
+		if _, err := r.Resolve(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.cacheMu.RLock()
+	ttl := r.cache["api.fastly.com"].expiresAt.Sub(clock.now)
+	r.cacheMu.RUnlock()
+	if ttl != 30*time.Second {
+		t.Errorf("Expected api.fastly.com cached for 30s, got %s", ttl)
+	}
+
+	var mu sync.Mutex
+	var refreshed []string
+	callback := func(domain string, ips []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshed = append(refreshed, domain)
+	}
+	clock.now = clock.now.Add(30 * time.Second)
+	r.refreshDue(callback, r.tick())
+	if strings.Join(refreshed, ",") != "api.fastly.com" {
+		t.Errorf("Expected only api.fastly.com refreshed after 30s, got %v", refreshed)
+	}
+
+	refreshed = nil
+	clock.now = clock.now.Add(9*time.Minute + 45*time.Second)
+	r.refreshDue(callback, r.tick())
+	sort.Strings(refreshed)
+	if strings.Join(refreshed, ",") != "api.fastly.com,www.example.com" {
+		t.Errorf("Expected both domains refreshed within half a tick of 10m, got %v", refreshed)
+	}
+}
+
+// TestCacheEviction tests that the least recently used domains are evicted
+// beyond the cache bound, and that refreshes don't count as a use
+func TestCacheEviction(t *testing.T) {
+	client := &fakeExchanger{}
+	for i, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		client.set(name+".", dns.TypeA, fmt.Sprintf("%s. 60 IN A 192.0.2.%d", name, i+1))
+	}
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := newTestResolver(t, client, clock)
+	r.Configure(Settings{CacheMaxEntries: 3})
+
+	resolve := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			clock.now = clock.now.Add(time.Second)
+			if _, err := r.Resolve(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cached := func() string {
+		var domains []string
+		for _, entry := range r.CacheEntries() {
+			domains = append(domains, entry.Domain)
+		}
+		return strings.Join(domains, ",")
+	}
+
+	resolve("a.example.com", "b.example.com", "c.example.com", "a.example.com")
+	r.refreshCache(nil)
+	resolve("d.example.com")
+	if got := cached(); got != "a.example.com,c.example.com,d.example.com" {
+		t.Errorf("Expected b.example.com evicted, got %s", got)
+	}
+	if got := r.Evictions(); got != 1 {
+		t.Errorf("Expected 1 eviction, got %d", got)
+	}
+
+	r.Configure(Settings{CacheMaxEntries: 1})
+	if got := cached(); got != "d.example.com" {
+		t.Errorf("Expected the most recently used domain kept, got %s", got)
+	}
+	if got := r.Evictions(); got != 3 {
+		t.Errorf("Expected 3 evictions, got %d", got)
+	}
+}
+
+// TestClientSubnet tests that the configured EDNS Client Subnet is sent
+func TestClientSubnet(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("cdn.example.com.", dns.TypeA, "cdn.example.com. 60 IN A 192.0.2.1")
+
+	r := newTestResolver(t, client, &fakeClock{now: time.Unix(0, 0)})
+	if _, err := r.Resolve("cdn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if client.subnet != "" {
+		t.Errorf("Expected no client subnet by default, got %s", client.subnet)
+	}
+
+	r.Configure(Settings{ClientSubnet: "203.0.113.77/24"})
+	if _, err := r.Resolve("other.example.com"); err == nil {
+		t.Fatal("Expected error for domain without records")
+	}
+	if client.subnet != "203.0.113.0/24" {
+		t.Errorf("Expected client subnet 203.0.113.0/24, got %q", client.subnet)
+	}
+}
+
+// TestPoolOrder tests the order of the upstreams of a query by strategy,
+// demoted upstreams last
+func TestPoolOrder(t *testing.T) {
+	servers := []string{"a:53", "b:53", "c:53"}
+	testCases := []struct {
+		name     string
+		strategy Strategy
+		rtts     map[string]time.Duration
+		down     []string
+		want     []string // Order of consecutive queries
+	}{
+		{
+			name: "ordered",
+			want: []string{"a:53,b:53,c:53", "a:53,b:53,c:53"},
+		},
+		{
+			name: "ordered with a demoted upstream",
+			down: []string{"a:53"},
+			want: []string{"b:53,c:53,a:53"},
+		},
+		{
+			name:     "round robin",
+			strategy: StrategyRoundRobin,
+			want:     []string{"a:53,b:53,c:53", "b:53,c:53,a:53", "c:53,a:53,b:53"},
+		},
+		{
+			name:     "round robin with a demoted upstream",
+			strategy: StrategyRoundRobin,
+			down:     []string{"b:53"},
+			want:     []string{"a:53,c:53,b:53", "c:53,a:53,b:53"},
+		},
+		{
+			name:     "fastest",
+			strategy: StrategyFastest,
+			rtts:     map[string]time.Duration{"a:53": 80 * time.Millisecond, "b:53": 20 * time.Millisecond},
+			want:     []string{"c:53,b:53,a:53"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPool(&fakeClock{now: time.Unix(1000, 0)})
+			p.configure(tc.strategy, 1, servers)
+			for server, rtt := range tc.rtts {
+				p.record(server, rtt, nil)
+			}
+			for _, server := range tc.down {
+				p.record(server, 0, fmt.Errorf("timed out"))
+			}
+			for i, want := range tc.want {
+				if got := strings.Join(p.order(servers), ","); got != want {
+					t.Errorf("Query %d: expected %s, got %s", i+1, want, got)
+				}
+			}
+		})
+	}
+}
+
+// TestUpstreamFailover tests that an upstream failing in a row is demoted
+// behind the others, and promoted again once a probe is answered
+func TestUpstreamFailover(t *testing.T) {
+	client := &fakeExchanger{down: map[string]bool{"192.0.2.53:53": true}}
+	client.set("a.example.com.", dns.TypeA, "a.example.com. 60 IN A 198.51.100.1")
+	client.set("b.example.com.", dns.TypeA, "b.example.com. 60 IN A 198.51.100.2")
+	client.set("b.example.com.", dns.TypeAAAA, "b.example.com. 60 IN AAAA 2001:db8::2")
+	r := newTestResolver(t, client, &fakeClock{now: time.Unix(1000, 0)})
+	r.Configure(Settings{Servers: []string{"192.0.2.53", "198.51.100.53"}, FailureThreshold: 2})
+
+	if _, err := r.Resolve("a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	status := r.Upstreams()
+	if len(status) != 2 || status[0].Healthy || status[0].Failures != 2 || !status[1].Healthy {
+		t.Fatalf("Expected 192.0.2.53 demoted after 2 failures, got %+v", status)
+	}
+
+	client.servers = nil
+	if _, err := r.Resolve("b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range client.servers {
+		if server != "198.51.100.53:53" {
+			t.Errorf("Expected only 198.51.100.53 queried, got %v", client.servers)
+			break
+		}
+	}
+
+	client.down = nil
+	r.probe()
+	if status := r.Upstreams(); !status[0].Healthy || status[0].ConsecutiveFailures != 0 {
+		t.Errorf("Expected 192.0.2.53 promoted after a probe, got %+v", status[0])
+	}
+}
@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultReverseTTL  = time.Hour
+	defaultReverseRate = 5 // Lookups per second
+	maxReverseEntries  = 4096
+)
+
+// ReverseResolver looks up the PTR names of addresses in the background, so
+// that log lines can name destinations without waiting for DNS. Names are
+// verified by resolving them forward; the number of lookups is limited, and
+// addresses over the limit are logged without a name.
+type ReverseResolver struct {
+	client  Exchanger
+	clock   Clock
+	servers []string
+	ttl     time.Duration
+	rate    float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	cache   map[string]reverseEntry
+	pending map[string][]func(string) // Address -> callbacks waiting for it
+}
+
+type reverseEntry struct {
+	name      string // "" if the address has no PTR record
+	expiresAt time.Time
+}
+
+// NewReverseResolver creates a reverse resolver querying servers, caching
+// names for ttl and starting at most rate lookups per second; zero values
+// select the defaults
+func NewReverseResolver(servers []string, ttl time.Duration, rate int) *ReverseResolver {
+	if len(servers) == 0 {
+		servers = defaultServers
+	}
+	if ttl <= 0 {
+		ttl = defaultReverseTTL
+	}
+	if rate <= 0 {
+		rate = defaultReverseRate
+	}
+	return &ReverseResolver{
+		client:  &dns.Client{Timeout: 5 * time.Second},
+		clock:   systemClock{},
+		servers: normalizeServers(servers),
+		ttl:     ttl,
+		rate:    float64(rate),
+		tokens:  float64(rate),
+		cache:   make(map[string]reverseEntry),
+		pending: make(map[string][]func(string)),
+	}
+}
+
+// LookupName calls done with the name of ip: immediately if it is cached
+// or the lookup limit is reached, otherwise once the lookup completes. The
+// name is "" if there is none, and marked "(unverified)" if it does not
+// resolve back to ip.
+func (r *ReverseResolver) LookupName(ip net.IP, done func(name string)) {
+	key := ip.String()
+
+	r.mu.Lock()
+	now := r.clock.Now()
+	if entry, ok := r.cache[key]; ok && now.Before(entry.expiresAt) {
+		r.mu.Unlock()
+		done(entry.name)
+		return
+	}
+	if callbacks, ok := r.pending[key]; ok {
+		r.pending[key] = append(callbacks, done)
+		r.mu.Unlock()
+		return
+	}
+	if !r.takeLocked(now) {
+		r.mu.Unlock()
+		done("")
+		return
+	}
+	r.pending[key] = []func(string){done}
+	r.mu.Unlock()
+
+	go r.resolve(key, append(net.IP(nil), ip...))
+}
+
+// takeLocked takes a token from the lookup budget, reporting whether one
+// was left
+// Must be called with mu held
+func (r *ReverseResolver) takeLocked(now time.Time) bool {
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.rate {
+			r.tokens = r.rate
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// resolve looks up and verifies the name of ip, caches it and hands it to
+// the waiting callbacks
+func (r *ReverseResolver) resolve(key string, ip net.IP) {
+	name := r.lookupPTR(ip)
+	if name != "" && !r.verify(name, ip) {
+		name += " (unverified)"
+	}
+
+	r.mu.Lock()
+	now := r.clock.Now()
+	if len(r.cache) >= maxReverseEntries {
+		r.pruneLocked(now)
+	}
+	r.cache[key] = reverseEntry{name: name, expiresAt: now.Add(r.ttl)}
+	callbacks := r.pending[key]
+	delete(r.pending, key)
+	r.mu.Unlock()
+
+	for _, done := range callbacks {
+		done(name)
+	}
+}
+
+// pruneLocked removes expired names, and all of them if none has expired
+// Must be called with mu held
+func (r *ReverseResolver) pruneLocked(now time.Time) {
+	for key, entry := range r.cache {
+		if !now.Before(entry.expiresAt) {
+			delete(r.cache, key)
+		}
+	}
+	if len(r.cache) >= maxReverseEntries {
+		r.cache = make(map[string]reverseEntry)
+	}
+}
+
+// lookupPTR returns the first PTR name of ip, without the trailing dot
+func (r *ReverseResolver) lookupPTR(ip net.IP) string {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ""
+	}
+	for _, rr := range r.exchange(arpa, dns.TypePTR) {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return strings.TrimSuffix(ptr.Ptr, ".")
+		}
+	}
+	return ""
+}
+
+// verify reports whether name resolves to ip (forward-confirmed reverse
+// DNS), so that a PTR record can't claim any name
+func (r *ReverseResolver) verify(name string, ip net.IP) bool {
+	qtype := dns.TypeAAAA
+	if ip.To4() != nil {
+		qtype = dns.TypeA
+	}
+	// Answers may include the CNAME chain; only addresses count
+	for _, rr := range r.exchange(dns.Fqdn(name), qtype) {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.A.Equal(ip) {
+				return true
+			}
+		case *dns.AAAA:
+			if rr.AAAA.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exchange returns the answer of the first server answering a query
+func (r *ReverseResolver) exchange(name string, qtype uint16) []dns.RR {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	for _, server := range r.servers {
+		resp, _, err := r.client.Exchange(msg, server)
+		if err != nil {
+			continue
+		}
+		if len(resp.Answer) > 0 || resp.Rcode == dns.RcodeNameError {
+			return resp.Answer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestLookupName tests verified, unverified and missing PTR names
+func TestLookupName(t *testing.T) {
+	client := &fakeExchanger{}
+	client.set("10.2.0.192.in-addr.arpa.", dns.TypePTR, "10.2.0.192.in-addr.arpa. 300 IN PTR web.example.com.")
+	client.set("web.example.com.", dns.TypeA, "web.example.com. 300 IN A 192.0.2.10")
+	client.set("11.2.0.192.in-addr.arpa.", dns.TypePTR, "11.2.0.192.in-addr.arpa. 300 IN PTR www.example.org.")
+	client.set("www.example.org.", dns.TypeA, "www.example.org. 300 IN A 198.51.100.1")
+
+	testCases := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.10", want: "web.example.com"},
+		{ip: "192.0.2.11", want: "www.example.org (unverified)"},
+		{ip: "192.0.2.12", want: ""},
+	}
+
+	r := NewReverseResolver(nil, time.Hour, 10)
+	r.client = client
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			names := make(chan string, 1)
+			r.LookupName(net.ParseIP(tc.ip), func(name string) { names <- name })
+			if got := <-names; got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	// Names are cached
+	queries := client.queries
+	r.LookupName(net.ParseIP("192.0.2.10"), func(string) {})
+	if client.queries != queries {
+		t.Errorf("Expected a cached name, got %d more queries", client.queries-queries)
+	}
+}
+
+// TestLookupNameRateLimit tests that lookups over the rate are skipped
+// until the budget refills
+func TestLookupNameRateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	r := NewReverseResolver(nil, time.Hour, 1)
+	r.client = &fakeExchanger{}
+	r.clock = clock
+
+	lookup := func(ip string) bool {
+		names := make(chan string, 1)
+		r.LookupName(net.ParseIP(ip), func(name string) { names <- name })
+		<-names
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, cached := r.cache[ip]
+		return cached
+	}
+	if !lookup("192.0.2.1") {
+		t.Error("Expected the first address to be looked up")
+	}
+	if lookup("192.0.2.2") {
+		t.Error("Expected the second address to be over the limit")
+	}
+	clock.now = clock.now.Add(time.Second)
+	if !lookup("192.0.2.2") {
+		t.Error("Expected a lookup once the budget refilled")
+	}
+}
@@ -0,0 +1,365 @@
+// Package dnsproxy answers the DNS queries of downstream clients,
+// forwarding them to the router's upstream resolvers. Names the policy
+// denies outright are answered NXDOMAIN instead of timing out at the IP
+// layer, and names no allow rule names are subject to Response Policy
+// Zones, e.g. blocklists of malware and ad domains. Local zones, such as
+// the hostnames of a LAN, are answered by the proxy itself, optionally
+// only for some clients to serve a split horizon. Every query can be logged with its answer and the policy's
+// verdict, and is counted per client for the stats API. With
+// allow_on_first_use, the addresses answered for the domains of rules are
+// added to the rules' sets before the client gets them.
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// Verdicts of queries
+const (
+	// VerdictAllowed is given when an allow rule names the domain
+	VerdictAllowed = "allowed"
+	// VerdictDenied is given when a deny rule names the domain for some
+	// connections; the query is answered and the IP layer decides
+	VerdictDenied = "denied"
+	// VerdictBlocked is given when the query is answered NXDOMAIN, or as
+	// an RPZ says
+	VerdictBlocked = "blocked"
+	// VerdictForwarded is given when no rule names the domain
+	VerdictForwarded = "forwarded"
+	// VerdictLocal is given when a local zone answers the query
+	VerdictLocal = "local"
+)
+
+// Decision is the policy's verdict on a name a client looks up
+type Decision struct {
+	Verdict string
+	Rule    string // Rule deciding, "" if none
+}
+
+// Policy decides the names clients look up
+type Policy interface {
+	DecideQuery(client net.IP, name string) Decision
+}
+
+// HostWatcher is told when the hosts of the local zones change as DHCP
+// leases come and go, if the Policy implements it
+type HostWatcher interface {
+	HostsChanged()
+}
+
+// AnswerWatcher is told the addresses upstream answered for a name a rule
+// names before the client gets them, with allow_on_first_use, if the
+// Policy implements it
+type AnswerWatcher interface {
+	Answered(name string, addresses []net.IP)
+}
+
+// ResponseWatcher is told every response a client gets, as sent, if the
+// Policy implements it
+type ResponseWatcher interface {
+	Responded(client net.IP, resp *dns.Msg)
+}
+
+// Upstream forwards queries to the upstream resolvers
+type Upstream interface {
+	Exchange(msg *dns.Msg) (*dns.Msg, error)
+}
+
+// Query is an answered query
+type Query struct {
+	Time    time.Time
+	Client  net.IP
+	Name    string
+	Type    string // A, AAAA, ...
+	Rcode   string // NOERROR, NXDOMAIN, ...
+	Answer  []string
+	Verdict string
+	Rule    string // Rule deciding the verdict, "" if none
+}
+
+// String formats the query as a log line, without the time
+func (q Query) String() string {
+	var b strings.Builder
+	b.WriteString(q.Verdict)
+	if q.Rule != "" {
+		fmt.Fprintf(&b, " rule=%s", q.Rule)
+	}
+	fmt.Fprintf(&b, " client=%s name=%s type=%s rcode=%s", q.Client, q.Name, q.Type, q.Rcode)
+	if len(q.Answer) > 0 {
+		fmt.Fprintf(&b, " answer=%s", strings.Join(q.Answer, ","))
+	}
+	return b.String()
+}
+
+// Server answers queries on the configured addresses
+type Server struct {
+	config   *config.DNSProxyConfig
+	policy   Policy
+	upstream Upstream
+	log      *queryLog
+	stats    *stats
+	zones    []*localZone
+	rpz      []*rpzZone
+
+	mu      sync.Mutex
+	servers []*dns.Server
+	stop    chan struct{}
+}
+
+// NewServer creates a proxy for cfg, opening its query log and loading
+// its zones and RPZs
+func NewServer(cfg *config.DNSProxyConfig, policy Policy, upstream Upstream) (*Server, error) {
+	zones, err := newLocalZones(cfg.Zones)
+	if err != nil {
+		return nil, err
+	}
+	queries, err := openQueryLog(cfg.QueryLog)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		config:   cfg,
+		policy:   policy,
+		upstream: upstream,
+		log:      queries,
+		stats:    newStats(),
+		zones:    zones,
+		rpz:      newRPZZones(cfg.RPZ),
+	}, nil
+}
+
+// Start listens on the configured addresses over UDP and TCP, reloading
+// the RPZs and DHCP leases as their files change
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, addr := range s.config.Listen {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			s.stopLocked()
+			return fmt.Errorf("failed to listen for DNS on udp %s: %w", addr, err)
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			pc.Close()
+			s.stopLocked()
+			return fmt.Errorf("failed to listen for DNS on tcp %s: %w", addr, err)
+		}
+		for _, server := range []*dns.Server{{PacketConn: pc, Handler: s}, {Listener: ln, Handler: s}} {
+			s.servers = append(s.servers, server)
+			go func(server *dns.Server) {
+				if err := server.ActivateAndServe(); err != nil {
+					log.Printf("Warning: DNS proxy stopped: %v", err)
+				}
+			}(server)
+		}
+	}
+	if len(s.rpz) > 0 || hasLeases(s.zones) {
+		s.stop = make(chan struct{})
+	}
+	if len(s.rpz) > 0 {
+		go reloadRPZ(s.rpz, s.stop)
+	}
+	if hasLeases(s.zones) {
+		var changed func()
+		if watcher, ok := s.policy.(HostWatcher); ok {
+			changed = watcher.HostsChanged
+		}
+		go watchLeases(s.zones, s.stop, changed)
+	}
+	log.Printf("DNS proxy listening on %s", strings.Join(s.config.Listen, ", "))
+	return nil
+}
+
+// Stop closes the listeners and the query log
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
+	return s.log.close()
+}
+
+// stopLocked closes the listeners
+// Must be called with mu held
+func (s *Server) stopLocked() {
+	for _, server := range s.servers {
+		server.Shutdown()
+	}
+	s.servers = nil
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// ServeDNS answers a query
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	client := addrIP(w.RemoteAddr())
+	if len(req.Question) != 1 {
+		w.WriteMsg(rcodeReply(req, dns.RcodeFormatError))
+		return
+	}
+	q := req.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	decision := s.policy.DecideQuery(client, name)
+	resp := s.respond(req, client, name, udp, &decision)
+	query := Query{
+		Time:    time.Now(),
+		Client:  client,
+		Name:    name,
+		Type:    dns.TypeToString[q.Qtype],
+		Rcode:   "DROPPED",
+		Verdict: decision.Verdict,
+		Rule:    decision.Rule,
+	}
+	if resp != nil && s.config.AllowOnFirstUse && resp.Rcode == dns.RcodeSuccess &&
+		(decision.Verdict == VerdictAllowed || decision.Verdict == VerdictDenied) {
+		if watcher, ok := s.policy.(AnswerWatcher); ok {
+			if addresses := answerIPs(resp.Answer); len(addresses) > 0 {
+				watcher.Answered(name, addresses)
+			}
+		}
+	}
+	if resp != nil {
+		if udp {
+			resp.Truncate(udpSize(req))
+		}
+		if watcher, ok := s.policy.(ResponseWatcher); ok {
+			watcher.Responded(client, resp)
+		}
+		w.WriteMsg(resp)
+		query.Rcode = dns.RcodeToString[resp.Rcode]
+		query.Answer = answerValues(resp.Answer)
+	}
+	s.stats.add(query)
+	s.log.write(query)
+}
+
+// respond returns the response to req, or nil to drop it. Names in a
+// local zone for client are answered from it. Names no allow rule names
+// are looked up in the RPZs, whose actions other than passthru block the
+// query.
+func (s *Server) respond(req *dns.Msg, client net.IP, name string, udp bool, decision *Decision) *dns.Msg {
+	if decision.Verdict == VerdictBlocked {
+		return rcodeReply(req, dns.RcodeNameError)
+	}
+	if zone := matchZone(s.zones, client, name); zone != nil {
+		*decision = Decision{Verdict: VerdictLocal, Rule: "zone:" + strings.TrimSuffix(zone.origin, ".")}
+		return zone.answer(req)
+	}
+	if decision.Verdict != VerdictAllowed {
+		if zone, action := matchRPZ(s.rpz, name); action != nil {
+			rule := "rpz:" + zone.zoneLabel()
+			switch action.kind {
+			case rpzNXDomain:
+				*decision = Decision{Verdict: VerdictBlocked, Rule: rule}
+				return rcodeReply(req, dns.RcodeNameError)
+			case rpzNoData:
+				*decision = Decision{Verdict: VerdictBlocked, Rule: rule}
+				return rcodeReply(req, dns.RcodeSuccess)
+			case rpzDrop:
+				*decision = Decision{Verdict: VerdictBlocked, Rule: rule}
+				return nil
+			case rpzLocalData:
+				*decision = Decision{Verdict: VerdictBlocked, Rule: rule}
+				return rpzAnswer(req, action)
+			case rpzTCPOnly:
+				if udp {
+					resp := rcodeReply(req, dns.RcodeSuccess)
+					resp.Truncated = true
+					return resp
+				}
+			}
+		}
+	}
+
+	resp, err := s.upstream.Exchange(req)
+	if err != nil {
+		return rcodeReply(req, dns.RcodeServerFailure)
+	}
+	resp.Id = req.Id
+	return resp
+}
+
+// rcodeReply returns an empty reply to req with rcode
+func rcodeReply(req *dns.Msg, rcode int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	resp.RecursionAvailable = true
+	return resp
+}
+
+// Stats returns the queries of each client, or of client if set, with
+// their top most queried and blocked domains; clients are ordered by
+// queries, most first
+func (s *Server) Stats(client net.IP, top int) []ClientStats {
+	return s.stats.snapshot(client, top)
+}
+
+// HostAddresses returns the addresses of a name in the local zones,
+// including the hostnames of DHCP leases, for every client
+func (s *Server) HostAddresses(name string) []string {
+	return zoneHostAddresses(s.zones, name)
+}
+
+// udpSize returns the largest response a client accepts over UDP
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// answerValues returns the data of the records in an answer
+func answerValues(answer []dns.RR) []string {
+	var values []string
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			values = append(values, rr.A.String())
+		case *dns.AAAA:
+			values = append(values, rr.AAAA.String())
+		case *dns.CNAME:
+			values = append(values, strings.TrimSuffix(rr.Target, "."))
+		default:
+			values = append(values, strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String())))
+		}
+	}
+	return values
+}
+
+// answerIPs returns the addresses in an answer
+func answerIPs(answer []dns.RR) []net.IP {
+	var ips []net.IP
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
+
+// addrIP returns the IP address of a client address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// fakePolicy decides names from a map
+type fakePolicy map[string]Decision
+
+func (p fakePolicy) DecideQuery(client net.IP, name string) Decision {
+	if d, ok := p[name]; ok {
+		return d
+	}
+	return Decision{Verdict: VerdictForwarded}
+}
+
+// fakeUpstream answers A queries with 192.0.2.1, failing for fail.example
+type fakeUpstream struct{}
+
+func (fakeUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	if msg.Question[0].Name == "fail.example." {
+		return nil, fmt.Errorf("timeout")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, rr)
+	return resp, nil
+}
+
+// recorder is a dns.ResponseWriter keeping the response
+type recorder struct {
+	dns.ResponseWriter
+	client net.Addr
+	msg    *dns.Msg
+}
+
+func (r *recorder) RemoteAddr() net.Addr        { return r.client }
+func (r *recorder) WriteMsg(msg *dns.Msg) error { r.msg = msg; return nil }
+
+// TestServeDNS tests that queries are forwarded or blocked by verdict and
+// counted per client
+func TestServeDNS(t *testing.T) {
+	policy := fakePolicy{
+		"api.example":     {Verdict: VerdictAllowed, Rule: "api"},
+		"ads.example":     {Verdict: VerdictBlocked, Rule: "no-ads"},
+		"tracker.example": {Verdict: VerdictDenied, Rule: "no-tracking"},
+	}
+	s, err := NewServer(&config.DNSProxyConfig{Listen: []string{"127.0.0.1:0"}}, policy, fakeUpstream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		query     string
+		wantRcode int
+		wantA     bool
+	}{
+		{name: "allowed", query: "api.example.", wantRcode: dns.RcodeSuccess, wantA: true},
+		{name: "unmatched", query: "www.example.", wantRcode: dns.RcodeSuccess, wantA: true},
+		{name: "blocked", query: "ads.example.", wantRcode: dns.RcodeNameError},
+		{name: "denied", query: "Tracker.Example.", wantRcode: dns.RcodeSuccess, wantA: true},
+		{name: "upstream failure", query: "fail.example.", wantRcode: dns.RcodeServerFailure},
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.query, dns.TypeA)
+			w := &recorder{client: client}
+			s.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Id != req.Id {
+				t.Fatalf("Expected a response to query %d, got %v", req.Id, w.msg)
+			}
+			if w.msg.Rcode != tc.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tc.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if got := len(w.msg.Answer) > 0; got != tc.wantA {
+				t.Errorf("Expected answer %v, got %v", tc.wantA, w.msg.Answer)
+			}
+		})
+	}
+
+	stats := s.Stats(client.IP, 10)
+	if len(stats) != 1 || stats[0].Queries != 5 || stats[0].Blocked != 2 {
+		t.Fatalf("Expected 5 queries with 2 blocked for %s, got %+v", client.IP, stats)
+	}
+	blocked := stats[0].TopBlocked
+	if len(blocked) != 2 || blocked[0].Domain != "ads.example" || blocked[1].Domain != "tracker.example" {
+		t.Errorf("Expected ads.example and tracker.example blocked, got %+v", blocked)
+	}
+}
+
+// answerPolicy is a fakePolicy recording the answers it is told about
+type answerPolicy struct {
+	fakePolicy
+	answered map[string][]net.IP
+}
+
+func (p *answerPolicy) Answered(name string, addresses []net.IP) {
+	p.answered[name] = addresses
+}
+
+// TestAllowOnFirstUse tests that the answers for names rules name are
+// passed on before the response, and only with allow_on_first_use
+func TestAllowOnFirstUse(t *testing.T) {
+	testCases := []struct {
+		name         string
+		query        string
+		firstUse     bool
+		wantAnswered bool
+	}{
+		{name: "allowed", query: "api.example.", firstUse: true, wantAnswered: true},
+		{name: "denied", query: "tracker.example.", firstUse: true, wantAnswered: true},
+		{name: "unmatched", query: "www.example.", firstUse: true},
+		{name: "blocked", query: "ads.example.", firstUse: true},
+		{name: "upstream failure", query: "fail.example.", firstUse: true},
+		{name: "disabled", query: "api.example."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := &answerPolicy{
+				fakePolicy: fakePolicy{
+					"api.example":     {Verdict: VerdictAllowed, Rule: "api"},
+					"ads.example":     {Verdict: VerdictBlocked, Rule: "no-ads"},
+					"tracker.example": {Verdict: VerdictDenied, Rule: "no-tracking"},
+					"fail.example":    {Verdict: VerdictAllowed, Rule: "fail"},
+				},
+				answered: make(map[string][]net.IP),
+			}
+			cfg := &config.DNSProxyConfig{Listen: []string{"127.0.0.1:0"}, AllowOnFirstUse: tc.firstUse}
+			s, err := NewServer(cfg, policy, fakeUpstream{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(tc.query, dns.TypeA)
+			s.ServeDNS(&recorder{client: &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}}, req)
+
+			name := strings.TrimSuffix(tc.query, ".")
+			addresses, answered := policy.answered[name]
+			if answered != tc.wantAnswered {
+				t.Fatalf("Expected answered %v, got %v", tc.wantAnswered, policy.answered)
+			}
+			if answered && (len(addresses) != 1 || !addresses[0].Equal(net.ParseIP("192.0.2.1"))) {
+				t.Errorf("Expected 192.0.2.1 answered for %s, got %v", name, addresses)
+			}
+		})
+	}
+}
+
+// responsePolicy is a fakePolicy recording the responses clients get
+type responsePolicy struct {
+	fakePolicy
+	clients   []net.IP
+	responses []*dns.Msg
+}
+
+func (p *responsePolicy) Responded(client net.IP, resp *dns.Msg) {
+	p.clients = append(p.clients, client)
+	p.responses = append(p.responses, resp)
+}
+
+// TestResponseWatcher tests that the responses sent, failures included, are
+// passed on with their client
+func TestResponseWatcher(t *testing.T) {
+	policy := &responsePolicy{fakePolicy: fakePolicy{
+		"api.example":  {Verdict: VerdictAllowed, Rule: "api"},
+		"fail.example": {Verdict: VerdictAllowed, Rule: "fail"},
+	}}
+	s, err := NewServer(&config.DNSProxyConfig{Listen: []string{"127.0.0.1:0"}}, policy, fakeUpstream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"api.example.", "fail.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(query, dns.TypeA)
+		s.ServeDNS(&recorder{client: &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}}, req)
+	}
+
+	if len(policy.responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(policy.responses))
+	}
+	if !policy.clients[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("Expected client 10.0.0.5, got %v", policy.clients[0])
+	}
+	resp := policy.responses[0]
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Expected api.example answered with 192.0.2.1, got %v", resp.Answer)
+	}
+	if policy.responses[1].Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL for fail.example, got %s", dns.RcodeToString[policy.responses[1].Rcode])
+	}
+}
+
+// TestQueryLogRotation tests that the log is rotated at its maximum size,
+// keeping the configured number of backups
+func TestQueryLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	l, err := newQueryLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	q := Query{
+		Time:    time.Now(),
+		Client:  net.ParseIP("10.0.0.5"),
+		Name:    "api.example",
+		Type:    "A",
+		Rcode:   "NOERROR",
+		Answer:  []string{"192.0.2.1"},
+		Verdict: VerdictAllowed,
+		Rule:    "api",
+	}
+	for i := 0; i < 20; i++ {
+		l.write(q)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Expected %s: %v", name, err)
+		}
+		if len(data) > 200 || !strings.Contains(string(data), "allowed rule=api client=10.0.0.5 name=api.example type=A rcode=NOERROR answer=192.0.2.1") {
+			t.Errorf("Unexpected content of %s: %q", name, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups, got %s.3", path)
+	}
+}
+
+// TestRPZ tests that the actions of RPZ triggers are applied to names no
+// allow rule names
+func TestRPZ(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.rpz")
+	zone := `$TTL 60
+$ORIGIN rpz.local.
+@                 SOA localhost. root.localhost. 1 3600 600 86400 60
+                  NS  localhost.
+ads.example       CNAME .
+*.ads.example     CNAME .
+ok.ads.example    CNAME rpz-passthru.
+nodata.example    CNAME *.
+drop.example      CNAME rpz-drop.
+walled.example    A     192.0.2.99
+api.example       CNAME .
+32.5.0.0.10.rpz-client-ip CNAME .
+`
+	if err := os.WriteFile(path, []byte(zone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy := fakePolicy{"api.example": {Verdict: VerdictAllowed, Rule: "api"}}
+	cfg := &config.DNSProxyConfig{Listen: []string{"127.0.0.1:0"}, RPZ: []config.RPZConfig{{File: path}}}
+	s, err := NewServer(cfg, policy, fakeUpstream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		query       string
+		wantDropped bool
+		wantRcode   int
+		wantAnswer  string
+		wantRule    string
+	}{
+		{name: "exact", query: "ads.example.", wantRcode: dns.RcodeNameError, wantRule: "rpz:rpz.local"},
+		{name: "wildcard", query: "x.y.ads.example.", wantRcode: dns.RcodeNameError, wantRule: "rpz:rpz.local"},
+		{name: "passthru", query: "ok.ads.example.", wantRcode: dns.RcodeSuccess, wantAnswer: "192.0.2.1"},
+		{name: "no data", query: "nodata.example.", wantRcode: dns.RcodeSuccess, wantRule: "rpz:rpz.local"},
+		{name: "drop", query: "drop.example.", wantDropped: true, wantRule: "rpz:rpz.local"},
+		{name: "local data", query: "walled.example.", wantRcode: dns.RcodeSuccess, wantAnswer: "192.0.2.99", wantRule: "rpz:rpz.local"},
+		{name: "allow rule first", query: "api.example.", wantRcode: dns.RcodeSuccess, wantAnswer: "192.0.2.1", wantRule: "api"},
+		{name: "no trigger", query: "www.example.", wantRcode: dns.RcodeSuccess, wantAnswer: "192.0.2.1"},
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.query, dns.TypeA)
+			name := strings.TrimSuffix(tc.query, ".")
+			decision := policy.DecideQuery(client.IP, name)
+			resp := s.respond(req, client.IP, name, true, &decision)
+			if tc.wantDropped {
+				if resp != nil {
+					t.Errorf("Expected the query to be dropped, got %v", resp)
+				}
+			} else if resp == nil || resp.Rcode != tc.wantRcode {
+				t.Fatalf("Expected rcode %s, got %v", dns.RcodeToString[tc.wantRcode], resp)
+			} else if got := strings.Join(answerValues(resp.Answer), ","); got != tc.wantAnswer {
+				t.Errorf("Expected answer %q, got %q", tc.wantAnswer, got)
+			}
+			if decision.Rule != tc.wantRule {
+				t.Errorf("Expected rule %q, got %q", tc.wantRule, decision.Rule)
+			}
+		})
+	}
+}
+
+// TestLocalZones tests that local zones are answered authoritatively,
+// for their sources only
+func TestLocalZones(t *testing.T) {
+	cfg := &config.DNSProxyConfig{
+		Listen: []string{"127.0.0.1:0"},
+		Zones: []config.DNSZoneConfig{
+			{
+				Name: "lan",
+				Records: []string{
+					"nas A 10.0.0.10",
+					"www CNAME nas",
+					"*.dev A 10.0.0.20",
+					"printer.office A 10.0.0.30",
+					"docs CNAME docs.example.com.",
+				},
+			},
+			{Name: "example.com", Sources: []string{"10.0.0.0/24"}, Records: []string{"app A 10.0.0.40"}},
+		},
+	}
+	s, err := NewServer(cfg, fakePolicy{}, fakeUpstream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		client     string
+		query      string
+		qtype      uint16
+		wantRcode  int
+		wantAnswer string
+		wantAuth   bool
+	}{
+		{name: "address", query: "nas.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: "10.0.0.10", wantAuth: true},
+		{name: "cname", query: "WWW.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: "nas.lan,10.0.0.10", wantAuth: true},
+		{name: "cname out of zone", query: "docs.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: "docs.example.com", wantAuth: true},
+		{name: "wildcard", query: "api.dev.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: "10.0.0.20", wantAuth: true},
+		{name: "no data", query: "nas.lan.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess, wantAuth: true},
+		{name: "empty non-terminal", query: "office.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAuth: true},
+		{name: "missing", query: "tv.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAuth: true},
+		{name: "inside horizon", client: "10.0.0.5", query: "app.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: "10.0.0.40", wantAuth: true},
+		{name: "outside horizon", client: "192.168.1.5", query: "app.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: "192.0.2.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := tc.client
+			if client == "" {
+				client = "10.0.0.5"
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(tc.query, tc.qtype)
+			name := strings.ToLower(strings.TrimSuffix(tc.query, "."))
+			decision := Decision{Verdict: VerdictForwarded}
+			resp := s.respond(req, net.ParseIP(client), name, true, &decision)
+			if resp == nil || resp.Rcode != tc.wantRcode {
+				t.Fatalf("Expected rcode %s, got %v", dns.RcodeToString[tc.wantRcode], resp)
+			}
+			if got := strings.Join(answerValues(resp.Answer), ","); got != tc.wantAnswer {
+				t.Errorf("Expected answer %q, got %q", tc.wantAnswer, got)
+			}
+			if resp.Authoritative != tc.wantAuth {
+				t.Errorf("Expected authoritative %v, got %v", tc.wantAuth, resp.Authoritative)
+			}
+			if tc.wantAuth && decision.Verdict != VerdictLocal {
+				t.Errorf("Expected verdict %s, got %s", VerdictLocal, decision.Verdict)
+			}
+		})
+	}
+}
+
+// TestLeases tests that the hostnames of DHCP leases are answered in their
+// zone, after its records
+func TestLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	expiry := time.Now().Add(time.Hour).Unix()
+	leases := fmt.Sprintf("%d 52:54:00:12:34:56 10.0.0.50 laptop *\n%d 52:54:00:12:34:57 10.0.0.51 nas *\n", expiry, expiry)
+	if err := os.WriteFile(path, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.DNSProxyConfig{
+		Listen: []string{"127.0.0.1:0"},
+		Zones: []config.DNSZoneConfig{{
+			Name:    "lan",
+			Records: []string{"nas A 10.0.0.10"},
+			Leases:  &config.DHCPLeasesConfig{File: path},
+		}},
+	}
+	s, err := NewServer(cfg, fakePolicy{}, fakeUpstream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.HostAddresses("Laptop.lan"); !reflect.DeepEqual(got, []string{"10.0.0.50"}) {
+		t.Errorf("Expected laptop.lan at 10.0.0.50, got %v", got)
+	}
+	if got := s.HostAddresses("nas.lan"); !reflect.DeepEqual(got, []string{"10.0.0.10"}) {
+		t.Errorf("Expected the record of nas.lan to take precedence, got %v", got)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("laptop.lan.", dns.TypeA)
+	decision := Decision{Verdict: VerdictForwarded}
+	resp := s.respond(req, net.ParseIP("10.0.0.5"), "laptop.lan", true, &decision)
+	if got := answerValues(resp.Answer); !reflect.DeepEqual(got, []string{"10.0.0.50"}) {
+		t.Errorf("Expected laptop.lan answered with 10.0.0.50, got %v", got)
+	}
+}
@@ -0,0 +1,63 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/internal/logfile"
+)
+
+// queryLog writes queries to the router's log, or to a file rotated once
+// it reaches its maximum size
+type queryLog struct {
+	file *logfile.File // nil logs to the router's log
+}
+
+// openQueryLog opens the log for cfg; a nil cfg logs nothing
+func openQueryLog(cfg *config.DNSQueryLogConfig) (*queryLog, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	return newQueryLog(cfg.File, cfg.EffectiveMaxSize(), cfg.EffectiveMaxBackups())
+}
+
+// newQueryLog opens the log file at path, rotated at maxSize bytes and
+// keeping maxBackups; "" logs to the router's log
+func newQueryLog(path string, maxSize int64, maxBackups int) (*queryLog, error) {
+	l := &queryLog{}
+	if path == "" {
+		return l, nil
+	}
+	file, err := logfile.Open(path, maxSize, maxBackups, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DNS query log: %w", err)
+	}
+	l.file = file
+	return l, nil
+}
+
+// write logs q
+func (l *queryLog) write(q Query) {
+	if l == nil {
+		return
+	}
+	if l.file == nil {
+		log.Printf("DNS query %s", q)
+		return
+	}
+
+	line := fmt.Sprintf("%s %s\n", q.Time.UTC().Format(time.RFC3339), q)
+	if err := l.file.Write([]byte(line)); err != nil {
+		log.Printf("Warning: failed to write DNS query log: %v", err)
+	}
+}
+
+// close closes the log file
+func (l *queryLog) close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,252 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// How often RPZ files are checked for changes
+const rpzCheckInterval = time.Minute
+
+// Policy actions of RPZ triggers
+const (
+	rpzNXDomain  = iota // CNAME .
+	rpzNoData           // CNAME *.
+	rpzPassthru         // CNAME rpz-passthru.
+	rpzDrop             // CNAME rpz-drop.
+	rpzTCPOnly          // CNAME rpz-tcp-only.
+	rpzLocalData        // Any other records, answered instead
+)
+
+// rpzAction is the policy of a trigger
+type rpzAction struct {
+	kind    int
+	records []dns.RR // Local data, with the trigger as owner
+}
+
+// rpzZone is a Response Policy Zone. Only QNAME triggers are supported;
+// IP, client IP and name server triggers are skipped when loading.
+type rpzZone struct {
+	name string // From the config, "" to name it after the zone
+	file string
+
+	mu      sync.RWMutex
+	label   string
+	stamp   string
+	actions map[string]*rpzAction // Trigger name without the origin -> action
+}
+
+// newRPZZones loads the zones configured, logging those that fail to load;
+// they are loaded once their file can be read
+func newRPZZones(cfgs []config.RPZConfig) []*rpzZone {
+	zones := make([]*rpzZone, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		zone := &rpzZone{name: cfg.Name, file: cfg.File, label: cfg.Name}
+		if zone.label == "" {
+			zone.label = filepath.Base(cfg.File)
+		}
+		if err := zone.reload(); err != nil {
+			log.Printf("Warning: failed to load RPZ %s: %v", cfg.File, err)
+		}
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// reload reads the zone file if it changed since it was last read,
+// keeping the current triggers on failure
+func (z *rpzZone) reload() error {
+	info, err := os.Stat(z.file)
+	if err != nil {
+		return err
+	}
+	stamp := fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+	z.mu.RLock()
+	unchanged := stamp == z.stamp
+	z.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	origin, actions, skipped, err := parseRPZ(z.file)
+	if err != nil {
+		return err
+	}
+	z.mu.Lock()
+	z.stamp = stamp
+	z.actions = actions
+	if z.name == "" && origin != "" {
+		z.label = origin
+	}
+	z.mu.Unlock()
+	log.Printf("Loaded RPZ %s with %d triggers", z.file, len(actions))
+	if skipped > 0 {
+		log.Printf("Warning: RPZ %s: skipped %d IP, client IP and name server triggers", z.file, skipped)
+	}
+	return nil
+}
+
+// parseRPZ reads a zone file, returning its origin, its QNAME triggers
+// and the number of other triggers skipped
+func parseRPZ(path string) (string, map[string]*rpzAction, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer file.Close()
+
+	// Triggers are kept relative to the zone's origin, which is the owner
+	// of its SOA: names given relative to no $ORIGIN are relative to the
+	// root, so they are already bare
+	origin := ""
+	var records []dns.RR
+	zp := dns.NewZoneParser(file, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if origin == "" {
+				origin = soa.Hdr.Name
+			}
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return "", nil, 0, fmt.Errorf("failed to parse RPZ: %w", err)
+	}
+
+	actions := make(map[string]*rpzAction)
+	skipped := 0
+	for _, rr := range records {
+		trigger := strings.ToLower(rr.Header().Name)
+		if origin != "" && origin != "." {
+			trigger = strings.TrimSuffix(trigger, "."+strings.ToLower(origin))
+		}
+		trigger = strings.TrimSuffix(trigger, ".")
+		if isSpecialTrigger(trigger) {
+			skipped++
+			continue
+		}
+		action := actions[trigger]
+		if action != nil && action.kind != rpzLocalData {
+			continue
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if kind, special := rpzCNAMEActions[strings.ToLower(cname.Target)]; special {
+				if action == nil {
+					actions[trigger] = &rpzAction{kind: kind}
+				}
+				continue
+			}
+		}
+		if action == nil {
+			action = &rpzAction{kind: rpzLocalData}
+			actions[trigger] = action
+		}
+		action.records = append(action.records, rr)
+	}
+	return strings.TrimSuffix(origin, "."), actions, skipped, nil
+}
+
+// rpzCNAMEActions are the actions encoded as CNAME targets
+var rpzCNAMEActions = map[string]int{
+	".":             rpzNXDomain,
+	"*.":            rpzNoData,
+	"rpz-passthru.": rpzPassthru,
+	"rpz-drop.":     rpzDrop,
+	"rpz-tcp-only.": rpzTCPOnly,
+}
+
+// isSpecialTrigger reports whether a trigger is not a QNAME trigger
+func isSpecialTrigger(trigger string) bool {
+	for _, suffix := range []string{"rpz-ip", "rpz-client-ip", "rpz-nsdname", "rpz-nsip"} {
+		if trigger == suffix || strings.HasSuffix(trigger, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the action for name: the exact trigger, or else the
+// wildcard trigger of its closest parent
+func (z *rpzZone) match(name string) *rpzAction {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if action, ok := z.actions[name]; ok {
+		return action
+	}
+	for parent := name; ; {
+		i := strings.IndexByte(parent, '.')
+		if i < 0 {
+			return nil
+		}
+		parent = parent[i+1:]
+		if action, ok := z.actions["*."+parent]; ok {
+			return action
+		}
+	}
+}
+
+// zoneLabel returns the name of the zone for the query log
+func (z *rpzZone) zoneLabel() string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.label
+}
+
+// matchRPZ returns the action of the first zone with a trigger for name
+func matchRPZ(zones []*rpzZone, name string) (*rpzZone, *rpzAction) {
+	for _, zone := range zones {
+		if action := zone.match(name); action != nil {
+			return zone, action
+		}
+	}
+	return nil, nil
+}
+
+// reloadRPZ reloads changed zone files until stop is closed
+func reloadRPZ(zones []*rpzZone, stop <-chan struct{}) {
+	ticker := time.NewTicker(rpzCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, zone := range zones {
+				if err := zone.reload(); err != nil {
+					log.Printf("Warning: failed to reload RPZ %s, keeping the current triggers: %v", zone.file, err)
+				}
+			}
+		}
+	}
+}
+
+// rpzAnswer returns the answer to req for local data, with records of its
+// type or CNAMEs
+func rpzAnswer(req *dns.Msg, action *rpzAction) *dns.Msg {
+	q := req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	for _, rr := range action.records {
+		if rr.Header().Rrtype != q.Qtype && rr.Header().Rrtype != dns.TypeCNAME {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp
+}
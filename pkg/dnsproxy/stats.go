@@ -0,0 +1,156 @@
+package dnsproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Clients beyond this many replace the one seen least recently
+	maxClients = 4096
+	// Domains of a client beyond this many replace its least queried one
+	maxDomainsPerClient = 1024
+	// DefaultTop is the number of domains per client returned by default
+	DefaultTop = 10
+)
+
+// ClientStats are the queries of a client since the router started
+type ClientStats struct {
+	Client  string `json:"client"`
+	Queries uint64 `json:"queries"`
+	// Blocked counts the queries for names the policy denies
+	Blocked    uint64        `json:"blocked"`
+	LastSeen   time.Time     `json:"last_seen"`
+	TopQueried []DomainCount `json:"top_queried"`
+	TopBlocked []DomainCount `json:"top_blocked"`
+}
+
+// DomainCount is the number of queries for a domain
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+}
+
+// clientCounts counts the queries of a client
+type clientCounts struct {
+	queries  uint64
+	blocked  uint64
+	lastSeen time.Time
+	queried  map[string]uint64 // Domain -> queries
+	denied   map[string]uint64 // Domain -> denied or blocked queries
+}
+
+// stats counts queries per client, bounded in the number of clients and
+// domains kept
+type stats struct {
+	mu      sync.Mutex
+	clients map[string]*clientCounts
+}
+
+func newStats() *stats {
+	return &stats{clients: make(map[string]*clientCounts)}
+}
+
+// add counts q
+func (st *stats) add(q Query) {
+	if q.Client == nil {
+		return
+	}
+	key := q.Client.String()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	counts := st.clients[key]
+	if counts == nil {
+		if len(st.clients) >= maxClients {
+			st.evictClient()
+		}
+		counts = &clientCounts{queried: make(map[string]uint64), denied: make(map[string]uint64)}
+		st.clients[key] = counts
+	}
+	counts.queries++
+	counts.lastSeen = q.Time
+	increment(counts.queried, q.Name)
+	if q.Verdict == VerdictBlocked || q.Verdict == VerdictDenied {
+		counts.blocked++
+		increment(counts.denied, q.Name)
+	}
+}
+
+// evictClient forgets the client seen least recently
+// Must be called with mu held
+func (st *stats) evictClient() {
+	var oldest string
+	for key, counts := range st.clients {
+		if oldest == "" || counts.lastSeen.Before(st.clients[oldest].lastSeen) {
+			oldest = key
+		}
+	}
+	delete(st.clients, oldest)
+}
+
+// increment counts a query for domain, replacing the least queried domain
+// when the map is full
+func increment(domains map[string]uint64, domain string) {
+	if _, ok := domains[domain]; !ok && len(domains) >= maxDomainsPerClient {
+		var least string
+		for d, count := range domains {
+			if least == "" || count < domains[least] {
+				least = d
+			}
+		}
+		delete(domains, least)
+	}
+	domains[domain]++
+}
+
+// snapshot returns the stats of every client, or of client if set
+func (st *stats) snapshot(client net.IP, top int) []ClientStats {
+	if top <= 0 {
+		top = DefaultTop
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var result []ClientStats
+	for key, counts := range st.clients {
+		if client != nil && key != client.String() {
+			continue
+		}
+		result = append(result, ClientStats{
+			Client:     key,
+			Queries:    counts.queries,
+			Blocked:    counts.blocked,
+			LastSeen:   counts.lastSeen,
+			TopQueried: topDomains(counts.queried, top),
+			TopBlocked: topDomains(counts.denied, top),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Queries != result[j].Queries {
+			return result[i].Queries > result[j].Queries
+		}
+		return result[i].Client < result[j].Client
+	})
+	return result
+}
+
+// topDomains returns the n domains with the most queries
+func topDomains(domains map[string]uint64, n int) []DomainCount {
+	counts := make([]DomainCount, 0, len(domains))
+	for domain, count := range domains {
+		counts = append(counts, DomainCount{Domain: domain, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Domain < counts[j].Domain
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
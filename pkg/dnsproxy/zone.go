@@ -0,0 +1,388 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dhcp"
+)
+
+const (
+	// CNAMEs followed within a local zone before answering with the chain
+	maxCNAMEChain = 8
+	// How often lease files are checked for changes
+	leaseCheckInterval = 10 * time.Second
+)
+
+// localZone is a zone answered by the proxy, for some clients only when
+// it serves a split horizon. The hostnames of DHCP leases are added to its
+// records, which take precedence.
+type localZone struct {
+	origin  string // Fully qualified, lower case
+	sources []*net.IPNet
+	soa     *dns.SOA
+	records map[string][]dns.RR // Owner -> records
+	names   map[string]bool     // Owners and the names between them and the origin
+	leases  *config.DHCPLeasesConfig
+	ttl     uint32
+
+	mu         sync.RWMutex
+	leaseStamp string
+	leased     map[string][]dns.RR // Owner -> A and AAAA records of leases
+}
+
+// newLocalZones loads the zones configured
+func newLocalZones(cfgs []config.DNSZoneConfig) ([]*localZone, error) {
+	zones := make([]*localZone, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		zone, err := loadLocalZone(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load zone %s: %w", cfg.Name, err)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// loadLocalZone reads the records and file of a zone, adding an SOA if
+// neither has one
+func loadLocalZone(cfg config.DNSZoneConfig) (*localZone, error) {
+	records, err := cfg.ParseRecords()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.File != "" {
+		file, err := os.Open(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		zp := dns.NewZoneParser(file, cfg.Origin(), cfg.File)
+		zp.SetDefaultTTL(uint32(cfg.EffectiveTTL().Seconds()))
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			if dns.IsSubDomain(cfg.Origin(), rr.Header().Name) {
+				records = append(records, rr)
+			}
+		}
+		if err := zp.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	z := &localZone{
+		origin:  cfg.Origin(),
+		records: make(map[string][]dns.RR),
+		names:   map[string]bool{cfg.Origin(): true},
+		leases:  cfg.Leases,
+		ttl:     uint32(cfg.EffectiveTTL().Seconds()),
+	}
+	for _, src := range cfg.Sources {
+		network, err := parseNetwork(src)
+		if err != nil {
+			return nil, err
+		}
+		z.sources = append(z.sources, network)
+	}
+	for _, rr := range records {
+		if soa, ok := rr.(*dns.SOA); ok && z.soa == nil {
+			z.soa = soa
+		}
+		z.add(rr)
+	}
+	if z.soa == nil {
+		z.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: z.origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: z.ttl},
+			Ns:      z.origin,
+			Mbox:    "hostmaster." + z.origin,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  z.ttl,
+		}
+		z.add(z.soa)
+	}
+	if z.leases != nil {
+		if _, err := z.reloadLeases(); err != nil {
+			log.Printf("Warning: failed to read DHCP leases %s: %v", z.leases.File, err)
+		}
+	}
+	return z, nil
+}
+
+// reloadLeases registers the hostnames of the active leases if the lease
+// file changed since it was last read, reporting whether they changed.
+// The current leases are kept on failure.
+func (z *localZone) reloadLeases() (bool, error) {
+	info, err := os.Stat(z.leases.File)
+	if err != nil {
+		return false, err
+	}
+	// Leases also end without the file changing
+	stamp := fmt.Sprintf("%d:%d:%d", info.Size(), info.ModTime().UnixNano(), time.Now().Unix()/60)
+	z.mu.RLock()
+	unchanged := stamp == z.leaseStamp
+	z.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	leases, err := dhcp.ReadLeases(z.leases.File, z.leases.EffectiveFormat(), time.Now())
+	if err != nil {
+		return false, err
+	}
+	leased := make(map[string][]dns.RR)
+	for _, lease := range leases {
+		owner := lease.Hostname + "." + z.origin
+		hdr := dns.RR_Header{Name: owner, Class: dns.ClassINET, Ttl: z.ttl}
+		if ip4 := lease.IP.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			leased[owner] = append(leased[owner], &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			leased[owner] = append(leased[owner], &dns.AAAA{Hdr: hdr, AAAA: lease.IP})
+		}
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.leaseStamp = stamp
+	changed := !sameRecords(z.leased, leased)
+	z.leased = leased
+	return changed, nil
+}
+
+// sameRecords reports whether a and b hold the same records
+func sameRecords(a, b map[string][]dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for owner, records := range a {
+		if len(b[owner]) != len(records) {
+			return false
+		}
+		for i := range records {
+			if records[i].String() != b[owner][i].String() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// watchLeases reloads the lease files of the zones as they change until
+// stop is closed, calling changed when the hostnames or addresses do
+func watchLeases(zones []*localZone, stop <-chan struct{}, changed func()) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded := false
+			for _, zone := range zones {
+				if zone.leases == nil {
+					continue
+				}
+				zoneChanged, err := zone.reloadLeases()
+				if err != nil {
+					log.Printf("Warning: failed to read DHCP leases %s, keeping the current ones: %v", zone.leases.File, err)
+				}
+				reloaded = reloaded || zoneChanged
+			}
+			if reloaded && changed != nil {
+				changed()
+			}
+		}
+	}
+}
+
+// hostAddresses returns the addresses of name in the zone
+func (z *localZone) hostAddresses(name string) []string {
+	records, _ := z.lookup(name)
+	var addrs []string
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	return addrs
+}
+
+// hasLeases reports whether a zone registers DHCP leases
+func hasLeases(zones []*localZone) bool {
+	for _, zone := range zones {
+		if zone.leases != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneHostAddresses returns the addresses of name in every zone, sorted
+func zoneHostAddresses(zones []*localZone, name string) []string {
+	name = strings.ToLower(dns.Fqdn(name))
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, zone := range zones {
+		if !dns.IsSubDomain(zone.origin, name) {
+			continue
+		}
+		for _, addr := range zone.hostAddresses(name) {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// add adds a record, marking the names above it as existing
+func (z *localZone) add(rr dns.RR) {
+	owner := strings.ToLower(rr.Header().Name)
+	z.records[owner] = append(z.records[owner], rr)
+	for name := owner; name != z.origin && name != "."; {
+		z.names[name] = true
+		i := strings.IndexByte(name, '.')
+		name = name[i+1:]
+	}
+}
+
+// serves reports whether the zone answers name for client
+func (z *localZone) serves(client net.IP, name string) bool {
+	if !dns.IsSubDomain(z.origin, name) {
+		return false
+	}
+	if len(z.sources) == 0 {
+		return true
+	}
+	for _, network := range z.sources {
+		if client != nil && network.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchZone returns the most specific zone answering name for client,
+// the first listed of those with the same name
+func matchZone(zones []*localZone, client net.IP, name string) *localZone {
+	name = dns.Fqdn(name)
+	var match *localZone
+	for _, zone := range zones {
+		if zone.serves(client, name) && (match == nil || len(zone.origin) > len(match.origin)) {
+			match = zone
+		}
+	}
+	return match
+}
+
+// lookup returns the records of name, or of the closest wildcard covering
+// it, and whether the name exists
+func (z *localZone) lookup(name string) ([]dns.RR, bool) {
+	if records, ok := z.records[name]; ok {
+		return records, true
+	}
+	if z.names[name] {
+		return nil, true
+	}
+	z.mu.RLock()
+	records, ok := z.leased[name]
+	z.mu.RUnlock()
+	if ok {
+		return records, true
+	}
+	for parent := name; parent != z.origin; {
+		i := strings.IndexByte(parent, '.')
+		parent = parent[i+1:]
+		if records, ok := z.records["*."+parent]; ok {
+			return records, true
+		}
+		if z.names[parent] {
+			break
+		}
+	}
+	return nil, false
+}
+
+// answer answers req authoritatively, following CNAMEs within the zone
+func (z *localZone) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	owner := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		records, exists := z.lookup(name)
+		if !exists {
+			if i == 0 {
+				resp.Rcode = dns.RcodeNameError
+				resp.Ns = []dns.RR{z.soa}
+			}
+			return resp
+		}
+		var cname *dns.CNAME
+		for _, rr := range records {
+			typ := rr.Header().Rrtype
+			if typ == q.Qtype || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, withOwner(rr, owner))
+			} else if typ == dns.TypeCNAME {
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if len(resp.Answer) > 0 || cname == nil {
+			if len(resp.Answer) == 0 {
+				resp.Ns = []dns.RR{z.soa}
+			}
+			return resp
+		}
+		resp.Answer = append(resp.Answer, withOwner(cname, owner))
+		owner = cname.Target
+		name = strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			// The client resolves the target itself
+			return resp
+		}
+	}
+	return resp
+}
+
+// withOwner returns a copy of rr named owner, for wildcard answers
+func withOwner(rr dns.RR, owner string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = owner
+	return rr
+}
+
+// parseNetwork parses an address or a CIDR network
+func parseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	return network, nil
+}
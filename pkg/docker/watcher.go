@@ -0,0 +1,321 @@
+// Package docker follows the containers of a Docker host, assigning the
+// addresses of containers labeled with a profile name to that profile as
+// they start and stop.
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+const (
+	defaultSocket = "/var/run/docker.sock"
+	defaultLabel  = "legion.policy"
+	maxBackoff    = 30 * time.Second
+)
+
+// errNotFound is returned for containers that are gone
+var errNotFound = errors.New("container not found")
+
+// Backend tracks the containers assigned to profiles
+type Backend interface {
+	SetContainer(id string, container filter.Container) error
+	RemoveContainer(id string) error
+	Containers() map[string]filter.Container
+}
+
+// Watcher follows container events from the Docker API
+type Watcher struct {
+	backend Backend
+	label   string
+	client  *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWatcher creates a watcher for the Docker host in cfg
+func NewWatcher(cfg *config.DockerConfig, backend Backend) *Watcher {
+	socket := cfg.Socket
+	if socket == "" {
+		socket = defaultSocket
+	}
+	label := cfg.Label
+	if label == "" {
+		label = defaultLabel
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Watcher{
+		backend: backend,
+		label:   label,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start begins following containers in the background
+func (w *Watcher) Start() {
+	log.Printf("Assigning Docker containers to profiles by label %s", w.label)
+	w.wg.Add(1)
+	go w.run()
+}
+
+// Stop stops following containers
+func (w *Watcher) Stop() error {
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+// run watches events, reconnecting with backoff when the stream ends, e.g.
+// because the Docker daemon restarted
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	backoff := time.Second
+	for {
+		synced, err := w.watch()
+		if w.ctx.Err() != nil {
+			return
+		}
+		if synced {
+			backoff = time.Second
+		}
+		log.Printf("Warning: Docker event stream ended, reconnecting in %s: %v", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// event is a Docker event
+type event struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// watch subscribes to events, synchronizes the running containers and
+// handles events until the stream ends; synced reports whether the
+// synchronization succeeded
+func (w *Watcher) watch() (synced bool, err error) {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container", "network"},
+		"event": {"start", "die", "connect", "disconnect"},
+	})
+	resp, err := w.get("/events?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// Events from here on are delivered, so nothing is missed between the
+	// listing and the stream
+	if err := w.sync(); err != nil {
+		return false, err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e event
+		if err := decoder.Decode(&e); err != nil {
+			return true, err
+		}
+		w.handle(e)
+	}
+}
+
+// handle applies an event
+func (w *Watcher) handle(e event) {
+	id := e.Actor.ID
+	switch {
+	case e.Type == "container" && e.Action == "die":
+		if err := w.backend.RemoveContainer(id); err != nil {
+			log.Printf("Warning: failed to remove container %s: %v", shortID(id), err)
+		}
+		return
+	case e.Type == "container" && e.Action == "start":
+		if _, ok := e.Actor.Attributes[w.label]; !ok {
+			return
+		}
+	case e.Type == "network":
+		// Connecting to or disconnecting from a network changes the
+		// addresses of a running container
+		id = e.Actor.Attributes["container"]
+	default:
+		return
+	}
+	if err := w.update(id); err != nil {
+		log.Printf("Warning: failed to update container %s: %v", shortID(id), err)
+	}
+}
+
+// update reads a container and assigns it to its profile, or removes it if
+// it is gone or no longer labeled
+func (w *Watcher) update(id string) error {
+	var c struct {
+		ID     string `json:"Id"`
+		Name   string `json:"Name"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		State struct {
+			Running bool `json:"Running"`
+		} `json:"State"`
+		NetworkSettings networkSettings `json:"NetworkSettings"`
+	}
+	err := w.getJSON("/containers/"+url.PathEscape(id)+"/json", &c)
+	if errors.Is(err, errNotFound) {
+		return w.backend.RemoveContainer(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	profile := c.Config.Labels[w.label]
+	if profile == "" || !c.State.Running {
+		return w.backend.RemoveContainer(c.ID)
+	}
+	return w.set(c.ID, strings.TrimPrefix(c.Name, "/"), profile, c.NetworkSettings)
+}
+
+// sync assigns the running labeled containers and removes the containers
+// that stopped while the watcher was disconnected
+func (w *Watcher) sync() error {
+	filters, _ := json.Marshal(map[string][]string{"label": {w.label}})
+	var containers []struct {
+		ID              string            `json:"Id"`
+		Names           []string          `json:"Names"`
+		Labels          map[string]string `json:"Labels"`
+		NetworkSettings networkSettings   `json:"NetworkSettings"`
+	}
+	if err := w.getJSON("/containers/json?filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return err
+	}
+
+	running := make(map[string]bool)
+	for _, c := range containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		running[c.ID] = true
+		if err := w.set(c.ID, name, c.Labels[w.label], c.NetworkSettings); err != nil {
+			log.Printf("Warning: failed to assign container %s: %v", name, err)
+		}
+	}
+	for id := range w.backend.Containers() {
+		if !running[id] {
+			if err := w.backend.RemoveContainer(id); err != nil {
+				log.Printf("Warning: failed to remove container %s: %v", shortID(id), err)
+			}
+		}
+	}
+	return nil
+}
+
+// networkSettings holds a container's addresses on each network
+type networkSettings struct {
+	Networks map[string]struct {
+		IPAddress         string `json:"IPAddress"`
+		GlobalIPv6Address string `json:"GlobalIPv6Address"`
+	} `json:"Networks"`
+}
+
+// addresses returns the addresses of a container on all its networks
+func (n networkSettings) addresses() []string {
+	var addrs []string
+	for _, network := range n.Networks {
+		for _, addr := range []string{network.IPAddress, network.GlobalIPv6Address} {
+			if addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// set assigns a container to profile
+func (w *Watcher) set(id, name, profile string, settings networkSettings) error {
+	addrs := settings.addresses()
+	if len(addrs) == 0 {
+		// Containers sharing the host's network have no addresses of their
+		// own to match
+		log.Printf("Warning: container %s has no addresses, not assigning it to profile %s", name, profile)
+		return w.backend.RemoveContainer(id)
+	}
+	return w.backend.SetContainer(id, filter.Container{Name: name, Profile: profile, Addresses: addrs})
+}
+
+// get sends a GET request to the Docker API
+func (w *Watcher) get(path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Docker API: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker API returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// getJSON decodes the response to a GET request into v
+func (w *Watcher) getJSON(path string, v interface{}) error {
+	resp, err := w.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// shortID shortens a container ID as the Docker CLI shows it
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
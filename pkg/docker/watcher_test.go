@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// fakeBackend records containers without touching nftables
+type fakeBackend struct {
+	containers map[string]filter.Container
+}
+
+func (b *fakeBackend) SetContainer(id string, container filter.Container) error {
+	b.containers[id] = container
+	return nil
+}
+
+func (b *fakeBackend) RemoveContainer(id string) error {
+	delete(b.containers, id)
+	return nil
+}
+
+func (b *fakeBackend) Containers() map[string]filter.Container {
+	return b.containers
+}
+
+// TestWatch tests synchronizing the running containers and following
+// their events
+func TestWatch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("filters") != `{"label":["legion.policy"]}` {
+			t.Errorf("Unexpected filters: %s", r.URL.Query().Get("filters"))
+		}
+		fmt.Fprint(w, `[{"Id": "aaa", "Names": ["/runner-1"], "Labels": {"legion.policy": "ci-runner"},
+			"NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2", "GlobalIPv6Address": "fd00::2"}}}}]`)
+	})
+	mux.HandleFunc("/containers/bbb/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Id": "bbb", "Name": "/runner-2", "Config": {"Labels": {"legion.policy": "ci-runner"}},
+			"State": {"Running": true}, "NetworkSettings": {"Networks": {"ci": {"IPAddress": "172.18.0.3"}}}}`)
+	})
+	mux.HandleFunc("/containers/ccc/json", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"Type": "container", "Action": "start", "Actor": {"ID": "bbb", "Attributes": {"legion.policy": "ci-runner"}}}`)
+		fmt.Fprintln(w, `{"Type": "container", "Action": "start", "Actor": {"ID": "unlabeled", "Attributes": {}}}`)
+		fmt.Fprintln(w, `{"Type": "container", "Action": "die", "Actor": {"ID": "aaa"}}`)
+		fmt.Fprintln(w, `{"Type": "network", "Action": "disconnect", "Actor": {"ID": "net", "Attributes": {"container": "ccc"}}}`)
+	})
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	backend := &fakeBackend{containers: map[string]filter.Container{
+		"ccc":   {Name: "runner-3", Profile: "ci-runner", Addresses: []string{"172.17.0.4"}},
+		"stale": {Name: "old", Profile: "ci-runner", Addresses: []string{"172.17.0.9"}},
+	}}
+	w := NewWatcher(&config.DockerConfig{Socket: socket}, backend)
+	defer w.Stop()
+
+	synced, err := w.watch()
+	if !synced {
+		t.Fatalf("Expected the containers to be synchronized: %v", err)
+	}
+
+	want := map[string]filter.Container{
+		"bbb": {Name: "runner-2", Profile: "ci-runner", Addresses: []string{"172.18.0.3"}},
+	}
+	if !reflect.DeepEqual(backend.containers, want) {
+		t.Errorf("Expected containers %+v, got %+v", want, backend.containers)
+	}
+}
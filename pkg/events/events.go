@@ -0,0 +1,413 @@
+// Package events stores the connections the router allows and denies and
+// its policy reloads in an embedded database, so that small deployments can
+// look back at what happened without an external logging stack. Events are
+// keyed by time, kept for a retention period and queried by time range and
+// filters.
+package events
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/internal/netutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Event types
+const (
+	TypeAllow  = "allow"
+	TypeDeny   = "deny"
+	TypeReload = "reload"
+	// TypeHoneypot is a connection redirected to the honeypot, with what
+	// the client sent
+	TypeHoneypot = "honeypot"
+)
+
+const (
+	// DefaultRetention is how long events are kept unless configured
+	DefaultRetention = 7 * 24 * time.Hour
+	// DefaultMaxEvents bounds the events kept unless configured
+	DefaultMaxEvents = 1000000
+
+	// Events are written in batches, as a transaction per connection
+	// would cost a disk sync each
+	flushInterval = time.Second
+	pruneInterval = time.Hour
+	// Events waiting to be written beyond this are dropped
+	maxPending = 10000
+)
+
+var eventsBucket = []byte("events")
+
+// Event is a stored event
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"` // allow, deny, reload or honeypot
+	// Rule deciding a connection, "" for connections no rule matched
+	Rule        string `json:"rule,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	Source      net.IP `json:"source,omitempty"`
+	SourcePort  uint16 `json:"source_port,omitempty"`
+	Destination net.IP `json:"destination,omitempty"`
+	Port        uint16 `json:"port,omitempty"`
+	Domain      string `json:"domain,omitempty"`
+	// PID, Process and Cgroup own the connection's socket on the router
+	// host, if the connection log attributes them
+	PID     int    `json:"pid,omitempty"`
+	Process string `json:"process,omitempty"`
+	Cgroup  string `json:"cgroup,omitempty"`
+	// Policy is the hash of the policy a reload applied
+	Policy string `json:"policy,omitempty"`
+	// Error is why a reload failed
+	Error string `json:"error,omitempty"`
+	// Request is what the client of a honeypot connection sent
+	Request string `json:"request,omitempty"`
+}
+
+// String formats the event as a line, without the time
+func (e Event) String() string {
+	var b strings.Builder
+	b.WriteString(e.Type)
+	if e.Type == TypeReload {
+		if e.Policy != "" {
+			fmt.Fprintf(&b, " policy=%s", e.Policy)
+		}
+		if e.Error != "" {
+			fmt.Fprintf(&b, " error=%q", e.Error)
+		}
+		return b.String()
+	}
+	if e.Rule != "" {
+		fmt.Fprintf(&b, " rule=%s", e.Rule)
+	}
+	fmt.Fprintf(&b, " proto=%s", e.Protocol)
+	if e.Interface != "" {
+		fmt.Fprintf(&b, " in=%s", e.Interface)
+	}
+	fmt.Fprintf(&b, " src=%s dst=%s", netutil.HostPort(e.Source, e.SourcePort), netutil.HostPort(e.Destination, e.Port))
+	if e.Domain != "" {
+		fmt.Fprintf(&b, " domain=%s", e.Domain)
+	}
+	if e.PID != 0 {
+		fmt.Fprintf(&b, " pid=%d comm=%s", e.PID, e.Process)
+		if e.Cgroup != "" {
+			fmt.Fprintf(&b, " cgroup=%s", e.Cgroup)
+		}
+	}
+	if e.Request != "" {
+		fmt.Fprintf(&b, " request=%q", e.Request)
+	}
+	return b.String()
+}
+
+// Retention bounds the events a store keeps
+type Retention struct {
+	// MaxAge drops events older than it (default 7 days)
+	MaxAge time.Duration
+	// MaxEvents drops the oldest events beyond it (default 1000000)
+	MaxEvents int
+}
+
+// Store keeps events in a bbolt database
+type Store struct {
+	db        *bolt.DB
+	retention Retention
+
+	mu      sync.Mutex
+	pending []Event
+	dropped int
+	closed  bool
+}
+
+// Open opens or creates the store at path. The database is locked while
+// open, so a router's store can only be read through it.
+func Open(path string, retention Retention) (*Store, error) {
+	if retention.MaxAge == 0 {
+		retention.MaxAge = DefaultRetention
+	}
+	if retention.MaxEvents == 0 {
+		retention.MaxEvents = DefaultMaxEvents
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize event store %s: %w", path, err)
+	}
+	return &Store{db: db, retention: retention}, nil
+}
+
+// OpenReadOnly opens the store at path for queries, while no router has it
+// open
+func OpenReadOnly(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event store %s: %w", path, err)
+	}
+	return &Store{db: db, closed: true}, nil
+}
+
+// Record queues an event to be written with the next batch
+func (s *Store) Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if len(s.pending) >= maxPending {
+		s.dropped++
+		return
+	}
+	s.pending = append(s.pending, event)
+}
+
+// Run writes the queued events every second and drops those past the
+// retention every hour, until stop is closed
+func (s *Store) Run(stop <-chan struct{}) {
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	s.prune(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case <-flush.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("Warning: failed to write events: %v", err)
+			}
+		case now := <-prune.C:
+			s.prune(now)
+		}
+	}
+}
+
+// prune applies the retention, logging failures
+func (s *Store) prune(now time.Time) {
+	if n, err := s.Prune(now); err != nil {
+		log.Printf("Warning: failed to prune events: %v", err)
+	} else if n > 0 {
+		log.Printf("Pruned %d events past the retention", n)
+	}
+}
+
+// Flush writes the queued events
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	pending, dropped := s.pending, s.dropped
+	s.pending, s.dropped = nil, 0
+	s.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Warning: dropped %d events, more arrived than could be written", dropped)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		for _, event := range pending {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("failed to encode event: %w", err)
+			}
+			if err := bucket.Put(eventKey(event.Time, seq), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// eventKey orders events by time, then by when they were written
+func eventKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// Prune drops the events older than the retention allows as of now, then
+// the oldest beyond the maximum count, and returns how many it dropped
+func (s *Store) Prune(now time.Time) (int, error) {
+	dropped := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		excess := bucket.Stats().KeyN - s.retention.MaxEvents
+		cutoff := eventKey(now.Add(-s.retention.MaxAge), 0)
+
+		// Deleting under a cursor skips keys, so the keys are collected
+		// first
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(keys) >= excess && string(k) >= string(cutoff) {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		dropped = len(keys)
+		return nil
+	})
+	return dropped, err
+}
+
+// Query selects events; unset fields select all
+type Query struct {
+	Since time.Time
+	Until time.Time
+	// Types selects events of any of the types
+	Types []string
+	Rule  string
+	// Source and Destination select connections from and to addresses in
+	// the networks
+	Source      *net.IPNet
+	Destination *net.IPNet
+	Port        uint16
+	// Domain selects connections to a domain containing it,
+	// case-insensitively
+	Domain string
+	// Limit returns the latest events selected; 0 returns them all
+	Limit int
+}
+
+// matches reports whether q selects event
+func (q Query) matches(event Event) bool {
+	if len(q.Types) > 0 {
+		found := false
+		for _, t := range q.Types {
+			found = found || t == event.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Rule != "" && event.Rule != q.Rule {
+		return false
+	}
+	if q.Source != nil && (event.Source == nil || !q.Source.Contains(event.Source)) {
+		return false
+	}
+	if q.Destination != nil && (event.Destination == nil || !q.Destination.Contains(event.Destination)) {
+		return false
+	}
+	if q.Port != 0 && event.Port != q.Port {
+		return false
+	}
+	if q.Domain != "" && !strings.Contains(strings.ToLower(event.Domain), strings.ToLower(q.Domain)) {
+		return false
+	}
+	return true
+}
+
+// Query returns the events q selects, oldest first
+func (s *Store) Query(q Query) ([]Event, error) {
+	events := []Event{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		// Walk back from the end of the range, so the limit keeps the
+		// latest events
+		c := bucket.Cursor()
+		var k, v []byte
+		if q.Until.IsZero() {
+			k, v = c.Last()
+		} else if k, v = c.Seek(eventKey(q.Until, 0)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		since := eventKey(q.Since, 0)
+		for ; k != nil; k, v = c.Prev() {
+			if !q.Since.IsZero() && string(k) < string(since) {
+				break
+			}
+			var event Event
+			if err := json.Unmarshal(v, &event); err != nil {
+				return fmt.Errorf("failed to decode event: %w", err)
+			}
+			if !q.matches(event) {
+				continue
+			}
+			events = append(events, event)
+			if q.Limit > 0 && len(events) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// Close writes the queued events and closes the database
+func (s *Store) Close() error {
+	s.mu.Lock()
+	wasClosed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+
+	if !wasClosed {
+		if err := s.Flush(); err != nil {
+			log.Printf("Warning: failed to write events: %v", err)
+		}
+	}
+	return s.db.Close()
+}
+
+// ParseNetwork parses an address or a CIDR network, as the source and
+// destination of a query
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,198 @@
+package events
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordTestEvents stores a reload and connections a minute apart from base
+func recordTestEvents(t *testing.T, store *Store, base time.Time) {
+	t.Helper()
+	for i, event := range []Event{
+		{Type: TypeReload, Policy: "abc123"},
+		{Type: TypeAllow, Rule: "allow-github", Protocol: "tcp", Source: net.ParseIP("10.0.0.5"), Destination: net.ParseIP("140.82.112.3"), Port: 443, Domain: "github.com"},
+		{Type: TypeDeny, Rule: "block-metadata", Protocol: "tcp", Source: net.ParseIP("10.0.1.7"), Destination: net.ParseIP("169.254.169.254"), Port: 80},
+		{Type: TypeAllow, Rule: "allow-github", Protocol: "tcp", Source: net.ParseIP("10.0.1.7"), Destination: net.ParseIP("140.82.112.4"), Port: 443, Domain: "api.GitHub.com"},
+		{Type: TypeDeny, Protocol: "udp", Source: net.ParseIP("fd00::5"), Destination: net.ParseIP("2001:db8::1"), Port: 53},
+	} {
+		event.Time = base.Add(time.Duration(i) * time.Minute)
+		store.Record(event)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Failed to write events: %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	store, err := Open(filepath.Join(t.TempDir(), "events.db"), Retention{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	recordTestEvents(t, store, base)
+
+	mustNetwork := func(s string) *net.IPNet {
+		network, err := ParseNetwork(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return network
+	}
+
+	testCases := []struct {
+		name  string
+		query Query
+		want  []time.Duration // Offsets from base of the events returned
+	}{
+		{
+			name:  "all",
+			query: Query{},
+			want:  []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute, 4 * time.Minute},
+		},
+		{
+			name:  "time range",
+			query: Query{Since: base.Add(time.Minute), Until: base.Add(3 * time.Minute)},
+			want:  []time.Duration{time.Minute, 2 * time.Minute},
+		},
+		{
+			name:  "limit keeps the latest",
+			query: Query{Limit: 2},
+			want:  []time.Duration{3 * time.Minute, 4 * time.Minute},
+		},
+		{
+			name:  "types",
+			query: Query{Types: []string{TypeDeny, TypeReload}},
+			want:  []time.Duration{0, 2 * time.Minute, 4 * time.Minute},
+		},
+		{
+			name:  "rule",
+			query: Query{Rule: "allow-github"},
+			want:  []time.Duration{time.Minute, 3 * time.Minute},
+		},
+		{
+			name:  "source network",
+			query: Query{Source: mustNetwork("10.0.1.0/24")},
+			want:  []time.Duration{2 * time.Minute, 3 * time.Minute},
+		},
+		{
+			name:  "destination and port",
+			query: Query{Destination: mustNetwork("2001:db8::1"), Port: 53},
+			want:  []time.Duration{4 * time.Minute},
+		},
+		{
+			name:  "domain case-insensitively",
+			query: Query{Domain: "api.github"},
+			want:  []time.Duration{3 * time.Minute},
+		},
+		{
+			name:  "nothing in range",
+			query: Query{Since: base.Add(time.Hour)},
+			want:  []time.Duration{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := store.Query(tc.query)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			got := []time.Duration{}
+			for _, event := range found {
+				got = append(got, event.Time.Sub(base))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected events at %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name        string
+		retention   Retention
+		now         time.Time
+		wantDropped int
+	}{
+		{
+			name:        "within retention",
+			retention:   Retention{MaxAge: time.Hour},
+			now:         base.Add(30 * time.Minute),
+			wantDropped: 0,
+		},
+		{
+			name:        "past max age",
+			retention:   Retention{MaxAge: time.Hour},
+			now:         base.Add(time.Hour + 150*time.Second),
+			wantDropped: 3,
+		},
+		{
+			name:        "beyond max events",
+			retention:   Retention{MaxAge: time.Hour, MaxEvents: 2},
+			now:         base,
+			wantDropped: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := Open(filepath.Join(t.TempDir(), "events.db"), tc.retention)
+			if err != nil {
+				t.Fatalf("Failed to open store: %v", err)
+			}
+			defer store.Close()
+			recordTestEvents(t, store, base)
+
+			dropped, err := store.Prune(tc.now)
+			if err != nil {
+				t.Fatalf("Prune failed: %v", err)
+			}
+			if dropped != tc.wantDropped {
+				t.Errorf("Expected %d events dropped, got %d", tc.wantDropped, dropped)
+			}
+			left, err := store.Query(Query{})
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			if len(left) != 5-tc.wantDropped {
+				t.Errorf("Expected %d events left, got %d", 5-tc.wantDropped, len(left))
+			}
+			if len(left) > 0 && left[0].Time.Before(base.Add(time.Duration(tc.wantDropped)*time.Minute)) {
+				t.Errorf("Expected the oldest events dropped, %s is left", left[0].Time)
+			}
+		})
+	}
+}
+
+func TestReadOnlyAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	store, err := Open(path, Retention{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.Record(Event{Time: time.Now(), Type: TypeReload, Policy: "abc123"})
+	// Closing writes the pending events
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	readOnly, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("Failed to open store read-only: %v", err)
+	}
+	defer readOnly.Close()
+	found, err := readOnly.Query(Query{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(found) != 1 || found[0].String() != "reload policy=abc123" {
+		t.Errorf("Expected the reload stored, got %v", found)
+	}
+}
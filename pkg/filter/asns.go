@@ -0,0 +1,110 @@
+package filter
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// ruleASNs returns the autonomous systems named in a rule's asns
+func ruleASNs(rule config.Rule) []uint32 {
+	var asns []uint32
+	for _, s := range rule.Egress.ASNs {
+		// ASNs are validated with the config
+		if asn, err := config.ParseASN(s); err == nil {
+			asns = append(asns, asn)
+		}
+	}
+	return asns
+}
+
+// configASNs returns the autonomous systems the rules of cfg name
+func configASNs(cfg *config.Config) []uint32 {
+	seen := make(map[uint32]bool)
+	var asns []uint32
+	for _, rule := range cfg.Rules {
+		for _, asn := range ruleASNs(rule) {
+			if !seen[asn] {
+				seen[asn] = true
+				asns = append(asns, asn)
+			}
+		}
+	}
+	return asns
+}
+
+// fetchASNPrefixes looks up the prefixes of the ASes the rules name,
+// skipping those already loaded unless all is set
+// Must be called with mu held
+func (f *Filter) fetchASNPrefixes(all bool) {
+	var asns []uint32
+	for _, asn := range configASNs(f.config) {
+		if all || !f.asns.Loaded(asn) {
+			asns = append(asns, asn)
+		}
+	}
+	if len(asns) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err := f.asns.Fetch(ctx, asns); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// refreshASNPrefixes looks up the prefixes periodically and updates the
+// rules naming ASes whose prefixes changed, until stopped
+func (f *Filter) refreshASNPrefixes() {
+	ticker := time.NewTicker(f.asns.Refresh())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.RLock()
+			asns := configASNs(f.config)
+			f.mu.RUnlock()
+			if len(asns) == 0 {
+				continue
+			}
+
+			// Lookups are done without holding mu
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			changed, err := f.asns.Fetch(ctx, asns)
+			cancel()
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			if len(changed) > 0 {
+				f.updateASNRules(changed)
+			}
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+// updateASNRules updates the sets of the rules naming ASes in asns
+func (f *Filter) updateASNRules(asns []uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed := make(map[uint32]bool)
+	for _, asn := range asns {
+		changed[asn] = true
+	}
+	for _, rule := range f.enabledRules() {
+		for _, asn := range ruleASNs(rule) {
+			if !changed[asn] {
+				continue
+			}
+			if err := f.updateRuleIPs(rule, nil); err != nil {
+				log.Printf("Failed to update IPs for rule %s: %v", rule.Name, err)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// Ban is a source dropped for hitting deny rules too often
+type Ban struct {
+	Source  string    `json:"source"`
+	Expires time.Time `json:"expires"`
+}
+
+// ban returns how cfg bans repeat offenders, nil if it doesn't
+func ban(cfg *config.Config) *nftables.Ban {
+	b := cfg.Ban
+	if b == nil {
+		return nil
+	}
+	return &nftables.Ban{
+		Threshold: b.EffectiveThreshold(),
+		Window:    b.EffectiveWindow(),
+		Duration:  b.EffectiveDuration(),
+		Exempt:    b.ExemptSources,
+	}
+}
+
+// Bans returns the banned sources, the soonest to expire first
+func (f *Filter) Bans() ([]Ban, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	banned, err := f.nft.BannedSources()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	bans := make([]Ban, 0, len(banned))
+	for _, b := range banned {
+		bans = append(bans, Ban{Source: b.IP.String(), Expires: now.Add(b.Expires)})
+	}
+	return bans, nil
+}
+
+// Unban lifts the ban of source before it expires
+func (f *Filter) Unban(source string) error {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return fmt.Errorf("invalid source: %s", source)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.nft.Unban(ip); err != nil {
+		return err
+	}
+	log.Printf("Unbanned %s", ip)
+	return nil
+}
+
+// bannedSources returns the banned sources, none if they can't be listed
+// Must be called with mu held
+func (f *Filter) bannedSources() []nftables.BannedSource {
+	banned, err := f.nft.BannedSources()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return banned
+}
+
+// restoreBans bans sources again after the table was recreated
+// Must be called with mu held
+func (f *Filter) restoreBans(banned []nftables.BannedSource) {
+	if err := f.nft.RestoreBans(banned); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// banDrops returns the packets of banned sources dropped
+// Must be called with mu held
+func (f *Filter) banDrops() uint64 {
+	drops, err := f.nft.BanDrops()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return drops
+}
@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"context"
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/bgp"
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// startBGP listens for the BGP neighbors in the background until the filter
+// stops, if configured. Changes to the bgp listener and neighbors take
+// effect on restart; groups follow reloads.
+// Must be called with mu held
+func (f *Filter) startBGP() {
+	if f.config.BGP == nil {
+		return
+	}
+	f.bgp = bgp.New(f.config.BGP, f.updateBGPRules)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-f.stopChan
+		cancel()
+	}()
+	go func() {
+		if err := f.bgp.Run(ctx); err != nil {
+			log.Printf("Warning: BGP stopped: %v", err)
+		}
+	}()
+}
+
+// bgpPrefixes returns the learned prefixes of a group under bgp.groups
+// Must be called with mu held
+func (f *Filter) bgpPrefixes(name string) []string {
+	if f.bgp == nil || f.config.BGP == nil {
+		return nil
+	}
+	group, ok := f.config.BGP.Group(name)
+	if !ok {
+		return nil
+	}
+	return f.bgp.Expand(group)
+}
+
+// updateBGPRules updates the sets of the rules naming @bgp groups
+func (f *Filter) updateBGPRules() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rule := range f.enabledRules() {
+		for _, group := range ipGroups(rule) {
+			if group.Provider != config.ProviderBGP {
+				continue
+			}
+			if err := f.updateRuleIPs(rule, nil); err != nil {
+				log.Printf("Failed to update IPs for rule %s: %v", rule.Name, err)
+			}
+			break
+		}
+	}
+}
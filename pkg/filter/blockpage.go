@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/skaegi/legion-router/pkg/blockpage"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// blockPagePort returns the port cfg serves the block page on, 0 if none
+func blockPagePort(cfg *config.Config) uint16 {
+	if cfg.BlockPage == nil {
+		return 0
+	}
+	return cfg.BlockPage.EffectivePort()
+}
+
+// startBlockPage serves the block page, if configured, before the ruleset
+// redirects denied HTTP to it; without it denied HTTP is dropped. Changes
+// to the block page settings take effect on restart.
+// Must be called with mu held
+func (f *Filter) startBlockPage() {
+	cfg := f.config.BlockPage
+	if cfg == nil {
+		return
+	}
+	server := blockpage.NewServer(cfg.EffectivePort(), cfg.Contact, f)
+	if err := server.Start(); err != nil {
+		log.Printf("Warning: block page disabled: %v", err)
+		return
+	}
+	f.blockPage = server
+	f.blockPagePort = cfg.EffectivePort()
+}
+
+// stopBlockPage closes the block page, if serving. Its requests are looked
+// up with mu held, so it must not be.
+func (f *Filter) stopBlockPage() {
+	f.mu.RLock()
+	server := f.blockPage
+	f.mu.RUnlock()
+
+	if server == nil {
+		return
+	}
+	if err := server.Stop(); err != nil {
+		log.Printf("Warning: failed to stop block page: %v", err)
+	}
+}
+
+// BlockedBy returns the rule denying HTTP connections from src to dst,
+// evaluated against a recording of the applied policy
+func (f *Filter) BlockedBy(src, dst net.IP) (blockpage.Block, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	shadow, err := f.recordedPolicy()
+	if err != nil {
+		return blockpage.Block{}, err
+	}
+	v, err := shadow.nft.Evaluate(nftables.Packet{
+		Source:         src,
+		Destination:    dst,
+		Protocol:       string(config.ProtocolTCP),
+		Port:           80,
+		InputInterface: sourceInterface(src),
+	})
+	if err != nil {
+		return blockpage.Block{}, err
+	}
+	if v.Accept || v.Queued {
+		return blockpage.Block{}, fmt.Errorf("the policy doesn't deny the connection")
+	}
+	block := blockpage.Block{Rule: v.Owner}
+	for _, rule := range f.config.Rules {
+		if rule.Name == v.Owner {
+			block.Description, block.Reference = rule.Description, rule.Reference
+			break
+		}
+	}
+	return block, nil
+}
+
+// recordedPolicy returns a recording of the applied policy, recorded again
+// once the policy or the addresses in its sets change
+// Must be called with mu held
+func (f *Filter) recordedPolicy() (*Filter, error) {
+	if f.recorded != nil && f.recordedConfig == f.config && f.recordedUpdates == f.nft.Updates() {
+		return f.recorded, nil
+	}
+	updates := f.nft.Updates()
+	shadow, err := f.recordApplied()
+	if err != nil {
+		return nil, err
+	}
+	f.recorded, f.recordedConfig, f.recordedUpdates = shadow, f.config, updates
+	return shadow, nil
+}
+
+// sourceInterface returns the interface on the network of src, "" if none
+// is, so that rules limited to an interface are evaluated as the kernel
+// applies them
+func sourceInterface(src net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && network.Contains(src) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/blockpage"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns/dnstest"
+)
+
+// TestBlockedBy tests that the block page names the rule denying HTTP to
+// a destination, with its description and reference
+func TestBlockedBy(t *testing.T) {
+	cfg := &config.Config{
+		Version:   "1.0",
+		BlockPage: &config.BlockPageConfig{Contact: "it@example.com"},
+		Rules: []config.Rule{
+			{
+				Name:        "deny-social",
+				Action:      config.ActionDeny,
+				Order:       1,
+				Egress:      config.Egress{Domains: []string{"social.example.com"}},
+				Description: "Social media is not for work",
+				Reference:   "SEC-12",
+			},
+			{
+				Name:   "allow-web",
+				Action: config.ActionAllow,
+				Order:  10,
+				Egress: config.Egress{IPs: []string{"192.0.2.0/24"}, Ports: []string{"80", "443"}},
+			},
+		},
+	}
+	resolver := dnstest.NewFakeResolver()
+	resolver.Set("social.example.com", "203.0.113.10")
+	f, err := compile(cfg, resolver)
+	if err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		dst     string
+		want    blockpage.Block
+		wantErr bool
+	}{
+		{
+			name: "denied by a rule",
+			dst:  "203.0.113.10",
+			want: blockpage.Block{Rule: "deny-social", Description: "Social media is not for work", Reference: "SEC-12"},
+		},
+		{
+			name: "denied by default",
+			dst:  "198.51.100.1",
+			want: blockpage.Block{},
+		},
+		{
+			name:    "allowed",
+			dst:     "192.0.2.1",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			block, err := f.BlockedBy(net.ParseIP("10.0.0.2"), net.ParseIP(tc.dst))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("BlockedBy() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if block != tc.want {
+				t.Errorf("Expected %+v, got %+v", tc.want, block)
+			}
+		})
+	}
+}
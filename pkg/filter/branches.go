@@ -0,0 +1,174 @@
+package filter
+
+import (
+	"log"
+	"net"
+	"sort"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/inspect"
+	"github.com/skaegi/legion-router/pkg/nftables"
+	"github.com/skaegi/legion-router/pkg/policy"
+)
+
+// ruleBranches returns a rule for each alternative the any_of and all_of
+// of rule expand to, with the egress of the alternative, in the order of
+// the branches they compile to; a rule without them is its only branch
+func ruleBranches(rule config.Rule) []config.Rule {
+	if !rule.Egress.Compound() {
+		return []config.Rule{rule}
+	}
+	egresses, err := rule.Egress.Branches()
+	if err != nil {
+		log.Printf("Warning: rule %s: %v", rule.Name, err)
+		return nil
+	}
+	branches := make([]config.Rule, len(egresses))
+	for i, egress := range egresses {
+		branches[i] = rule
+		branches[i].Egress = egress
+	}
+	return branches
+}
+
+// hasDestinationSet reports whether the rules of a branch match the
+// destinations in its sets
+func hasDestinationSet(rule config.Rule) bool {
+	return len(rule.Egress.IPs) > 0 || len(rule.Egress.Domains) > 0 || len(rule.Egress.Services) > 0 ||
+		len(rule.Egress.ASNs) > 0
+}
+
+// updateRuleIPs replaces the destination sets of each branch of rule with
+// its current addresses, taking those of the domains in known from known
+// Must be called with mu held
+func (f *Filter) updateRuleIPs(rule config.Rule, known map[string][]string) error {
+	for i, branch := range ruleBranches(rule) {
+		if !hasDestinationSet(branch) {
+			continue
+		}
+		ips, _ := f.resolveRuleIPs(branch, known)
+		if err := f.nft.UpdateIPs(nftables.BranchName(rule.Name, i), ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateExcludedIPs replaces the exclusion sets of the branches of rule
+// excluding domains with their current addresses, taking those of the
+// domains in known from known
+// Must be called with mu held
+func (f *Filter) updateExcludedIPs(rule config.Rule, known map[string][]string) error {
+	for i, branch := range ruleBranches(rule) {
+		if len(branch.Egress.NotDomains) == 0 {
+			continue
+		}
+		ips, _ := f.resolveExcludedIPs(branch, known)
+		if err := f.nft.UpdateExcludedIPs(nftables.BranchName(rule.Name, i), ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleContainsIP reports whether ip is in the destination sets of any
+// branch of rule
+// Must be called with mu held
+func (f *Filter) ruleContainsIP(rule config.Rule, ip net.IP) bool {
+	for i := range ruleBranches(rule) {
+		if f.nft.ContainsIP(nftables.BranchName(rule.Name, i), ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleIPs returns the addresses in the destination sets of the branches of
+// rule, sorted for compound rules
+// Must be called with mu held
+func (f *Filter) ruleIPs(rule config.Rule) []string {
+	if !rule.Egress.Compound() {
+		return f.nft.RuleIPs(rule.Name)
+	}
+	seen := make(map[string]bool)
+	var ips []string
+	for i := range ruleBranches(rule) {
+		for _, ip := range f.nft.RuleIPs(nftables.BranchName(rule.Name, i)) {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// ruleMatches reports whether the destinations of rule, or of one of its
+// branches that conn's protocol and port match, match conn as the kernel
+// would; ruleAppliesTo checks what the branches share
+// Must be called with mu held
+func (f *Filter) ruleMatches(rule config.Rule, conn inspect.Conn) bool {
+	if !rule.Egress.Compound() {
+		return f.destinationMatches(rule, rule.Name, conn.Address)
+	}
+	for i, branch := range ruleBranches(rule) {
+		if branchAppliesTo(branch, conn) && f.destinationMatches(branch, nftables.BranchName(rule.Name, i), conn.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationMatches reports whether ip is among the destinations of a
+// rule, or a branch of one with sets named setsName, and not excluded
+// Must be called with mu held
+func (f *Filter) destinationMatches(rule config.Rule, setsName string, ip net.IP) bool {
+	hasDestinations := hasDestinationSet(rule)
+	if hasDestinations && !f.nft.ContainsIP(setsName, ip) {
+		return false
+	}
+	if f.nft.ExcludesIP(setsName, ip) {
+		return false
+	}
+	// Rules without destinations are only installed with protocols, l7,
+	// a VLAN, a VRF, a profile, exclusions, conntrack states, TTLs or
+	// lengths
+	return hasDestinations || len(rule.Egress.Protocols) > 0 || len(rule.Egress.L7) > 0 || rule.VLANID != 0 || rule.VRF != "" ||
+		rule.Profile != "" || rule.Egress.Excludes() || len(rule.CtStates) > 0 || rule.MatchesPacket()
+}
+
+// branchAppliesTo reports whether the protocols and ports of a branch
+// match conn
+func branchAppliesTo(branch config.Rule, conn inspect.Conn) bool {
+	if !appliesTo(branch, config.Protocol(conn.Network)) || !policy.NewPortSet(branch.Egress.Ports).Contains(conn.Port) {
+		return false
+	}
+	return len(branch.Egress.NotPorts) == 0 || !policy.NewPortSet(branch.Egress.NotPorts).Contains(conn.Port)
+}
+
+// branchesNaming returns the branches of rule with a domain matching name,
+// with the names of their sets
+func branchesNaming(rule config.Rule, name string) map[string]config.Rule {
+	branches := make(map[string]config.Rule)
+	for i, branch := range ruleBranches(rule) {
+		for _, domain := range branch.Egress.Domains {
+			if matchDomain(normalizeName(domain), normalizeName(name)) {
+				branches[nftables.BranchName(rule.Name, i)] = branch
+				break
+			}
+		}
+	}
+	return branches
+}
+
+// namingBranchAppliesTo reports whether a branch of rule with a domain
+// matching name applies to conn
+func namingBranchAppliesTo(rule config.Rule, name string, conn inspect.Conn) bool {
+	for _, branch := range branchesNaming(rule, name) {
+		if branchAppliesTo(branch, conn) {
+			return true
+		}
+	}
+	return false
+}
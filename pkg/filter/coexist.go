@@ -0,0 +1,53 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// SetForce makes the filter start even if other firewall managers are
+// found and the config refuses to run alongside them. It must be called
+// before Start.
+func (f *Filter) SetForce(force bool) {
+	f.force = force
+}
+
+// checkFirewalls looks for other firewall managers before the ruleset is
+// first set up, and handles them as the config's coexistence says. Their
+// chains see the same packets, and a packet must pass theirs and the
+// router's, which is baffling when unexpected.
+// Must be called with mu held
+func (f *Filter) checkFirewalls() error {
+	p, err := placement(f.config)
+	if err != nil {
+		return err
+	}
+	f.nft.SetPlacement(p)
+	firewalls, err := f.nft.DetectFirewalls()
+	if err != nil {
+		log.Printf("Warning: failed to look for other firewall managers: %v", err)
+		return nil
+	}
+	for _, fw := range firewalls {
+		log.Printf("Warning: %s is also filtering; packets must pass its chains as well as the router's", fw)
+	}
+	if len(firewalls) == 0 {
+		return nil
+	}
+
+	switch f.config.Chain.EffectiveCoexistence() {
+	case config.CoexistRefuse:
+		if !f.force {
+			return fmt.Errorf("other firewall managers are active; set chain.coexistence or run with --force")
+		}
+		log.Println("Warning: starting alongside other firewall managers as forced")
+	case config.CoexistIntegrate:
+		f.firewalls = firewalls
+		if p.Priority == nil {
+			log.Printf("Running the policy chain at priority %d, after the other firewall managers", *f.nft.PriorityAfter(firewalls))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/flowlog"
+	"github.com/skaegi/legion-router/pkg/inspect"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// maxDomainAddresses bounds the addresses remembered per rule for
+// attributing connections; a rule over the bound starts over
+const maxDomainAddresses = 4096
+
+// startConnectionLog starts logging new connections, if configured
+func (f *Filter) startConnectionLog() {
+	cl := f.config.ConnectionLog
+	if cl == nil {
+		return
+	}
+
+	logConfig := flowlog.Config{
+		Group:     connectionLogGroup(f.config),
+		File:      cl.File,
+		NetNS:     f.netns,
+		Domains:   f,
+		Processes: cl.Processes,
+	}
+	var s sinks
+	if f.eventStore != nil {
+		s = append(s, connectionEvents{store: f.eventStore})
+	}
+	if f.decisionLog != nil {
+		s = append(s, recordedDecisions{log: f.decisionLog})
+	}
+	if len(s) > 0 {
+		logConfig.Sink = s
+	}
+	logger, err := flowlog.New(logConfig)
+	if err != nil {
+		log.Printf("Warning: connection log disabled: %v", err)
+		return
+	}
+	f.connLog = logger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-f.stopChan
+		cancel()
+	}()
+	go func() {
+		if err := logger.Run(ctx); err != nil {
+			log.Printf("Warning: connection log stopped: %v", err)
+		}
+	}()
+}
+
+// connectionLogGroup returns the NFLOG group new connections are sent to
+func connectionLogGroup(cfg *config.Config) uint16 {
+	if cfg.ConnectionLog != nil && cfg.ConnectionLog.Group != 0 {
+		return cfg.ConnectionLog.Group
+	}
+	return flowlog.DefaultGroup
+}
+
+// connectionLog returns what the ruleset of cfg sends to the connection
+// log, nil if nothing
+func connectionLog(cfg *config.Config) *nftables.ConnectionLog {
+	cl := cfg.ConnectionLog
+	if cl == nil {
+		return nil
+	}
+	return &nftables.ConnectionLog{
+		Group:     connectionLogGroup(cfg),
+		Unmatched: cl.Denied,
+		DNS:       cl.SnoopDNS,
+	}
+}
+
+// logsConnections reports whether the new connections rule decides are
+// logged
+func logsConnections(cfg *config.Config, rule config.Rule) bool {
+	cl := cfg.ConnectionLog
+	return cl != nil && (rule.Action == config.ActionAllow || cl.Denied)
+}
+
+// DomainOf returns the domain ip was last resolved or learned for under the
+// rule named rule, "" if it has none
+func (f *Filter) DomainOf(rule string, ip net.IP) string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.domains[rule][ip.String()]
+}
+
+// recordDomain remembers that address was resolved or learned for domain
+// under a rule
+// Must be called with mu held
+func (f *Filter) recordDomain(ruleName, address, domain string) {
+	if f.domains == nil {
+		f.domains = make(map[string]map[string]string)
+	}
+	addresses := f.domains[ruleName]
+	if addresses == nil || len(addresses) >= maxDomainAddresses {
+		addresses = make(map[string]string)
+		f.domains[ruleName] = addresses
+	}
+	addresses[address] = domain
+}
+
+// inspectedConnections logs the connections the inspector allows by server
+// name, which the ruleset queues instead of logging
+type inspectedConnections struct {
+	log *flowlog.Logger
+}
+
+// Allowed logs a connection allowed under rule for server name
+func (c inspectedConnections) Allowed(rule, name string, conn inspect.Conn) {
+	c.log.Log(flowlog.Entry{
+		Time:        time.Now(),
+		Verdict:     nftables.ConnectionLogAllow,
+		Rule:        rule,
+		Protocol:    conn.Network,
+		Interface:   conn.Interface,
+		Source:      conn.Source,
+		SourcePort:  conn.SourcePort,
+		Destination: conn.Address,
+		Port:        conn.Port,
+		Domain:      name,
+	})
+}
@@ -0,0 +1,76 @@
+package filter
+
+import (
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+	"github.com/skaegi/legion-router/pkg/flowlog"
+)
+
+// startDecisionLog opens the decision log, if configured, which records a
+// sample of what the connection log logs
+// Must be called with mu held
+func (f *Filter) startDecisionLog() {
+	cfg := f.config.DecisionLog
+	if cfg == nil {
+		return
+	}
+	w, err := decisionlog.Open(cfg.Path, decisionlog.Options{
+		SampleRate: cfg.SampleRate,
+		MaxSize:    cfg.EffectiveMaxSize(),
+		MaxBackups: cfg.EffectiveMaxBackups(),
+	})
+	if err != nil {
+		log.Printf("Warning: decision log disabled: %v", err)
+		return
+	}
+	f.decisionLog = w
+
+	log.Printf("Recording decisions in %s", cfg.Path)
+	if f.config.ConnectionLog == nil {
+		log.Println("Warning: decisions are recorded as the connection log logs them; none are recorded without connection_log")
+	}
+}
+
+// closeDecisionLog closes the decision log
+// Must be called with mu held
+func (f *Filter) closeDecisionLog() {
+	if f.decisionLog == nil {
+		return
+	}
+	if err := f.decisionLog.Close(); err != nil {
+		log.Printf("Warning: failed to close the decision log: %v", err)
+	}
+	f.decisionLog = nil
+}
+
+// recordedDecisions records the connections the connection log logs
+type recordedDecisions struct {
+	log *decisionlog.Writer
+}
+
+// Logged records a logged connection, if sampled
+func (r recordedDecisions) Logged(entry flowlog.Entry) {
+	r.log.Record(decisionlog.Decision{
+		Time:        entry.Time,
+		Verdict:     entry.Verdict,
+		Rule:        entry.Rule,
+		Protocol:    entry.Protocol,
+		Interface:   entry.Interface,
+		Source:      entry.Source,
+		SourcePort:  entry.SourcePort,
+		Destination: entry.Destination,
+		Port:        entry.Port,
+		Domain:      entry.Domain,
+	})
+}
+
+// sinks passes the logged connections to each sink
+type sinks []flowlog.Sink
+
+// Logged passes a logged connection on
+func (s sinks) Logged(entry flowlog.Entry) {
+	for _, sink := range s {
+		sink.Logged(entry)
+	}
+}
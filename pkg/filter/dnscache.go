@@ -0,0 +1,33 @@
+package filter
+
+import (
+	"fmt"
+
+	"github.com/skaegi/legion-router/pkg/dns"
+)
+
+// DNSCache is the content of the DNS cache
+type DNSCache struct {
+	// Entries are the cached domains, sorted by name
+	Entries []dns.CacheEntry `json:"entries"`
+	// Limit is the number of domains the cache is bounded to
+	Limit int `json:"limit"`
+	// Evictions counts the domains evicted since the router started
+	Evictions uint64 `json:"evictions"`
+}
+
+// DNSCache returns the content of the DNS cache
+func (f *Filter) DNSCache() (*DNSCache, error) {
+	f.mu.RLock()
+	resolver, ok := f.dns.(cacheLister)
+	f.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("the resolver has no cache")
+	}
+	return &DNSCache{
+		Entries:   resolver.CacheEntries(),
+		Limit:     resolver.CacheLimit(),
+		Evictions: resolver.Evictions(),
+	}, nil
+}
@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dnsproxy"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// startDNSProxy answers the queries of downstream clients, if configured.
+// Changes to the proxy settings take effect on restart.
+// Must be called with mu held
+func (f *Filter) startDNSProxy() {
+	cfg := f.config.DNS.Proxy
+	if cfg == nil {
+		return
+	}
+	upstream, ok := f.dns.(dnsproxy.Upstream)
+	if !ok {
+		log.Println("Warning: DNS proxy disabled: the resolver can't forward queries")
+		return
+	}
+	proxy, err := dnsproxy.NewServer(cfg, f, upstream)
+	if err != nil {
+		log.Printf("Warning: DNS proxy disabled: %v", err)
+		return
+	}
+	if err := proxy.Start(); err != nil {
+		log.Printf("Warning: DNS proxy disabled: %v", err)
+		return
+	}
+	f.dnsProxy = proxy
+	// Profiles were applied before the hosts they name could be resolved
+	if err := f.applyProfiles(); err != nil {
+		log.Printf("Warning: failed to apply profile hosts: %v", err)
+	}
+}
+
+// HostsChanged updates the profiles naming hosts of the DNS proxy's local
+// zones as their DHCP leases change
+func (f *Filter) HostsChanged() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.applyProfiles(); err != nil {
+		log.Printf("Warning: failed to apply profile hosts: %v", err)
+	}
+}
+
+// stopDNSProxy closes the DNS proxy, if running. Its queries are decided
+// with mu held, so it must not be.
+func (f *Filter) stopDNSProxy() {
+	f.mu.RLock()
+	proxy := f.dnsProxy
+	f.mu.RUnlock()
+
+	if proxy == nil {
+		return
+	}
+	if err := proxy.Stop(); err != nil {
+		log.Printf("Warning: failed to stop DNS proxy: %v", err)
+	}
+}
+
+// DecideQuery returns the verdict of the first enabled rule naming name
+// that applies to client. A deny rule applying to every connection to the
+// name blocks the query; one limited to some ports, protocols or networks,
+// or excluding some traffic, leaves it to the IP layer.
+func (f *Filter) DecideQuery(client net.IP, name string) dnsproxy.Decision {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, i := range f.index.MatchDomain(name) {
+		rule := f.config.Rules[i]
+		if !f.ruleEnabled(rule) {
+			continue
+		}
+		if rule.Profile != "" && !f.nft.ProfileContains(rule.Profile, client) {
+			continue
+		}
+		if rule.Action == config.ActionAllow {
+			return dnsproxy.Decision{Verdict: dnsproxy.VerdictAllowed, Rule: rule.Name}
+		}
+		// A compound rule blocks the query if a branch naming it would
+		branches := []config.Rule{rule}
+		if rule.Egress.Compound() {
+			branches = nil
+			for _, branch := range branchesNaming(rule, name) {
+				branches = append(branches, branch)
+			}
+		}
+		for _, branch := range branches {
+			if blocksQuery(branch) {
+				return dnsproxy.Decision{Verdict: dnsproxy.VerdictBlocked, Rule: rule.Name}
+			}
+		}
+		return dnsproxy.Decision{Verdict: dnsproxy.VerdictDenied, Rule: rule.Name}
+	}
+	return dnsproxy.Decision{Verdict: dnsproxy.VerdictForwarded}
+}
+
+// blocksQuery reports whether a deny rule applies to every connection to
+// its domains
+func blocksQuery(rule config.Rule) bool {
+	return len(rule.Egress.Ports) == 0 && len(rule.Egress.Protocols) == 0 && len(rule.Egress.L7) == 0 &&
+		rule.VLANID == 0 && rule.VRF == "" && !rule.Egress.Excludes() && rule.MatchesCtState(config.CtStateNew) &&
+		!rule.MatchesPacket()
+}
+
+// Answered adds the addresses the DNS proxy answered for name to the sets
+// of the rules naming it, for allow_on_first_use. They are kept like the
+// addresses learned from SNI, so that the next refresh doesn't remove
+// addresses a client was just given.
+func (f *Filter) Answered(name string, addresses []net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rule := range f.enabledRules() {
+		for i, branch := range ruleBranches(rule) {
+			if namesDomain(branch, name) {
+				f.answered(rule.Name, nftables.BranchName(rule.Name, i), name, addresses)
+			}
+		}
+	}
+}
+
+// Responded hands the DNS proxy's responses to the connection log with
+// snoop_dns, so that the connections of its clients are attributed to the
+// names they looked up, as for the answers the router forwards
+func (f *Filter) Responded(client net.IP, resp *dns.Msg) {
+	f.mu.RLock()
+	logger := f.connLog
+	snoop := f.config.ConnectionLog != nil && f.config.ConnectionLog.SnoopDNS
+	f.mu.RUnlock()
+	if logger != nil && snoop {
+		logger.Answered(client, resp)
+	}
+}
+
+// answered adds the addresses answered for name to the sets of a rule, or
+// of a branch of one with sets named setsName
+// Must be called with mu held
+func (f *Filter) answered(ruleName, setsName, name string, addresses []net.IP) {
+	var added []string
+	for _, address := range addresses {
+		if f.learn(ruleName, name, address.String()) && !f.nft.ContainsIP(setsName, address) {
+			added = append(added, address.String())
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	// Added to the set as it is, since resolving the rule's other domains
+	// would hold up the answer
+	if err := f.nft.UpdateIPs(setsName, append(f.nft.RuleIPs(setsName), added...)); err != nil {
+		log.Printf("Warning: failed to add the addresses of %s to rule %s: %v", name, ruleName, err)
+		return
+	}
+	log.Printf("Added %s to rule %s from the DNS proxy answer for %s", strings.Join(added, ", "), ruleName, name)
+}
+
+// DNSStats returns the DNS queries of each client, or of client if set,
+// with their top most queried and blocked domains
+func (f *Filter) DNSStats(client net.IP, top int) ([]dnsproxy.ClientStats, error) {
+	f.mu.RLock()
+	proxy := f.dnsProxy
+	f.mu.RUnlock()
+
+	if proxy == nil {
+		return nil, fmt.Errorf("the DNS proxy is not enabled")
+	}
+	return proxy.Stats(client, top), nil
+}
+
+// namesDomain reports whether a rule names the domain name itself
+func namesDomain(rule config.Rule, name string) bool {
+	for _, domain := range rule.Egress.Domains {
+		if strings.EqualFold(strings.TrimSuffix(domain, "."), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/flowlog"
+)
+
+// TestResponded tests that the connections of the DNS proxy's clients are
+// attributed to the names it answered them, only with snoop_dns
+func TestResponded(t *testing.T) {
+	testCases := []struct {
+		name       string
+		snoop      bool
+		wantDomain bool
+	}{
+		{name: "snoop_dns", snoop: true, wantDomain: true},
+		{name: "without snoop_dns"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{Version: "1.0", ConnectionLog: &config.ConnectionLogConfig{SnoopDNS: tc.snoop}}
+			f, _ := newTestFilter(t, cfg)
+			path := filepath.Join(t.TempDir(), "connections.log")
+			logger, err := flowlog.New(flowlog.Config{File: path})
+			if err != nil {
+				t.Fatalf("Failed to create logger: %v", err)
+			}
+			f.connLog = logger
+
+			req := new(dns.Msg)
+			req.SetQuestion("api.example.com.", dns.TypeA)
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			rr, _ := dns.NewRR("api.example.com. 60 IN A 203.0.113.9")
+			resp.Answer = append(resp.Answer, rr)
+			f.Responded(net.ParseIP("10.0.0.5"), resp)
+
+			logger.Log(flowlog.Entry{
+				Time:        time.Now(),
+				Verdict:     "deny",
+				Protocol:    "tcp",
+				Source:      net.ParseIP("10.0.0.5"),
+				SourcePort:  51234,
+				Destination: net.ParseIP("203.0.113.9"),
+				Port:        443,
+			})
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read log: %v", err)
+			}
+			if got := strings.Contains(string(data), "domain=api.example.com"); got != tc.wantDomain {
+				t.Errorf("Expected domain logged %v, got %q", tc.wantDomain, data)
+			}
+		})
+	}
+}
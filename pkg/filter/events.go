@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/skaegi/legion-router/pkg/flowlog"
+)
+
+// startEventStore opens the event store, if configured, and writes to it in
+// the background until the filter stops
+// Must be called with mu held
+func (f *Filter) startEventStore() {
+	cfg := f.config.Events
+	if cfg == nil {
+		return
+	}
+
+	store, err := events.Open(cfg.Path, events.Retention{
+		MaxAge:    cfg.Retention.Std(),
+		MaxEvents: cfg.MaxEvents,
+	})
+	if err != nil {
+		log.Printf("Warning: event store disabled: %v", err)
+		return
+	}
+	f.eventStore = store
+	go store.Run(f.stopChan)
+
+	log.Printf("Storing events in %s", cfg.Path)
+	if f.config.ConnectionLog == nil {
+		log.Println("Warning: connections are stored as the connection log logs them; only reloads are stored without connection_log")
+	}
+}
+
+// closeEventStore writes the pending events and closes the store
+// Must be called with mu held
+func (f *Filter) closeEventStore() {
+	if f.eventStore == nil {
+		return
+	}
+	if err := f.eventStore.Close(); err != nil {
+		log.Printf("Warning: failed to close the event store: %v", err)
+	}
+	f.eventStore = nil
+}
+
+// recordReload stores the outcome of a reload
+func (f *Filter) recordReload(err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.eventStore == nil {
+		return
+	}
+	event := events.Event{Type: events.TypeReload, Policy: f.configHash}
+	if err != nil {
+		event.Policy, event.Error = "", err.Error()
+	}
+	f.eventStore.Record(event)
+}
+
+// Events returns the stored events q selects
+func (f *Filter) Events(q events.Query) ([]events.Event, error) {
+	f.mu.RLock()
+	store := f.eventStore
+	f.mu.RUnlock()
+
+	if store == nil {
+		return nil, fmt.Errorf("no event store is configured")
+	}
+	return store.Query(q)
+}
+
+// connectionEvents stores the connections the connection log logs
+type connectionEvents struct {
+	store *events.Store
+}
+
+// Logged stores a logged connection
+func (c connectionEvents) Logged(entry flowlog.Entry) {
+	event := events.Event{
+		Time:        entry.Time,
+		Type:        entry.Verdict,
+		Rule:        entry.Rule,
+		Protocol:    entry.Protocol,
+		Interface:   entry.Interface,
+		Source:      entry.Source,
+		SourcePort:  entry.SourcePort,
+		Destination: entry.Destination,
+		Port:        entry.Port,
+		Domain:      entry.Domain,
+	}
+	if p := entry.Process; p != nil {
+		event.PID, event.Process, event.Cgroup = p.PID, p.Name, p.Cgroup
+	}
+	c.store.Record(event)
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// How often the rules are checked for expiry
+const expiryCheckInterval = time.Minute
+
+// expiredRules returns the names of the rules that have expired by now
+func expiredRules(rules []config.Rule, now time.Time) map[string]bool {
+	expired := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Expired(now) {
+			expired[rule.Name] = true
+		}
+	}
+	return expired
+}
+
+// expireRulesPeriodically reapplies the policy when a programmed rule
+// expires, until stopped
+func (f *Filter) expireRulesPeriodically() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.Lock()
+			f.expireRulesLocked(time.Now())
+			f.mu.Unlock()
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+// expireRulesLocked reapplies the policy without the rules that have
+// expired by now since it was applied
+// Must be called with mu held
+func (f *Filter) expireRulesLocked(now time.Time) {
+	var names []string
+	for name := range expiredRules(f.config.Rules, now) {
+		if !f.expired[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	// Reapplying would end the rollout without deciding it; the new policy
+	// applies once it completes
+	if f.rollout != nil {
+		return
+	}
+	sort.Strings(names)
+	log.Printf("Removing expired rule(s) from the ruleset: %v", names)
+	if err := f.applyConfig(f.config); err != nil {
+		log.Printf("ERROR: failed to remove expired rules: %v", err)
+	}
+}
@@ -1,34 +1,152 @@
 package filter
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/skaegi/legion-router/pkg/asn"
+	"github.com/skaegi/legion-router/pkg/bgp"
+	"github.com/skaegi/legion-router/pkg/blockpage"
 	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+	"github.com/skaegi/legion-router/pkg/discovery"
 	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/dnsproxy"
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/skaegi/legion-router/pkg/flowlog"
+	"github.com/skaegi/legion-router/pkg/honeypot"
+	"github.com/skaegi/legion-router/pkg/inspect"
+	"github.com/skaegi/legion-router/pkg/ipranges"
+	"github.com/skaegi/legion-router/pkg/metrics"
+	"github.com/skaegi/legion-router/pkg/network"
 	"github.com/skaegi/legion-router/pkg/nftables"
+	"github.com/skaegi/legion-router/pkg/policy"
 )
 
 // Filter manages the egress filtering
 type Filter struct {
 	config     *config.Config
 	configPath string
-	dns        *dns.Resolver
+	dns        dns.Resolver
 	nft        *nftables.Manager
 	mu         sync.RWMutex
 	stopChan   chan struct{}
 	watcher    *fsnotify.Watcher
+	// Hash of the applied policy, in the comments of its nftables rules
+	configHash string
+	// Matchers of the applied policy, for decisions taken in userspace
+	index *policy.Index
+	// Set for filters recording a copy of the policy, which don't log the
+	// rules they apply
+	quiet bool
+
+	// Last persisted ruleset and the set updates it includes
+	persistedScript  []byte
+	persistedUpdates uint64
+
+	// Key-value store the config was loaded from instead of configPath
+	source         config.Source
+	sourceRevision uint64
+
+	// Network namespace programmed instead of the router's own, if set
+	netns int
+
+	// Startup resolution state
+	unresolved map[string]map[string]bool // Rule name -> unresolved domains
+	// Domains of lazily applied rules still resolving, see deferDomains
+	pending   map[string]bool
+	persisted map[string][]string // Last persisted addresses per domain
+	retryWake chan struct{}
+
+	// Addresses learned from allowed SNI and DNS proxy answers: rule name ->
+	// address -> name and last seen
+	learned map[string]map[string]learnedAddress
+	// Domains addresses were last resolved or learned for, to attribute
+	// logged connections: rule name -> address -> domain
+	domains map[string]map[string]string
+	// Logs new allowed connections, if configured
+	connLog *flowlog.Logger
+	// Stores logged connections and reloads, if configured
+	eventStore *events.Store
+	// Records a sample of the logged connections, if configured
+	decisionLog *decisionlog.Writer
+	// Samples of the counters for dashboards, if configured
+	metrics *metrics.Recorder
+
+	// Temporary grants by source, destination and port
+	grants map[string]Grant
+	// UPnP and NAT-PMP port mappings by protocol and external port
+	mappings map[string]PortMapping
+
+	// Rule name -> enabled, switched through the admin API; takes
+	// precedence over the config until restart
+	enabled map[string]bool
+	// Rules left out of the applied policy as expired when it was applied
+	expired map[string]bool
+
+	// Addresses received from the active router: rule name -> addresses
+	synced map[string]syncedAddresses
+
+	// Set while maintenance mode is on
+	maintenance *maintenanceState
+	// Set while a changed policy is rolled out
+	rollout *rolloutState
+
+	// VLAN subinterfaces and VRFs created at startup, removed on Stop
+	createdLinks []string
+	// VRF member interface -> VRF device
+	vrfMembers map[string]string
+	// Static routes installed for the current config, removed on Stop
+	routes []network.Route
+
+	// Containers assigned to profiles by ID
+	containers map[string]Container
+
+	// Service discovery and the last endpoints of each service
+	discovery *discovery.Discovery
+	endpoints map[string][]string
+
+	// Published cloud ranges named in egress ips
+	ranges *ipranges.Ranges
+	// Prefixes of the autonomous systems named in egress asns
+	asns *asn.Prefixes
+	// Prefixes of @bgp groups learned from the BGP neighbors, if configured
+	bgp *bgp.Speaker
+	// Answers the queries of downstream clients, if configured
+	dnsProxy *dnsproxy.Server
+	// Serves the page denied HTTP is redirected to, if configured, and its
+	// port; see startBlockPage
+	blockPage     *blockpage.Server
+	blockPagePort uint16
+	// Records the connections to denied targets redirected to it, if
+	// configured, and its port; see startHoneypot
+	honeypot     *honeypot.Server
+	honeypotPort uint16
+	// Recording of the applied policy the block page looks rules up in,
+	// and the policy and set updates it was recorded at
+	recorded        *Filter
+	recordedConfig  *config.Config
+	recordedUpdates uint64
+
+	// Other firewall managers found at startup, whose chains the policy
+	// chain runs after when integrating; see checkFirewalls
+	firewalls []nftables.Firewall
+	// Start despite other firewall managers the config refuses
+	force bool
 }
 
-// New creates a new Filter instance
-func New(cfg *config.Config, configPath string) (*Filter, error) {
-	// Create DNS resolver
-	resolver, err := dns.NewResolver()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create DNS resolver: %w", err)
+// New creates a new Filter instance resolving domains with resolver
+func New(cfg *config.Config, configPath string, resolver dns.Resolver) (*Filter, error) {
+	if resolver == nil {
+		return nil, fmt.Errorf("a DNS resolver is required")
 	}
+	resolver.Configure(resolverSettings(cfg))
 
 	// Create nftables manager
 	nftMgr, err := nftables.NewManager()
@@ -36,6 +154,11 @@ func New(cfg *config.Config, configPath string) (*Filter, error) {
 		return nil, fmt.Errorf("failed to create nftables manager: %w", err)
 	}
 
+	disc, err := newDiscovery(cfg, resolver.Resolve)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up service discovery: %w", err)
+	}
+
 	// Create file watcher
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -45,10 +168,23 @@ func New(cfg *config.Config, configPath string) (*Filter, error) {
 	return &Filter{
 		config:     cfg,
 		configPath: configPath,
+		index:      policy.New(cfg.Rules),
 		dns:        resolver,
 		nft:        nftMgr,
 		stopChan:   make(chan struct{}),
 		watcher:    watcher,
+		unresolved: make(map[string]map[string]bool),
+		retryWake:  make(chan struct{}, 1),
+		learned:    make(map[string]map[string]learnedAddress),
+		grants:     make(map[string]Grant),
+		mappings:   make(map[string]PortMapping),
+		enabled:    make(map[string]bool),
+		synced:     make(map[string]syncedAddresses),
+		containers: make(map[string]Container),
+		discovery:  disc,
+		endpoints:  make(map[string][]string),
+		ranges:     ipranges.New(cfg.IPRanges),
+		asns:       asn.New(cfg.ASNPrefixes),
 	}, nil
 }
 
@@ -57,25 +193,41 @@ func (f *Filter) Start() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	log.Println("Setting up nftables rules...")
-	if err := f.nft.Setup(); err != nil {
-		return fmt.Errorf("failed to setup nftables: %w", err)
+	f.startBlockPage()
+	f.startHoneypot()
+	if err := f.program(); err != nil {
+		return err
 	}
 
-	log.Println("Processing filtering rules...")
-	if err := f.applyRules(); err != nil {
-		return fmt.Errorf("failed to apply rules: %w", err)
-	}
-
-	// Start watching config file for changes
-	if err := f.watcher.Add(f.configPath); err != nil {
+	// Start watching the config source or file for changes
+	if f.source != nil {
+		log.Printf("Watching %s for changes", f.source)
+		go f.watchSource()
+	} else if err := f.watcher.Add(f.configPath); err != nil {
 		log.Printf("Warning: failed to watch config file: %v", err)
 	} else {
 		log.Printf("Watching config file for changes: %s", f.configPath)
 		go f.watchConfigFile()
 	}
 
-	// Start DNS resolver background tasks
+	f.startEventStore()
+	f.startDecisionLog()
+	f.startConnectionLog()
+	f.startInspection()
+	f.startMetrics()
+	f.startBGP()
+	f.startDNSProxy()
+
+	// Start DNS resolver and service discovery background tasks
+	go f.retryUnresolved()
+	go f.refreshServices()
+	go f.refreshIPRanges()
+	go f.refreshASNPrefixes()
+	go f.persistPeriodically()
+	go f.expireRulesPeriodically()
+	if pool, ok := f.dns.(upstreamPool); ok {
+		go pool.StartHealthChecks(f.stopChan)
+	}
 	go f.dns.StartPeriodicRefresh(f.stopChan, func(domain string, ips []string) {
 		// Callback when DNS entries are refreshed
 		if err := f.updateDomainIPs(domain, ips); err != nil {
@@ -86,114 +238,772 @@ func (f *Filter) Start() error {
 	return nil
 }
 
-// Stop stops the filter
+// ApplyOnce programs the ruleset, resolving domains once, and leaves it in
+// place without starting any background task, for images where a timer
+// runs it again to follow DNS changes
+func (f *Filter) ApplyOnce() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
+	if err := f.program(); err != nil {
+		return err
+	}
+	if insp := f.config.Inspection; (insp != nil && insp.SNI) || hasL7Rules(f.config) {
+		log.Println("Warning: inspection needs the daemon; traffic queued for inspection is dropped")
+	}
+	if f.config.Docker != nil {
+		log.Println("Warning: following Docker containers needs the daemon; only static profile sources are applied")
+	}
+	if f.config.ConnectionLog != nil {
+		log.Println("Warning: the connection log needs the daemon; new connections are not logged")
+	}
+	if f.config.Events != nil {
+		log.Println("Warning: the event store needs the daemon; no events are stored")
+	}
+	if f.config.DecisionLog != nil {
+		log.Println("Warning: the decision log needs the daemon; no decisions are recorded")
+	}
+	if f.config.BGP != nil {
+		log.Println("Warning: BGP needs the daemon; @bgp groups are empty")
+	}
+	if f.config.DNS.Proxy != nil {
+		log.Println("Warning: the DNS proxy needs the daemon; queries are not answered")
+	}
+	if f.config.BlockPage != nil {
+		log.Println("Warning: the block page needs the daemon; denied HTTP is dropped")
+	}
+	if f.config.Honeypot != nil {
+		log.Println("Warning: the honeypot needs the daemon; its targets are left to the policy")
+	}
+	f.saveDNSCache()
+	return nil
+}
+
+// program sets up interfaces and the ruleset for the current config
+// Must be called with mu held
+func (f *Filter) program() error {
+	f.setupVLANs()
+	f.setupVRFs()
+	f.setupRoutes()
+
+	if err := f.checkFirewalls(); err != nil {
+		return err
+	}
+
+	log.Println("Setting up nftables rules...")
+	if err := f.setupTable(f.config); err != nil {
+		return fmt.Errorf("failed to setup nftables: %w", err)
+	}
+
+	f.loadDNSCache()
+	f.loadPersistedAddresses()
+	f.discoverServices(true)
+	f.fetchIPRanges(true)
+	f.fetchASNPrefixes(true)
+
+	if f.config.DNS.Startup.EffectivePolicy() == config.StartupBlock {
+		if err := f.waitForDomains(); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Processing filtering rules...")
+	if err := f.applyRules(); err != nil {
+		return fmt.Errorf("failed to apply rules: %w", err)
+	}
+	f.persistRuleset()
+	return nil
+}
+
+// Stop stops the filter, leaving the ruleset as on_shutdown says
 func (f *Filter) Stop() error {
+	return f.stop(false)
+}
+
+// Handover stops the filter leaving the ruleset in place, for the instance
+// taking over to replace
+func (f *Filter) Handover() error {
+	return f.stop(true)
+}
+
+func (f *Filter) stop(handover bool) error {
 	close(f.stopChan)
 
 	if f.watcher != nil {
 		f.watcher.Close()
 	}
+	f.stopDNSProxy()
+	f.stopBlockPage()
+	f.stopHoneypot()
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	log.Println("Cleaning up nftables rules...")
-	return f.nft.Cleanup()
+	if f.maintenance != nil {
+		f.maintenance.timer.Stop()
+	}
+	f.endRolloutLocked()
+
+	f.saveDNSCache()
+	f.closeEventStore()
+	f.closeDecisionLog()
+
+	if handover {
+		log.Println("Keeping nftables rules in place for the new instance")
+		return nil
+	}
+	switch f.config.EffectiveOnShutdown() {
+	case config.ShutdownKeep:
+		// The rules may match the VLAN subinterfaces, which stay too, as
+		// do the routes through them
+		log.Println("Keeping nftables rules in place (on_shutdown: keep)")
+		return nil
+	case config.ShutdownClosed:
+		log.Println("Replacing nftables rules with a deny-all (on_shutdown: closed)")
+		err := f.nft.DenyAll()
+		f.removeRoutes()
+		f.removeVLANs()
+		return err
+	}
+	log.Println("Cleaning up nftables rules (on_shutdown: open)...")
+	err := f.nft.Cleanup()
+	f.removeRoutes()
+	f.removeVLANs()
+	return err
+}
+
+// loadDNSCache loads the persisted DNS cache, if configured
+func (f *Filter) loadDNSCache() {
+	path := f.config.DNS.CacheFile
+	persister, ok := f.dns.(dns.Persister)
+	if path == "" || !ok {
+		return
+	}
+
+	loaded, err := persister.LoadCache(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to load DNS cache from %s: %v", path, err)
+		}
+		return
+	}
+	log.Printf("Loaded %d DNS cache entries from %s", loaded, path)
+}
+
+// saveDNSCache persists the DNS cache, if configured
+func (f *Filter) saveDNSCache() {
+	path := f.config.DNS.CacheFile
+	persister, ok := f.dns.(dns.Persister)
+	if path == "" || !ok {
+		return
+	}
+
+	if err := persister.SaveCache(path); err != nil {
+		log.Printf("Warning: failed to save DNS cache to %s: %v", path, err)
+		return
+	}
+	log.Printf("Saved DNS cache to %s", path)
 }
 
 // applyRules processes all configuration rules and applies them
 func (f *Filter) applyRules() error {
-	for _, rule := range f.config.Rules {
-		if err := f.applyRule(rule); err != nil {
-			return fmt.Errorf("failed to apply rule %s: %w", rule.Name, err)
+	f.unresolved = make(map[string]map[string]bool)
+	f.pending = make(map[string]bool)
+	f.nft.SetLenient(f.config.Lenient)
+	f.configHash = f.config.Hash()
+	f.index = policy.New(f.config.Rules)
+	f.expired = expiredRules(f.config.Rules, time.Now())
+
+	if err := f.applyHardening(); err != nil {
+		return err
+	}
+	if err := f.applyRateLimits(); err != nil {
+		return err
+	}
+	if err := f.applyMetadataProtection(); err != nil {
+		return err
+	}
+	// Rules are compiled concurrently, as resolving their addresses can
+	// take a while, and programmed in order from this goroutine alone
+	compiled := f.compileRules(f.config.Rules)
+	for i, rule := range f.config.Rules {
+		if !f.ruleEnabled(rule) {
+			if f.quiet {
+				continue
+			}
+			if f.expired[rule.Name] {
+				log.Printf("Skipped expired rule: %s (expired %s)", rule.Name, rule.Expires.Format(time.RFC3339))
+			} else {
+				log.Printf("Skipped disabled rule: %s", rule.Name)
+			}
+			continue
+		}
+		f.markUnresolved(rule.Name, compiled[i].unresolved)
+		for _, r := range compiled[i].rules {
+			if err := f.nft.AddRule(r); err != nil {
+				return fmt.Errorf("failed to apply rule %s: %w", rule.Name, err)
+			}
 		}
-		log.Printf("Applied rule: %s (order: %d, action: %s)", rule.Name, rule.Order, rule.Action)
+		if !f.quiet {
+			log.Printf("Applied rule: %s (order: %d, action: %s)", rule.Name, rule.Order, rule.Action)
+		}
+	}
+
+	if err := f.addQueueRule(); err != nil {
+		return err
+	}
+	if err := f.applyProfiles(); err != nil {
+		return err
 	}
+
+	if !f.quiet {
+		f.reportUnresolved()
+	}
+	f.resolvePending()
 	return nil
 }
 
-// applyRule applies a single rule
-func (f *Filter) applyRule(rule config.Rule) error {
-	// Handle domain-based rules
-	if len(rule.Egress.Domains) > 0 {
-		for _, domain := range rule.Egress.Domains {
-			// Skip wildcard domains - they can't be pre-resolved
-			// Wildcard matching would need to be done at connection time with SNI inspection
-			// For now, wildcards are logged but not enforced
-			if isWildcard(domain) {
-				log.Printf("Note: Wildcard domain %s in rule %s - wildcard enforcement requires SNI inspection (Phase 2)", domain, rule.Name)
-				continue
+// Check reports the first rule of cfg that would fail to build, as a reload
+// would
+func Check(cfg *config.Config) error {
+	return checkRules(cfg)
+}
+
+// checkRules reports the first rule of cfg, including its maintenance
+// rules, that would fail to build, so that the running ruleset can be kept
+// rather than torn down for a policy that can't be applied
+func checkRules(cfg *config.Config) error {
+	if cfg.Lenient {
+		return nil
+	}
+	rules := cfg.Rules
+	if cfg.Maintenance != nil {
+		rules = append(append([]config.Rule(nil), rules...), cfg.Maintenance.Rules...)
+	}
+	for i, rule := range rules {
+		for branch, branchRule := range ruleBranches(rule) {
+			// Only the static addresses are known before the rules are
+			// built, which is enough to tell whether they can be
+			var excludedIPs []string
+			if branchRule.Egress.Excludes() {
+				excludedIPs = branchRule.Egress.NotIPs
+			}
+			for _, r := range branchRules(cfg, i, branchRule, branch, staticIPs(branchRule), excludedIPs, "") {
+				if err := nftables.CheckRule(r); err != nil {
+					return fmt.Errorf("rule %s: %w", rule.Name, err)
+				}
 			}
+		}
+	}
+	return nil
+}
 
-			// Resolve domain to IPs
-			ips, err := f.dns.Resolve(domain)
-			if err != nil {
-				log.Printf("Warning: failed to resolve domain %s: %v", domain, err)
-				continue
+// compileRule builds the nftables rules of a rule, with the addresses it
+// resolved to and the domains that failed to resolve; deferred domains are
+// left out, see deferDomains
+// Must be called with mu held; safe to call concurrently
+func (f *Filter) compileRule(index int, rule config.Rule, deferred map[string][]string) compiledRule {
+	var compiled compiledRule
+	for branch, branchRule := range ruleBranches(rule) {
+		c := f.compileBranch(index, branchRule, branch, deferred)
+		compiled.rules = append(compiled.rules, c.rules...)
+		compiled.unresolved = append(compiled.unresolved, c.unresolved...)
+	}
+	return compiled
+}
+
+// compileBranch builds the nftables rules of a branch of a rule, see
+// ruleBranches
+// Must be called with mu held; safe to call concurrently
+func (f *Filter) compileBranch(index int, rule config.Rule, branch int, deferred map[string][]string) compiledRule {
+	var compiled compiledRule
+
+	// Excluded addresses go in sets of their own, kept even while empty
+	// for the addresses of excluded domains resolved later
+	var excludedIPs []string
+	if rule.Egress.Excludes() {
+		excludedIPs, compiled.unresolved = f.resolveExcludedIPs(rule, nil)
+	}
+
+	// Domain, service and IP rules share a single set holding the static
+	// IPs plus the current addresses of all domains and services
+	var ips []string
+	if discoversIPs(rule) || len(rule.Egress.IPs) > 0 {
+		var unresolved []string
+		ips, unresolved = f.resolveRuleIPs(rule, deferred)
+		compiled.unresolved = append(compiled.unresolved, unresolved...)
+	}
+
+	compiled.rules = branchRules(f.config, index, rule, branch, ips, excludedIPs, f.ruleComment(rule))
+	return compiled
+}
+
+// discoversIPs reports whether the addresses of rule are learned, from its
+// domains, services, IP groups or ASNs, rather than all static
+func discoversIPs(rule config.Rule) bool {
+	return len(rule.Egress.Domains) > 0 || len(rule.Egress.Services) > 0 ||
+		len(ipGroups(rule)) > 0 || len(rule.Egress.ASNs) > 0
+}
+
+// branchRules builds the nftables rules of a branch of a rule of cfg
+// matching ips, except excludedIPs
+func branchRules(cfg *config.Config, index int, rule config.Rule, branch int, ips, excludedIPs []string, comment string) []nftables.Rule {
+	var rules []nftables.Rule
+
+	// Rules with l7 protocols queue their traffic to the inspector, which
+	// classifies each flow and applies the verdict
+	inspectL7 := len(rule.Egress.L7) > 0
+	var mark uint32
+	if inspectL7 {
+		mark = inspect.L7Mark(index)
+	}
+
+	// Lengths are validated with the config
+	minLength, maxLength, _ := config.ParseLength(rule.Length)
+
+	discovered := discoversIPs(rule)
+	if discovered || len(rule.Egress.IPs) > 0 {
+		// Domain and service rules keep their sets even while empty, so
+		// addresses resolved later can be filled in
+		rules = append(rules, nftables.Rule{
+			Name:           rule.Name,
+			Action:         string(rule.Action),
+			Priority:       rule.Order,
+			IPs:            ips,
+			Ports:          rule.Egress.Ports,
+			PortGroup:      rule.Egress.PortGroup,
+			Protocols:      protocolsToStrings(rule.Egress.Protocols),
+			CtStates:       ctStatesToStrings(rule.CtStates),
+			TTLLessThan:    rule.TTLLessThan,
+			TTLEqual:       rule.TTLEqual,
+			MinLength:      minLength,
+			MaxLength:      maxLength,
+			DestinationSet: discovered,
+			ExcludedIPs:    excludedIPs,
+			ExcludedSet:    len(rule.Egress.NotDomains) > 0,
+			ExcludedPorts:  rule.Egress.NotPorts,
+			Branch:         branch,
+			BlockQUIC:      rule.BlockQUIC,
+			DenyBehavior:   string(rule.DenyBehavior),
+			RejectWith:     rule.RejectWith,
+			Log:            rule.Log,
+			LogConnections: logsConnections(cfg, rule),
+			Inspect:        inspectL7,
+			Queue:          inspectionQueue(cfg),
+			Mark:           mark,
+			InputInterface: ruleInterface(cfg, rule),
+			VRF:            rule.VRF,
+			Profile:        rule.Profile,
+			Comment:        comment,
+		})
+	}
+
+	// Handle protocol-only rules (e.g., allow all ICMP), l7-only rules and
+	// rules matching everything from a VLAN, VRF or profile, everything but
+	// what they exclude, or everything in some conntrack states or with some
+	// TTLs or lengths
+	scoped := len(rule.Egress.Protocols) > 0 || inspectL7 || rule.VLANID != 0 || rule.VRF != "" || rule.Profile != "" ||
+		rule.Egress.Excludes() || len(rule.CtStates) > 0 || rule.MatchesPacket()
+	if scoped && len(rule.Egress.IPs) == 0 && !discovered {
+		rules = append(rules, nftables.Rule{
+			Name:           rule.Name,
+			Action:         string(rule.Action),
+			Priority:       rule.Order,
+			Ports:          rule.Egress.Ports,
+			PortGroup:      rule.Egress.PortGroup,
+			Protocols:      protocolsToStrings(rule.Egress.Protocols),
+			CtStates:       ctStatesToStrings(rule.CtStates),
+			TTLLessThan:    rule.TTLLessThan,
+			TTLEqual:       rule.TTLEqual,
+			MinLength:      minLength,
+			MaxLength:      maxLength,
+			ExcludedIPs:    excludedIPs,
+			ExcludedSet:    len(rule.Egress.NotDomains) > 0,
+			ExcludedPorts:  rule.Egress.NotPorts,
+			Branch:         branch,
+			BlockQUIC:      rule.BlockQUIC,
+			DenyBehavior:   string(rule.DenyBehavior),
+			RejectWith:     rule.RejectWith,
+			Log:            rule.Log,
+			LogConnections: logsConnections(cfg, rule),
+			Inspect:        inspectL7,
+			Queue:          inspectionQueue(cfg),
+			Mark:           mark,
+			InputInterface: ruleInterface(cfg, rule),
+			VRF:            rule.VRF,
+			Profile:        rule.Profile,
+			Comment:        comment,
+		})
+	}
+
+	return rules
+}
+
+// ruleComment maps the nftables rules of rule back to the policy: the hash
+// of the config and the rule's name and ID, then its reference and
+// description, which go last as the comment is cut to the length nft accepts
+func (f *Filter) ruleComment(rule config.Rule) string {
+	comment := fmt.Sprintf("config=%s rule=%s", f.configHash, rule.Name)
+	if rule.ID != "" {
+		comment += " id=" + rule.ID
+	}
+	if rule.Reference != "" {
+		comment += " ref=" + rule.Reference
+	}
+	if rule.Description != "" {
+		comment += " desc=" + rule.Description
+	}
+	return comment
+}
+
+// resolveRuleIPs returns the static IPs of a rule plus the addresses of its
+// domains, and the domains that failed to resolve. Addresses in known take
+// precedence over resolver lookups; persisted addresses are used for domains
+// that fail to resolve when the persisted startup policy is active.
+func (f *Filter) resolveRuleIPs(rule config.Rule, known map[string][]string) ([]string, []string) {
+	var unresolved []string
+	var ips []string
+	seen := make(map[string]bool)
+	for _, ip := range rule.Egress.IPs {
+		expanded := []string{ip}
+		if config.IsIPGroup(ip) {
+			group, _ := config.ParseIPGroup(ip)
+			if group.Provider == config.ProviderBGP {
+				expanded = f.bgpPrefixes(group.Service)
+			} else {
+				expanded = f.ranges.Expand(group)
+			}
+		}
+		for _, addr := range expanded {
+			if !seen[addr] {
+				seen[addr] = true
+				ips = append(ips, addr)
 			}
+		}
+	}
 
-			// Add IPs to nftables
-			if err := f.nft.AddRule(nftables.Rule{
-				Name:      rule.Name,
-				Action:    string(rule.Action),
-				Priority:  rule.Order,
-				IPs:       ips,
-				Ports:     rule.Egress.Ports,
-				Protocols: protocolsToStrings(rule.Egress.Protocols),
-			}); err != nil {
-				return fmt.Errorf("failed to add nftables rule for domain %s: %w", domain, err)
+	for _, domain := range rule.Egress.Domains {
+		// Skip wildcard domains - they can't be pre-resolved
+		// They are matched at connection time by SNI inspection
+		if isWildcard(domain) {
+			if insp := f.config.Inspection; insp == nil || !insp.SNI {
+				log.Printf("Note: Wildcard domain %s in rule %s - wildcard enforcement requires inspection.sni", domain, rule.Name)
+			}
+			continue
+		}
+
+		domainIPs, ok := f.lookupDomain(domain, known)
+		if !ok {
+			unresolved = append(unresolved, domain)
+		}
+		for _, ip := range domainIPs {
+			f.recordDomain(rule.Name, ip, domain)
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	// Current endpoints of services
+	for _, service := range rule.Egress.Services {
+		for _, ip := range f.endpoints[service.String()] {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
 			}
 		}
 	}
 
-	// Handle IP-based rules
-	if len(rule.Egress.IPs) > 0 {
-		if err := f.nft.AddRule(nftables.Rule{
-			Name:      rule.Name,
-			Action:    string(rule.Action),
-			Priority:  rule.Order,
-			IPs:       rule.Egress.IPs,
-			Ports:     rule.Egress.Ports,
-			Protocols: protocolsToStrings(rule.Egress.Protocols),
-		}); err != nil {
-			return fmt.Errorf("failed to add nftables rule: %w", err)
+	// Announced prefixes of autonomous systems
+	for _, asn := range ruleASNs(rule) {
+		for _, prefix := range f.asns.Expand(asn) {
+			if !seen[prefix] {
+				seen[prefix] = true
+				ips = append(ips, prefix)
+			}
 		}
 	}
 
-	// Handle protocol-only rules (e.g., allow all ICMP)
-	if len(rule.Egress.Protocols) > 0 && len(rule.Egress.IPs) == 0 && len(rule.Egress.Domains) == 0 {
-		if err := f.nft.AddRule(nftables.Rule{
-			Name:      rule.Name,
-			Action:    string(rule.Action),
-			Priority:  rule.Order,
-			Ports:     rule.Egress.Ports,
-			Protocols: protocolsToStrings(rule.Egress.Protocols),
-		}); err != nil {
-			return fmt.Errorf("failed to add protocol rule: %w", err)
+	// Addresses allowed by SNI inspection, the DNS proxy or the active router
+	for _, ip := range append(f.learnedIPs(rule), f.syncedIPs(rule.Name)...) {
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
 		}
 	}
 
-	return nil
+	return ips, unresolved
+}
+
+// lookupDomain returns the addresses of domain, from known if there,
+// reporting whether it resolved; a domain that fails to resolve keeps its
+// last persisted addresses, if any
+// Must be called with mu held
+func (f *Filter) lookupDomain(domain string, known map[string][]string) ([]string, bool) {
+	if ips, ok := known[domain]; ok {
+		return ips, true
+	}
+	ips, err := f.dns.Resolve(domain)
+	if err == nil {
+		return ips, true
+	}
+	log.Printf("Warning: failed to resolve domain %s: %v", domain, err)
+	if ips, ok := f.persisted[domain]; ok {
+		log.Printf("Using last persisted addresses for %s: %v", domain, ips)
+		return ips, false
+	}
+	return nil, false
+}
+
+// resolveExcludedIPs returns the addresses rule excludes: its not_ips plus
+// the current addresses of its not_domains, with the domains that failed to
+// resolve
+// Must be called with mu held
+func (f *Filter) resolveExcludedIPs(rule config.Rule, known map[string][]string) ([]string, []string) {
+	var unresolved []string
+	ips := append([]string(nil), rule.Egress.NotIPs...)
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		seen[ip] = true
+	}
+	for _, domain := range rule.Egress.NotDomains {
+		domainIPs, ok := f.lookupDomain(domain, known)
+		if !ok {
+			unresolved = append(unresolved, domain)
+		}
+		for _, ip := range domainIPs {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, unresolved
 }
 
 // updateDomainIPs updates nftables rules when DNS entries change
 func (f *Filter) updateDomainIPs(domain string, ips []string) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	return f.updateDomainIPsLocked(domain, ips)
+}
+
+// updateDomainIPsLocked is updateDomainIPs for callers holding mu
+// Must be called with mu held
+func (f *Filter) updateDomainIPsLocked(domain string, ips []string) error {
+	if err := f.updateDomainSets(domain, ips); err != nil {
+		return err
+	}
+	// The canary policy follows DNS changes too
+	if f.rollout != nil {
+		return f.rollout.canary.updateDomainSets(domain, ips)
+	}
+	return nil
+}
+
+// updateDomainSets replaces the sets of the rules using domain
+// Must be called with mu held
+func (f *Filter) updateDomainSets(domain string, ips []string) error {
+	for _, rule := range rulesUsingDomain(f.enabledRules(), domain) {
+		// Replace the rule's sets with the refreshed addresses
+		if err := f.updateRuleIPs(rule, map[string][]string{domain: ips}); err != nil {
+			return err
+		}
+	}
+	for _, rule := range rulesExcludingDomain(f.enabledRules(), domain) {
+		if err := f.updateExcludedIPs(rule, map[string][]string{domain: ips}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	// Find rules that use this domain
-	for _, rule := range f.config.Rules {
-		for _, d := range rule.Egress.Domains {
+// rulesUsingDomain returns the rules with a domain pattern matching domain
+func rulesUsingDomain(rules []config.Rule, domain string) []config.Rule {
+	var result []config.Rule
+	for _, rule := range rules {
+		for _, d := range rule.Egress.AllDomains() {
 			if matchDomain(d, domain) {
-				// Update the rule with new IPs
-				if err := f.nft.UpdateIPs(rule.Name, ips); err != nil {
-					return err
-				}
+				result = append(result, rule)
+				break
 			}
 		}
 	}
+	return result
+}
 
-	return nil
+// rulesExcludingDomain returns the rules with domain in the not_domains of
+// any of their branches
+func rulesExcludingDomain(rules []config.Rule, domain string) []config.Rule {
+	var result []config.Rule
+	for _, rule := range rules {
+		if excludesDomain(rule, domain) {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+// excludesDomain reports whether a branch of rule has domain in its
+// not_domains
+func excludesDomain(rule config.Rule, domain string) bool {
+	for _, branch := range ruleBranches(rule) {
+		for _, d := range branch.Egress.NotDomains {
+			if d == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setupTable sets up the ruleset's table where cfg places it
+func (f *Filter) setupTable(cfg *config.Config) error {
+	p, err := placement(cfg)
+	if err != nil {
+		return err
+	}
+	f.nft.SetPlacement(p)
+	f.nft.SetConnectionLog(connectionLog(cfg))
+	f.nft.SetMasquerade(masquerade(cfg))
+	f.nft.SetForwards(forwards(cfg))
+	f.nft.SetPortMappings(portMappingInterface(cfg))
+	f.nft.SetBlockPage(f.blockPagePort)
+	f.nft.SetHoneypot(honeypotRedirect(cfg, f.honeypotPort))
+	f.nft.SetInspectionExempt(cfg.InspectionExemptSources)
+	f.nft.SetBan(ban(cfg))
+	f.nft.SetPortGroups(portGroups(cfg))
+	if cfg.Chain.EffectiveCoexistence() == config.CoexistIntegrate && p.Priority == nil && len(f.firewalls) > 0 {
+		p.Priority = f.nft.PriorityAfter(f.firewalls)
+		f.nft.SetPlacement(p)
+	}
+	return f.nft.Setup()
+}
+
+// portGroups returns the ports of the port groups of cfg
+func portGroups(cfg *config.Config) map[string][]string {
+	groups := make(map[string][]string, len(cfg.PortGroups))
+	for name, definition := range cfg.PortGroups {
+		group, err := config.ParsePortGroup(definition)
+		if err != nil {
+			continue // Rejected by Validate
+		}
+		groups[name] = group.Ports
+	}
+	return groups
+}
+
+// placement returns where cfg places the ruleset
+func placement(cfg *config.Config) (nftables.Placement, error) {
+	if cfg.Chain == nil {
+		return nftables.Placement{}, nil
+	}
+	return nftables.ParsePlacement(cfg.Chain.Family, cfg.Chain.Hook, cfg.Chain.Priority)
+}
+
+// masquerade returns how cfg scopes masquerading, nil for all traffic
+func masquerade(cfg *config.Config) *nftables.Masquerade {
+	if cfg.NAT == nil {
+		return nil
+	}
+	return &nftables.Masquerade{
+		Interfaces:          cfg.NAT.Interfaces,
+		ExcludeDestinations: cfg.NAT.ExcludeDestinations,
+	}
+}
+
+// forwards returns the port forwards of cfg
+func forwards(cfg *config.Config) []nftables.Forward {
+	if cfg.NAT == nil {
+		return nil
+	}
+	var result []nftables.Forward
+	for _, pf := range cfg.NAT.Forwards {
+		// Validated with the config
+		to, port, _ := pf.Target()
+		result = append(result, nftables.Forward{
+			Protocol:  pf.EffectiveProtocol(),
+			Port:      pf.Port,
+			Address:   net.ParseIP(pf.Address),
+			Interface: pf.Interface,
+			To:        to,
+			ToPort:    port,
+			Hairpin:   pf.Hairpin,
+		})
+	}
+	return result
+}
+
+// portMappingInterface returns the interface of the port mappings of cfg,
+// "" without them
+func portMappingInterface(cfg *config.Config) string {
+	if cfg.UPnP == nil {
+		return ""
+	}
+	return cfg.UPnP.ExternalInterface
+}
+
+// resolverSettings derives the resolver's routing and caching settings from
+// a config
+func resolverSettings(cfg *config.Config) dns.Settings {
+	settings := dns.Settings{
+		Servers:            cfg.DNS.Servers,
+		Suffixes:           make(map[string][]string),
+		Domains:            make(map[string][]string),
+		WatchCNAMETargets:  cfg.DNS.WatchCNAMETargets,
+		RefreshConcurrency: cfg.DNS.Refresh.Concurrency,
+		RefreshJitter:      cfg.DNS.Refresh.Jitter.Std(),
+		RefreshDeadline:    cfg.DNS.Refresh.Deadline.Std(),
+		RefreshInterval:    cfg.DNS.Refresh.Interval.Std(),
+		CacheTTL:           cfg.DNS.CacheTTL.Std(),
+		CacheMaxEntries:    cfg.DNS.CacheMaxEntries,
+		ClientSubnet:       cfg.DNS.ClientSubnet,
+		Strategy:           dns.Strategy(cfg.DNS.Pool.EffectiveStrategy()),
+		FailureThreshold:   cfg.DNS.Pool.FailureThreshold,
+		ProbeInterval:      cfg.DNS.Pool.ProbeInterval.Std(),
+		ProbeDomain:        cfg.DNS.Pool.ProbeDomain,
+	}
+
+	for _, s := range cfg.DNS.Suffixes {
+		settings.Suffixes[s.Suffix] = s.Servers
+	}
+
+	for _, rule := range cfg.Rules {
+		if len(rule.Resolvers) == 0 {
+			continue
+		}
+		for _, domain := range rule.Egress.AllDomains() {
+			settings.Domains[domain] = rule.Resolvers
+		}
+	}
+
+	// A domain of several rules is refreshed as often as any of them asks
+	for _, rule := range cfg.Rules {
+		interval := rule.RefreshInterval.Std()
+		if interval == 0 {
+			continue
+		}
+		if settings.DomainRefreshIntervals == nil {
+			settings.DomainRefreshIntervals = make(map[string]time.Duration)
+		}
+		for _, domain := range rule.Egress.AllDomains() {
+			if prev, ok := settings.DomainRefreshIntervals[domain]; !ok || interval < prev {
+				settings.DomainRefreshIntervals[domain] = interval
+			}
+		}
+	}
+
+	if agg := cfg.DNS.Aggregation; agg != nil {
+		settings.AggregationRounds = agg.Rounds
+		settings.AggregationIPTTL = agg.IPTTL.Std()
+	}
+
+	return settings
 }
 
 // matchDomain checks if a domain pattern matches a domain
@@ -215,6 +1025,15 @@ func protocolsToStrings(protocols []config.Protocol) []string {
 	return result
 }
 
+// ctStatesToStrings converts conntrack states to strings
+func ctStatesToStrings(states []config.CtState) []string {
+	result := make([]string, len(states))
+	for i, s := range states {
+		result[i] = string(s)
+	}
+	return result
+}
+
 // watchConfigFile watches for config file changes and reloads
 func (f *Filter) watchConfigFile() {
 	for {
@@ -254,32 +1073,147 @@ func (f *Filter) reloadConfig() error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	return f.Reload(newConfig)
+}
+
+// ReloadNow reloads the config from its source or file without waiting for
+// a change to be noticed, e.g. on SIGHUP
+func (f *Filter) ReloadNow() error {
+	if f.source == nil {
+		return f.reloadConfig()
+	}
+	newConfig, _, err := config.LoadSource(context.Background(), f.source)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	return f.Reload(newConfig)
+}
+
+// Reload validates and applies a changed config read from its source,
+// storing the outcome as an event
+func (f *Filter) Reload(newConfig *config.Config) error {
+	applied, err := f.reload(newConfig)
+	if applied || err != nil {
+		f.recordReload(err)
+	}
+	return err
+}
+
+// reload validates and applies newConfig, reporting whether it applied it
+func (f *Filter) reload(newConfig *config.Config) (bool, error) {
 	// Validate config
 	if err := newConfig.Validate(); err != nil {
-		return fmt.Errorf("config validation failed: %w", err)
+		return false, fmt.Errorf("config validation failed: %w", err)
+	}
+
+	if f.netns != 0 {
+		if err := checkNetNSConfig(newConfig); err != nil {
+			return false, err
+		}
+	}
+
+	// Agents get their policy from the controller
+	if newConfig.Cluster != nil {
+		log.Println("Policy is managed by the cluster controller, ignoring local changes until restart")
+		return false, nil
+	}
+
+	return true, f.Apply(newConfig)
+}
+
+// Apply replaces the policy with cfg, which must be valid. A policy with
+// rules that fail to build is refused, keeping the running one, unless it
+// is lenient.
+func (f *Filter) Apply(newConfig *config.Config) error {
+	if err := checkRules(newConfig); err != nil {
+		return fmt.Errorf("keeping the running policy: %w", err)
 	}
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	// Maintenance mode stays on across reloads, with the new normal rules
+	if f.maintenance != nil {
+		if newConfig.Maintenance == nil {
+			log.Println("Maintenance policy removed from config, leaving maintenance mode")
+			f.stopMaintenanceLocked()
+		} else {
+			f.maintenance.base = newConfig
+			newConfig = maintenanceConfig(newConfig)
+		}
+	}
+
+	// Changes roll out gradually if configured, except onto the maintenance
+	// policy
+	if newConfig.Rollout != nil && f.maintenance == nil {
+		err := f.startRolloutLocked(newConfig)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Warning: applying the new policy to all traffic, rollout failed: %v", err)
+	}
+
+	return f.applyConfig(newConfig)
+}
+
+// applyConfig recreates the ruleset for cfg, recreating the previous one if
+// that fails so that traffic isn't left without a policy
+// Must be called with mu held
+func (f *Filter) applyConfig(cfg *config.Config) error {
+	// Any rollout ends with the ruleset it was split from
+	f.endRolloutLocked()
+
+	previous := f.config
+	err := f.buildConfig(cfg)
+	if err == nil || previous == nil || previous == cfg {
+		return err
+	}
+	log.Printf("Warning: restoring the previous policy: %v", err)
+	if restoreErr := f.buildConfig(previous); restoreErr != nil {
+		log.Printf("Warning: failed to restore the previous policy: %v", restoreErr)
+	}
+	return err
+}
+
+// buildConfig clears the ruleset and builds the one for cfg
+// Must be called with mu held
+func (f *Filter) buildConfig(cfg *config.Config) error {
 	log.Println("Clearing existing nftables rules...")
-	// Clear existing rules and recreate
+	// Clear existing rules and recreate, keeping the bans
+	banned := f.bannedSources()
 	if err := f.nft.Cleanup(); err != nil {
 		return fmt.Errorf("failed to cleanup nftables: %w", err)
 	}
 
-	if err := f.nft.Setup(); err != nil {
+	if err := f.setupTable(cfg); err != nil {
 		return fmt.Errorf("failed to setup nftables: %w", err)
 	}
+	f.restoreGrants()
+	f.restoreBans(banned)
+	f.restorePortMappings(cfg)
 
 	// Update config
-	f.config = newConfig
+	f.config = cfg
+	f.setupVLANs()
+	f.setupVRFs()
+	f.setupRoutes()
+	f.dns.Configure(resolverSettings(cfg))
+	f.loadPersistedAddresses()
+	if disc, err := newDiscovery(cfg, f.dns.Resolve); err != nil {
+		log.Printf("Warning: keeping the previous service discovery settings: %v", err)
+	} else {
+		f.discovery = disc
+	}
+	f.discoverServices(false)
+	f.fetchIPRanges(false)
+	f.fetchASNPrefixes(false)
 
 	// Apply new rules
 	log.Println("Applying new configuration rules...")
 	if err := f.applyRules(); err != nil {
 		return fmt.Errorf("failed to apply rules: %w", err)
 	}
+	f.persistRuleset()
 
 	return nil
 }
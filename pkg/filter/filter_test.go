@@ -0,0 +1,543 @@
+package filter
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/dns/dnstest"
+	"github.com/skaegi/legion-router/pkg/inspect"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+func newTestFilter(t *testing.T, cfg *config.Config) (*Filter, *dnstest.FakeResolver) {
+	t.Helper()
+	resolver := dnstest.NewFakeResolver()
+	f, err := New(cfg, "", resolver)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	t.Cleanup(func() { f.watcher.Close() })
+	return f, resolver
+}
+
+// TestNewRequiresResolver tests that a resolver must be injected
+func TestNewRequiresResolver(t *testing.T) {
+	if _, err := New(&config.Config{Version: "1.0"}, "", nil); err == nil {
+		t.Error("Expected error without resolver")
+	}
+}
+
+// TestResolverSettings tests that DNS config and per-rule resolvers are applied
+func TestResolverSettings(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		DNS: config.DNSConfig{
+			Servers:     []string{"9.9.9.9"},
+			Suffixes:    []config.SuffixResolver{{Suffix: "corp.example.com", Servers: []string{"10.0.0.53"}}},
+			Aggregation: &config.AggregationConfig{Rounds: 3, IPTTL: config.Duration(30 * time.Minute)},
+			Refresh:     config.RefreshConfig{Interval: config.Duration(10 * time.Minute)},
+			Pool:        config.PoolConfig{Strategy: config.PoolFastest, FailureThreshold: 5},
+		},
+		Rules: []config.Rule{
+			{
+				Name:      "internal",
+				Action:    config.ActionAllow,
+				Egress:    config.Egress{Domains: []string{"git.internal"}},
+				Resolvers: []string{"10.1.0.53"},
+			},
+			{
+				Name:            "cdn",
+				Action:          config.ActionAllow,
+				Egress:          config.Egress{Domains: []string{"api.fastly.com", "www.fastly.com"}},
+				RefreshInterval: config.Duration(2 * time.Minute),
+			},
+			{
+				Name:            "cdn-api",
+				Action:          config.ActionAllow,
+				Egress:          config.Egress{Domains: []string{"api.fastly.com"}},
+				RefreshInterval: config.Duration(30 * time.Second),
+			},
+		},
+	}
+
+	_, resolver := newTestFilter(t, cfg)
+	settings := resolver.Settings()
+
+	if len(settings.Servers) != 1 || settings.Servers[0] != "9.9.9.9" {
+		t.Errorf("Expected default servers [9.9.9.9], got %v", settings.Servers)
+	}
+	if got := settings.Suffixes["corp.example.com"]; len(got) != 1 || got[0] != "10.0.0.53" {
+		t.Errorf("Expected suffix route to 10.0.0.53, got %v", got)
+	}
+	if got := settings.Domains["git.internal"]; len(got) != 1 || got[0] != "10.1.0.53" {
+		t.Errorf("Expected domain route to 10.1.0.53, got %v", got)
+	}
+	if settings.AggregationRounds != 3 || settings.AggregationIPTTL != 30*time.Minute {
+		t.Errorf("Expected aggregation 3 rounds / 30m, got %d / %s", settings.AggregationRounds, settings.AggregationIPTTL)
+	}
+	if settings.RefreshInterval != 10*time.Minute {
+		t.Errorf("Expected refresh interval 10m, got %s", settings.RefreshInterval)
+	}
+	if settings.Strategy != dns.StrategyFastest || settings.FailureThreshold != 5 {
+		t.Errorf("Expected the fastest upstream first, demoted after 5 failures, got %s / %d", settings.Strategy, settings.FailureThreshold)
+	}
+	intervals := settings.DomainRefreshIntervals
+	if len(intervals) != 2 || intervals["api.fastly.com"] != 30*time.Second || intervals["www.fastly.com"] != 2*time.Minute {
+		t.Errorf("Expected the shortest interval of each domain, got %v", intervals)
+	}
+}
+
+// TestResolveRuleIPs tests combining static IPs with resolved domains
+func TestResolveRuleIPs(t *testing.T) {
+	rule := config.Rule{
+		Name:   "allow-github",
+		Action: config.ActionAllow,
+		Egress: config.Egress{
+			IPs:     []string{"10.0.0.0/8", "140.82.112.3"},
+			Domains: []string{"github.com", "api.github.com", "*.github.com", "broken.example.com"},
+		},
+	}
+
+	f, resolver := newTestFilter(t, &config.Config{Version: "1.0", Rules: []config.Rule{rule}})
+	resolver.Set("github.com", "140.82.112.3", "140.82.112.4")
+	resolver.Set("api.github.com", "140.82.112.5", "2606:50c0:8000::64")
+
+	got, unresolved := f.resolveRuleIPs(rule, nil)
+	want := "10.0.0.0/8,140.82.112.3,140.82.112.4,140.82.112.5,2606:50c0:8000::64"
+	if strings.Join(got, ",") != want {
+		t.Errorf("resolveRuleIPs() = %v, want %s", got, want)
+	}
+	if strings.Join(unresolved, ",") != "broken.example.com" {
+		t.Errorf("Expected broken.example.com to be unresolved, got %v", unresolved)
+	}
+
+	if resolver.Lookups("*.github.com") != 0 {
+		t.Error("Expected wildcard domain not to be resolved")
+	}
+
+	// Refreshed addresses take precedence over the resolver
+	got, _ = f.resolveRuleIPs(rule, map[string][]string{"api.github.com": {"140.82.112.6"}})
+	want = "10.0.0.0/8,140.82.112.3,140.82.112.4,140.82.112.6"
+	if strings.Join(got, ",") != want {
+		t.Errorf("resolveRuleIPs() with refresh = %v, want %s", got, want)
+	}
+
+	// Resolved addresses are attributed to their domains in the connection log
+	if got := f.DomainOf("allow-github", net.ParseIP("140.82.112.6")); got != "api.github.com" {
+		t.Errorf("Expected 140.82.112.6 to be attributed to api.github.com, got %q", got)
+	}
+	if got := f.DomainOf("allow-github", net.ParseIP("10.0.0.1")); got != "" {
+		t.Errorf("Expected no domain for a static address, got %q", got)
+	}
+}
+
+// TestRulesUsingDomain tests which rules a refreshed domain updates
+func TestRulesUsingDomain(t *testing.T) {
+	rules := []config.Rule{
+		{Name: "exact", Egress: config.Egress{Domains: []string{"api.github.com"}}},
+		{Name: "wildcard", Egress: config.Egress{Domains: []string{"*.github.com"}}},
+		{Name: "other", Egress: config.Egress{Domains: []string{"registry.npmjs.org"}}},
+		{Name: "ips", Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}},
+	}
+
+	var names []string
+	for _, rule := range rulesUsingDomain(rules, "api.github.com") {
+		names = append(names, rule.Name)
+	}
+	if strings.Join(names, ",") != "exact,wildcard" {
+		t.Errorf("Expected exact and wildcard rules, got %v", names)
+	}
+}
+
+// TestPersistedFallback tests that persisted addresses stand in for domains
+// that fail to resolve, while the rule is still reported as degraded
+func TestPersistedFallback(t *testing.T) {
+	rule := config.Rule{
+		Name:   "allow-registry",
+		Action: config.ActionAllow,
+		Egress: config.Egress{Domains: []string{"registry.example.com", "mirror.example.com"}},
+	}
+
+	f, resolver := newTestFilter(t, &config.Config{Version: "1.0", Rules: []config.Rule{rule}})
+	resolver.Set("mirror.example.com", "192.0.2.20")
+	f.persisted = map[string][]string{"registry.example.com": {"192.0.2.10"}}
+
+	ips, unresolved := f.resolveRuleIPs(rule, nil)
+	if strings.Join(ips, ",") != "192.0.2.10,192.0.2.20" {
+		t.Errorf("Expected persisted and resolved addresses, got %v", ips)
+	}
+
+	f.markUnresolved(rule.Name, unresolved)
+	status := f.Status()
+	if !status.Degraded {
+		t.Error("Expected degraded status")
+	}
+	if got := status.Unresolved["allow-registry"]; len(got) != 1 || got[0] != "registry.example.com" {
+		t.Errorf("Expected registry.example.com unresolved, got %v", got)
+	}
+}
+
+// TestLazyResolution tests that lazily resolved domain rules are installed
+// without their addresses, which are filled in in the background
+func TestLazyResolution(t *testing.T) {
+	rule := config.Rule{
+		Name:   "allow-registry",
+		Action: config.ActionAllow,
+		Egress: config.Egress{
+			IPs:     []string{"192.0.2.1"},
+			Domains: []string{"registry.example.com", "broken.example.com", "*.example.org"},
+		},
+	}
+	cfg := &config.Config{Version: "1.0", Rules: []config.Rule{rule}}
+	cfg.DNS.Startup.Lazy = true
+
+	f, resolver := newTestFilter(t, cfg)
+	resolver.Set("registry.example.com", "192.0.2.10")
+	f.nft = nftables.NewScriptManager()
+	if err := f.setupTable(cfg); err != nil {
+		t.Fatalf("Failed to set up table: %v", err)
+	}
+
+	f.mu.Lock()
+	if err := f.applyRules(); err != nil {
+		f.mu.Unlock()
+		t.Fatalf("applyRules() error = %v", err)
+	}
+	if !f.nft.ContainsIP(rule.Name, net.ParseIP("192.0.2.1")) || f.nft.ContainsIP(rule.Name, net.ParseIP("192.0.2.10")) {
+		t.Error("Expected only the static address to be installed up front")
+	}
+	if len(f.pending) != 2 || len(f.unresolved) != 0 {
+		t.Errorf("Expected 2 pending and no unresolved domains, got %v and %v", f.pending, f.unresolved)
+	}
+	f.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Status().Pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := f.Status()
+	if status.Pending != 0 {
+		t.Fatalf("Expected every domain to be resolved, %d pending", status.Pending)
+	}
+	if !f.nft.ContainsIP(rule.Name, net.ParseIP("192.0.2.10")) {
+		t.Error("Expected the resolved address to be filled in")
+	}
+	if got := status.Unresolved[rule.Name]; len(got) != 1 || got[0] != "broken.example.com" {
+		t.Errorf("Expected broken.example.com unresolved, got %v", got)
+	}
+}
+
+// TestAnswered tests that the addresses the DNS proxy answers for an
+// unresolved domain are allowed at once and kept by the next refresh
+func TestAnswered(t *testing.T) {
+	rule := config.Rule{
+		Name:   "allow-registry",
+		Action: config.ActionAllow,
+		Egress: config.Egress{Domains: []string{"registry.example.com"}},
+	}
+	cfg := &config.Config{Version: "1.0", Rules: []config.Rule{rule}}
+
+	f, _ := newTestFilter(t, cfg)
+	f.nft = nftables.NewScriptManager()
+	if err := f.setupTable(cfg); err != nil {
+		t.Fatalf("Failed to set up table: %v", err)
+	}
+	f.mu.Lock()
+	err := f.applyRules()
+	f.mu.Unlock()
+	if err != nil {
+		t.Fatalf("applyRules() error = %v", err)
+	}
+
+	address := net.ParseIP("192.0.2.10")
+	f.Answered("other.example.com", []net.IP{address})
+	if f.nft.ContainsIP(rule.Name, address) {
+		t.Fatal("Expected the answer for another domain to be ignored")
+	}
+	f.Answered("registry.example.com", []net.IP{address})
+	if !f.nft.ContainsIP(rule.Name, address) {
+		t.Fatal("Expected the answered address to be allowed")
+	}
+	ips, _ := f.resolveRuleIPs(rule, nil)
+	if strings.Join(ips, ",") != "192.0.2.10" {
+		t.Errorf("Expected the answered address to be kept, got %v", ips)
+	}
+}
+
+// TestNextBackoff tests exponential backoff capping
+func TestNextBackoff(t *testing.T) {
+	delay := initialRetryDelay
+	for i := 0; i < 10; i++ {
+		delay = nextBackoff(delay, 30*time.Second)
+	}
+	if delay != 30*time.Second {
+		t.Errorf("Expected backoff capped at 30s, got %s", delay)
+	}
+}
+
+// TestSyncedAddresses tests that addresses received from the active router
+// are allowed until they go stale
+func TestSyncedAddresses(t *testing.T) {
+	rule := config.Rule{
+		Name:   "allow-registry",
+		Action: config.ActionAllow,
+		Egress: config.Egress{Domains: []string{"registry.example.com"}},
+	}
+
+	f, resolver := newTestFilter(t, &config.Config{Version: "1.0", Rules: []config.Rule{rule}})
+	resolver.Set("registry.example.com", "192.0.2.10")
+	f.synced[rule.Name] = syncedAddresses{ips: []string{"192.0.2.10", "192.0.2.11"}, received: time.Now()}
+
+	ips, _ := f.resolveRuleIPs(rule, nil)
+	if strings.Join(ips, ",") != "192.0.2.10,192.0.2.11" {
+		t.Errorf("Expected resolved and synced addresses, got %v", ips)
+	}
+
+	f.synced[rule.Name] = syncedAddresses{ips: []string{"192.0.2.11"}, received: time.Now().Add(-2 * learnedTTL)}
+	ips, _ = f.resolveRuleIPs(rule, nil)
+	if strings.Join(ips, ",") != "192.0.2.10" {
+		t.Errorf("Expected stale synced addresses to be dropped, got %v", ips)
+	}
+}
+
+// TestCheckRules tests that a policy with rules that fail to build is
+// refused unless it is lenient
+func TestCheckRules(t *testing.T) {
+	badPort := config.Rule{Name: "web", Action: config.ActionAllow, Egress: config.Egress{Protocols: []config.Protocol{config.ProtocolTCP}, Ports: []string{"44x3"}}}
+	testCases := []struct {
+		name    string
+		cfg     *config.Config
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			cfg: &config.Config{Rules: []config.Rule{
+				{Name: "web", Action: config.ActionAllow, Egress: config.Egress{Protocols: []config.Protocol{config.ProtocolTCP}, Ports: []string{"443"}}},
+			}},
+		},
+		{
+			name:    "invalid port",
+			cfg:     &config.Config{Rules: []config.Rule{badPort}},
+			wantErr: true,
+		},
+		{
+			name: "invalid branch port",
+			cfg: &config.Config{Rules: []config.Rule{
+				{Name: "web", Action: config.ActionAllow, Egress: config.Egress{
+					Protocols: []config.Protocol{config.ProtocolTCP},
+					AnyOf: []config.Egress{
+						{IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}},
+						{IPs: []string{"198.51.100.0/24"}, Ports: []string{"84x3"}},
+					},
+				}},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid maintenance port",
+			cfg:     &config.Config{Maintenance: &config.MaintenanceConfig{Rules: []config.Rule{badPort}}},
+			wantErr: true,
+		},
+		{
+			name: "lenient",
+			cfg:  &config.Config{Lenient: true, Rules: []config.Rule{badPort}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkRules(tc.cfg); (err != nil) != tc.wantErr {
+				t.Errorf("checkRules() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestApplyConfigRestores tests that a policy failing to build, here on a
+// port of one of its branches only, leaves the previous rules in place
+func TestApplyConfigRestores(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-internal", Action: config.ActionAllow, Order: 10, Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}},
+		},
+	}
+	f := newRulesFilter(t, cfg, nil)
+
+	bad := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-web", Action: config.ActionAllow, Order: 10, Egress: config.Egress{
+				Protocols: []config.Protocol{config.ProtocolTCP},
+				AnyOf: []config.Egress{
+					{IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}},
+					{IPs: []string{"198.51.100.0/24"}, Ports: []string{"84x3"}},
+				},
+			}},
+		},
+	}
+	f.mu.Lock()
+	err := f.applyConfig(bad)
+	f.mu.Unlock()
+	if err == nil {
+		t.Fatal("Expected the policy to fail to build")
+	}
+
+	if f.config != cfg {
+		t.Error("Expected the previous policy to be kept")
+	}
+	v, err := f.nft.Evaluate(nftables.Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP("10.1.2.3"), Protocol: "tcp", Port: 443})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if !v.Accept {
+		t.Error("Expected the previous rules to still allow 10.1.2.3")
+	}
+}
+
+// TestRuleComment tests mapping the nftables rules of a rule back to the
+// policy and the justification of the rule
+func TestRuleComment(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule config.Rule
+		want string
+	}{
+		{
+			name: "name",
+			rule: config.Rule{Name: "allow-github"},
+			want: "config=3f9a0c21d4e7 rule=allow-github",
+		},
+		{
+			name: "id",
+			rule: config.Rule{Name: "allow-github", ID: "r-c5ef8a6ad5"},
+			want: "config=3f9a0c21d4e7 rule=allow-github id=r-c5ef8a6ad5",
+		},
+		{
+			name: "justified",
+			rule: config.Rule{
+				Name:        "allow-vendor",
+				Description: "Vendor API for invoicing",
+				Reference:   "https://tickets.example.com/SEC-142",
+			},
+			want: "config=3f9a0c21d4e7 rule=allow-vendor ref=https://tickets.example.com/SEC-142 desc=Vendor API for invoicing",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &Filter{configHash: "3f9a0c21d4e7"}
+			if got := f.ruleComment(tc.rule); got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestExclusions tests that a rule skips its excluded destinations and
+// follows the addresses of its excluded domains as they change
+func TestExclusions(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-https", Action: config.ActionAllow, Order: 10, Egress: config.Egress{
+				Protocols:  []config.Protocol{config.ProtocolTCP},
+				Ports:      []string{"443"},
+				NotIPs:     []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+				NotDomains: []string{"intranet.example.com"},
+			}},
+		},
+	}
+	f := newRulesFilter(t, cfg, map[string]string{"intranet.example.com": "203.0.113.10"})
+
+	// accepted evaluates an HTTPS connection to dst
+	accepted := func(dst string) bool {
+		t.Helper()
+		v, err := f.nft.Evaluate(nftables.Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP(dst), Protocol: "tcp", Port: 443})
+		if err != nil {
+			t.Fatalf("Evaluate() error = %v", err)
+		}
+		return v.Accept
+	}
+	testCases := []struct {
+		dst  string
+		want bool
+	}{
+		{dst: "93.184.216.34", want: true},
+		{dst: "10.1.2.3"},
+		{dst: "172.20.0.1"},
+		{dst: "203.0.113.10"},
+	}
+	for _, tc := range testCases {
+		if got := accepted(tc.dst); got != tc.want {
+			t.Errorf("Expected accept %v for %s, got %v", tc.want, tc.dst, got)
+		}
+	}
+
+	if err := f.updateDomainIPs("intranet.example.com", []string{"203.0.113.11"}); err != nil {
+		t.Fatalf("updateDomainIPs() error = %v", err)
+	}
+	if !accepted("203.0.113.10") || accepted("203.0.113.11") {
+		t.Error("Expected the exclusion to follow the refreshed address of intranet.example.com")
+	}
+}
+
+// TestCompoundRules tests that a rule with any_of matches each of its
+// alternatives on its own ports, and that refreshing a domain only changes
+// the branch naming it
+func TestCompoundRules(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-api", Action: config.ActionAllow, Order: 10, Egress: config.Egress{
+				Protocols: []config.Protocol{config.ProtocolTCP},
+				AnyOf: []config.Egress{
+					{IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}},
+					{Domains: []string{"api.example.com"}, Ports: []string{"8443"}},
+				},
+			}},
+		},
+	}
+	f := newRulesFilter(t, cfg, map[string]string{"api.example.com": "203.0.113.10"})
+
+	// accepted evaluates a connection to dst on port
+	accepted := func(dst string, port uint16) bool {
+		t.Helper()
+		v, err := f.nft.Evaluate(nftables.Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP(dst), Protocol: "tcp", Port: port})
+		if err != nil {
+			t.Fatalf("Evaluate() error = %v", err)
+		}
+		return v.Accept
+	}
+	testCases := []struct {
+		dst  string
+		port uint16
+		want bool
+	}{
+		{dst: "192.0.2.1", port: 443, want: true},
+		{dst: "192.0.2.1", port: 8443},
+		{dst: "203.0.113.10", port: 8443, want: true},
+		{dst: "203.0.113.10", port: 443},
+		{dst: "198.51.100.1", port: 443},
+	}
+	for _, tc := range testCases {
+		if got := accepted(tc.dst, tc.port); got != tc.want {
+			t.Errorf("Expected accept %v for %s:%d, got %v", tc.want, tc.dst, tc.port, got)
+		}
+	}
+
+	if err := f.updateDomainIPs("api.example.com", []string{"203.0.113.11"}); err != nil {
+		t.Fatalf("updateDomainIPs() error = %v", err)
+	}
+	if accepted("203.0.113.10", 8443) || !accepted("203.0.113.11", 8443) || !accepted("192.0.2.1", 443) {
+		t.Error("Expected only the domain branch to follow the refreshed address of api.example.com")
+	}
+	if !f.DecideL7(0, "", inspect.Conn{Network: "tcp", Address: net.ParseIP("203.0.113.11"), Port: 8443}) ||
+		f.DecideL7(0, "", inspect.Conn{Network: "tcp", Address: net.ParseIP("203.0.113.11"), Port: 443}) {
+		t.Error("Expected DecideL7 to match the branch of the connection's port")
+	}
+}
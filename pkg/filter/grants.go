@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const defaultMaxGrantTTL = 24 * time.Hour
+
+// Grant is a temporary allow entry for a destination and port, enforced
+// ahead of every rule until it expires
+type Grant struct {
+	// Source, if set, is the only address the grant allows traffic from
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination"`
+	Port        uint16    `json:"port"`
+	Expires     time.Time `json:"expires"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// key identifies a grant by source, destination and port
+func (g Grant) key() string {
+	key := net.JoinHostPort(g.Destination, strconv.Itoa(int(g.Port)))
+	if g.Source != "" {
+		key += " from " + g.Source
+	}
+	return key
+}
+
+// sourceIP returns the address the grant is scoped to, or nil for any
+func (g Grant) sourceIP() net.IP {
+	if g.Source == "" {
+		return nil
+	}
+	return net.ParseIP(g.Source)
+}
+
+// Grant allows TCP and UDP traffic to destination and port for ttl; granting
+// an existing entry again restarts its timeout
+func (f *Filter) Grant(destination string, port uint16, ttl time.Duration, reason string) (Grant, error) {
+	return f.GrantFrom("", destination, port, ttl, reason)
+}
+
+// GrantFrom allows TCP and UDP traffic from source, or any source if empty,
+// to destination and port for ttl
+func (f *Filter) GrantFrom(source, destination string, port uint16, ttl time.Duration, reason string) (Grant, error) {
+	ip := net.ParseIP(destination)
+	if ip == nil {
+		return Grant{}, fmt.Errorf("invalid destination: %s", destination)
+	}
+	if port == 0 {
+		return Grant{}, fmt.Errorf("port is required")
+	}
+	if source != "" {
+		src := net.ParseIP(source)
+		if src == nil {
+			return Grant{}, fmt.Errorf("invalid source: %s", source)
+		}
+		if (src.To4() == nil) != (ip.To4() == nil) {
+			return Grant{}, fmt.Errorf("source %s and destination %s must be of the same family", source, destination)
+		}
+		source = src.String()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if max := f.maxGrantTTL(); ttl <= 0 || ttl > max {
+		return Grant{}, fmt.Errorf("ttl must be between 0 and %s", max)
+	}
+
+	grant := Grant{
+		Source:      source,
+		Destination: ip.String(),
+		Port:        port,
+		Expires:     time.Now().Add(ttl),
+		Reason:      reason,
+	}
+	f.pruneGrants()
+	if err := f.setGrantLocked(grant); err != nil {
+		return Grant{}, err
+	}
+
+	log.Printf("Granted access to %s until %s: %s", grant.key(), grant.Expires.Format(time.RFC3339), reason)
+	return grant, nil
+}
+
+// setGrantLocked installs grant, replacing an existing entry
+// Must be called with mu held
+func (f *Filter) setGrantLocked(grant Grant) error {
+	ip := net.ParseIP(grant.Destination)
+	if _, ok := f.grants[grant.key()]; ok {
+		if err := f.nft.DeleteGrant(grant.sourceIP(), ip, grant.Port); err != nil {
+			return err
+		}
+		delete(f.grants, grant.key())
+	}
+	if err := f.nft.AddGrant(grant.sourceIP(), ip, grant.Port, time.Until(grant.Expires)); err != nil {
+		return err
+	}
+	f.grants[grant.key()] = grant
+	f.updateCanaryGrant(grant.sourceIP(), ip, grant.Port, time.Until(grant.Expires))
+	return nil
+}
+
+// Revoke removes the grants to destination and port, from any source,
+// before they expire
+func (f *Filter) Revoke(destination string, port uint16) error {
+	ip := net.ParseIP(destination)
+	if ip == nil {
+		return fmt.Errorf("invalid destination: %s", destination)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pruneGrants()
+	revoked := 0
+	for key, grant := range f.grants {
+		if grant.Destination != ip.String() || grant.Port != port {
+			continue
+		}
+		if err := f.nft.DeleteGrant(grant.sourceIP(), ip, port); err != nil {
+			return err
+		}
+		delete(f.grants, key)
+		f.updateCanaryGrant(grant.sourceIP(), ip, port, 0)
+		log.Printf("Revoked access to %s", key)
+		revoked++
+	}
+	if revoked == 0 {
+		return fmt.Errorf("no grant for %s", Grant{Destination: ip.String(), Port: port}.key())
+	}
+	return nil
+}
+
+// Grants returns the active grants ordered by expiry
+func (f *Filter) Grants() []Grant {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pruneGrants()
+	grants := make([]Grant, 0, len(f.grants))
+	for _, grant := range f.grants {
+		grants = append(grants, grant)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Expires.Before(grants[j].Expires)
+	})
+	return grants
+}
+
+// pruneGrants forgets grants the kernel has expired
+// Must be called with mu held
+func (f *Filter) pruneGrants() {
+	now := time.Now()
+	for key, grant := range f.grants {
+		if !now.Before(grant.Expires) {
+			delete(f.grants, key)
+		}
+	}
+}
+
+// restoreGrants reinstalls active grants after the table was recreated
+// Must be called with mu held
+func (f *Filter) restoreGrants() {
+	f.pruneGrants()
+	for key, grant := range f.grants {
+		ttl := time.Until(grant.Expires)
+		if err := f.nft.AddGrant(grant.sourceIP(), net.ParseIP(grant.Destination), grant.Port, ttl); err != nil {
+			log.Printf("Warning: failed to restore grant for %s: %v", key, err)
+			delete(f.grants, key)
+		}
+	}
+}
+
+// maxGrantTTL returns the longest allowed grant lifetime
+// Must be called with mu held
+func (f *Filter) maxGrantTTL() time.Duration {
+	if admin := f.config.Admin; admin != nil && admin.MaxGrantTTL > 0 {
+		return admin.MaxGrantTTL.Std()
+	}
+	return defaultMaxGrantTTL
+}
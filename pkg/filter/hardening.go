@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// bogonGroup is the group of the bogon sources hardening drops by default
+var bogonGroup = config.IPGroup{Provider: config.ProviderBogons}
+
+// applyHardening drops invalid and spoofed packets, if configured
+// Must be called with mu held
+func (f *Filter) applyHardening() error {
+	h := f.config.Hardening
+	if h == nil {
+		return nil
+	}
+	bogons := h.Bogons
+	if h.DropsBogonGroup() {
+		bogons = f.ranges.Expand(bogonGroup)
+	}
+	err := f.nft.SetupHardening(nftables.Hardening{
+		DropInvalid:   h.DropsInvalid(),
+		ReversePath:   h.ChecksReversePath(),
+		TCPFlags:      h.ChecksTCPFlags(),
+		WANInterfaces: h.WANInterfaces,
+		Bogons:        bogons,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up hardening: %w", err)
+	}
+	return nil
+}
+
+// hardeningDrops returns the invalid and spoofed packets dropped
+// Must be called with mu held
+func (f *Filter) hardeningDrops() uint64 {
+	drops, err := f.nft.HardeningDrops()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return drops
+}
+
+// updateHardeningBogons updates the bogon sources hardening drops to the
+// @bogons group, if it drops them
+// Must be called with mu held
+func (f *Filter) updateHardeningBogons() {
+	if h := f.config.Hardening; h == nil || !h.DropsBogonGroup() {
+		return
+	}
+	if err := f.nft.UpdateHardeningBogons(f.ranges.Expand(bogonGroup)); err != nil {
+		log.Printf("Failed to update hardening bogons: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package filter
+
+import (
+	"log"
+	"net"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/skaegi/legion-router/pkg/honeypot"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// honeypotPort returns the port cfg's honeypot listens on, 0 if none
+func honeypotPort(cfg *config.Config) uint16 {
+	if cfg.Honeypot == nil {
+		return 0
+	}
+	return cfg.Honeypot.EffectivePort()
+}
+
+// honeypotRedirect returns where cfg redirects denied targets, nil unless
+// the honeypot listens on port
+func honeypotRedirect(cfg *config.Config, port uint16) *nftables.Honeypot {
+	h := cfg.Honeypot
+	if h == nil || port == 0 {
+		return nil
+	}
+	return &nftables.Honeypot{
+		Port:    port,
+		Targets: h.Targets,
+		Ports:   h.Ports,
+		Exempt:  h.ExemptSources,
+	}
+}
+
+// startHoneypot starts the honeypot, if configured, before the ruleset
+// redirects its targets to it; without it they are left to the policy.
+// Changes to its port and max_bytes take effect on restart.
+// Must be called with mu held
+func (f *Filter) startHoneypot() {
+	cfg := f.config.Honeypot
+	if cfg == nil {
+		return
+	}
+	server := honeypot.NewServer(cfg.EffectivePort(), cfg.EffectiveMaxBytes(), f)
+	if err := server.Start(); err != nil {
+		log.Printf("Warning: honeypot disabled: %v", err)
+		return
+	}
+	f.honeypot = server
+	f.honeypotPort = cfg.EffectivePort()
+}
+
+// stopHoneypot closes the honeypot, if listening. Its captures are stored
+// with mu held, so it must not be.
+func (f *Filter) stopHoneypot() {
+	f.mu.RLock()
+	server := f.honeypot
+	f.mu.RUnlock()
+
+	if server == nil {
+		return
+	}
+	if err := server.Stop(); err != nil {
+		log.Printf("Warning: failed to stop honeypot: %v", err)
+	}
+}
+
+// Captured logs what a client redirected to the honeypot sent, and stores
+// it in the event store if configured
+func (f *Filter) Captured(c honeypot.Capture) {
+	event := events.Event{
+		Time:     c.Time,
+		Type:     events.TypeHoneypot,
+		Protocol: string(config.ProtocolTCP),
+		Request:  string(c.Request),
+	}
+	if c.Source != nil {
+		event.Source, event.SourcePort = c.Source.IP, uint16(c.Source.Port)
+	}
+	if c.Destination != nil {
+		event.Destination, event.Port = c.Destination.IP, uint16(c.Destination.Port)
+	}
+	truncated := ""
+	if c.Truncated {
+		truncated = " (truncated)"
+	}
+	log.Printf("Honeypot: %s sent %d bytes%s to %s: %q", hostPort(c.Source), len(c.Request), truncated, hostPort(c.Destination), c.Request)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.eventStore != nil {
+		f.eventStore.Record(event)
+	}
+}
+
+// hostPort formats addr, "unknown" if nil
+func hostPort(addr *net.TCPAddr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	return addr.String()
+}
+
+// honeypotRedirects returns the connections redirected to the honeypot
+// Must be called with mu held
+func (f *Filter) honeypotRedirects() uint64 {
+	redirects, err := f.nft.HoneypotRedirects()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return redirects
+}
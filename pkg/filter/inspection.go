@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/inspect"
+)
+
+const (
+	tlsPort    = 443
+	learnedTTL = time.Hour // How long an address learned from SNI or the DNS proxy stays allowed
+)
+
+// startInspection starts the inspector if SNI inspection is enabled or any
+// rule matches l7 protocols
+func (f *Filter) startInspection() {
+	insp := f.config.Inspection
+	if (insp == nil || !insp.SNI) && !hasL7Rules(f.config) {
+		return
+	}
+
+	cfg := inspect.Config{Queue: inspectionQueue(f.config), NetNS: f.netns}
+	if insp != nil {
+		cfg.VerifyCertificates = insp.VerifyCertificate
+		cfg.Fingerprints = insp.Fingerprints
+		if rdns := insp.ReverseDNS; rdns != nil {
+			cfg.Names = dns.NewReverseResolver(f.config.DNS.Servers, rdns.CacheTTL.Std(), rdns.Rate)
+		}
+	}
+	if f.connLog != nil {
+		cfg.Connections = inspectedConnections{f.connLog}
+	}
+	inspector := inspect.New(cfg, f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-f.stopChan
+		cancel()
+	}()
+	go func() {
+		if err := inspector.Run(ctx); err != nil {
+			log.Printf("Warning: inspection stopped: %v", err)
+		}
+	}()
+}
+
+// addQueueRule queues unmatched TLS traffic to the inspector, if configured
+// Must be called with mu held
+func (f *Filter) addQueueRule() error {
+	insp := f.config.Inspection
+	if insp == nil || !insp.SNI {
+		return nil
+	}
+
+	queue := inspectionQueue(f.config)
+	// TLS over TCP and QUIC over UDP
+	for _, protocol := range []string{"tcp", "udp"} {
+		if err := f.nft.AddQueueRule(queue, protocol, tlsPort); err != nil {
+			return fmt.Errorf("failed to add inspection rule: %w", err)
+		}
+	}
+	log.Printf("Queueing unmatched TLS and QUIC connections to nfqueue %d for SNI inspection", queue)
+	return nil
+}
+
+// MatchSNI returns the first rule, in order, with a domain matching name
+// that applies to conn
+func (f *Filter) MatchSNI(name string, conn inspect.Conn) (inspect.Match, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, i := range f.index.MatchDomain(name) {
+		if !f.ruleAppliesTo(i, conn) {
+			continue
+		}
+		rule := f.config.Rules[i]
+		if rule.Egress.Compound() && !namingBranchAppliesTo(rule, name, conn) {
+			continue
+		}
+		return inspect.Match{
+			Rule:      rule.Name,
+			Allow:     rule.Action == config.ActionAllow,
+			BlockQUIC: rule.BlockQUIC,
+		}, true
+	}
+	return inspect.Match{}, false
+}
+
+// Learn adds an address seen with an allowed server name to a rule's set
+func (f *Filter) Learn(ruleName, name string, address net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ip := address.String()
+	if !f.learn(ruleName, name, ip) {
+		return
+	}
+
+	for _, rule := range f.enabledRules() {
+		if rule.Name != ruleName {
+			continue
+		}
+		if err := f.updateRuleIPs(rule, nil); err != nil {
+			log.Printf("Failed to allow %s (%s) for rule %s: %v", ip, name, ruleName, err)
+			return
+		}
+		log.Printf("Allowed %s for rule %s via SNI %s", ip, ruleName, name)
+	}
+}
+
+// learn remembers an address seen for name, allowed by a rule, for
+// learnedTTL and reports whether it is new
+// Must be called with mu held
+func (f *Filter) learn(ruleName, name, ip string) bool {
+	now := time.Now()
+	learned := f.learned[ruleName]
+	if learned == nil {
+		learned = make(map[string]learnedAddress)
+		f.learned[ruleName] = learned
+	}
+	_, known := learned[ip]
+	learned[ip] = learnedAddress{name: name, seen: now}
+	f.recordDomain(ruleName, ip, name)
+	for addr, a := range learned {
+		if now.Sub(a.seen) > learnedTTL {
+			delete(learned, addr)
+		}
+	}
+	return !known
+}
+
+// learnedAddress is an address learned for a server name
+type learnedAddress struct {
+	name string
+	seen time.Time
+}
+
+// learnedIPs returns the addresses learned from SNI or DNS proxy answers
+// for a rule, or a branch of one, for names its domains match
+// Must be called with mu held
+func (f *Filter) learnedIPs(rule config.Rule) []string {
+	var ips []string
+	for ip, a := range f.learned[rule.Name] {
+		name := normalizeName(a.name)
+		for _, domain := range rule.Egress.Domains {
+			if matchDomain(normalizeName(domain), name) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// normalizeName returns a domain or server name in lower case without a
+// trailing dot, as the index matches them
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// DecideL7 evaluates the rules from the l7 rule at index onwards, as the
+// kernel would, for a connection classified as app
+func (f *Filter) DecideL7(index int, app string, conn inspect.Conn) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if index >= len(f.config.Rules) {
+		return false
+	}
+	for i := index; i < len(f.config.Rules); i++ {
+		if !f.ruleAppliesTo(i, conn) {
+			continue
+		}
+		rule := f.config.Rules[i]
+		if len(rule.Egress.L7) > 0 && !containsApp(rule.Egress.L7, app) {
+			continue
+		}
+		if !f.ruleMatches(rule, conn) {
+			continue
+		}
+		return rule.Action == config.ActionAllow
+	}
+	return false
+}
+
+// ruleAppliesTo reports whether the rule at index i is enabled and its
+// protocol, port, profile, VLAN and VRF match conn; connections are decided
+// as they open, so rules limited to other conntrack states don't apply, nor
+// do rules matching the TTLs or lengths of packets
+// Must be called with mu held
+func (f *Filter) ruleAppliesTo(i int, conn inspect.Conn) bool {
+	rule := f.config.Rules[i]
+	if !f.ruleEnabled(rule) || !appliesTo(rule, config.Protocol(conn.Network)) || !f.index.PortMatches(i, conn.Port) ||
+		f.index.PortExcluded(i, conn.Port) || !rule.MatchesCtState(config.CtStateNew) || rule.MatchesPacket() {
+		return false
+	}
+	if rule.Profile != "" && !f.nft.ProfileContains(rule.Profile, conn.Source) {
+		return false
+	}
+	if rule.VLANID != 0 {
+		iface, _ := f.config.VLANInterface(rule.VLANID)
+		return conn.Interface == iface
+	}
+	if rule.VRF != "" {
+		return f.inVRF(conn.Interface, rule.VRF)
+	}
+	return true
+}
+
+// inspectionQueue returns the NFQUEUE number used for inspection
+func inspectionQueue(cfg *config.Config) uint16 {
+	if cfg.Inspection != nil && cfg.Inspection.Queue != 0 {
+		return cfg.Inspection.Queue
+	}
+	return inspect.DefaultQueue
+}
+
+// hasL7Rules reports whether any rule matches l7 protocols
+func hasL7Rules(cfg *config.Config) bool {
+	for _, rule := range cfg.Rules {
+		if len(rule.Egress.L7) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// containsApp reports whether app is one of apps
+func containsApp(apps []config.AppProtocol, app string) bool {
+	for _, a := range apps {
+		if string(a) == app {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo reports whether a rule matches traffic of protocol
+func appliesTo(rule config.Rule, protocol config.Protocol) bool {
+	if len(rule.Egress.Protocols) == 0 {
+		return true
+	}
+	for _, p := range rule.Egress.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
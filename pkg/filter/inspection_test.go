@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/inspect"
+)
+
+// TestMatchSNI tests that server names are matched against rules in order
+func TestMatchSNI(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		VLANs:   []config.VLANConfig{{ID: 100, Parent: "eth1"}},
+		VRFs:    []config.VRFConfig{{Name: "blue"}},
+		Rules: []config.Rule{
+			{
+				Name:   "allow-blue-vrf",
+				Action: config.ActionAllow,
+				Order:  1,
+				VRF:    "blue",
+				Egress: config.Egress{Domains: []string{"blue.example.org"}},
+			},
+			{
+				Name:   "allow-guest-vlan",
+				Action: config.ActionAllow,
+				Order:  5,
+				VLANID: 100,
+				Egress: config.Egress{Domains: []string{"example.org"}},
+			},
+			{
+				Name:   "deny-uploads",
+				Action: config.ActionDeny,
+				Order:  10,
+				Egress: config.Egress{Domains: []string{"upload.github.com"}},
+			},
+			{
+				Name:   "allow-github",
+				Action: config.ActionAllow,
+				Order:  20,
+				Egress: config.Egress{Domains: []string{"*.github.com"}, Ports: []string{"443"}},
+			},
+			{
+				Name:   "allow-dns",
+				Action: config.ActionAllow,
+				Order:  30,
+				Egress: config.Egress{Domains: []string{"dns.google"}, Protocols: []config.Protocol{config.ProtocolUDP}},
+			},
+			{
+				Name:   "allow-alt",
+				Action: config.ActionAllow,
+				Order:  40,
+				Egress: config.Egress{Domains: []string{"alt.example.com"}, Ports: []string{"8000-9000"}},
+			},
+		},
+	}
+	f, _ := newTestFilter(t, cfg)
+	f.vrfMembers = map[string]string{"eth2": "blue"}
+
+	testCases := []struct {
+		name      string
+		sni       string
+		network   string
+		iface     string
+		port      uint16
+		wantRule  string
+		wantAllow bool
+	}{
+		{name: "earlier deny wins", sni: "upload.github.com", port: 443, wantRule: "deny-uploads"},
+		{name: "wildcard allow", sni: "API.github.com.", port: 443, wantRule: "allow-github", wantAllow: true},
+		{name: "port not in rule", sni: "api.github.com", port: 8443},
+		{name: "udp only rule", sni: "dns.google", port: 443},
+		{name: "udp only rule over QUIC", sni: "dns.google", network: "udp", port: 443, wantRule: "allow-dns", wantAllow: true},
+		{name: "port range", sni: "alt.example.com", port: 8443, wantRule: "allow-alt", wantAllow: true},
+		{name: "unknown name", sni: "example.org", port: 443},
+		{name: "vlan rule", sni: "example.org", iface: "eth1.100", port: 443, wantRule: "allow-guest-vlan", wantAllow: true},
+		{name: "vrf device", sni: "blue.example.org", iface: "blue", port: 443, wantRule: "allow-blue-vrf", wantAllow: true},
+		{name: "vrf member", sni: "blue.example.org", iface: "eth2", port: 443, wantRule: "allow-blue-vrf", wantAllow: true},
+		{name: "outside vrf", sni: "blue.example.org", iface: "eth1", port: 443},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			network := tc.network
+			if network == "" {
+				network = "tcp"
+			}
+			match, ok := f.MatchSNI(tc.sni, inspect.Conn{Network: network, Interface: tc.iface, Port: tc.port})
+			if ok != (tc.wantRule != "") {
+				t.Fatalf("MatchSNI(%q, %d) matched = %v, want %v", tc.sni, tc.port, ok, tc.wantRule != "")
+			}
+			if match.Rule != tc.wantRule || match.Allow != tc.wantAllow {
+				t.Errorf("MatchSNI(%q, %d) = %+v, want rule %s allow %v", tc.sni, tc.port, match, tc.wantRule, tc.wantAllow)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// ipGroups returns the cloud range groups named in a rule's ips
+func ipGroups(rule config.Rule) []config.IPGroup {
+	var groups []config.IPGroup
+	for _, ip := range rule.Egress.IPs {
+		if !config.IsIPGroup(ip) {
+			continue
+		}
+		// Groups are validated with the config
+		if group, err := config.ParseIPGroup(ip); err == nil {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// staticIPs returns the addresses and prefixes in a rule's ips, without its
+// groups
+func staticIPs(rule config.Rule) []string {
+	var ips []string
+	for _, ip := range rule.Egress.IPs {
+		if !config.IsIPGroup(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// configProviders returns the providers whose ranges the rules of cfg, or
+// its hardening, use; BGP groups are learned, not downloaded, and the bogons
+// only are with full_bogons
+func configProviders(cfg *config.Config) []string {
+	fullBogons := cfg.IPRanges != nil && cfg.IPRanges.FullBogons
+	seen := make(map[string]bool)
+	var providers []string
+	for _, rule := range cfg.Rules {
+		for _, group := range ipGroups(rule) {
+			if group.Provider == config.ProviderBGP || (group.Provider == config.ProviderBogons && !fullBogons) {
+				continue
+			}
+			if !seen[group.Provider] {
+				seen[group.Provider] = true
+				providers = append(providers, group.Provider)
+			}
+		}
+	}
+	if h := cfg.Hardening; fullBogons && h != nil && h.DropsBogonGroup() && !seen[config.ProviderBogons] {
+		providers = append(providers, config.ProviderBogons)
+	}
+	return providers
+}
+
+// fetchIPRanges downloads the ranges of the providers the rules use,
+// skipping those already loaded unless all is set
+// Must be called with mu held
+func (f *Filter) fetchIPRanges(all bool) {
+	var providers []string
+	for _, provider := range configProviders(f.config) {
+		if all || !f.ranges.Loaded(provider) {
+			providers = append(providers, provider)
+		}
+	}
+	if len(providers) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err := f.ranges.Fetch(ctx, providers); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// refreshIPRanges downloads the ranges periodically and updates the rules
+// using providers whose ranges changed, until stopped
+func (f *Filter) refreshIPRanges() {
+	ticker := time.NewTicker(f.ranges.Refresh())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.RLock()
+			providers := configProviders(f.config)
+			f.mu.RUnlock()
+			if len(providers) == 0 {
+				continue
+			}
+
+			// Downloads are done without holding mu
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			changed, err := f.ranges.Fetch(ctx, providers)
+			cancel()
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			if len(changed) > 0 {
+				f.updateIPGroups(changed)
+			}
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+// updateIPGroups updates the sets of the rules, and of hardening, using
+// ranges of providers
+func (f *Filter) updateIPGroups(providers []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed := make(map[string]bool)
+	for _, provider := range providers {
+		changed[provider] = true
+	}
+	for _, rule := range f.enabledRules() {
+		for _, group := range ipGroups(rule) {
+			if !changed[group.Provider] {
+				continue
+			}
+			if err := f.updateRuleIPs(rule, nil); err != nil {
+				log.Printf("Failed to update IPs for rule %s: %v", rule.Name, err)
+			}
+			break
+		}
+	}
+	if changed[config.ProviderBogons] {
+		f.updateHardeningBogons()
+	}
+}
@@ -0,0 +1,145 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const defaultMaxMaintenance = 4 * time.Hour
+
+// maintenanceState tracks an active maintenance window
+type maintenanceState struct {
+	base   *config.Config // Normal config to revert to
+	until  time.Time
+	reason string
+	timer  *time.Timer
+}
+
+// MaintenanceStatus describes an active maintenance window
+type MaintenanceStatus struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// EnterMaintenance switches to the maintenance policy for duration, after
+// which the normal rules are restored. Entering again while active extends
+// or shortens the window.
+func (f *Filter) EnterMaintenance(duration time.Duration, reason string) (MaintenanceStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	base := f.config
+	if f.maintenance != nil {
+		base = f.maintenance.base
+	}
+	if base.Maintenance == nil {
+		return MaintenanceStatus{}, fmt.Errorf("no maintenance policy is configured")
+	}
+	max := defaultMaxMaintenance
+	if base.Maintenance.MaxDuration > 0 {
+		max = base.Maintenance.MaxDuration.Std()
+	}
+	if duration <= 0 || duration > max {
+		return MaintenanceStatus{}, fmt.Errorf("duration must be between 0 and %s", max)
+	}
+
+	state := &maintenanceState{
+		base:   base,
+		until:  time.Now().Add(duration),
+		reason: reason,
+	}
+	if f.maintenance != nil {
+		// Already on; only the window changes
+		f.maintenance.timer.Stop()
+		f.maintenance = state
+	} else {
+		f.maintenance = state
+		if err := f.applyConfig(maintenanceConfig(base)); err != nil {
+			f.maintenance = nil
+			f.revertLocked(base)
+			return MaintenanceStatus{}, fmt.Errorf("failed to apply maintenance policy: %w", err)
+		}
+	}
+	state.timer = time.AfterFunc(duration, func() { f.expireMaintenance(state) })
+
+	log.Printf("Maintenance mode on until %s: %s", state.until.Format(time.RFC3339), reason)
+	return MaintenanceStatus{Until: state.until, Reason: reason}, nil
+}
+
+// ExitMaintenance restores the normal rules before the window ends
+func (f *Filter) ExitMaintenance() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maintenance == nil {
+		return fmt.Errorf("maintenance mode is not on")
+	}
+	base := f.maintenance.base
+	f.stopMaintenanceLocked()
+	log.Println("Maintenance mode off, restoring normal rules")
+	return f.applyConfig(base)
+}
+
+// Maintenance returns the active maintenance window, if any
+func (f *Filter) Maintenance() *MaintenanceStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.maintenanceStatusLocked()
+}
+
+// maintenanceStatusLocked returns the active maintenance window, if any
+// Must be called with mu held
+func (f *Filter) maintenanceStatusLocked() *MaintenanceStatus {
+	if f.maintenance == nil {
+		return nil
+	}
+	return &MaintenanceStatus{Until: f.maintenance.until, Reason: f.maintenance.reason}
+}
+
+// expireMaintenance restores the normal rules when state's window ends
+func (f *Filter) expireMaintenance(state *maintenanceState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The window may have been changed or ended in the meantime
+	if f.maintenance != state {
+		return
+	}
+	f.stopMaintenanceLocked()
+	log.Println("Maintenance window ended, restoring normal rules")
+	f.revertLocked(state.base)
+}
+
+// revertLocked applies the normal config, logging failures since there is
+// no caller to report them to
+// Must be called with mu held
+func (f *Filter) revertLocked(base *config.Config) {
+	if err := f.applyConfig(base); err != nil {
+		log.Printf("ERROR: failed to restore normal rules: %v", err)
+	}
+}
+
+// stopMaintenanceLocked ends maintenance mode without touching the ruleset
+// Must be called with mu held
+func (f *Filter) stopMaintenanceLocked() {
+	if f.maintenance.timer != nil {
+		f.maintenance.timer.Stop()
+	}
+	f.maintenance = nil
+}
+
+// maintenanceConfig derives the config in effect during maintenance: the
+// maintenance rules, followed by the normal rules if the policy extends
+// them, arranged together for the conflict policy
+func maintenanceConfig(base *config.Config) *config.Config {
+	cfg := *base
+	cfg.Rules = append([]config.Rule(nil), base.Maintenance.Rules...)
+	if base.Maintenance.Extend {
+		cfg.Rules = append(cfg.Rules, base.Rules...)
+		base.EffectiveConflictPolicy().Arrange(cfg.Rules)
+	}
+	return &cfg
+}
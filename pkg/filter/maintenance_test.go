@@ -0,0 +1,85 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestMaintenanceConfig tests the rules in effect during maintenance
+func TestMaintenanceConfig(t *testing.T) {
+	testCases := []struct {
+		name           string
+		extend         bool
+		conflictPolicy config.ConflictPolicy
+		wantRules      []string
+	}{
+		{
+			name:      "replace",
+			wantRules: []string{"allow-mirrors"},
+		},
+		{
+			name:      "extend",
+			extend:    true,
+			wantRules: []string{"allow-mirrors", "allow-api", "deny-lab"},
+		},
+		{
+			name:           "extend with deny overriding",
+			extend:         true,
+			conflictPolicy: config.ConflictDenyOverrides,
+			wantRules:      []string{"deny-lab", "allow-mirrors", "allow-api"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			base := &config.Config{
+				Version:        "1.0",
+				ConflictPolicy: tc.conflictPolicy,
+				Rules:          []config.Rule{{Name: "allow-api", Action: config.ActionAllow}, {Name: "deny-lab", Action: config.ActionDeny}},
+				Maintenance: &config.MaintenanceConfig{
+					Rules:  []config.Rule{{Name: "allow-mirrors", Action: config.ActionAllow}},
+					Extend: tc.extend,
+				},
+			}
+
+			cfg := maintenanceConfig(base)
+			var names []string
+			for _, rule := range cfg.Rules {
+				names = append(names, rule.Name)
+			}
+			if len(names) != len(tc.wantRules) {
+				t.Fatalf("Expected rules %v, got %v", tc.wantRules, names)
+			}
+			for i := range names {
+				if names[i] != tc.wantRules[i] {
+					t.Errorf("Expected rules %v, got %v", tc.wantRules, names)
+				}
+			}
+			if len(base.Rules) != 2 || base.Rules[0].Name != "allow-api" {
+				t.Errorf("Base config was modified: %v", base.Rules)
+			}
+		})
+	}
+}
+
+// TestEnterMaintenanceBounds tests that maintenance needs a configured
+// policy and a bounded duration
+func TestEnterMaintenanceBounds(t *testing.T) {
+	f, _ := newTestFilter(t, &config.Config{
+		Version: "1.0",
+		Rules:   []config.Rule{{Name: "allow-api", Action: config.ActionAllow}},
+	})
+	if _, err := f.EnterMaintenance(time.Hour, "upgrade"); err == nil {
+		t.Error("Expected error without a maintenance policy")
+	}
+
+	f.config.Maintenance = &config.MaintenanceConfig{
+		Rules:       []config.Rule{{Name: "allow-mirrors", Action: config.ActionAllow}},
+		MaxDuration: config.Duration(2 * time.Hour),
+	}
+	if _, err := f.EnterMaintenance(3*time.Hour, "upgrade"); err == nil {
+		t.Error("Expected error for a duration above max_duration")
+	}
+}
@@ -0,0 +1,36 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+)
+
+// applyMetadataProtection blocks the instance metadata service, if
+// configured
+// Must be called with mu held
+func (f *Filter) applyMetadataProtection() error {
+	mp := f.config.MetadataProtection
+	if mp == nil {
+		return nil
+	}
+	if err := f.nft.SetupMetadataProtection(mp.EffectiveDestinations(), mp.ExemptSources); err != nil {
+		return fmt.Errorf("failed to protect instance metadata: %w", err)
+	}
+	if len(mp.ExemptSources) > 0 && f.netns == 0 {
+		// IMDSv2 token responses are sent with a hop limit of 1 by default,
+		// which expires when the router forwards them
+		log.Println("Note: exempt sources behind the router need an instance metadata hop limit of 2 or more for IMDSv2")
+	}
+	return nil
+}
+
+// metadataDrops returns the packets dropped on their way to the metadata
+// service
+// Must be called with mu held
+func (f *Filter) metadataDrops() uint64 {
+	drops, err := f.nft.MetadataDrops()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return drops
+}
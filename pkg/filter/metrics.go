@@ -0,0 +1,124 @@
+package filter
+
+import (
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/metrics"
+)
+
+// Series sampled for dashboards; per-rule series are named
+// "<series>:<rule>"
+const (
+	seriesAllowed      = "allowed"
+	seriesDenied       = "denied"
+	seriesBytes        = "bytes"
+	seriesUnmatched    = "unmatched"
+	seriesDNSFailures  = "dns_failures"
+	seriesDNSEvictions = "dns_cache_evictions"
+	seriesBanDrops     = "ban_drops"
+)
+
+// failureCounter is implemented by resolvers counting their failed lookups
+type failureCounter interface {
+	Failures() uint64
+}
+
+// upstreamPool is implemented by resolvers tracking the health of their
+// upstreams
+type upstreamPool interface {
+	StartHealthChecks(stopChan <-chan struct{})
+	Upstreams() []dns.UpstreamStatus
+}
+
+// cacheLister is implemented by resolvers bounding and listing their cache
+type cacheLister interface {
+	CacheEntries() []dns.CacheEntry
+	CacheSize() int
+	CacheLimit() int
+	Evictions() uint64
+}
+
+// startMetrics samples the counters in the background until the filter
+// stops, if configured
+// Must be called with mu held
+func (f *Filter) startMetrics() {
+	cfg := f.config.Metrics
+	if cfg == nil {
+		return
+	}
+	f.metrics = metrics.NewRecorder(cfg.Interval.Std(), cfg.Retention.Std())
+	go f.sampleMetrics(f.metrics)
+}
+
+// sampleMetrics adds a sample to recorder every interval until the filter
+// stops
+func (f *Filter) sampleMetrics(recorder *metrics.Recorder) {
+	ticker := time.NewTicker(recorder.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stopChan:
+			return
+		case now := <-ticker.C:
+			sample, err := f.sampleCounters(now)
+			if err != nil {
+				log.Printf("Warning: failed to sample counters: %v", err)
+				continue
+			}
+			recorder.Add(sample)
+		}
+	}
+}
+
+// sampleCounters reads the packets and bytes each rule decided, the packets
+// no rule matched, the failed DNS lookups, the domains evicted from the
+// DNS cache and the packets of banned sources dropped
+func (f *Filter) sampleCounters(now time.Time) (metrics.Sample, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	sample := metrics.Sample{Time: now, Counters: make(map[string]uint64)}
+	counters, err := f.nft.RuleCounters()
+	if err != nil {
+		return sample, err
+	}
+	for _, rule := range f.config.Rules {
+		c, ok := counters[rule.Name]
+		if !ok {
+			continue
+		}
+		series := seriesAllowed
+		if rule.Action == config.ActionDeny {
+			series = seriesDenied
+		}
+		sample.Counters[series+":"+rule.Name] = c.Packets
+		sample.Counters[seriesBytes+":"+rule.Name] = c.Bytes
+	}
+
+	unmatched, err := f.nft.UnmatchedCounters()
+	if err != nil {
+		return sample, err
+	}
+	sample.Counters[seriesUnmatched] = unmatched.Packets
+	if resolver, ok := f.dns.(failureCounter); ok {
+		sample.Counters[seriesDNSFailures] = resolver.Failures()
+	}
+	if resolver, ok := f.dns.(cacheLister); ok {
+		sample.Counters[seriesDNSEvictions] = resolver.Evictions()
+	}
+	if f.config.Ban != nil {
+		sample.Counters[seriesBanDrops] = f.banDrops()
+	}
+	return sample, nil
+}
+
+// Metrics returns the sampled counters, nil if none are sampled
+func (f *Filter) Metrics() *metrics.Recorder {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.metrics
+}
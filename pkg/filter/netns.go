@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"fmt"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// SetNetNS makes the filter program the network namespace of netnsFd, such
+// as a pod's, instead of the router's own, filtering the traffic that
+// originates in it. It must be called before Start.
+func (f *Filter) SetNetNS(netnsFd int) error {
+	if err := checkNetNSConfig(f.config); err != nil {
+		return err
+	}
+	nftMgr, err := nftables.NewManager(nftables.InNamespace(netnsFd))
+	if err != nil {
+		return fmt.Errorf("failed to create nftables manager: %w", err)
+	}
+	f.nft = nftMgr
+	f.netns = netnsFd
+	return nil
+}
+
+// checkNetNSConfig rejects configs that can't be applied in a target
+// namespace: interfaces are only managed in the router's own, and all
+// traffic originates in the namespace itself
+func checkNetNSConfig(cfg *config.Config) error {
+	if len(cfg.VLANs) > 0 || len(cfg.VRFs) > 0 {
+		return fmt.Errorf("vlans and vrfs are not supported in a target network namespace")
+	}
+	if len(cfg.Routes) > 0 {
+		return fmt.Errorf("routes are not supported in a target network namespace")
+	}
+	if len(cfg.Profiles) > 0 || cfg.Docker != nil {
+		return fmt.Errorf("profiles are not supported in a target network namespace")
+	}
+	if cfg.BlockPage != nil {
+		return fmt.Errorf("the block page is not supported in a target network namespace")
+	}
+	if cfg.Honeypot != nil {
+		return fmt.Errorf("the honeypot is not supported in a target network namespace")
+	}
+	if cfg.ConnectionLog != nil && cfg.ConnectionLog.Processes {
+		return fmt.Errorf("connection log processes are not supported in a target network namespace")
+	}
+	if cfg.Chain != nil && cfg.Chain.Hook != "" && cfg.Chain.Hook != "output" {
+		return fmt.Errorf("only the output hook is supported in a target network namespace")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/internal/fileutil"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+const defaultPersistInterval = 5 * time.Minute
+
+// persistRuleset writes the nft script of the applied policy to the persist
+// path, if configured, so that nftables restores it at boot or after a
+// crash until the router starts again
+// Must be called with mu held
+func (f *Filter) persistRuleset() {
+	p := f.config.Persist
+	// Lazily resolved rules are persisted once their domains resolve, see
+	// resolveDeferred
+	if p == nil || len(f.pending) > 0 {
+		return
+	}
+
+	f.persistedUpdates = f.nft.Updates()
+	script, err := f.renderApplied()
+	if err != nil {
+		log.Printf("Warning: failed to render the ruleset to persist: %v", err)
+		return
+	}
+	if bytes.Equal(script, f.persistedScript) {
+		return
+	}
+	if err := fileutil.WriteAtomic(p.Path, script); err != nil {
+		log.Printf("Warning: failed to persist the ruleset: %v", err)
+		return
+	}
+	f.persistedScript = script
+	log.Printf("Persisted the ruleset to %s", p.Path)
+}
+
+// renderApplied returns the nft script of the applied policy, with the
+// current addresses of its domains and services
+// Must be called with mu held
+func (f *Filter) renderApplied() ([]byte, error) {
+	shadow, err := f.recordApplied()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := shadow.nft.WriteScript(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// recordApplied records the applied policy, with the current addresses of
+// its domains and services, in a filter of its own
+// Must be called with mu held
+func (f *Filter) recordApplied() (*Filter, error) {
+	var opts []nftables.Option
+	if f.netns != 0 {
+		opts = append(opts, nftables.InNamespace(f.netns))
+	}
+	shadow, err := f.canaryFilter(f.config, nftables.NewScriptManager(opts...))
+	if err != nil {
+		return nil, err
+	}
+	// Temporary grants aren't persisted, as they would outlive a reboot
+	shadow.firewalls = f.firewalls
+	shadow.quiet = true
+	if err := shadow.setupTable(f.config); err != nil {
+		return nil, fmt.Errorf("failed to set up table: %w", err)
+	}
+	if err := shadow.applyRules(); err != nil {
+		return nil, fmt.Errorf("failed to apply rules: %w", err)
+	}
+	return shadow, nil
+}
+
+// persistPeriodically rewrites the persisted ruleset as the addresses of
+// domains and services change
+func (f *Filter) persistPeriodically() {
+	for {
+		f.mu.RLock()
+		interval := defaultPersistInterval
+		if p := f.config.Persist; p != nil && p.Interval > 0 {
+			interval = p.Interval.Std()
+		}
+		f.mu.RUnlock()
+
+		select {
+		case <-f.stopChan:
+			return
+		case <-time.After(interval):
+		}
+
+		f.mu.Lock()
+		if f.nft.Updates() != f.persistedUpdates {
+			f.persistRuleset()
+		}
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// TestPersistRuleset tests writing the applied policy, with the current
+// addresses of its domains, to the persist path
+func TestPersistRuleset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nftables.d", "legion-router.nft")
+	cfg := &config.Config{
+		Version: "1.0",
+		Persist: &config.PersistConfig{Path: path},
+		Rules: []config.Rule{{
+			Name:   "allow-registry",
+			Action: config.ActionAllow,
+			Egress: config.Egress{Domains: []string{"registry.example.com"}},
+		}},
+	}
+	f, resolver := newTestFilter(t, cfg)
+	resolver.Set("registry.example.com", "192.0.2.10")
+	f.nft = nftables.NewScriptManager()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.setupTable(cfg); err != nil {
+		t.Fatalf("Failed to set up table: %v", err)
+	}
+	if err := f.applyRules(); err != nil {
+		t.Fatalf("applyRules() error = %v", err)
+	}
+	f.persistRuleset()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the ruleset to be persisted: %v", err)
+	}
+	for _, want := range []string{"delete table inet legion_filter", "192.0.2.10"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected the persisted ruleset to contain %q, got:\n%s", want, data)
+		}
+	}
+
+	// Following a DNS change
+	if err := f.updateDomainSets("registry.example.com", []string{"192.0.2.20"}); err != nil {
+		t.Fatalf("updateDomainSets() error = %v", err)
+	}
+	if f.nft.Updates() == f.persistedUpdates {
+		t.Fatal("Expected the DNS change to count as an update")
+	}
+	resolver.Set("registry.example.com", "192.0.2.20")
+	f.persistRuleset()
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "192.0.2.20") {
+		t.Errorf("Expected the persisted ruleset to follow the DNS change, got:\n%s", data)
+	}
+}
@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// compiledRule is a rule ready to be programmed
+type compiledRule struct {
+	rules      []nftables.Rule
+	unresolved []string // Domains that failed to resolve
+}
+
+// compileRules compiles the enabled rules on a worker per CPU, returning
+// them in the order of rules
+// Must be called with mu held
+func (f *Filter) compileRules(rules []config.Rule) []compiledRule {
+	// Deferring records pending domains, so it isn't left to the workers
+	deferred := make([]map[string][]string, len(rules))
+	var enabled []int
+	for i, rule := range rules {
+		if f.ruleEnabled(rule) {
+			deferred[i] = f.deferDomains(rule)
+			enabled = append(enabled, i)
+		}
+	}
+
+	compiled := make([]compiledRule, len(rules))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(runtime.GOMAXPROCS(0), len(enabled)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				compiled[i] = f.compileRule(i, rules[i], deferred[i])
+			}
+		}()
+	}
+	for _, i := range enabled {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return compiled
+}
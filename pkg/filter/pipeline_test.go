@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns/dnstest"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// largeConfig returns a policy of n domain, IP and protocol rules
+func largeConfig(n int) *config.Config {
+	cfg := &config.Config{Version: "1.0"}
+	for i := 0; i < n; i++ {
+		rule := config.Rule{
+			Name:   fmt.Sprintf("rule-%d", i),
+			Action: config.ActionAllow,
+			Order:  i,
+		}
+		switch i % 3 {
+		case 0:
+			rule.Egress.Domains = []string{fmt.Sprintf("svc-%d.example.com", i)}
+			rule.Egress.Ports = []string{"443"}
+		case 1:
+			rule.Egress.IPs = []string{fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)}
+		default:
+			rule.Egress.Protocols = []config.Protocol{config.ProtocolUDP}
+			rule.Egress.Ports = []string{fmt.Sprintf("%d", 10000+i)}
+		}
+		cfg.Rules = append(cfg.Rules, rule)
+	}
+	return cfg
+}
+
+// TestCompileRules tests that rules compiled concurrently come out in policy
+// order with their addresses and unresolved domains
+func TestCompileRules(t *testing.T) {
+	cfg := largeConfig(100)
+	f, resolver := newTestFilter(t, cfg)
+	for i := 0; i < 99; i += 3 {
+		resolver.Set(fmt.Sprintf("svc-%d.example.com", i), fmt.Sprintf("192.0.2.%d", i))
+	}
+	resolver.Set("svc-99.example.com")
+
+	f.mu.Lock()
+	compiled := f.compileRules(cfg.Rules)
+	f.mu.Unlock()
+
+	for i, c := range compiled {
+		if len(c.rules) != 1 || c.rules[0].Name != cfg.Rules[i].Name {
+			t.Fatalf("Expected rule %s at %d, got %+v", cfg.Rules[i].Name, i, c.rules)
+		}
+	}
+	if got := compiled[3].rules[0].IPs; len(got) != 1 || got[0] != "192.0.2.3" {
+		t.Errorf("Expected the resolved address of rule-3, got %v", got)
+	}
+	if got := compiled[99].unresolved; len(got) != 0 {
+		t.Errorf("Expected no unresolved domains for an empty answer, got %v", got)
+	}
+}
+
+// BenchmarkApplyRules tracks the latency of applying a policy of 1,000 rules
+func BenchmarkApplyRules(b *testing.B) {
+	cfg := largeConfig(1000)
+	resolver := dnstest.NewFakeResolver()
+	for i := 0; i < len(cfg.Rules); i += 3 {
+		resolver.Set(fmt.Sprintf("svc-%d.example.com", i), fmt.Sprintf("192.0.%d.%d", i/256, i%256))
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f, err := compile(cfg, resolver)
+	if err != nil {
+		b.Fatalf("Failed to compile: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.nft = nftables.NewScriptManager()
+		if err := f.setupTable(cfg); err != nil {
+			b.Fatalf("Failed to set up table: %v", err)
+		}
+		if err := f.applyRules(); err != nil {
+			b.Fatalf("applyRules() error = %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Milliseconds())/float64(b.N), "ms/apply")
+}
@@ -0,0 +1,144 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/inspect"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// TestResult is the outcome of a policy test
+type TestResult struct {
+	Test config.PolicyTest
+	// Verdict is the action the policy takes; "" if it couldn't be
+	// evaluated
+	Verdict config.Action
+	// Reason names what decided: the rule in nft syntax, or the inspection
+	Reason string
+	Err    error
+}
+
+// Passed reports whether the policy takes the expected action
+func (r TestResult) Passed() bool {
+	return r.Err == nil && r.Verdict == r.Test.Expect
+}
+
+// RunTests evaluates tests against the ruleset cfg compiles to, as Render
+// writes it, resolving domains with resolver. Traffic queued for
+// inspection is decided as the inspector would.
+func RunTests(cfg *config.Config, resolver dns.Resolver, tests []config.PolicyTest) ([]TestResult, error) {
+	f, err := compile(cfg, resolver)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]TestResult, 0, len(tests))
+	for _, test := range tests {
+		results = append(results, f.runTest(test))
+	}
+	return results, nil
+}
+
+// runTest evaluates a test for its destination, or for every address its
+// domain resolves to, all of which must get the expected verdict
+func (f *Filter) runTest(test config.PolicyTest) TestResult {
+	result := TestResult{Test: test}
+	destinations := []string{test.Destination}
+	if test.Destination == "" {
+		if isWildcard(test.Domain) {
+			result.Err = fmt.Errorf("dst is required with a wildcard domain")
+			return result
+		}
+		ips, err := f.dns.Resolve(test.Domain)
+		if err != nil {
+			result.Err = fmt.Errorf("failed to resolve %s: %w", test.Domain, err)
+			return result
+		}
+		destinations = ips
+	}
+
+	for _, dst := range destinations {
+		verdict, reason, err := f.evaluate(test, net.ParseIP(dst))
+		if err != nil {
+			result.Err = fmt.Errorf("failed to evaluate %s: %w", dst, err)
+			return result
+		}
+		if test.Destination == "" {
+			reason = dst + ": " + reason
+		}
+		result.Verdict, result.Reason = verdict, reason
+		if verdict != test.Expect {
+			break
+		}
+	}
+	return result
+}
+
+// evaluate decides a test's connection to dst
+func (f *Filter) evaluate(test config.PolicyTest, dst net.IP) (config.Action, string, error) {
+	src := net.ParseIP(test.Source)
+	if src == nil {
+		src = net.IPv4zero
+		if dst.To4() == nil {
+			src = net.IPv6unspecified
+		}
+	}
+	v, err := f.nft.Evaluate(nftables.Packet{
+		Source:         src,
+		Destination:    dst,
+		Protocol:       string(test.Protocol),
+		Port:           test.Port,
+		InputInterface: test.Interface,
+		State:          string(test.State),
+		TTL:            test.TTL,
+		Length:         test.Length,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if !v.Queued {
+		reason := "no rule decided"
+		if v.Rule != "" {
+			reason = fmt.Sprintf("chain %s: %s", v.Chain, v.Rule)
+		}
+		if v.Accept {
+			return config.ActionAllow, reason, nil
+		}
+		return config.ActionDeny, reason, nil
+	}
+
+	conn := inspect.Conn{
+		Network:   string(test.Protocol),
+		Interface: test.Interface,
+		Source:    src,
+		Address:   dst,
+		Port:      test.Port,
+	}
+	if index, ok := inspect.L7RuleIndex(v.Mark); ok {
+		if test.App == "" {
+			return "", "", fmt.Errorf("rule %s classifies the traffic; app is required", f.config.Rules[index].Name)
+		}
+		reason := fmt.Sprintf("l7 inspection as %s from rule %s", test.App, f.config.Rules[index].Name)
+		if f.DecideL7(index, string(test.App), conn) {
+			return config.ActionAllow, reason, nil
+		}
+		return config.ActionDeny, reason, nil
+	}
+
+	// SNI inspection
+	if test.Domain == "" {
+		return config.ActionDeny, "sni inspection: no server name", nil
+	}
+	match, ok := f.MatchSNI(test.Domain, conn)
+	switch {
+	case !ok:
+		return config.ActionDeny, fmt.Sprintf("sni inspection: no rule matches %s", test.Domain), nil
+	case !match.Allow:
+		return config.ActionDeny, fmt.Sprintf("sni inspection: rule %s", match.Rule), nil
+	case test.Protocol == config.ProtocolUDP && match.BlockQUIC:
+		return config.ActionDeny, fmt.Sprintf("sni inspection: QUIC blocked by rule %s", match.Rule), nil
+	}
+	return config.ActionAllow, fmt.Sprintf("sni inspection: rule %s", match.Rule), nil
+}
@@ -0,0 +1,219 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns/dnstest"
+)
+
+// TestRunTests tests evaluating expected verdicts against the compiled
+// ruleset, including inspected traffic
+func TestRunTests(t *testing.T) {
+	cfg := &config.Config{
+		Version:    "1.0",
+		Inspection: &config.InspectionConfig{SNI: true},
+		Rules: []config.Rule{
+			{
+				Name:   "deny-internal",
+				Action: config.ActionDeny,
+				Order:  1,
+				Egress: config.Egress{IPs: []string{"10.0.0.0/8"}},
+			},
+			{
+				Name:   "allow-api",
+				Action: config.ActionAllow,
+				Order:  10,
+				Egress: config.Egress{Domains: []string{"api.example.com"}, Ports: []string{"443"}},
+			},
+			{
+				Name:   "allow-github",
+				Action: config.ActionAllow,
+				Order:  20,
+				Egress: config.Egress{Domains: []string{"*.github.com"}},
+			},
+			{
+				Name:   "allow-ssh",
+				Action: config.ActionAllow,
+				Order:  30,
+				Egress: config.Egress{L7: []config.AppProtocol{config.AppSSH}, Ports: []string{"22"}},
+			},
+			{
+				Name:     "allow-replies",
+				Action:   config.ActionAllow,
+				Order:    40,
+				CtStates: []config.CtState{config.CtStateEstablished, config.CtStateRelated},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		test        config.PolicyTest
+		wantVerdict config.Action
+		wantReason  string
+		wantErr     bool
+	}{
+		{
+			name:        "resolved domain",
+			test:        config.PolicyTest{Domain: "api.example.com", Protocol: config.ProtocolTCP, Port: 443},
+			wantVerdict: config.ActionAllow,
+			wantReason:  "ip daddr @ips_allow_api th dport 443 counter accept",
+		},
+		{
+			name:        "denied address",
+			test:        config.PolicyTest{Destination: "10.1.2.3", Protocol: config.ProtocolTCP, Port: 443},
+			wantVerdict: config.ActionDeny,
+			wantReason:  "ip daddr @ips_deny_internal counter drop",
+		},
+		{
+			name:        "unmatched",
+			test:        config.PolicyTest{Destination: "192.0.2.1", Protocol: config.ProtocolUDP, Port: 53},
+			wantVerdict: config.ActionDeny,
+			wantReason:  "counter drop",
+		},
+		{
+			name:        "established",
+			test:        config.PolicyTest{Destination: "192.0.2.1", Protocol: config.ProtocolUDP, Port: 53, State: config.CtStateEstablished},
+			wantVerdict: config.ActionAllow,
+			wantReason:  "ct state established,related counter accept",
+		},
+		{
+			name:        "wildcard by sni",
+			test:        config.PolicyTest{Destination: "140.82.112.3", Domain: "codeload.github.com", Protocol: config.ProtocolTCP, Port: 443},
+			wantVerdict: config.ActionAllow,
+			wantReason:  "sni inspection: rule allow-github",
+		},
+		{
+			name:        "unknown sni",
+			test:        config.PolicyTest{Destination: "192.0.2.1", Domain: "example.net", Protocol: config.ProtocolTCP, Port: 443},
+			wantVerdict: config.ActionDeny,
+			wantReason:  "no rule matches example.net",
+		},
+		{
+			name:        "l7",
+			test:        config.PolicyTest{Destination: "192.0.2.1", Protocol: config.ProtocolTCP, Port: 22, App: config.AppSSH},
+			wantVerdict: config.ActionAllow,
+			wantReason:  "l7 inspection as ssh",
+		},
+		{
+			name:    "l7 without app",
+			test:    config.PolicyTest{Destination: "192.0.2.1", Protocol: config.ProtocolTCP, Port: 22},
+			wantErr: true,
+		},
+		{
+			name:    "wildcard without dst",
+			test:    config.PolicyTest{Domain: "*.github.com", Protocol: config.ProtocolTCP, Port: 443},
+			wantErr: true,
+		},
+	}
+
+	resolver := dnstest.NewFakeResolver()
+	resolver.Set("api.example.com", "203.0.113.10", "203.0.113.11")
+	tests := make([]config.PolicyTest, len(testCases))
+	for i, tc := range testCases {
+		tests[i] = tc.test
+	}
+	results, err := RunTests(cfg, resolver, tests)
+	if err != nil {
+		t.Fatalf("RunTests() error = %v", err)
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := results[i]
+			if (result.Err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", result.Err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if result.Verdict != tc.wantVerdict {
+				t.Errorf("Expected %s, got %s (%s)", tc.wantVerdict, result.Verdict, result.Reason)
+			}
+			if !strings.Contains(result.Reason, tc.wantReason) {
+				t.Errorf("Expected reason to contain %q, got %q", tc.wantReason, result.Reason)
+			}
+		})
+	}
+}
+
+// TestConflictPolicy tests that the compiled ruleset decides traffic both
+// allow and deny rules match as the conflict policy does
+func TestConflictPolicy(t *testing.T) {
+	policy := `
+rules:
+  - name: allow-web
+    action: allow
+    order: 10
+    egress:
+      ips: ["192.0.2.0/24"]
+  - name: deny-host
+    action: deny
+    order: 20
+    egress:
+      ips: ["192.0.2.7"]
+  - name: deny-lab
+    action: deny
+    order: 30
+    egress:
+      ips: ["198.51.100.0/24"]
+  - name: allow-lab-host
+    action: allow
+    order: 40
+    egress:
+      ips: ["198.51.100.7"]
+`
+	tests := []config.PolicyTest{
+		{Destination: "192.0.2.7", Protocol: config.ProtocolTCP, Port: 443},
+		{Destination: "198.51.100.7", Protocol: config.ProtocolTCP, Port: 443},
+		{Destination: "192.0.2.8", Protocol: config.ProtocolTCP, Port: 443},
+	}
+
+	testCases := []struct {
+		name           string
+		conflictPolicy string
+		want           []config.Action
+	}{
+		{
+			name: "first match by default",
+			want: []config.Action{config.ActionAllow, config.ActionDeny, config.ActionAllow},
+		},
+		{
+			name:           "deny overrides",
+			conflictPolicy: "deny-overrides",
+			want:           []config.Action{config.ActionDeny, config.ActionDeny, config.ActionAllow},
+		},
+		{
+			name:           "allow overrides",
+			conflictPolicy: "allow-overrides",
+			want:           []config.Action{config.ActionAllow, config.ActionAllow, config.ActionAllow},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := "version: \"1.0\"\n"
+			if tc.conflictPolicy != "" {
+				data += "conflict_policy: " + tc.conflictPolicy + "\n"
+			}
+			cfg, err := config.Parse([]byte(data + policy))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			results, err := RunTests(cfg, dnstest.NewFakeResolver(), tests)
+			if err != nil {
+				t.Fatalf("RunTests() error = %v", err)
+			}
+			for i, result := range results {
+				if result.Err != nil {
+					t.Fatalf("Failed to evaluate %s: %v", tests[i].Destination, result.Err)
+				}
+				if result.Verdict != tc.want[i] {
+					t.Errorf("Expected %s for %s, got %s (%s)", tc.want[i], tests[i].Destination, result.Verdict, result.Reason)
+				}
+			}
+		})
+	}
+}
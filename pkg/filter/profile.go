@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Container is a container assigned to a profile, whose addresses are
+// sources of the profile while it runs
+type Container struct {
+	Name      string   `json:"name"`
+	Profile   string   `json:"profile"`
+	Addresses []string `json:"addresses"`
+}
+
+// SetContainer assigns a running container to its profile, replacing what
+// was known about it
+func (f *Filter) SetContainer(id string, container Container) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous, known := f.containers[id]
+	f.containers[id] = container
+	if _, ok := f.config.Profile(container.Profile); !ok {
+		log.Printf("Warning: container %s names unknown profile %s", container.Name, container.Profile)
+	}
+	if err := f.applyProfiles(); err != nil {
+		return err
+	}
+	if !known || previous.Profile != container.Profile {
+		log.Printf("Container %s joined profile %s with addresses %v", container.Name, container.Profile, container.Addresses)
+	}
+	return nil
+}
+
+// RemoveContainer removes a stopped container from its profile
+func (f *Filter) RemoveContainer(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	container, ok := f.containers[id]
+	if !ok {
+		return nil
+	}
+	delete(f.containers, id)
+	if err := f.applyProfiles(); err != nil {
+		return err
+	}
+	log.Printf("Container %s left profile %s", container.Name, container.Profile)
+	return nil
+}
+
+// Containers returns the containers assigned to profiles by ID
+func (f *Filter) Containers() map[string]Container {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	containers := make(map[string]Container, len(f.containers))
+	for id, container := range f.containers {
+		containers[id] = container
+	}
+	return containers
+}
+
+// applyProfiles sets the sources of every profile: its static sources plus
+// the addresses of its containers and hosts
+// Must be called with mu held
+func (f *Filter) applyProfiles() error {
+	for _, p := range f.config.Profiles {
+		if err := f.nft.SetProfileSources(p.Name, f.profileSources(p.Name)); err != nil {
+			return fmt.Errorf("failed to set sources of profile %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// profileSources returns the static sources, container addresses and host
+// addresses of a profile
+// Must be called with mu held
+func (f *Filter) profileSources(name string) []string {
+	p, _ := f.config.Profile(name)
+	sources := append([]string(nil), p.Sources...)
+	if f.dnsProxy != nil {
+		for _, host := range p.Hosts {
+			sources = append(sources, f.dnsProxy.HostAddresses(host)...)
+		}
+	}
+	var containers []string
+	for _, container := range f.containers {
+		if container.Profile == name {
+			containers = append(containers, container.Addresses...)
+		}
+	}
+	sort.Strings(containers)
+	return append(sources, containers...)
+}
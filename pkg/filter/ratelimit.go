@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// defaultRateLimitBurst is the number of connections allowed beyond the
+// rate at once, as nft's own default
+const defaultRateLimitBurst = 5
+
+// applyRateLimits limits the rate of new connections, if configured
+// Must be called with mu held
+func (f *Filter) applyRateLimits() error {
+	rl := f.config.RateLimit
+	if rl == nil {
+		return nil
+	}
+	limits := nftables.RateLimits{
+		Global:    rate(rl.Global),
+		PerSource: rate(rl.PerSource),
+		Burst:     rl.Burst,
+		Exempt:    rl.ExemptSources,
+	}
+	if limits.Burst == 0 {
+		limits.Burst = defaultRateLimitBurst
+	}
+	if err := f.nft.SetupRateLimits(limits); err != nil {
+		return fmt.Errorf("failed to set up rate limits: %w", err)
+	}
+	return nil
+}
+
+// rate returns the rate s names, or no limit if it is empty
+func rate(s string) nftables.Rate {
+	// Rates are validated with the config
+	count, per, err := config.ParseRate(s)
+	if err != nil {
+		return nftables.Rate{}
+	}
+	return nftables.Rate{Count: count, Per: per}
+}
+
+// rateLimitDrops returns the new connections dropped beyond their rate
+// Must be called with mu held
+func (f *Filter) rateLimitDrops() uint64 {
+	drops, err := f.nft.RateLimitDrops()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return drops
+}
@@ -0,0 +1,77 @@
+package filter
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/skaegi/legion-router/pkg/asn"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/ipranges"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// Render writes the nft script of the ruleset cfg would program, without
+// touching the kernel or network interfaces. Domains are resolved with
+// resolver and services discovered as at startup.
+func Render(cfg *config.Config, resolver dns.Resolver, w io.Writer) error {
+	f, err := compile(cfg, resolver)
+	if err != nil {
+		return err
+	}
+	return f.nft.WriteScript(w)
+}
+
+// RenderText returns the ruleset cfg would program in the deterministic
+// text form of nftables.Manager.RenderText, for golden file tests of
+// configs
+func RenderText(cfg *config.Config, resolver dns.Resolver) (string, error) {
+	f, err := compile(cfg, resolver)
+	if err != nil {
+		return "", err
+	}
+	return f.nft.RenderText()
+}
+
+// compile records the ruleset cfg would program in a filter of its own,
+// without logging each rule applied, so that commands print only their
+// report
+func compile(cfg *config.Config, resolver dns.Resolver) (*Filter, error) {
+	resolver.Configure(resolverSettings(cfg))
+	disc, err := newDiscovery(cfg, resolver.Resolve)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up service discovery: %w", err)
+	}
+	f := &Filter{
+		config:     cfg,
+		dns:        resolver,
+		nft:        nftables.NewScriptManager(),
+		unresolved: make(map[string]map[string]bool),
+		retryWake:  make(chan struct{}, 1),
+		learned:    make(map[string]map[string]learnedAddress),
+		grants:     make(map[string]Grant),
+		mappings:   make(map[string]PortMapping),
+		synced:     make(map[string]syncedAddresses),
+		containers: make(map[string]Container),
+		discovery:  disc,
+		endpoints:  make(map[string][]string),
+		ranges:     ipranges.New(cfg.IPRanges),
+		asns:       asn.New(cfg.ASNPrefixes),
+		// As the daemon serving the block page would redirect
+		blockPagePort: blockPagePort(cfg),
+		honeypotPort:  honeypotPort(cfg),
+		quiet:         true,
+	}
+
+	if err := f.setupTable(cfg); err != nil {
+		return nil, fmt.Errorf("failed to setup nftables: %w", err)
+	}
+	f.loadPersistedAddresses()
+	f.discoverServices(true)
+	f.fetchIPRanges(true)
+	f.fetchASNPrefixes(true)
+	if err := f.applyRules(); err != nil {
+		return nil, fmt.Errorf("failed to apply rules: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+	"github.com/skaegi/legion-router/pkg/dns"
+)
+
+// Flow is the recorded decisions of connections alike but for their
+// source port
+type Flow struct {
+	// Verdict and Rule are as recorded, Rule "" if no rule matched
+	Verdict     config.Action
+	Rule        string
+	Protocol    string
+	Interface   string
+	Source      net.IP
+	Destination net.IP
+	Port        uint16
+	Domain      string
+	// Count is the number of decisions, First and Last the times of the
+	// first and last
+	Count       int
+	First, Last time.Time
+}
+
+// String describes the flow, e.g. 10.0.0.5 -> 140.82.112.3 github.com tcp/443
+func (f Flow) String() string {
+	dst := f.Destination.String()
+	if f.Domain != "" {
+		dst += " " + f.Domain
+	}
+	if f.Port == 0 {
+		return fmt.Sprintf("%s -> %s %s", f.Source, dst, f.Protocol)
+	}
+	return fmt.Sprintf("%s -> %s %s/%d", f.Source, dst, f.Protocol, f.Port)
+}
+
+// test returns the policy test evaluating the flow, expecting the
+// recorded verdict
+func (f Flow) test() config.PolicyTest {
+	proto := config.Protocol(f.Protocol)
+	if f.Protocol == "icmpv6" {
+		proto = config.ProtocolICMP
+	}
+	return config.PolicyTest{
+		Source:      f.Source.String(),
+		Destination: f.Destination.String(),
+		Domain:      f.Domain,
+		Protocol:    proto,
+		Port:        f.Port,
+		Interface:   f.Interface,
+		Expect:      f.Verdict,
+	}
+}
+
+// replayable reports whether a policy test can evaluate the flow
+func (f Flow) replayable() bool {
+	switch f.Protocol {
+	case "tcp", "udp", "icmp", "icmpv6":
+		return f.Source != nil && f.Destination != nil
+	}
+	return false
+}
+
+// Flows groups decisions into flows, the most frequent first
+func Flows(decisions []decisionlog.Decision) []Flow {
+	index := make(map[string]int)
+	var flows []Flow
+	for _, d := range decisions {
+		key := fmt.Sprintf("%s %s %s %s %s %s %d %s", d.Verdict, d.Rule, d.Protocol, d.Interface, d.Source, d.Destination, d.Port, d.Domain)
+		i, ok := index[key]
+		if !ok {
+			i = len(flows)
+			index[key] = i
+			flows = append(flows, Flow{
+				Verdict:     config.Action(d.Verdict),
+				Rule:        d.Rule,
+				Protocol:    d.Protocol,
+				Interface:   d.Interface,
+				Source:      d.Source,
+				Destination: d.Destination,
+				Port:        d.Port,
+				Domain:      d.Domain,
+				First:       d.Time,
+				Last:        d.Time,
+			})
+		}
+		flow := &flows[i]
+		flow.Count++
+		if d.Time.Before(flow.First) {
+			flow.First = d.Time
+		}
+		if d.Time.After(flow.Last) {
+			flow.Last = d.Time
+		}
+	}
+	sort.SliceStable(flows, func(i, j int) bool {
+		return flows[i].Count > flows[j].Count
+	})
+	return flows
+}
+
+// ReplayResult is what a policy does with a recorded flow
+type ReplayResult struct {
+	Flow Flow
+	// Verdict is the action the policy takes, and Reason what decided, as
+	// in TestResult; Verdict is "" if the flow couldn't be evaluated
+	Verdict config.Action
+	Reason  string
+	Err     error
+}
+
+// Changed reports whether the policy decides the flow otherwise than
+// recorded
+func (r ReplayResult) Changed() bool {
+	return r.Err == nil && r.Verdict != r.Flow.Verdict
+}
+
+// Replay evaluates recorded flows against the ruleset cfg compiles to, as
+// RunTests does. Destinations are evaluated as recorded, domains are
+// resolved with resolver for the rules only.
+func Replay(cfg *config.Config, resolver dns.Resolver, flows []Flow) ([]ReplayResult, error) {
+	f, err := compile(cfg, resolver)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ReplayResult, 0, len(flows))
+	for _, flow := range flows {
+		result := ReplayResult{Flow: flow}
+		if !flow.replayable() {
+			result.Err = fmt.Errorf("protocol %s can't be evaluated", flow.Protocol)
+			results = append(results, result)
+			continue
+		}
+		test := f.runTest(flow.test())
+		result.Verdict, result.Reason, result.Err = test.Verdict, test.Reason, test.Err
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/decisionlog"
+	"github.com/skaegi/legion-router/pkg/dns/dnstest"
+)
+
+// TestReplay tests grouping recorded decisions into flows and evaluating
+// them against a candidate policy
+func TestReplay(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	decision := func(verdict, rule string, dst string, port uint16, at time.Duration) decisionlog.Decision {
+		return decisionlog.Decision{
+			Time: now.Add(at), Verdict: verdict, Rule: rule, Protocol: "tcp",
+			Source: net.ParseIP("10.0.0.5"), SourcePort: uint16(40000 + at/time.Second),
+			Destination: net.ParseIP(dst), Port: port,
+		}
+	}
+	decisions := []decisionlog.Decision{
+		decision("allow", "allow-web", "192.0.2.1", 443, 0),
+		decision("allow", "allow-web", "192.0.2.1", 443, 2*time.Second),
+		decision("allow", "allow-web", "192.0.2.1", 80, time.Second),
+		decision("deny", "", "198.51.100.7", 22, 3*time.Second),
+		{Time: now, Verdict: "deny", Protocol: "47", Source: net.ParseIP("10.0.0.5"), Destination: net.ParseIP("192.0.2.9")},
+	}
+
+	flows := Flows(decisions)
+	if len(flows) != 4 {
+		t.Fatalf("Expected 4 flows, got %d: %v", len(flows), flows)
+	}
+	if flows[0].Count != 2 || flows[0].Port != 443 || !flows[0].First.Equal(now) || !flows[0].Last.Equal(now.Add(2*time.Second)) {
+		t.Errorf("Expected the flow to port 443 first, twice, got %+v", flows[0])
+	}
+	if got, want := flows[0].String(), "10.0.0.5 -> 192.0.2.1 tcp/443"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// The candidate narrows the web rule to HTTPS and allows SSH
+	candidate := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-web", Action: config.ActionAllow, Order: 10, Egress: config.Egress{IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}}},
+			{Name: "allow-ssh", Action: config.ActionAllow, Order: 20, Egress: config.Egress{IPs: []string{"198.51.100.0/24"}, Ports: []string{"22"}}},
+		},
+	}
+	results, err := Replay(candidate, dnstest.NewFakeResolver(), flows)
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+
+	want := map[uint16]config.Action{443: config.ActionAllow, 80: config.ActionDeny, 22: config.ActionAllow}
+	for _, result := range results {
+		if result.Flow.Protocol == "47" {
+			if result.Err == nil || result.Changed() {
+				t.Errorf("Expected GRE not to be evaluated, got %+v", result)
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Fatalf("Failed to replay %s: %v", result.Flow, result.Err)
+		}
+		if result.Verdict != want[result.Flow.Port] {
+			t.Errorf("Expected %s for %s, got %s (%s)", want[result.Flow.Port], result.Flow, result.Verdict, result.Reason)
+		}
+		if changed := result.Flow.Port != 443; result.Changed() != changed {
+			t.Errorf("Expected %s changed %v, got %v", result.Flow, changed, result.Changed())
+		}
+	}
+}
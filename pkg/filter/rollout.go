@@ -0,0 +1,326 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+const (
+	defaultAbortRatio    = 2
+	defaultMinDenies     = 100
+	rolloutCheckInterval = 30 * time.Second
+)
+
+// rolloutState tracks a policy rolled out as a canary alongside the running
+// one, which stays in f.config until the rollout completes
+type rolloutState struct {
+	target   *config.Config
+	settings config.RolloutConfig
+	canary   *Filter // Programs the canary table
+	until    time.Time
+	stop     chan struct{}
+	// Default deny counter of the running table when the rollout started
+	baseStart uint64
+}
+
+// RolloutStatus describes a rollout in progress
+type RolloutStatus struct {
+	Percent int       `json:"percent,omitempty"`
+	LogOnly bool      `json:"log_only,omitempty"`
+	Until   time.Time `json:"until"`
+	// Packets no rule allowed since the rollout started, by the running and
+	// the new policy
+	BaseDenies   uint64 `json:"base_denies"`
+	CanaryDenies uint64 `json:"canary_denies"`
+}
+
+// startRolloutLocked programs cfg as a canary next to the running policy,
+// to be enforced everywhere after its rollout duration unless its deny rate
+// spikes
+// Must be called with mu held
+func (f *Filter) startRolloutLocked(cfg *config.Config) error {
+	if usesInspection(f.config) || usesInspection(cfg) {
+		return fmt.Errorf("policies with inspection can't be rolled out")
+	}
+	// Both tables must see the same traffic to split it
+	if !reflect.DeepEqual(f.config.Chain, cfg.Chain) {
+		return fmt.Errorf("the chain placement can't change in a rollout")
+	}
+	// A rollout in progress is replaced; this also removes its source split
+	if f.rollout != nil {
+		if err := f.applyConfig(f.config); err != nil {
+			return err
+		}
+	}
+
+	settings := *cfg.Rollout
+	nftMgr, err := nftables.NewManager(nftables.InNamespace(f.netns), nftables.Canary(settings.LogOnly))
+	if err != nil {
+		return fmt.Errorf("failed to create nftables manager: %w", err)
+	}
+	canary, err := f.canaryFilter(cfg, nftMgr)
+	if err != nil {
+		return err
+	}
+	if err := canary.programCanary(settings); err != nil {
+		nftMgr.Remove()
+		return err
+	}
+
+	baseStart, err := f.nft.DefaultDenies()
+	if err != nil {
+		nftMgr.Remove()
+		return err
+	}
+	if !settings.LogOnly {
+		if err := f.nft.SplitSources(settings.Percent); err != nil {
+			nftMgr.Remove()
+			return err
+		}
+	}
+
+	state := &rolloutState{
+		target:    cfg,
+		settings:  settings,
+		canary:    canary,
+		until:     time.Now().Add(settings.Duration.Std()),
+		stop:      make(chan struct{}),
+		baseStart: baseStart,
+	}
+	f.rollout = state
+	go f.watchRollout(state)
+
+	if settings.LogOnly {
+		log.Printf("Rolling out the new policy in log-only mode until %s", state.until.Format(time.RFC3339))
+	} else {
+		log.Printf("Rolling out the new policy to %d%% of sources until %s", settings.Percent, state.until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// canaryFilter creates the filter programming cfg in nftMgr's table. It
+// shares the running filter's resolver, address databases and grants;
+// domains resolve with the running resolver settings.
+// Must be called with mu held
+func (f *Filter) canaryFilter(cfg *config.Config, nftMgr *nftables.Manager) (*Filter, error) {
+	disc, err := newDiscovery(cfg, f.dns.Resolve)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up service discovery: %w", err)
+	}
+	endpoints := make(map[string][]string, len(f.endpoints))
+	for service, ips := range f.endpoints {
+		endpoints[service] = ips
+	}
+	// The canary drops the mappings its policy doesn't permit from its
+	// own table only
+	mappings := make(map[string]PortMapping, len(f.mappings))
+	for key, mapping := range f.mappings {
+		mappings[key] = mapping
+	}
+	return &Filter{
+		config:     cfg,
+		dns:        f.dns,
+		nft:        nftMgr,
+		netns:      f.netns,
+		unresolved: make(map[string]map[string]bool),
+		learned:    f.learned,
+		grants:     f.grants,
+		mappings:   mappings,
+		enabled:    f.enabled,
+		synced:     f.synced,
+		vrfMembers: f.vrfMembers,
+		containers: f.containers,
+		discovery:  disc,
+		endpoints:  endpoints,
+		ranges:     f.ranges,
+		asns:       f.asns,
+		bgp:        f.bgp,
+		dnsProxy:   f.dnsProxy,
+		// The recording of the applied policy redirects as it does
+		blockPagePort: f.blockPagePort,
+		honeypotPort:  f.honeypotPort,
+	}, nil
+}
+
+// programCanary sets up the canary table, splitting the sources with the
+// running table unless the canary is log-only
+func (f *Filter) programCanary(settings config.RolloutConfig) error {
+	if err := f.setupTable(f.config); err != nil {
+		return fmt.Errorf("failed to setup canary table: %w", err)
+	}
+	f.restoreGrants()
+	f.restorePortMappings(f.config)
+	f.loadPersistedAddresses()
+	f.discoverServices(false)
+	f.fetchIPRanges(false)
+	f.fetchASNPrefixes(false)
+	if err := f.applyRules(); err != nil {
+		return fmt.Errorf("failed to apply canary rules: %w", err)
+	}
+	if settings.LogOnly {
+		return nil
+	}
+	return f.nft.SplitSources(settings.Percent)
+}
+
+// watchRollout checks the deny rates of a rollout periodically, aborting it
+// if the new policy's spikes, and enforces the new policy once it is due
+func (f *Filter) watchRollout(state *rolloutState) {
+	ticker := time.NewTicker(rolloutCheckInterval)
+	defer ticker.Stop()
+	due := time.NewTimer(time.Until(state.until))
+	defer due.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.rollout == state {
+				f.checkRolloutLocked()
+			}
+			done := f.rollout != state
+			f.mu.Unlock()
+			if done {
+				return
+			}
+		case <-due.C:
+			f.mu.Lock()
+			if f.rollout == state {
+				log.Println("Rollout complete, enforcing the new policy for all traffic")
+				if err := f.applyConfig(state.target); err != nil {
+					log.Printf("ERROR: failed to enforce the new policy: %v", err)
+				}
+			}
+			f.mu.Unlock()
+			return
+		case <-state.stop:
+			return
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+// checkRolloutLocked aborts the rollout, restoring the running policy for
+// all sources, if the new policy denies too much more traffic
+// Must be called with mu held
+func (f *Filter) checkRolloutLocked() {
+	status := f.rolloutStatusLocked()
+	if !denyRateSpiked(f.rollout.settings, status.BaseDenies, status.CanaryDenies) {
+		return
+	}
+	log.Printf("Warning: aborting rollout, the new policy denied %d packets against %d by the running policy",
+		status.CanaryDenies, status.BaseDenies)
+	f.revertLocked(f.config)
+}
+
+// denyRateSpiked reports whether the new policy denied at least the minimum
+// and, per share of the sources it decides for, more than the abort ratio
+// times what the running policy denied
+func denyRateSpiked(settings config.RolloutConfig, baseDenies, canaryDenies uint64) bool {
+	ratio := settings.AbortRatio
+	if ratio == 0 {
+		ratio = defaultAbortRatio
+	}
+	min := settings.MinDenies
+	if min == 0 {
+		min = defaultMinDenies
+	}
+	if canaryDenies < min {
+		return false
+	}
+
+	// A log-only canary sees all traffic, like the running policy
+	canaryShare, baseShare := 100.0, 100.0
+	if !settings.LogOnly {
+		canaryShare, baseShare = float64(settings.Percent), float64(100-settings.Percent)
+	}
+	return float64(canaryDenies)/canaryShare > ratio*float64(baseDenies)/baseShare
+}
+
+// rolloutStatusLocked returns the rollout in progress, if any
+// Must be called with mu held
+func (f *Filter) rolloutStatusLocked() *RolloutStatus {
+	if f.rollout == nil {
+		return nil
+	}
+	status := &RolloutStatus{
+		Percent: f.rollout.settings.Percent,
+		LogOnly: f.rollout.settings.LogOnly,
+		Until:   f.rollout.until,
+	}
+	if denies, err := f.nft.DefaultDenies(); err != nil {
+		log.Printf("Warning: %v", err)
+	} else if denies > f.rollout.baseStart {
+		status.BaseDenies = denies - f.rollout.baseStart
+	}
+	if denies, err := f.rollout.canary.nft.DefaultDenies(); err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		status.CanaryDenies = denies
+	}
+	return status
+}
+
+// endRolloutLocked removes the canary table of a rollout in progress; the
+// running table's source split is left to be recreated by the caller
+// Must be called with mu held
+func (f *Filter) endRolloutLocked() {
+	if f.rollout == nil {
+		return
+	}
+	close(f.rollout.stop)
+	if err := f.rollout.canary.nft.Cleanup(); err != nil {
+		log.Printf("Warning: failed to remove canary table: %v", err)
+	}
+	f.rollout = nil
+}
+
+// updateCanaryGrant mirrors a grant change into the canary table, whose
+// sources bypass the running table's grants
+// Must be called with mu held
+func (f *Filter) updateCanaryGrant(source, ip net.IP, port uint16, ttl time.Duration) {
+	if f.rollout == nil {
+		return
+	}
+	nftMgr := f.rollout.canary.nft
+	// The entry may not exist yet
+	nftMgr.DeleteGrant(source, ip, port)
+	if ttl <= 0 {
+		return
+	}
+	if err := nftMgr.AddGrant(source, ip, port, ttl); err != nil {
+		log.Printf("Warning: failed to grant access in the canary table: %v", err)
+	}
+}
+
+// updateCanaryPortMapping mirrors a port mapping into the canary table,
+// removing it for a zero ttl
+// Must be called with mu held
+func (f *Filter) updateCanaryPortMapping(mapping PortMapping, ttl time.Duration) {
+	if f.rollout == nil {
+		return
+	}
+	nftMgr := f.rollout.canary.nft
+	ip := net.ParseIP(mapping.Internal)
+	// The entry may not exist yet
+	nftMgr.DeletePortMapping(mapping.Protocol, mapping.ExternalPort, ip, mapping.InternalPort)
+	if ttl <= 0 {
+		return
+	}
+	if err := nftMgr.AddPortMapping(mapping.Protocol, mapping.ExternalPort, ip, mapping.InternalPort, ttl); err != nil {
+		log.Printf("Warning: failed to map the port in the canary table: %v", err)
+	}
+}
+
+// usesInspection reports whether cfg queues traffic to the inspector
+func usesInspection(cfg *config.Config) bool {
+	insp := cfg.Inspection
+	return (insp != nil && insp.SNI) || hasL7Rules(cfg)
+}
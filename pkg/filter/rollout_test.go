@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestDenyRateSpiked tests comparing the deny rates of a canary and the
+// running policy per share of the sources
+func TestDenyRateSpiked(t *testing.T) {
+	testCases := []struct {
+		name         string
+		settings     config.RolloutConfig
+		baseDenies   uint64
+		canaryDenies uint64
+		want         bool
+	}{
+		{
+			name:         "same rate",
+			settings:     config.RolloutConfig{Percent: 10},
+			baseDenies:   900,
+			canaryDenies: 100,
+			want:         false,
+		},
+		{
+			name:         "spike",
+			settings:     config.RolloutConfig{Percent: 10},
+			baseDenies:   900,
+			canaryDenies: 250,
+			want:         true,
+		},
+		{
+			name:         "below minimum",
+			settings:     config.RolloutConfig{Percent: 10},
+			canaryDenies: 50,
+			want:         false,
+		},
+		{
+			name:         "custom ratio",
+			settings:     config.RolloutConfig{Percent: 10, AbortRatio: 3},
+			baseDenies:   900,
+			canaryDenies: 250,
+			want:         false,
+		},
+		{
+			name:         "log only",
+			settings:     config.RolloutConfig{LogOnly: true, MinDenies: 10},
+			baseDenies:   100,
+			canaryDenies: 150,
+			want:         false,
+		},
+		{
+			name:         "log only spike",
+			settings:     config.RolloutConfig{LogOnly: true, MinDenies: 10},
+			baseDenies:   100,
+			canaryDenies: 201,
+			want:         true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := denyRateSpiked(tc.settings, tc.baseDenies, tc.canaryDenies); got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package filter
+
+import (
+	"log"
+	"net"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/network"
+)
+
+// setupRoutes installs the configured static routes and removes those
+// installed for a previous config. Failures are logged, like those of
+// VLANs: a route through an interface that is still missing is retried on
+// the next reload.
+// Must be called with mu held
+func (f *Filter) setupRoutes() {
+	wanted := configRoutes(f.config)
+	for _, stale := range staleRoutes(f.routes, wanted) {
+		if err := network.DeleteRoute(stale); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		log.Printf("Removed route %s", stale)
+	}
+
+	f.routes = nil
+	for _, route := range wanted {
+		if err := network.EnsureRoute(route); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		f.routes = append(f.routes, route)
+	}
+}
+
+// removeRoutes deletes the routes installed by setupRoutes
+// Must be called with mu held
+func (f *Filter) removeRoutes() {
+	for _, route := range f.routes {
+		if err := network.DeleteRoute(route); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	f.routes = nil
+}
+
+// configRoutes returns the static routes of cfg; the config is validated,
+// so destinations parse and VRFs exist
+func configRoutes(cfg *config.Config) []network.Route {
+	var routes []network.Route
+	for _, r := range cfg.Routes {
+		destination, err := r.Network()
+		if err != nil {
+			continue
+		}
+		route := network.Route{
+			Destination: destination,
+			Interface:   r.Interface,
+			Metric:      r.Metric,
+		}
+		if r.Gateway != "" {
+			route.Gateway = net.ParseIP(r.Gateway)
+		}
+		if vrf, ok := cfg.VRF(r.VRF); ok {
+			route.Table = vrf.Table
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// staleRoutes returns the installed routes that aren't wanted anymore
+func staleRoutes(installed, wanted []network.Route) []network.Route {
+	keep := make(map[string]bool, len(wanted))
+	for _, route := range wanted {
+		keep[route.String()] = true
+	}
+	var stale []network.Route
+	for _, route := range installed {
+		if !keep[route.String()] {
+			stale = append(stale, route)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,274 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// RuleQuery selects rules of the applied policy; unset fields select all
+type RuleQuery struct {
+	Action config.Action
+	// Destination selects rules whose destinations contain the address,
+	// listed or as resolved
+	Destination net.IP
+	// Domain selects rules with a domain containing it, case-insensitively
+	Domain string
+	// Tag selects rules carrying the tag
+	Tag string
+	// Offset and Limit page through the selected rules; a Limit of 0
+	// returns them all
+	Offset int
+	Limit  int
+	// Hits also counts the packets each rule of the page decided
+	Hits bool
+}
+
+// RulePage is a page of the rules a query selects, in policy order
+type RulePage struct {
+	Rules []config.Rule `json:"rules"`
+	// Total counts the selected rules across all pages
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	// Disabled lists the rules of the page left out of the ruleset
+	Disabled []string `json:"disabled,omitempty"`
+	// Hits counts the packets each programmed rule of the page decided
+	// since it was programmed, if asked for
+	Hits map[string]uint64 `json:"hits,omitempty"`
+}
+
+// Rules returns the rules of the applied policy q selects
+func (f *Filter) Rules(q RuleQuery) RulePage {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var matched map[int]bool
+	if q.Destination != nil {
+		matched = make(map[int]bool)
+		for _, i := range f.index.MatchIP(q.Destination) {
+			matched[i] = true
+		}
+	}
+	domain := strings.ToLower(q.Domain)
+
+	page := RulePage{Rules: []config.Rule{}, Offset: q.Offset}
+	for i, rule := range f.config.Rules {
+		if q.Action != "" && rule.Action != q.Action {
+			continue
+		}
+		if matched != nil && !matched[i] && !f.ruleContainsIP(rule, q.Destination) {
+			continue
+		}
+		if domain != "" && !hasDomainContaining(rule, domain) {
+			continue
+		}
+		if q.Tag != "" && !rule.HasTag(q.Tag) {
+			continue
+		}
+		if page.Total >= q.Offset && (q.Limit == 0 || len(page.Rules) < q.Limit) {
+			page.Rules = append(page.Rules, rule)
+			if !f.ruleEnabled(rule) {
+				page.Disabled = append(page.Disabled, rule.Name)
+			}
+		}
+		page.Total++
+	}
+	if q.Hits {
+		page.Hits = make(map[string]uint64, len(page.Rules))
+		for _, rule := range page.Rules {
+			hits, err := f.nft.Hits(rule.Name)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+				continue
+			}
+			page.Hits[rule.Name] = hits
+		}
+	}
+	return page
+}
+
+// hasDomainContaining reports whether a domain of rule contains s, which is
+// lower case
+func hasDomainContaining(rule config.Rule, s string) bool {
+	for _, domain := range rule.Egress.AllDomains() {
+		if strings.Contains(strings.ToLower(domain), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandedRule is a rule of the applied policy as programmed
+type ExpandedRule struct {
+	Rule config.Rule `json:"rule"`
+	// Disabled is set for rules left out of the ruleset
+	Disabled bool `json:"disabled,omitempty"`
+	// Expired is set for rules left out as expired
+	Expired bool `json:"expired,omitempty"`
+	// Hits counts the packets the rule decided since it was programmed
+	Hits uint64 `json:"hits"`
+	// IPs are the addresses in the rule's destination sets
+	IPs []string `json:"ips,omitempty"`
+	// Unresolved lists the rule's domains that failed to resolve
+	Unresolved []string `json:"unresolved,omitempty"`
+	// Nftables are the kernel rules built from the rule, in nft syntax
+	Nftables []string `json:"nftables"`
+}
+
+// ExpandRule returns the rule of the applied policy named name as
+// programmed
+func (f *Filter) ExpandRule(name string) (ExpandedRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, rule := range f.config.Rules {
+		if rule.Name != name {
+			continue
+		}
+		if !f.ruleEnabled(rule) {
+			return ExpandedRule{Rule: rule, Disabled: true, Expired: f.expired[name]}, nil
+		}
+		hits, err := f.nft.Hits(name)
+		if err != nil {
+			return ExpandedRule{}, err
+		}
+		expanded := ExpandedRule{Rule: rule, Hits: hits, IPs: f.ruleIPs(rule)}
+		for domain := range f.unresolved[name] {
+			expanded.Unresolved = append(expanded.Unresolved, domain)
+		}
+		sort.Strings(expanded.Unresolved)
+
+		text, err := f.renderRule(i, rule)
+		if err != nil {
+			return ExpandedRule{}, fmt.Errorf("failed to render rule %s: %w", name, err)
+		}
+		expanded.Nftables = text
+		return expanded, nil
+	}
+	return ExpandedRule{}, fmt.Errorf("no rule %s in the applied policy", name)
+}
+
+// renderRule records the nftables rules of the rule at index in a filter of
+// its own, as renderApplied does for the whole policy, and returns them in
+// nft syntax
+// Must be called with mu held
+func (f *Filter) renderRule(index int, rule config.Rule) ([]string, error) {
+	var opts []nftables.Option
+	if f.netns != 0 {
+		opts = append(opts, nftables.InNamespace(f.netns))
+	}
+	shadow, err := f.canaryFilter(f.config, nftables.NewScriptManager(opts...))
+	if err != nil {
+		return nil, err
+	}
+	shadow.firewalls = f.firewalls
+	shadow.quiet = true
+	shadow.configHash = f.configHash
+	if err := shadow.setupTable(f.config); err != nil {
+		return nil, fmt.Errorf("failed to set up table: %w", err)
+	}
+	shadow.nft.SetLenient(f.config.Lenient)
+
+	for _, r := range shadow.compileRule(index, rule, nil).rules {
+		if err := shadow.nft.AddRule(r); err != nil {
+			return nil, err
+		}
+	}
+	return shadow.nft.RuleText(rule.Name)
+}
+
+// SetRuleEnabled enables or disables the rule of the applied policy named
+// name and reprograms the ruleset. A disabled rule stays in the config and
+// is listed, but is left out of the kernel. The switch takes precedence
+// over the rule's enabled setting and outlasts reloads, but not restarts.
+func (f *Filter) SetRuleEnabled(name string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	found := false
+	for _, rule := range f.config.Rules {
+		if rule.Name != name {
+			continue
+		}
+		if enabled && rule.Expired(time.Now()) {
+			return fmt.Errorf("rule %s expired on %s", name, rule.Expires.Format(time.RFC3339))
+		}
+		found = true
+		break
+	}
+	if !found {
+		return fmt.Errorf("no rule %s in the applied policy", name)
+	}
+	if err := f.setEnabledLocked([]string{name}, enabled); err != nil {
+		return err
+	}
+
+	if enabled {
+		log.Printf("Enabled rule %s", name)
+	} else {
+		log.Printf("Disabled rule %s", name)
+	}
+	return nil
+}
+
+// ruleEnabled reports whether rule is programmed: not if it had expired
+// when the policy was applied, else as switched through the admin API, or
+// else as configured
+// Must be called with mu held
+func (f *Filter) ruleEnabled(rule config.Rule) bool {
+	if f.expired[rule.Name] {
+		return false
+	}
+	if enabled, ok := f.enabled[rule.Name]; ok {
+		return enabled
+	}
+	return rule.IsEnabled()
+}
+
+// enabledRules returns the rules of the applied policy that are programmed,
+// in policy order
+// Must be called with mu held
+func (f *Filter) enabledRules() []config.Rule {
+	rules := make([]config.Rule, 0, len(f.config.Rules))
+	for _, rule := range f.config.Rules {
+		if f.ruleEnabled(rule) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// setEnabledLocked switches rules on or off and reprograms the ruleset,
+// restoring the previous switches if it fails
+// Must be called with mu held
+func (f *Filter) setEnabledLocked(names []string, enabled bool) error {
+	// Reprogramming would end the rollout without deciding it
+	if f.rollout != nil {
+		return fmt.Errorf("a rollout is in progress; try again once it completes")
+	}
+
+	previous := make(map[string]bool, len(f.enabled))
+	for name, on := range f.enabled {
+		previous[name] = on
+	}
+	for _, name := range names {
+		f.enabled[name] = enabled
+	}
+	if err := f.applyConfig(f.config); err != nil {
+		for name := range f.enabled {
+			delete(f.enabled, name)
+		}
+		for name, on := range previous {
+			f.enabled[name] = on
+		}
+		f.revertLocked(f.config)
+		return fmt.Errorf("failed to apply the policy: %w", err)
+	}
+	return nil
+}
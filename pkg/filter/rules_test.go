@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+// newRulesFilter returns a filter with the rules of cfg applied to a script
+// manager
+func newRulesFilter(t *testing.T, cfg *config.Config, answers map[string]string) *Filter {
+	t.Helper()
+	f, resolver := newTestFilter(t, cfg)
+	for domain, ip := range answers {
+		resolver.Set(domain, ip)
+	}
+	f.nft = nftables.NewScriptManager()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.setupTable(cfg); err != nil {
+		t.Fatalf("Failed to set up table: %v", err)
+	}
+	if err := f.applyRules(); err != nil {
+		t.Fatalf("applyRules() error = %v", err)
+	}
+	return f
+}
+
+// TestRules tests filtering and paging the rules of the applied policy
+func TestRules(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-github", Action: config.ActionAllow, Order: 10, Egress: config.Egress{Domains: []string{"*.GitHub.com", "github.com"}}},
+			{Name: "allow-internal", Action: config.ActionAllow, Order: 20, Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}},
+			{Name: "deny-metadata", Action: config.ActionDeny, Order: 30, Egress: config.Egress{IPs: []string{"169.254.169.254"}}},
+			{Name: "allow-registry", Action: config.ActionAllow, Order: 40, Egress: config.Egress{Domains: []string{"registry.example.com"}}},
+		},
+	}
+	f := newRulesFilter(t, cfg, map[string]string{"github.com": "140.82.112.3", "registry.example.com": "10.1.2.3"})
+
+	testCases := []struct {
+		name      string
+		query     RuleQuery
+		want      []string
+		wantTotal int
+	}{
+		{name: "all", want: []string{"allow-github", "allow-internal", "deny-metadata", "allow-registry"}, wantTotal: 4},
+		{name: "action", query: RuleQuery{Action: config.ActionDeny}, want: []string{"deny-metadata"}, wantTotal: 1},
+		{name: "domain", query: RuleQuery{Domain: "github"}, want: []string{"allow-github"}, wantTotal: 1},
+		{name: "listed destination", query: RuleQuery{Destination: net.ParseIP("10.9.9.9")}, want: []string{"allow-internal"}, wantTotal: 1},
+		{name: "resolved destination", query: RuleQuery{Destination: net.ParseIP("10.1.2.3")}, want: []string{"allow-internal", "allow-registry"}, wantTotal: 2},
+		{name: "page", query: RuleQuery{Offset: 1, Limit: 2}, want: []string{"allow-internal", "deny-metadata"}, wantTotal: 4},
+		{name: "past the end", query: RuleQuery{Offset: 10, Limit: 2}, want: nil, wantTotal: 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			page := f.Rules(tc.query)
+			var got []string
+			for _, rule := range page.Rules {
+				got = append(got, rule.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) || page.Total != tc.wantTotal {
+				t.Errorf("Expected %v of %d, got %v of %d", tc.want, tc.wantTotal, got, page.Total)
+			}
+		})
+	}
+}
+
+// TestExpandRule tests showing a rule with its addresses and kernel rules
+func TestExpandRule(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-internal", Action: config.ActionAllow, Order: 10, Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}},
+			{Name: "allow-api", Action: config.ActionAllow, Order: 20, Egress: config.Egress{
+				Domains: []string{"api.example.com", "gone.example.com"},
+				Ports:   []string{"443"},
+			}},
+		},
+	}
+	f := newRulesFilter(t, cfg, map[string]string{"api.example.com": "192.0.2.10"})
+
+	expanded, err := f.ExpandRule("allow-api")
+	if err != nil {
+		t.Fatalf("ExpandRule() error = %v", err)
+	}
+	if want := []string{"192.0.2.10"}; !reflect.DeepEqual(expanded.IPs, want) {
+		t.Errorf("Expected IPs %v, got %v", want, expanded.IPs)
+	}
+	if want := []string{"gone.example.com"}; !reflect.DeepEqual(expanded.Unresolved, want) {
+		t.Errorf("Expected unresolved %v, got %v", want, expanded.Unresolved)
+	}
+	text := strings.Join(expanded.Nftables, "\n")
+	for _, want := range []string{"jump rule_allow_api", "chain rule_allow_api: ", "ip daddr @ips_allow_api th dport 443 counter accept", "rule=allow-api"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected the kernel rules to contain %q, got:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "allow_internal") {
+		t.Errorf("Expected only the rules of allow-api, got:\n%s", text)
+	}
+
+	if _, err := f.ExpandRule("allow-gitlab"); err == nil {
+		t.Error("Expected error for an unknown rule")
+	}
+}
+
+// TestSetRuleEnabled tests leaving rules disabled in the config or through
+// the admin API out of the ruleset while listing them
+func TestSetRuleEnabled(t *testing.T) {
+	disabled := false
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-internal", Action: config.ActionAllow, Order: 10, Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}},
+			{Name: "deny-registry", Action: config.ActionDeny, Order: 20, Enabled: &disabled, Egress: config.Egress{Domains: []string{"registry.example.com"}}},
+		},
+	}
+	f := newRulesFilter(t, cfg, map[string]string{"registry.example.com": "192.0.2.20"})
+
+	// ruleset returns the rendered ruleset
+	ruleset := func() string {
+		t.Helper()
+		script, err := f.nft.RenderText()
+		if err != nil {
+			t.Fatalf("RenderText() error = %v", err)
+		}
+		return script
+	}
+	if script := ruleset(); strings.Contains(script, "deny_registry") {
+		t.Errorf("Expected deny-registry left out of the ruleset, got:\n%s", script)
+	}
+	if got := f.Status().Disabled; !reflect.DeepEqual(got, []string{"deny-registry"}) {
+		t.Errorf("Expected deny-registry reported disabled, got %v", got)
+	}
+	if page := f.Rules(RuleQuery{}); page.Total != 2 || !reflect.DeepEqual(page.Disabled, []string{"deny-registry"}) {
+		t.Errorf("Expected both rules listed with deny-registry disabled, got %+v", page)
+	}
+	// A refresh of a disabled rule's domain leaves it out
+	if err := f.updateDomainIPs("registry.example.com", []string{"192.0.2.21"}); err != nil {
+		t.Errorf("updateDomainIPs() error = %v", err)
+	}
+
+	if err := f.SetRuleEnabled("deny-registry", true); err != nil {
+		t.Fatalf("SetRuleEnabled() error = %v", err)
+	}
+	if err := f.SetRuleEnabled("allow-internal", false); err != nil {
+		t.Fatalf("SetRuleEnabled() error = %v", err)
+	}
+	script := ruleset()
+	if !strings.Contains(script, "deny_registry") || strings.Contains(script, "allow_internal") {
+		t.Errorf("Expected only deny-registry in the ruleset, got:\n%s", script)
+	}
+	if expanded, err := f.ExpandRule("allow-internal"); err != nil || !expanded.Disabled {
+		t.Errorf("Expected allow-internal shown as disabled, got %+v, %v", expanded, err)
+	}
+
+	if err := f.SetRuleEnabled("allow-gitlab", false); err == nil {
+		t.Error("Expected error for an unknown rule")
+	}
+}
+
+// TestExpireRules tests leaving expired rules out of the ruleset, at apply
+// time and once they expire
+func TestExpireRules(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-internal", Action: config.ActionAllow, Order: 10, Egress: config.Egress{IPs: []string{"10.0.0.0/8"}}},
+			{Name: "allow-trial", Action: config.ActionAllow, Order: 20, Expires: &past, Egress: config.Egress{IPs: []string{"198.51.100.0/24"}}},
+			{Name: "allow-migration", Action: config.ActionAllow, Order: 30, Expires: &future, Egress: config.Egress{IPs: []string{"203.0.113.0/24"}}},
+		},
+	}
+	f := newRulesFilter(t, cfg, nil)
+
+	script, err := f.nft.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	if strings.Contains(script, "allow_trial") || !strings.Contains(script, "allow_migration") {
+		t.Errorf("Expected only allow-trial left out of the ruleset, got:\n%s", script)
+	}
+	if got := f.Status().Expired; !reflect.DeepEqual(got, []string{"allow-trial"}) {
+		t.Errorf("Expected allow-trial reported expired, got %v", got)
+	}
+	if expanded, err := f.ExpandRule("allow-trial"); err != nil || !expanded.Expired {
+		t.Errorf("Expected allow-trial shown as expired, got %+v, %v", expanded, err)
+	}
+	if err := f.SetRuleEnabled("allow-trial", true); err == nil {
+		t.Error("Expected error enabling an expired rule")
+	}
+
+	// allow-migration expires after the policy was applied
+	future = time.Now().Add(-time.Minute)
+	f.mu.Lock()
+	f.expireRulesLocked(time.Now())
+	f.mu.Unlock()
+	if script, _ := f.nft.RenderText(); strings.Contains(script, "allow_migration") {
+		t.Errorf("Expected allow-migration removed once expired, got:\n%s", script)
+	}
+}
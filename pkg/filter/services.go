@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/discovery"
+)
+
+// newDiscovery creates the service discovery of a config
+func newDiscovery(cfg *config.Config, resolve func(string) ([]string, error)) (*discovery.Discovery, error) {
+	return discovery.New(cfg.Discovery, cfg.DNS.Servers, resolve)
+}
+
+// configServices returns the services the rules of cfg name
+func configServices(cfg *config.Config) []config.ServiceRef {
+	seen := make(map[string]bool)
+	var services []config.ServiceRef
+	for _, rule := range cfg.Rules {
+		for _, service := range rule.Egress.Services {
+			if !seen[service.String()] {
+				seen[service.String()] = true
+				services = append(services, service)
+			}
+		}
+	}
+	return services
+}
+
+// discoverServices looks up the endpoints of the services the rules name,
+// skipping those already known unless all is set. A service that fails to
+// be discovered keeps its last endpoints.
+// Must be called with mu held
+func (f *Filter) discoverServices(all bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.discovery.Interval())
+	defer cancel()
+
+	for _, service := range configServices(f.config) {
+		if _, ok := f.endpoints[service.String()]; ok && !all {
+			continue
+		}
+		endpoints, err := f.discovery.Endpoints(ctx, service)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		f.endpoints[service.String()] = endpoints
+	}
+}
+
+// refreshServices keeps the destination sets of rules naming services in
+// sync with their endpoints until stopped
+func (f *Filter) refreshServices() {
+	f.mu.RLock()
+	interval := f.discovery.Interval()
+	f.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.refreshServicesOnce()
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+// refreshServicesOnce looks up every service and updates the rules of
+// those whose endpoints changed. The lookups are done without holding mu.
+func (f *Filter) refreshServicesOnce() {
+	f.mu.RLock()
+	services := configServices(f.config)
+	d := f.discovery
+	f.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.Interval())
+	defer cancel()
+	discovered := make(map[string][]string)
+	for _, service := range services {
+		endpoints, err := d.Endpoints(ctx, service)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		discovered[service.String()] = endpoints
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for service, endpoints := range discovered {
+		if reflect.DeepEqual(f.endpoints[service], endpoints) {
+			continue
+		}
+		log.Printf("Endpoints of %s changed: %v", service, endpoints)
+		f.endpoints[service] = endpoints
+		for _, rule := range rulesUsingService(f.enabledRules(), service) {
+			if err := f.updateRuleIPs(rule, nil); err != nil {
+				log.Printf("Failed to update IPs for rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+}
+
+// rulesUsingService returns the rules naming a service
+func rulesUsingService(rules []config.Rule, service string) []config.Rule {
+	var result []config.Rule
+	for _, rule := range rules {
+		for _, s := range rule.Egress.Services {
+			if s.String() == service {
+				result = append(result, rule)
+				break
+			}
+		}
+	}
+	return result
+}
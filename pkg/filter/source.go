@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const maxSourceBackoff = time.Minute
+
+// SetSource makes the filter follow the config in src, starting after
+// revision, instead of watching the config file. It must be called
+// before Start.
+func (f *Filter) SetSource(src config.Source, revision uint64) {
+	f.source = src
+	f.sourceRevision = revision
+}
+
+// watchSource applies config changes from the source until stopped
+// Invalid configs are logged and the current one stays in effect, as with
+// file reloads.
+func (f *Filter) watchSource() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-f.stopChan
+		cancel()
+	}()
+
+	delay := initialRetryDelay
+	for {
+		data, revision, err := f.source.Wait(ctx, f.sourceRevision)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Warning: failed to watch %s, retrying in %s: %v", f.source, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = nextBackoff(delay, maxSourceBackoff)
+			continue
+		}
+		delay = initialRetryDelay
+		f.sourceRevision = revision
+
+		log.Printf("Config changed in %s (revision %d), reloading", f.source, revision)
+		newConfig, err := config.Parse(data)
+		if err == nil {
+			err = f.Reload(newConfig)
+		}
+		if err != nil {
+			log.Printf("Error reloading config: %v", err)
+		} else {
+			log.Println("Config reloaded successfully")
+		}
+	}
+}
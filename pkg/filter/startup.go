@@ -0,0 +1,394 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/version"
+)
+
+const (
+	initialRetryDelay = time.Second
+	defaultMaxBackoff = time.Minute
+	// Parallel lookups of lazily resolved domains, unless dns.refresh sets it
+	defaultLazyConcurrency = 8
+)
+
+// Status reports the health of the applied policy
+type Status struct {
+	// Degraded is set while any rule has domains that failed to resolve
+	Degraded bool `json:"degraded"`
+	// Unresolved maps rule names to their unresolved domains
+	Unresolved map[string][]string `json:"unresolved,omitempty"`
+	// Pending counts the domains of lazily applied rules still resolving
+	Pending int `json:"pending,omitempty"`
+	// Maintenance is set while the maintenance policy is in effect
+	Maintenance *MaintenanceStatus `json:"maintenance,omitempty"`
+	// MetadataDrops counts the packets dropped on their way to the instance
+	// metadata service
+	MetadataDrops uint64 `json:"metadata_drops,omitempty"`
+	// HardeningDrops counts the invalid and spoofed packets dropped
+	HardeningDrops uint64 `json:"hardening_drops,omitempty"`
+	// RateLimitDrops counts the new connections dropped beyond their rate
+	RateLimitDrops uint64 `json:"rate_limit_drops,omitempty"`
+	// Banned counts the sources banned for hitting deny rules too often,
+	// and BanDrops their packets dropped
+	Banned   int    `json:"banned,omitempty"`
+	BanDrops uint64 `json:"ban_drops,omitempty"`
+	// HoneypotRedirects counts the connections redirected to the honeypot
+	HoneypotRedirects uint64 `json:"honeypot_redirects,omitempty"`
+	// DNSCacheEntries counts the domains in the DNS cache, bounded to
+	// DNSCacheLimit
+	DNSCacheEntries int `json:"dns_cache_entries,omitempty"`
+	DNSCacheLimit   int `json:"dns_cache_limit,omitempty"`
+	// Upstreams is the health of the upstream resolvers
+	Upstreams []dns.UpstreamStatus `json:"upstreams,omitempty"`
+	// Rollout is set while a changed policy is rolled out
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+	// ConfigHash identifies the applied policy in the comments of its
+	// nftables rules
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Build identifies the binary enforcing the policy
+	Build version.Info `json:"build"`
+	// Disabled lists the rules kept in the config but left out of the
+	// ruleset
+	Disabled []string `json:"disabled,omitempty"`
+	// Expired lists the rules of the config past their expiry date, which
+	// are left out of the ruleset but are yet to be removed from the config
+	Expired []string `json:"expired,omitempty"`
+}
+
+// Status returns the current policy status
+func (f *Filter) Status() Status {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	status := Status{Unresolved: make(map[string][]string)}
+	for rule, domains := range f.unresolved {
+		for domain := range domains {
+			status.Unresolved[rule] = append(status.Unresolved[rule], domain)
+		}
+		sort.Strings(status.Unresolved[rule])
+	}
+	status.Degraded = len(status.Unresolved) > 0
+	status.Pending = len(f.pending)
+	status.Maintenance = f.maintenanceStatusLocked()
+	status.MetadataDrops = f.metadataDrops()
+	status.HardeningDrops = f.hardeningDrops()
+	status.RateLimitDrops = f.rateLimitDrops()
+	status.Banned = len(f.bannedSources())
+	status.BanDrops = f.banDrops()
+	status.HoneypotRedirects = f.honeypotRedirects()
+	if resolver, ok := f.dns.(cacheLister); ok {
+		status.DNSCacheEntries, status.DNSCacheLimit = resolver.CacheSize(), resolver.CacheLimit()
+	}
+	if pool, ok := f.dns.(upstreamPool); ok {
+		status.Upstreams = pool.Upstreams()
+	}
+	status.Rollout = f.rolloutStatusLocked()
+	status.ConfigHash = f.configHash
+	status.Build = version.Get()
+	now := time.Now()
+	for _, rule := range f.config.Rules {
+		if !f.ruleEnabled(rule) {
+			status.Disabled = append(status.Disabled, rule.Name)
+		}
+		if rule.Expired(now) {
+			status.Expired = append(status.Expired, rule.Name)
+		}
+	}
+	return status
+}
+
+// markUnresolved records the unresolved domains of a rule
+// Must be called with mu held
+func (f *Filter) markUnresolved(ruleName string, domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+	if f.unresolved[ruleName] == nil {
+		f.unresolved[ruleName] = make(map[string]bool)
+	}
+	for _, domain := range domains {
+		f.unresolved[ruleName][domain] = true
+	}
+}
+
+// reportUnresolved logs unresolved rules prominently and wakes the retry
+// loop when the startup policy retries
+// Must be called with mu held
+func (f *Filter) reportUnresolved() {
+	if len(f.unresolved) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(f.unresolved))
+	for name := range f.unresolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	log.Printf("DEGRADED: %d rule(s) have unresolved domains", len(names))
+	for _, name := range names {
+		var domains []string
+		for domain := range f.unresolved[name] {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+		log.Printf("DEGRADED: rule %s: %s", name, strings.Join(domains, ", "))
+	}
+
+	if f.config.DNS.Startup.EffectivePolicy() == config.StartupSkip {
+		log.Printf("Startup policy is 'skip': unresolved domains are not retried until the config is reloaded")
+		return
+	}
+
+	select {
+	case f.retryWake <- struct{}{}:
+	default:
+	}
+}
+
+// deferDomains records the domains of rule for resolvePending when startup
+// resolution is lazy, and returns them without addresses for resolveRuleIPs
+// to install the rule with. Filters compiled for rendering or a canary have
+// no background loops to fill their sets in, and resolve up front.
+// Must be called with mu held
+func (f *Filter) deferDomains(rule config.Rule) map[string][]string {
+	if !f.config.DNS.Startup.Lazy || f.stopChan == nil {
+		return nil
+	}
+	deferred := make(map[string][]string)
+	for _, domain := range rule.Egress.AllDomains() {
+		if !isWildcard(domain) {
+			deferred[domain] = nil
+			f.pending[domain] = true
+		}
+	}
+	return deferred
+}
+
+// resolvePending resolves the deferred domains in the background, filling
+// the sets of their rules in as each resolves
+// Must be called with mu held
+func (f *Filter) resolvePending() {
+	if len(f.pending) == 0 {
+		return
+	}
+	domains := make([]string, 0, len(f.pending))
+	for domain := range f.pending {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	concurrency := f.config.DNS.Refresh.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultLazyConcurrency
+	}
+	log.Printf("Resolving %d domain(s) in the background", len(domains))
+
+	go func() {
+		jobs := make(chan string)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for domain := range jobs {
+					f.resolveDeferred(domain)
+				}
+			}()
+		}
+	send:
+		for _, domain := range domains {
+			select {
+			case jobs <- domain:
+			case <-f.stopChan:
+				break send
+			}
+		}
+		close(jobs)
+		wg.Wait()
+	}()
+}
+
+// resolveDeferred resolves a deferred domain and installs its addresses;
+// a domain that fails is handled by the startup policy like any other
+func (f *Filter) resolveDeferred(domain string) {
+	ips, err := f.dns.Resolve(domain)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The config may have been reloaded meanwhile
+	if !f.pending[domain] {
+		return
+	}
+	delete(f.pending, domain)
+	if len(f.pending) == 0 {
+		defer f.persistRuleset()
+	}
+
+	if err != nil {
+		log.Printf("Warning: failed to resolve domain %s: %v", domain, err)
+		for _, rule := range rulesUsingDomain(f.config.Rules, domain) {
+			f.markUnresolved(rule.Name, []string{domain})
+		}
+		defer f.reportUnresolved()
+		var ok bool
+		if ips, ok = f.persisted[domain]; !ok {
+			return
+		}
+		log.Printf("Using last persisted addresses for %s: %v", domain, ips)
+	}
+	if err := f.updateDomainIPsLocked(domain, ips); err != nil {
+		log.Printf("Failed to install IPs for domain %s: %v", domain, err)
+	}
+}
+
+// loadPersistedAddresses loads fallback addresses for the persisted policy
+// Must be called with mu held
+func (f *Filter) loadPersistedAddresses() {
+	f.persisted = nil
+	if f.config.DNS.Startup.EffectivePolicy() != config.StartupPersisted {
+		return
+	}
+
+	persisted, err := dns.ReadCacheFile(f.config.DNS.CacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read persisted addresses: %v", err)
+		}
+		return
+	}
+	f.persisted = persisted
+}
+
+// waitForDomains blocks until every domain in the config resolves, retrying
+// with backoff, or until the startup timeout passes
+// Must be called with mu held
+func (f *Filter) waitForDomains() error {
+	pending := make(map[string]bool)
+	for _, rule := range f.config.Rules {
+		for _, domain := range rule.Egress.AllDomains() {
+			if !isWildcard(domain) {
+				pending[domain] = true
+			}
+		}
+	}
+
+	var deadline <-chan time.Time
+	if timeout := f.config.DNS.Startup.Timeout.Std(); timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	delay := initialRetryDelay
+	for {
+		for domain := range pending {
+			if _, err := f.dns.Resolve(domain); err == nil {
+				delete(pending, domain)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		log.Printf("Waiting for %d domain(s) to resolve before starting, retrying in %s", len(pending), delay)
+		select {
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for %d domain(s) to resolve", len(pending))
+		case <-f.stopChan:
+			return fmt.Errorf("stopped while waiting for domains to resolve")
+		case <-time.After(delay):
+		}
+		delay = nextBackoff(delay, maxBackoff(f.config))
+	}
+}
+
+// retryUnresolved re-resolves unresolved domains with backoff whenever
+// reportUnresolved wakes it, until they all resolve
+func (f *Filter) retryUnresolved() {
+	for {
+		select {
+		case <-f.stopChan:
+			return
+		case <-f.retryWake:
+		}
+
+		delay := initialRetryDelay
+		for f.Status().Degraded {
+			select {
+			case <-f.stopChan:
+				return
+			case <-time.After(delay):
+			}
+			f.retryOnce()
+
+			f.mu.RLock()
+			delay = nextBackoff(delay, maxBackoff(f.config))
+			f.mu.RUnlock()
+		}
+	}
+}
+
+// retryOnce tries each unresolved domain once and installs the addresses of
+// those that now resolve
+func (f *Filter) retryOnce() {
+	f.mu.RLock()
+	pending := make(map[string]bool)
+	for _, domains := range f.unresolved {
+		for domain := range domains {
+			pending[domain] = true
+		}
+	}
+	f.mu.RUnlock()
+
+	for domain := range pending {
+		ips, err := f.dns.Resolve(domain)
+		if err != nil {
+			continue
+		}
+
+		if err := f.updateDomainIPs(domain, ips); err != nil {
+			log.Printf("Failed to install IPs for domain %s: %v", domain, err)
+			continue
+		}
+
+		f.mu.Lock()
+		for rule, domains := range f.unresolved {
+			delete(domains, domain)
+			if len(domains) == 0 {
+				delete(f.unresolved, rule)
+			}
+		}
+		degraded := len(f.unresolved) > 0
+		f.mu.Unlock()
+
+		log.Printf("Resolved previously unresolved domain %s", domain)
+		if !degraded {
+			log.Println("All domains resolved, no longer degraded")
+		}
+	}
+}
+
+// maxBackoff returns the configured retry delay cap
+func maxBackoff(cfg *config.Config) time.Duration {
+	if max := cfg.DNS.Startup.MaxBackoff.Std(); max > 0 {
+		return max
+	}
+	return defaultMaxBackoff
+}
+
+// nextBackoff doubles a retry delay up to max
+func nextBackoff(delay, max time.Duration) time.Duration {
+	delay *= 2
+	if delay > max {
+		return max
+	}
+	return delay
+}
@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// SyncState is the runtime state an active router replicates to its
+// standby, so that flows allowed before a failover stay allowed after it
+type SyncState struct {
+	// Addresses allowed for each domain rule, resolved or learned from SNI
+	Addresses map[string][]string `json:"addresses"`
+	Grants    []Grant             `json:"grants"`
+}
+
+// syncedAddresses are a rule's addresses received from the active router
+type syncedAddresses struct {
+	ips      []string
+	received time.Time
+}
+
+// SyncState returns the state to replicate to a standby
+func (f *Filter) SyncState() SyncState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := SyncState{Addresses: make(map[string][]string)}
+	for _, rule := range f.config.Rules {
+		// The standby resolves the domains of compound rules itself, as
+		// their addresses are kept per branch
+		if len(rule.Egress.Domains) == 0 || rule.Egress.Compound() {
+			continue
+		}
+		ips, _ := f.resolveRuleIPs(rule, nil)
+		state.Addresses[rule.Name] = ips
+	}
+
+	f.pruneGrants()
+	for _, grant := range f.grants {
+		state.Grants = append(state.Grants, grant)
+	}
+	return state
+}
+
+// ApplySyncState adds the active router's addresses to the domain rules and
+// mirrors its grants. Received addresses stay allowed for as long as
+// learned ones after the last update.
+func (f *Filter) ApplySyncState(state SyncState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for _, rule := range f.enabledRules() {
+		ips, ok := state.Addresses[rule.Name]
+		if !ok || len(rule.Egress.Domains) == 0 || rule.Egress.Compound() {
+			continue
+		}
+		f.synced[rule.Name] = syncedAddresses{ips: ips, received: now}
+		ruleIPs, _ := f.resolveRuleIPs(rule, nil)
+		if err := f.nft.UpdateIPs(rule.Name, ruleIPs); err != nil {
+			log.Printf("Warning: failed to apply synced addresses for rule %s: %v", rule.Name, err)
+		}
+	}
+
+	f.pruneGrants()
+	active := make(map[string]bool)
+	for _, grant := range state.Grants {
+		if net.ParseIP(grant.Destination) == nil || (grant.Source != "" && grant.sourceIP() == nil) || !now.Before(grant.Expires) {
+			continue
+		}
+		active[grant.key()] = true
+		if current, ok := f.grants[grant.key()]; ok && current.Expires.Equal(grant.Expires) {
+			continue
+		}
+		if err := f.setGrantLocked(grant); err != nil {
+			log.Printf("Warning: failed to apply synced grant for %s: %v", grant.key(), err)
+		}
+	}
+	for key, grant := range f.grants {
+		if active[key] {
+			continue
+		}
+		if err := f.nft.DeleteGrant(grant.sourceIP(), net.ParseIP(grant.Destination), grant.Port); err != nil {
+			log.Printf("Warning: failed to remove synced grant for %s: %v", key, err)
+			continue
+		}
+		delete(f.grants, key)
+	}
+}
+
+// syncedIPs returns the addresses received from the active router for a
+// rule, unless they are stale
+// Must be called with mu held
+func (f *Filter) syncedIPs(ruleName string) []string {
+	synced, ok := f.synced[ruleName]
+	if !ok || time.Since(synced.received) > learnedTTL {
+		return nil
+	}
+	return synced.ips
+}
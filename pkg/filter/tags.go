@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// TagStatus reports the rules of the applied policy carrying a tag
+type TagStatus struct {
+	Tag   string   `json:"tag"`
+	Rules []string `json:"rules"`
+	// Disabled lists the rules left out of the ruleset
+	Disabled []string `json:"disabled,omitempty"`
+	// Hits counts the packets the rules decided since they were programmed
+	Hits uint64 `json:"hits"`
+}
+
+// Tags reports the tags of the applied policy, sorted, with their rules and
+// hits
+func (f *Filter) Tags() ([]TagStatus, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	hits, err := f.nft.RuleHits()
+	if err != nil {
+		return nil, err
+	}
+	byTag := make(map[string]*TagStatus)
+	for _, rule := range f.config.Rules {
+		for _, tag := range rule.Tags {
+			status, ok := byTag[tag]
+			if !ok {
+				status = &TagStatus{Tag: tag}
+				byTag[tag] = status
+			}
+			status.Rules = append(status.Rules, rule.Name)
+			if !f.ruleEnabled(rule) {
+				status.Disabled = append(status.Disabled, rule.Name)
+			}
+			status.Hits += hits[rule.Name]
+		}
+	}
+
+	tags := make([]TagStatus, 0, len(byTag))
+	for _, status := range byTag {
+		tags = append(tags, *status)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags, nil
+}
+
+// SetTagEnabled enables or disables the rules of the applied policy tagged
+// tag and reprograms the ruleset, returning the names of the rules. The
+// switch outlasts reloads, for rules of the same name, but not restarts.
+func (f *Filter) SetTagEnabled(tag string, enabled bool) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var names []string
+	for _, rule := range f.config.Rules {
+		if rule.HasTag(tag) {
+			names = append(names, rule.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no rule of the applied policy is tagged %s", tag)
+	}
+	if err := f.setEnabledLocked(names, enabled); err != nil {
+		return nil, err
+	}
+
+	verb := "Disabled"
+	if enabled {
+		verb = "Enabled"
+	}
+	log.Printf("%s %d rule(s) tagged %s: %v", verb, len(names), tag, names)
+	return names, nil
+}
@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestSetTagEnabled tests disabling and enabling the rules carrying a tag
+func TestSetTagEnabled(t *testing.T) {
+	cfg := &config.Config{
+		Version: "1.0",
+		Rules: []config.Rule{
+			{Name: "allow-stripe", Action: config.ActionAllow, Order: 10, Tags: []string{"payments", "external"}, Egress: config.Egress{IPs: []string{"198.51.100.0/24"}}},
+			{Name: "allow-ledger", Action: config.ActionAllow, Order: 20, Tags: []string{"payments"}, Egress: config.Egress{IPs: []string{"10.2.0.0/16"}}},
+			{Name: "allow-github", Action: config.ActionAllow, Order: 30, Tags: []string{"external"}, Egress: config.Egress{IPs: []string{"140.82.112.0/20"}}},
+		},
+	}
+	f := newRulesFilter(t, cfg, nil)
+
+	names, err := f.SetTagEnabled("payments", false)
+	if err != nil {
+		t.Fatalf("SetTagEnabled() error = %v", err)
+	}
+	if want := []string{"allow-stripe", "allow-ledger"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected rules %v, got %v", want, names)
+	}
+	script, err := f.nft.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	if strings.Contains(script, "allow_stripe") || strings.Contains(script, "allow_ledger") {
+		t.Errorf("Expected the disabled rules left out of the ruleset, got:\n%s", script)
+	}
+	if !strings.Contains(script, "allow_github") {
+		t.Errorf("Expected allow-github in the ruleset, got:\n%s", script)
+	}
+
+	tags, err := f.Tags()
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+	want := []TagStatus{
+		{Tag: "external", Rules: []string{"allow-stripe", "allow-github"}, Disabled: []string{"allow-stripe"}},
+		{Tag: "payments", Rules: []string{"allow-stripe", "allow-ledger"}, Disabled: []string{"allow-stripe", "allow-ledger"}},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("Expected tags %+v, got %+v", want, tags)
+	}
+	if expanded, err := f.ExpandRule("allow-ledger"); err != nil || !expanded.Disabled {
+		t.Errorf("Expected allow-ledger shown as disabled, got %+v, %v", expanded, err)
+	}
+	if page := f.Rules(RuleQuery{Tag: "external"}); page.Total != 2 {
+		t.Errorf("Expected 2 rules tagged external, got %d", page.Total)
+	}
+
+	if _, err := f.SetTagEnabled("payments", true); err != nil {
+		t.Fatalf("SetTagEnabled() error = %v", err)
+	}
+	if script, _ := f.nft.RenderText(); !strings.Contains(script, "allow_ledger") {
+		t.Errorf("Expected allow-ledger back in the ruleset, got:\n%s", script)
+	}
+
+	if _, err := f.SetTagEnabled("billing", false); err == nil {
+		t.Error("Expected error for a tag no rule carries")
+	}
+}
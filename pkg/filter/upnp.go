@@ -0,0 +1,175 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+var (
+	// ErrPortMappingRefused is returned for a mapping the policy doesn't
+	// permit
+	ErrPortMappingRefused = errors.New("port mapping is not permitted")
+	// ErrPortMappingConflict is returned for a port already forwarded
+	// elsewhere
+	ErrPortMappingConflict = errors.New("port is already mapped")
+)
+
+// PortMapping forwards a port of the external interface to an internal host
+// that requested it through UPnP or NAT-PMP, until it expires
+type PortMapping struct {
+	Protocol     string    `json:"protocol"`
+	ExternalPort uint16    `json:"external_port"`
+	Internal     string    `json:"internal"`
+	InternalPort uint16    `json:"internal_port"`
+	Expires      time.Time `json:"expires"`
+	Description  string    `json:"description,omitempty"`
+}
+
+// key identifies a mapping by protocol and external port
+func (m PortMapping) key() string {
+	return m.Protocol + "/" + strconv.Itoa(int(m.ExternalPort))
+}
+
+// AddPortMapping forwards mapping.ExternalPort to the internal host and port
+// for ttl, capped by the upnp settings, if the policy permits it; adding a
+// mapping of the same host again renews it
+func (f *Filter) AddPortMapping(mapping PortMapping, ttl time.Duration) (PortMapping, error) {
+	ip := net.ParseIP(mapping.Internal).To4()
+	if ip == nil {
+		return PortMapping{}, fmt.Errorf("invalid internal address: %s", mapping.Internal)
+	}
+	if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+		return PortMapping{}, fmt.Errorf("invalid protocol: %s", mapping.Protocol)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cfg := f.config.UPnP
+	if cfg == nil {
+		return PortMapping{}, ErrPortMappingRefused
+	}
+	if !cfg.Permits(ip, mapping.ExternalPort, mapping.InternalPort) {
+		return PortMapping{}, ErrPortMappingRefused
+	}
+	if f.config.NAT != nil {
+		for _, forward := range f.config.NAT.Forwards {
+			if forward.EffectiveProtocol() == mapping.Protocol && forward.Port == mapping.ExternalPort {
+				return PortMapping{}, ErrPortMappingConflict
+			}
+		}
+	}
+	if ttl <= 0 || ttl > cfg.EffectiveMaxLease() {
+		ttl = cfg.EffectiveMaxLease()
+	}
+
+	f.prunePortMappings()
+	mapping.Internal = ip.String()
+	mapping.Expires = time.Now().Add(ttl)
+	if existing, ok := f.mappings[mapping.key()]; ok {
+		if existing.Internal != mapping.Internal {
+			return PortMapping{}, ErrPortMappingConflict
+		}
+		if err := f.deletePortMappingLocked(existing); err != nil {
+			return PortMapping{}, err
+		}
+	}
+	if err := f.nft.AddPortMapping(mapping.Protocol, mapping.ExternalPort, ip, mapping.InternalPort, ttl); err != nil {
+		return PortMapping{}, err
+	}
+	f.mappings[mapping.key()] = mapping
+	f.updateCanaryPortMapping(mapping, ttl)
+
+	log.Printf("Mapped %s port %d to %s:%d until %s: %s", mapping.Protocol, mapping.ExternalPort,
+		mapping.Internal, mapping.InternalPort, mapping.Expires.Format(time.RFC3339), mapping.Description)
+	return mapping, nil
+}
+
+// DeletePortMapping removes the mapping of an external port before it
+// expires; internal limits it to the mappings of that host
+func (f *Filter) DeletePortMapping(protocol string, externalPort uint16, internal string) (PortMapping, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prunePortMappings()
+	key := PortMapping{Protocol: protocol, ExternalPort: externalPort}.key()
+	mapping, ok := f.mappings[key]
+	if !ok || (internal != "" && !net.ParseIP(internal).Equal(net.ParseIP(mapping.Internal))) {
+		return PortMapping{}, fmt.Errorf("no mapping of %s", key)
+	}
+	if err := f.deletePortMappingLocked(mapping); err != nil {
+		return PortMapping{}, err
+	}
+
+	log.Printf("Unmapped %s port %d from %s:%d", mapping.Protocol, mapping.ExternalPort, mapping.Internal, mapping.InternalPort)
+	return mapping, nil
+}
+
+// deletePortMappingLocked removes mapping from the kernel and the table
+// Must be called with mu held
+func (f *Filter) deletePortMappingLocked(mapping PortMapping) error {
+	if err := f.nft.DeletePortMapping(mapping.Protocol, mapping.ExternalPort, net.ParseIP(mapping.Internal), mapping.InternalPort); err != nil {
+		return err
+	}
+	delete(f.mappings, mapping.key())
+	f.updateCanaryPortMapping(mapping, 0)
+	return nil
+}
+
+// PortMappings returns the active port mappings ordered by protocol and
+// external port
+func (f *Filter) PortMappings() []PortMapping {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prunePortMappings()
+	mappings := make([]PortMapping, 0, len(f.mappings))
+	for _, mapping := range f.mappings {
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].Protocol != mappings[j].Protocol {
+			return mappings[i].Protocol < mappings[j].Protocol
+		}
+		return mappings[i].ExternalPort < mappings[j].ExternalPort
+	})
+	return mappings
+}
+
+// prunePortMappings forgets mappings the kernel has expired
+// Must be called with mu held
+func (f *Filter) prunePortMappings() {
+	now := time.Now()
+	for key, mapping := range f.mappings {
+		if !now.Before(mapping.Expires) {
+			delete(f.mappings, key)
+		}
+	}
+}
+
+// restorePortMappings reinstalls active mappings after the table was
+// recreated, dropping those the policy no longer permits
+// Must be called with mu held
+func (f *Filter) restorePortMappings(cfg *config.Config) {
+	f.prunePortMappings()
+	for key, mapping := range f.mappings {
+		ip := net.ParseIP(mapping.Internal)
+		if cfg.UPnP == nil || !cfg.UPnP.Permits(ip, mapping.ExternalPort, mapping.InternalPort) {
+			log.Printf("Dropping mapping of %s to %s:%d, which the policy no longer permits", key, mapping.Internal, mapping.InternalPort)
+			delete(f.mappings, key)
+			continue
+		}
+		ttl := time.Until(mapping.Expires)
+		if err := f.nft.AddPortMapping(mapping.Protocol, mapping.ExternalPort, ip, mapping.InternalPort, ttl); err != nil {
+			log.Printf("Warning: failed to restore mapping of %s: %v", key, err)
+			delete(f.mappings, key)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package filter
+
+import (
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/network"
+)
+
+// setupVLANs creates or checks the configured VLAN subinterfaces. Failures
+// are logged: rules match subinterfaces by name, so they take effect once
+// the interface appears.
+// Must be called with mu held
+func (f *Filter) setupVLANs() {
+	for _, v := range f.config.VLANs {
+		vlan := network.VLAN{
+			ID:        v.ID,
+			Parent:    v.Parent,
+			Name:      v.InterfaceName(),
+			Addresses: v.Addresses,
+		}
+		if !v.Create {
+			if err := network.CheckVLAN(vlan); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			continue
+		}
+
+		created, err := network.EnsureVLAN(vlan)
+		if err != nil {
+			log.Printf("Warning: failed to set up VLAN %d: %v", v.ID, err)
+			continue
+		}
+		if created {
+			f.createdLinks = append(f.createdLinks, vlan.Name)
+		}
+	}
+}
+
+// removeVLANs deletes the subinterfaces and VRFs created by setupVLANs and
+// setupVRFs
+// Must be called with mu held
+func (f *Filter) removeVLANs() {
+	for _, name := range f.createdLinks {
+		if err := network.DeleteLink(name); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	f.createdLinks = nil
+}
+
+// ruleInterface returns the input interface a rule is scoped to, if any
+func ruleInterface(cfg *config.Config, rule config.Rule) string {
+	if rule.VLANID == 0 {
+		return ""
+	}
+	iface, _ := cfg.VLANInterface(rule.VLANID)
+	return iface
+}
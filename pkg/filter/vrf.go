@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"log"
+
+	"github.com/skaegi/legion-router/pkg/network"
+)
+
+// setupVRFs creates or checks the configured VRF devices and records their
+// member interfaces. Failures are logged: rules match the VRF device by
+// name, so they take effect once it appears.
+// Must be called with mu held
+func (f *Filter) setupVRFs() {
+	f.vrfMembers = make(map[string]string)
+	for _, v := range f.config.VRFs {
+		vrf := network.VRF{
+			Name:       v.Name,
+			Table:      v.Table,
+			Interfaces: v.Interfaces,
+		}
+		if v.Create {
+			created, err := network.EnsureVRF(vrf)
+			if created {
+				f.createdLinks = append(f.createdLinks, vrf.Name)
+			}
+			if err != nil {
+				log.Printf("Warning: failed to set up VRF %s: %v", v.Name, err)
+				continue
+			}
+		} else if err := network.CheckVRF(vrf); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+
+		members, err := network.VRFMembers(v.Name)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		for _, member := range members {
+			f.vrfMembers[member] = v.Name
+		}
+	}
+}
+
+// inVRF reports whether traffic from iface is routed in vrf. Queued
+// packets may report either the VRF device or the member interface they
+// arrived on.
+// Must be called with mu held
+func (f *Filter) inVRF(iface, vrf string) bool {
+	return iface == vrf || f.vrfMembers[iface] == vrf
+}
@@ -0,0 +1,443 @@
+package flowlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// The maps the eBPF programs record the owners of sockets in. An owner is
+// the pid (tgid), 4 bytes of padding, the cgroup ID and the command name.
+// Ports are in host byte order, but remote ones in network byte order, in
+// 32-bit words; IPv4 addresses take the first word of an address.
+const (
+	ownerLen   = 32
+	cookieLen  = 8  // Socket cookie -> owner
+	flowKeyLen = 40 // Local port, remote port, local address, remote address -> owner
+	destKeyLen = 20 // Remote port, remote address -> owner of the last UDP socket sending to it
+
+	maxOwners = 65536
+	maxFlows  = 65536
+	maxDests  = 16384
+)
+
+// The cgroup index is rebuilt when a lookup misses, at most this often
+const minRescan = time.Second
+
+// Fields of bpf_sock_addr and bpf_sock_ops, from linux/bpf.h
+const (
+	sockAddrUserIP4  = 4
+	sockAddrUserIP6  = 8
+	sockAddrUserPort = 24
+	sockAddrProtocol = 36
+
+	sockOpsOp         = 0
+	sockOpsFamily     = 20
+	sockOpsRemoteIP4  = 24
+	sockOpsLocalIP4   = 28
+	sockOpsRemoteIP6  = 32
+	sockOpsLocalIP6   = 48
+	sockOpsRemotePort = 64
+	sockOpsLocalPort  = 68
+
+	sockOpsTCPConnectCB = 3
+)
+
+// bpfOwners attributes connections with eBPF programs attached to the root
+// of the cgroup2 hierarchy. The connect and UDP sendmsg programs record the
+// process calling them as the owner of the socket, and of UDP datagrams to
+// the destination; the sock_ops program records the owner of a TCP
+// connection by its addresses before its SYN is sent. The owners outlive
+// their sockets and processes, until the maps evict them.
+type bpfOwners struct {
+	owners, flows, dests *ebpf.Map
+	links                []link.Link
+	diag                 *sockDiag
+	cgroups              *cgroupIndex
+}
+
+// openBPFOwners loads and attaches the programs, which needs
+// CAP_BPF and CAP_NET_ADMIN, or root, and Linux 5.10 or later
+func openBPFOwners() (b *bpfOwners, err error) {
+	root, err := cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("failed to lift the memlock limit: %w", err)
+	}
+
+	b = &bpfOwners{cgroups: &cgroupIndex{root: root}}
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+	for _, m := range []struct {
+		m          **ebpf.Map
+		name       string
+		keyLen     uint32
+		maxEntries uint32
+	}{
+		{&b.owners, "legion_owners", cookieLen, maxOwners},
+		{&b.flows, "legion_flows", flowKeyLen, maxFlows},
+		{&b.dests, "legion_dests", destKeyLen, maxDests},
+	} {
+		*m.m, err = ebpf.NewMap(&ebpf.MapSpec{
+			Name:       m.name,
+			Type:       ebpf.LRUHash,
+			KeySize:    m.keyLen,
+			ValueSize:  ownerLen,
+			MaxEntries: m.maxEntries,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create map %s: %w", m.name, err)
+		}
+	}
+
+	for _, p := range []struct {
+		attach ebpf.AttachType
+		v6     bool
+	}{
+		{ebpf.AttachCGroupInet4Connect, false},
+		{ebpf.AttachCGroupInet6Connect, true},
+		{ebpf.AttachCGroupUDP4Sendmsg, false},
+		{ebpf.AttachCGroupUDP6Sendmsg, true},
+	} {
+		spec := &ebpf.ProgramSpec{
+			Type:         ebpf.CGroupSockAddr,
+			AttachType:   p.attach,
+			License:      "GPL",
+			Instructions: connectProgram(b.owners, b.dests, p.v6),
+		}
+		if err := b.attach(root, spec); err != nil {
+			return nil, err
+		}
+	}
+	spec := &ebpf.ProgramSpec{
+		Type:         ebpf.SockOps,
+		AttachType:   ebpf.AttachCGroupSockOps,
+		License:      "GPL",
+		Instructions: sockOpsProgram(b.owners, b.flows),
+	}
+	if err := b.attach(root, spec); err != nil {
+		return nil, err
+	}
+
+	b.diag, err = openSockDiag()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sock_diag: %w", err)
+	}
+	return b, nil
+}
+
+// attach loads a program and attaches it to the cgroup at path
+func (b *bpfOwners) attach(path string, spec *ebpf.ProgramSpec) error {
+	prog, err := ebpf.NewProgram(spec)
+	if err != nil {
+		return fmt.Errorf("failed to load %s program: %w", spec.AttachType, err)
+	}
+	// The link holds the program
+	defer prog.Close()
+	l, err := link.AttachCgroup(link.CgroupOptions{Path: path, Attach: spec.AttachType, Program: prog})
+	if err != nil {
+		return fmt.Errorf("failed to attach %s program to %s: %w", spec.AttachType, path, err)
+	}
+	b.links = append(b.links, l)
+	return nil
+}
+
+// Close detaches the programs and releases the maps
+func (b *bpfOwners) Close() error {
+	var errs []error
+	for _, l := range b.links {
+		errs = append(errs, l.Close())
+	}
+	for _, m := range []*ebpf.Map{b.owners, b.flows, b.dests} {
+		if m != nil {
+			errs = append(errs, m.Close())
+		}
+	}
+	if b.diag != nil {
+		errs = append(errs, b.diag.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ownerOf looks a TCP connection up by its addresses, and other
+// connections by the cookie of their socket if it is still open, or else a
+// UDP one by its destination
+func (b *bpfOwners) ownerOf(entry Entry) *Process {
+	var owner []byte
+	if entry.Protocol == "tcp" {
+		owner = lookupOwner(b.flows, flowKeys(entry))
+	}
+	if owner == nil {
+		if sock, ok := b.diag.find(entry); ok {
+			key := make([]byte, cookieLen)
+			binary.NativeEndian.PutUint64(key, sock.cookie)
+			owner = lookupOwner(b.owners, [][]byte{key})
+		}
+	}
+	if owner == nil && entry.Protocol == "udp" {
+		owner = lookupOwner(b.dests, destKeys(entry))
+	}
+	if len(owner) != ownerLen {
+		return nil
+	}
+	return b.process(owner, time.Now())
+}
+
+// process returns the process of an owner recorded by the programs
+func (b *bpfOwners) process(owner []byte, now time.Time) *Process {
+	name := owner[16:ownerLen]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return &Process{
+		PID:    int(binary.NativeEndian.Uint32(owner)),
+		Name:   string(name),
+		Cgroup: b.cgroups.path(binary.NativeEndian.Uint64(owner[8:]), now),
+	}
+}
+
+// lookupOwner returns the owner of the first of keys in m, nil if none is
+func lookupOwner(m *ebpf.Map, keys [][]byte) []byte {
+	for _, key := range keys {
+		if owner, err := m.LookupBytes(key); err == nil && owner != nil {
+			return owner
+		}
+	}
+	return nil
+}
+
+// flowKeys returns the keys a TCP connection may have in the flows map
+func flowKeys(entry Entry) [][]byte {
+	sources, destinations := bpfAddresses(entry.Source), bpfAddresses(entry.Destination)
+	var keys [][]byte
+	for i := 0; i < len(sources) && i < len(destinations); i++ {
+		key := make([]byte, flowKeyLen)
+		binary.NativeEndian.PutUint32(key, uint32(entry.SourcePort))
+		binary.BigEndian.PutUint16(key[4:], entry.Port)
+		copy(key[8:24], sources[i])
+		copy(key[24:40], destinations[i])
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// destKeys returns the keys a UDP destination may have in the dests map
+func destKeys(entry Entry) [][]byte {
+	var keys [][]byte
+	for _, addr := range bpfAddresses(entry.Destination) {
+		key := make([]byte, destKeyLen)
+		binary.BigEndian.PutUint16(key, entry.Port)
+		copy(key[4:], addr)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// bpfAddresses returns the forms ip may have in the maps: an IPv4 address
+// as the address of an IPv4 socket, or IPv4-mapped, of an IPv6 one
+func bpfAddresses(ip net.IP) [][]byte {
+	v6 := make([]byte, net.IPv6len)
+	copy(v6, ip.To16())
+	if ip4 := ip.To4(); ip4 != nil {
+		v4 := make([]byte, net.IPv6len)
+		copy(v4, ip4)
+		return [][]byte{v4, v6}
+	}
+	return [][]byte{v6}
+}
+
+// connectProgram records the calling process as the owner of the socket,
+// by its cookie, and of a UDP socket also by its destination. The owner is
+// at fp-40, the cookie at fp-8 and the destination at fp-60.
+func connectProgram(owners, dests *ebpf.Map, v6 bool) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, -40, asm.R0, asm.Word),
+		asm.StoreImm(asm.RFP, -36, 0, asm.Word),
+		asm.FnGetCurrentCgroupId.Call(),
+		asm.StoreMem(asm.RFP, -32, asm.R0, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, -24),
+		asm.Mov.Imm(asm.R2, 16),
+		asm.FnGetCurrentComm.Call(),
+		asm.LoadMapPtr(asm.R1, owners.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -40),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnMapUpdateElem.Call(),
+
+		asm.LoadMem(asm.R7, asm.R6, sockAddrProtocol, asm.Word),
+		asm.JNE.Imm(asm.R7, syscall.IPPROTO_UDP, "out"),
+		asm.LoadMem(asm.R7, asm.R6, sockAddrUserPort, asm.Word),
+		asm.StoreMem(asm.RFP, -60, asm.R7, asm.Word),
+	}
+	if v6 {
+		for i := int16(0); i < 4; i++ {
+			insns = append(insns,
+				asm.LoadMem(asm.R7, asm.R6, sockAddrUserIP6+4*i, asm.Word),
+				asm.StoreMem(asm.RFP, -56+4*i, asm.R7, asm.Word),
+			)
+		}
+	} else {
+		insns = append(insns,
+			asm.LoadMem(asm.R7, asm.R6, sockAddrUserIP4, asm.Word),
+			asm.StoreMem(asm.RFP, -56, asm.R7, asm.Word),
+			asm.StoreImm(asm.RFP, -52, 0, asm.Word),
+			asm.StoreImm(asm.RFP, -48, 0, asm.DWord),
+		)
+	}
+	return append(insns,
+		asm.LoadMapPtr(asm.R1, dests.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -60),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -40),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnMapUpdateElem.Call(),
+		// Allow the call
+		asm.Mov.Imm(asm.R0, 1).WithSymbol("out"),
+		asm.Return(),
+	)
+}
+
+// sockOpsProgram records the owner of the socket of a connecting TCP
+// socket by its addresses, with the key at fp-48. Older kernels shift the
+// remote port into the upper half of its word.
+func sockOpsProgram(owners, flows *ebpf.Map) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, sockOpsOp, asm.Word),
+		asm.JNE.Imm(asm.R7, sockOpsTCPConnectCB, "out"),
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+		asm.LoadMapPtr(asm.R1, owners.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "out"),
+		asm.Mov.Reg(asm.R8, asm.R0),
+
+		asm.LoadMem(asm.R7, asm.R6, sockOpsLocalPort, asm.Word),
+		asm.StoreMem(asm.RFP, -48, asm.R7, asm.Word),
+		asm.LoadMem(asm.R7, asm.R6, sockOpsRemotePort, asm.Word),
+		asm.JLE.Imm(asm.R7, 0xffff, "port"),
+		asm.RSh.Imm(asm.R7, 16),
+		asm.StoreMem(asm.RFP, -44, asm.R7, asm.Word).WithSymbol("port"),
+		asm.LoadMem(asm.R7, asm.R6, sockOpsFamily, asm.Word),
+		asm.JEq.Imm(asm.R7, syscall.AF_INET6, "v6"),
+		asm.LoadMem(asm.R7, asm.R6, sockOpsLocalIP4, asm.Word),
+		asm.StoreMem(asm.RFP, -40, asm.R7, asm.Word),
+		asm.StoreImm(asm.RFP, -36, 0, asm.Word),
+		asm.StoreImm(asm.RFP, -32, 0, asm.DWord),
+		asm.LoadMem(asm.R7, asm.R6, sockOpsRemoteIP4, asm.Word),
+		asm.StoreMem(asm.RFP, -24, asm.R7, asm.Word),
+		asm.StoreImm(asm.RFP, -20, 0, asm.Word),
+		asm.StoreImm(asm.RFP, -16, 0, asm.DWord),
+		asm.Ja.Label("update"),
+	}
+	for i := int16(0); i < 4; i++ {
+		load := asm.LoadMem(asm.R7, asm.R6, sockOpsLocalIP6+4*i, asm.Word)
+		if i == 0 {
+			load = load.WithSymbol("v6")
+		}
+		insns = append(insns, load,
+			asm.StoreMem(asm.RFP, -40+4*i, asm.R7, asm.Word),
+			asm.LoadMem(asm.R7, asm.R6, sockOpsRemoteIP6+4*i, asm.Word),
+			asm.StoreMem(asm.RFP, -24+4*i, asm.R7, asm.Word),
+		)
+	}
+	return append(insns,
+		asm.LoadMapPtr(asm.R1, flows.FD()).WithSymbol("update"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -48),
+		asm.Mov.Reg(asm.R3, asm.R8),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnMapUpdateElem.Call(),
+		asm.Mov.Imm(asm.R0, 1).WithSymbol("out"),
+		asm.Return(),
+	)
+}
+
+// cgroupIndex maps the IDs of cgroups to their paths in the unified
+// hierarchy, as the ID of a cgroup is the inode of its directory
+type cgroupIndex struct {
+	root    string // Where the hierarchy is mounted
+	paths   map[uint64]string
+	scanned time.Time
+}
+
+// path returns the path of the cgroup with id, rebuilding the index if it
+// has none and was built before minRescan; "" if it has been removed
+func (c *cgroupIndex) path(id uint64, now time.Time) string {
+	path, ok := c.paths[id]
+	if !ok && now.Sub(c.scanned) >= minRescan {
+		c.paths, c.scanned = cgroupPaths(c.root), now
+		path = c.paths[id]
+	}
+	return path
+}
+
+// cgroupPaths returns the paths of the cgroups under root by their IDs
+func cgroupPaths(root string) map[uint64]string {
+	paths := make(map[uint64]string)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			rel, _ := filepath.Rel(root, path)
+			paths[st.Ino] = filepath.Join("/", rel)
+		}
+		return nil
+	})
+	return paths
+}
+
+// cgroup2Mount returns where the unified cgroup hierarchy is mounted
+func cgroup2Mount() (string, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, "self", "mountinfo"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// id parent major:minor root mount-point options [optional...] - type source super-options
+		fields := strings.Fields(line)
+		for i := 5; i < len(fields)-1; i++ {
+			if fields[i] == "-" {
+				if fields[i+1] == "cgroup2" {
+					return fields[4], nil
+				}
+				break
+			}
+		}
+	}
+	return "", fmt.Errorf("no cgroup2 hierarchy is mounted")
+}
@@ -0,0 +1,128 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestBPFKeys tests the keys of connections against those the programs
+// record on a little-endian host
+func TestBPFKeys(t *testing.T) {
+	testCases := []struct {
+		name  string
+		entry Entry
+		want  []string
+	}{
+		{
+			name: "tcp",
+			entry: Entry{Protocol: "tcp", Source: net.ParseIP("127.0.0.1"), SourcePort: 47664,
+				Destination: net.ParseIP("127.0.0.1"), Port: 33211},
+			want: []string{
+				"30ba000081bb0000" + "7f000001000000000000000000000000" + "7f000001000000000000000000000000",
+				// From an IPv6 socket
+				"30ba000081bb0000" + "00000000000000000000ffff7f000001" + "00000000000000000000ffff7f000001",
+			},
+		},
+		{
+			name: "tcp6",
+			entry: Entry{Protocol: "tcp", Source: net.ParseIP("::1"), SourcePort: 52206,
+				Destination: net.ParseIP("::1"), Port: 37073},
+			want: []string{"eecb000090d10000" + "00000000000000000000000000000001" + "00000000000000000000000000000001"},
+		},
+		{
+			name: "udp",
+			entry: Entry{Protocol: "udp", Source: net.ParseIP("127.0.0.1"), SourcePort: 40000,
+				Destination: net.ParseIP("127.0.0.1"), Port: 5353},
+			want: []string{"14e90000" + "7f000001000000000000000000000000", "14e90000" + "00000000000000000000ffff7f000001"},
+		},
+		{
+			name: "udp6",
+			entry: Entry{Protocol: "udp", Source: net.ParseIP("::1"), SourcePort: 40000,
+				Destination: net.ParseIP("::1"), Port: 5354},
+			want: []string{"14ea0000" + "00000000000000000000000000000001"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := destKeys(tc.entry)
+			if tc.entry.Protocol == "tcp" {
+				keys = flowKeys(tc.entry)
+			}
+			var got []string
+			for _, key := range keys {
+				got = append(got, hex.EncodeToString(key))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCgroupIndex(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "system.slice", "chronyd.service"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	inode := func(path string) uint64 {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+
+	b := &bpfOwners{cgroups: &cgroupIndex{root: root}}
+	now := time.Now()
+	owner := make([]byte, ownerLen)
+	binary.NativeEndian.PutUint32(owner, 97)
+	binary.NativeEndian.PutUint64(owner[8:], inode("system.slice/chronyd.service"))
+	copy(owner[16:], "chronyd")
+	want := Process{PID: 97, Name: "chronyd", Cgroup: "/system.slice/chronyd.service"}
+	if got := b.process(owner, now); *got != want {
+		t.Errorf("Expected %+v, got %+v", want, *got)
+	}
+	if got := b.cgroups.path(inode(""), now); got != "/" {
+		t.Errorf("Expected the root cgroup /, got %q", got)
+	}
+
+	// Cgroups created since the index was built are found once it may be
+	// rebuilt
+	if err := os.Mkdir(filepath.Join(root, "system.slice", "ntpdate.service"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	id := inode("system.slice/ntpdate.service")
+	if got := b.cgroups.path(id, now.Add(minRescan/2)); got != "" {
+		t.Errorf("Expected no path before the index is rebuilt, got %q", got)
+	}
+	if got := b.cgroups.path(id, now.Add(minRescan)); got != "/system.slice/ntpdate.service" {
+		t.Errorf("Expected /system.slice/ntpdate.service, got %q", got)
+	}
+}
+
+func TestCgroup2Mount(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(procRoot, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mountinfo := `25 1 259:1 / / rw,relatime shared:1 - ext4 /dev/root rw
+30 25 0:26 / /sys/fs/cgroup rw,nosuid,nodev,noexec shared:4 - tmpfs tmpfs ro,mode=755
+31 30 0:27 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:5 - cgroup2 cgroup2 rw,nsdelegate
+32 30 0:28 / /sys/fs/cgroup/pids rw,nosuid,nodev,noexec,relatime shared:6 - cgroup cgroup rw,pids
+`
+	if err := os.WriteFile(filepath.Join(procRoot, "self", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cgroup2Mount(); err != nil || got != "/sys/fs/cgroup/unified" {
+		t.Errorf("Expected /sys/fs/cgroup/unified, got %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,347 @@
+// Package flowlog logs new connections, as an egress audit trail comparable
+// to a proxy's access log. The ruleset sends the first packet of each
+// connection to an NFLOG group, prefixed with the verdict and the name of
+// the rule deciding it; the logger receives them, attributes the destination
+// to a domain and writes a line per connection. The destination is
+// attributed to the name its client looked up, if the DNS answers forwarded
+// to clients are sent to the group too or the router's DNS proxy hands over
+// its own, or else to the domain of the rule it was resolved for.
+package flowlog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skaegi/legion-router/pkg/internal/netutil"
+	"github.com/skaegi/legion-router/pkg/nftables"
+)
+
+const (
+	// DefaultGroup is the NFLOG group new connections are sent to
+	DefaultGroup = 100
+
+	// Clients retry denied connections, each attempt a new connection;
+	// repeats within the window are logged once
+	denyRepeatWindow = 30 * time.Second
+	maxDenied        = 4096
+
+	// Connections waiting for the process owning them; beyond this, they
+	// are logged without it rather than holding up the group
+	maxPending = 1024
+)
+
+// Config configures a Logger
+type Config struct {
+	Group uint16 // NFLOG group
+	// File appends the log to a file instead of the router's log, if set
+	File string
+	// NetNS is the network namespace file descriptor the group is in, if
+	// not the router's own
+	NetNS int
+	// Domains attributes destinations to domains, if set
+	Domains Domains
+	// Sink also receives the logged entries, e.g. to store them, if set
+	Sink Sink
+	// Processes attributes connections to the process owning their socket
+	// on the router host, for the output hook, with eBPF if it can be loaded
+	Processes bool
+}
+
+// Sink receives the entries a Logger writes
+type Sink interface {
+	Logged(entry Entry)
+}
+
+// Domains attributes the destinations of connections to domains
+type Domains interface {
+	// DomainOf returns the domain ip was resolved or learned for under
+	// rule, "" if it has none
+	DomainOf(rule string, ip net.IP) string
+}
+
+// Entry is a logged connection
+type Entry struct {
+	Time    time.Time
+	Verdict string // allow or deny
+	// Rule deciding the connection, "" for connections no rule matched
+	Rule     string
+	Protocol string // tcp, udp, icmp, icmpv6 or the protocol number
+	// Interface the connection arrived on, "" if unknown
+	Interface   string
+	Source      net.IP
+	SourcePort  uint16
+	Destination net.IP
+	Port        uint16
+	// Domain the destination was looked up, resolved or learned for, ""
+	// if unknown
+	Domain string
+	// Process owning the connection's socket on the router host, nil if
+	// unknown
+	Process *Process
+}
+
+// String formats the entry as a log line, without the time
+func (e Entry) String() string {
+	var b strings.Builder
+	b.WriteString(e.Verdict)
+	if e.Rule != "" {
+		fmt.Fprintf(&b, " rule=%s", e.Rule)
+	}
+	fmt.Fprintf(&b, " proto=%s", e.Protocol)
+	if e.Interface != "" {
+		fmt.Fprintf(&b, " in=%s", e.Interface)
+	}
+	fmt.Fprintf(&b, " src=%s dst=%s", netutil.HostPort(e.Source, e.SourcePort), netutil.HostPort(e.Destination, e.Port))
+	if e.Domain != "" {
+		fmt.Fprintf(&b, " domain=%s", e.Domain)
+	}
+	if p := e.Process; p != nil {
+		fmt.Fprintf(&b, " pid=%d comm=%s", p.PID, p.Name)
+		if p.Cgroup != "" {
+			fmt.Fprintf(&b, " cgroup=%s", p.Cgroup)
+		}
+	}
+	return b.String()
+}
+
+// ParseLine parses a line of the log file, or a connection in the router's
+// log, back into an entry, but for its process
+func ParseLine(line string) (Entry, error) {
+	var e Entry
+	var rest string
+	if before, after, ok := strings.Cut(line, " Connection "); ok {
+		t, err := time.ParseInLocation("2006/01/02 15:04:05", before, time.Local)
+		if err != nil {
+			return e, fmt.Errorf("invalid time in %q", line)
+		}
+		e.Time, rest = t, after
+	} else {
+		before, after, _ := strings.Cut(line, " ")
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return e, fmt.Errorf("invalid time in %q", line)
+		}
+		e.Time, rest = t, after
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || (fields[0] != nftables.ConnectionLogAllow && fields[0] != nftables.ConnectionLogDeny) {
+		return e, fmt.Errorf("no verdict in %q", line)
+	}
+	e.Verdict = fields[0]
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "rule":
+			e.Rule = value
+		case "proto":
+			e.Protocol = value
+		case "in":
+			e.Interface = value
+		case "src":
+			e.Source, e.SourcePort, err = netutil.ParseHostPort(value)
+		case "dst":
+			e.Destination, e.Port, err = netutil.ParseHostPort(value)
+		case "domain":
+			e.Domain = value
+		}
+		if err != nil {
+			return e, fmt.Errorf("invalid %s in %q", key, line)
+		}
+	}
+	if e.Protocol == "" || e.Source == nil || e.Destination == nil {
+		return e, fmt.Errorf("incomplete connection %q", line)
+	}
+	return e, nil
+}
+
+// Logger logs the connections received on an NFLOG group
+type Logger struct {
+	config Config
+	file   *os.File
+	out    *log.Logger // nil logs to the router's log
+	names  *clientNames
+
+	// Attribute connections to processes off the receive path; nil unless
+	// the config asks for processes
+	owners  owners
+	pending chan Entry
+
+	mu     sync.Mutex
+	denied map[string]time.Time // Denied connection -> last logged
+}
+
+// New creates a Logger, opening its file if it has one
+func New(config Config) (*Logger, error) {
+	if config.Group == 0 {
+		config.Group = DefaultGroup
+	}
+	l := &Logger{config: config, names: newClientNames(), denied: make(map[string]time.Time)}
+	if config.File != "" {
+		file, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open connection log: %w", err)
+		}
+		l.file, l.out = file, log.New(file, "", 0)
+	}
+	return l, nil
+}
+
+// Run receives connections from the NFLOG group until ctx is cancelled,
+// then closes the log file
+func (l *Logger) Run(ctx context.Context) error {
+	if l.file != nil {
+		defer l.file.Close()
+	}
+
+	group, err := openGroup(l.config.Group, l.config.NetNS)
+	if err != nil {
+		return fmt.Errorf("failed to open nflog group %d: %w", l.config.Group, err)
+	}
+	go func() {
+		<-ctx.Done()
+		group.Close()
+	}()
+	log.Printf("Logging new connections from nflog group %d", l.config.Group)
+
+	if l.config.Processes {
+		if l.owners = openOwners(); l.owners != nil {
+			l.pending = make(chan Entry, maxPending)
+			done := make(chan struct{})
+			go func() {
+				l.attribute()
+				close(done)
+			}()
+			defer func() {
+				close(l.pending)
+				<-done
+				l.owners.Close()
+			}()
+		}
+	}
+
+	for {
+		packets, err := group.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("Warning: nflog receive error: %v", err)
+			continue
+		}
+		for _, p := range packets {
+			l.handle(p)
+		}
+	}
+}
+
+// Answered attributes the connections client makes next to the names of a
+// DNS response it got other than through the router's forwarding, as from
+// the router's own DNS proxy
+func (l *Logger) Answered(client net.IP, resp *dns.Msg) {
+	l.names.learnMsg(client, resp)
+}
+
+// handle logs the connection of a packet received from the group, or
+// learns the names in a DNS answer
+func (l *Logger) handle(p nflogPacket) {
+	verdict, rule, _ := strings.Cut(p.prefix, " ")
+	if verdict == nftables.ConnectionLogDNS {
+		if client, answer, err := parseDNSAnswer(p); err == nil {
+			l.names.learn(client, answer)
+		}
+		return
+	}
+
+	entry, err := parseEntry(p)
+	if err != nil {
+		log.Printf("Warning: failed to log connection %q: %v", p.prefix, err)
+		return
+	}
+	entry.Time = time.Now()
+	entry.Verdict, entry.Rule = verdict, rule
+	entry.Interface = interfaceName(p.inDev)
+	if l.pending != nil && (entry.Protocol == "tcp" || entry.Protocol == "udp") {
+		select {
+		case l.pending <- entry:
+			return
+		default:
+		}
+	}
+	l.Log(entry)
+}
+
+// attribute logs the pending connections with the processes owning their
+// sockets, until pending is closed
+func (l *Logger) attribute() {
+	for entry := range l.pending {
+		entry.Process = l.owners.ownerOf(entry)
+		l.Log(entry)
+	}
+}
+
+// Log attributes an entry's destination to a domain, unless it already
+// names one, and writes it; repeats of a denied connection are skipped
+func (l *Logger) Log(entry Entry) {
+	if entry.Verdict == nftables.ConnectionLogDeny && l.repeated(entry) {
+		return
+	}
+	if entry.Domain == "" {
+		entry.Domain = l.names.lookup(entry.Source, entry.Destination)
+	}
+	if entry.Domain == "" && entry.Rule != "" && l.config.Domains != nil {
+		entry.Domain = l.config.Domains.DomainOf(entry.Rule, entry.Destination)
+	}
+	if l.config.Sink != nil {
+		l.config.Sink.Logged(entry)
+	}
+	if l.out == nil {
+		log.Printf("Connection %s", entry)
+		return
+	}
+	l.out.Printf("%s %s", entry.Time.UTC().Format(time.RFC3339), entry)
+}
+
+// repeated reports whether a denied connection was logged within the
+// repeat window, recording it otherwise
+func (l *Logger) repeated(entry Entry) bool {
+	key := fmt.Sprintf("%s %s %s %d", entry.Protocol, entry.Source, entry.Destination, entry.Port)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.denied[key]; ok && entry.Time.Sub(last) < denyRepeatWindow {
+		return true
+	}
+	if len(l.denied) >= maxDenied {
+		for k, last := range l.denied {
+			if entry.Time.Sub(last) >= denyRepeatWindow {
+				delete(l.denied, k)
+			}
+		}
+	}
+	if len(l.denied) < maxDenied {
+		l.denied[key] = entry.Time
+	}
+	return false
+}
+
+// interfaceName returns the name of the interface with index, or "" if it
+// is unknown
+func interfaceName(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
@@ -0,0 +1,301 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/miekg/dns"
+)
+
+// ipv4Packet builds the headers of an IPv4 packet of proto with ports
+func ipv4Packet(proto byte, src, dst string, srcPort, dstPort uint16) []byte {
+	data := make([]byte, 28)
+	data[0] = 0x45
+	data[9] = proto
+	copy(data[12:16], net.ParseIP(src).To4())
+	copy(data[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(data[20:22], srcPort)
+	binary.BigEndian.PutUint16(data[22:24], dstPort)
+	return data
+}
+
+func TestParseEntry(t *testing.T) {
+	ipv6 := make([]byte, 48)
+	ipv6[0] = 0x60
+	ipv6[6] = 58
+	copy(ipv6[8:24], net.ParseIP("fd00::5"))
+	copy(ipv6[24:40], net.ParseIP("2001:db8::1"))
+
+	testCases := []struct {
+		name    string
+		payload []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "tcp",
+			payload: ipv4Packet(6, "10.0.0.5", "93.184.216.34", 51234, 443),
+			want:    "allow rule=web proto=tcp src=10.0.0.5:51234 dst=93.184.216.34:443",
+		},
+		{
+			name:    "udp",
+			payload: ipv4Packet(17, "10.0.0.5", "8.8.8.8", 40000, 53),
+			want:    "allow rule=web proto=udp src=10.0.0.5:40000 dst=8.8.8.8:53",
+		},
+		{
+			name:    "icmpv6",
+			payload: ipv6,
+			want:    "allow rule=web proto=icmpv6 src=fd00::5 dst=2001:db8::1",
+		},
+		{
+			name:    "short",
+			payload: []byte{0x45, 0},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entry, err := parseEntry(nflogPacket{prefix: "allow web", payload: tc.payload})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", entry)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			entry.Verdict, entry.Rule = "allow", "web"
+			if got := entry.String(); got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	testCases := []struct {
+		name    string
+		line    string
+		want    string // The entry formatted again
+		wantErr bool
+	}{
+		{
+			name: "log file",
+			line: "2026-10-16T12:00:00Z allow rule=web proto=tcp in=eth1 src=10.0.0.5:51234 dst=93.184.216.34:443 domain=example.com",
+			want: "allow rule=web proto=tcp in=eth1 src=10.0.0.5:51234 dst=93.184.216.34:443 domain=example.com",
+		},
+		{
+			name: "router's log",
+			line: "2026/10/16 12:00:02 Connection deny proto=icmpv6 src=fd00::5 dst=2001:db8::1 pid=812 comm=curl",
+			want: "deny proto=icmpv6 src=fd00::5 dst=2001:db8::1",
+		},
+		{
+			name: "ipv6 with ports",
+			line: "2026-10-16T12:00:00Z deny proto=udp src=[fd00::5]:40000 dst=[2001:db8::1]:53",
+			want: "deny proto=udp src=[fd00::5]:40000 dst=[2001:db8::1]:53",
+		},
+		{
+			name:    "other log line",
+			line:    "2026/10/16 12:00:02 Watching config file for changes: /etc/legion-router/config.yaml",
+			wantErr: true,
+		},
+		{
+			name:    "no destination",
+			line:    "2026-10-16T12:00:00Z allow rule=web proto=tcp src=10.0.0.5:51234",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entry, err := ParseLine(tc.line)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", entry)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := entry.String(); got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+			if entry.Time.IsZero() {
+				t.Errorf("Expected the time parsed")
+			}
+		})
+	}
+}
+
+func TestParsePacketMessage(t *testing.T) {
+	indev := make([]byte, 4)
+	binary.BigEndian.PutUint32(indev, 3)
+	payload := ipv4Packet(6, "10.0.0.5", "93.184.216.34", 51234, 443)
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfulaIfindexIndev, Data: indev},
+		{Type: nfulaPayload, Data: payload},
+		{Type: nfulaPrefix, Data: []byte("web\x00")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal attributes: %v", err)
+	}
+
+	p, err := parsePacketMessage(append(nfgenHeader(DefaultGroup), attrs...))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p.prefix != "web" || p.inDev != 3 || string(p.payload) != string(payload) {
+		t.Errorf("Unexpected packet %+v", p)
+	}
+}
+
+type fakeDomains map[string]string
+
+func (d fakeDomains) DomainOf(rule string, ip net.IP) string {
+	return d[rule+" "+ip.String()]
+}
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.log")
+	l, err := New(Config{File: path, Domains: fakeDomains{"web 93.184.216.34": "example.com"}})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer l.file.Close()
+
+	at := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l.Log(Entry{Time: at, Verdict: "allow", Rule: "web", Protocol: "tcp", Source: net.ParseIP("10.0.0.5"), SourcePort: 51234,
+		Destination: net.ParseIP("93.184.216.34"), Port: 443})
+	l.Log(Entry{Time: at, Verdict: "allow", Rule: "sni", Protocol: "tcp", Source: net.ParseIP("10.0.0.5"), SourcePort: 51235,
+		Destination: net.ParseIP("140.82.112.6"), Port: 443, Domain: "github.com"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	want := []string{
+		"2026-10-16T12:00:00Z allow rule=web proto=tcp src=10.0.0.5:51234 dst=93.184.216.34:443 domain=example.com",
+		"2026-10-16T12:00:00Z allow rule=sni proto=tcp src=10.0.0.5:51235 dst=140.82.112.6:443 domain=github.com",
+	}
+	if got := strings.Split(strings.TrimSpace(string(data)), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected log\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// dnsAnswer builds a DNS answer to a query for name carrying addresses
+func dnsAnswer(t *testing.T, name string, addresses ...string) []byte {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Response = true
+	for _, address := range addresses {
+		rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN A %s", dns.Fqdn(name), address))
+		if err != nil {
+			t.Fatalf("Failed to build record: %v", err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack answer: %v", err)
+	}
+	return data
+}
+
+func TestLogDeniedWithClientNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.log")
+	l, err := New(Config{File: path, Domains: fakeDomains{"web 93.184.216.34": "example.com"}})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer l.file.Close()
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l.names.now = func() time.Time { return now }
+
+	// The answer to 10.0.0.5 passes the router on its way back
+	answer := append(ipv4Packet(17, "8.8.8.8", "10.0.0.5", 53, 40000), dnsAnswer(t, "Evil.Example.com", "203.0.113.9")...)
+	l.handle(nflogPacket{prefix: "dns", payload: answer})
+
+	deny := ipv4Packet(6, "10.0.0.5", "203.0.113.9", 51234, 443)
+	for i := 0; i < 3; i++ {
+		l.handle(nflogPacket{prefix: "deny", payload: deny})
+	}
+	// Other clients didn't look the address up
+	l.handle(nflogPacket{prefix: "deny", payload: ipv4Packet(6, "10.0.0.6", "203.0.113.9", 51234, 443)})
+	// Without a lookup by the client, the domain of the rule is used
+	l.handle(nflogPacket{prefix: "allow web", payload: ipv4Packet(6, "10.0.0.5", "93.184.216.34", 51235, 443)})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Strip the time
+		got = append(got, line[strings.Index(line, " ")+1:])
+	}
+	want := []string{
+		"deny proto=tcp src=10.0.0.5:51234 dst=203.0.113.9:443 domain=evil.example.com",
+		"deny proto=tcp src=10.0.0.6:51234 dst=203.0.113.9:443",
+		"allow rule=web proto=tcp src=10.0.0.5:51235 dst=93.184.216.34:443 domain=example.com",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected log\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	// Names are forgotten once expired
+	now = now.Add(maxNameTTL)
+	if name := l.names.lookup(net.ParseIP("10.0.0.5"), net.ParseIP("203.0.113.9")); name != "" {
+		t.Errorf("Expected the name to expire, got %q", name)
+	}
+}
+
+// fakeOwners attributes every connection to a process
+type fakeOwners struct{ process *Process }
+
+func (o fakeOwners) ownerOf(entry Entry) *Process { return o.process }
+func (o fakeOwners) Close() error                 { return nil }
+
+func TestAttributeOffReceivePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.log")
+	l, err := New(Config{File: path, Processes: true})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer l.file.Close()
+	l.owners = fakeOwners{&Process{PID: 97, Name: "chronyd", Cgroup: "/system.slice/chronyd.service"}}
+	l.pending = make(chan Entry, 1)
+
+	// The first waits for its process; the queue is full for the second
+	l.handle(nflogPacket{prefix: "allow ntp", payload: ipv4Packet(17, "10.0.0.1", "162.159.200.1", 123, 123)})
+	l.handle(nflogPacket{prefix: "deny", payload: ipv4Packet(6, "10.0.0.1", "203.0.113.9", 51234, 443)})
+	close(l.pending)
+	l.attribute()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Strip the time
+		got = append(got, line[strings.Index(line, " ")+1:])
+	}
+	want := []string{
+		"deny proto=tcp src=10.0.0.1:51234 dst=203.0.113.9:443",
+		"allow rule=ntp proto=udp src=10.0.0.1:123 dst=162.159.200.1:123 pid=97 comm=chronyd cgroup=/system.slice/chronyd.service",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected log\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
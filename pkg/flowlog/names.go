@@ -0,0 +1,122 @@
+package flowlog
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Names are kept at least this long, as clients connect a while after
+	// looking up short-lived answers
+	minNameTTL = 5 * time.Minute
+	maxNameTTL = time.Hour
+	// Addresses remembered per client, and clients remembered
+	maxClientNames = 1024
+	maxClients     = 4096
+)
+
+// clientNames maps the addresses in the DNS answers clients received to
+// the names they looked up
+type clientNames struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]map[string]clientName // Client -> address -> name
+}
+
+type clientName struct {
+	name      string
+	expiresAt time.Time
+}
+
+func newClientNames() *clientNames {
+	return &clientNames{
+		now:     time.Now,
+		clients: make(map[string]map[string]clientName),
+	}
+}
+
+// learn records the addresses of a DNS answer sent to client; other
+// messages are ignored
+func (c *clientNames) learn(client net.IP, answer []byte) {
+	var msg dns.Msg
+	if err := msg.Unpack(answer); err != nil {
+		return
+	}
+	c.learnMsg(client, &msg)
+}
+
+// learnMsg records the addresses of a DNS response sent to client
+func (c *clientNames) learnMsg(client net.IP, msg *dns.Msg) {
+	if !msg.Response || len(msg.Question) == 0 {
+		return
+	}
+	// The name asked for, rather than the end of a CNAME chain, is what
+	// the client connects to
+	name := strings.ToLower(strings.TrimSuffix(msg.Question[0].Name, "."))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	names := c.clients[client.String()]
+	if names == nil {
+		if len(c.clients) >= maxClients {
+			c.clients = make(map[string]map[string]clientName)
+		}
+		names = make(map[string]clientName)
+		c.clients[client.String()] = names
+	}
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if ttl < minNameTTL {
+			ttl = minNameTTL
+		} else if ttl > maxNameTTL {
+			ttl = maxNameTTL
+		}
+		if len(names) >= maxClientNames {
+			pruneNames(names, now)
+		}
+		names[ip.String()] = clientName{name: name, expiresAt: now.Add(ttl)}
+	}
+}
+
+// lookup returns the name client last looked up address under, "" if it
+// looked up none recently
+func (c *clientNames) lookup(client, address net.IP) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.clients[client.String()][address.String()]
+	if !ok || c.now().After(entry.expiresAt) {
+		return ""
+	}
+	return entry.name
+}
+
+// pruneNames forgets expired names, or all if none expired
+func pruneNames(names map[string]clientName, now time.Time) {
+	for address, entry := range names {
+		if now.After(entry.expiresAt) {
+			delete(names, address)
+		}
+	}
+	if len(names) >= maxClientNames {
+		for address := range names {
+			delete(names, address)
+		}
+	}
+}
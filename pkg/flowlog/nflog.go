@@ -0,0 +1,226 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// NFLOG message types and attributes, from linux/netfilter/nfnetlink_log.h
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind = 1
+	nfulnlCopyPacket = 2
+
+	nfulaIfindexIndev = 4
+	nfulaPayload      = 9
+	nfulaPrefix       = 10
+
+	// Enough of each packet for the headers, and of DNS answers for the
+	// question and addresses
+	copyRange = 2048
+)
+
+// nflogPacket is a packet received from an NFLOG group
+type nflogPacket struct {
+	prefix  string
+	inDev   uint32
+	payload []byte
+}
+
+// nflogGroup receives the packets the ruleset logs to a group
+type nflogGroup struct {
+	conn *netlink.Conn
+}
+
+// openGroup binds to an NFLOG group, copying the start of each packet
+func openGroup(group uint16, netns int) (*nflogGroup, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: netns})
+	if err != nil {
+		return nil, err
+	}
+	g := &nflogGroup{conn: conn}
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, copyRange)
+	mode[4] = nfulnlCopyPacket
+	for _, attr := range []netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}},
+		{Type: nfulaCfgMode, Data: mode},
+	} {
+		if err := g.configure(group, attr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// configure sends a config message for group
+func (g *nflogGroup) configure(group uint16, attr netlink.Attribute) error {
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+	if err != nil {
+		return err
+	}
+	_, err = g.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenHeader(group), attrs...),
+	})
+	return err
+}
+
+// nfgenHeader returns the netfilter header of messages for group
+func nfgenHeader(group uint16) []byte {
+	header := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], group)
+	return header
+}
+
+// Receive waits for logged packets
+func (g *nflogGroup) Receive() ([]nflogPacket, error) {
+	msgs, err := g.conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	var packets []nflogPacket
+	for _, msg := range msgs {
+		if msg.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket) {
+			continue
+		}
+		p, err := parsePacketMessage(msg.Data)
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// Close unbinds from the group
+func (g *nflogGroup) Close() error {
+	return g.conn.Close()
+}
+
+// parsePacketMessage parses the attributes of an NFLOG packet message
+func parsePacketMessage(data []byte) (nflogPacket, error) {
+	var p nflogPacket
+	if len(data) < 4 {
+		return p, fmt.Errorf("short nflog message")
+	}
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return p, fmt.Errorf("failed to decode nflog message: %w", err)
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPrefix:
+			p.prefix = strings.TrimRight(string(ad.Bytes()), "\x00")
+		case nfulaIfindexIndev:
+			p.inDev = ad.Uint32()
+		case nfulaPayload:
+			p.payload = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return p, fmt.Errorf("failed to decode nflog message: %w", err)
+	}
+	return p, nil
+}
+
+// parseEntry builds the entry of a logged packet from its network and
+// transport headers
+func parseEntry(p nflogPacket) (Entry, error) {
+	entry := Entry{}
+	proto, src, dst, transport, err := parseIP(p.payload)
+	if err != nil {
+		return entry, err
+	}
+	entry.Source, entry.Destination = src, dst
+
+	switch proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP:
+		entry.Protocol = "tcp"
+		if proto == unix.IPPROTO_UDP {
+			entry.Protocol = "udp"
+		}
+		if len(transport) < 4 {
+			return entry, fmt.Errorf("short %s header", entry.Protocol)
+		}
+		entry.SourcePort = binary.BigEndian.Uint16(transport[0:2])
+		entry.Port = binary.BigEndian.Uint16(transport[2:4])
+	case unix.IPPROTO_ICMP:
+		entry.Protocol = "icmp"
+	case unix.IPPROTO_ICMPV6:
+		entry.Protocol = "icmpv6"
+	default:
+		entry.Protocol = fmt.Sprint(proto)
+	}
+	return entry, nil
+}
+
+// parseDNSAnswer returns the client a logged DNS answer is sent to and the
+// DNS message
+func parseDNSAnswer(p nflogPacket) (net.IP, []byte, error) {
+	proto, _, dst, transport, err := parseIP(p.payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proto != unix.IPPROTO_UDP || len(transport) < 8 {
+		return nil, nil, fmt.Errorf("not a UDP packet")
+	}
+	return dst, transport[8:], nil
+}
+
+// parseIP parses the network header of a packet, returning the transport
+// protocol, the addresses and the rest of the packet, which may be cut short
+// of the copy range
+func parseIP(data []byte) (proto uint8, src, dst net.IP, transport []byte, err error) {
+	if len(data) < 1 {
+		return 0, nil, nil, nil, fmt.Errorf("empty packet")
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return 0, nil, nil, nil, fmt.Errorf("short IPv4 header")
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return 0, nil, nil, nil, fmt.Errorf("malformed IPv4 header")
+		}
+		transport = data[ihl:]
+		if total := int(binary.BigEndian.Uint16(data[2:4])); total >= ihl && total < len(data) {
+			transport = data[ihl:total]
+		}
+		src = net.IP(append([]byte(nil), data[12:16]...))
+		dst = net.IP(append([]byte(nil), data[16:20]...))
+		return data[9], src, dst, transport, nil
+	case 6:
+		if len(data) < 40 {
+			return 0, nil, nil, nil, fmt.Errorf("short IPv6 header")
+		}
+		transport = data[40:]
+		if length := int(binary.BigEndian.Uint16(data[4:6])); length < len(transport) {
+			transport = transport[:length]
+		}
+		// Extension headers are not followed
+		src = net.IP(append([]byte(nil), data[8:24]...))
+		dst = net.IP(append([]byte(nil), data[24:40]...))
+		return data[6], src, dst, transport, nil
+	default:
+		return 0, nil, nil, nil, fmt.Errorf("unknown IP version %d", data[0]>>4)
+	}
+}
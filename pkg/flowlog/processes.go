@@ -0,0 +1,152 @@
+package flowlog
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// procRoot is where procfs is mounted
+var procRoot = "/proc"
+
+// Process is the owner of a connection's socket on the router host
+type Process struct {
+	PID  int
+	Name string // Command name, as in /proc/<pid>/comm
+	// Cgroup is the unified hierarchy path, e.g.
+	// /system.slice/chronyd.service; "" if unknown
+	Cgroup string
+}
+
+// owners attributes connections to the processes owning their sockets.
+// Lookups may block, so they are made off the NFLOG receive path.
+type owners interface {
+	// ownerOf returns the process owning the socket of the connection of
+	// entry, nil if unknown
+	ownerOf(entry Entry) *Process
+	Close() error
+}
+
+// openOwners attributes connections with eBPF programs recording the owner
+// of each socket as it connects, or else by looking their sockets up once
+// they are logged; nil if neither is available
+func openOwners() owners {
+	b, err := openBPFOwners()
+	if err == nil {
+		log.Printf("Attributing connections to processes with eBPF")
+		return b
+	}
+	log.Printf("Warning: failed to load the eBPF programs attributing connections to processes, looking up their sockets instead: %v", err)
+	p, err := openProcOwners()
+	if err != nil {
+		log.Printf("Warning: failed to attribute connections to processes: %v", err)
+		return nil
+	}
+	return p
+}
+
+// procOwners attributes connections by finding their sockets' inodes with
+// NETLINK_SOCK_DIAG and the processes holding them in an index of the
+// descriptors in /proc. Sockets closed before the lookup are left
+// unattributed.
+type procOwners struct {
+	diag    *sockDiag
+	inodes  map[uint32]int // Socket inode -> pid
+	scanned time.Time
+}
+
+// openProcOwners opens the NETLINK_SOCK_DIAG socket procOwners looks up
+// sockets with
+func openProcOwners() (*procOwners, error) {
+	diag, err := openSockDiag()
+	if err != nil {
+		return nil, err
+	}
+	return &procOwners{diag: diag}, nil
+}
+
+// Close closes the NETLINK_SOCK_DIAG socket
+func (o *procOwners) Close() error {
+	return o.diag.Close()
+}
+
+func (o *procOwners) ownerOf(entry Entry) *Process {
+	sock, ok := o.diag.find(entry)
+	if !ok {
+		return nil
+	}
+	return o.inodeOwner(sock.inode, entry.Time)
+}
+
+// inodeOwner returns the process holding a descriptor of the socket with
+// inode, nil if none does. The index is rebuilt if it has no such socket
+// and was built before the connection was logged, so a backlog of
+// connections is looked up with a single scan of /proc.
+func (o *procOwners) inodeOwner(inode uint32, logged time.Time) *Process {
+	pid, ok := o.inodes[inode]
+	if !ok && o.scanned.Before(logged) {
+		o.inodes, o.scanned = socketInodes(), time.Now()
+		pid, ok = o.inodes[inode]
+	}
+	if !ok {
+		return nil
+	}
+	return processOf(pid)
+}
+
+// socketInodes returns the processes holding a descriptor of each socket,
+// by its inode
+func socketInodes() map[uint32]int {
+	inodes := make(map[uint32]int)
+	dirs, err := os.ReadDir(procRoot)
+	if err != nil {
+		return inodes
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, dir.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			inode, ok := strings.CutPrefix(link, "socket:[")
+			if !ok {
+				continue
+			}
+			if n, err := strconv.ParseUint(strings.TrimSuffix(inode, "]"), 10, 32); err == nil {
+				inodes[uint32(n)] = pid
+			}
+		}
+	}
+	return inodes
+}
+
+// processOf returns the name and cgroup of the process with pid
+func processOf(pid int) *Process {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	p := &Process{PID: pid}
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		p.Name = strings.TrimSpace(string(comm))
+	}
+	if cgroups, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		for _, line := range strings.Split(string(cgroups), "\n") {
+			// The unified hierarchy is 0::<path>
+			if path, ok := strings.CutPrefix(line, "0::"); ok {
+				p.Cgroup = path
+				break
+			}
+		}
+	}
+	return p
+}
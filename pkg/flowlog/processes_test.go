@@ -0,0 +1,107 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// addProcess adds a process holding a socket with inode to a fake procfs
+func addProcess(t *testing.T, root, pid, comm, cgroup, inode string) {
+	fd := filepath.Join(root, pid, "fd")
+	if err := os.MkdirAll(fd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dev/null", filepath.Join(fd, "0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:["+inode+"]", filepath.Join(fd, "3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, pid, "comm"), []byte(comm+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, pid, "cgroup"), []byte(cgroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInodeOwner(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = t.TempDir()
+	addProcess(t, procRoot, "812", "curl", "0::/user.slice/session-3.scope\n", "4242")
+	addProcess(t, procRoot, "97", "chronyd", "12:pids:/system.slice\n0::/system.slice/chronyd.service\n", "4343")
+
+	o := &procOwners{}
+	now := time.Now()
+	testCases := []struct {
+		name  string
+		inode uint32
+		at    time.Duration // When the connection is logged, after now
+		open  bool          // Whether a process opens the socket first
+		want  *Process
+	}{
+		{name: "tcp", inode: 4242, want: &Process{PID: 812, Name: "curl", Cgroup: "/user.slice/session-3.scope"}},
+		{name: "udp", inode: 4343, want: &Process{PID: 97, Name: "chronyd", Cgroup: "/system.slice/chronyd.service"}},
+		// Opened since the index was built, but logged before
+		{name: "new socket logged before", inode: 4444, at: -time.Minute, open: true},
+		{name: "new socket", inode: 4444, at: time.Minute, want: &Process{PID: 1033, Name: "ntpdate"}},
+		{name: "unknown", inode: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.open {
+				addProcess(t, procRoot, "1033", "ntpdate", "", "4444")
+			}
+			got := o.inodeOwner(tc.inode, now.Add(tc.at))
+			if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+				t.Errorf("Expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDiagRequest(t *testing.T) {
+	entry := Entry{Source: net.ParseIP("10.0.0.5"), SourcePort: 40000,
+		Destination: net.ParseIP("162.159.200.1"), Port: 123}
+
+	testCases := []struct {
+		name         string
+		protocol     uint8
+		family       uint8
+		source, dest net.IP
+		sport, dport uint16
+	}{
+		{name: "tcp", protocol: unix.IPPROTO_TCP, family: unix.AF_INET,
+			source: entry.Source.To4(), dest: entry.Destination.To4(), sport: 40000, dport: 123},
+		// The UDP socket receives from the destination
+		{name: "udp", protocol: unix.IPPROTO_UDP, family: unix.AF_INET,
+			source: entry.Destination.To4(), dest: entry.Source.To4(), sport: 123, dport: 40000},
+		{name: "udp as ipv6", protocol: unix.IPPROTO_UDP, family: unix.AF_INET6,
+			source: entry.Destination.To16(), dest: entry.Source.To16(), sport: 123, dport: 40000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := diagRequest(entry, tc.family, tc.protocol)
+			if len(b) != inetDiagReqLen || b[0] != tc.family || b[1] != tc.protocol {
+				t.Fatalf("Expected a request for family %d protocol %d, got %x", tc.family, tc.protocol, b)
+			}
+			if sport, dport := binary.BigEndian.Uint16(b[8:]), binary.BigEndian.Uint16(b[10:]); sport != tc.sport || dport != tc.dport {
+				t.Errorf("Expected ports %d %d, got %d %d", tc.sport, tc.dport, sport, dport)
+			}
+			if src := b[12 : 12+len(tc.source)]; !net.IP(src).Equal(tc.source) {
+				t.Errorf("Expected source %s, got %s", tc.source, net.IP(src))
+			}
+			if dst := b[28 : 28+len(tc.dest)]; !net.IP(dst).Equal(tc.dest) {
+				t.Errorf("Expected destination %s, got %s", tc.dest, net.IP(dst))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Sizes and fields of inet_diag_req_v2 and inet_diag_msg, from
+// linux/inet_diag.h
+const (
+	sockDiagByFamily = 20
+
+	inetDiagReqLen   = 56
+	inetDiagMsgLen   = 72
+	inetDiagCookie   = 44
+	inetDiagInode    = 68
+	inetDiagNoCookie = 0xffffffff
+)
+
+// diagSocket is a socket found with NETLINK_SOCK_DIAG
+type diagSocket struct {
+	inode  uint32
+	cookie uint64 // As returned by bpf_get_socket_cookie
+}
+
+// sockDiag looks up the sockets of connections by their addresses
+type sockDiag struct {
+	conn *netlink.Conn
+}
+
+// openSockDiag opens a NETLINK_SOCK_DIAG socket in the router's network
+// namespace
+func openSockDiag() (*sockDiag, error) {
+	conn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sockDiag{conn: conn}, nil
+}
+
+// Close closes the netlink socket
+func (d *sockDiag) Close() error {
+	return d.conn.Close()
+}
+
+// find returns the socket of the connection of entry, false if it is not
+// a TCP or UDP socket of the host or closed by now. An IPv4 connection is
+// looked up among IPv6 sockets too, which the kernel may report it as.
+func (d *sockDiag) find(entry Entry) (diagSocket, bool) {
+	var protocol uint8
+	switch entry.Protocol {
+	case "tcp":
+		protocol = unix.IPPROTO_TCP
+	case "udp":
+		protocol = unix.IPPROTO_UDP
+	default:
+		return diagSocket{}, false
+	}
+	families := []uint8{unix.AF_INET6}
+	if entry.Source.To4() != nil && entry.Destination.To4() != nil {
+		families = []uint8{unix.AF_INET, unix.AF_INET6}
+	}
+	for _, family := range families {
+		msgs, err := d.conn.Execute(netlink.Message{
+			Header: netlink.Header{Type: sockDiagByFamily, Flags: netlink.Request},
+			Data:   diagRequest(entry, family, protocol),
+		})
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if len(msg.Data) >= inetDiagMsgLen {
+				return parseDiagSocket(msg.Data), true
+			}
+		}
+	}
+	return diagSocket{}, false
+}
+
+// diagRequest encodes an inet_diag_req_v2 for the socket of the connection
+// of entry. TCP looks the socket up by its local address as the source,
+// but UDP as the receiver of a datagram from the remote address, which
+// also finds unconnected sockets.
+func diagRequest(entry Entry, family, protocol uint8) []byte {
+	local, remote := entry.Source, entry.Destination
+	localPort, remotePort := entry.SourcePort, entry.Port
+	if protocol == unix.IPPROTO_UDP {
+		local, remote = remote, local
+		localPort, remotePort = remotePort, localPort
+	}
+	b := make([]byte, inetDiagReqLen)
+	b[0], b[1] = family, protocol
+	binary.NativeEndian.PutUint32(b[4:], 0xffffffff) // All states
+	binary.BigEndian.PutUint16(b[8:], localPort)
+	binary.BigEndian.PutUint16(b[10:], remotePort)
+	copy(b[12:28], diagAddress(local, family))
+	copy(b[28:44], diagAddress(remote, family))
+	binary.NativeEndian.PutUint32(b[48:], inetDiagNoCookie)
+	binary.NativeEndian.PutUint32(b[52:], inetDiagNoCookie)
+	return b
+}
+
+// diagAddress returns ip as the address of a socket of family
+func diagAddress(ip net.IP, family uint8) net.IP {
+	if family == unix.AF_INET {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// parseDiagSocket parses the inode and cookie of an inet_diag_msg
+func parseDiagSocket(b []byte) diagSocket {
+	// The cookie is two 32-bit words, the low one first
+	cookie := uint64(binary.NativeEndian.Uint32(b[inetDiagCookie:])) |
+		uint64(binary.NativeEndian.Uint32(b[inetDiagCookie+4:]))<<32
+	return diagSocket{inode: binary.NativeEndian.Uint32(b[inetDiagInode:]), cookie: cookie}
+}
@@ -0,0 +1,41 @@
+package ha
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// conntrackdCommands hand the conntrack tables over on role changes, as
+// conntrackd's primary-backup.sh does:
+//
+//	active:  commit the external cache, flush the caches, resync with the
+//	         kernel and send a bulk update to the peer
+//	standby: shorten kernel timers of flows now handled by the peer and
+//	         request a resync from it
+var conntrackdCommands = map[string][][]string{
+	config.RoleActive:  {{"-c"}, {"-f"}, {"-R"}, {"-B"}},
+	config.RoleStandby: {{"-t"}, {"-n"}},
+}
+
+// runConntrackd runs conntrackd with args
+var runConntrackd = func(args ...string) error {
+	if out, err := exec.Command("conntrackd", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("conntrackd %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// handOverConntrack runs the conntrackd commands for a new role
+// Failures are logged: the filter keeps working, but established flows may
+// be reset by the failover.
+func handOverConntrack(role string) {
+	for _, args := range conntrackdCommands[role] {
+		if err := runConntrackd(args...); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package ha runs legion-router as one half of an active/standby pair.
+// keepalived handles VRRP and the virtual addresses; the node follows the
+// role it reports, replicates filter state to the standby and drives
+// conntrackd so that established flows survive a failover.
+package ha
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+const defaultSyncInterval = 5 * time.Second
+
+// Backend is the filter state replicated between the pair
+type Backend interface {
+	SyncState() filter.SyncState
+	ApplySyncState(state filter.SyncState)
+}
+
+// Node follows this router's role in the pair
+type Node struct {
+	config  *config.HAConfig
+	backend Backend
+	http    *http.Server
+	client  *http.Client
+	stop    chan struct{}
+	fifo    *os.File
+
+	mu   sync.Mutex
+	role string
+}
+
+// NewNode creates a node for backend
+func NewNode(cfg *config.HAConfig, backend Backend) *Node {
+	role := cfg.Role
+	if role == "" {
+		role = config.RoleStandby
+	}
+	n := &Node{
+		config:  cfg,
+		backend: backend,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+		role:    role,
+	}
+	if cfg.Sync != nil {
+		n.http = &http.Server{
+			Addr:              cfg.Sync.Listen,
+			Handler:           n.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+	return n
+}
+
+// Role returns the current role, active or standby
+func (n *Node) Role() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+// Start begins following keepalived and replicating state
+func (n *Node) Start() error {
+	if n.config.NotifyFIFO != "" {
+		fifo, err := openFIFO(n.config.NotifyFIFO)
+		if err != nil {
+			return err
+		}
+		n.fifo = fifo
+		go n.watchNotifications(fifo)
+	}
+
+	if n.http != nil {
+		listener, err := net.Listen("tcp", n.config.Sync.Listen)
+		if err != nil {
+			n.closeFIFO()
+			return fmt.Errorf("failed to listen on %s: %w", n.config.Sync.Listen, err)
+		}
+		go func() {
+			if err := n.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Printf("Warning: HA sync listener stopped: %v", err)
+			}
+		}()
+		go n.pushLoop()
+		log.Printf("HA state sync listening on %s, peer %s", listener.Addr(), n.config.Sync.Peer)
+	}
+
+	log.Printf("HA node starting as %s", n.Role())
+	return nil
+}
+
+// Stop stops following keepalived and replicating state
+func (n *Node) Stop() error {
+	close(n.stop)
+	n.closeFIFO()
+	if n.http == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return n.http.Shutdown(ctx)
+}
+
+// setRole switches to role, handing conntrack state over on changes
+func (n *Node) setRole(role string) {
+	n.mu.Lock()
+	previous := n.role
+	n.role = role
+	n.mu.Unlock()
+
+	if role == previous {
+		return
+	}
+	log.Printf("HA role changed from %s to %s", previous, role)
+
+	if n.config.Conntrackd {
+		handOverConntrack(role)
+	}
+	if role == config.RoleActive && n.config.Sync != nil {
+		// Bring the new standby up to date at once
+		go n.push()
+	}
+}
+
+// closeFIFO closes the notification FIFO, if open
+func (n *Node) closeFIFO() {
+	if n.fifo != nil {
+		n.fifo.Close()
+		n.fifo = nil
+	}
+}
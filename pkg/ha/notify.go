@@ -0,0 +1,70 @@
+package ha
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+// openFIFO opens keepalived's notify_fifo, creating it if needed
+// It is opened read-write so that reads block instead of reaching EOF
+// while keepalived restarts.
+func openFIFO(path string) (*os.File, error) {
+	if err := unix.Mkfifo(path, 0600); err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to create notify FIFO %s: %w", path, err)
+	}
+	fifo, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open notify FIFO %s: %w", path, err)
+	}
+	return fifo, nil
+}
+
+// watchNotifications applies the role changes keepalived writes to fifo
+// until it is closed
+func (n *Node) watchNotifications(fifo *os.File) {
+	scanner := bufio.NewScanner(fifo)
+	for scanner.Scan() {
+		role, ok := parseNotify(scanner.Text(), n.config.Instance)
+		if ok {
+			n.setRole(role)
+		}
+	}
+}
+
+// parseNotify parses a notify_fifo line such as
+//
+//	INSTANCE "VI_1" MASTER 100
+//
+// into a role, if it concerns instance (or any instance if empty). FAULT and
+// STOP make the router a standby, as it no longer holds the addresses.
+func parseNotify(line, instance string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return "", false
+	}
+	switch fields[0] {
+	case "INSTANCE", "GROUP":
+	default:
+		return "", false
+	}
+	if name := strings.Trim(fields[1], `"`); instance != "" && name != instance {
+		return "", false
+	}
+
+	switch fields[2] {
+	case "MASTER":
+		return config.RoleActive, true
+	case "BACKUP", "FAULT", "STOP":
+		return config.RoleStandby, true
+	default:
+		log.Printf("Warning: ignoring keepalived state %s", fields[2])
+		return "", false
+	}
+}
@@ -0,0 +1,36 @@
+package ha
+
+import (
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestParseNotify tests mapping keepalived notifications to roles
+func TestParseNotify(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		instance string
+		wantRole string
+		wantOK   bool
+	}{
+		{name: "master", line: `INSTANCE "VI_1" MASTER 100`, wantRole: config.RoleActive, wantOK: true},
+		{name: "backup", line: `INSTANCE "VI_1" BACKUP 50`, wantRole: config.RoleStandby, wantOK: true},
+		{name: "fault", line: `INSTANCE "VI_1" FAULT 0`, wantRole: config.RoleStandby, wantOK: true},
+		{name: "sync group", line: `GROUP "G1" MASTER 0`, instance: "G1", wantRole: config.RoleActive, wantOK: true},
+		{name: "other instance", line: `INSTANCE "VI_2" MASTER 100`, instance: "VI_1"},
+		{name: "unknown state", line: `INSTANCE "VI_1" DELETED 0`},
+		{name: "not an instance", line: `VS "10.0.0.1:80" UP`},
+		{name: "short line", line: `INSTANCE`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			role, ok := parseNotify(tc.line, tc.instance)
+			if role != tc.wantRole || ok != tc.wantOK {
+				t.Errorf("parseNotify() = %q, %v, want %q, %v", role, ok, tc.wantRole, tc.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package ha
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// Handler returns the HTTP handler receiving state from the active router
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/state", n.handleState)
+	return mux
+}
+
+func (n *Node) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	expected := []byte("Bearer " + n.config.Sync.Key)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+		http.Error(w, "invalid or missing key", http.StatusUnauthorized)
+		return
+	}
+	// Both routers believing they are active must not overwrite each other
+	if n.Role() == config.RoleActive {
+		http.Error(w, "this router is active", http.StatusConflict)
+		return
+	}
+
+	var state filter.SyncState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, fmt.Sprintf("invalid state: %v", err), http.StatusBadRequest)
+		return
+	}
+	n.backend.ApplySyncState(state)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pushLoop pushes state to the peer while this router is active
+func (n *Node) pushLoop() {
+	interval := n.config.Sync.Interval.Std()
+	if interval == 0 {
+		interval = defaultSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			if n.Role() == config.RoleActive {
+				n.push()
+			}
+		}
+	}
+}
+
+// push sends the current state to the peer
+func (n *Node) push() {
+	if err := n.send(n.backend.SyncState()); err != nil {
+		log.Printf("Warning: failed to sync state to %s: %v", n.config.Sync.Peer, err)
+	}
+}
+
+// send sends state to the peer
+func (n *Node) send(state filter.SyncState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPut, "http://"+n.config.Sync.Peer+"/v1/state", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+n.config.Sync.Key)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach peer: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package ha
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// fakeBackend records the state it is given
+type fakeBackend struct {
+	state   filter.SyncState
+	applied []filter.SyncState
+}
+
+func (b *fakeBackend) SyncState() filter.SyncState {
+	return b.state
+}
+
+func (b *fakeBackend) ApplySyncState(state filter.SyncState) {
+	b.applied = append(b.applied, state)
+}
+
+// TestSync tests that the active router's state reaches a standby with the
+// right key, and never an active router
+func TestSync(t *testing.T) {
+	testCases := []struct {
+		name      string
+		peerRole  string
+		key       string
+		wantErr   bool
+		wantState bool
+	}{
+		{name: "standby", peerRole: config.RoleStandby, key: "secret", wantState: true},
+		{name: "wrong key", peerRole: config.RoleStandby, key: "guess", wantErr: true},
+		{name: "active peer", peerRole: config.RoleActive, key: "secret", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			peerBackend := &fakeBackend{}
+			peer := NewNode(&config.HAConfig{
+				Role: tc.peerRole,
+				Sync: &config.HASyncConfig{Listen: "127.0.0.1:0", Peer: "127.0.0.1:0", Key: "secret"},
+			}, peerBackend)
+			ts := httptest.NewServer(peer.Handler())
+			defer ts.Close()
+
+			active := NewNode(&config.HAConfig{
+				Role: config.RoleActive,
+				Sync: &config.HASyncConfig{Listen: "127.0.0.1:0", Peer: strings.TrimPrefix(ts.URL, "http://"), Key: tc.key},
+			}, &fakeBackend{})
+
+			state := filter.SyncState{
+				Addresses: map[string][]string{"allow-registry": {"192.0.2.10"}},
+				Grants:    []filter.Grant{{Destination: "203.0.113.10", Port: 22, Expires: time.Now().Add(time.Hour)}},
+			}
+			err := active.send(state)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("send() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got := len(peerBackend.applied) == 1; got != tc.wantState {
+				t.Fatalf("Expected state applied: %v, got %d updates", tc.wantState, len(peerBackend.applied))
+			}
+			if tc.wantState && peerBackend.applied[0].Addresses["allow-registry"][0] != "192.0.2.10" {
+				t.Errorf("Unexpected state: %+v", peerBackend.applied[0])
+			}
+		})
+	}
+}
+
+// TestRoleChange tests that conntrackd takes over the flows on failover
+func TestRoleChange(t *testing.T) {
+	var calls []string
+	runConntrackd = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+
+	node := NewNode(&config.HAConfig{Conntrackd: true}, &fakeBackend{})
+	node.setRole(config.RoleStandby)
+	if len(calls) != 0 {
+		t.Errorf("Expected no commands without a role change, got %v", calls)
+	}
+
+	node.setRole(config.RoleActive)
+	if strings.Join(calls, ",") != "-c,-f,-R,-B" {
+		t.Errorf("Unexpected conntrackd commands: %v", calls)
+	}
+	if node.Role() != config.RoleActive {
+		t.Errorf("Expected active role, got %s", node.Role())
+	}
+}
@@ -0,0 +1,125 @@
+// Package honeypot accepts the connections to denied targets redirected to
+// it and records what the clients send, so that an attempt to reach, e.g.,
+// the metadata service can be investigated instead of silently dropped.
+package honeypot
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/network"
+)
+
+// readTimeout bounds how long a client may take to send its request
+const readTimeout = 10 * time.Second
+
+// Capture is what a client sent to a redirected connection
+type Capture struct {
+	Time   time.Time
+	Source *net.TCPAddr
+	// Destination is the target the client connected to, nil if the
+	// connection was not redirected
+	Destination *net.TCPAddr
+	Request     []byte
+	// Truncated tells whether the client sent more than was recorded
+	Truncated bool
+	// HTTP tells whether the request parsed as HTTP, and was answered
+	HTTP bool
+}
+
+// Recorder records the captures
+type Recorder interface {
+	Captured(c Capture)
+}
+
+// Server is the listener of the honeypot
+type Server struct {
+	port     uint16
+	maxBytes int
+	recorder Recorder
+
+	listener net.Listener
+	conns    sync.WaitGroup
+}
+
+// NewServer creates a honeypot listening on port, recording up to maxBytes
+// of each connection to recorder
+func NewServer(port uint16, maxBytes int, recorder Recorder) *Server {
+	return &Server{port: port, maxBytes: maxBytes, recorder: recorder}
+}
+
+// Start listens on the port on every address and accepts in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	s.listener = listener
+	go s.accept()
+	log.Printf("Honeypot listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop closes the listener and waits for the open connections to be
+// recorded
+func (s *Server) Stop() error {
+	err := s.listener.Close()
+	s.conns.Wait()
+	return err
+}
+
+// accept serves the connections until the listener is closed
+func (s *Server) accept() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Warning: honeypot stopped: %v", err)
+			}
+			return
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.serve(c)
+		}()
+	}
+}
+
+// serve records what the client sends until it stops, the read times out
+// or maxBytes is reached. An HTTP request is answered with a 404, so that
+// the client doesn't retry.
+func (s *Server) serve(c net.Conn) {
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(readTimeout)); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	capture := Capture{Time: time.Now(), Destination: network.OriginalDestination(c)}
+	capture.Source, _ = c.RemoteAddr().(*net.TCPAddr)
+
+	// One byte beyond maxBytes tells that the request was truncated
+	var request bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(io.LimitReader(c, int64(s.maxBytes)+1), &request))
+	if req, err := http.ReadRequest(r); err == nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+		capture.HTTP = true
+		_, _ = io.WriteString(c, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	} else {
+		_, _ = io.Copy(io.Discard, r)
+	}
+
+	capture.Request = request.Bytes()
+	if len(capture.Request) > s.maxBytes {
+		capture.Request, capture.Truncated = capture.Request[:s.maxBytes], true
+	}
+	s.recorder.Captured(capture)
+}
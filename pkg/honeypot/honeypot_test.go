@@ -0,0 +1,109 @@
+package honeypot
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRecorder keeps the captures
+type fakeRecorder struct {
+	mu       sync.Mutex
+	captures []Capture
+}
+
+func (r *fakeRecorder) Captured(c Capture) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.captures = append(r.captures, c)
+}
+
+// TestServer tests that what a client sends is recorded, and HTTP answered
+func TestServer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		maxBytes      int
+		request       string
+		wantRequest   string
+		wantHTTP      bool
+		wantTruncated bool
+	}{
+		{
+			name:        "HTTP request",
+			request:     "GET /latest/meta-data/iam/security-credentials/ HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n",
+			wantRequest: "GET /latest/meta-data/iam/security-credentials/ HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n",
+			wantHTTP:    true,
+		},
+		{
+			name:        "HTTP request with a body",
+			request:     "PUT /latest/api/token HTTP/1.1\r\nHost: 169.254.169.254\r\nContent-Length: 4\r\n\r\nttl=",
+			wantRequest: "PUT /latest/api/token HTTP/1.1\r\nHost: 169.254.169.254\r\nContent-Length: 4\r\n\r\nttl=",
+			wantHTTP:    true,
+		},
+		{
+			name:        "not HTTP",
+			request:     "\x16\x03\x01\x00\x05hello",
+			wantRequest: "\x16\x03\x01\x00\x05hello",
+		},
+		{
+			name:          "truncated",
+			maxBytes:      64,
+			request:       strings.Repeat("x", 100),
+			wantRequest:   strings.Repeat("x", 64),
+			wantTruncated: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &fakeRecorder{}
+			maxBytes := tc.maxBytes
+			if maxBytes == 0 {
+				maxBytes = 1024
+			}
+			s := NewServer(0, maxBytes, recorder)
+			if err := s.Start(); err != nil {
+				t.Fatalf("Failed to start: %v", err)
+			}
+
+			c, err := net.Dial("tcp", s.listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			if _, err := io.WriteString(c, tc.request); err != nil {
+				t.Fatalf("Failed to send: %v", err)
+			}
+			if !tc.wantHTTP {
+				c.(*net.TCPConn).CloseWrite()
+			}
+			answer, _ := io.ReadAll(c)
+			c.Close()
+			if err := s.Stop(); err != nil {
+				t.Fatalf("Failed to stop: %v", err)
+			}
+
+			if len(recorder.captures) != 1 {
+				t.Fatalf("Expected 1 capture, got %d", len(recorder.captures))
+			}
+			capture := recorder.captures[0]
+			if string(capture.Request) != tc.wantRequest {
+				t.Errorf("Expected request %q, got %q", tc.wantRequest, capture.Request)
+			}
+			if capture.HTTP != tc.wantHTTP || capture.Truncated != tc.wantTruncated {
+				t.Errorf("Expected HTTP %v truncated %v, got %v %v", tc.wantHTTP, tc.wantTruncated, capture.HTTP, capture.Truncated)
+			}
+			if capture.Source == nil || !capture.Source.IP.IsLoopback() {
+				t.Errorf("Expected a loopback source, got %v", capture.Source)
+			}
+			// A direct connection was not redirected
+			if capture.Destination != nil {
+				t.Errorf("Expected no original destination, got %v", capture.Destination)
+			}
+			if tc.wantHTTP && !strings.HasPrefix(string(answer), "HTTP/1.1 404 ") {
+				t.Errorf("Expected a 404, got %q", answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package inspect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	recordHeaderLen          = 5
+
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extPointFormats        = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// ErrIncomplete is returned when more data is needed to parse a message
+var ErrIncomplete = errors.New("incomplete TLS message")
+
+// ClientHello holds the fields of a TLS ClientHello used for policy and
+// fingerprinting
+type ClientHello struct {
+	Version             uint16   // Legacy version field
+	SNI                 string   // Server name, empty if absent
+	CipherSuites        []uint16 // In offered order
+	Extensions          []uint16 // Extension types in offered order
+	Groups              []uint16 // Supported groups (elliptic curves)
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	ALPN                []string
+	SupportedVersions   []uint16
+}
+
+// RecordLength returns the total length of the TLS record starting at data,
+// or ErrIncomplete if the header has not been seen yet
+func RecordLength(data []byte) (int, error) {
+	if len(data) < recordHeaderLen {
+		return 0, ErrIncomplete
+	}
+	if data[0] != recordTypeHandshake {
+		return 0, fmt.Errorf("not a handshake record: type %d", data[0])
+	}
+	return recordHeaderLen + int(binary.BigEndian.Uint16(data[3:5])), nil
+}
+
+// ParseClientHello parses a ClientHello from the start of a TLS record
+// stream. A ClientHello spanning several records is not supported.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	length, err := RecordLength(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < length {
+		return nil, ErrIncomplete
+	}
+	return ParseHandshake(data[recordHeaderLen:length])
+}
+
+// ParseHandshake parses a ClientHello handshake message without the record
+// layer, as carried in QUIC CRYPTO frames
+func ParseHandshake(msg []byte) (*ClientHello, error) {
+	r := reader(msg)
+	msgType, ok := r.u8()
+	if !ok {
+		return nil, ErrIncomplete
+	}
+	if msgType != handshakeTypeClientHello {
+		return nil, fmt.Errorf("not a ClientHello: handshake type %d", msgType)
+	}
+	body, ok := r.vec(3)
+	if !ok {
+		return nil, ErrIncomplete
+	}
+
+	hello := &ClientHello{}
+	b := reader(body)
+	if hello.Version, ok = b.u16(); !ok {
+		return nil, errMalformed("version")
+	}
+	if !b.skip(32) { // random
+		return nil, errMalformed("random")
+	}
+	if _, ok = b.vec(1); !ok { // session id
+		return nil, errMalformed("session id")
+	}
+	ciphers, ok := b.vec(2)
+	if !ok {
+		return nil, errMalformed("cipher suites")
+	}
+	hello.CipherSuites = readU16s(ciphers)
+	if _, ok = b.vec(1); !ok { // compression methods
+		return nil, errMalformed("compression methods")
+	}
+	if len(b) == 0 {
+		return hello, nil
+	}
+
+	exts, ok := b.vec(2)
+	if !ok {
+		return nil, errMalformed("extensions")
+	}
+	e := reader(exts)
+	for len(e) > 0 {
+		typ, ok := e.u16()
+		if !ok {
+			return nil, errMalformed("extension type")
+		}
+		data, ok := e.vec(2)
+		if !ok {
+			return nil, errMalformed("extension data")
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+		if err := hello.parseExtension(typ, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+// parseExtension decodes the extensions that policy and fingerprints use
+func (h *ClientHello) parseExtension(typ uint16, data reader) error {
+	switch typ {
+	case extServerName:
+		list, ok := data.vec(2)
+		if !ok {
+			return errMalformed("server name")
+		}
+		for len(list) > 0 {
+			nameType, ok := list.u8()
+			if !ok {
+				return errMalformed("server name")
+			}
+			name, ok := list.vec(2)
+			if !ok {
+				return errMalformed("server name")
+			}
+			if nameType == 0 && h.SNI == "" {
+				h.SNI = string(name)
+			}
+		}
+	case extSupportedGroups:
+		list, ok := data.vec(2)
+		if !ok {
+			return errMalformed("supported groups")
+		}
+		h.Groups = readU16s(list)
+	case extPointFormats:
+		list, ok := data.vec(1)
+		if !ok {
+			return errMalformed("point formats")
+		}
+		h.PointFormats = append([]uint8(nil), list...)
+	case extSignatureAlgorithms:
+		list, ok := data.vec(2)
+		if !ok {
+			return errMalformed("signature algorithms")
+		}
+		h.SignatureAlgorithms = readU16s(list)
+	case extALPN:
+		list, ok := data.vec(2)
+		if !ok {
+			return errMalformed("alpn")
+		}
+		for len(list) > 0 {
+			proto, ok := list.vec(1)
+			if !ok {
+				return errMalformed("alpn")
+			}
+			h.ALPN = append(h.ALPN, string(proto))
+		}
+	case extSupportedVersions:
+		list, ok := data.vec(1)
+		if !ok {
+			return errMalformed("supported versions")
+		}
+		h.SupportedVersions = readU16s(list)
+	}
+	return nil
+}
+
+func errMalformed(field string) error {
+	return fmt.Errorf("malformed ClientHello %s", field)
+}
+
+// reader consumes big-endian fields from a byte slice
+type reader []byte
+
+func (r *reader) u8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vec reads a vector prefixed by a lenBytes long length
+func (r *reader) vec(lenBytes int) (reader, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	if len(*r) < lenBytes+n {
+		return nil, false
+	}
+	v := (*r)[lenBytes : lenBytes+n]
+	*r = (*r)[lenBytes+n:]
+	return v, true
+}
+
+func readU16s(b []byte) []uint16 {
+	values := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		values = append(values, binary.BigEndian.Uint16(b[i:]))
+	}
+	return values
+}
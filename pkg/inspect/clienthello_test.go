@@ -0,0 +1,94 @@
+package inspect
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// captureClientHello returns the first TLS record sent by a Go client
+func captureClientHello(t *testing.T, serverName string, alpn []string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn}).Handshake()
+	}()
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+// TestParseClientHello tests parsing a ClientHello sent by crypto/tls
+func TestParseClientHello(t *testing.T) {
+	record := captureClientHello(t, "api.example.com", []string{"h2", "http/1.1"})
+
+	hello, err := ParseClientHello(record)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if hello.SNI != "api.example.com" {
+		t.Errorf("Expected SNI api.example.com, got %q", hello.SNI)
+	}
+	if strings.Join(hello.ALPN, ",") != "h2,http/1.1" {
+		t.Errorf("Expected ALPN h2,http/1.1, got %v", hello.ALPN)
+	}
+	if len(hello.CipherSuites) == 0 || len(hello.SupportedVersions) == 0 {
+		t.Errorf("Expected cipher suites and supported versions, got %+v", hello)
+	}
+
+	if _, err := ParseClientHello(record[:len(record)-1]); err != ErrIncomplete {
+		t.Errorf("Expected ErrIncomplete for truncated record, got %v", err)
+	}
+	if _, err := ParseClientHello([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Error("Expected error for non-TLS data")
+	}
+}
+
+// TestFingerprints tests JA3 and JA4 of a hand-built ClientHello
+func TestFingerprints(t *testing.T) {
+	hello := &ClientHello{
+		Version:             0x0303,
+		SNI:                 "example.com",
+		CipherSuites:        []uint16{0x1a1a, 0x1301, 0xc02b, 0x1302},
+		Extensions:          []uint16{0x2a2a, extServerName, extSupportedGroups, extPointFormats, extSignatureAlgorithms, extALPN, extSupportedVersions},
+		Groups:              []uint16{0x4a4a, 29, 23},
+		PointFormats:        []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+		ALPN:                []string{"h2"},
+		SupportedVersions:   []uint16{0x3a3a, 0x0304, 0x0303},
+	}
+
+	if got, want := hello.JA3String(), "771,4865-49195-4866,0-10-11-13-16-43,29-23,0"; got != want {
+		t.Errorf("JA3String() = %q, want %q", got, want)
+	}
+	if len(hello.JA3()) != 32 {
+		t.Errorf("Expected MD5 hex JA3, got %q", hello.JA3())
+	}
+
+	ja4 := hello.JA4(false)
+	parts := strings.Split(ja4, "_")
+	if len(parts) != 3 || parts[0] != "t13d0306h2" {
+		t.Errorf("Unexpected JA4 %q", ja4)
+	}
+	if want := truncatedHash("1301,1302,c02b"); parts[1] != want {
+		t.Errorf("JA4 cipher hash = %s, want %s", parts[1], want)
+	}
+	if want := truncatedHash("000a,000b,000d,002b_0403,0804"); parts[2] != want {
+		t.Errorf("JA4 extension hash = %s, want %s", parts[2], want)
+	}
+	if !strings.HasPrefix(hello.JA4(true), "q13d") {
+		t.Errorf("Expected QUIC JA4 prefix, got %s", hello.JA4(true))
+	}
+}
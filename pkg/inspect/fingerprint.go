@@ -0,0 +1,161 @@
+package inspect
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients
+// randomize and fingerprints ignore
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3String returns the JA3 fingerprint string of a ClientHello:
+// version,ciphers,extensions,groups,point formats
+func (h *ClientHello) JA3String() string {
+	fields := []string{
+		strconv.Itoa(int(h.Version)),
+		joinU16(h.CipherSuites, "-"),
+		joinU16(h.Extensions, "-"),
+		joinU16(h.Groups, "-"),
+	}
+	formats := make([]string, len(h.PointFormats))
+	for i, f := range h.PointFormats {
+		formats[i] = strconv.Itoa(int(f))
+	}
+	fields = append(fields, strings.Join(formats, "-"))
+	return strings.Join(fields, ",")
+}
+
+// JA3 returns the MD5 hash of the JA3 string
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello. quic selects the QUIC
+// transport marker instead of TCP.
+func (h *ClientHello) JA4(quic bool) string {
+	transport := "t"
+	if quic {
+		transport = "q"
+	}
+
+	sni := "i"
+	if h.SNI != "" {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		first := h.ALPN[0]
+		alpn = alpnChar(first[0], true) + alpnChar(first[len(first)-1], false)
+	}
+
+	a := fmt.Sprintf("%s%s%s%02d%02d%s",
+		transport, ja4Version(h), sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	// The server name and ALPN are already covered by the first part
+	var hashed []uint16
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+	extPart := hexList(sortedU16(hashed))
+	if algs := hexList(h.SignatureAlgorithms); algs != "" && extPart != "" {
+		extPart += "_" + algs
+	}
+
+	return a + "_" + truncatedHash(hexList(sortedU16(ciphers))) + "_" + truncatedHash(extPart)
+}
+
+// ja4Version returns the two character JA4 version of the highest offered
+// TLS version
+func ja4Version(h *ClientHello) string {
+	version := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// alpnChar returns an ALPN character for JA4, replacing non alphanumeric
+// bytes with a hex digit of their value
+func alpnChar(c byte, first bool) string {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return string(c)
+	}
+	h := hex.EncodeToString([]byte{c})
+	if first {
+		return h[:1]
+	}
+	return h[1:]
+}
+
+// truncatedHash returns the first 12 hex characters of the SHA-256 of s
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	result := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func sortedU16(values []uint16) []uint16 {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// joinU16 joins non-GREASE values as decimal numbers
+func joinU16(values []uint16, sep string) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range withoutGREASE(values) {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, sep)
+}
+
+// hexList joins values as 4 digit hex numbers
+func hexList(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,475 @@
+package inspect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+)
+
+const (
+	DefaultQueue = 100
+
+	flowTimeout    = 2 * time.Minute
+	pruneInterval  = 30 * time.Second
+	maxHelloLength = 16 * 1024
+	// QUIC CRYPTO frames buffered per flow before giving up on a ClientHello
+	maxCryptoFrames = 64
+)
+
+// Verdict is the decision for a queued packet
+type Verdict int
+
+const (
+	Accept Verdict = iota
+	Drop
+	// Pending holds the packet until the certificate of its server is
+	// verified; the verdict is handed over once decided
+	Pending
+)
+
+// Match is the policy decision for a server name
+type Match struct {
+	Rule  string // Name of the matching rule
+	Allow bool
+	// BlockQUIC denies QUIC to the rule's domains so that clients fall
+	// back to TCP
+	BlockQUIC bool
+}
+
+// Conn describes the connection a decision is made for
+type Conn struct {
+	Network    string // "tcp" or "udp"
+	Interface  string // Input interface, "" if unknown
+	Source     net.IP // Source address
+	SourcePort uint16
+	Address    net.IP // Destination address
+	Port       uint16 // Destination port
+}
+
+// Policy decides which server names may be reached
+type Policy interface {
+	// MatchSNI returns the first rule whose domains match name and that
+	// applies to conn
+	MatchSNI(name string, conn Conn) (Match, bool)
+	// Learn allows further traffic to address under rule
+	Learn(rule, name string, address net.IP)
+	// DecideL7 evaluates the rules from the l7 rule at index onwards for
+	// conn, classified as app ("" if unknown), and reports whether it is
+	// allowed
+	DecideL7(index int, app string, conn Conn) bool
+}
+
+// Config configures an Inspector
+type Config struct {
+	Queue uint16 // NFQUEUE number
+	// VerifyCertificates probes the server and requires a valid
+	// certificate for the server name before allowing it
+	VerifyCertificates bool
+	// Fingerprints logs JA3 and JA4 fingerprints of every ClientHello
+	Fingerprints bool
+	// NetNS is the network namespace file descriptor the queue is in, if
+	// not the router's own
+	NetNS int
+	// Names adds the names of destinations to the log lines of dropped
+	// connections, if set
+	Names Namer
+	// Connections records the connections allowed by server name, if set
+	Connections Connections
+}
+
+// Connections records the connections the inspector allows
+type Connections interface {
+	// Allowed records a connection allowed under rule for server name
+	Allowed(rule, name string, conn Conn)
+}
+
+// Namer looks up the names of addresses for logging
+type Namer interface {
+	// LookupName calls done with the name of ip, "" if it has none,
+	// possibly after returning
+	LookupName(ip net.IP, done func(name string))
+}
+
+// Inspector enforces domain rules on TLS and QUIC connections by their SNI
+type Inspector struct {
+	config   Config
+	policy   Policy
+	verifier *Verifier
+	now      func() time.Time
+
+	mu        sync.Mutex
+	flows     map[flow]*flowState
+	lastPrune time.Time
+}
+
+// flowState tracks a connection seen by the inspector
+type flowState struct {
+	hello   []byte        // ClientHello segments received so far
+	crypto  []cryptoFrame // QUIC CRYPTO frames received so far
+	allowed bool
+	// verifying holds the flow while the server's certificate is verified
+	verifying bool
+	lastSeen  time.Time
+
+	// Application protocol decision for flows queued by l7 rules
+	l7Decided bool
+	l7Verdict Verdict
+}
+
+// New creates an Inspector applying policy
+func New(config Config, policy Policy) *Inspector {
+	if config.Queue == 0 {
+		config.Queue = DefaultQueue
+	}
+	return &Inspector{
+		config:   config,
+		policy:   policy,
+		verifier: NewVerifier(nil),
+		now:      time.Now,
+		flows:    make(map[flow]*flowState),
+	}
+}
+
+// Run receives packets from the NFQUEUE until ctx is cancelled
+func (i *Inspector) Run(ctx context.Context) error {
+	nf, err := nfqueue.Open(&nfqueue.Config{
+		NfQueue:      i.config.Queue,
+		MaxPacketLen: 0xffff,
+		MaxQueueLen:  1024,
+		Copymode:     nfqueue.NfQnlCopyPacket,
+		NetNS:        i.config.NetNS,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open nfqueue %d: %w", i.config.Queue, err)
+	}
+	defer nf.Close()
+
+	hook := func(a nfqueue.Attribute) int {
+		if a.PacketID == nil || a.Payload == nil {
+			return 0
+		}
+		iface := i.interfaceName(a.InDev)
+		id := *a.PacketID
+		setVerdict := func(result Verdict) {
+			verdict := nfqueue.NfDrop
+			if result == Accept {
+				verdict = nfqueue.NfAccept
+			}
+			if err := nf.SetVerdict(id, verdict); err != nil {
+				log.Printf("Failed to set verdict for packet %d: %v", id, err)
+			}
+		}
+		var result Verdict
+		if index, ok := l7RuleIndexOf(a.Mark); ok {
+			result = i.InspectL7(*a.Payload, index, iface)
+		} else {
+			result = i.Inspect(*a.Payload, iface, setVerdict)
+		}
+		if result != Pending {
+			setVerdict(result)
+		}
+		return 0
+	}
+	errHook := func(err error) int {
+		if ctx.Err() != nil {
+			return 1
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return 0
+		}
+		log.Printf("Warning: nfqueue receive error: %v", err)
+		return 0
+	}
+
+	if err := nf.RegisterWithErrorFunc(ctx, hook, errHook); err != nil {
+		return fmt.Errorf("failed to register nfqueue handler: %w", err)
+	}
+	log.Printf("Inspecting connections on nfqueue %d", i.config.Queue)
+
+	<-ctx.Done()
+	return nil
+}
+
+// Inspect decides whether a packet queued from input interface iface may
+// pass. TCP packets without payload are accepted so that handshakes can
+// complete; payload is only allowed on flows whose ClientHello was allowed.
+// A ClientHello whose server certificate must be verified first is held:
+// Pending is returned and later is called with the verdict, possibly before
+// Inspect returns. Other packets of the flow are dropped meanwhile, as
+// clients send nothing more before the server answers.
+func (i *Inspector) Inspect(data []byte, iface string, later func(Verdict)) Verdict {
+	pkt, err := parsePacket(data)
+	if err != nil {
+		log.Printf("Dropping unparseable packet: %v", err)
+		return Drop
+	}
+	pkt.iface = iface
+	if pkt.proto == protoTCP && len(pkt.payload) == 0 {
+		return Accept
+	}
+
+	i.mu.Lock()
+	now := i.now()
+	i.pruneLocked(now)
+	key := pkt.flow()
+	state, ok := i.flows[key]
+	if !ok {
+		state = &flowState{}
+		i.flows[key] = state
+	}
+	state.lastSeen = now
+	if state.allowed {
+		i.mu.Unlock()
+		return Accept
+	}
+	if state.verifying {
+		i.mu.Unlock()
+		return Drop
+	}
+
+	if pkt.proto == protoUDP {
+		return i.inspectQUIC(pkt, state, later)
+	}
+
+	// Reassemble ClientHellos spanning several segments; partial segments
+	// pass since the server cannot answer an incomplete ClientHello
+	state.hello = append(state.hello, pkt.payload...)
+	length, err := RecordLength(state.hello)
+	if err == nil && len(state.hello) < length && length <= maxHelloLength {
+		i.mu.Unlock()
+		return Accept
+	}
+	buffered := state.hello
+	state.hello = nil
+	i.mu.Unlock()
+
+	if err != nil {
+		i.logDrop(pkt, "Dropping non-TLS traffic to %s from %s: %v", pkt.destination(), pkt.src, err)
+		return Drop
+	}
+	hello, err := ParseClientHello(buffered)
+	if err != nil {
+		i.logDrop(pkt, "Dropping malformed TLS traffic to %s from %s: %v", pkt.destination(), pkt.src, err)
+		return Drop
+	}
+
+	return i.decide(pkt, state, hello, false, later)
+}
+
+// inspectQUIC decides on a UDP packet of a flow not yet allowed, which must
+// be a QUIC Initial carrying an allowed ClientHello
+// Must be called with mu held; returns with mu released
+func (i *Inspector) inspectQUIC(pkt *packet, state *flowState, later func(Verdict)) Verdict {
+	frames, err := parseQUICInitial(pkt.payload)
+	if err != nil {
+		i.mu.Unlock()
+		i.logDrop(pkt, "Dropping UDP traffic to %s from %s: %v", pkt.destination(), pkt.src, err)
+		return Drop
+	}
+
+	// Clients may spread the ClientHello over several Initial packets
+	state.crypto = append(state.crypto, frames...)
+	hello, err := ParseHandshake(assembleCrypto(state.crypto))
+	if err == ErrIncomplete && len(state.crypto) < maxCryptoFrames {
+		i.mu.Unlock()
+		return Accept
+	}
+	state.crypto = nil
+	i.mu.Unlock()
+
+	if err != nil {
+		i.logDrop(pkt, "Dropping malformed QUIC Initial to %s from %s: %v", pkt.destination(), pkt.src, err)
+		return Drop
+	}
+	return i.decide(pkt, state, hello, true, later)
+}
+
+// decide applies the policy to a flow's ClientHello, verifying the
+// server's certificate in the background if configured
+func (i *Inspector) decide(pkt *packet, state *flowState, hello *ClientHello, quic bool, later func(Verdict)) Verdict {
+	match, ok := i.match(pkt, hello, quic)
+	if !ok {
+		return Drop
+	}
+	if !i.config.VerifyCertificates {
+		i.admit(pkt, state, match, hello.SNI)
+		return Accept
+	}
+
+	// The packet's buffer is reused once the verdict is set
+	pkt = pkt.detach()
+	name := hello.SNI
+	i.mu.Lock()
+	state.verifying = true
+	i.mu.Unlock()
+	i.verifier.Verify(pkt.destination(), name, func(err error) {
+		i.mu.Lock()
+		state.verifying = false
+		i.mu.Unlock()
+		if err != nil {
+			log.Printf("Dropping %s connection to %s (%s) from %s: certificate verification failed: %v",
+				transportName(quic), name, pkt.destination(), pkt.src, err)
+			later(Drop)
+			return
+		}
+		i.admit(pkt, state, match, name)
+		later(Accept)
+	})
+	return Pending
+}
+
+// match applies the policy to a ClientHello, returning the rule allowing it
+func (i *Inspector) match(pkt *packet, hello *ClientHello, quic bool) (Match, bool) {
+	transport := transportName(quic)
+	if i.config.Fingerprints {
+		log.Printf("%s client %s -> %s sni=%q ja3=%s ja4=%s",
+			transport, pkt.src, pkt.destination(), hello.SNI, hello.JA3(), hello.JA4(quic))
+	}
+
+	if hello.SNI == "" {
+		i.logDrop(pkt, "Dropping %s connection without SNI to %s from %s", transport, pkt.destination(), pkt.src)
+		return Match{}, false
+	}
+
+	match, ok := i.policy.MatchSNI(hello.SNI, pkt.conn())
+	if !ok || !match.Allow {
+		i.logDrop(pkt, "Dropping %s connection to %s (%s) from %s: not allowed", transport, hello.SNI, pkt.destination(), pkt.src)
+		return Match{}, false
+	}
+	if quic && match.BlockQUIC {
+		log.Printf("Dropping QUIC connection to %s (%s) from %s: QUIC blocked by rule %s", hello.SNI, pkt.destination(), pkt.src, match.Rule)
+		return Match{}, false
+	}
+	return match, true
+}
+
+// admit allows the rest of a flow whose ClientHello for name match allowed,
+// and learns its destination
+func (i *Inspector) admit(pkt *packet, state *flowState, match Match, name string) {
+	i.mu.Lock()
+	state.allowed = true
+	i.mu.Unlock()
+
+	i.policy.Learn(match.Rule, name, pkt.dst)
+	if i.config.Connections != nil {
+		i.config.Connections.Allowed(match.Rule, name, pkt.conn())
+	}
+}
+
+// transportName names the transport of a ClientHello in log lines
+func transportName(quic bool) string {
+	if quic {
+		return "QUIC"
+	}
+	return "TLS"
+}
+
+// logDrop logs a dropped connection, with the PTR name of its destination
+// once it is known if names are looked up
+func (i *Inspector) logDrop(pkt *packet, format string, args ...interface{}) {
+	if i.config.Names == nil {
+		log.Printf(format, args...)
+		return
+	}
+	// The packet's buffer is reused, so the line is formatted right away
+	line := fmt.Sprintf(format, args...)
+	i.config.Names.LookupName(pkt.dst, func(name string) {
+		if name == "" {
+			log.Print(line)
+			return
+		}
+		log.Printf("%s [ptr %s]", line, name)
+	})
+}
+
+// InspectL7 decides on a packet queued by the l7 rule at index from input
+// interface iface. The first payload of a flow is classified and the verdict
+// is kept for the rest of the flow; TCP packets without payload pass so that
+// the handshake can complete
+func (i *Inspector) InspectL7(data []byte, index int, iface string) Verdict {
+	pkt, err := parsePacket(data)
+	if err != nil {
+		log.Printf("Dropping unparseable packet: %v", err)
+		return Drop
+	}
+	pkt.iface = iface
+	if pkt.proto == protoTCP && len(pkt.payload) == 0 {
+		return Accept
+	}
+
+	i.mu.Lock()
+	now := i.now()
+	i.pruneLocked(now)
+	key := pkt.flow()
+	state, ok := i.flows[key]
+	if !ok {
+		state = &flowState{}
+		i.flows[key] = state
+	}
+	state.lastSeen = now
+	if state.l7Decided {
+		verdict := state.l7Verdict
+		i.mu.Unlock()
+		return verdict
+	}
+	i.mu.Unlock()
+
+	app := Classify(pkt.proto, pkt.payload)
+	verdict := Drop
+	if i.policy.DecideL7(index, app, pkt.conn()) {
+		verdict = Accept
+	} else {
+		if app == "" {
+			app = "unknown"
+		}
+		log.Printf("Dropping %s flow %s -> %s", app, pkt.src, pkt.destination())
+	}
+
+	i.mu.Lock()
+	state.l7Decided = true
+	state.l7Verdict = verdict
+	i.mu.Unlock()
+	return verdict
+}
+
+// interfaceName returns the name of the interface with index, or "" if it
+// is unknown
+func (i *Inspector) interfaceName(index *uint32) string {
+	if index == nil {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(int(*index))
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// l7RuleIndexOf returns the l7 rule index of a queued packet's mark
+func l7RuleIndexOf(mark *uint32) (int, bool) {
+	if mark == nil {
+		return 0, false
+	}
+	return L7RuleIndex(*mark)
+}
+
+// pruneLocked forgets idle flows
+// Must be called with mu held
+func (i *Inspector) pruneLocked(now time.Time) {
+	if now.Sub(i.lastPrune) < pruneInterval {
+		return
+	}
+	i.lastPrune = now
+	for key, state := range i.flows {
+		if now.Sub(state.lastSeen) > flowTimeout {
+			delete(i.flows, key)
+		}
+	}
+}
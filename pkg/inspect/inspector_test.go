@@ -0,0 +1,220 @@
+package inspect
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePolicy allows server names under allowed suffixes
+type fakePolicy struct {
+	allowed   []string
+	blockQUIC bool
+	learned   []string
+}
+
+func (p *fakePolicy) MatchSNI(name string, conn Conn) (Match, bool) {
+	for _, suffix := range p.allowed {
+		if strings.HasSuffix(name, suffix) {
+			return Match{Rule: "allow-" + suffix, Allow: true, BlockQUIC: p.blockQUIC}, true
+		}
+	}
+	return Match{}, false
+}
+
+func (p *fakePolicy) Learn(rule, name string, address net.IP) {
+	p.learned = append(p.learned, rule+" "+address.String())
+}
+
+func (p *fakePolicy) DecideL7(index int, app string, conn Conn) bool {
+	for _, allowed := range p.allowed {
+		if app == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpPacket builds an IPv4 TCP packet from 10.0.0.2:40000 to dst:443
+func tcpPacket(dst string, payload []byte) []byte {
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[9] = protoTCP
+	copy(pkt[12:16], net.ParseIP("10.0.0.2").To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[20:], 40000)
+	binary.BigEndian.PutUint16(pkt[22:], 443)
+	pkt[32] = 5 << 4 // Data offset
+	copy(pkt[40:], payload)
+	return pkt
+}
+
+// TestInspect tests verdicts for handshakes, ClientHellos and data
+func TestInspect(t *testing.T) {
+	testCases := []struct {
+		name     string
+		segments [][]byte
+		want     []Verdict
+		learned  int
+	}{
+		{
+			name:     "handshake without payload",
+			segments: [][]byte{nil},
+			want:     []Verdict{Accept},
+		},
+		{
+			name:     "allowed server name then data",
+			segments: [][]byte{hello(t, "api.example.com"), []byte("application data")},
+			want:     []Verdict{Accept, Accept},
+			learned:  1,
+		},
+		{
+			name:     "disallowed server name",
+			segments: [][]byte{hello(t, "evil.test")},
+			want:     []Verdict{Drop},
+		},
+		{
+			name:     "ClientHello split across segments",
+			segments: split(hello(t, "api.example.com"), 100),
+			want:     []Verdict{Accept, Accept},
+			learned:  1,
+		},
+		{
+			name:     "non-TLS payload",
+			segments: [][]byte{[]byte("SSH-2.0-OpenSSH_9.6\r\n")},
+			want:     []Verdict{Drop},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := &fakePolicy{allowed: []string{"example.com"}}
+			inspector := New(Config{}, policy)
+
+			for i, segment := range tc.segments {
+				if got := inspector.Inspect(tcpPacket("192.0.2.10", segment), "", nil); got != tc.want[i] {
+					t.Errorf("segment %d: got verdict %d, want %d", i, got, tc.want[i])
+				}
+			}
+			if len(policy.learned) != tc.learned {
+				t.Errorf("Expected %d learned addresses, got %v", tc.learned, policy.learned)
+			}
+		})
+	}
+}
+
+// TestVerifier tests certificate verification against the requested name
+func TestVerifier(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	roots := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	verifier := NewVerifier(roots)
+	address := server.Listener.Addr().String()
+	verify := func(name string) error {
+		result := make(chan error, 1)
+		verifier.Verify(address, name, func(err error) { result <- err })
+		return <-result
+	}
+
+	// The httptest certificate is issued for example.com
+	if err := verify("example.com"); err != nil {
+		t.Errorf("Expected valid certificate, got %v", err)
+	}
+	if err := verify("api.other.test"); err == nil {
+		t.Error("Expected certificate mismatch for other name")
+	}
+}
+
+// TestVerifierBounds tests that handshakes in progress are limited and the
+// cache is emptied once full of unexpired results
+func TestVerifierBounds(t *testing.T) {
+	release := make(chan struct{})
+	verifier := NewVerifier(nil)
+	verifier.dial = func(address string, cfg *tls.Config) error {
+		<-release
+		return nil
+	}
+
+	for n := 0; n < maxVerifyPending; n++ {
+		verifier.Verify(fmt.Sprintf("192.0.2.1:%d", n), "example.com", func(error) {})
+	}
+	var busy error
+	verifier.Verify("192.0.2.2:443", "example.com", func(err error) { busy = err })
+	if busy != errVerifyBusy {
+		t.Errorf("Expected %v beyond %d handshakes, got %v", errVerifyBusy, maxVerifyPending, busy)
+	}
+	close(release)
+
+	verifier = NewVerifier(nil)
+	verifier.dial = func(address string, cfg *tls.Config) error { return nil }
+	verifier.mu.Lock()
+	for n := 0; n < maxVerifyCache; n++ {
+		verifier.cache[fmt.Sprintf("192.0.2.3:%d example.com", n)] = verifyResult{expiresAt: time.Now().Add(time.Hour)}
+	}
+	verifier.mu.Unlock()
+	done := make(chan error, 1)
+	verifier.Verify("192.0.2.4:443", "example.com", func(err error) { done <- err })
+	<-done
+
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	if len(verifier.cache) != 1 {
+		t.Errorf("Expected the full cache emptied, got %d results", len(verifier.cache))
+	}
+}
+
+// TestInspectVerifying tests that a ClientHello is held while the server's
+// certificate is verified, and the rest of its flow dropped until then
+func TestInspectVerifying(t *testing.T) {
+	release := make(chan struct{})
+	policy := &fakePolicy{allowed: []string{"example.com"}}
+	inspector := New(Config{VerifyCertificates: true}, policy)
+	inspector.verifier.dial = func(address string, cfg *tls.Config) error {
+		<-release
+		if cfg.ServerName != "api.example.com" {
+			return fmt.Errorf("certificate not valid for %s", cfg.ServerName)
+		}
+		return nil
+	}
+
+	verdicts := make(chan Verdict, 2)
+	later := func(v Verdict) { verdicts <- v }
+	if got := inspector.Inspect(tcpPacket("192.0.2.10", hello(t, "api.example.com")), "", later); got != Pending {
+		t.Fatalf("Expected the ClientHello held, got verdict %d", got)
+	}
+	if got := inspector.Inspect(tcpPacket("192.0.2.10", []byte("early data")), "", later); got != Drop {
+		t.Errorf("Expected data while verifying dropped, got verdict %d", got)
+	}
+	if got := inspector.Inspect(tcpPacket("192.0.2.11", hello(t, "www.example.com")), "", later); got != Pending {
+		t.Fatalf("Expected the ClientHello held, got verdict %d", got)
+	}
+
+	close(release)
+	got := map[Verdict]int{<-verdicts: 1}
+	got[<-verdicts]++
+	if got[Accept] != 1 || got[Drop] != 1 {
+		t.Errorf("Expected one ClientHello accepted and one dropped, got %v", got)
+	}
+	if got := inspector.Inspect(tcpPacket("192.0.2.10", []byte("application data")), "", later); got != Accept {
+		t.Errorf("Expected data of the verified flow accepted, got verdict %d", got)
+	}
+	if len(policy.learned) != 1 {
+		t.Errorf("Expected 1 learned address, got %v", policy.learned)
+	}
+}
+
+func hello(t *testing.T, serverName string) []byte {
+	return captureClientHello(t, serverName, nil)
+}
+
+func split(data []byte, at int) [][]byte {
+	return [][]byte{data[:at], data[at:]}
+}
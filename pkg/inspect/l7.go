@@ -0,0 +1,87 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Application protocols recognized by Classify
+const (
+	AppSSH  = "ssh"
+	AppTLS  = "tls"
+	AppHTTP = "http"
+	AppDNS  = "dns"
+)
+
+// l7MarkBase tags packets queued by l7 rules; the low 16 bits hold the
+// rule index
+const (
+	l7MarkBase = 0x4c370000
+	l7MarkMask = 0xffff0000
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+	[]byte("TRACE "), []byte("PRI * HTTP/2.0"),
+}
+
+// L7Mark returns the packet mark identifying the rule at index
+func L7Mark(index int) uint32 {
+	return l7MarkBase | uint32(index&0xffff)
+}
+
+// L7RuleIndex returns the rule index of a packet mark set by L7Mark
+func L7RuleIndex(mark uint32) (int, bool) {
+	if mark&l7MarkMask != l7MarkBase {
+		return 0, false
+	}
+	return int(mark & 0xffff), true
+}
+
+// Classify guesses the application protocol of the first payload a client
+// sent on a flow, or returns "" if it is not recognized
+func Classify(proto uint8, payload []byte) string {
+	switch {
+	case bytes.HasPrefix(payload, []byte("SSH-")):
+		return AppSSH
+	case len(payload) >= 3 && payload[0] == recordTypeHandshake && payload[1] == 0x03 && payload[2] <= 0x04:
+		return AppTLS
+	case isHTTPRequest(payload):
+		return AppHTTP
+	case isDNSQuery(proto, payload):
+		return AppDNS
+	}
+	return ""
+}
+
+func isHTTPRequest(payload []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(payload, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDNSQuery checks for a plausible standard query header; DNS over TCP
+// carries a two byte length prefix
+func isDNSQuery(proto uint8, payload []byte) bool {
+	if proto == protoTCP {
+		if len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != len(payload)-2 {
+			return false
+		}
+		payload = payload[2:]
+	}
+	if len(payload) < 17 { // Header plus the shortest question
+		return false
+	}
+
+	flags := binary.BigEndian.Uint16(payload[2:4])
+	qr := flags >> 15
+	opcode := (flags >> 11) & 0x0f
+	z := (flags >> 6) & 0x01
+	qdcount := binary.BigEndian.Uint16(payload[4:6])
+	ancount := binary.BigEndian.Uint16(payload[6:8])
+	return qr == 0 && opcode <= 5 && z == 0 && qdcount >= 1 && qdcount <= 4 && ancount == 0
+}
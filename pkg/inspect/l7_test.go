@@ -0,0 +1,61 @@
+package inspect
+
+import (
+	"testing"
+)
+
+// TestClassify tests application protocol heuristics
+func TestClassify(t *testing.T) {
+	dnsQuery := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+
+	testCases := []struct {
+		name    string
+		proto   uint8
+		payload []byte
+		want    string
+	}{
+		{name: "ssh banner", proto: protoTCP, payload: []byte("SSH-2.0-OpenSSH_9.6\r\n"), want: AppSSH},
+		{name: "tls record", proto: protoTCP, payload: []byte{0x16, 0x03, 0x01, 0x02, 0x00}, want: AppTLS},
+		{name: "http request", proto: protoTCP, payload: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n"), want: AppHTTP},
+		{name: "http2 preface", proto: protoTCP, payload: []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), want: AppHTTP},
+		{name: "dns over udp", proto: protoUDP, payload: dnsQuery, want: AppDNS},
+		{name: "dns over tcp", proto: protoTCP, payload: append([]byte{0, byte(len(dnsQuery))}, dnsQuery...), want: AppDNS},
+		{name: "dns over tcp without length", proto: protoTCP, payload: dnsQuery, want: ""},
+		{name: "unknown", proto: protoTCP, payload: []byte{0x00, 0x01, 0x02}, want: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Classify(tc.proto, tc.payload); got != tc.want {
+				t.Errorf("Classify() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestInspectL7 tests that the first payload decides the whole flow
+func TestInspectL7(t *testing.T) {
+	inspector := New(Config{}, &fakePolicy{allowed: []string{AppHTTP}})
+
+	if got := inspector.InspectL7(tcpPacket("192.0.2.30", nil), 0, ""); got != Accept {
+		t.Errorf("Expected handshake to pass, got %d", got)
+	}
+	if got := inspector.InspectL7(tcpPacket("192.0.2.30", []byte("SSH-2.0-OpenSSH_9.6\r\n")), 0, ""); got != Drop {
+		t.Errorf("Expected ssh to be dropped, got %d", got)
+	}
+	// Later payload on the same flow keeps the verdict
+	if got := inspector.InspectL7(tcpPacket("192.0.2.30", []byte("GET / HTTP/1.1\r\n")), 0, ""); got != Drop {
+		t.Errorf("Expected flow verdict to stick, got %d", got)
+	}
+
+	if got := inspector.InspectL7(tcpPacket("192.0.2.31", []byte("GET / HTTP/1.1\r\n")), 0, ""); got != Accept {
+		t.Errorf("Expected http to pass, got %d", got)
+	}
+	if _, ok := L7RuleIndex(L7Mark(7)); !ok {
+		t.Error("Expected L7Mark to round trip")
+	}
+}
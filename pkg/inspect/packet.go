@@ -0,0 +1,127 @@
+package inspect
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// packet is a parsed IPv4 or IPv6 TCP/UDP packet
+type packet struct {
+	src, dst         net.IP
+	proto            uint8
+	srcPort, dstPort uint16
+	payload          []byte
+	iface            string // Input interface, if known
+}
+
+// flow identifies a connection by its addresses and ports
+type flow struct {
+	src, dst         string
+	proto            uint8
+	srcPort, dstPort uint16
+}
+
+func (p *packet) flow() flow {
+	return flow{
+		src:     p.src.String(),
+		dst:     p.dst.String(),
+		proto:   p.proto,
+		srcPort: p.srcPort,
+		dstPort: p.dstPort,
+	}
+}
+
+// conn describes the packet's connection for policy decisions
+func (p *packet) conn() Conn {
+	network := "tcp"
+	if p.proto == protoUDP {
+		network = "udp"
+	}
+	return Conn{Network: network, Interface: p.iface, Source: p.src, SourcePort: p.srcPort, Address: p.dst, Port: p.dstPort}
+}
+
+// detach returns a copy of the packet's headers that doesn't share the
+// buffer it was parsed from, without its payload
+func (p *packet) detach() *packet {
+	c := *p
+	c.src = append(net.IP(nil), p.src...)
+	c.dst = append(net.IP(nil), p.dst...)
+	c.payload = nil
+	return &c
+}
+
+// destination returns the destination as host:port
+func (p *packet) destination() string {
+	return net.JoinHostPort(p.dst.String(), strconv.Itoa(int(p.dstPort)))
+}
+
+// parsePacket parses the network and transport headers of a packet as
+// delivered by NFQUEUE
+func parsePacket(data []byte) (*packet, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty packet")
+	}
+
+	p := &packet{}
+	var transport []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, fmt.Errorf("short IPv4 header")
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		if ihl < 20 || total < ihl || len(data) < total {
+			return nil, fmt.Errorf("malformed IPv4 header")
+		}
+		p.proto = data[9]
+		p.src = net.IP(data[12:16])
+		p.dst = net.IP(data[16:20])
+		transport = data[ihl:total]
+	case 6:
+		if len(data) < 40 {
+			return nil, fmt.Errorf("short IPv6 header")
+		}
+		length := int(binary.BigEndian.Uint16(data[4:6]))
+		if len(data) < 40+length {
+			return nil, fmt.Errorf("malformed IPv6 header")
+		}
+		// Extension headers are not followed
+		p.proto = data[6]
+		p.src = net.IP(data[8:24])
+		p.dst = net.IP(data[24:40])
+		transport = data[40 : 40+length]
+	default:
+		return nil, fmt.Errorf("unknown IP version %d", data[0]>>4)
+	}
+
+	switch p.proto {
+	case protoTCP:
+		if len(transport) < 20 {
+			return nil, fmt.Errorf("short TCP header")
+		}
+		offset := int(transport[12]>>4) * 4
+		if offset < 20 || len(transport) < offset {
+			return nil, fmt.Errorf("malformed TCP header")
+		}
+		p.payload = transport[offset:]
+	case protoUDP:
+		if len(transport) < 8 {
+			return nil, fmt.Errorf("short UDP header")
+		}
+		p.payload = transport[8:]
+	default:
+		return nil, fmt.Errorf("unsupported protocol %d", p.proto)
+	}
+	p.srcPort = binary.BigEndian.Uint16(transport[0:2])
+	p.dstPort = binary.BigEndian.Uint16(transport[2:4])
+
+	return p, nil
+}
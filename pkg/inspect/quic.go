@@ -0,0 +1,258 @@
+package inspect
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+
+	frameTypePadding = 0x00
+	frameTypePing    = 0x01
+	frameTypeACK     = 0x02
+	frameTypeACKECN  = 0x03
+	frameTypeCrypto  = 0x06
+)
+
+// Initial salts from RFC 9001 section 5.2 and RFC 9369 section 3.3.1
+var (
+	quicSaltV1 = []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	}
+	quicSaltV2 = []byte{
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	}
+)
+
+// ErrNotQUICInitial is returned for UDP payloads that are not a QUIC
+// Initial packet
+var ErrNotQUICInitial = errors.New("not a QUIC Initial packet")
+
+// cryptoFrame is a fragment of the TLS handshake carried in QUIC
+type cryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// IsQUICInitial reports whether a UDP payload starts with a QUIC Initial
+// packet of a supported version
+func IsQUICInitial(payload []byte) bool {
+	if len(payload) < 5 || payload[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(payload[1:5]) {
+	case quicVersion1:
+		return payload[0]&0x30 == 0x00
+	case quicVersion2:
+		return payload[0]&0x30 == 0x10
+	}
+	return false
+}
+
+// parseQUICInitial removes the protection of a client Initial packet and
+// returns its CRYPTO frames. Only the first packet of a coalesced datagram
+// is read.
+func parseQUICInitial(payload []byte) ([]cryptoFrame, error) {
+	if !IsQUICInitial(payload) {
+		return nil, ErrNotQUICInitial
+	}
+	version := binary.BigEndian.Uint32(payload[1:5])
+
+	r := reader(payload[5:])
+	dcid, ok := r.vec(1)
+	if !ok || len(dcid) > 20 {
+		return nil, fmt.Errorf("malformed QUIC destination connection id")
+	}
+	if _, ok := r.vec(1); !ok { // source connection id
+		return nil, fmt.Errorf("malformed QUIC source connection id")
+	}
+	tokenLen, ok := r.varint()
+	if !ok || !r.skip(int(tokenLen)) {
+		return nil, fmt.Errorf("malformed QUIC token")
+	}
+	length, ok := r.varint()
+	if !ok || uint64(len(r)) < length || length < 20 {
+		return nil, fmt.Errorf("malformed QUIC packet length")
+	}
+	pnOffset := len(payload) - len(r)
+	packetEnd := pnOffset + int(length)
+
+	key, iv, hp := quicClientKeys(version, dcid)
+
+	// Remove header protection (RFC 9001 section 5.4)
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, payload[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := append([]byte(nil), payload[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	// Decrypt the payload (RFC 9001 section 5.3)
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	plaintext, err := aead.Open(nil, nonce, payload[pnOffset+pnLen:packetEnd], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt QUIC Initial: %w", err)
+	}
+
+	return parseCryptoFrames(plaintext)
+}
+
+// parseCryptoFrames returns the CRYPTO frames of an Initial packet payload
+func parseCryptoFrames(payload []byte) ([]cryptoFrame, error) {
+	var frames []cryptoFrame
+	r := reader(payload)
+	for len(r) > 0 {
+		frameType, _ := r.varint()
+		switch frameType {
+		case frameTypePadding, frameTypePing:
+		case frameTypeACK, frameTypeACKECN:
+			if !r.skipACK(frameType == frameTypeACKECN) {
+				return nil, fmt.Errorf("malformed QUIC ACK frame")
+			}
+		case frameTypeCrypto:
+			offset, ok1 := r.varint()
+			length, ok2 := r.varint()
+			if !ok1 || !ok2 || uint64(len(r)) < length {
+				return nil, fmt.Errorf("malformed QUIC CRYPTO frame")
+			}
+			frames = append(frames, cryptoFrame{offset: offset, data: r[:length]})
+			r = r[length:]
+		default:
+			// Other frames are not allowed in a client's first Initial
+			return frames, nil
+		}
+	}
+	return frames, nil
+}
+
+// assembleCrypto returns the contiguous handshake data from offset 0
+func assembleCrypto(frames []cryptoFrame) []byte {
+	sorted := append([]cryptoFrame(nil), frames...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].offset < sorted[j].offset })
+
+	var data []byte
+	for _, f := range sorted {
+		end := f.offset + uint64(len(f.data))
+		if f.offset > uint64(len(data)) {
+			break
+		}
+		if end > uint64(len(data)) {
+			data = append(data, f.data[uint64(len(data))-f.offset:]...)
+		}
+	}
+	return data
+}
+
+// quicClientKeys derives the client Initial packet protection keys
+func quicClientKeys(version uint32, dcid []byte) (key, iv, hp []byte) {
+	salt, keyLabel, ivLabel, hpLabel := quicSaltV1, "quic key", "quic iv", "quic hp"
+	if version == quicVersion2 {
+		salt, keyLabel, ivLabel, hpLabel = quicSaltV2, "quicv2 key", "quicv2 iv", "quicv2 hp"
+	}
+
+	initial := hkdfExtract(salt, dcid)
+	client := hkdfExpandLabel(initial, "client in", sha256.Size)
+	return hkdfExpandLabel(client, keyLabel, 16),
+		hkdfExpandLabel(client, ivLabel, 12),
+		hkdfExpandLabel(client, hpLabel, 16)
+}
+
+// hkdfExtract is HKDF-Extract (RFC 5869) with SHA-256
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from TLS 1.3 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(full))}
+	info = append(info, full...)
+	info = append(info, 0) // Empty context
+
+	var out, prev []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// varint reads a QUIC variable-length integer
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, b := range (*r)[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
+
+// skipACK skips the body of an ACK frame
+func (r *reader) skipACK(ecn bool) bool {
+	// Largest acknowledged, delay and range count
+	if _, ok := r.varint(); !ok {
+		return false
+	}
+	if _, ok := r.varint(); !ok {
+		return false
+	}
+	count, ok := r.varint()
+	if !ok || count > uint64(len(*r)) {
+		return false
+	}
+	// First range, then a gap and length per additional range
+	fields := 1 + 2*int(count)
+	if ecn {
+		fields += 3
+	}
+	for i := 0; i < fields; i++ {
+		if _, ok := r.varint(); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package inspect
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// TestQUICClientKeys tests key derivation against RFC 9001 appendix A.1
+func TestQUICClientKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp := quicClientKeys(quicVersion1, dcid)
+
+	if got := hex.EncodeToString(key); got != "1f369613dd76d5467730efcbe3b1a22d" {
+		t.Errorf("key = %s", got)
+	}
+	if got := hex.EncodeToString(iv); got != "fa044b2f42a3fd3b46fb255c" {
+		t.Errorf("iv = %s", got)
+	}
+	if got := hex.EncodeToString(hp); got != "9f50449e04a0e810283a1e9933adedd2" {
+		t.Errorf("hp = %s", got)
+	}
+}
+
+// sealQUICInitial builds a protected client Initial packet carrying a
+// CRYPTO frame with data at offset
+func sealQUICInitial(t *testing.T, dcid []byte, offset int, data []byte) []byte {
+	t.Helper()
+	const pnLen = 2
+	key, iv, hp := quicClientKeys(quicVersion1, dcid)
+
+	plaintext := []byte{frameTypeCrypto}
+	plaintext = appendVarint2(plaintext, offset)
+	plaintext = appendVarint2(plaintext, len(data))
+	plaintext = append(plaintext, data...)
+	if len(plaintext) < 1100 {
+		plaintext = append(plaintext, make([]byte, 1100-len(plaintext))...) // PADDING
+	}
+
+	header := []byte{0xc0 | (pnLen - 1), 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0, 0) // Source connection id, token
+	header = appendVarint2(header, pnLen+len(plaintext)+16)
+	pnOffset := len(header)
+	header = append(header, 0, 7) // Packet number 7
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := append([]byte(nil), iv...)
+	nonce[len(nonce)-1] ^= 7
+	packet := aead.Seal(append([]byte(nil), header...), nonce, plaintext, header)
+
+	hpBlock, _ := aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func appendVarint2(b []byte, v int) []byte {
+	return append(b, 0x40|byte(v>>8), byte(v))
+}
+
+// udpPacket builds an IPv4 UDP packet from 10.0.0.2:50000 to dst:443
+func udpPacket(dst string, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[9] = protoUDP
+	copy(pkt[12:16], net.ParseIP("10.0.0.2").To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[20:], 50000)
+	binary.BigEndian.PutUint16(pkt[22:], 443)
+	binary.BigEndian.PutUint16(pkt[24:], uint16(8+len(payload)))
+	copy(pkt[28:], payload)
+	return pkt
+}
+
+// TestInspectQUIC tests SNI enforcement on QUIC Initial packets
+func TestInspectQUIC(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	// The ClientHello handshake message without the TLS record header
+	allowed := hello(t, "api.example.com")[recordHeaderLen:]
+
+	testCases := []struct {
+		name      string
+		packets   [][]byte
+		blockQUIC bool
+		want      []Verdict
+	}{
+		{
+			name:    "allowed server name",
+			packets: [][]byte{sealQUICInitial(t, dcid, 0, allowed)},
+			want:    []Verdict{Accept},
+		},
+		{
+			name: "ClientHello split across Initial packets",
+			packets: [][]byte{
+				sealQUICInitial(t, dcid, 100, allowed[100:]),
+				sealQUICInitial(t, dcid, 0, allowed[:100]),
+			},
+			want: []Verdict{Accept, Accept},
+		},
+		{
+			name:      "rule blocks QUIC",
+			packets:   [][]byte{sealQUICInitial(t, dcid, 0, allowed)},
+			blockQUIC: true,
+			want:      []Verdict{Drop},
+		},
+		{
+			name:    "disallowed server name",
+			packets: [][]byte{sealQUICInitial(t, dcid, 0, hello(t, "evil.test")[recordHeaderLen:])},
+			want:    []Verdict{Drop},
+		},
+		{
+			name:    "not QUIC",
+			packets: [][]byte{[]byte("plain udp payload")},
+			want:    []Verdict{Drop},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := &fakePolicy{allowed: []string{"example.com"}, blockQUIC: tc.blockQUIC}
+			inspector := New(Config{}, policy)
+			for i, payload := range tc.packets {
+				if got := inspector.Inspect(udpPacket("192.0.2.20", payload), "", nil); got != tc.want[i] {
+					t.Errorf("packet %d: got verdict %d, want %d", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package inspect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	verifyTimeout  = 5 * time.Second
+	verifyCacheTTL = 10 * time.Minute
+	maxVerifyCache = 4096
+	// maxVerifyPending bounds the handshakes in progress, so that clients
+	// sending new names can't start any number of them
+	maxVerifyPending = 256
+)
+
+// errVerifyBusy fails the verifications beyond maxVerifyPending
+var errVerifyBusy = errors.New("too many verifications in progress")
+
+// Verifier checks that a server presents a valid certificate for the name
+// a client asked for, so a client cannot reach an arbitrary address by
+// sending an allowed SNI. Handshakes run in the background, so that the
+// packets of other connections don't wait for them.
+type Verifier struct {
+	roots *x509.CertPool // nil uses the system roots
+	dial  func(address string, cfg *tls.Config) error
+	now   func() time.Time
+
+	mu      sync.Mutex
+	cache   map[string]verifyResult  // "address name" -> result
+	pending map[string][]func(error) // "address name" -> callbacks waiting for it
+}
+
+type verifyResult struct {
+	err       error
+	expiresAt time.Time
+}
+
+// NewVerifier creates a certificate verifier trusting roots, or the system
+// roots if roots is nil
+func NewVerifier(roots *x509.CertPool) *Verifier {
+	return &Verifier{
+		roots:   roots,
+		dial:    dialTLS,
+		now:     time.Now,
+		cache:   make(map[string]verifyResult),
+		pending: make(map[string][]func(error)),
+	}
+}
+
+// dialTLS performs a TLS handshake with address, verifying its certificate
+func dialTLS(address string, cfg *tls.Config) error {
+	dialer := &net.Dialer{Timeout: verifyTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Verify connects to address and checks its certificate chain is valid for
+// name, calling done with the result: immediately if it is cached or too
+// many handshakes are in progress, otherwise once the handshake completes.
+// Results are cached per address and name.
+func (v *Verifier) Verify(address, name string, done func(error)) {
+	key := address + " " + name
+
+	v.mu.Lock()
+	if result, ok := v.cache[key]; ok && v.now().Before(result.expiresAt) {
+		v.mu.Unlock()
+		done(result.err)
+		return
+	}
+	if callbacks, ok := v.pending[key]; ok {
+		v.pending[key] = append(callbacks, done)
+		v.mu.Unlock()
+		return
+	}
+	if len(v.pending) >= maxVerifyPending {
+		v.mu.Unlock()
+		done(errVerifyBusy)
+		return
+	}
+	v.pending[key] = []func(error){done}
+	v.mu.Unlock()
+
+	go v.verify(key, address, name)
+}
+
+// verify performs the handshake, caches its result and hands it to the
+// waiting callbacks
+func (v *Verifier) verify(key, address, name string) {
+	err := v.dial(address, &tls.Config{
+		ServerName: name,
+		RootCAs:    v.roots,
+		MinVersion: tls.VersionTLS12,
+	})
+
+	v.mu.Lock()
+	now := v.now()
+	if len(v.cache) >= maxVerifyCache {
+		v.pruneLocked(now)
+	}
+	v.cache[key] = verifyResult{err: err, expiresAt: now.Add(verifyCacheTTL)}
+	callbacks := v.pending[key]
+	delete(v.pending, key)
+	v.mu.Unlock()
+
+	for _, done := range callbacks {
+		done(err)
+	}
+}
+
+// pruneLocked removes expired results, and all of them if none has expired
+// Must be called with mu held
+func (v *Verifier) pruneLocked(now time.Time) {
+	for key, result := range v.cache {
+		if !now.Before(result.expiresAt) {
+			delete(v.cache, key)
+		}
+	}
+	if len(v.cache) >= maxVerifyCache {
+		v.cache = make(map[string]verifyResult)
+	}
+}
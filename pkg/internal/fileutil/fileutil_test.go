@@ -0,0 +1,32 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteAtomic tests replacing a file in a directory to be created
+func TestWriteAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "state.json")
+	for _, data := range []string{"first", "second"} {
+		if err := WriteAtomic(path, []byte(data)); err != nil {
+			t.Fatalf("WriteAtomic() error = %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the file to be left, got %d entries", len(entries))
+	}
+}
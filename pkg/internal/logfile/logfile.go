@@ -0,0 +1,115 @@
+// Package logfile appends to log files rotated by size
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File appends to a file that is rotated once it reaches its maximum size:
+// the file is renamed to <file>.1, whose predecessor becomes <file>.2 and
+// so on, dropping the oldest beyond the backups kept
+type File struct {
+	path       string
+	maxSize    int64 // 0 never rotates
+	maxBackups int
+	header     []byte
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens the file at path for appending, writing header first to a
+// new or empty file, as to each file rotation starts
+func Open(path string, maxSize int64, maxBackups int, header []byte) (*File, error) {
+	f := &File{path: path, maxSize: maxSize, maxBackups: maxBackups, header: header}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file, writing the header to an empty one
+// Must be called with mu held
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	if f.size == 0 && len(f.header) > 0 {
+		n, err := file.Write(f.header)
+		f.size += int64(n)
+		if err != nil {
+			file.Close()
+			f.file = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends p in a single write, so that a reader never sees part of
+// it unless the write failed, rotating the file first if p would take it
+// beyond its maximum size. The file is left closed, and later writes
+// dropped, only if it can't be opened again after rotating.
+func (f *File) Write(p []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	var rotateErr error
+	if f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > int64(len(f.header)) {
+		if rotateErr = f.rotate(); rotateErr != nil {
+			rotateErr = fmt.Errorf("failed to rotate %s: %w", f.path, rotateErr)
+			if f.file == nil {
+				return rotateErr
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.path, err)
+	}
+	return rotateErr
+}
+
+// rotate moves the file to the first backup and opens a new one
+// Must be called with mu held
+func (f *File) rotate() error {
+	f.file.Close()
+	f.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// Keep appending to the current file rather than losing lines
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,37 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRotate tests that each rotated file starts with the header and the
+// oldest beyond the backups are dropped
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	f, err := Open(path, 10, 2, []byte("H"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for _, line := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee", "ffff", "gggg"} {
+		if err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	f.Close()
+
+	want := map[string]string{path: "Hgggg", path + ".1": "Heeeeffff", path + ".2": "Hccccdddd"}
+	for name, content := range want {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Expected %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups")
+	}
+}
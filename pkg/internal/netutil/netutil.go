@@ -0,0 +1,35 @@
+// Package netutil formats and parses the addresses of connection logs and
+// events
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// HostPort formats an address with its port, or alone if the protocol has
+// no ports
+func HostPort(ip net.IP, port uint16) string {
+	if port == 0 {
+		return ip.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// ParseHostPort parses an address formatted by HostPort
+func ParseHostPort(s string) (net.IP, uint16, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, 0, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0, fmt.Errorf("invalid address: %s", s)
+	}
+	return ip, uint16(p), nil
+}
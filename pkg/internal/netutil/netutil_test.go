@@ -0,0 +1,34 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+)
+
+// TestHostPort tests formatting addresses and parsing them back
+func TestHostPort(t *testing.T) {
+	testCases := []struct {
+		ip   string
+		port uint16
+		want string
+	}{
+		{ip: "192.0.2.7", port: 443, want: "192.0.2.7:443"},
+		{ip: "2001:db8::1", port: 53, want: "[2001:db8::1]:53"},
+		{ip: "192.0.2.7", want: "192.0.2.7"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			got := HostPort(net.ParseIP(tc.ip), tc.port)
+			if got != tc.want {
+				t.Fatalf("Expected %s, got %s", tc.want, got)
+			}
+			ip, port, err := ParseHostPort(got)
+			if err != nil {
+				t.Fatalf("ParseHostPort() error = %v", err)
+			}
+			if !ip.Equal(net.ParseIP(tc.ip)) || port != tc.port {
+				t.Errorf("Expected %s port %d, got %s port %d", tc.ip, tc.port, ip, port)
+			}
+		})
+	}
+}
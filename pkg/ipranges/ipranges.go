@@ -0,0 +1,359 @@
+// Package ipranges downloads the IP ranges cloud providers publish for
+// their services (AWS ip-ranges.json, Google Cloud's cloud.json and Azure
+// Service Tags) and Team Cymru's full bogons, and expands named groups such
+// as @aws:s3:us-east-1 to their prefixes.
+package ipranges
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/internal/fileutil"
+)
+
+const (
+	defaultAWSURL  = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+	defaultGCPURL  = "https://www.gstatic.com/ipranges/cloud.json"
+	defaultRefresh = 24 * time.Hour
+	// Published files are a few MB; anything much larger is not one
+	maxDocumentSize = 64 << 20
+)
+
+// defaultBogonsURLs are Team Cymru's full bogons, IPv4 then IPv6
+var defaultBogonsURLs = []string{
+	"https://www.team-cymru.org/Services/Bogons/fullbogons-ipv4.txt",
+	"https://www.team-cymru.org/Services/Bogons/fullbogons-ipv6.txt",
+}
+
+// prefix is a published prefix with the service and region it belongs to
+type prefix struct {
+	cidr    string
+	service string
+	region  string
+}
+
+// Ranges holds the last downloaded ranges of each provider
+type Ranges struct {
+	urls     map[string]string
+	bogons   []string // Locations of the full bogons, if downloaded
+	refresh  time.Duration
+	cacheDir string
+	client   *http.Client
+
+	mu       sync.RWMutex
+	prefixes map[string][]prefix // Provider -> prefixes
+	digests  map[string][32]byte // Provider -> digest of the document
+}
+
+// New creates the ranges for cfg, which may be nil
+func New(cfg *config.IPRangesConfig) *Ranges {
+	r := &Ranges{
+		urls: map[string]string{
+			config.ProviderAWS: defaultAWSURL,
+			config.ProviderGCP: defaultGCPURL,
+		},
+		refresh:  defaultRefresh,
+		client:   &http.Client{Timeout: time.Minute},
+		prefixes: make(map[string][]prefix),
+		digests:  make(map[string][32]byte),
+	}
+	if cfg == nil {
+		return r
+	}
+
+	if cfg.Refresh > 0 {
+		r.refresh = cfg.Refresh.Std()
+	}
+	r.cacheDir = cfg.CacheDir
+	for provider, url := range map[string]string{
+		config.ProviderAWS:   cfg.AWSURL,
+		config.ProviderGCP:   cfg.GCPURL,
+		config.ProviderAzure: cfg.AzureURL,
+	} {
+		if url != "" {
+			r.urls[provider] = url
+		}
+	}
+	if cfg.FullBogons {
+		r.bogons = defaultBogonsURLs
+		if len(cfg.BogonsURLs) > 0 {
+			r.bogons = cfg.BogonsURLs
+		}
+	}
+	return r
+}
+
+// Refresh returns the time between downloads
+func (r *Ranges) Refresh() time.Duration {
+	return r.refresh
+}
+
+// Fetch downloads the ranges of providers and reports the providers whose
+// ranges changed. A provider that can't be downloaded keeps its last
+// ranges, loaded from the cache directory at first.
+func (r *Ranges) Fetch(ctx context.Context, providers []string) (changed []string, err error) {
+	var errs []string
+	for _, provider := range providers {
+		data, fetchErr := r.download(ctx, provider)
+		if fetchErr != nil {
+			errs = append(errs, fetchErr.Error())
+			if data, fetchErr = r.loadCached(provider); fetchErr != nil {
+				continue
+			}
+		}
+
+		digest := sha256.Sum256(data)
+		r.mu.RLock()
+		same := r.digests[provider] == digest
+		r.mu.RUnlock()
+		if same {
+			continue
+		}
+		prefixes, parseErr := parse(provider, data)
+		if parseErr != nil {
+			errs = append(errs, fmt.Sprintf("failed to parse %s ranges: %v", provider, parseErr))
+			continue
+		}
+
+		r.mu.Lock()
+		r.prefixes[provider] = prefixes
+		r.digests[provider] = digest
+		r.mu.Unlock()
+		changed = append(changed, provider)
+		log.Printf("Loaded %d %s ranges", len(prefixes), provider)
+	}
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// Loaded reports whether ranges of provider are loaded
+func (r *Ranges) Loaded(provider string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.prefixes[provider]
+	return ok
+}
+
+// Expand returns the prefixes of a group from the last fetched ranges; the
+// bogons are DefaultBogons until the full bogons are
+func (r *Ranges) Expand(group config.IPGroup) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.prefixes[group.Provider]; !ok && group.Provider == config.ProviderBogons {
+		cidrs := append([]string(nil), config.DefaultBogons...)
+		sort.Strings(cidrs)
+		return cidrs
+	}
+	var cidrs []string
+	for _, p := range r.prefixes[group.Provider] {
+		if group.Service != "" && !strings.EqualFold(p.service, group.Service) {
+			continue
+		}
+		if group.Region != "" && !strings.EqualFold(p.region, group.Region) {
+			continue
+		}
+		cidrs = append(cidrs, p.cidr)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// download fetches the document of a provider, keeping a copy in the cache
+// directory. The full bogons are joined into one document.
+func (r *Ranges) download(ctx context.Context, provider string) ([]byte, error) {
+	urls := r.bogons
+	if provider != config.ProviderBogons {
+		url, ok := r.urls[provider]
+		if !ok {
+			return nil, fmt.Errorf("no location of %s ranges configured", provider)
+		}
+		urls = []string{url}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no location of %s ranges configured", provider)
+	}
+
+	var data []byte
+	for _, url := range urls {
+		document, err := r.get(ctx, provider, url)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, document...), '\n')
+	}
+
+	if r.cacheDir != "" {
+		if err := fileutil.WriteAtomic(r.cachePath(provider), data); err != nil {
+			log.Printf("Warning: failed to cache %s ranges: %v", provider, err)
+		}
+	}
+	return data, nil
+}
+
+// get fetches a document of provider from url
+func (r *Ranges) get(ctx context.Context, provider, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s ranges: %w", provider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s ranges: %s returned %s", provider, url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s ranges: %w", provider, err)
+	}
+	return data, nil
+}
+
+// loadCached reads the cached document of a provider, unless its ranges
+// are already loaded
+func (r *Ranges) loadCached(provider string) ([]byte, error) {
+	if r.Loaded(provider) || r.cacheDir == "" {
+		return nil, fmt.Errorf("no cached %s ranges", provider)
+	}
+	data, err := os.ReadFile(r.cachePath(provider))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using cached %s ranges from %s", provider, r.cachePath(provider))
+	return data, nil
+}
+
+func (r *Ranges) cachePath(provider string) string {
+	if provider == config.ProviderBogons {
+		return filepath.Join(r.cacheDir, provider+".txt")
+	}
+	return filepath.Join(r.cacheDir, provider+".json")
+}
+
+// parse parses the document of a provider
+func parse(provider string, data []byte) ([]prefix, error) {
+	switch provider {
+	case config.ProviderAWS:
+		return parseAWS(data)
+	case config.ProviderGCP:
+		return parseGCP(data)
+	case config.ProviderAzure:
+		return parseAzure(data)
+	case config.ProviderBogons:
+		return parseBogons(data)
+	default:
+		return nil, fmt.Errorf("unknown provider %s", provider)
+	}
+}
+
+// parseAWS parses ip-ranges.json
+func parseAWS(data []byte) ([]prefix, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var prefixes []prefix
+	for _, p := range doc.Prefixes {
+		prefixes = append(prefixes, prefix{cidr: p.IPPrefix, service: p.Service, region: p.Region})
+	}
+	for _, p := range doc.IPv6Prefixes {
+		prefixes = append(prefixes, prefix{cidr: p.IPv6Prefix, service: p.Service, region: p.Region})
+	}
+	return prefixes, nil
+}
+
+// parseGCP parses cloud.json, the ranges of Google Cloud customers' resources
+func parseGCP(data []byte) ([]prefix, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var prefixes []prefix
+	for _, p := range doc.Prefixes {
+		for _, cidr := range []string{p.IPv4Prefix, p.IPv6Prefix} {
+			if cidr != "" {
+				prefixes = append(prefixes, prefix{cidr: cidr, service: p.Service, region: p.Scope})
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+// parseAzure parses a Service Tags file; the service of a prefix is its
+// tag, such as Storage.WestEurope
+func parseAzure(data []byte) ([]prefix, error) {
+	var doc struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var prefixes []prefix
+	for _, v := range doc.Values {
+		for _, cidr := range v.Properties.AddressPrefixes {
+			prefixes = append(prefixes, prefix{cidr: cidr, service: v.Name, region: v.Properties.Region})
+		}
+	}
+	return prefixes, nil
+}
+
+// parseBogons parses lists of prefixes, one per line, with # comments
+func parseBogons(data []byte) ([]prefix, error) {
+	var prefixes []prefix
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(line); err != nil {
+			return nil, fmt.Errorf("invalid prefix %q", line)
+		}
+		prefixes = append(prefixes, prefix{cidr: line})
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no prefixes")
+	}
+	return prefixes, nil
+}
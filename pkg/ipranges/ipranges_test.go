@@ -0,0 +1,127 @@
+package ipranges
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+const (
+	awsRanges = `{"prefixes": [
+		{"ip_prefix": "3.5.0.0/19", "region": "us-east-1", "service": "AMAZON"},
+		{"ip_prefix": "3.5.0.0/19", "region": "us-east-1", "service": "S3"},
+		{"ip_prefix": "52.95.0.0/20", "region": "eu-west-1", "service": "S3"}],
+		"ipv6_prefixes": [{"ipv6_prefix": "2600:1f18::/33", "region": "us-east-1", "service": "S3"}]}`
+	gcpRanges = `{"prefixes": [
+		{"ipv4Prefix": "34.1.208.0/20", "service": "Google Cloud", "scope": "africa-south1"},
+		{"ipv6Prefix": "2600:1900:8000::/44", "service": "Google Cloud", "scope": "us-east1"}]}`
+	azureRanges = `{"values": [
+		{"name": "Storage.WestEurope", "properties": {"region": "westeurope", "addressPrefixes": ["13.69.40.0/24", "2603:1020:206::/48"]}},
+		{"name": "AzureCloud.WestEurope", "properties": {"region": "westeurope", "addressPrefixes": ["13.69.0.0/17"]}}]}`
+)
+
+// TestExpand tests expanding groups of each provider
+func TestExpand(t *testing.T) {
+	docs := map[string]string{"/aws": awsRanges, "/gcp": gcpRanges, "/azure": azureRanges}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(docs[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	r := New(&config.IPRangesConfig{
+		CacheDir: cacheDir,
+		AWSURL:   server.URL + "/aws",
+		GCPURL:   server.URL + "/gcp",
+		AzureURL: server.URL + "/azure",
+	})
+	providers := []string{config.ProviderAWS, config.ProviderGCP, config.ProviderAzure}
+	changed, err := r.Fetch(context.Background(), providers)
+	if err != nil || len(changed) != 3 {
+		t.Fatalf("Expected all ranges to change, got %v (%v)", changed, err)
+	}
+	if changed, _ := r.Fetch(context.Background(), providers); len(changed) != 0 {
+		t.Errorf("Expected no change on a second fetch, got %v", changed)
+	}
+
+	testCases := []struct {
+		group string
+		want  []string
+	}{
+		{group: "@aws:s3", want: []string{"2600:1f18::/33", "3.5.0.0/19", "52.95.0.0/20"}},
+		{group: "@aws:s3:us-east-1", want: []string{"2600:1f18::/33", "3.5.0.0/19"}},
+		{group: "@aws:ec2:us-east-1", want: nil},
+		{group: "@gcp", want: []string{"2600:1900:8000::/44", "34.1.208.0/20"}},
+		{group: "@gcp:us-east1", want: []string{"2600:1900:8000::/44"}},
+		{group: "@azure:Storage.WestEurope", want: []string{"13.69.40.0/24", "2603:1020:206::/48"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.group, func(t *testing.T) {
+			group, err := config.ParseIPGroup(tc.group)
+			if err != nil {
+				t.Fatalf("Failed to parse group: %v", err)
+			}
+			if got := r.Expand(group); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	// A restart while the provider is unreachable uses the cached ranges
+	server.Close()
+	r = New(&config.IPRangesConfig{CacheDir: cacheDir, AWSURL: server.URL + "/aws"})
+	if _, err := r.Fetch(context.Background(), []string{config.ProviderAWS}); err == nil {
+		t.Error("Expected an error for an unreachable provider")
+	}
+	if got := r.Expand(config.IPGroup{Provider: config.ProviderAWS, Service: "S3", Region: "eu-west-1"}); !reflect.DeepEqual(got, []string{"52.95.0.0/20"}) {
+		t.Errorf("Expected the cached ranges, got %v", got)
+	}
+}
+
+// TestExpandBogons tests that @bogons is the default list until the full
+// bogons are downloaded, and that a broken download keeps the last list
+func TestExpandBogons(t *testing.T) {
+	docs := map[string]string{
+		"/ipv4": "# last updated 1760000000 (Wed Oct  8 08:53:20 2025 GMT)\n0.0.0.0/8\n2.56.8.0/22\n",
+		"/ipv6": "# last updated 1760000000 (Wed Oct  8 08:53:20 2025 GMT)\n::/8\n2001:db8::/32",
+	}
+	var broken atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if broken.Load() && r.URL.Path == "/ipv6" {
+			w.Write([]byte("<html>Service unavailable</html>"))
+			return
+		}
+		w.Write([]byte(docs[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	group, err := config.ParseIPGroup("@bogons")
+	if err != nil {
+		t.Fatalf("Failed to parse group: %v", err)
+	}
+	r := New(&config.IPRangesConfig{FullBogons: true, BogonsURLs: []string{server.URL + "/ipv4", server.URL + "/ipv6"}})
+	if got := r.Expand(group); len(got) != len(config.DefaultBogons) {
+		t.Errorf("Expected the default bogons, got %v", got)
+	}
+
+	if _, err := r.Fetch(context.Background(), []string{config.ProviderBogons}); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	want := []string{"0.0.0.0/8", "2.56.8.0/22", "2001:db8::/32", "::/8"}
+	if got := r.Expand(group); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	broken.Store(true)
+	if _, err := r.Fetch(context.Background(), []string{config.ProviderBogons}); err == nil {
+		t.Error("Expected an error for a broken document")
+	}
+	if got := r.Expand(group); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the last bogons %v, got %v", want, got)
+	}
+}
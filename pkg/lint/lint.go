@@ -0,0 +1,298 @@
+// Package lint checks a policy for rules that are likely mistakes or go
+// against best practice, such as rules that can never match, without
+// compiling or applying it
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// Names of the checks
+const (
+	// CheckShadowed flags rules an earlier rule matching all their traffic
+	// makes unreachable
+	CheckShadowed = "shadowed"
+	// CheckDenyAfterAllow flags deny rules an earlier allow rule matching all
+	// their traffic overrides
+	CheckDenyAfterAllow = "deny-after-allow"
+	// CheckOverlappingCIDRs flags egress ips or not_ips entries contained in
+	// another entry of the same rule, or ips entries contained in those of a
+	// rule with another action
+	CheckOverlappingCIDRs = "overlapping-cidrs"
+	// CheckAllowAllPorts flags allow rules that don't limit the ports
+	CheckAllowAllPorts = "allow-all-ports"
+	// CheckUnusedGroup flags port groups, profiles and BGP groups no rule
+	// names
+	CheckUnusedGroup = "unused-group"
+)
+
+// Checks lists the checks in the order findings are reported
+var Checks = []string{CheckShadowed, CheckDenyAfterAllow, CheckOverlappingCIDRs, CheckAllowAllPorts, CheckUnusedGroup}
+
+// Finding is a problem a check found
+type Finding struct {
+	Check string
+	// Rule the finding is about, "" for findings about the rest of the
+	// config
+	Rule    string
+	Message string
+}
+
+// String describes the finding, e.g. rule web-old: shadowed by web (order
+// 10), which matches all its traffic [shadowed]
+func (f Finding) String() string {
+	if f.Rule == "" {
+		return fmt.Sprintf("%s [%s]", f.Message, f.Check)
+	}
+	return fmt.Sprintf("rule %s: %s [%s]", f.Rule, f.Message, f.Check)
+}
+
+// Check runs the checks on a loaded config, whose rules are sorted and
+// whose port groups are expanded, returning the findings by check and
+// then in policy order. Disabled rules and those expired by now are
+// skipped, but still count as naming groups.
+func Check(cfg *config.Config, now time.Time) []Finding {
+	var active []config.Rule
+	for _, rule := range cfg.Rules {
+		if rule.IsEnabled() && !rule.Expired(now) {
+			active = append(active, rule)
+		}
+	}
+
+	var findings []Finding
+	findings = append(findings, shadowed(active)...)
+	findings = append(findings, overlappingCIDRs(active)...)
+	findings = append(findings, allowAllPorts(active)...)
+	findings = append(findings, unusedGroups(cfg)...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		return checkIndex(findings[i].Check) < checkIndex(findings[j].Check)
+	})
+	return findings
+}
+
+// checkIndex returns the position of check in Checks
+func checkIndex(check string) int {
+	for i, c := range Checks {
+		if c == check {
+			return i
+		}
+	}
+	return len(Checks)
+}
+
+// shadowed finds the rules an earlier rule covers. As the first matching
+// rule decides, they never match, and a deny rule behind an allow rule
+// never denies.
+func shadowed(rules []config.Rule) []Finding {
+	var findings []Finding
+	for j := range rules {
+		for i := 0; i < j; i++ {
+			if !rules[i].Covers(&rules[j]) {
+				continue
+			}
+			earlier := rules[i]
+			if earlier.Action == config.ActionAllow && rules[j].Action == config.ActionDeny {
+				findings = append(findings, Finding{
+					Check:   CheckDenyAfterAllow,
+					Rule:    rules[j].Name,
+					Message: fmt.Sprintf("never denies, as allow rule %s (order %d) accepts all its traffic first", earlier.Name, earlier.Order),
+				})
+			} else {
+				findings = append(findings, Finding{
+					Check:   CheckShadowed,
+					Rule:    rules[j].Name,
+					Message: fmt.Sprintf("shadowed by %s (order %d), which matches all its traffic", earlier.Name, earlier.Order),
+				})
+			}
+			break
+		}
+	}
+	return findings
+}
+
+// overlappingCIDRs finds the ips and not_ips entries of a rule that another
+// entry of the same list contains, the ips entries its not_ips exclude
+// entirely, and the ips entries within those of a rule with another action,
+// where which of them applies depends on their order
+func overlappingCIDRs(rules []config.Rule) []Finding {
+	var findings []Finding
+	for j, rule := range rules {
+		for _, list := range []struct {
+			name    string
+			entries []string
+		}{
+			{"ips", rule.Egress.IPs},
+			{"not_ips", rule.Egress.NotIPs},
+		} {
+			for j, inner := range list.entries {
+				for i, outer := range list.entries {
+					// Of duplicates, the later one is reported
+					if i == j || (outer == inner && i > j) || !config.NetworkContains(outer, inner) {
+						continue
+					}
+					findings = append(findings, Finding{
+						Check:   CheckOverlappingCIDRs,
+						Rule:    rule.Name,
+						Message: fmt.Sprintf("%s entry %s is within %s", list.name, inner, outer),
+					})
+					break
+				}
+			}
+		}
+		for _, ip := range rule.Egress.IPs {
+			for _, excluded := range rule.Egress.NotIPs {
+				if config.NetworkContains(excluded, ip) {
+					findings = append(findings, Finding{
+						Check:   CheckOverlappingCIDRs,
+						Rule:    rule.Name,
+						Message: fmt.Sprintf("ips entry %s is excluded entirely by not_ips %s", ip, excluded),
+					})
+					break
+				}
+			}
+		}
+		for _, ip := range rule.Egress.IPs {
+			if other, outer, ok := containingRule(rules, j, ip); ok {
+				findings = append(findings, Finding{
+					Check:   CheckOverlappingCIDRs,
+					Rule:    rule.Name,
+					Message: fmt.Sprintf("ips entry %s is within %s of %s rule %s (order %d)", ip, outer, other.Action, other.Name, other.Order),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// containingRule returns the first rule other than rules[j], with another
+// action, one of whose ips entries contains ip, and that entry
+func containingRule(rules []config.Rule, j int, ip string) (config.Rule, string, bool) {
+	for i, other := range rules {
+		if i == j || other.Action == rules[j].Action {
+			continue
+		}
+		for _, outer := range other.Egress.IPs {
+			if config.NetworkContains(outer, ip) {
+				return other, outer, true
+			}
+		}
+	}
+	return config.Rule{}, "", false
+}
+
+// allowAllPorts finds the allow rules accepting TCP or UDP on every port,
+// unless limited to application protocols
+func allowAllPorts(rules []config.Rule) []Finding {
+	var findings []Finding
+	for _, rule := range rules {
+		if rule.Action != config.ActionAllow {
+			continue
+		}
+		branches, err := rule.Egress.Branches()
+		if err != nil {
+			continue
+		}
+		for _, branch := range branches {
+			if len(branch.Ports) > 0 || len(branch.L7) > 0 || !matchesPorts(branch.Protocols) {
+				continue
+			}
+			destinations := "its destinations"
+			if len(branch.Domains) == 0 && len(branch.IPs) == 0 && len(branch.Services) == 0 && len(branch.ASNs) == 0 {
+				destinations = "any destination"
+			}
+			findings = append(findings, Finding{
+				Check:   CheckAllowAllPorts,
+				Rule:    rule.Name,
+				Message: fmt.Sprintf("allows all ports of %s; list the ports it needs", destinations),
+			})
+			break
+		}
+	}
+	return findings
+}
+
+// matchesPorts reports whether protocols include one with ports, as all
+// protocols do
+func matchesPorts(protocols []config.Protocol) bool {
+	if len(protocols) == 0 {
+		return true
+	}
+	for _, proto := range protocols {
+		if proto == config.ProtocolTCP || proto == config.ProtocolUDP {
+			return true
+		}
+	}
+	return false
+}
+
+// unusedGroups finds the port groups, profiles and BGP groups no rule, nor
+// maintenance rule, names
+func unusedGroups(cfg *config.Config) []Finding {
+	rules := cfg.Rules
+	if cfg.Maintenance != nil {
+		rules = append(append([]config.Rule(nil), rules...), cfg.Maintenance.Rules...)
+	}
+	used := make(map[string]bool)
+	for _, rule := range rules {
+		for _, group := range rule.Egress.PortGroups {
+			used["port group "+group] = true
+		}
+		if rule.Profile != "" {
+			used["profile "+rule.Profile] = true
+		}
+		for _, ip := range rule.Egress.IPs {
+			if !config.IsIPGroup(ip) {
+				continue
+			}
+			if group, err := config.ParseIPGroup(ip); err == nil && group.Provider == config.ProviderBGP {
+				used["bgp group "+group.Service] = true
+			}
+		}
+	}
+
+	var defined []string
+	for name := range cfg.PortGroups {
+		defined = append(defined, "port group "+name)
+	}
+	sort.Strings(defined)
+	for _, profile := range cfg.Profiles {
+		defined = append(defined, "profile "+profile.Name)
+	}
+	if cfg.BGP != nil {
+		for _, group := range cfg.BGP.Groups {
+			defined = append(defined, "bgp group "+group.Name)
+		}
+	}
+
+	var findings []Finding
+	for _, group := range defined {
+		if !used[group] {
+			findings = append(findings, Finding{
+				Check:   CheckUnusedGroup,
+				Message: fmt.Sprintf("%s is not named by any rule", group),
+			})
+		}
+	}
+	return findings
+}
+
+// ParseChecks parses a comma-separated list of checks into a set
+func ParseChecks(s string) (map[string]bool, error) {
+	checks := make(map[string]bool)
+	for _, check := range strings.Split(s, ",") {
+		check = strings.TrimSpace(check)
+		if check == "" {
+			continue
+		}
+		if checkIndex(check) == len(Checks) {
+			return nil, fmt.Errorf("unknown check %q: use %s", check, strings.Join(Checks, ", "))
+		}
+		checks[check] = true
+	}
+	return checks, nil
+}
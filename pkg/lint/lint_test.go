@@ -0,0 +1,113 @@
+package lint
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// TestCheck tests the findings of each check on a policy
+func TestCheck(t *testing.T) {
+	cfg, err := config.Parse([]byte(`version: "1.0"
+port_groups:
+  web: tcp/80,443
+  mail: tcp/25,587
+profiles:
+  - name: ci
+    sources: [10.0.9.0/24]
+rules:
+  - name: deny-lab
+    action: deny
+    order: 5
+    egress:
+      ips: ["10.1.0.0/16"]
+  - name: web
+    action: allow
+    order: 10
+    egress:
+      ips: ["192.0.2.0/24", "192.0.2.128/25"]
+      ports: [web]
+  - name: web-host
+    action: allow
+    order: 20
+    egress:
+      protocols: [tcp]
+      ips: ["192.0.2.7"]
+      ports: ["443"]
+  - name: block-host
+    action: deny
+    order: 30
+    egress:
+      protocols: [tcp]
+      ips: ["192.0.2.9"]
+      ports: ["80"]
+  - name: old-web
+    action: allow
+    order: 35
+    enabled: false
+    egress:
+      protocols: [tcp]
+      ips: ["192.0.2.10"]
+      ports: ["80"]
+  - name: internal
+    action: allow
+    order: 40
+    egress:
+      ips: ["10.0.0.0/8", "10.2.0.0/16"]
+      not_ips: ["10.2.0.0/16"]
+  - name: icmp
+    action: allow
+    order: 50
+    egress:
+      protocols: [icmp]
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	var got []string
+	for _, finding := range Check(cfg, time.Now()) {
+		got = append(got, finding.String())
+	}
+	want := []string{
+		"rule web-host: shadowed by web (order 10), which matches all its traffic [shadowed]",
+		"rule block-host: never denies, as allow rule web (order 10) accepts all its traffic first [deny-after-allow]",
+		"rule deny-lab: ips entry 10.1.0.0/16 is within 10.0.0.0/8 of allow rule internal (order 40) [overlapping-cidrs]",
+		"rule web: ips entry 192.0.2.128/25 is within 192.0.2.0/24 [overlapping-cidrs]",
+		"rule block-host: ips entry 192.0.2.9 is within 192.0.2.0/24 of allow rule web (order 10) [overlapping-cidrs]",
+		"rule internal: ips entry 10.2.0.0/16 is within 10.0.0.0/8 [overlapping-cidrs]",
+		"rule internal: ips entry 10.2.0.0/16 is excluded entirely by not_ips 10.2.0.0/16 [overlapping-cidrs]",
+		"rule internal: allows all ports of its destinations; list the ports it needs [allow-all-ports]",
+		"port group mail is not named by any rule [unused-group]",
+		"profile ci is not named by any rule [unused-group]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected findings:\n%q\ngot:\n%q", want, got)
+	}
+}
+
+// TestParseChecks tests parsing the checks to skip
+func TestParseChecks(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{value: "", want: map[string]bool{}},
+		{value: "shadowed, unused-group", want: map[string]bool{CheckShadowed: true, CheckUnusedGroup: true}},
+		{value: "shadowed,typo", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := ParseChecks(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseChecks() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
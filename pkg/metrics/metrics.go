@@ -0,0 +1,160 @@
+// Package metrics keeps samples of the router's counters in memory and turns
+// them into time series of how much each counted per interval, for
+// dashboards without a Prometheus to scrape the router.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultInterval is how often counters are sampled unless configured
+	DefaultInterval = time.Minute
+	// DefaultRetention is how long samples are kept unless configured
+	DefaultRetention = 24 * time.Hour
+
+	// Bounds the samples kept, whatever the interval and retention
+	maxSamples = 100000
+)
+
+// Sample is the value of each counter at a time, by series name. Series
+// named "<aggregate>:<name>" are also summed into the aggregate series.
+type Sample struct {
+	Time     time.Time
+	Counters map[string]uint64
+}
+
+// Point is how much a series counted over the step starting at Time
+type Point struct {
+	Time  time.Time
+	Value uint64
+}
+
+// Recorder keeps the samples of the retention period
+type Recorder struct {
+	interval time.Duration
+
+	mu      sync.RWMutex
+	samples []Sample // Oldest first, at most size
+	size    int
+}
+
+// NewRecorder creates a Recorder for samples taken every interval and kept
+// for retention
+func NewRecorder(interval, retention time.Duration) *Recorder {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	size := int(retention / interval)
+	if size < 2 {
+		size = 2
+	} else if size > maxSamples {
+		size = maxSamples
+	}
+	return &Recorder{interval: interval, size: size}
+}
+
+// Interval returns how often samples are taken
+func (r *Recorder) Interval() time.Duration {
+	return r.interval
+}
+
+// Add records a sample, dropping the oldest beyond the retention
+func (r *Recorder) Add(sample Sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.samples) >= r.size {
+		copy(r.samples, r.samples[1:])
+		r.samples = r.samples[:len(r.samples)-1]
+	}
+	r.samples = append(r.samples, sample)
+}
+
+// Names returns the series of the kept samples and their aggregates, sorted
+func (r *Recorder) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, sample := range r.samples {
+		for name := range sample.Counters {
+			seen[name] = true
+			if aggregate, _, ok := strings.Cut(name, ":"); ok {
+				seen[aggregate] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Query returns how much the series name counted over each step from from
+// to to; steps shorter than the interval are widened to it. A counter that
+// went down between samples, as rule counters do when the policy is
+// reloaded, is taken to have restarted from zero.
+func (r *Recorder) Query(name string, from, to time.Time, step time.Duration) []Point {
+	if step < r.interval {
+		step = r.interval
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	points := []Point{}
+	for i := 1; i < len(r.samples); i++ {
+		sample := r.samples[i]
+		if sample.Time.Before(from) || sample.Time.After(to) {
+			continue
+		}
+		value, ok := delta(r.samples[i-1], sample, name)
+		if !ok {
+			continue
+		}
+		start := from.Add(sample.Time.Sub(from).Truncate(step))
+		if n := len(points); n > 0 && points[n-1].Time.Equal(start) {
+			points[n-1].Value += value
+			continue
+		}
+		points = append(points, Point{Time: start, Value: value})
+	}
+	return points
+}
+
+// delta returns how much name counted from prev to cur, summing the series
+// of an aggregate, and whether cur has the series
+func delta(prev, cur Sample, name string) (uint64, bool) {
+	if value, ok := cur.Counters[name]; ok {
+		return counterDelta(prev.Counters, name, value), true
+	}
+
+	prefix := name + ":"
+	var sum uint64
+	found := false
+	for series, value := range cur.Counters {
+		if strings.HasPrefix(series, prefix) {
+			sum += counterDelta(prev.Counters, series, value)
+			found = true
+		}
+	}
+	return sum, found
+}
+
+// counterDelta returns how much a series counted up to value since the
+// previous sample
+func counterDelta(prev map[string]uint64, series string, value uint64) uint64 {
+	last, ok := prev[series]
+	if !ok || value < last {
+		return value
+	}
+	return value - last
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	r := NewRecorder(time.Minute, time.Hour)
+	for i, counters := range []map[string]uint64{
+		{"allowed:web": 10, "allowed:dns": 5, "unmatched": 1},
+		{"allowed:web": 30, "allowed:dns": 6, "unmatched": 1},
+		{"allowed:web": 35, "allowed:dns": 10, "unmatched": 4},
+		// Reloaded: the rule counters restarted and dns was removed
+		{"allowed:web": 2, "unmatched": 4},
+		{"allowed:web": 12, "unmatched": 7},
+	} {
+		r.Add(Sample{Time: base.Add(time.Duration(i) * time.Minute), Counters: counters})
+	}
+
+	point := func(minute int, value uint64) Point {
+		return Point{Time: base.Add(time.Duration(minute) * time.Minute), Value: value}
+	}
+
+	testCases := []struct {
+		name   string
+		series string
+		from   time.Time
+		step   time.Duration
+		want   []Point
+	}{
+		{
+			name:   "series",
+			series: "allowed:web",
+			from:   base,
+			want:   []Point{point(1, 20), point(2, 5), point(3, 2), point(4, 10)},
+		},
+		{
+			name:   "aggregate",
+			series: "allowed",
+			from:   base,
+			want:   []Point{point(1, 21), point(2, 9), point(3, 2), point(4, 10)},
+		},
+		{
+			name:   "wider step",
+			series: "allowed:web",
+			from:   base,
+			step:   2 * time.Minute,
+			want:   []Point{point(0, 20), point(2, 7), point(4, 10)},
+		},
+		{
+			name:   "from",
+			series: "allowed:web",
+			from:   base.Add(3 * time.Minute),
+			want:   []Point{point(3, 2), point(4, 10)},
+		},
+		{
+			name:   "unknown",
+			series: "denied",
+			from:   base,
+			want:   []Point{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := r.Query(tc.series, tc.from, base.Add(time.Hour), tc.step)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	wantNames := []string{"allowed", "allowed:dns", "allowed:web", "unmatched"}
+	if got := r.Names(); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("Expected names %v, got %v", wantNames, got)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	r := NewRecorder(time.Minute, 3*time.Minute)
+	for i := 0; i < 10; i++ {
+		r.Add(Sample{Time: base.Add(time.Duration(i) * time.Minute), Counters: map[string]uint64{"unmatched": uint64(i)}})
+	}
+
+	got := r.Query("unmatched", base, base.Add(time.Hour), 0)
+	want := []Point{{Time: base.Add(8 * time.Minute), Value: 1}, {Time: base.Add(9 * time.Minute), Value: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the last 3 samples kept, got points %v", got)
+	}
+}
@@ -0,0 +1,32 @@
+package network
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenNetNS opens a network namespace by path, e.g. /var/run/netns/<name>
+// or /proc/<pid>/ns/net
+func OpenNetNS(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace %s: %w", path, err)
+	}
+	nstype, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a namespace: %w", path, err)
+	}
+	if nstype != unix.CLONE_NEWNET {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a network namespace", path)
+	}
+	return f, nil
+}
+
+// NetNSPath returns the path of the network namespace of a process
+func NetNSPath(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// OriginalDestination returns the destination conntrack translated to the
+// local address of a redirected TCP connection, or nil if it wasn't
+// translated. The kernel answers with a sockaddr_in or sockaddr_in6, read
+// here through the getsockopt helpers of structs large enough to hold them.
+func OriginalDestination(c net.Conn) *net.TCPAddr {
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	local, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var dst *net.TCPAddr
+	raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				return
+			}
+			// Family and port, then the address
+			addr := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+				Port: int(addr[2])<<8 | int(addr[3]),
+			}
+		} else {
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				return
+			}
+			// The port is in network byte order in memory
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+		}
+	})
+	// Connections to the listener itself keep their destination
+	if dst == nil || (dst.IP.Equal(local.IP) && dst.Port == local.Port) {
+		return nil
+	}
+	return dst
+}
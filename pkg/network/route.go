@@ -0,0 +1,89 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Route describes a static route
+type Route struct {
+	Destination *net.IPNet
+	Gateway     net.IP // Next hop, nil for on-link routes
+	Interface   string // Outgoing interface, optional with a gateway
+	Metric      int
+	Table       uint32 // 0 for the main table
+}
+
+// String returns the route the way ip route shows it
+func (r Route) String() string {
+	s := r.Destination.String()
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Interface != "" {
+		s += " dev " + r.Interface
+	}
+	if r.Metric != 0 {
+		s += fmt.Sprintf(" metric %d", r.Metric)
+	}
+	if r.Table != 0 {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+// EnsureRoute installs a route, replacing one to the same destination with
+// the same metric
+func EnsureRoute(r Route) error {
+	route, err := netlinkRoute(r)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add route %s: %w", r, err)
+	}
+	return nil
+}
+
+// DeleteRoute removes a route installed by EnsureRoute; a route that is
+// already gone, e.g. with its interface, is not an error
+func DeleteRoute(r Route) error {
+	route, err := netlinkRoute(r)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete route %s: %w", r, err)
+	}
+	return nil
+}
+
+// netlinkRoute converts r, looking up its interface
+func netlinkRoute(r Route) (*netlink.Route, error) {
+	route := &netlink.Route{
+		Dst:      r.Destination,
+		Gw:       r.Gateway,
+		Priority: r.Metric,
+		Table:    int(r.Table),
+		Protocol: unix.RTPROT_STATIC,
+	}
+	if r.Gateway == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	if r.Interface != "" {
+		link, err := netlink.LinkByName(r.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %w", r.Interface, err)
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	return route, nil
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// VLAN describes an 802.1Q subinterface
+type VLAN struct {
+	ID        uint16
+	Parent    string   // Trunk interface
+	Name      string   // Subinterface name
+	Addresses []string // CIDR addresses assigned to the subinterface
+}
+
+// EnsureVLAN creates a VLAN subinterface if it does not exist, assigns its
+// addresses and brings it up. It reports whether the interface was created.
+func EnsureVLAN(v VLAN) (bool, error) {
+	link, err := netlink.LinkByName(v.Name)
+	if err == nil {
+		if vlan, ok := link.(*netlink.Vlan); !ok || vlan.VlanId != int(v.ID) {
+			return false, fmt.Errorf("interface %s exists but is not VLAN %d", v.Name, v.ID)
+		}
+		return false, configureLink(link, v.Addresses)
+	}
+	var notFound netlink.LinkNotFoundError
+	if !errors.As(err, &notFound) {
+		return false, fmt.Errorf("failed to look up %s: %w", v.Name, err)
+	}
+
+	parent, err := netlink.LinkByName(v.Parent)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up parent interface %s: %w", v.Parent, err)
+	}
+	link = &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        v.Name,
+			ParentIndex: parent.Attrs().Index,
+		},
+		VlanId:       int(v.ID),
+		VlanProtocol: netlink.VLAN_PROTOCOL_8021Q,
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", v.Name, err)
+	}
+	log.Printf("Created VLAN %d subinterface %s on %s", v.ID, v.Name, v.Parent)
+
+	return true, configureLink(link, v.Addresses)
+}
+
+// CheckVLAN verifies that an existing subinterface carries VLAN id
+func CheckVLAN(v VLAN) error {
+	link, err := netlink.LinkByName(v.Name)
+	if err != nil {
+		return fmt.Errorf("VLAN %d interface %s not found: %w", v.ID, v.Name, err)
+	}
+	if vlan, ok := link.(*netlink.Vlan); !ok || vlan.VlanId != int(v.ID) {
+		return fmt.Errorf("interface %s is not VLAN %d", v.Name, v.ID)
+	}
+	return nil
+}
+
+// DeleteLink removes an interface created by EnsureVLAN
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// configureLink assigns addresses to a link and brings it up
+func configureLink(link netlink.Link, addresses []string) error {
+	for _, a := range addresses {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			return fmt.Errorf("invalid address %s: %w", a, err)
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add %s to %s: %w", a, link.Attrs().Name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
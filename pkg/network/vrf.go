@@ -0,0 +1,94 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+)
+
+// VRF describes a VRF device and its member interfaces
+type VRF struct {
+	Name       string
+	Table      uint32
+	Interfaces []string // Enslaved to the VRF
+}
+
+// EnsureVRF creates a VRF device if it does not exist, enslaves its
+// interfaces and brings it up. It reports whether the device was created.
+func EnsureVRF(v VRF) (bool, error) {
+	created := false
+	link, err := netlink.LinkByName(v.Name)
+	if err == nil {
+		if vrf, ok := link.(*netlink.Vrf); !ok || vrf.Table != v.Table {
+			return false, fmt.Errorf("interface %s exists but is not a VRF with table %d", v.Name, v.Table)
+		}
+	} else {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return false, fmt.Errorf("failed to look up %s: %w", v.Name, err)
+		}
+		link = &netlink.Vrf{
+			LinkAttrs: netlink.LinkAttrs{Name: v.Name},
+			Table:     v.Table,
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return false, fmt.Errorf("failed to create %s: %w", v.Name, err)
+		}
+		// Reload to learn the index assigned by the kernel
+		if link, err = netlink.LinkByName(v.Name); err != nil {
+			return true, fmt.Errorf("failed to look up %s: %w", v.Name, err)
+		}
+		created = true
+		log.Printf("Created VRF %s with table %d", v.Name, v.Table)
+	}
+
+	for _, name := range v.Interfaces {
+		member, err := netlink.LinkByName(name)
+		if err != nil {
+			return created, fmt.Errorf("failed to look up %s: %w", name, err)
+		}
+		if member.Attrs().MasterIndex == link.Attrs().Index {
+			continue
+		}
+		if err := netlink.LinkSetMasterByIndex(member, link.Attrs().Index); err != nil {
+			return created, fmt.Errorf("failed to add %s to VRF %s: %w", name, v.Name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return created, fmt.Errorf("failed to bring up %s: %w", v.Name, err)
+	}
+	return created, nil
+}
+
+// CheckVRF verifies that an existing device is a VRF
+func CheckVRF(v VRF) error {
+	link, err := netlink.LinkByName(v.Name)
+	if err != nil {
+		return fmt.Errorf("VRF %s not found: %w", v.Name, err)
+	}
+	if _, ok := link.(*netlink.Vrf); !ok {
+		return fmt.Errorf("interface %s is not a VRF", v.Name)
+	}
+	return nil
+}
+
+// VRFMembers returns the names of the interfaces enslaved to a VRF
+func VRFMembers(name string) ([]string, error) {
+	vrf, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	var members []string
+	for _, link := range links {
+		if link.Attrs().MasterIndex == vrf.Attrs().Index {
+			members = append(members, link.Attrs().Name)
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,352 @@
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	banChainName         = "ban"
+	banChainPrefix       = "ban_"
+	bannedSetName        = "banned"         // IPv4 banned sources
+	banned6SetName       = "banned6"        // IPv6 banned sources
+	banOffendersSetName  = "ban_offenders"  // IPv4 sources and their denied rates
+	banOffenders6SetName = "ban_offenders6" // IPv6 sources and their denied rates
+	banExemptSetName     = "ban_exempt"     // IPv4 sources never banned
+	banExempt6SetName    = "ban_exempt6"    // IPv6 sources never banned
+)
+
+// Ban is how SetBan bans repeat offenders
+type Ban struct {
+	// Threshold is the number of denied packets a source may send within
+	// Window before it is banned for Duration
+	Threshold uint32
+	Window    time.Duration
+	Duration  time.Duration
+	// Exempt sources are never banned (IPs or CIDRs)
+	Exempt []string
+}
+
+// BannedSource is a banned source and the time left of its ban
+type BannedSource struct {
+	IP      net.IP
+	Expires time.Duration
+}
+
+// SetBan bans the sources hitting deny rules too often from the next
+// Setup, nil turns it off. Packets no rule matched don't count. Canary
+// tables and log-only policies don't ban.
+func (m *Manager) SetBan(ban *Ban) {
+	m.ban = ban
+}
+
+// banning reports whether sources hitting deny rules get banned
+func (m *Manager) banning() bool {
+	return m.ban != nil && !m.canary && !m.logOnly
+}
+
+// rate returns the rate of denied packets a source may send, approximated
+// in the largest unit nft names within the window
+func (b *Ban) rate() Rate {
+	per := time.Second
+	for _, unit := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour} {
+		if unit <= b.Window {
+			per = unit
+		}
+	}
+	window := b.Window
+	if window < time.Second {
+		window = time.Second
+	}
+	count := (uint64(b.Threshold)*uint64(per) + uint64(window) - 1) / uint64(window)
+	if count == 0 {
+		count = 1
+	}
+	return Rate{Count: count, Per: per}
+}
+
+// setupBan creates the sets of the banned sources and offenders, and a
+// base chain of its own ahead of all others dropping the banned sources
+func (m *Manager) setupBan() error {
+	if !m.banning() {
+		return nil
+	}
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     banChainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  m.hook(),
+		Priority: m.banPriority(),
+	})
+
+	v4, v6, err := m.addressRanges(m.ban.Exempt)
+	if err != nil {
+		return fmt.Errorf("invalid ban exemption: %w", err)
+	}
+	// An offender's count is forgotten once it is idle for a window, by
+	// when its bucket would have refilled anyway
+	offendersTimeout := m.ban.Window
+	if offendersTimeout < time.Second {
+		offendersTimeout = time.Second
+	}
+	banned, offenders := &ruleSets{}, &ruleSets{}
+	var exempt *ruleSets
+	if len(v4) > 0 || len(v6) > 0 {
+		exempt = &ruleSets{ranges4: v4, ranges6: v6}
+	}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		if !m.carries(family) {
+			continue
+		}
+		bannedName, offendersName, exemptName, exemptRanges := bannedSetName, banOffendersSetName, banExemptSetName, v4
+		if family == familyIPv6 {
+			bannedName, offendersName, exemptName, exemptRanges = banned6SetName, banOffenders6SetName, banExempt6SetName, v6
+		}
+		for _, s := range []struct {
+			sets    *ruleSets
+			name    string
+			timeout time.Duration
+		}{
+			{banned, bannedName, m.ban.Duration},
+			{offenders, offendersName, offendersTimeout},
+		} {
+			set := &nftables.Set{
+				Table:      m.table,
+				Name:       s.name,
+				KeyType:    family.keyType,
+				HasTimeout: true,
+				Timeout:    s.timeout,
+				Dynamic:    true,
+			}
+			if err := m.conn.AddSet(set, nil); err != nil {
+				return fmt.Errorf("failed to create %s ban set: %w", family.name, err)
+			}
+			s.sets.set(family, set)
+		}
+		if exempt != nil {
+			set, err := m.addRangeSet(exemptName, family, exemptRanges)
+			if err != nil {
+				return fmt.Errorf("failed to create %s ban exempt set: %w", family.name, err)
+			}
+			exempt.set(family, set)
+		}
+
+		set := banned.v4
+		if family == familyIPv6 {
+			set = banned.v6
+		}
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+				sourceExpression(family),
+				&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+	}
+	m.banChain, m.bannedSets, m.banOffenders, m.banExemptSets = chain, banned, offenders, exempt
+	log.Printf("Banning sources denied %d times within %s for %s, %d exempt sources",
+		m.ban.Threshold, m.ban.Window, m.ban.Duration, len(m.ban.Exempt))
+	return nil
+}
+
+// sourceExpression loads the source address of a packet of family
+func sourceExpression(family addrFamily) *expr.Payload {
+	return &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       family.saddrOffset,
+		Len:          family.addrLen,
+	}
+}
+
+// offenderChain returns the chain a deny with verdict goes to, adding it on
+// first use: the rate of the source's denied packets is updated, banning
+// it beyond the threshold, and the packet gets the verdict
+func (m *Manager) offenderChain(kind string, verdict []expr.Any) string {
+	name := banChainPrefix + kind
+	if _, ok := m.banChains[name]; ok {
+		return name
+	}
+	if m.banChains == nil {
+		m.banChains = make(map[string]*nftables.Chain)
+	}
+	chain := m.conn.AddChain(&nftables.Chain{Name: name, Table: m.table})
+	m.banChains[name] = chain
+
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		if !m.carries(family) {
+			continue
+		}
+		banned, offenders := m.bannedSets.v4, m.banOffenders.v4
+		if family == familyIPv6 {
+			banned, offenders = m.bannedSets.v6, m.banOffenders.v6
+		}
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		}
+		if m.banExemptSets != nil {
+			exempt := m.banExemptSets.v4
+			if family == familyIPv6 {
+				exempt = m.banExemptSets.v6
+			}
+			exprs = append(exprs,
+				sourceExpression(family),
+				&expr.Lookup{SourceRegister: 1, SetName: exempt.Name, SetID: exempt.ID, Invert: true},
+			)
+		}
+		// The update ends the rule unless the source is beyond its rate
+		exprs = append(exprs,
+			sourceExpression(family),
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   offenders.Name,
+				SetID:     offenders.ID,
+				Operation: unix.NFT_DYNSET_OP_UPDATE,
+				Exprs:     []expr.Any{m.ban.rate().limit(m.ban.Threshold)},
+			},
+			sourceExpression(family),
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   banned.Name,
+				SetID:     banned.ID,
+				Operation: unix.NFT_DYNSET_OP_ADD,
+			},
+		)
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: exprs})
+	}
+	m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: verdict})
+	return name
+}
+
+// BannedSources returns the banned sources, the soonest to expire first
+func (m *Manager) BannedSources() ([]BannedSource, error) {
+	if m.bannedSets == nil {
+		return nil, nil
+	}
+	var banned []BannedSource
+	for _, set := range []*nftables.Set{m.bannedSets.v4, m.bannedSets.v6} {
+		if set == nil {
+			continue
+		}
+		elements, err := m.conn.GetSetElements(set)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list banned sources: %w", err)
+		}
+		for _, element := range elements {
+			banned = append(banned, BannedSource{IP: net.IP(element.Key), Expires: element.Expires})
+		}
+	}
+	sort.Slice(banned, func(i, j int) bool {
+		return banned[i].Expires < banned[j].Expires
+	})
+	return banned, nil
+}
+
+// RestoreBans bans sources again for the time left of their bans, after
+// the table was recreated
+func (m *Manager) RestoreBans(banned []BannedSource) error {
+	if m.bannedSets == nil || len(banned) == 0 {
+		return nil
+	}
+	for _, b := range banned {
+		set, key, err := m.banElement(m.bannedSets, b.IP)
+		if err != nil {
+			return err
+		}
+		if err := m.conn.SetAddElements(set, []nftables.SetElement{{Key: key, Timeout: b.Expires}}); err != nil {
+			return fmt.Errorf("failed to restore ban of %s: %w", b.IP, err)
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to restore bans: %w", err)
+	}
+	return nil
+}
+
+// Unban lifts the ban of ip before it expires, and forgets its denied
+// packets so that it isn't banned again on the next one
+func (m *Manager) Unban(ip net.IP) error {
+	if m.bannedSets == nil {
+		return fmt.Errorf("banning is not set up")
+	}
+	for _, sets := range []*ruleSets{m.bannedSets, m.banOffenders} {
+		set, key, err := m.banElement(sets, ip)
+		if err != nil {
+			return err
+		}
+		elements, err := m.conn.GetSetElements(set)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", set.Name, err)
+		}
+		found := false
+		for _, element := range elements {
+			if bytes.Equal(element.Key, key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if sets == m.bannedSets {
+				return fmt.Errorf("%s is not banned", ip)
+			}
+			continue
+		}
+		if err := m.conn.SetDeleteElements(set, []nftables.SetElement{{Key: key}}); err != nil {
+			return fmt.Errorf("failed to unban %s: %w", ip, err)
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to unban %s: %w", ip, err)
+	}
+	return nil
+}
+
+// banElement returns the set of sets and element key for ip
+func (m *Manager) banElement(sets *ruleSets, ip net.IP) (*nftables.Set, []byte, error) {
+	set, key := sets.v4, []byte(ip.To4())
+	if key == nil {
+		set, key = sets.v6, []byte(ip.To16())
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	if set == nil {
+		return nil, nil, fmt.Errorf("the table doesn't carry %s", ip)
+	}
+	return set, key, nil
+}
+
+// BanDrops returns the number of packets of banned sources dropped, or 0
+// if banning is not set up
+func (m *Manager) BanDrops() (uint64, error) {
+	if m.banChain == nil {
+		return 0, nil
+	}
+	rules, err := m.conn.GetRules(m.table, m.banChain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read ban counters: %w", err)
+	}
+	var packets uint64
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				packets += counter.Packets
+			}
+		}
+	}
+	return packets, nil
+}
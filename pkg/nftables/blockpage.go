@@ -0,0 +1,155 @@
+package nftables
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	blockPageSetName     = "blockpage"  // IPv4 source . destination of denied HTTP
+	blockPage6SetName    = "blockpage6" // IPv6 source . destination of denied HTTP
+	blockPageChainPrefix = "blockpage_"
+	// How long the connections of a client to a destination it was denied
+	// go to the block page
+	blockPageTimeout = time.Minute
+	httpPort         = 80
+)
+
+// SetBlockPage redirects denied HTTP connections to port on the router,
+// where the block page is served, from the next Setup; 0 turns it off. A
+// deny drops the first packet of a connection to port 80 and records its
+// source and destination, so that the client's retry is redirected. Canary
+// and namespace tables don't redirect.
+func (m *Manager) SetBlockPage(port uint16) {
+	m.blockPagePort = port
+}
+
+// blockPage reports whether denied HTTP goes to the block page
+func (m *Manager) blockPage() bool {
+	return m.blockPagePort != 0 && !m.local() && !m.canary && !m.logOnly
+}
+
+// setupBlockPage creates the timed sets of the denied HTTP connections and
+// the rules redirecting them in the prerouting chain
+func (m *Manager) setupBlockPage(prerouting *nftables.Chain) error {
+	if !m.blockPage() {
+		return nil
+	}
+	m.blockPageSets = &ruleSets{}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		if !m.carries(family) {
+			continue
+		}
+		name := blockPageSetName
+		if family.nfproto == unix.NFPROTO_IPV6 {
+			name = blockPage6SetName
+		}
+		set := &nftables.Set{
+			Table:         m.table,
+			Name:          name,
+			KeyType:       nftables.MustConcatSetType(family.keyType, family.keyType),
+			Concatenation: true,
+			HasTimeout:    true,
+			Timeout:       blockPageTimeout,
+			Dynamic:       true,
+		}
+		if err := m.conn.AddSet(set, nil); err != nil {
+			return fmt.Errorf("failed to create %s block page set: %w", family.name, err)
+		}
+		m.blockPageSets.set(family, set)
+
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		}
+		exprs = append(exprs, protocolPortExpressions(unix.IPPROTO_TCP, httpPort)...)
+		exprs = append(exprs, addressPairExpressions(family)...)
+		exprs = append(exprs,
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+			&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(m.blockPagePort)},
+			&expr.Redir{RegisterProtoMin: 1},
+		)
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: prerouting, Exprs: exprs})
+	}
+	return nil
+}
+
+// addressPairExpressions loads the source and destination address of a
+// packet into adjacent registers, for a concatenated lookup
+func addressPairExpressions(family addrFamily) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       family.saddrOffset,
+			Len:          family.addrLen,
+		},
+		&expr.Payload{
+			DestRegister: portRegister(family),
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       family.daddrOffset,
+			Len:          family.addrLen,
+		},
+	}
+}
+
+// blockPageChain returns the chain a deny with verdict goes to, adding it
+// on first use: HTTP connections are recorded for the redirect and
+// dropped, so that the client retries, and other traffic gets the verdict
+func (m *Manager) blockPageChain(kind string, verdict []expr.Any) string {
+	name := blockPageChainPrefix + kind
+	if _, ok := m.blockPageChains[name]; ok {
+		return name
+	}
+	if m.blockPageChains == nil {
+		m.blockPageChains = make(map[string]*nftables.Chain)
+	}
+	chain := m.conn.AddChain(&nftables.Chain{Name: name, Table: m.table})
+	m.blockPageChains[name] = chain
+
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		if !m.carries(family) {
+			continue
+		}
+		set := m.blockPageSets.v4
+		if family.nfproto == unix.NFPROTO_IPV6 {
+			set = m.blockPageSets.v6
+		}
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		}
+		exprs = append(exprs, protocolPortExpressions(unix.IPPROTO_TCP, httpPort)...)
+		exprs = append(exprs, addressPairExpressions(family)...)
+		exprs = append(exprs,
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   set.Name,
+				SetID:     set.ID,
+				Operation: unix.NFT_DYNSET_OP_UPDATE,
+			},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: exprs})
+	}
+	m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: verdict})
+	return name
+}
+
+// clearBlockPage forgets the denied HTTP connections, so that clients
+// reach what a grant opened without waiting for the redirect to time out
+func (m *Manager) clearBlockPage() {
+	if m.blockPageSets == nil {
+		return
+	}
+	for _, set := range []*nftables.Set{m.blockPageSets.v4, m.blockPageSets.v6} {
+		if set != nil {
+			m.conn.FlushSet(set)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package nftables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BranchName returns the name the sets of a branch of a rule go by, for
+// UpdateIPs and the like; the first branch's are the rule's own
+func BranchName(name string, branch int) string {
+	if branch == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s#%d", name, branch)
+}
+
+// setsName returns the name the sets of a rule go by
+func (r Rule) setsName() string {
+	return BranchName(r.Name, r.Branch)
+}
+
+// branchSets returns the names of the sets of a rule's branches among sets
+func branchSets(sets map[string]*ruleSets, name string) []string {
+	var names []string
+	for setsName := range sets {
+		if setsName == name || strings.HasPrefix(setsName, name+"#") {
+			names = append(names, setsName)
+		}
+	}
+	return names
+}
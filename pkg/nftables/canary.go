@@ -0,0 +1,171 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	canaryTableName = "legion_canary"
+	canaryLogPrefix = "legion-canary deny: "
+	// The kernel keeps log prefixes of up to 127 bytes
+	maxLogPrefixLen = 127
+	// Both tables must hash sources alike to split them between policies
+	canarySeed    = 0x6c656769
+	canaryBuckets = 100
+)
+
+// Canary programs a policy rolled out alongside the running one in a table
+// of its own. A packet passes only if both tables accept it, so each table
+// accepts the sources the other one decides for (see SplitSources). With
+// logOnly the canary logs and accepts what it would deny.
+func Canary(logOnly bool) Option {
+	return func(m *Manager) {
+		m.name = canaryTableName
+		m.canary = true
+		m.logOnly = logOnly
+	}
+}
+
+// denyExpressions returns the expressions ending the evaluation of a packet
+// rule denies: a drop or reject as the rule says, logged if it says so, or a
+// log line and acceptance in a log-only canary. With the block page, the
+// verdict is taken in a chain that first records denied HTTP, and with
+// banning in one that first counts the source's denied packets.
+func (m *Manager) denyExpressions(rule Rule) []expr.Any {
+	if m.logOnly {
+		return []expr.Any{
+			&expr.Log{Key: 1 << unix.NFTA_LOG_PREFIX, Data: []byte(canaryLogPrefix)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}
+	}
+
+	var exprs []expr.Any
+	if rule.Log {
+		exprs = append(exprs, &expr.Log{Key: 1 << unix.NFTA_LOG_PREFIX, Data: []byte(denyLogPrefix(rule.Name))})
+	}
+	kind, verdict := denyVerdict(rule)
+	if m.blockPage() {
+		verdict = []expr.Any{&expr.Verdict{Kind: expr.VerdictGoto, Chain: m.blockPageChain(kind, verdict)}}
+		kind = blockPageChainPrefix + kind
+	}
+	// Only the packets of deny rules count towards a ban, not unmatched ones
+	if m.banning() && rule.Name != "" {
+		verdict = []expr.Any{&expr.Verdict{Kind: expr.VerdictGoto, Chain: m.offenderChain(kind, verdict)}}
+	}
+	return append(exprs, verdict...)
+}
+
+// denyVerdict returns the verdict of a deny rule and a name for it
+func denyVerdict(rule Rule) (string, []expr.Any) {
+	switch rule.DenyBehavior {
+	case DenyReject:
+		// As nft's plain reject does in an inet table, unless told otherwise
+		if rule.RejectWith == RejectAdminProhibited {
+			return "reject_admin", []expr.Any{&expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED}}
+		}
+		return "reject", []expr.Any{&expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH}}
+	case DenyRejectTCPRST:
+		return "reset", []expr.Any{&expr.Reject{Type: unix.NFT_REJECT_TCP_RST}}
+	}
+	return "drop", []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}
+}
+
+// denyLogPrefix returns the kernel log prefix of the packets a rule denies,
+// shortened to the length the kernel keeps
+func denyLogPrefix(ruleName string) string {
+	prefix := "legion deny " + ruleName + ": "
+	if len(prefix) > maxLogPrefixLen {
+		prefix = prefix[:maxLogPrefixLen-2] + ": "
+	}
+	return prefix
+}
+
+// SplitSources hands percent of the sources, picked by a hash of their
+// address, to the canary table: the running table accepts them ahead of
+// its policy, and the canary table accepts all others. Later changes to
+// the ruleset must not insert rules ahead of the split.
+func (m *Manager) SplitSources(percent int) error {
+	if percent <= 0 || percent >= canaryBuckets {
+		return fmt.Errorf("percent must be between 1 and %d", canaryBuckets-1)
+	}
+	// Each table accepts the buckets of the other one
+	first, last := 0, percent
+	if m.canary {
+		first, last = percent, canaryBuckets
+	}
+
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		if !m.carries(family) {
+			continue
+		}
+		buckets := &nftables.Set{
+			Table:     m.table,
+			Anonymous: true,
+			Constant:  true,
+			KeyType:   nftables.TypeInteger,
+		}
+		var elements []nftables.SetElement
+		for bucket := first; bucket < last; bucket++ {
+			elements = append(elements, nftables.SetElement{Key: binaryutil.NativeEndian.PutUint32(uint32(bucket))})
+		}
+		if err := m.conn.AddSet(buckets, elements); err != nil {
+			return fmt.Errorf("failed to create %s bucket set: %w", family.name, err)
+		}
+
+		m.conn.InsertRule(&nftables.Rule{
+			Table: m.table,
+			Chain: m.chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       family.saddrOffset,
+					Len:          family.addrLen,
+				},
+				&expr.Hash{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Length:         family.addrLen,
+					Modulus:        canaryBuckets,
+					Seed:           canarySeed,
+					Type:           expr.HashTypeJenkins,
+				},
+				&expr.Lookup{SourceRegister: 1, SetName: buckets.Name, SetID: buckets.ID},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		})
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to split sources: %w", err)
+	}
+	return nil
+}
+
+// DefaultDenies returns the number of packets no rule allowed, counted by
+// the default rule at the end of the policy chain
+func (m *Manager) DefaultDenies() (uint64, error) {
+	if m.chain == nil {
+		return 0, nil
+	}
+	rules, err := m.conn.GetRules(m.table, m.chain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read deny counter: %w", err)
+	}
+	var packets uint64
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				packets += counter.Packets
+			}
+		}
+	}
+	return packets, nil
+}
@@ -0,0 +1,110 @@
+package nftables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// Firewall is another firewall manager found programming netfilter
+type Firewall struct {
+	Name string // firewalld, ufw or kube-proxy
+	// Chains are its base chains on the hook of the policy chain, which
+	// see the same packets
+	Chains []*nftables.Chain
+}
+
+// String describes the firewall and its base chains, e.g.
+// "firewalld (filter_FORWARD priority 10)"
+func (fw Firewall) String() string {
+	if len(fw.Chains) == 0 {
+		return fw.Name
+	}
+	chains := make([]string, len(fw.Chains))
+	for i, ch := range fw.Chains {
+		chains[i] = fmt.Sprintf("%s priority %d", ch.Name, *ch.Priority)
+	}
+	return fmt.Sprintf("%s (%s)", fw.Name, strings.Join(chains, ", "))
+}
+
+// firewallName returns the firewall manager that programs a chain, going by
+// the names of its table and chain, or ""; iptables-nft based managers
+// share the iptables tables, so their chains give them away
+func firewallName(ch *nftables.Chain) string {
+	switch {
+	case ch.Table.Name == "firewalld":
+		return "firewalld"
+	case ch.Table.Name == "kube-proxy", strings.HasPrefix(ch.Name, "KUBE-"):
+		return "kube-proxy"
+	case strings.HasPrefix(ch.Name, "ufw-"), strings.HasPrefix(ch.Name, "ufw6-"):
+		return "ufw"
+	}
+	return ""
+}
+
+// DetectFirewalls lists the other firewall managers programming netfilter,
+// with their base chains on the policy chain's hook. Rules of iptables-legacy
+// aren't visible through nftables.
+func (m *Manager) DetectFirewalls() ([]Firewall, error) {
+	chains, err := m.conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	type tableKey struct {
+		family nftables.TableFamily
+		name   string
+	}
+	owners := make(map[tableKey]map[string]bool)
+	for _, ch := range chains {
+		if ch.Table.Name == tableName || ch.Table.Name == canaryTableName {
+			continue
+		}
+		if name := firewallName(ch); name != "" {
+			key := tableKey{ch.Table.Family, ch.Table.Name}
+			if owners[key] == nil {
+				owners[key] = make(map[string]bool)
+			}
+			owners[key][name] = true
+		}
+	}
+
+	found := make(map[string]*Firewall)
+	for _, ch := range chains {
+		for name := range owners[tableKey{ch.Table.Family, ch.Table.Name}] {
+			fw, ok := found[name]
+			if !ok {
+				fw = &Firewall{Name: name}
+				found[name] = fw
+			}
+			if ch.Hooknum != nil && *ch.Hooknum == *m.hook() && ch.Priority != nil {
+				fw.Chains = append(fw.Chains, ch)
+			}
+		}
+	}
+
+	firewalls := make([]Firewall, 0, len(found))
+	for _, fw := range found {
+		sort.Slice(fw.Chains, func(i, j int) bool { return *fw.Chains[i].Priority < *fw.Chains[j].Priority })
+		firewalls = append(firewalls, *fw)
+	}
+	sort.Slice(firewalls, func(i, j int) bool { return firewalls[i].Name < firewalls[j].Name })
+	return firewalls, nil
+}
+
+// PriorityAfter returns the priority running the policy chain after the
+// base chains of firewalls that run at or after its priority now, so that
+// it sees the packets as they leave them
+func (m *Manager) PriorityAfter(firewalls []Firewall) *nftables.ChainPriority {
+	priority := *m.priority()
+	for _, fw := range firewalls {
+		for _, ch := range fw.Chains {
+			if *ch.Priority >= priority {
+				priority = *ch.Priority + 1
+			}
+		}
+	}
+	return nftables.ChainPriorityRef(priority)
+}
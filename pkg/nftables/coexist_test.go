@@ -0,0 +1,95 @@
+package nftables
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+// TestDetectFirewalls tests recognizing other firewall managers by their
+// tables and chains, and placing the policy chain after theirs
+func TestDetectFirewalls(t *testing.T) {
+	testCases := []struct {
+		name         string
+		tables       map[string][]*nftables.Chain // Table name -> chains
+		want         []string
+		wantPriority nftables.ChainPriority
+	}{
+		{
+			name: "none",
+			tables: map[string][]*nftables.Chain{
+				"nat": {{Name: "POSTROUTING", Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}},
+			},
+			wantPriority: 0,
+		},
+		{
+			name: "firewalld",
+			tables: map[string][]*nftables.Chain{
+				"firewalld": {
+					{Name: "filter_FORWARD", Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityRef(10)},
+					{Name: "filter_INPUT", Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityRef(10)},
+				},
+			},
+			want:         []string{"firewalld (filter_FORWARD priority 10)"},
+			wantPriority: 11,
+		},
+		{
+			name: "iptables-nft",
+			tables: map[string][]*nftables.Chain{
+				"filter": {
+					{Name: "FORWARD", Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter},
+					{Name: "KUBE-FORWARD"},
+					{Name: "ufw-before-forward"},
+				},
+				"mangle": {
+					{Name: "FORWARD", Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityMangle},
+				},
+			},
+			want:         []string{"kube-proxy (FORWARD priority 0)", "ufw (FORWARD priority 0)"},
+			wantPriority: 1,
+		},
+		{
+			name: "ahead of the policy",
+			tables: map[string][]*nftables.Chain{
+				"kube-proxy": {{Name: "filter-forward", Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityRef(-10)}},
+			},
+			want:         []string{"kube-proxy (filter-forward priority -10)"},
+			wantPriority: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager()
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			for name, chains := range tc.tables {
+				table := m.conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: name})
+				for _, ch := range chains {
+					ch.Table = table
+					if ch.Hooknum != nil {
+						ch.Type = nftables.ChainTypeFilter
+					}
+					m.conn.AddChain(ch)
+				}
+			}
+
+			firewalls, err := m.DetectFirewalls()
+			if err != nil {
+				t.Fatalf("DetectFirewalls() error = %v", err)
+			}
+			if len(firewalls) != len(tc.want) {
+				t.Fatalf("Expected %v, got %v", tc.want, firewalls)
+			}
+			for i, want := range tc.want {
+				if got := firewalls[i].String(); got != want {
+					t.Errorf("Expected %q, got %q", want, got)
+				}
+			}
+			if got := *m.PriorityAfter(firewalls); got != tc.wantPriority {
+				t.Errorf("Expected priority %d, got %d", tc.wantPriority, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package nftables
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Prefixes of the packets sent to the connection log group: the verdict and
+// the rule name of the first packet of a connection, or the DNS answers to
+// clients
+const (
+	ConnectionLogAllow = "allow"
+	ConnectionLogDeny  = "deny"
+	ConnectionLogDNS   = "dns"
+)
+
+const dnsPort = 53
+
+// ConnectionLog configures what the ruleset sends to an NFLOG group, on top
+// of the connections of rules with LogConnections set
+type ConnectionLog struct {
+	Group uint16
+	// Unmatched sends the new connections the default drop denies
+	Unmatched bool
+	// DNS sends DNS answers forwarded to clients, so that their connections
+	// can be attributed to the names they looked up
+	DNS bool
+}
+
+// SetConnectionLog sets up the connection log in the next Setup and the
+// rules added after it; nil turns it off
+func (m *Manager) SetConnectionLog(cl *ConnectionLog) {
+	m.connLog = cl
+}
+
+// ConnectionLogPrefix returns the log prefix of the connections a rule with
+// action decides, shortened to the length the kernel keeps
+func ConnectionLogPrefix(action, ruleName string) string {
+	verdict := ConnectionLogAllow
+	if action != "allow" {
+		verdict = ConnectionLogDeny
+	}
+	prefix := verdict + " " + ruleName
+	if len(prefix) > maxLogPrefixLen {
+		prefix = prefix[:maxLogPrefixLen]
+	}
+	return prefix
+}
+
+// connectionLogExpressions sends the first packet of a connection to the
+// connection log group with prefix
+func (m *Manager) connectionLogExpressions(prefix string) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		m.connectionLogStatement(prefix),
+	}
+}
+
+// connectionLogStatement sends a packet to the connection log group
+func (m *Manager) connectionLogStatement(prefix string) *expr.Log {
+	return &expr.Log{
+		Key:   1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_GROUP,
+		Group: m.connLog.Group,
+		Data:  []byte(prefix),
+	}
+}
+
+// logUnmatched logs the new connections no rule matched ahead of the
+// default drop, if configured
+func (m *Manager) logUnmatched() {
+	if m.connLog == nil || !m.connLog.Unmatched || m.canary {
+		return
+	}
+	m.conn.AddRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chain,
+		Exprs: m.connectionLogExpressions(ConnectionLogDeny),
+	})
+}
+
+// logDNSAnswers sends the DNS answers forwarded to clients ahead of all
+// other rules, if configured
+func (m *Manager) logDNSAnswers() {
+	if m.connLog == nil || !m.connLog.DNS || m.canary {
+		return
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(dnsPort)},
+		m.connectionLogStatement(ConnectionLogDNS),
+	}
+	m.conn.InsertRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chain,
+		Exprs: exprs,
+	})
+}
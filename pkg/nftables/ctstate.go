@@ -0,0 +1,41 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// ctStateBits maps conntrack states to their bits in ct state
+var ctStateBits = map[string]uint32{
+	"new":         expr.CtStateBitNEW,
+	"established": expr.CtStateBitESTABLISHED,
+	"related":     expr.CtStateBitRELATED,
+	"invalid":     expr.CtStateBitINVALID,
+	"untracked":   expr.CtStateBitUNTRACKED,
+}
+
+// ctStateExpressions returns the expressions matching packets in any of
+// states, as `ct state new,related`
+func ctStateExpressions(states []string) ([]expr.Any, error) {
+	var mask uint32
+	for _, state := range states {
+		bit, ok := ctStateBits[state]
+		if !ok {
+			return nil, fmt.Errorf("invalid ct state: %s", state)
+		}
+		mask |= bit
+	}
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(mask),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}, nil
+}
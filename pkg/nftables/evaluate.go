@@ -0,0 +1,467 @@
+package nftables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Packet is the first packet of a connection to evaluate against a
+// recorded ruleset
+type Packet struct {
+	Source         net.IP
+	Destination    net.IP
+	Protocol       string // tcp, udp or icmp
+	Port           uint16 // Destination port, for tcp and udp
+	InputInterface string
+	// State is the conntrack state of the packet's connection, new unless
+	// set: established, related, invalid or untracked
+	State string
+	// TTL is the IPv4 TTL or IPv6 hop limit of the packet, 64 unless set
+	TTL uint8
+	// Length is the length of the packet in bytes, 60 unless set
+	Length uint16
+}
+
+// Verdict is how a recorded ruleset treats a packet
+type Verdict struct {
+	// Accept is set if every base chain accepted the packet
+	Accept bool
+	// Queued is set if the packet was queued to userspace, with Mark
+	Queued bool
+	Queue  uint16
+	Mark   uint32
+	// Rule is the rule that decided, in nft syntax, or "" for the end of
+	// the chains
+	Rule  string
+	Chain string
+	// Owner is the name of the policy rule Rule was built from, if any
+	Owner string
+}
+
+// maxJumps bounds chain jumps, as the kernel limits the jump stack
+const maxJumps = 16
+
+// defaultTTL is the TTL of packets evaluated without one, as most hosts
+// send them
+const defaultTTL = 64
+
+// defaultLength is the length of packets evaluated without one, that of a
+// TCP SYN
+const defaultLength = 60
+
+// Evaluate runs a packet through the recorded ruleset as the kernel would:
+// the filter chains of the hook in priority order, each of which must
+// accept it. State is that of a new connection.
+func (m *Manager) Evaluate(p Packet) (Verdict, error) {
+	c, ok := m.conn.(*scriptConn)
+	if !ok {
+		return Verdict{}, fmt.Errorf("the ruleset is programmed, not recorded")
+	}
+	if (p.Source.To4() == nil) != (p.Destination.To4() == nil) {
+		return Verdict{}, fmt.Errorf("source and destination must be of the same family")
+	}
+	hook := m.hook()
+
+	type baseChain struct {
+		table *scriptTable
+		chain *scriptChain
+	}
+	// Tables of the other address family don't see the packet
+	family := nftables.TableFamilyIPv6
+	if p.Destination.To4() != nil {
+		family = nftables.TableFamilyIPv4
+	}
+	var chains []baseChain
+	for _, t := range c.tables {
+		if t.table.Family != nftables.TableFamilyINet && t.table.Family != family {
+			continue
+		}
+		for _, sc := range t.chains {
+			ch := sc.chain
+			if ch.Hooknum != nil && *ch.Hooknum == *hook && ch.Type == nftables.ChainTypeFilter {
+				chains = append(chains, baseChain{t, sc})
+			}
+		}
+	}
+	sort.SliceStable(chains, func(i, j int) bool {
+		return *chains[i].chain.chain.Priority < *chains[j].chain.chain.Priority
+	})
+
+	verdict := Verdict{Accept: true}
+	for _, base := range chains {
+		e := &evaluation{table: base.table, packet: p}
+		if base.table.table == m.table {
+			e.owners = m.chainRules
+		}
+		v, err := e.chain(base.chain, 0)
+		if err != nil {
+			return Verdict{}, err
+		}
+		if v.Accept && !v.Queued {
+			verdict = v
+			continue
+		}
+		return v, nil
+	}
+	return verdict, nil
+}
+
+// evaluation is the state of a packet running through a table
+type evaluation struct {
+	table  *scriptTable
+	packet Packet
+	// 16 32 bit registers, which the four 128 bit registers overlay
+	registers [64]byte
+	mark      uint32
+	// Chain name -> the rules the chain holds, for the manager's own table
+	owners map[string]*chainRules
+}
+
+// chain runs the packet through a chain; a zero Verdict means no rule
+// decided
+func (e *evaluation) chain(sc *scriptChain, depth int) (Verdict, error) {
+	if depth > maxJumps {
+		return Verdict{}, fmt.Errorf("too many jumps at chain %s", sc.chain.Name)
+	}
+	for i, r := range sc.rules {
+		v, decided, returned, err := e.rule(r.Exprs, depth)
+		if err != nil {
+			return Verdict{}, fmt.Errorf("chain %s: %w", sc.chain.Name, err)
+		}
+		if returned {
+			return Verdict{}, nil
+		}
+		if !decided {
+			continue
+		}
+		if v.Rule == "" {
+			if v.Rule, err = e.table.ruleText(r); err != nil {
+				return Verdict{}, err
+			}
+			v.Chain = sc.chain.Name
+			if cr, ok := e.owners[sc.chain.Name]; ok && i < len(cr.owners) {
+				v.Owner = cr.owners[i]
+			}
+		}
+		return v, nil
+	}
+	// Base chains accept what falls through
+	if sc.chain.Hooknum != nil {
+		return Verdict{Accept: true}, nil
+	}
+	return Verdict{}, nil
+}
+
+// rule evaluates the expressions of a rule, reporting whether it decided
+// the packet's fate or returned from the chain
+func (e *evaluation) rule(exprs []expr.Any, depth int) (v Verdict, decided, returned bool, err error) {
+	for _, ex := range exprs {
+		switch ex := ex.(type) {
+		case *expr.Meta:
+			if ex.SourceRegister {
+				e.mark = binaryutil.NativeEndian.Uint32(e.load(ex.Register, 4))
+				continue
+			}
+			data, err := e.meta(ex.Key)
+			if err != nil {
+				return v, false, false, err
+			}
+			e.store(ex.Register, data)
+		case *expr.Ct:
+			if ex.Key != expr.CtKeySTATE {
+				return v, false, false, fmt.Errorf("unsupported ct key %d", ex.Key)
+			}
+			state := expr.CtStateBitNEW
+			if e.packet.State != "" {
+				bit, ok := ctStateBits[e.packet.State]
+				if !ok {
+					return v, false, false, fmt.Errorf("invalid ct state %q", e.packet.State)
+				}
+				state = bit
+			}
+			e.store(ex.Register, binaryutil.NativeEndian.PutUint32(state))
+		case *expr.Fib:
+			if !ex.FlagSADDR || !ex.ResultOIF {
+				return v, false, false, fmt.Errorf("unsupported fib lookup")
+			}
+			// Evaluated sources are routed back the way they came
+			e.store(ex.Register, binaryutil.NativeEndian.PutUint32(1))
+		case *expr.Payload:
+			data, ok, err := e.payload(ex)
+			if err != nil || !ok {
+				return v, false, false, err
+			}
+			e.store(ex.DestRegister, data)
+		case *expr.Byteorder:
+			if ex.Size != 4 || ex.Len != 4 {
+				return v, false, false, fmt.Errorf("unsupported byteorder of size %d", ex.Size)
+			}
+			data := binaryutil.NativeEndian.Uint32(e.load(ex.SourceRegister, 4))
+			if ex.Op == expr.ByteorderNtoh {
+				data = binaryutil.BigEndian.Uint32(e.load(ex.SourceRegister, 4))
+				e.store(ex.DestRegister, binaryutil.NativeEndian.PutUint32(data))
+				continue
+			}
+			e.store(ex.DestRegister, binaryutil.BigEndian.PutUint32(data))
+		case *expr.Bitwise:
+			data := e.load(ex.SourceRegister, ex.Len)
+			result := make([]byte, ex.Len)
+			for i := range result {
+				result[i] = data[i] & ex.Mask[i]
+				if i < len(ex.Xor) {
+					result[i] ^= ex.Xor[i]
+				}
+			}
+			e.store(ex.DestRegister, result)
+		case *expr.Cmp:
+			if !compare(ex.Op, bytes.Compare(e.load(ex.Register, uint32(len(ex.Data))), ex.Data)) {
+				return v, false, false, nil
+			}
+		case *expr.Range:
+			data := e.load(ex.Register, uint32(len(ex.FromData)))
+			in := bytes.Compare(data, ex.FromData) >= 0 && bytes.Compare(data, ex.ToData) <= 0
+			if in != (ex.Op == expr.CmpOpEq) {
+				return v, false, false, nil
+			}
+		case *expr.Lookup:
+			found, err := e.lookup(ex)
+			if err != nil {
+				return v, false, false, err
+			}
+			if found == ex.Invert {
+				return v, false, false, nil
+			}
+		case *expr.Immediate:
+			e.store(ex.Register, ex.Data)
+		case *expr.Limit:
+			// A single packet is never beyond a rate
+			if ex.Over {
+				return v, false, false, nil
+			}
+		case *expr.Dynset:
+			for _, x := range ex.Exprs {
+				if limit, ok := x.(*expr.Limit); ok && limit.Over {
+					return v, false, false, nil
+				}
+			}
+		case *expr.Counter, *expr.Log:
+		case *expr.Queue:
+			return Verdict{Queued: true, Queue: ex.Num, Mark: e.mark}, true, false, nil
+		case *expr.Reject:
+			return Verdict{}, true, false, nil
+		case *expr.Verdict:
+			switch ex.Kind {
+			case expr.VerdictAccept:
+				return Verdict{Accept: true}, true, false, nil
+			case expr.VerdictDrop:
+				return Verdict{}, true, false, nil
+			case expr.VerdictReturn:
+				return v, false, true, nil
+			case expr.VerdictJump:
+				target := e.table.chainNamed(ex.Chain)
+				if target == nil {
+					return v, false, false, fmt.Errorf("chain %s does not exist", ex.Chain)
+				}
+				v, err := e.chain(target, depth+1)
+				if err != nil || v.Rule == "" {
+					return v, false, false, err
+				}
+				return v, true, false, nil
+			case expr.VerdictGoto:
+				// The chain finishes the rule's verdict, so the rule is
+				// reported; falling through it returns from this chain
+				target := e.table.chainNamed(ex.Chain)
+				if target == nil {
+					return v, false, false, fmt.Errorf("chain %s does not exist", ex.Chain)
+				}
+				v, err := e.chain(target, depth+1)
+				if err != nil {
+					return v, false, false, err
+				}
+				if v.Rule == "" {
+					return v, false, true, nil
+				}
+				v.Rule, v.Chain, v.Owner = "", "", ""
+				return v, true, false, nil
+			default:
+				return v, false, false, fmt.Errorf("unsupported verdict %d", ex.Kind)
+			}
+		default:
+			return v, false, false, fmt.Errorf("unsupported expression %T", ex)
+		}
+	}
+	return v, false, false, nil
+}
+
+// meta returns the value of a meta key for the packet
+func (e *evaluation) meta(key expr.MetaKey) ([]byte, error) {
+	switch key {
+	case expr.MetaKeyNFPROTO:
+		if e.packet.Destination.To4() != nil {
+			return []byte{unix.NFPROTO_IPV4}, nil
+		}
+		return []byte{unix.NFPROTO_IPV6}, nil
+	case expr.MetaKeyL4PROTO:
+		return []byte{protocolToNum(e.packet.Protocol)}, nil
+	case expr.MetaKeyIIFNAME:
+		return ifname(e.packet.InputInterface), nil
+	case expr.MetaKeyOIFNAME:
+		// Evaluated traffic leaves through an external interface
+		return ifname(""), nil
+	case expr.MetaKeyLEN:
+		length := e.packet.Length
+		if length == 0 {
+			length = defaultLength
+		}
+		return binaryutil.NativeEndian.PutUint32(uint32(length)), nil
+	default:
+		return nil, fmt.Errorf("unsupported meta key %d", key)
+	}
+}
+
+// payload returns the header field a payload expression loads, or false if
+// the packet has no such field, in which case the rule does not match
+func (e *evaluation) payload(p *expr.Payload) ([]byte, bool, error) {
+	family := familyIPv6
+	src, dst := e.packet.Source.To16(), e.packet.Destination.To16()
+	if v4 := e.packet.Destination.To4(); v4 != nil {
+		family = familyIPv4
+		src, dst = e.packet.Source.To4(), v4
+	}
+	switch {
+	case p.Base == expr.PayloadBaseNetworkHeader && p.Len == family.addrLen && p.Offset == family.saddrOffset:
+		return src, true, nil
+	case p.Base == expr.PayloadBaseNetworkHeader && p.Len == family.addrLen && p.Offset == family.daddrOffset:
+		return dst, true, nil
+	case p.Base == expr.PayloadBaseNetworkHeader && p.Len == 1 && p.Offset == family.ttlOffset:
+		ttl := e.packet.TTL
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+		return []byte{ttl}, true, nil
+	case p.Base == expr.PayloadBaseNetworkHeader:
+		// A field of the other family, behind an nfproto match
+		return nil, false, nil
+	case p.Base == expr.PayloadBaseTransportHeader && p.Offset == 2 && p.Len == 2:
+		if e.packet.Protocol != "tcp" && e.packet.Protocol != "udp" {
+			return nil, false, nil
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, e.packet.Port)
+		return port, true, nil
+	case p.Base == expr.PayloadBaseTransportHeader && p.Offset == 0 && p.Len == 2:
+		// Source ports are unknown; only answers to clients match them
+		return nil, false, nil
+	case p.Base == expr.PayloadBaseTransportHeader && p.Offset == tcpFlagsOffset && p.Len == 1:
+		if e.packet.Protocol != "tcp" {
+			return nil, false, nil
+		}
+		// A new connection opens with a SYN, others carry an ACK
+		if e.packet.State == "" || e.packet.State == "new" {
+			return []byte{tcpFlagSYN}, true, nil
+		}
+		return []byte{tcpFlagACK}, true, nil
+	default:
+		return nil, false, fmt.Errorf("unsupported payload at offset %d", p.Offset)
+	}
+}
+
+// lookup reports whether the registers from the lookup's source hold an
+// element of its set
+func (e *evaluation) lookup(l *expr.Lookup) (bool, error) {
+	var set *scriptSet
+	for _, s := range e.table.sets {
+		if s.set.Name == l.SetName {
+			set = s
+		}
+	}
+	if set == nil {
+		return false, fmt.Errorf("set %s does not exist", l.SetName)
+	}
+
+	if set.set.Interval {
+		for _, element := range set.elements {
+			if element.IntervalEnd {
+				continue
+			}
+			key := e.load(l.SourceRegister, uint32(len(element.Key)))
+			end := intervalEnd(element.Key, intervalEnds(set.elements))
+			if bytes.Compare(key, element.Key) >= 0 && bytes.Compare(key, end) <= 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	for _, element := range set.elements {
+		if bytes.Equal(e.load(l.SourceRegister, uint32(len(element.Key))), element.Key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// intervalEnds returns the end elements of an interval set by key
+func intervalEnds(elements []nftables.SetElement) map[string]net.IP {
+	ends := make(map[string]net.IP)
+	for _, element := range elements {
+		if element.IntervalEnd {
+			ends[string(element.Key)] = net.IP(element.Key)
+		}
+	}
+	return ends
+}
+
+// registerOffset returns where a register starts: registers 1 to 4 are the
+// 128 bit ones, 8 and up the 32 bit ones overlaying them
+func registerOffset(register uint32) int {
+	if register >= 8 {
+		return int(register-8) * 4
+	}
+	return int(register-1) * 16
+}
+
+// store writes data to the registers from register on, zero padding it to
+// 32 bits as the kernel does
+func (e *evaluation) store(register uint32, data []byte) {
+	offset := registerOffset(register)
+	n := copy(e.registers[offset:], data)
+	for i := offset + n; i < len(e.registers) && (i-offset)%4 != 0; i++ {
+		e.registers[i] = 0
+	}
+}
+
+// load reads n bytes from the registers from register on
+func (e *evaluation) load(register, n uint32) []byte {
+	offset := registerOffset(register)
+	end := offset + int(n)
+	if end > len(e.registers) {
+		end = len(e.registers)
+	}
+	return e.registers[offset:end]
+}
+
+// compare applies a comparison to the result of bytes.Compare
+func compare(op expr.CmpOp, result int) bool {
+	switch op {
+	case expr.CmpOpEq:
+		return result == 0
+	case expr.CmpOpNeq:
+		return result != 0
+	case expr.CmpOpLt:
+		return result < 0
+	case expr.CmpOpLte:
+		return result <= 0
+	case expr.CmpOpGt:
+		return result > 0
+	default:
+		return result >= 0
+	}
+}
@@ -0,0 +1,629 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestEvaluate tests running packets through a recorded ruleset
+func TestEvaluate(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.SetupMetadataProtection([]string{"169.254.169.254"}, nil); err != nil {
+		t.Fatalf("Failed to set up metadata protection: %v", err)
+	}
+	for _, rule := range []Rule{
+		{Name: "internal", Action: "deny", IPs: []string{"10.0.0.0/8"}},
+		{Name: "web", Action: "allow", IPs: []string{"0.0.0.0/0", "::/0"}, Protocols: []string{"tcp"}, Ports: []string{"443", "8000-8080"}},
+		{Name: "dns", Action: "allow", Protocols: []string{"udp", "tcp"}, Ports: []string{"53"}},
+		{Name: "ping", Action: "allow", Protocols: []string{"icmp"}, InputInterface: "eth1.100"},
+		{Name: "blue", Action: "allow", Protocols: []string{"udp"}, VRF: "blue"},
+	} {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule %s: %v", rule.Name, err)
+		}
+	}
+	if err := m.AddQueueRule(100, "udp", 443); err != nil {
+		t.Fatalf("Failed to add queue rule: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		packet     Packet
+		wantAccept bool
+		wantQueued bool
+		wantRule   string
+	}{
+		{
+			name:       "allowed port",
+			packet:     Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "tcp", Port: 8000},
+			wantAccept: true,
+			wantRule:   "ip daddr @ips_web th dport { 443, 8000-8080 } counter accept",
+		},
+		{
+			name:       "allowed port in list",
+			packet:     Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "tcp", Port: 443},
+			wantAccept: true,
+			wantRule:   "ip daddr @ips_web th dport { 443, 8000-8080 } counter accept",
+		},
+		{
+			name:       "protocol in list",
+			packet:     Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "tcp", Port: 53},
+			wantAccept: true,
+			wantRule:   "meta l4proto { udp, tcp } th dport 53 counter accept",
+		},
+		{
+			name:       "allowed range",
+			packet:     Packet{Destination: net.ParseIP("2001:db8::1"), Protocol: "tcp", Port: 8080},
+			wantAccept: true,
+			wantRule:   "ip6 daddr @ips6_web",
+		},
+		{
+			name:     "denied destination",
+			packet:   Packet{Destination: net.ParseIP("10.1.2.3"), Protocol: "tcp", Port: 8000},
+			wantRule: "ip daddr @ips_internal counter drop",
+		},
+		{
+			name:     "default drop",
+			packet:   Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "tcp", Port: 22},
+			wantRule: "counter drop",
+		},
+		{
+			name:     "metadata",
+			packet:   Packet{Destination: net.ParseIP("169.254.169.254"), Protocol: "tcp", Port: 8000},
+			wantRule: "ip daddr @metadata counter drop",
+		},
+		{
+			name:       "interface",
+			packet:     Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "icmp", InputInterface: "eth1.100"},
+			wantAccept: true,
+			wantRule:   `iifname "eth1.100"`,
+		},
+		{
+			name:     "other interface",
+			packet:   Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "icmp", InputInterface: "eth1.200"},
+			wantRule: "counter drop",
+		},
+		{
+			name:       "vrf",
+			packet:     Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "udp", Port: 53, InputInterface: "blue"},
+			wantAccept: true,
+			wantRule:   "meta l4proto udp counter accept",
+		},
+		{
+			name:       "queued",
+			packet:     Packet{Destination: net.ParseIP("192.0.2.1"), Protocol: "udp", Port: 443},
+			wantQueued: true,
+			wantRule:   "queue num 100",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.packet.Source = net.IPv4zero
+			if tc.packet.Destination.To4() == nil {
+				tc.packet.Source = net.IPv6unspecified
+			}
+			v, err := m.Evaluate(tc.packet)
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept || v.Queued != tc.wantQueued {
+				t.Errorf("Expected accept %v, queued %v, got %+v", tc.wantAccept, tc.wantQueued, v)
+			}
+			if !strings.Contains(v.Rule, tc.wantRule) {
+				t.Errorf("Expected rule to contain %q, got %q", tc.wantRule, v.Rule)
+			}
+		})
+	}
+}
+
+// TestEvaluateBlockPage tests that a deny going to a block page chain is
+// reported as the rule deciding, with the policy rule it was built from
+func TestEvaluateBlockPage(t *testing.T) {
+	m := NewScriptManager()
+	m.SetBlockPage(8081)
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "social", Action: "deny", IPs: []string{"192.0.2.0/24"}, DenyBehavior: DenyReject}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		dst       string
+		wantRule  string
+		wantOwner string
+	}{
+		{
+			name:      "denied by a rule",
+			dst:       "192.0.2.1",
+			wantRule:  "meta nfproto ipv4 ip daddr @ips_social counter goto blockpage_reject",
+			wantOwner: "social",
+		},
+		{
+			name:     "default drop",
+			dst:      "198.51.100.1",
+			wantRule: "counter goto blockpage_drop",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: 80})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept || v.Rule != tc.wantRule || v.Owner != tc.wantOwner {
+				t.Errorf("Expected rule %q of %q, got %+v", tc.wantRule, tc.wantOwner, v)
+			}
+		})
+	}
+}
+
+// TestEvaluateInspectionExempt tests that exempt sources skip the queue
+// rules and are decided by the rules matching addresses
+func TestEvaluateInspectionExempt(t *testing.T) {
+	m := NewScriptManager()
+	m.SetInspectionExempt([]string{"10.0.0.5", "fd00::/64"})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "video", Action: "allow", Protocols: []string{"tcp"}, Inspect: true, Queue: 100, Mark: 7}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "web", Action: "allow", IPs: []string{"192.0.2.0/24"}, Ports: []string{"443"}, Protocols: []string{"tcp"}}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+	if err := m.AddQueueRule(100, "tcp", 443); err != nil {
+		t.Fatalf("Failed to add queue rule: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		src        string
+		dst        string
+		wantQueued bool
+		wantAccept bool
+	}{
+		{name: "inspected", src: "10.0.0.2", dst: "192.0.2.1", wantQueued: true},
+		{name: "exempt", src: "10.0.0.5", dst: "192.0.2.1", wantAccept: true},
+		{name: "exempt and unmatched", src: "10.0.0.5", dst: "198.51.100.1"},
+		{name: "exempt IPv6", src: "fd00::5", dst: "2001:db8::1"},
+		{name: "inspected IPv6", src: "fd01::5", dst: "2001:db8::1", wantQueued: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP(tc.src), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: 443})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Queued != tc.wantQueued || v.Accept != tc.wantAccept {
+				t.Errorf("Expected queued %v, accept %v, got %+v", tc.wantQueued, tc.wantAccept, v)
+			}
+		})
+	}
+}
+
+// TestEvaluatePortGroups tests that the rules of a port group share its set,
+// and that rules of other ports keep their own
+func TestEvaluatePortGroups(t *testing.T) {
+	m := NewScriptManager()
+	m.SetPortGroups(map[string][]string{"web": {"80", "443"}, "alt": {"8080"}})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	rules := []Rule{
+		{Name: "web", Action: "allow", IPs: []string{"192.0.2.0/24"}, Ports: []string{"80", "443"}, PortGroup: "web", Protocols: []string{"tcp"}},
+		{Name: "web-too", Action: "allow", IPs: []string{"198.51.100.0/24"}, Ports: []string{"80", "443"}, PortGroup: "web", Protocols: []string{"tcp"}},
+		{Name: "alt", Action: "allow", IPs: []string{"203.0.113.0/24"}, Ports: []string{"8080"}, PortGroup: "alt", Protocols: []string{"tcp"}},
+	}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	if n := strings.Count(script, "th dport @ports_web"); n != 4 {
+		t.Errorf("Expected both families of both web rules to share @ports_web, got %d:\n%s", n, script)
+	}
+	if strings.Contains(script, "ports_alt") {
+		t.Errorf("Expected no set for a group of a single port:\n%s", script)
+	}
+
+	testCases := []struct {
+		dst        string
+		port       uint16
+		wantAccept bool
+	}{
+		{dst: "192.0.2.1", port: 443, wantAccept: true},
+		{dst: "198.51.100.1", port: 80, wantAccept: true},
+		{dst: "198.51.100.1", port: 8080},
+		{dst: "203.0.113.1", port: 8080, wantAccept: true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s:%d", tc.dst, tc.port), func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: tc.port})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+}
+
+// TestEvaluateExclusions tests that a rule skips the destinations and
+// ports it excludes, including addresses added to its exclusion sets later
+func TestEvaluateExclusions(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	rules := []Rule{
+		{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}, ExcludedIPs: []string{"10.0.0.0/8", "192.168.0.0/16", "fc00::/7"}, ExcludedSet: true},
+		{Name: "high", Action: "allow", IPs: []string{"198.51.100.0/24"}, Protocols: []string{"tcp"}, Ports: []string{"1024-65535"}, ExcludedPorts: []string{"3306", "5432"}},
+	}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+	if err := m.UpdateExcludedIPs("web", []string{"10.0.0.0/8", "192.168.0.0/16", "fc00::/7", "203.0.113.7"}); err != nil {
+		t.Fatalf("UpdateExcludedIPs() error = %v", err)
+	}
+
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	for _, want := range []string{"ip daddr != @not_ips_web", "ip6 daddr != @not_ips6_web"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected %q in:\n%s", want, script)
+		}
+	}
+
+	testCases := []struct {
+		dst        string
+		port       uint16
+		wantAccept bool
+	}{
+		{dst: "93.184.216.34", port: 443, wantAccept: true},
+		{dst: "10.1.2.3", port: 443},
+		{dst: "192.168.1.1", port: 443},
+		{dst: "2001:db8::1", port: 443, wantAccept: true},
+		{dst: "fd00::1", port: 443},
+		{dst: "203.0.113.7", port: 443},
+		{dst: "198.51.100.1", port: 8080, wantAccept: true},
+		{dst: "198.51.100.1", port: 5432},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s:%d", tc.dst, tc.port), func(t *testing.T) {
+			src := "10.0.0.2"
+			if strings.Contains(tc.dst, ":") {
+				src = "2001:db8::2"
+			}
+			v, err := m.Evaluate(Packet{Source: net.ParseIP(src), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: tc.port})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+}
+
+// TestEvaluateCtStates tests that rules limited to conntrack states only
+// match the packets of connections in them
+func TestEvaluateCtStates(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	rules := []Rule{
+		{Name: "replies", Action: "allow", CtStates: []string{"established", "related"}},
+		{Name: "web", Action: "allow", IPs: []string{"192.0.2.0/24"}, Protocols: []string{"tcp"}, Ports: []string{"443"}, CtStates: []string{"new"}},
+	}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	for _, want := range []string{"ct state established,related", "ct state new"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected %q in:\n%s", want, script)
+		}
+	}
+
+	testCases := []struct {
+		dst        string
+		port       uint16
+		state      string
+		wantAccept bool
+	}{
+		{dst: "192.0.2.1", port: 443, wantAccept: true},
+		{dst: "192.0.2.1", port: 443, state: "new", wantAccept: true},
+		{dst: "198.51.100.1", port: 443},
+		{dst: "198.51.100.1", port: 443, state: "established", wantAccept: true},
+		{dst: "198.51.100.1", port: 53, state: "related", wantAccept: true},
+		{dst: "198.51.100.1", port: 443, state: "invalid"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s:%d %s", tc.dst, tc.port, tc.state), func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: tc.port, State: tc.state})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+
+	if err := m.AddRule(Rule{Name: "bad", Action: "allow", CtStates: []string{"open"}}); err == nil {
+		t.Error("Expected an error for an invalid ct state")
+	}
+}
+
+// TestEvaluateTTL tests that rules matching TTLs match the TTL of IPv4
+// packets and the hop limit of IPv6 ones
+func TestEvaluateTTL(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	rules := []Rule{
+		{Name: "expiring", Action: "deny", TTLLessThan: 2},
+		{Name: "tethered", Action: "deny", TTLEqual: 63},
+		{Name: "web", Action: "allow", Protocols: []string{"tcp"}},
+	}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	for _, want := range []string{"ip ttl < 2", "ip6 hoplimit < 2", "ip ttl 63", "ip6 hoplimit 63"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected %q in:\n%s", want, script)
+		}
+	}
+
+	testCases := []struct {
+		dst        string
+		ttl        uint8
+		wantAccept bool
+	}{
+		{dst: "192.0.2.1", wantAccept: true},
+		{dst: "192.0.2.1", ttl: 64, wantAccept: true},
+		{dst: "192.0.2.1", ttl: 63},
+		{dst: "192.0.2.1", ttl: 1},
+		{dst: "2001:db8::1", ttl: 128, wantAccept: true},
+		{dst: "2001:db8::1", ttl: 63},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s ttl %d", tc.dst, tc.ttl), func(t *testing.T) {
+			src := "10.0.0.2"
+			if strings.Contains(tc.dst, ":") {
+				src = "2001:db8::2"
+			}
+			v, err := m.Evaluate(Packet{Source: net.ParseIP(src), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: 443, TTL: tc.ttl})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+}
+
+// TestEvaluateLength tests that rules matching lengths match the packets
+// longer, shorter or as long as they ask for
+func TestEvaluateLength(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	rules := []Rule{
+		{Name: "jumbo", Action: "deny", MinLength: 1401, MaxLength: 65535},
+		{Name: "tiny", Action: "deny", MaxLength: 39},
+		{Name: "exact", Action: "deny", MinLength: 576, MaxLength: 576},
+		{Name: "band", Action: "deny", MinLength: 1000, MaxLength: 1100},
+		{Name: "web", Action: "allow", Protocols: []string{"tcp"}},
+	}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	for _, want := range []string{"meta length > 1400", "meta length < 40", "meta length 576", "meta length 1000-1100"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected %q in:\n%s", want, script)
+		}
+	}
+
+	testCases := []struct {
+		length     uint16
+		wantAccept bool
+	}{
+		{length: 0, wantAccept: true},
+		{length: 1400, wantAccept: true},
+		{length: 1401},
+		{length: 39},
+		{length: 40, wantAccept: true},
+		{length: 576},
+		{length: 1050},
+		{length: 1101, wantAccept: true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.length), func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP("192.0.2.1"), Protocol: "tcp", Port: 443, Length: tc.length})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+}
+
+// TestEvaluateBranches tests that the branches of a rule match their own
+// destinations and ports, and are updated and deleted with the rule
+func TestEvaluateBranches(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	rules := []Rule{
+		{Name: "partners", Action: "allow", IPs: []string{"192.0.2.0/24"}, Protocols: []string{"tcp"}, Ports: []string{"443"}},
+		{Name: "partners", Action: "allow", DestinationSet: true, Protocols: []string{"tcp"}, Ports: []string{"8443"}, Branch: 1},
+	}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+	if err := m.UpdateIPs(BranchName("partners", 1), []string{"198.51.100.7"}); err != nil {
+		t.Fatalf("UpdateIPs() error = %v", err)
+	}
+
+	testCases := []struct {
+		dst        string
+		port       uint16
+		wantAccept bool
+	}{
+		{dst: "192.0.2.1", port: 443, wantAccept: true},
+		{dst: "192.0.2.1", port: 8443},
+		{dst: "198.51.100.7", port: 8443, wantAccept: true},
+		{dst: "198.51.100.7", port: 443},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s:%d", tc.dst, tc.port), func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: tc.port})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+			if tc.wantAccept && v.Owner != "partners" {
+				t.Errorf("Expected the verdict of partners, got %+v", v)
+			}
+		})
+	}
+
+	if err := m.DeleteRule("partners"); err != nil {
+		t.Fatalf("DeleteRule() error = %v", err)
+	}
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	if strings.Contains(script, "partners") {
+		t.Errorf("Expected the sets of both branches deleted:\n%s", script)
+	}
+}
+
+// TestEvaluateHardening tests that invalid packets and bogon sources on
+// the WAN interface are dropped ahead of a rule allowing everything
+func TestEvaluateHardening(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "all", Action: "allow", IPs: []string{"0.0.0.0/0", "::/0"}}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+	err := m.SetupHardening(Hardening{
+		DropInvalid:   true,
+		ReversePath:   true,
+		TCPFlags:      true,
+		WANInterfaces: []string{"eth0"},
+		Bogons:        []string{"10.0.0.0/8", "fc00::/7"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up hardening: %v", err)
+	}
+
+	script, err := m.RenderText()
+	if err != nil {
+		t.Fatalf("RenderText() error = %v", err)
+	}
+	for _, want := range []string{
+		"type filter hook forward priority -20; policy accept;",
+		"ct state invalid counter drop",
+		"fib saddr . iif oif missing counter drop",
+		"meta l4proto tcp tcp flags & (fin|syn) == fin|syn counter drop",
+		"meta l4proto tcp tcp flags & (fin|syn|rst|psh|ack|urg) == 0x0 counter drop",
+		"ct state new meta l4proto tcp tcp flags & (fin|syn|rst|ack) != syn counter drop",
+		"iifname \"eth0\" meta nfproto ipv4 ip saddr @hardening_bogons counter drop",
+		"iifname \"eth0\" meta nfproto ipv6 ip6 saddr @hardening_bogons6 counter drop",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected %q in:\n%s", want, script)
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		src        string
+		dst        string
+		iface      string
+		state      string
+		wantAccept bool
+	}{
+		{name: "new", src: "10.0.0.2", dst: "192.0.2.1", iface: "lan0", wantAccept: true},
+		{name: "established", src: "10.0.0.2", dst: "192.0.2.1", iface: "lan0", state: "established", wantAccept: true},
+		{name: "invalid", src: "10.0.0.2", dst: "192.0.2.1", iface: "lan0", state: "invalid"},
+		{name: "bogon on wan", src: "10.0.0.2", dst: "192.0.2.1", iface: "eth0"},
+		{name: "public on wan", src: "198.51.100.1", dst: "10.0.0.2", iface: "eth0", wantAccept: true},
+		{name: "ipv6 bogon on wan", src: "fd00::2", dst: "2001:db8::1", iface: "eth0"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := m.Evaluate(Packet{
+				Source:         net.ParseIP(tc.src),
+				Destination:    net.ParseIP(tc.dst),
+				Protocol:       "tcp",
+				Port:           443,
+				InputInterface: tc.iface,
+				State:          tc.state,
+			})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+	if drops, err := m.HardeningDrops(); err != nil || drops != 0 {
+		t.Errorf("Expected no drops, got %d (%v)", drops, err)
+	}
+}
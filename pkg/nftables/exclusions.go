@@ -0,0 +1,105 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/google/nftables/expr"
+)
+
+const (
+	excludedSetNameFmt  = "not_ips_%s"  // IPv4 destinations excluded per rule
+	excluded6SetNameFmt = "not_ips6_%s" // IPv6 destinations excluded per rule
+)
+
+// excludes reports whether a rule has destinations excluded by address,
+// which are held in sets of their own
+func (r Rule) excludes() bool {
+	return len(r.ExcludedIPs) > 0 || r.ExcludedSet
+}
+
+// addExcludedSets creates the sets of the destinations a rule excludes
+func (m *Manager) addExcludedSets(rule Rule) (*ruleSets, error) {
+	v4, v6, err := m.addressRanges(rule.ExcludedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid excluded address: %w", err)
+	}
+	sets := &ruleSets{ranges4: v4, ranges6: v6}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		name, ranges := fmt.Sprintf(excludedSetNameFmt, sanitizeName(rule.setsName())), v4
+		if family == familyIPv6 {
+			name, ranges = fmt.Sprintf(excluded6SetNameFmt, sanitizeName(rule.setsName())), v6
+		}
+		set, err := m.addRangeSet(name, family, ranges)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s exclusion set: %w", family.name, err)
+		}
+		sets.set(family, set)
+	}
+	m.excludedSets[rule.setsName()] = sets
+	return sets, nil
+}
+
+// exclusionExpressions returns the expressions skipping a rule of family
+// for the destinations and ports it excludes
+func (m *Manager) exclusionExpressions(rule Rule, family addrFamily) ([]expr.Any, error) {
+	var exprs []expr.Any
+	if sets, ok := m.excludedSets[rule.setsName()]; ok && rule.excludes() && family.nfproto != 0 {
+		set := sets.v4
+		if family == familyIPv6 {
+			set = sets.v6
+		}
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       family.daddrOffset,
+				Len:          family.addrLen,
+			},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: true},
+		)
+	}
+
+	if len(rule.ExcludedPorts) > 0 {
+		portExprs, err := m.portExpressions(rule.ExcludedPorts)
+		if err != nil {
+			return nil, err
+		}
+		// Invert the comparison ending the port match
+		if len(portExprs) > 0 {
+			switch e := portExprs[len(portExprs)-1].(type) {
+			case *expr.Cmp:
+				e.Op = expr.CmpOpNeq
+			case *expr.Range:
+				e.Op = expr.CmpOpNeq
+			case *expr.Lookup:
+				e.Invert = true
+			}
+		}
+		exprs = append(exprs, portExprs...)
+	}
+	return exprs, nil
+}
+
+// ExcludesIP reports whether ip is in a rule's exclusion sets
+func (m *Manager) ExcludesIP(ruleName string, ip net.IP) bool {
+	sets, ok := m.excludedSets[ruleName]
+	return ok && sets.contains(ip)
+}
+
+// UpdateExcludedIPs replaces the destinations a rule excludes, such as the
+// refreshed addresses of its excluded domains
+func (m *Manager) UpdateExcludedIPs(ruleName string, ips []string) error {
+	sets, ok := m.excludedSets[ruleName]
+	if !ok {
+		return fmt.Errorf("no exclusion set found for rule %s", ruleName)
+	}
+
+	changes, err := m.replaceRanges(sets, ips)
+	if err != nil || changes == "" {
+		return err
+	}
+	log.Printf("Updated exclusion sets for rule %s: %s", ruleName, changes)
+	return nil
+}
@@ -0,0 +1,155 @@
+package nftables
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	forwardChainName = "prerouting"
+	// ctStatusDNAT is the conntrack status bit of destination NAT
+	// (IPS_DST_NAT)
+	ctStatusDNAT uint32 = 1 << 5
+)
+
+// Forward forwards connections to a port of the router to an internal host
+type Forward struct {
+	Protocol string // tcp or udp
+	Port     uint16
+	// Address limits the forward to one of the router's addresses; nil
+	// matches any of them
+	Address net.IP
+	// Interface limits the forward to connections arriving on it
+	Interface string
+	To        net.IP
+	ToPort    uint16
+	// Hairpin also forwards connections from other interfaces than
+	// Interface, and masquerades them so that the replies return through
+	// the router
+	Hairpin bool
+}
+
+// SetForwards sets up the port forwards in the next Setup
+func (m *Manager) SetForwards(forwards []Forward) {
+	m.forwards = forwards
+}
+
+// setupForwards adds the chain translating the destination of forwarded
+// and mapped connections and of those redirected to the block page or the
+// honeypot, returning it; nil without any
+func (m *Manager) setupForwards() *nftables.Chain {
+	if len(m.forwards) == 0 && m.mappingInterface == "" && !m.blockPage() && !m.honeypotting() {
+		return nil
+	}
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     forwardChainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	for _, f := range m.forwards {
+		family := forwardFamily(f)
+		if !m.carries(family) {
+			continue
+		}
+		var exprs []expr.Any
+		// A hairpin forward is also reached from the inside
+		if f.Interface != "" && !f.Hairpin {
+			exprs = append(exprs, interfaceExpressions(f.Interface)...)
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		)
+		if f.Address != nil {
+			exprs = append(exprs,
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       family.daddrOffset,
+					Len:          family.addrLen,
+				},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: familyAddress(family, f.Address)},
+			)
+		} else {
+			// Any address of the router
+			exprs = append(exprs,
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+			)
+		}
+		exprs = append(exprs, protocolPortExpressions(protocolToNum(f.Protocol), f.Port)...)
+		exprs = append(exprs,
+			&expr.Immediate{Register: 1, Data: familyAddress(family, f.To)},
+			&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(f.ToPort)},
+			&expr.NAT{
+				Type:        expr.NATTypeDestNAT,
+				Family:      uint32(family.nfproto),
+				RegAddrMin:  1,
+				RegProtoMin: 2,
+			},
+		)
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: exprs})
+	}
+	return chain
+}
+
+// hairpinExpressions matches the forwarded connections of a hairpin
+// forward that came from the inside, to be masqueraded
+func hairpinExpressions(f Forward) []expr.Any {
+	family := forwardFamily(f)
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname(f.Interface)},
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+	}
+	exprs = append(exprs, dnatExpressions()...)
+	exprs = append(exprs,
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       family.daddrOffset,
+			Len:          family.addrLen,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: familyAddress(family, f.To)},
+	)
+	return append(exprs, protocolPortExpressions(protocolToNum(f.Protocol), f.ToPort)...)
+}
+
+// dnatExpressions matches connections whose destination was translated
+func dnatExpressions() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATUS, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(ctStatusDNAT),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// forwardFamily returns the address family of a forward's target
+func forwardFamily(f Forward) addrFamily {
+	if f.To.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// familyAddress returns ip in the length of family
+func familyAddress(family addrFamily, ip net.IP) []byte {
+	if family.nfproto == unix.NFPROTO_IPV4 {
+		return ip.To4()
+	}
+	return ip.To16()
+}
@@ -0,0 +1,77 @@
+package nftables
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// FuzzBuildPortExpression tests that the manager builds a matcher for
+// exactly the ports config validation accepts, and that it matches them
+func FuzzBuildPortExpression(f *testing.F) {
+	for _, seed := range []string{"443", "8000-9000", "0", "65536", "80-79", "-1", "+80", "80-", "80abc", "1-65535", "443-443"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		exprs, err := buildPortExpression(s)
+		start, end, validErr := config.ParsePortRange(s)
+		if (err != nil) != (validErr != nil) {
+			t.Fatalf("buildPortExpression(%q) error = %v, validation error = %v", s, err, validErr)
+		}
+		if err != nil {
+			return
+		}
+		if len(exprs) != 2 {
+			t.Fatalf("buildPortExpression(%q) = %d expressions", s, len(exprs))
+		}
+		from, to := []byte{byte(start >> 8), byte(start)}, []byte{byte(end >> 8), byte(end)}
+		switch e := exprs[1].(type) {
+		case *expr.Cmp:
+			if start != end || !bytes.Equal(e.Data, from) {
+				t.Errorf("buildPortExpression(%q) compares %v", s, e.Data)
+			}
+		case *expr.Range:
+			if !bytes.Equal(e.FromData, from) || !bytes.Equal(e.ToData, to) {
+				t.Errorf("buildPortExpression(%q) matches %v-%v", s, e.FromData, e.ToData)
+			}
+		default:
+			t.Errorf("buildPortExpression(%q) matches with %T", s, e)
+		}
+	})
+}
+
+// FuzzParseRange tests that parsed ranges are well formed and hold the
+// address they were parsed from
+func FuzzParseRange(f *testing.F) {
+	for _, seed := range []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::ffff:10.0.0.0/104", "::ffff:192.0.2.1", "10.0.0.1/33", "0.0.0.0/0", "::/0"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		r, err := parseRange(s)
+		if err != nil {
+			return
+		}
+		if len(r.start) != len(r.end) || (len(r.start) != net.IPv4len && len(r.start) != net.IPv6len) {
+			t.Fatalf("parseRange(%q) = %v-%v", s, r.start, r.end)
+		}
+		if bytes.Compare(r.start, r.end) > 0 {
+			t.Fatalf("parseRange(%q) starts after it ends: %v-%v", s, r.start, r.end)
+		}
+		ip, _, cidrErr := net.ParseCIDR(s)
+		if cidrErr != nil {
+			ip = net.ParseIP(s)
+		}
+		if len(r.start) == net.IPv4len {
+			ip = ip.To4()
+		}
+		if !r.contains(ip) {
+			t.Errorf("parseRange(%q) = %v-%v does not hold %v", s, r.start, r.end, ip)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package nftables
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+// TestRenderTextGolden tests the rulesets the manager builds against the
+// golden files in testdata; run with -update to rewrite them after an
+// intended change
+func TestRenderTextGolden(t *testing.T) {
+	testCases := []struct {
+		name  string
+		opts  []Option
+		build func(m *Manager) error
+	}{
+		{
+			name: "rules",
+			build: func(m *Manager) error {
+				for _, rule := range []Rule{
+					{Name: "deny-internal", Action: "deny", IPs: []string{"10.0.0.0/8", "192.168.0.0/16", "fd00::/8"}, Comment: "config=0a1b2c3d4e5f rule=deny-internal"},
+					{Name: "allow-dns", Action: "allow", Protocols: []string{"udp", "tcp"}, Ports: []string{"53"}},
+					{Name: "allow-web", Action: "allow", IPs: []string{"203.0.113.10", "2001:db8::10"}, Protocols: []string{"tcp"}, Ports: []string{"443", "8000-8080"}, BlockQUIC: true},
+					{Name: "guests", Action: "allow", Protocols: []string{"icmp"}, InputInterface: "eth1.100"},
+					{Name: "ssh", Action: "allow", Ports: []string{"22"}, Inspect: true, Queue: 100, Mark: 1},
+				} {
+					if err := m.AddRule(rule); err != nil {
+						return err
+					}
+				}
+				return m.AddQueueRule(100, "tcp", 443)
+			},
+		},
+		{
+			name: "scoped",
+			build: func(m *Manager) error {
+				if err := m.SetProfileSources("ci-runner", []string{"10.0.5.10", "10.0.5.11", "fd00::5"}); err != nil {
+					return err
+				}
+				for _, rule := range []Rule{
+					{Name: "blue-dns", Action: "allow", Protocols: []string{"udp"}, Ports: []string{"53"}, VRF: "blue"},
+					{Name: "ci-registry", Action: "allow", IPs: []string{"198.51.100.0/24"}, Profile: "ci-runner"},
+					{Name: "default", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}},
+				} {
+					if err := m.AddRule(rule); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "metadata and grants",
+			build: func(m *Manager) error {
+				if err := m.SetupMetadataProtection([]string{"169.254.169.254", "fd00:ec2::254"}, []string{"10.0.5.10"}); err != nil {
+					return err
+				}
+				// Added out of order, rendered sorted
+				if err := m.AddGrant(nil, net.ParseIP("198.51.100.7"), 8443, time.Hour); err != nil {
+					return err
+				}
+				if err := m.AddGrant(nil, net.ParseIP("192.0.2.1"), 22, 30*time.Minute); err != nil {
+					return err
+				}
+				return m.AddGrant(nil, net.ParseIP("2001:db8::1"), 443, time.Hour)
+			},
+		},
+		{
+			name: "canary",
+			opts: []Option{Canary(false)},
+			build: func(m *Manager) error {
+				if err := m.AddRule(Rule{Name: "allow-web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}}); err != nil {
+					return err
+				}
+				return m.SplitSources(10)
+			},
+		},
+		{
+			name: "namespace",
+			opts: []Option{InNamespace(3)},
+			build: func(m *Manager) error {
+				return m.AddRule(Rule{Name: "allow-web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager(tc.opts...)
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			if err := tc.build(m); err != nil {
+				t.Fatalf("Failed to build ruleset: %v", err)
+			}
+			got, err := m.RenderText()
+			if err != nil {
+				t.Fatalf("RenderText() error = %v", err)
+			}
+
+			path := filepath.Join("testdata", filepath.Base(t.Name())+".nft")
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatalf("Failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read golden file: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("Ruleset differs from %s:\n%s", path, got)
+			}
+		})
+	}
+}
+
+// TestRenderTextOrder tests that the text does not depend on the order set
+// elements were added in
+func TestRenderTextOrder(t *testing.T) {
+	grants := []net.IP{net.ParseIP("198.51.100.7"), net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.200")}
+	render := func(order ...int) string {
+		m := NewScriptManager()
+		if err := m.Setup(); err != nil {
+			t.Fatalf("Failed to set up: %v", err)
+		}
+		for _, i := range order {
+			if err := m.AddGrant(nil, grants[i], 443, time.Hour); err != nil {
+				t.Fatalf("Failed to add grant: %v", err)
+			}
+		}
+		text, err := m.RenderText()
+		if err != nil {
+			t.Fatalf("RenderText() error = %v", err)
+		}
+		return text
+	}
+
+	if a, b := render(0, 1, 2), render(2, 1, 0); a != b {
+		t.Errorf("Expected the same text for either order:\n%s\n%s", a, b)
+	}
+}
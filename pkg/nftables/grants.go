@@ -0,0 +1,237 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	grantSetName        = "grants"         // IPv4 destination . port grants
+	grant6SetName       = "grants6"        // IPv6 destination . port grants
+	sourceGrantSetName  = "source_grants"  // IPv4 source . destination . port grants
+	sourceGrant6SetName = "source_grants6" // IPv6 source . destination . port grants
+)
+
+// setupGrants creates the timed grant sets and the rules accepting traffic
+// they match ahead of every policy rule
+func (m *Manager) setupGrants() error {
+	if err := m.setupSourceGrants(); err != nil {
+		return err
+	}
+	m.grants = &ruleSets{}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		name := grantSetName
+		if family.nfproto == unix.NFPROTO_IPV6 {
+			name = grant6SetName
+		}
+		set := &nftables.Set{
+			Table:         m.table,
+			Name:          name,
+			KeyType:       nftables.MustConcatSetType(family.keyType, nftables.TypeInetService),
+			Concatenation: true,
+			HasTimeout:    true,
+		}
+		if err := m.conn.AddSet(set, nil); err != nil {
+			return fmt.Errorf("failed to create %s grant set: %w", family.name, err)
+		}
+		m.grants.set(family, set)
+		if !m.carries(family) {
+			continue
+		}
+
+		protoExprs, err := m.transportProtocolExpressions()
+		if err != nil {
+			return err
+		}
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		}
+		exprs = append(exprs, protoExprs...)
+		exprs = append(exprs,
+			// Destination address and port are concatenated in adjacent
+			// registers for the lookup
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       family.daddrOffset,
+				Len:          family.addrLen,
+			},
+			&expr.Payload{
+				DestRegister: portRegister(family),
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       2, // Destination port offset
+				Len:          2, // Port length
+			},
+			&expr.Lookup{
+				SourceRegister: 1,
+				SetName:        set.Name,
+				SetID:          set.ID,
+			},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		)
+		m.conn.InsertRule(&nftables.Rule{
+			Table: m.table,
+			Chain: m.chain,
+			Exprs: exprs,
+		})
+	}
+	return nil
+}
+
+// setupSourceGrants creates the timed sets of grants scoped to a source and
+// the rules accepting traffic they match ahead of every policy rule
+func (m *Manager) setupSourceGrants() error {
+	m.sourceGrants = &ruleSets{}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		name := sourceGrantSetName
+		if family.nfproto == unix.NFPROTO_IPV6 {
+			name = sourceGrant6SetName
+		}
+		set := &nftables.Set{
+			Table:         m.table,
+			Name:          name,
+			KeyType:       nftables.MustConcatSetType(family.keyType, family.keyType, nftables.TypeInetService),
+			Concatenation: true,
+			HasTimeout:    true,
+		}
+		if err := m.conn.AddSet(set, nil); err != nil {
+			return fmt.Errorf("failed to create %s source grant set: %w", family.name, err)
+		}
+		m.sourceGrants.set(family, set)
+		if !m.carries(family) {
+			continue
+		}
+
+		protoExprs, err := m.transportProtocolExpressions()
+		if err != nil {
+			return err
+		}
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		}
+		exprs = append(exprs, protoExprs...)
+		exprs = append(exprs, addressPairExpressions(family)...)
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: pairPortRegister(family),
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       2, // Destination port offset
+				Len:          2, // Port length
+			},
+			&expr.Lookup{
+				SourceRegister: 1,
+				SetName:        set.Name,
+				SetID:          set.ID,
+			},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		)
+		m.conn.InsertRule(&nftables.Rule{
+			Table: m.table,
+			Chain: m.chain,
+			Exprs: exprs,
+		})
+	}
+	return nil
+}
+
+// AddGrant allows TCP and UDP traffic to ip and port until ttl elapses,
+// from source only unless it is nil, ending the redirects of denied HTTP
+// to the block page
+// The kernel removes the element when it expires; an existing grant must be
+// deleted first to change its timeout
+func (m *Manager) AddGrant(source, ip net.IP, port uint16, ttl time.Duration) error {
+	set, key, err := m.grantElement(source, ip, port)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.SetAddElements(set, []nftables.SetElement{{Key: key, Timeout: ttl}}); err != nil {
+		return fmt.Errorf("failed to add grant: %w", err)
+	}
+	m.clearBlockPage()
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add grant: %w", err)
+	}
+	return nil
+}
+
+// DeleteGrant removes a grant from source, or any source if nil, before it
+// expires
+func (m *Manager) DeleteGrant(source, ip net.IP, port uint16) error {
+	set, key, err := m.grantElement(source, ip, port)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.SetDeleteElements(set, []nftables.SetElement{{Key: key}}); err != nil {
+		return fmt.Errorf("failed to delete grant: %w", err)
+	}
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete grant: %w", err)
+	}
+	return nil
+}
+
+// grantElement returns the grant set and element key for ip and port, in
+// the source grant sets if source is set
+func (m *Manager) grantElement(source, ip net.IP, port uint16) (*nftables.Set, []byte, error) {
+	if m.grants == nil || m.sourceGrants == nil {
+		return nil, nil, fmt.Errorf("grant sets are not set up")
+	}
+	if ip.To16() == nil {
+		return nil, nil, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	family := familyIPv6
+	if ip.To4() != nil {
+		family = familyIPv4
+	}
+	sets, key := m.grants, grantKey(familyAddress(family, ip), port)
+	if source != nil {
+		src := familyAddress(family, source)
+		if src == nil || (source.To4() == nil) != (ip.To4() == nil) {
+			return nil, nil, fmt.Errorf("source %s and destination %s must be of the same family", source, ip)
+		}
+		sets, key = m.sourceGrants, sourceGrantKey(src, familyAddress(family, ip), port)
+	}
+	if family.nfproto == unix.NFPROTO_IPV6 {
+		return sets.v6, key, nil
+	}
+	return sets.v4, key, nil
+}
+
+// grantKey builds a concatenated address . port key; every field of a
+// concatenation is padded to a multiple of four bytes
+func grantKey(ip net.IP, port uint16) []byte {
+	key := append([]byte(nil), ip...)
+	return append(key, byte(port>>8), byte(port&0xff), 0, 0)
+}
+
+// sourceGrantKey builds a concatenated source . destination . port key
+func sourceGrantKey(source, ip net.IP, port uint16) []byte {
+	key := append([]byte(nil), source...)
+	return append(key, grantKey(ip, port)...)
+}
+
+// pairPortRegister returns the register following a source and destination
+// address loaded by addressPairExpressions
+func pairPortRegister(family addrFamily) uint32 {
+	if family.nfproto == unix.NFPROTO_IPV6 {
+		return 3
+	}
+	return 10
+}
+
+// portRegister returns the register following the address in a concatenated
+// lookup: the 32 bit register after IPv4 addresses, the next 128 bit register
+// after IPv6 addresses
+func portRegister(family addrFamily) uint32 {
+	if family.nfproto == unix.NFPROTO_IPV6 {
+		return 2
+	}
+	return 9
+}
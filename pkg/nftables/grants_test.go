@@ -0,0 +1,103 @@
+package nftables
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestGrantKey tests concatenated address . port keys
+func TestGrantKey(t *testing.T) {
+	testCases := []struct {
+		name string
+		ip   net.IP
+		port uint16
+		want []byte
+	}{
+		{
+			name: "ipv4",
+			ip:   net.ParseIP("203.0.113.10").To4(),
+			port: 22,
+			want: []byte{203, 0, 113, 10, 0, 22, 0, 0},
+		},
+		{
+			name: "ipv6",
+			ip:   net.ParseIP("2001:db8::1"),
+			port: 443,
+			want: append(net.ParseIP("2001:db8::1").To16(), 0x01, 0xbb, 0, 0),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := grantKey(tc.ip, tc.port); !bytes.Equal(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestSourceGrantKey tests concatenated source . address . port keys
+func TestSourceGrantKey(t *testing.T) {
+	source := net.ParseIP("192.0.2.7").To4()
+	ip := net.ParseIP("203.0.113.10").To4()
+	want := []byte{192, 0, 2, 7, 203, 0, 113, 10, 0, 22, 0, 0}
+	if got := sourceGrantKey(source, ip, 22); !bytes.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// TestEvaluateSourceGrants tests that a grant scoped to a source accepts
+// its traffic only
+func TestEvaluateSourceGrants(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddGrant(net.ParseIP("10.0.0.5"), net.ParseIP("203.0.113.10"), 22, time.Minute); err != nil {
+		t.Fatalf("Failed to add grant: %v", err)
+	}
+	if err := m.AddGrant(net.ParseIP("fd00::5"), net.ParseIP("2001:db8::10"), 22, time.Minute); err != nil {
+		t.Fatalf("Failed to add grant: %v", err)
+	}
+	if err := m.AddGrant(net.ParseIP("10.0.0.5"), net.ParseIP("2001:db8::10"), 22, time.Minute); err == nil {
+		t.Errorf("Expected an error for a grant mixing address families")
+	}
+
+	testCases := []struct {
+		name       string
+		src        string
+		dst        string
+		port       uint16
+		wantAccept bool
+	}{
+		{name: "granted source", src: "10.0.0.5", dst: "203.0.113.10", port: 22, wantAccept: true},
+		{name: "other source", src: "10.0.0.6", dst: "203.0.113.10", port: 22},
+		{name: "other port", src: "10.0.0.5", dst: "203.0.113.10", port: 23},
+		{name: "granted IPv6 source", src: "fd00::5", dst: "2001:db8::10", port: 22, wantAccept: true},
+		{name: "other IPv6 source", src: "fd00::6", dst: "2001:db8::10", port: 22},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := m.Evaluate(Packet{Source: net.ParseIP(tc.src), Destination: net.ParseIP(tc.dst), Protocol: "tcp", Port: tc.port})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept != tc.wantAccept {
+				t.Errorf("Expected accept %v, got %+v", tc.wantAccept, v)
+			}
+		})
+	}
+
+	if err := m.DeleteGrant(net.ParseIP("10.0.0.5"), net.ParseIP("203.0.113.10"), 22); err != nil {
+		t.Fatalf("Failed to delete grant: %v", err)
+	}
+	v, err := m.Evaluate(Packet{Source: net.ParseIP("10.0.0.5"), Destination: net.ParseIP("203.0.113.10"), Protocol: "tcp", Port: 22})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if v.Accept {
+		t.Errorf("Expected the deleted grant to no longer accept, got %+v", v)
+	}
+}
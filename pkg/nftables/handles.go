@@ -0,0 +1,281 @@
+package nftables
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// chainRules records which rule owns each rule of a chain, in chain order.
+// The kernel assigns rule handles when a batch is flushed; since the manager
+// is the only writer of its chains, the handles are looked up by position.
+type chainRules struct {
+	chain  *nftables.Chain
+	owners []string // Rule names; "" for rules not built from a Rule
+}
+
+// track records that the rule just added to the end of chain belongs to
+// owner
+func (m *Manager) track(chain *nftables.Chain, owner string) {
+	if m.chainRules == nil {
+		m.chainRules = make(map[string]*chainRules)
+	}
+	cr, ok := m.chainRules[chain.Name]
+	if !ok {
+		cr = &chainRules{chain: chain}
+		m.chainRules[chain.Name] = cr
+	}
+	cr.owners = append(cr.owners, owner)
+}
+
+// handles returns the kernel handles of a chain's rules, in chain order
+func (m *Manager) handles(cr *chainRules) ([]uint64, error) {
+	rules, err := m.conn.GetRules(m.table, cr.chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules of chain %s: %w", cr.chain.Name, err)
+	}
+	if len(rules) != len(cr.owners) {
+		return nil, fmt.Errorf("chain %s holds %d rules, expected %d", cr.chain.Name, len(rules), len(cr.owners))
+	}
+	handles := make([]uint64, len(rules))
+	for i, r := range rules {
+		handles[i] = r.Handle
+	}
+	return handles, nil
+}
+
+// ownedChains returns the tracked chains holding a rule's rules, sorted by
+// name
+func (m *Manager) ownedChains(name string) []*chainRules {
+	var owned []*chainRules
+	for _, cr := range m.chainRules {
+		for _, owner := range cr.owners {
+			if owner == name {
+				owned = append(owned, cr)
+				break
+			}
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].chain.Name < owned[j].chain.Name })
+	return owned
+}
+
+// RuleHandles returns the kernel handles of the rules built from a rule
+func (m *Manager) RuleHandles(name string) ([]uint64, error) {
+	owned := m.ownedChains(name)
+	if name == "" || len(owned) == 0 {
+		return nil, fmt.Errorf("no rules found for rule %s", name)
+	}
+	var handles []uint64
+	for _, cr := range owned {
+		chainHandles, err := m.handles(cr)
+		if err != nil {
+			return nil, err
+		}
+		for i, owner := range cr.owners {
+			if owner == name {
+				handles = append(handles, chainHandles[i])
+			}
+		}
+	}
+	return handles, nil
+}
+
+// DeleteRule removes the rules built from a rule, its chain and its
+// destination sets, leaving the rest of the ruleset in place
+func (m *Manager) DeleteRule(name string) error {
+	owned := m.ownedChains(name)
+	if name == "" || len(owned) == 0 {
+		return fmt.Errorf("no rules found for rule %s", name)
+	}
+	// The chain itself goes once its rules and the jump to it are deleted
+	for _, cr := range owned {
+		handles, err := m.handles(cr)
+		if err != nil {
+			return err
+		}
+		if err := m.delRules(cr, name, handles); err != nil {
+			return err
+		}
+	}
+	chain, hasChain := m.ruleChains[name]
+	if hasChain {
+		m.conn.DelChain(chain)
+	}
+	sets, excluded := branchSets(m.sets, name), branchSets(m.excludedSets, name)
+	for _, setsName := range sets {
+		m.conn.DelSet(m.sets[setsName].v4)
+		m.conn.DelSet(m.sets[setsName].v6)
+	}
+	for _, setsName := range excluded {
+		m.conn.DelSet(m.excludedSets[setsName].v4)
+		m.conn.DelSet(m.excludedSets[setsName].v6)
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete rule %s: %w", name, err)
+	}
+
+	for _, cr := range owned {
+		cr.owners = spliceOwners(cr.owners, name, 0)
+	}
+	if hasChain {
+		delete(m.chainRules, chain.Name)
+		delete(m.ruleChains, name)
+	}
+	for _, setsName := range sets {
+		delete(m.sets, setsName)
+	}
+	for _, setsName := range excluded {
+		delete(m.excludedSets, setsName)
+	}
+	return nil
+}
+
+// ReplaceRule rebuilds the rules of a rule in its chain, which keeps its
+// place in the policy. Its destination sets are updated to its IPs by
+// difference, so that traffic to unchanged addresses is matched
+// throughout. The rule must stay in the same chain, and have a single
+// branch before and after; otherwise it takes DeleteRule and AddRule.
+func (m *Manager) ReplaceRule(rule Rule) error {
+	chain, ok := m.ruleChains[rule.Name]
+	if rule.Name == "" || !ok {
+		return fmt.Errorf("no rules found for rule %s", rule.Name)
+	}
+	if rule.Branch != 0 || len(branchSets(m.sets, rule.Name)) > 1 || len(branchSets(m.excludedSets, rule.Name)) > 1 {
+		return fmt.Errorf("rule %s has several branches, which can't be replaced in place", rule.Name)
+	}
+	parent, err := m.ruleChain(rule)
+	if err != nil {
+		return err
+	}
+	if cr, ok := m.chainRules[parent.Name]; !ok || !contains(cr.owners, rule.Name) {
+		return fmt.Errorf("rule %s would move to chain %s", rule.Name, parent.Name)
+	}
+	cr := m.chainRules[chain.Name]
+	handles, err := m.handles(cr)
+	if err != nil {
+		return err
+	}
+
+	// Check the rule builds before touching the ruleset, so that a rule that
+	// fails to build leaves the old one in place
+	if _, err := m.buildRules(rule, familyAny, nil); err != nil {
+		return err
+	}
+
+	excluded, hasExcluded := m.excludedSets[rule.Name]
+	if rule.excludes() {
+		if hasExcluded {
+			if _, err := m.replaceRanges(excluded, rule.ExcludedIPs); err != nil {
+				return err
+			}
+		} else if _, err := m.addExcludedSets(rule); err != nil {
+			return err
+		}
+	}
+
+	sets, hasSets := m.sets[rule.Name]
+	wantSets := len(rule.IPs) > 0 || rule.DestinationSet
+	var rules []*nftables.Rule
+	if wantSets || rule.excludes() {
+		// Exclusions alone match any destination of each family
+		familySets := &ruleSets{}
+		if wantSets && hasSets {
+			if _, err := m.replaceRanges(sets, rule.IPs); err != nil {
+				return err
+			}
+			familySets = sets
+		} else if wantSets {
+			if familySets, err = m.addSets(rule); err != nil {
+				return err
+			}
+		}
+		for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+			set := familySets.v4
+			if family == familyIPv6 {
+				set = familySets.v6
+			}
+			familyRules, err := m.buildRules(rule, family, set)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, familyRules...)
+		}
+	} else if rules, err = m.buildRules(rule, familyAny, nil); err != nil {
+		return err
+	}
+
+	if err := m.delRules(cr, rule.Name, handles); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		m.conn.AddRule(r)
+	}
+	if hasSets && !wantSets {
+		m.conn.DelSet(sets.v4)
+		m.conn.DelSet(sets.v6)
+	}
+	if hasExcluded && !rule.excludes() {
+		m.conn.DelSet(excluded.v4)
+		m.conn.DelSet(excluded.v6)
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to replace rule %s: %w", rule.Name, err)
+	}
+
+	cr.owners = spliceOwners(cr.owners, rule.Name, len(rules))
+	if hasSets && !wantSets {
+		delete(m.sets, rule.Name)
+	}
+	if hasExcluded && !rule.excludes() {
+		delete(m.excludedSets, rule.Name)
+	}
+	return nil
+}
+
+// delRules queues the deletion of a rule's rules in a chain, given the
+// chain's handles
+func (m *Manager) delRules(cr *chainRules, name string, handles []uint64) error {
+	for i, owner := range cr.owners {
+		if owner != name {
+			continue
+		}
+		if err := m.conn.DelRule(&nftables.Rule{Table: m.table, Chain: cr.chain, Handle: handles[i]}); err != nil {
+			return fmt.Errorf("failed to delete rule %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// contains reports whether names holds name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// spliceOwners replaces the owners named name with n new ones at the
+// position of the first
+func spliceOwners(owners []string, name string, n int) []string {
+	spliced := make([]string, 0, len(owners)+n)
+	replaced := false
+	for _, owner := range owners {
+		if owner != name {
+			spliced = append(spliced, owner)
+			continue
+		}
+		if !replaced {
+			for i := 0; i < n; i++ {
+				spliced = append(spliced, name)
+			}
+			replaced = true
+		}
+	}
+	return spliced
+}
@@ -0,0 +1,232 @@
+package nftables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+// TestDeleteReplaceRule tests removing and rebuilding single rules while the
+// rest of the chain stays in place
+func TestDeleteReplaceRule(t *testing.T) {
+	testCases := []struct {
+		name      string
+		change    func(m *Manager) error
+		wantRules []string
+		wantSets  []string
+		wantErr   bool
+	}{
+		{
+			name:   "delete",
+			change: func(m *Manager) error { return m.DeleteRule("internal") },
+			wantRules: []string{
+				"meta l4proto tcp th dport 443 counter accept",
+				"meta l4proto udp th dport 53 counter accept",
+				"queue num 100",
+			},
+		},
+		{
+			name: "replace",
+			change: func(m *Manager) error {
+				return m.ReplaceRule(Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"8443"}})
+			},
+			wantRules: []string{
+				"meta nfproto ipv4 ip daddr @ips_internal counter drop",
+				"meta nfproto ipv6 ip6 daddr @ips6_internal counter drop",
+				"meta l4proto tcp th dport 8443 counter accept",
+				"meta l4proto udp th dport 53 counter accept",
+				"queue num 100",
+			},
+			wantSets: []string{"ips_internal", "ips6_internal"},
+		},
+		{
+			name: "replace addresses",
+			change: func(m *Manager) error {
+				return m.ReplaceRule(Rule{Name: "internal", Action: "deny", IPs: []string{"192.168.0.0/16"}})
+			},
+			wantRules: []string{
+				"meta nfproto ipv4 ip daddr @ips_internal counter drop",
+				"meta nfproto ipv6 ip6 daddr @ips6_internal counter drop",
+				"meta l4proto tcp th dport 443 counter accept",
+				"meta l4proto udp th dport 53 counter accept",
+				"queue num 100",
+			},
+			wantSets: []string{"ips_internal", "ips6_internal", "192.168.0.0/16"},
+		},
+		{
+			name: "replace without addresses",
+			change: func(m *Manager) error {
+				return m.ReplaceRule(Rule{Name: "internal", Action: "deny", Protocols: []string{"udp"}})
+			},
+			wantRules: []string{
+				"meta l4proto udp counter drop",
+				"meta l4proto tcp th dport 443 counter accept",
+				"meta l4proto udp th dport 53 counter accept",
+				"queue num 100",
+			},
+		},
+		{
+			name: "replace adding addresses",
+			change: func(m *Manager) error {
+				return m.ReplaceRule(Rule{Name: "dns", Action: "allow", IPs: []string{"192.0.2.53"}, Protocols: []string{"udp"}, Ports: []string{"53"}})
+			},
+			wantRules: []string{
+				"meta nfproto ipv4 ip daddr @ips_internal counter drop",
+				"meta nfproto ipv6 ip6 daddr @ips6_internal counter drop",
+				"meta l4proto tcp th dport 443 counter accept",
+				"meta nfproto ipv4 meta l4proto udp ip daddr @ips_dns th dport 53 counter accept",
+				"meta nfproto ipv6 meta l4proto udp ip6 daddr @ips6_dns th dport 53 counter accept",
+				"queue num 100",
+			},
+			wantSets: []string{"ips_internal", "ips6_internal", "ips_dns", "192.0.2.53"},
+		},
+		{
+			name: "replace invalid",
+			change: func(m *Manager) error {
+				return m.ReplaceRule(Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443x"}})
+			},
+			wantErr: true,
+		},
+		{
+			name: "replace into another chain",
+			change: func(m *Manager) error {
+				return m.ReplaceRule(Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, VRF: "blue"})
+			},
+			wantErr: true,
+		},
+		{
+			name:    "delete unknown",
+			change:  func(m *Manager) error { return m.DeleteRule("unknown") },
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager()
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			for _, rule := range []Rule{
+				{Name: "internal", Action: "deny", IPs: []string{"10.0.0.0/8", "fd00::/8"}},
+				{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}},
+				{Name: "dns", Action: "allow", Protocols: []string{"udp"}, Ports: []string{"53"}},
+			} {
+				if err := m.AddRule(rule); err != nil {
+					t.Fatalf("Failed to add rule %s: %v", rule.Name, err)
+				}
+			}
+			if err := m.AddQueueRule(100, "tcp", 22); err != nil {
+				t.Fatalf("Failed to add queue rule: %v", err)
+			}
+			before := chainText(t, m)
+
+			err := tc.change(m)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				if after := chainText(t, m); !reflect.DeepEqual(after, before) {
+					t.Errorf("Expected the chain unchanged, got %q", after)
+				}
+				return
+			}
+
+			got := chainText(t, m)
+			if len(got) != len(tc.wantRules) {
+				t.Fatalf("Expected %d rules, got %q", len(tc.wantRules), got)
+			}
+			for i, want := range tc.wantRules {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("Expected rule %d to contain %q, got %q", i, want, got[i])
+				}
+			}
+
+			// Handles keep resolving after the change
+			if _, err := m.RuleHandles("web"); err != nil {
+				t.Errorf("RuleHandles() error = %v", err)
+			}
+
+			text, err := m.RenderText()
+			if err != nil {
+				t.Fatalf("RenderText() error = %v", err)
+			}
+			for _, set := range []string{"ips_internal", "ips6_internal", "ips_dns"} {
+				want := false
+				for _, s := range tc.wantSets {
+					want = want || s == set
+				}
+				if strings.Contains(text, "set "+set+" ") != want {
+					t.Errorf("Expected set %s present %v:\n%s", set, want, text)
+				}
+			}
+			for _, s := range tc.wantSets {
+				if !strings.Contains(text, s) {
+					t.Errorf("Expected %q in:\n%s", s, text)
+				}
+			}
+		})
+	}
+}
+
+// TestRuleHandles tests finding the handles of a rule's rules
+func TestRuleHandles(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "web", Action: "allow", IPs: []string{"192.0.2.1"}, Protocols: []string{"tcp"}, BlockQUIC: true}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+
+	handles, err := m.RuleHandles("web")
+	if err != nil {
+		t.Fatalf("RuleHandles() error = %v", err)
+	}
+	// The jump to the rule's chain, then a QUIC block and a rule per family
+	var rules []*nftables.Rule
+	for _, chain := range []*nftables.Chain{m.rules, m.ruleChains["web"]} {
+		chainRules, err := m.conn.GetRules(m.table, chain)
+		if err != nil {
+			t.Fatalf("GetRules() error = %v", err)
+		}
+		rules = append(rules, chainRules...)
+	}
+	if len(handles) != 5 || len(rules) != 5 {
+		t.Fatalf("Expected 5 handles, got %v", handles)
+	}
+	for i, r := range rules {
+		if r.Handle != handles[i] {
+			t.Errorf("Expected handle %d at %d, got %d", handles[i], i, r.Handle)
+		}
+	}
+}
+
+// chainText returns the rules of the egress_rules chain as nft statements,
+// with the rules of the rule chains it jumps to in place of the jumps
+func chainText(t *testing.T, m *Manager) []string {
+	t.Helper()
+	table := m.conn.(*scriptConn).table(m.table)
+	var text []string
+	for _, r := range table.chainNamed(rulesName).rules {
+		line, err := table.ruleText(r)
+		if err != nil {
+			t.Fatalf("Failed to render rule: %v", err)
+		}
+		name, ok := strings.CutPrefix(line, "jump ")
+		if !ok {
+			text = append(text, line)
+			continue
+		}
+		for _, r := range table.chainNamed(name).rules {
+			line, err := table.ruleText(r)
+			if err != nil {
+				t.Fatalf("Failed to render rule: %v", err)
+			}
+			text = append(text, line)
+		}
+	}
+	return text
+}
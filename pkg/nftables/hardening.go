@@ -0,0 +1,206 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	hardeningChainName     = "hardening"
+	hardeningBogonSetName  = "hardening_bogons"  // IPv4 bogon sources
+	hardeningBogon6SetName = "hardening_bogons6" // IPv6 bogon sources
+)
+
+// TCP header flags, in the byte at offset 13 of the header
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagURG = 0x20
+)
+
+// tcpFlagsOffset is the offset of the flags in the TCP header
+const tcpFlagsOffset = 13
+
+// Hardening selects the protections SetupHardening installs
+type Hardening struct {
+	// DropInvalid drops packets in the invalid ct state
+	DropInvalid bool
+	// ReversePath drops packets whose source isn't routed back through the
+	// interface they arrived on
+	ReversePath bool
+	// TCPFlags drops TCP packets with bogus flags, and new connections not
+	// opened with a SYN
+	TCPFlags bool
+	// WANInterfaces drop packets from Bogons (IPs or CIDRs)
+	WANInterfaces []string
+	Bogons        []string
+}
+
+// SetupHardening drops invalid and spoofed packets, counting the drops. It
+// has a base chain of its own ahead of the metadata and policy chains, so
+// that neither rules nor grants let such packets through.
+func (m *Manager) SetupHardening(h Hardening) error {
+	// The running table keeps dropping such packets during a rollout
+	if m.canary {
+		return nil
+	}
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     hardeningChainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  m.hook(),
+		Priority: m.hardeningPriority(),
+	})
+	drop := func(exprs ...expr.Any) {
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: append(exprs, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}),
+		})
+	}
+
+	var (
+		enabled []string
+		bogons  *ruleSets
+	)
+	if h.DropInvalid {
+		exprs, err := ctStateExpressions([]string{"invalid"})
+		if err != nil {
+			return err
+		}
+		drop(exprs...)
+		enabled = append(enabled, "invalid packets")
+	}
+
+	// The route back to the source is only known for packets that arrived
+	// on an interface
+	if h.ReversePath && *m.hook() != *nftables.ChainHookOutput {
+		drop(
+			&expr.Fib{Register: 1, FlagSADDR: true, FlagIIF: true, ResultOIF: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		)
+		enabled = append(enabled, "reverse path")
+	}
+
+	if h.TCPFlags {
+		for _, flags := range []struct{ mask, value byte }{
+			{tcpFlagFIN | tcpFlagSYN, tcpFlagFIN | tcpFlagSYN},
+			{tcpFlagSYN | tcpFlagRST, tcpFlagSYN | tcpFlagRST},
+			{tcpFlagFIN | tcpFlagRST, tcpFlagFIN | tcpFlagRST},
+			{tcpFlagFIN | tcpFlagPSH | tcpFlagURG, tcpFlagFIN | tcpFlagPSH | tcpFlagURG},     // Xmas scan
+			{tcpFlagFIN | tcpFlagSYN | tcpFlagRST | tcpFlagPSH | tcpFlagACK | tcpFlagURG, 0}, // Null scan
+		} {
+			drop(tcpFlagsExpressions(flags.mask, expr.CmpOpEq, flags.value)...)
+		}
+		ct, err := ctStateExpressions([]string{"new"})
+		if err != nil {
+			return err
+		}
+		drop(append(ct, tcpFlagsExpressions(tcpFlagFIN|tcpFlagSYN|tcpFlagRST|tcpFlagACK, expr.CmpOpNeq, tcpFlagSYN)...)...)
+		enabled = append(enabled, "tcp flags")
+	}
+
+	if len(h.WANInterfaces) > 0 {
+		v4, v6, err := m.addressRanges(h.Bogons)
+		if err != nil {
+			return fmt.Errorf("invalid bogon: %w", err)
+		}
+		bogons = &ruleSets{ranges4: v4, ranges6: v6}
+		for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+			name, ranges := hardeningBogonSetName, v4
+			if family == familyIPv6 {
+				name, ranges = hardeningBogon6SetName, v6
+			}
+			set, err := m.addRangeSet(name, family, ranges)
+			if err != nil {
+				return fmt.Errorf("failed to create %s bogon set: %w", family.name, err)
+			}
+			bogons.set(family, set)
+			if !m.carries(family) {
+				continue
+			}
+			for _, iface := range h.WANInterfaces {
+				drop(append(interfaceExpressions(iface),
+					&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseNetworkHeader,
+						Offset:       family.saddrOffset,
+						Len:          family.addrLen,
+					},
+					&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+				)...)
+			}
+		}
+		enabled = append(enabled, "bogons on "+strings.Join(h.WANInterfaces, ", "))
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set up hardening: %w", err)
+	}
+	m.hardeningChain, m.hardeningBogons = chain, bogons
+	log.Printf("Hardening: dropping %s", strings.Join(enabled, ", "))
+	return nil
+}
+
+// UpdateHardeningBogons replaces the bogon sources dropped on the WAN
+// interfaces, such as the refreshed full bogons
+func (m *Manager) UpdateHardeningBogons(ips []string) error {
+	if m.hardeningBogons == nil {
+		return nil
+	}
+	changes, err := m.replaceRanges(m.hardeningBogons, ips)
+	if err != nil || changes == "" {
+		return err
+	}
+	log.Printf("Updated hardening bogon sets: %s", changes)
+	return nil
+}
+
+// tcpFlagsExpressions returns the expressions comparing the masked flags
+// of TCP packets to value, as `tcp flags & (fin|syn) == fin|syn`
+func tcpFlagsExpressions(mask byte, op expr.CmpOp, value byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       tcpFlagsOffset,
+			Len:          1,
+		},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{mask}, Xor: []byte{0}},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte{value}},
+	}
+}
+
+// HardeningDrops returns the number of invalid and spoofed packets
+// dropped, or 0 if hardening is not set up
+func (m *Manager) HardeningDrops() (uint64, error) {
+	if m.hardeningChain == nil {
+		return 0, nil
+	}
+	rules, err := m.conn.GetRules(m.table, m.hardeningChain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read hardening counters: %w", err)
+	}
+	var packets uint64
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				packets += counter.Packets
+			}
+		}
+	}
+	return packets, nil
+}
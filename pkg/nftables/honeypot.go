@@ -0,0 +1,145 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	honeypotTargetSetName  = "honeypot_targets"  // IPv4 destinations redirected
+	honeypotTarget6SetName = "honeypot_targets6" // IPv6 destinations redirected
+	honeypotExemptSetName  = "honeypot_exempt"   // IPv4 sources never redirected
+	honeypotExempt6SetName = "honeypot_exempt6"  // IPv6 sources never redirected
+)
+
+// Honeypot is where SetHoneypot redirects connections to
+type Honeypot struct {
+	// Port of the listener on the router
+	Port uint16
+	// Targets are the destinations redirected (IPs or CIDRs), on Ports or
+	// all ports if none
+	Targets []string
+	Ports   []string
+	// Exempt sources keep reaching the targets (IPs or CIDRs)
+	Exempt []string
+}
+
+// SetHoneypot redirects TCP connections to the honeypot's targets to its
+// port on the router from the next Setup, nil turns it off. Canary and
+// namespace tables don't redirect.
+func (m *Manager) SetHoneypot(h *Honeypot) {
+	m.honeypot = h
+}
+
+// honeypotting reports whether connections to targets are redirected
+func (m *Manager) honeypotting() bool {
+	return m.honeypot != nil && !m.local() && !m.canary
+}
+
+// setupHoneypot creates the sets of the targets and exempt sources, and the
+// rules redirecting the targets in the prerouting chain, counting the
+// redirected connections
+func (m *Manager) setupHoneypot(prerouting *nftables.Chain) error {
+	if !m.honeypotting() {
+		return nil
+	}
+	targets4, targets6, err := m.addressRanges(m.honeypot.Targets)
+	if err != nil {
+		return fmt.Errorf("invalid honeypot target: %w", err)
+	}
+	exempt4, exempt6, err := m.addressRanges(m.honeypot.Exempt)
+	if err != nil {
+		return fmt.Errorf("invalid honeypot exemption: %w", err)
+	}
+	ports, err := m.portExpressions(m.honeypot.Ports)
+	if err != nil {
+		return fmt.Errorf("invalid honeypot ports: %w", err)
+	}
+
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		targetName, targetRanges := honeypotTargetSetName, targets4
+		exemptName, exemptRanges := honeypotExemptSetName, exempt4
+		if family == familyIPv6 {
+			targetName, targetRanges = honeypotTarget6SetName, targets6
+			exemptName, exemptRanges = honeypotExempt6SetName, exempt6
+		}
+		if !m.carries(family) || len(targetRanges) == 0 {
+			continue
+		}
+		targets, err := m.addRangeSet(targetName, family, targetRanges)
+		if err != nil {
+			return fmt.Errorf("failed to create %s honeypot target set: %w", family.name, err)
+		}
+
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+		}
+		if len(exemptRanges) > 0 {
+			exempt, err := m.addRangeSet(exemptName, family, exemptRanges)
+			if err != nil {
+				return fmt.Errorf("failed to create %s honeypot exempt set: %w", family.name, err)
+			}
+			exprs = append(exprs,
+				sourceExpression(family),
+				&expr.Lookup{SourceRegister: 1, SetName: exempt.Name, SetID: exempt.ID, Invert: true},
+			)
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		)
+		exprs = append(exprs, ports...)
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       family.daddrOffset,
+				Len:          family.addrLen,
+			},
+			&expr.Lookup{SourceRegister: 1, SetName: targets.Name, SetID: targets.ID},
+			&expr.Counter{},
+			&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(m.honeypot.Port)},
+			&expr.Redir{RegisterProtoMin: 1},
+		)
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: prerouting, Exprs: exprs})
+	}
+	m.honeypotChain = prerouting
+	log.Printf("Redirecting TCP connections to %d honeypot targets to port %d", len(m.honeypot.Targets), m.honeypot.Port)
+	return nil
+}
+
+// HoneypotRedirects returns the number of connections redirected to the
+// honeypot, or 0 if it is not set up
+func (m *Manager) HoneypotRedirects() (uint64, error) {
+	if m.honeypotChain == nil {
+		return 0, nil
+	}
+	rules, err := m.conn.GetRules(m.table, m.honeypotChain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read honeypot counters: %w", err)
+	}
+	// The prerouting chain also holds the forwards and the block page
+	var packets uint64
+	for _, rule := range rules {
+		honeypot := false
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Lookup:
+				if e.SetName == honeypotTargetSetName || e.SetName == honeypotTarget6SetName {
+					honeypot = true
+				}
+			case *expr.Counter:
+				if honeypot {
+					packets += e.Packets
+				}
+			}
+		}
+	}
+	return packets, nil
+}
@@ -0,0 +1,85 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	inspectionExemptSetName  = "inspection_exempt"  // IPv4 sources never queued
+	inspectionExempt6SetName = "inspection_exempt6" // IPv6 sources never queued
+)
+
+// SetInspectionExempt keeps traffic from sources (IPs or CIDRs) out of the
+// inspection queues from the next Setup, so that it is decided by the rules
+// matching addresses alone
+func (m *Manager) SetInspectionExempt(sources []string) {
+	m.inspectionExempt = sources
+}
+
+// setupInspectionExempt creates the sets of the sources exempt from
+// inspection, if any
+func (m *Manager) setupInspectionExempt() error {
+	if len(m.inspectionExempt) == 0 {
+		return nil
+	}
+	v4, v6, err := m.addressRanges(m.inspectionExempt)
+	if err != nil {
+		return fmt.Errorf("invalid inspection exemption: %w", err)
+	}
+	m.inspectionExemptSets = &ruleSets{}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		if !m.carries(family) {
+			continue
+		}
+		name, ranges := inspectionExemptSetName, v4
+		if family.nfproto == unix.NFPROTO_IPV6 {
+			name, ranges = inspectionExempt6SetName, v6
+		}
+		set, err := m.addRangeSet(name, family, ranges)
+		if err != nil {
+			return fmt.Errorf("failed to create %s inspection exempt set: %w", family.name, err)
+		}
+		m.inspectionExemptSets.set(family, set)
+	}
+	return nil
+}
+
+// queueFamilies returns the families a queue rule of family is built for:
+// the source of a packet can only be matched against the exempt sources
+// once its family is known
+func (m *Manager) queueFamilies(family addrFamily) []addrFamily {
+	if m.inspectionExemptSets == nil || family.nfproto != 0 {
+		return []addrFamily{family}
+	}
+	var families []addrFamily
+	for _, f := range []addrFamily{familyIPv4, familyIPv6} {
+		if m.carries(f) {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// inspectionExemptExpressions returns the expressions skipping a queue rule
+// of family for the exempt sources; nothing without exempt sources
+func (m *Manager) inspectionExemptExpressions(family addrFamily) []expr.Any {
+	if m.inspectionExemptSets == nil || family.nfproto == 0 {
+		return nil
+	}
+	set := m.inspectionExemptSets.v4
+	if family.nfproto == unix.NFPROTO_IPV6 {
+		set = m.inspectionExemptSets.v6
+	}
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       family.saddrOffset,
+			Len:          family.addrLen,
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: true},
+	}
+}
@@ -0,0 +1,191 @@
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+const (
+	// Ranges per set element message; a message's attributes are limited
+	// to 64 KiB, which a range of two IPv6 elements takes about 80 bytes of
+	messageRanges = 512
+	// Ranges per transaction when adding to or removing from large sets
+	defaultBatchSize = 16384
+)
+
+// BatchSize flushes changes to large sets, such as IP range feeds, in
+// transactions of n address ranges rather than one, so that they don't
+// overflow the netlink socket's buffer
+func BatchSize(n int) Option {
+	return func(m *Manager) {
+		m.batchSize = n
+	}
+}
+
+// batchRanges applies op, adding or removing elements, to the elements of
+// ranges, split into messages and flushed in batches; the last batch is
+// left for the caller to flush along with its other changes. The ends of a
+// range stay in one batch, so that a flushed set never holds half of one.
+func (m *Manager) batchRanges(set *nftables.Set, ranges []ipRange, verb string, op func(*nftables.Set, []nftables.SetElement) error) error {
+	batchSize := m.batchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	for start := 0; start < len(ranges); start += messageRanges {
+		end := min(start+messageRanges, len(ranges))
+		elements := make([]nftables.SetElement, 0, 2*(end-start))
+		for _, r := range ranges[start:end] {
+			elements = append(elements, rangeElements(r)...)
+		}
+		if err := op(set, elements); err != nil {
+			return err
+		}
+
+		// Flush every batchSize ranges, or as near as whole messages allow
+		if end == len(ranges) || end/batchSize == start/batchSize {
+			continue
+		}
+		if err := m.conn.Flush(); err != nil {
+			return fmt.Errorf("failed to apply set elements: %w", err)
+		}
+		log.Printf("%s %d/%d ranges of set %s", verb, end, len(ranges), set.Name)
+	}
+	return nil
+}
+
+// ipRange is an inclusive range of addresses of a single family
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// key identifies a range for diffing set contents
+func (r ipRange) key() string {
+	return r.start.String() + "-" + r.end.String()
+}
+
+// contains reports whether ip, of the range's family, is in the range
+func (r ipRange) contains(ip net.IP) bool {
+	return bytes.Compare(ip, r.start) >= 0 && bytes.Compare(ip, r.end) <= 0
+}
+
+// splitFamilies splits IP and CIDR strings into IPv4 and IPv6 ranges
+// Overlapping and adjacent ranges are merged, as required by interval sets
+func splitFamilies(ips []string) (v4, v6 []ipRange, invalid []string) {
+	for _, s := range ips {
+		r, err := parseRange(s)
+		if err != nil {
+			invalid = append(invalid, s)
+			continue
+		}
+		if len(r.start) == net.IPv4len {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+	return mergeRanges(v4), mergeRanges(v6), invalid
+}
+
+// parseRange parses a single IP or CIDR into a range
+// IPv4 ranges use 4 byte addresses, IPv6 ranges 16 byte addresses
+func parseRange(s string) (ipRange, error) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		start := ipNet.IP
+		if v4 := start.To4(); v4 != nil {
+			start = v4
+		}
+		// IPv4-mapped IPv6 networks have a 16 byte mask for 4 byte addresses
+		mask := ipNet.Mask[len(ipNet.Mask)-len(start):]
+		end := make(net.IP, len(start))
+		for i := range start {
+			end[i] = start[i] | ^mask[i]
+		}
+		return ipRange{start: start, end: end}, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ipRange{}, fmt.Errorf("invalid IP address: %s", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return ipRange{start: ip, end: ip}, nil
+}
+
+// mergeRanges sorts ranges and merges overlapping or adjacent ones
+func mergeRanges(ranges []ipRange) []ipRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	merged := []ipRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		next, overflow := nextIP(last.end)
+		if overflow || bytes.Compare(r.start, next) <= 0 {
+			if bytes.Compare(r.end, last.end) > 0 {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// nextIP returns ip+1, reporting overflow past the end of the address space
+func nextIP(ip net.IP) (net.IP, bool) {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next, false
+		}
+	}
+	return next, true
+}
+
+// rangeElements converts a range into interval set elements
+// The interval end is exclusive; ranges reaching the end of the address space
+// have no end element
+func rangeElements(r ipRange) []nftables.SetElement {
+	elements := []nftables.SetElement{{Key: r.start}}
+	if end, overflow := nextIP(r.end); !overflow {
+		elements = append(elements, nftables.SetElement{Key: end, IntervalEnd: true})
+	}
+	return elements
+}
+
+// diffRanges returns the ranges only in wanted and the ranges only in current
+func diffRanges(current, wanted []ipRange) (added, removed []ipRange) {
+	have := make(map[string]bool)
+	for _, r := range current {
+		have[r.key()] = true
+	}
+	want := make(map[string]bool)
+	for _, r := range wanted {
+		want[r.key()] = true
+		if !have[r.key()] {
+			added = append(added, r)
+		}
+	}
+	for _, r := range current {
+		if !want[r.key()] {
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,203 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+// TestSplitFamilies tests range parsing, family split and merging
+func TestSplitFamilies(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ips     []string
+		wantV4  []string
+		wantV6  []string
+		invalid int
+	}{
+		{
+			name:   "single addresses",
+			ips:    []string{"8.8.8.8", "2001:db8::1"},
+			wantV4: []string{"8.8.8.8-8.8.8.8"},
+			wantV6: []string{"2001:db8::1-2001:db8::1"},
+		},
+		{
+			name:   "cidr expands to full range",
+			ips:    []string{"10.0.0.0/8"},
+			wantV4: []string{"10.0.0.0-10.255.255.255"},
+		},
+		{
+			name:   "contained address merged",
+			ips:    []string{"10.1.2.3", "10.0.0.0/8"},
+			wantV4: []string{"10.0.0.0-10.255.255.255"},
+		},
+		{
+			name:   "adjacent ranges merged",
+			ips:    []string{"192.168.1.0/24", "192.168.0.0/24", "192.168.3.0/24"},
+			wantV4: []string{"192.168.0.0-192.168.1.255", "192.168.3.0-192.168.3.255"},
+		},
+		{
+			name:   "ipv6 cidr",
+			ips:    []string{"2001:db8::/32"},
+			wantV6: []string{"2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		},
+		{
+			name:   "ipv4-mapped cidr",
+			ips:    []string{"::ffff:10.0.0.0/104"},
+			wantV4: []string{"10.0.0.0-10.255.255.255"},
+		},
+		{
+			name:    "invalid entries reported",
+			ips:     []string{"not-an-ip", "1.2.3.4/33", "1.1.1.1"},
+			wantV4:  []string{"1.1.1.1-1.1.1.1"},
+			invalid: 2,
+		},
+	}
+
+	keys := func(ranges []ipRange) string {
+		var result []string
+		for _, r := range ranges {
+			result = append(result, r.key())
+		}
+		return strings.Join(result, ",")
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v4, v6, invalid := splitFamilies(tc.ips)
+			if got := keys(v4); got != strings.Join(tc.wantV4, ",") {
+				t.Errorf("v4 = %s, want %v", got, tc.wantV4)
+			}
+			if got := keys(v6); got != strings.Join(tc.wantV6, ",") {
+				t.Errorf("v6 = %s, want %v", got, tc.wantV6)
+			}
+			if len(invalid) != tc.invalid {
+				t.Errorf("invalid = %v, want %d entries", invalid, tc.invalid)
+			}
+		})
+	}
+}
+
+// TestRangeElements tests interval element generation
+func TestRangeElements(t *testing.T) {
+	r, _ := parseRange("10.0.0.0/8")
+	elements := rangeElements(r)
+	if len(elements) != 2 {
+		t.Fatalf("Expected 2 elements, got %d", len(elements))
+	}
+	if net.IP(elements[1].Key).String() != "11.0.0.0" || !elements[1].IntervalEnd {
+		t.Errorf("Expected exclusive interval end 11.0.0.0, got %v", elements[1])
+	}
+
+	r, _ = parseRange("0.0.0.0/0")
+	if elements := rangeElements(r); len(elements) != 1 {
+		t.Errorf("Expected open-ended range to have 1 element, got %d", len(elements))
+	}
+}
+
+// batchConn counts the element messages and flushes of a recorded ruleset
+type batchConn struct {
+	conn
+	messages, flushes int
+	largest           int // Most elements in one message
+}
+
+func (c *batchConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.messages++
+	c.largest = max(c.largest, len(vals))
+	return c.conn.SetAddElements(s, vals)
+}
+
+func (c *batchConn) Flush() error {
+	c.flushes++
+	return c.conn.Flush()
+}
+
+// feed returns n distinct, non-adjacent /24 networks
+func feed(n int) []string {
+	ips := make([]string, n)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("%d.%d.%d.0/24", 10+i/32768, i/128%256, i%128*2)
+	}
+	return ips
+}
+
+// TestBatchRanges tests that large sets are added in bounded messages and
+// flushed in batches
+func TestBatchRanges(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ranges      int
+		batchSize   int
+		wantMessage int
+		wantFlushes int // Including one per family adding the rule
+	}{
+		{name: "small set", ranges: 10, wantMessage: 1, wantFlushes: 2},
+		{name: "one batch", ranges: 2000, wantMessage: 4, wantFlushes: 2},
+		{name: "batches", ranges: 2000, batchSize: 1000, wantMessage: 4, wantFlushes: 3},
+		{name: "batch per message", ranges: 2000, batchSize: 100, wantMessage: 4, wantFlushes: 5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager(BatchSize(tc.batchSize))
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			bc := &batchConn{conn: m.conn}
+			m.conn = bc
+
+			if err := m.AddRule(Rule{Name: "feed", Action: "deny", IPs: feed(tc.ranges)}); err != nil {
+				t.Fatalf("AddRule() error = %v", err)
+			}
+			if bc.messages != tc.wantMessage || bc.flushes != tc.wantFlushes {
+				t.Errorf("Expected %d messages and %d flushes, got %d and %d", tc.wantMessage, tc.wantFlushes, bc.messages, bc.flushes)
+			}
+			if bc.largest > 2*messageRanges {
+				t.Errorf("Expected at most %d elements per message, got %d", 2*messageRanges, bc.largest)
+			}
+			for i, ip := range []string{"10.0.0.7", fmt.Sprintf("10.%d.%d.1", (tc.ranges-1)/128%256, (tc.ranges-1)%128*2)} {
+				if !m.ContainsIP("feed", net.ParseIP(ip)) {
+					t.Errorf("Expected range %d to contain %s", i, ip)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddRanges(b *testing.B) {
+	ips := feed(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := NewScriptManager()
+		if err := m.Setup(); err != nil {
+			b.Fatalf("Failed to set up: %v", err)
+		}
+		if err := m.AddRule(Rule{Name: "feed", Action: "deny", IPs: ips}); err != nil {
+			b.Fatalf("AddRule() error = %v", err)
+		}
+	}
+	b.ReportMetric(float64(len(ips))*float64(b.N)/b.Elapsed().Seconds(), "ranges/s")
+}
+
+func BenchmarkUpdateIPs(b *testing.B) {
+	ips := feed(110000)
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		b.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "feed", Action: "deny", IPs: ips[:100000]}); err != nil {
+		b.Fatalf("AddRule() error = %v", err)
+	}
+	// Each update swaps a tenth of the feed
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shift := 10000 * (i%2 + 1)
+		if err := m.UpdateIPs("feed", ips[shift-10000:shift+90000]); err != nil {
+			b.Fatalf("UpdateIPs() error = %v", err)
+		}
+	}
+}
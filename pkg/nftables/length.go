@@ -0,0 +1,37 @@
+package nftables
+
+import (
+	"math"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// lengthExpressions returns the expressions matching the length of a
+// rule's packets, as `meta length > 1400`; nothing unless the rule matches
+// it. The length is loaded in host byte order and converted, as nft does,
+// since comparisons go byte by byte.
+func lengthExpressions(rule Rule) []expr.Any {
+	if rule.MaxLength == 0 {
+		return nil
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyLEN, Register: 1},
+		&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 4, Size: 4},
+	}
+	min, max := uint32(rule.MinLength), uint32(rule.MaxLength)
+	switch {
+	case min == max:
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint32(min)})
+	case min == 0:
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpLt, Register: 1, Data: binaryutil.BigEndian.PutUint32(max + 1)})
+	case max == math.MaxUint16:
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: binaryutil.BigEndian.PutUint32(min - 1)})
+	}
+	return append(exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint32(min),
+		ToData:   binaryutil.BigEndian.PutUint32(max),
+	})
+}
@@ -4,27 +4,204 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	tableName  = "legion_filter"
-	chainName  = "egress_filter"
-	setNameFmt = "ips_%s" // IP sets per rule
+	tableName   = "legion_filter"
+	chainName   = "egress_filter"
+	rulesName   = "egress_rules"
+	setNameFmt  = "ips_%s"  // IPv4 sets per rule
+	set6NameFmt = "ips6_%s" // IPv6 sets per rule
 )
 
+// addrFamily describes how destinations of an address family are matched
+type addrFamily struct {
+	name        string
+	nfproto     byte // 0 matches any family
+	setNameFmt  string
+	keyType     nftables.SetDatatype
+	saddrOffset uint32 // Source address offset in the network header
+	daddrOffset uint32 // Destination address offset in the network header
+	addrLen     uint32
+	ttlOffset   uint32 // TTL or hop limit offset in the network header
+}
+
+var (
+	familyAny  = addrFamily{name: "any"}
+	familyIPv4 = addrFamily{
+		name:        "ipv4",
+		nfproto:     unix.NFPROTO_IPV4,
+		setNameFmt:  setNameFmt,
+		keyType:     nftables.TypeIPAddr,
+		saddrOffset: 12,
+		daddrOffset: 16,
+		addrLen:     4,
+		ttlOffset:   8,
+	}
+	familyIPv6 = addrFamily{
+		name:        "ipv6",
+		nfproto:     unix.NFPROTO_IPV6,
+		setNameFmt:  set6NameFmt,
+		keyType:     nftables.TypeIP6Addr,
+		saddrOffset: 8,
+		daddrOffset: 24,
+		addrLen:     16,
+		ttlOffset:   7,
+	}
+)
+
+// ruleSets holds a rule's per-family destination sets and their contents
+type ruleSets struct {
+	v4      *nftables.Set
+	v6      *nftables.Set
+	ranges4 []ipRange
+	ranges6 []ipRange
+}
+
+// set assigns the set of a family
+func (s *ruleSets) set(family addrFamily, set *nftables.Set) {
+	if family.nfproto == unix.NFPROTO_IPV6 {
+		s.v6 = set
+	} else {
+		s.v4 = set
+	}
+}
+
+// conn is the part of *nftables.Conn the manager uses, so that a ruleset
+// can be recorded and rendered instead of programmed
+type conn interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	AddChain(c *nftables.Chain) *nftables.Chain
+	AddRule(r *nftables.Rule) *nftables.Rule
+	InsertRule(r *nftables.Rule) *nftables.Rule
+	DelRule(r *nftables.Rule) error
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
+	DelChain(c *nftables.Chain)
+	SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error
+	GetSetElements(s *nftables.Set) ([]nftables.SetElement, error)
+	DelSet(s *nftables.Set)
+	FlushSet(s *nftables.Set)
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+	ListChains() ([]*nftables.Chain, error)
+	Flush() error
+}
+
 // Manager manages nftables rules
 type Manager struct {
-	conn  *nftables.Conn
+	conn  conn
+	name  string // Table name
 	table *nftables.Table
 	chain *nftables.Chain
-	sets  map[string]*nftables.Set // Rule name -> IP set
+	// Chain of the rules not scoped to a VRF or profile
+	rules *nftables.Chain
+	sets  map[string]*ruleSets // Rule name -> destination sets
+	// Rule name -> sets of the destinations it excludes
+	excludedSets map[string]*ruleSets
+	// Timed destination . port grants (ranges are unused)
+	grants *ruleSets
+	// Timed source . destination . port grants
+	sourceGrants *ruleSets
+	// VRF device -> chain of the rules scoped to it
+	vrfChains map[string]*nftables.Chain
+	// Profile -> chain of the rules scoped to it and its source sets
+	profiles map[string]*profile
+	// Chain dropping traffic to the instance metadata service, if set up
+	metadataChain *nftables.Chain
+	// Chain dropping invalid and spoofed packets, if set up
+	hardeningChain *nftables.Chain
+	// Bogon sources the hardening chain drops on the WAN interfaces
+	hardeningBogons *ruleSets
+	// Chain dropping new connections beyond their rate, if set up
+	rateLimitChain *nftables.Chain
+	// How repeat offenders are banned, see SetBan
+	ban *Ban
+	// Chain dropping the banned sources, if set up
+	banChain *nftables.Chain
+	// Timed sets of the banned sources and of the offenders' denied rates
+	// (ranges are unused)
+	bannedSets   *ruleSets
+	banOffenders *ruleSets
+	// Interval sets of the sources never banned, if any
+	banExemptSets *ruleSets
+	// Chain name -> chain taking a deny verdict after counting the
+	// source's denied packets, see offenderChain
+	banChains map[string]*nftables.Chain
+	// Network namespace programmed instead of the router's own, if set
+	netnsFd int
+	// Set for the table of a canary policy, see Canary
+	canary  bool
+	logOnly bool
+	// Skip parts of rules that fail to build instead of failing the rule
+	lenient bool
+	// Chain name -> the rules the chain holds, see track
+	chainRules map[string]*chainRules
+	// Table family, hook and priority, see SetPlacement
+	placement Placement
+	// Rule name -> the chain holding the rule's rules, see subChain
+	ruleChains map[string]*nftables.Chain
+	// Ranges of a set flushed per transaction, see BatchSize
+	batchSize int
+	// Changes to the addresses in sets, see Updates
+	updates uint64
+	// What is sent to the connection log, if anything; see SetConnectionLog
+	connLog *ConnectionLog
+	// Scope of masquerading, see SetMasquerade
+	masquerade *Masquerade
+	// Port forwards, see SetForwards
+	forwards []Forward
+	// Interface of the UPnP and NAT-PMP port mappings, see SetPortMappings
+	mappingInterface string
+	// Timed protocol . port -> address . port map of the mappings, in the
+	// running table only
+	mappings *nftables.Set
+	// Timed address . protocol . port set of the mappings' targets
+	mappingTargets *nftables.Set
+	// Port of the block page, see SetBlockPage
+	blockPagePort uint16
+	// Timed source . destination sets of the denied HTTP connections
+	// redirected to the block page (ranges are unused)
+	blockPageSets *ruleSets
+	// Chain name -> chain taking a deny verdict after recording denied
+	// HTTP, see blockPageChain
+	blockPageChains map[string]*nftables.Chain
+	// Where denied targets are redirected, see SetHoneypot
+	honeypot *Honeypot
+	// Prerouting chain holding the honeypot's redirects, once set up
+	honeypotChain *nftables.Chain
+	// Sources kept out of the inspection queues, see SetInspectionExempt
+	inspectionExempt []string
+	// Interval sets of the exempt sources (ranges are unused)
+	inspectionExemptSets *ruleSets
+	// Ports of the port groups, see SetPortGroups, and the sets shared by
+	// the rules of groups of several ranges
+	portGroups    map[string][]string
+	portGroupSets map[string]*nftables.Set
 }
 
+// How a deny ends a connection
+const (
+	DenyDrop   = "drop"
+	DenyReject = "reject"
+	// DenyRejectTCPRST resets TCP connections and rejects other protocols
+	DenyRejectTCPRST = "reject-tcp-rst"
+
+	// RejectAdminProhibited answers rejected packets with ICMP
+	// administratively prohibited, telling filtered apart from refused
+	RejectAdminProhibited = "admin-prohibited"
+)
+
 // Rule represents a filtering rule to be applied
 type Rule struct {
 	Name      string
@@ -33,73 +210,202 @@ type Rule struct {
 	IPs       []string // IP addresses or CIDR ranges
 	Ports     []string // Port numbers or ranges
 	Protocols []string // tcp, udp, icmp
+	// CtStates limits the rule to packets of connections in these conntrack
+	// states: new, established, related, invalid or untracked
+	CtStates []string
+	// TTLLessThan and TTLEqual limit the rule to packets whose IPv4 TTL or
+	// IPv6 hop limit is below or equal to a value, unless 0
+	TTLLessThan uint8
+	TTLEqual    uint8
+	// MinLength and MaxLength limit the rule to packets of a length in the
+	// range, in bytes, unless MaxLength is 0
+	MinLength uint16
+	MaxLength uint16
+	// PortGroup matches the ports in the set shared by the rules of a port
+	// group, see SetPortGroups, instead of a set of the rule's own
+	PortGroup string
+	// DestinationSet creates the destination sets even when IPs is empty,
+	// for domain rules whose addresses are filled in later
+	DestinationSet bool
+	// ExcludedIPs are destinations (IPs or CIDR ranges) the rule doesn't
+	// match, held in exclusion sets of its own
+	ExcludedIPs []string
+	// ExcludedSet creates the exclusion sets even when ExcludedIPs is
+	// empty, for excluded domains whose addresses are filled in later
+	ExcludedSet bool
+	// ExcludedPorts are destination ports or ranges the rule doesn't match
+	ExcludedPorts []string
+	// Branch numbers the alternatives of a rule matching any of several
+	// combinations of matchers, each added as a rule of the same name with
+	// sets of its own, see BranchName
+	Branch int
+	// BlockQUIC rejects QUIC (UDP 443) to the rule's destinations ahead of
+	// an allow, so that clients fall back to TCP
+	BlockQUIC bool
+	// DenyBehavior is how a deny ends a connection: DenyDrop (the default),
+	// DenyReject or DenyRejectTCPRST
+	DenyBehavior string
+	// RejectWith is the ICMP code rejects answer with, port unreachable
+	// unless RejectAdminProhibited
+	RejectWith string
+	// Log logs the packets a deny drops or rejects, prefixed with the rule
+	// name
+	Log bool
+	// LogConnections sends the first packet of each connection the rule
+	// decides to the connection log group, see SetConnectionLog
+	LogConnections bool
+	// Inspect hands matching TCP and UDP traffic to userspace on Queue,
+	// with Mark set, instead of applying Action
+	Inspect bool
+	Queue   uint16
+	Mark    uint32
+	// InputInterface limits the rule to traffic arriving on an interface,
+	// such as a VLAN subinterface
+	InputInterface string
+	// VRF places the rule in the chain of traffic routed in a VRF, matched
+	// by the VRF device
+	VRF string
+	// Profile places the rule in the chain of traffic from the profile's
+	// source addresses
+	Profile string
+	// Comment is attached to the nftables rules, so that `nft list ruleset`
+	// shows what they were built from
+	Comment string
 }
 
 // NewManager creates a new nftables manager
-func NewManager() (*Manager, error) {
-	conn, err := nftables.New()
+func NewManager(opts ...Option) (*Manager, error) {
+	m := &Manager{
+		name:         tableName,
+		sets:         make(map[string]*ruleSets),
+		excludedSets: make(map[string]*ruleSets),
+		vrfChains:    make(map[string]*nftables.Chain),
+		profiles:     make(map[string]*profile),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	var connOpts []nftables.ConnOption
+	if m.local() {
+		connOpts = append(connOpts, nftables.WithNetNSFd(m.netnsFd))
+	}
+	conn, err := nftables.New(connOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create nftables connection: %w", err)
 	}
-
-	return &Manager{
-		conn: conn,
-		sets: make(map[string]*nftables.Set),
-	}, nil
+	m.conn = conn
+	return m, nil
 }
 
 // Setup initializes the nftables table and chain
 func (m *Manager) Setup() error {
-	// Create table
-	m.table = m.conn.AddTable(&nftables.Table{
-		Family: nftables.TableFamilyIPv4,
-		Name:   tableName,
-	})
+	// Create table - inet, the default, covers both IPv4 and IPv6 traffic
+	table := &nftables.Table{
+		Family: m.tableFamily(),
+		Name:   m.name,
+	}
+	// Replace a table left behind, e.g. by --oneshot; adding it first makes
+	// the delete succeed if there is none
+	m.conn.AddTable(table)
+	m.conn.DelTable(table)
+	m.table = m.conn.AddTable(table)
 
-	// Create chain for forward filtering (traffic passing through the router)
+	// Create chain for forward filtering (traffic passing through the router),
+	// or output filtering of the traffic originating in a target namespace,
+	// unless placed elsewhere
 	// Note: Default policy will be DROP - any unmatched traffic is dropped
 	m.chain = m.conn.AddChain(&nftables.Chain{
 		Name:     chainName,
 		Table:    m.table,
 		Type:     nftables.ChainTypeFilter,
-		Hooknum:  nftables.ChainHookForward,
-		Priority: nftables.ChainPriorityFilter,
+		Hooknum:  m.hook(),
+		Priority: m.priority(),
 	})
 
-	// Add NAT chain for masquerading outbound traffic
-	natChain := m.conn.AddChain(&nftables.Chain{
-		Name:     "postrouting",
-		Table:    m.table,
-		Type:     nftables.ChainTypeNAT,
-		Hooknum:  nftables.ChainHookPostrouting,
-		Priority: nftables.ChainPriorityNATSource,
-	})
+	// A canary table filters alongside the running one, which translates
+	// and masquerades
+	if !m.local() && !m.canary {
+		prerouting := m.setupForwards()
+		if err := m.setupBlockPage(prerouting); err != nil {
+			return err
+		}
+		if err := m.setupHoneypot(prerouting); err != nil {
+			return err
+		}
+		if err := m.setupPortMappings(prerouting); err != nil {
+			return err
+		}
+		if err := m.setupMasquerade(); err != nil {
+			return err
+		}
+	} else if !m.local() {
+		if err := m.setupPortMappings(nil); err != nil {
+			return err
+		}
+	}
 
-	// Add masquerade rule for all outbound traffic
+	// Rules are added to a chain of their own, so that they stay ahead of
+	// the default drop however many are added later
+	m.rules = m.conn.AddChain(&nftables.Chain{
+		Name:  rulesName,
+		Table: m.table,
+	})
 	m.conn.AddRule(&nftables.Rule{
 		Table: m.table,
-		Chain: natChain,
+		Chain: m.chain,
 		Exprs: []expr.Any{
-			&expr.Masq{},
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: rulesName},
 		},
 	})
 
+	// Sources hitting deny rules too often are dropped ahead of all chains
+	if err := m.setupBan(); err != nil {
+		return err
+	}
+
 	// Add default drop rule at the end of the chain
-	// Any traffic that didn't match any rules will be dropped
+	// Any traffic that didn't match any rules will be dropped, and counted
+	m.logUnmatched()
 	m.conn.AddRule(&nftables.Rule{
 		Table: m.table,
 		Chain: m.chain,
-		Exprs: []expr.Any{
-			&expr.Verdict{Kind: expr.VerdictDrop},
-		},
+		Exprs: append([]expr.Any{&expr.Counter{}}, m.denyExpressions(Rule{})...),
 	})
 
+	if err := m.setupInspectionExempt(); err != nil {
+		return err
+	}
+	if err := m.setupPortGroups(); err != nil {
+		return err
+	}
+
+	// Temporary grants are checked before any policy rule
+	if err := m.setupGrants(); err != nil {
+		return err
+	}
+	if m.local() {
+		m.setupLocal()
+	}
+	m.logDNSAnswers()
+
 	// Flush and apply
 	if err := m.conn.Flush(); err != nil {
 		return fmt.Errorf("failed to flush nftables: %w", err)
 	}
 
-	log.Printf("Created nftables table '%s' with forward chain and NAT", tableName)
+	// A recorded ruleset isn't created in the kernel
+	if _, ok := m.conn.(*scriptConn); ok {
+		return nil
+	}
+	hook := hookName(*m.hook())
+	if m.local() {
+		log.Printf("Created nftables table '%s' with %s chain in the target namespace", m.name, hook)
+	} else if m.canary {
+		log.Printf("Created nftables table '%s' with %s chain", m.name, hook)
+	} else {
+		log.Printf("Created nftables table '%s' with %s chain and NAT", m.name, hook)
+	}
 	return nil
 }
 
@@ -108,46 +414,161 @@ func (m *Manager) Cleanup() error {
 	if m.table != nil {
 		m.conn.DelTable(m.table)
 	}
+	m.sets = make(map[string]*ruleSets)
+	m.excludedSets = make(map[string]*ruleSets)
+	m.grants = nil
+	m.sourceGrants = nil
+	m.mappings = nil
+	m.mappingTargets = nil
+	m.blockPageSets = nil
+	m.blockPageChains = nil
+	m.honeypotChain = nil
+	m.inspectionExemptSets = nil
+	m.portGroupSets = nil
+	m.vrfChains = make(map[string]*nftables.Chain)
+	m.profiles = make(map[string]*profile)
+	m.metadataChain = nil
+	m.hardeningChain = nil
+	m.hardeningBogons = nil
+	m.rateLimitChain = nil
+	m.banChain = nil
+	m.bannedSets = nil
+	m.banOffenders = nil
+	m.banExemptSets = nil
+	m.banChains = nil
+	m.chainRules = nil
+	m.ruleChains = nil
 
 	return m.conn.Flush()
 }
 
+// DenyAll replaces the ruleset with a table whose chain drops all traffic on
+// the policy chain's hook, so that a stopped router fails closed
+func (m *Manager) DenyAll() error {
+	table := &nftables.Table{
+		Family: m.tableFamily(),
+		Name:   m.name,
+	}
+	// Whether or not the ruleset is set up, adding the table first makes
+	// the delete succeed
+	m.conn.AddTable(table)
+	m.conn.DelTable(table)
+	m.table = nil
+	if err := m.Cleanup(); err != nil {
+		return err
+	}
+
+	m.table = m.conn.AddTable(table)
+	m.chain = m.conn.AddChain(&nftables.Chain{
+		Name:     chainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  m.hook(),
+		Priority: m.priority(),
+	})
+	if m.local() {
+		m.setupLocal()
+	}
+	m.conn.AddRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chain,
+		Exprs: []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}},
+	})
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to flush nftables: %w", err)
+	}
+	return nil
+}
+
+// SetLenient makes the manager skip the parts of rules that fail to build,
+// such as invalid ports or addresses, with a warning. By default AddRule and
+// the setup of features holding addresses fail instead, since a rule
+// missing a match is broader than intended.
+func (m *Manager) SetLenient(lenient bool) {
+	m.lenient = lenient
+}
+
+// CheckRule reports the error adding rule to a manager would fail with,
+// without programming anything
+func CheckRule(rule Rule) error {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		return err
+	}
+	return m.AddRule(rule)
+}
+
 // AddRule adds a new filtering rule
 func (m *Manager) AddRule(rule Rule) error {
-	// Create IP set for this rule if there are IPs
-	var ipSet *nftables.Set
-	if len(rule.IPs) > 0 {
-		setName := fmt.Sprintf(setNameFmt, sanitizeName(rule.Name))
-		ipSet = &nftables.Set{
-			Table:   m.table,
-			Name:    setName,
-			KeyType: nftables.TypeIPAddr,
-		}
+	destinations := len(rule.IPs) > 0 || rule.DestinationSet
+	if !destinations && !rule.excludes() && !rule.matchesTTL() {
+		return m.addRuleForFamily(rule, familyAny, nil)
+	}
 
-		if err := m.conn.AddSet(ipSet, nil); err != nil {
-			return fmt.Errorf("failed to create IP set: %w", err)
+	// Excluded destinations and hop counts are matched per family too, so
+	// a rule with either alone is built for any destination of each family
+	sets := &ruleSets{}
+	if destinations {
+		var err error
+		if sets, err = m.addSets(rule); err != nil {
+			return err
 		}
+	}
+	if rule.excludes() {
+		if _, err := m.addExcludedSets(rule); err != nil {
+			return err
+		}
+	}
+	if err := m.addRuleForFamily(rule, familyIPv4, sets.v4); err != nil {
+		return err
+	}
+	return m.addRuleForFamily(rule, familyIPv6, sets.v6)
+}
 
-		m.sets[rule.Name] = ipSet
-
-		// Add IPs to set
-		if err := m.addIPsToSet(ipSet, rule.IPs); err != nil {
-			return fmt.Errorf("failed to add IPs to set: %w", err)
+// addSets creates the destination sets of a rule holding its IPs
+func (m *Manager) addSets(rule Rule) (*ruleSets, error) {
+	// Create one interval set per address family so that domain refreshes
+	// can later move addresses between them
+	sets := &ruleSets{}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		set := &nftables.Set{
+			Table:    m.table,
+			Name:     fmt.Sprintf(family.setNameFmt, sanitizeName(rule.setsName())),
+			KeyType:  family.keyType,
+			Interval: true,
+		}
+		if err := m.conn.AddSet(set, nil); err != nil {
+			return nil, fmt.Errorf("failed to create %s set: %w", family.name, err)
 		}
+		sets.set(family, set)
 	}
+	m.sets[rule.setsName()] = sets
 
-	// Build nftables rule expressions
-	exprs, err := m.buildRuleExpressions(rule, ipSet)
+	v4, v6, err := m.addressRanges(rule.IPs)
 	if err != nil {
-		return fmt.Errorf("failed to build rule expressions: %w", err)
+		return nil, err
 	}
+	if err := m.addRanges(sets.v4, v4); err != nil {
+		return nil, fmt.Errorf("failed to add IPs to set: %w", err)
+	}
+	if err := m.addRanges(sets.v6, v6); err != nil {
+		return nil, fmt.Errorf("failed to add IPs to set: %w", err)
+	}
+	sets.ranges4, sets.ranges6 = v4, v6
+	return sets, nil
+}
 
-	// Add the rule
-	m.conn.AddRule(&nftables.Rule{
-		Table: m.table,
-		Chain: m.chain,
-		Exprs: exprs,
-	})
+// addRuleForFamily adds the chain rule matching a rule's destinations of
+// one address family
+func (m *Manager) addRuleForFamily(rule Rule, family addrFamily, ipSet *nftables.Set) error {
+	rules, err := m.buildRules(rule, family, ipSet)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		m.conn.AddRule(r)
+		m.track(r.Chain, rule.Name)
+	}
 
 	// Apply changes
 	if err := m.conn.Flush(); err != nil {
@@ -157,25 +578,176 @@ func (m *Manager) AddRule(rule Rule) error {
 	return nil
 }
 
+// buildRules builds the chain rules matching a rule's destinations of one
+// address family, without adding them
+func (m *Manager) buildRules(rule Rule, family addrFamily, ipSet *nftables.Set) ([]*nftables.Rule, error) {
+	if !m.carries(family) {
+		if _, err := m.ruleChain(rule); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	var rules []*nftables.Rule
+	if rule.BlockQUIC && rule.Action == "allow" && !m.logOnly {
+		// Destinations the allow excludes aren't rejected either
+		exclusionExprs, err := m.exclusionExpressions(rule, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build rule expressions: %w", err)
+		}
+		rules = append(rules, &nftables.Rule{
+			Exprs: buildQUICBlockExpressions(family, ipSet, rule.InputInterface, exclusionExprs),
+		})
+	}
+	// New connections are logged ahead of the rule deciding them; a canary
+	// table sees the same connections as the running one
+	if rule.LogConnections && m.connLog != nil && !rule.Inspect && !m.canary {
+		exprs, err := m.matchExpressions(rule, family, ipSet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build rule expressions: %w", err)
+		}
+		rules = append(rules, &nftables.Rule{
+			Exprs: append(exprs, m.connectionLogExpressions(ConnectionLogPrefix(rule.Action, rule.Name))...),
+		})
+	}
+
+	// Build nftables rule expressions; a deny resetting TCP takes a rule
+	// per verdict
+	if rule.Action == "deny" && rule.DenyBehavior == DenyRejectTCPRST && !rule.Inspect && !m.logOnly {
+		resetRules, err := m.buildTCPResetRules(rule, family, ipSet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build rule expressions: %w", err)
+		}
+		rules = append(rules, resetRules...)
+	} else if rule.Inspect {
+		for _, queueFamily := range m.queueFamilies(family) {
+			exprs, err := m.buildRuleExpressions(rule, queueFamily, ipSet)
+			if err != nil {
+				return nil, fmt.Errorf("failed to build rule expressions: %w", err)
+			}
+			rules = append(rules, &nftables.Rule{Exprs: exprs})
+		}
+	} else {
+		exprs, err := m.buildRuleExpressions(rule, family, ipSet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build rule expressions: %w", err)
+		}
+		rules = append(rules, &nftables.Rule{Exprs: exprs})
+	}
+
+	chain, err := m.subChain(rule)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		r.Table, r.Chain, r.UserData = m.table, chain, commentUserData(rule.Comment)
+	}
+	return rules, nil
+}
+
+// maxCommentLen is the longest comment nft accepts
+const maxCommentLen = 127
+
+// commentUserData encodes a rule comment as nft does, shortened to the
+// length nft accepts and with double quotes, which nft can't list,
+// replaced; nil for no comment
+func commentUserData(comment string) []byte {
+	if comment == "" {
+		return nil
+	}
+	comment = strings.ReplaceAll(comment, `"`, "'")
+	if len(comment) > maxCommentLen {
+		n := maxCommentLen
+		for n > 0 && !utf8.RuneStart(comment[n]) {
+			n--
+		}
+		comment = comment[:n]
+	}
+	return userdata.AppendString(nil, userdata.TypeComment, comment)
+}
+
 // buildRuleExpressions builds nftables expressions for a rule
-func (m *Manager) buildRuleExpressions(rule Rule, ipSet *nftables.Set) ([]expr.Any, error) {
+func (m *Manager) buildRuleExpressions(rule Rule, family addrFamily, ipSet *nftables.Set) ([]expr.Any, error) {
+	exprs, err := m.matchExpressions(rule, family, ipSet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Exempt sources skip the queue and go on to the next rules
+	if rule.Inspect {
+		exprs = append(exprs, m.inspectionExemptExpressions(family)...)
+	}
+
+	// Count the packets the rule decides, reported as its hits
+	exprs = append(exprs, &expr.Counter{})
+
+	// Queue for inspection, tagged so userspace knows the rule
+	if rule.Inspect {
+		if len(rule.Protocols) == 0 {
+			protoExprs, err := m.transportProtocolExpressions()
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, protoExprs...)
+		}
+		exprs = append(exprs,
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(rule.Mark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			&expr.Queue{Num: rule.Queue},
+		)
+		return exprs, nil
+	}
+
+	// Add verdict (accept, drop or reject)
+	if rule.Action == "allow" {
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	} else {
+		exprs = append(exprs, m.denyExpressions(rule)...)
+	}
+
+	return exprs, nil
+}
+
+// matchExpressions builds the expressions matching the traffic of a rule
+func (m *Manager) matchExpressions(rule Rule, family addrFamily, ipSet *nftables.Set) ([]expr.Any, error) {
 	var exprs []expr.Any
 
-	// Match protocol if specified
+	// The inet table sees both families; restrict family specific rules
+	if family.nfproto != 0 {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{family.nfproto},
+			},
+		)
+	}
+
+	// Match input interface if specified
+	if rule.InputInterface != "" {
+		exprs = append(exprs, interfaceExpressions(rule.InputInterface)...)
+	}
+
+	// Match conntrack states if specified; a list matches any of them
+	if len(rule.CtStates) > 0 {
+		ctExprs, err := ctStateExpressions(rule.CtStates)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, ctExprs...)
+	}
+
+	// Match the TTL or hop limit and the length if specified
+	exprs = append(exprs, ttlExpressions(rule, family)...)
+	exprs = append(exprs, lengthExpressions(rule)...)
+
+	// Match protocol if specified; a list matches any of them
 	if len(rule.Protocols) > 0 {
-		for _, proto := range rule.Protocols {
-			protoNum := protocolToNum(proto)
-			exprs = append(exprs,
-				// Load protocol from IP header
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				// Compare with desired protocol
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     []byte{protoNum},
-				},
-			)
+		protoExprs, err := m.protocolExpressions(rule.Protocols)
+		if err != nil {
+			return nil, err
 		}
+		exprs = append(exprs, protoExprs...)
 	}
 
 	// Match destination IP if IP set exists
@@ -185,8 +757,8 @@ func (m *Manager) buildRuleExpressions(rule Rule, ipSet *nftables.Set) ([]expr.A
 			&expr.Payload{
 				DestRegister: 1,
 				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       16, // Destination IP offset in IPv4 header
-				Len:          4,  // IPv4 address length
+				Offset:       family.daddrOffset,
+				Len:          family.addrLen,
 			},
 			// Check if IP is in set
 			&expr.Lookup{
@@ -197,130 +769,597 @@ func (m *Manager) buildRuleExpressions(rule Rule, ipSet *nftables.Set) ([]expr.A
 		)
 	}
 
-	// Match destination port if specified
-	if len(rule.Ports) > 0 {
-		for _, portStr := range rule.Ports {
-			portExprs, err := buildPortExpression(portStr)
-			if err != nil {
-				log.Printf("Warning: invalid port specification %s: %v", portStr, err)
-				continue
-			}
-			exprs = append(exprs, portExprs...)
+	// Match destination port if specified; a list matches any of them
+	if set, ok := m.portGroupSets[rule.PortGroup]; ok {
+		exprs = append(exprs, portLookupExpressions(set)...)
+	} else if len(rule.Ports) > 0 {
+		portExprs, err := m.portExpressions(rule.Ports)
+		if err != nil {
+			return nil, err
 		}
+		exprs = append(exprs, portExprs...)
 	}
 
-	// Add verdict (accept or drop)
-	if rule.Action == "allow" {
-		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
-	} else {
-		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	// Skip the excluded destinations and ports
+	exclusionExprs, err := m.exclusionExpressions(rule, family)
+	if err != nil {
+		return nil, err
 	}
+	return append(exprs, exclusionExprs...), nil
+}
 
-	return exprs, nil
+// buildTCPResetRules builds the rules of a deny rule resetting TCP: one
+// matching its TCP traffic, and one rejecting its other protocols if it
+// matches any
+func (m *Manager) buildTCPResetRules(rule Rule, family addrFamily, ipSet *nftables.Set) ([]*nftables.Rule, error) {
+	var tcp bool
+	var others []string
+	for _, proto := range rule.Protocols {
+		if proto == "tcp" {
+			tcp = true
+		} else {
+			others = append(others, proto)
+		}
+	}
+
+	var rules []*nftables.Rule
+	if tcp || len(rule.Protocols) == 0 {
+		tcpRule := rule
+		tcpRule.Protocols = []string{"tcp"}
+		exprs, err := m.buildRuleExpressions(tcpRule, family, ipSet)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &nftables.Rule{Exprs: exprs})
+	}
+	if len(others) > 0 || len(rule.Protocols) == 0 {
+		rest := rule
+		rest.Protocols, rest.DenyBehavior = others, DenyReject
+		exprs, err := m.buildRuleExpressions(rest, family, ipSet)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &nftables.Rule{Exprs: exprs})
+	}
+	return rules, nil
 }
 
-// addIPsToSet adds IP addresses to an nftables set
-func (m *Manager) addIPsToSet(set *nftables.Set, ips []string) error {
-	for _, ipStr := range ips {
-		// Handle CIDR notation
-		if _, ipNet, err := net.ParseCIDR(ipStr); err == nil {
-			// For CIDR, add the network address
-			// TODO: Properly handle CIDR ranges in sets
-			ip := ipNet.IP.To4()
-			if ip != nil {
-				if err := m.conn.SetAddElements(set, []nftables.SetElement{{Key: ip}}); err != nil {
-					return err
-				}
+// AddQueueRule queues traffic of protocol to port that no earlier rule
+// matched to userspace for inspection, but for the exempt sources. Without
+// a listener on the queue the traffic is dropped.
+func (m *Manager) AddQueueRule(queue uint16, protocol string, port uint16) error {
+	for _, family := range m.queueFamilies(familyAny) {
+		var exprs []expr.Any
+		if family.nfproto != 0 {
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+			)
+		}
+		exprs = append(exprs, protocolPortExpressions(protocolToNum(protocol), port)...)
+		exprs = append(exprs, m.inspectionExemptExpressions(family)...)
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: m.rules,
+			Exprs: append(exprs, &expr.Queue{Num: queue}),
+		})
+		m.track(m.rules, "")
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add queue rule: %w", err)
+	}
+	return nil
+}
+
+// buildQUICBlockExpressions builds a rule rejecting QUIC to the
+// destinations in ipSet, or to any destination if ipSet is nil, from
+// iface if set, but for the traffic exclusions match
+// Rejecting with port unreachable makes clients fall back to TCP at once
+func buildQUICBlockExpressions(family addrFamily, ipSet *nftables.Set, iface string, exclusions []expr.Any) []expr.Any {
+	var exprs []expr.Any
+	if iface != "" {
+		exprs = append(exprs, interfaceExpressions(iface)...)
+	}
+	if family.nfproto != 0 {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{family.nfproto},
+			},
+		)
+	}
+	exprs = append(exprs, protocolPortExpressions(unix.IPPROTO_UDP, 443)...)
+	if ipSet != nil {
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       family.daddrOffset,
+				Len:          family.addrLen,
+			},
+			&expr.Lookup{
+				SourceRegister: 1,
+				SetName:        ipSet.Name,
+				SetID:          ipSet.ID,
+			},
+		)
+	}
+	exprs = append(exprs, exclusions...)
+	return append(exprs, &expr.Reject{
+		Type: unix.NFT_REJECT_ICMPX_UNREACH,
+		Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH,
+	})
+}
+
+// transportProtocolExpressions matches TCP or UDP via an anonymous set
+func (m *Manager) transportProtocolExpressions() ([]expr.Any, error) {
+	return m.protocolSetExpressions([]byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP})
+}
+
+// protocolExpressions matches any of protocols, comparing a single one and
+// looking several up in an anonymous set
+func (m *Manager) protocolExpressions(protocols []string) ([]expr.Any, error) {
+	var nums []byte
+	seen := make(map[byte]bool)
+	for _, proto := range protocols {
+		num := protocolToNum(proto)
+		if num == 0 {
+			if !m.lenient {
+				return nil, fmt.Errorf("invalid protocol %s", proto)
 			}
-		} else {
-			// Single IP
-			ip := net.ParseIP(ipStr).To4()
-			if ip == nil {
-				log.Printf("Warning: invalid IP address: %s", ipStr)
-				continue
+			log.Printf("Warning: invalid protocol %s", proto)
+			continue
+		}
+		if !seen[num] {
+			seen[num] = true
+			nums = append(nums, num)
+		}
+	}
+
+	switch len(nums) {
+	case 0:
+		return nil, nil
+	case 1:
+		return []expr.Any{
+			// Load protocol from IP header
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			// Compare with desired protocol
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{nums[0]},
+			},
+		}, nil
+	}
+	return m.protocolSetExpressions(nums)
+}
+
+// protocolSetExpressions matches any of protocols via an anonymous set
+func (m *Manager) protocolSetExpressions(protocols []byte) ([]expr.Any, error) {
+	set := &nftables.Set{
+		Table:     m.table,
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeInetProto,
+	}
+	elements := make([]nftables.SetElement, len(protocols))
+	for i, proto := range protocols {
+		elements[i] = nftables.SetElement{Key: []byte{proto}}
+	}
+	if err := m.conn.AddSet(set, elements); err != nil {
+		return nil, fmt.Errorf("failed to create protocol set: %w", err)
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+		},
+	}, nil
+}
+
+// portExpressions matches any of ports, comparing a single port or range
+// and looking several up in an anonymous interval set
+func (m *Manager) portExpressions(ports []string) ([]expr.Any, error) {
+	ranges, err := m.portRanges(ports)
+	if err != nil {
+		return nil, err
+	}
+	switch len(ranges) {
+	case 0:
+		return nil, nil
+	case 1:
+		return portRangeExpressions(ranges[0].start, ranges[0].end), nil
+	}
+
+	set := &nftables.Set{
+		Table:     m.table,
+		Anonymous: true,
+		Constant:  true,
+		Interval:  true,
+		KeyType:   nftables.TypeInetService,
+	}
+	if err := m.conn.AddSet(set, portSetElements(ranges)); err != nil {
+		return nil, fmt.Errorf("failed to create port set: %w", err)
+	}
+	return portLookupExpressions(set), nil
+}
+
+// portRanges parses ports into merged ranges, skipping invalid ones with a
+// warning when lenient
+func (m *Manager) portRanges(ports []string) ([]portRange, error) {
+	var ranges []portRange
+	for _, portStr := range ports {
+		start, end, err := parsePortRange(portStr)
+		if err != nil {
+			if !m.lenient {
+				return nil, err
 			}
+			log.Printf("Warning: invalid port specification %s: %v", portStr, err)
+			continue
+		}
+		ranges = append(ranges, portRange{start, end})
+	}
+	return mergePortRanges(ranges), nil
+}
+
+// addressRanges splits ips into merged ranges by family, skipping invalid
+// addresses with a warning when lenient
+func (m *Manager) addressRanges(ips []string) (v4, v6 []ipRange, err error) {
+	v4, v6, invalid := splitFamilies(ips)
+	if len(invalid) > 0 && !m.lenient {
+		return nil, nil, fmt.Errorf("invalid IP address: %s", invalid[0])
+	}
+	for _, ip := range invalid {
+		log.Printf("Warning: invalid IP address: %s", ip)
+	}
+	return v4, v6, nil
+}
 
-			if err := m.conn.SetAddElements(set, []nftables.SetElement{{Key: ip}}); err != nil {
-				return err
+// portSetElements returns the elements of an interval set of ranges
+func portSetElements(ranges []portRange) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, r := range ranges {
+		elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(r.start)})
+		if r.end < 65535 {
+			elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(r.end + 1), IntervalEnd: true})
+		}
+	}
+	return elements
+}
+
+// portLookupExpressions matches the destination port against a set of
+// ports
+func portLookupExpressions(set *nftables.Set) []expr.Any {
+	return []expr.Any{
+		// Load destination port
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // Destination port offset
+			Len:          2, // Port length
+		},
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+			SetID:          set.ID,
+		},
+	}
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	start, end uint16
+}
+
+// mergePortRanges sorts ranges and merges overlapping or adjacent ones, as
+// interval sets require
+func mergePortRanges(ranges []portRange) []portRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	var merged []portRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && int(r.start) <= int(merged[n-1].end)+1 {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
 			}
+			continue
 		}
+		merged = append(merged, r)
 	}
+	return merged
+}
 
-	return nil
+// interfaceExpressions matches the input interface by name, so that rules
+// apply to interfaces created after them
+func interfaceExpressions(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(name),
+		},
+	}
+}
+
+// ifname pads an interface name to IFNAMSIZ as the kernel compares it
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// protocolPortExpressions matches a layer 4 protocol and destination port
+func protocolPortExpressions(proto uint8, port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{proto},
+		},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // Destination port offset
+			Len:          2, // Port length
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{byte(port >> 8), byte(port & 0xff)},
+		},
+	}
+}
+
+// addRanges adds address ranges to an interval set
+func (m *Manager) addRanges(set *nftables.Set, ranges []ipRange) error {
+	return m.batchRanges(set, ranges, "Added", m.conn.SetAddElements)
+}
+
+// removeRanges removes address ranges from an interval set
+func (m *Manager) removeRanges(set *nftables.Set, ranges []ipRange) error {
+	return m.batchRanges(set, ranges, "Removed", m.conn.SetDeleteElements)
 }
 
-// UpdateIPs updates the IPs in a rule's set
+// UpdateIPs replaces the IPs in a rule's sets
+// Only the difference is applied so that unchanged elements stay in place
 func (m *Manager) UpdateIPs(ruleName string, ips []string) error {
-	set, ok := m.sets[ruleName]
+	sets, ok := m.sets[ruleName]
 	if !ok {
 		return fmt.Errorf("no IP set found for rule %s", ruleName)
 	}
 
-	// Flush existing elements
-	// TODO: Implement proper set update without flushing
+	changes, err := m.replaceRanges(sets, ips)
+	if err != nil || changes == "" {
+		return err
+	}
+	log.Printf("Updated IP sets for rule %s: %s", ruleName, changes)
+	return nil
+}
+
+// replaceRanges replaces the addresses in a pair of sets by applying the
+// difference, and summarizes the changes; the summary is empty if nothing
+// changed
+func (m *Manager) replaceRanges(sets *ruleSets, ips []string) (string, error) {
+	v4, v6, err := m.addressRanges(ips)
+	if err != nil {
+		return "", err
+	}
 
-	// Add new IPs
-	return m.addIPsToSet(set, ips)
+	added4, removed4 := diffRanges(sets.ranges4, v4)
+	added6, removed6 := diffRanges(sets.ranges6, v6)
+	changes := len(added4) + len(removed4) + len(added6) + len(removed6)
+	if changes == 0 {
+		return "", nil
+	}
+
+	// Removals go first so merged ranges never overlap their predecessors
+	if err := m.removeRanges(sets.v4, removed4); err != nil {
+		return "", fmt.Errorf("failed to remove IPs from set: %w", err)
+	}
+	if err := m.removeRanges(sets.v6, removed6); err != nil {
+		return "", fmt.Errorf("failed to remove IPs from set: %w", err)
+	}
+	if err := m.addRanges(sets.v4, added4); err != nil {
+		return "", fmt.Errorf("failed to add IPs to set: %w", err)
+	}
+	if err := m.addRanges(sets.v6, added6); err != nil {
+		return "", fmt.Errorf("failed to add IPs to set: %w", err)
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return "", fmt.Errorf("failed to update IP set: %w", err)
+	}
+
+	sets.ranges4, sets.ranges6 = v4, v6
+	m.updates++
+	return fmt.Sprintf("ipv4 +%d -%d, ipv6 +%d -%d",
+		len(added4), len(removed4), len(added6), len(removed6)), nil
 }
 
-// buildPortExpression builds nftables expressions for port matching
-// Supports both single ports (443) and ranges (8000-9000)
-func buildPortExpression(portStr string) ([]expr.Any, error) {
-	var exprs []expr.Any
+// Updates counts the changes to the addresses in the sets of rules and
+// profiles, so that a copy of the ruleset can tell whether it is stale
+func (m *Manager) Updates() uint64 {
+	return m.updates
+}
+
+// ContainsIP reports whether ip is in a rule's destination sets
+func (m *Manager) ContainsIP(ruleName string, ip net.IP) bool {
+	sets, ok := m.sets[ruleName]
+	return ok && sets.contains(ip)
+}
 
-	// Check if it's a range (contains "-")
-	if idx := strings.Index(portStr, "-"); idx > 0 {
-		// Port range
-		var startPort, endPort uint16
-		if _, err := fmt.Sscanf(portStr, "%d-%d", &startPort, &endPort); err != nil {
-			return nil, fmt.Errorf("invalid port range: %s", portStr)
+// contains reports whether ip is in the sets
+func (s *ruleSets) contains(ip net.IP) bool {
+	ranges := s.ranges6
+	if v4 := ip.To4(); v4 != nil {
+		ip, ranges = v4, s.ranges4
+	}
+	for _, r := range ranges {
+		if r.contains(ip) {
+			return true
 		}
+	}
+	return false
+}
+
+// RuleIPs returns the addresses in a rule's destination sets, as addresses,
+// prefixes or start-end ranges
+func (m *Manager) RuleIPs(ruleName string) []string {
+	sets, ok := m.sets[ruleName]
+	if !ok {
+		return nil
+	}
 
-		if startPort > endPort {
-			return nil, fmt.Errorf("invalid port range %s: start > end", portStr)
+	ips := make([]string, 0, len(sets.ranges4)+len(sets.ranges6))
+	for _, r := range append(append([]ipRange(nil), sets.ranges4...), sets.ranges6...) {
+		ips = append(ips, formatRange(r.start, r.end))
+	}
+	return ips
+}
+
+// RuleHits returns the packets each rule has decided since it was
+// programmed, by rule name
+func (m *Manager) RuleHits() (map[string]uint64, error) {
+	hits := make(map[string]uint64, len(m.ruleChains))
+	for name := range m.ruleChains {
+		n, err := m.Hits(name)
+		if err != nil {
+			return nil, err
 		}
+		hits[name] = n
+	}
+	return hits, nil
+}
 
-		exprs = append(exprs,
-			// Load destination port
-			&expr.Payload{
-				DestRegister: 1,
-				Base:         expr.PayloadBaseTransportHeader,
-				Offset:       2, // Destination port offset
-				Len:          2, // Port length
-			},
-			// Check if port is in range [startPort, endPort]
-			&expr.Range{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				FromData: []byte{byte(startPort >> 8), byte(startPort & 0xff)},
-				ToData:   []byte{byte(endPort >> 8), byte(endPort & 0xff)},
-			},
-		)
-	} else {
-		// Single port
-		var port uint16
-		if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
-			return nil, fmt.Errorf("invalid port: %s", portStr)
+// Hits returns the packets a rule has decided since it was programmed
+func (m *Manager) Hits(ruleName string) (uint64, error) {
+	chain, ok := m.ruleChains[ruleName]
+	if !ok {
+		return 0, nil
+	}
+	counters, err := m.chainCounters(chain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read counters of rule %s: %w", ruleName, err)
+	}
+	return counters.Packets, nil
+}
+
+// Counters are the packets and bytes counted by the counters of a chain
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// RuleCounters returns the packets and bytes each rule has decided since it
+// was programmed, by rule name
+func (m *Manager) RuleCounters() (map[string]Counters, error) {
+	counters := make(map[string]Counters, len(m.ruleChains))
+	for name, chain := range m.ruleChains {
+		c, err := m.chainCounters(chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read counters of rule %s: %w", name, err)
 		}
+		counters[name] = c
+	}
+	return counters, nil
+}
 
-		exprs = append(exprs,
-			// Load destination port
-			&expr.Payload{
-				DestRegister: 1,
-				Base:         expr.PayloadBaseTransportHeader,
-				Offset:       2, // Destination port offset
-				Len:          2, // Port length
-			},
-			// Compare port
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     []byte{byte(port >> 8), byte(port & 0xff)},
-			},
-		)
+// UnmatchedCounters returns the packets and bytes no rule matched, which the
+// default rule dropped
+func (m *Manager) UnmatchedCounters() (Counters, error) {
+	if m.chain == nil {
+		return Counters{}, nil
 	}
+	counters, err := m.chainCounters(m.chain)
+	if err != nil {
+		return Counters{}, fmt.Errorf("failed to read the default rule's counter: %w", err)
+	}
+	return counters, nil
+}
 
-	return exprs, nil
+// chainCounters sums the counters of the rules of chain
+func (m *Manager) chainCounters(chain *nftables.Chain) (Counters, error) {
+	rules, err := m.conn.GetRules(m.table, chain)
+	if err != nil {
+		return Counters{}, err
+	}
+	var counters Counters
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				counters.Packets += counter.Packets
+				counters.Bytes += counter.Bytes
+			}
+		}
+	}
+	return counters, nil
+}
+
+// buildPortExpression builds nftables expressions for port matching
+// Supports both single ports (443) and ranges (8000-9000)
+func buildPortExpression(portStr string) ([]expr.Any, error) {
+	startPort, endPort, err := parsePortRange(portStr)
+	if err != nil {
+		return nil, err
+	}
+	return portRangeExpressions(startPort, endPort), nil
+}
+
+// portRangeExpressions matches a single port, or a range of ports
+func portRangeExpressions(startPort, endPort uint16) []expr.Any {
+	exprs := []expr.Any{
+		// Load destination port
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // Destination port offset
+			Len:          2, // Port length
+		},
+	}
+	if startPort != endPort {
+		// Check if port is in range [startPort, endPort]
+		return append(exprs, &expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			FromData: []byte{byte(startPort >> 8), byte(startPort & 0xff)},
+			ToData:   []byte{byte(endPort >> 8), byte(endPort & 0xff)},
+		})
+	}
+	// Compare port
+	return append(exprs, &expr.Cmp{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		Data:     []byte{byte(startPort >> 8), byte(startPort & 0xff)},
+	})
+}
+
+// parsePortRange parses a single port or a range of ports from 1 to 65535,
+// rejecting anything else, such as trailing characters or signs, rather
+// than matching a port the config did not name
+func parsePortRange(portStr string) (uint16, uint16, error) {
+	first, last, isRange := strings.Cut(portStr, "-")
+	start, err := strconv.ParseUint(first, 10, 16)
+	if err != nil || start == 0 {
+		return 0, 0, fmt.Errorf("invalid port: %s", portStr)
+	}
+	if !isRange {
+		return uint16(start), uint16(start), nil
+	}
+	end, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || end == 0 {
+		return 0, 0, fmt.Errorf("invalid port range: %s", portStr)
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid port range %s: start > end", portStr)
+	}
+	return uint16(start), uint16(end), nil
 }
 
 // protocolToNum converts protocol name to number
@@ -0,0 +1,169 @@
+package nftables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/nftables/userdata"
+)
+
+// TestAddRuleStrict tests that rules with parts that fail to build are
+// refused unless the manager is lenient
+func TestAddRuleStrict(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    Rule
+		lenient bool
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rule: Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}},
+		},
+		{
+			name:    "invalid port",
+			rule:    Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443x"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid protocol",
+			rule:    Rule{Name: "web", Action: "allow", Protocols: []string{"sctp"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid address",
+			rule:    Rule{Name: "web", Action: "allow", IPs: []string{"192.0.2.1", "192.0.2.300"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid excluded address",
+			rule:    Rule{Name: "web", Action: "allow", ExcludedIPs: []string{"192.0.2.x"}},
+			wantErr: true,
+		},
+		{
+			name:    "lenient",
+			rule:    Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443x"}},
+			lenient: true,
+		},
+		{
+			name:    "lenient address",
+			rule:    Rule{Name: "web", Action: "allow", IPs: []string{"192.0.2.1", "192.0.2.300"}},
+			lenient: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager()
+			m.SetLenient(tc.lenient)
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			if err := m.AddRule(tc.rule); (err != nil) != tc.wantErr {
+				t.Errorf("AddRule() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.lenient {
+				if err := CheckRule(tc.rule); (err != nil) != tc.wantErr {
+					t.Errorf("CheckRule() error = %v, wantErr %v", err, tc.wantErr)
+				}
+			}
+		})
+	}
+}
+
+// TestCommentUserData tests encoding rule comments as nft accepts them
+func TestCommentUserData(t *testing.T) {
+	testCases := []struct {
+		name    string
+		comment string
+		want    string
+	}{
+		{
+			name:    "comment",
+			comment: "config=0a1b2c3d4e5f rule=web",
+			want:    "config=0a1b2c3d4e5f rule=web",
+		},
+		{
+			name:    "quotes",
+			comment: `rule="web"`,
+			want:    "rule='web'",
+		},
+		{
+			name:    "truncated",
+			comment: "rule=" + strings.Repeat("a", 200),
+			want:    "rule=" + strings.Repeat("a", maxCommentLen-5),
+		},
+		{
+			name:    "truncated at a character",
+			comment: strings.Repeat("a", maxCommentLen-1) + "é",
+			want:    strings.Repeat("a", maxCommentLen-1),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := userdata.GetString(commentUserData(tc.comment), userdata.TypeComment)
+			if !ok || got != tc.want {
+				t.Errorf("Expected comment %q, got %q", tc.want, got)
+			}
+		})
+	}
+	if commentUserData("") != nil {
+		t.Error("Expected no user data without a comment")
+	}
+}
+
+// TestDenyAll tests replacing the ruleset with a chain dropping everything
+func TestDenyAll(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "web", Action: "allow", IPs: []string{"192.0.2.1"}}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	if err := m.DenyAll(); err != nil {
+		t.Fatalf("DenyAll() error = %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("WriteScript() error = %v", err)
+	}
+	script := b.String()
+	if !strings.Contains(script, "type filter hook forward priority 0") || !strings.Contains(script, "counter drop") {
+		t.Errorf("Expected a forward chain dropping everything, got:\n%s", script)
+	}
+	for _, gone := range []string{"egress_rules", "ips_web", "masquerade"} {
+		if strings.Contains(script, gone) {
+			t.Errorf("Expected %s to be removed, got:\n%s", gone, script)
+		}
+	}
+}
+
+func TestDenyLogPrefix(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ruleName string
+		want     string
+	}{
+		{
+			name:     "rule",
+			ruleName: "smtp",
+			want:     "legion deny smtp: ",
+		},
+		{
+			name:     "truncated",
+			ruleName: strings.Repeat("a", 200),
+			want:     "legion deny " + strings.Repeat("a", maxLogPrefixLen-len("legion deny ")-2) + ": ",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := denyLogPrefix(tc.ruleName); got != tc.want {
+				t.Errorf("Expected prefix %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	masqueradeChainName    = "postrouting"
+	masqueradeExcludeName  = "masquerade_exclude"  // IPv4 destinations not masqueraded
+	masqueradeExclude6Name = "masquerade_exclude6" // IPv6 destinations not masqueraded
+)
+
+// Masquerade scopes the masquerading of forwarded traffic, which by default
+// applies to all of it
+type Masquerade struct {
+	// Interfaces limits masquerading to traffic leaving these interfaces,
+	// such as the uplink
+	Interfaces []string
+	// ExcludeDestinations keeps the source address of traffic to these
+	// addresses and CIDRs, such as other internal subnets
+	ExcludeDestinations []string
+}
+
+// SetMasquerade scopes masquerading in the next Setup; nil masquerades all
+// forwarded traffic
+func (m *Manager) SetMasquerade(masq *Masquerade) {
+	m.masquerade = masq
+}
+
+// setupMasquerade adds the chain masquerading forwarded traffic
+func (m *Manager) setupMasquerade() error {
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     masqueradeChainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	masq := m.masquerade
+	if masq == nil {
+		masq = &Masquerade{}
+	}
+
+	// Connections hairpinned back inside are masqueraded whatever the
+	// scope, as their replies would otherwise bypass the router
+	for _, f := range m.forwards {
+		if f.Hairpin && m.carries(forwardFamily(f)) {
+			m.conn.AddRule(&nftables.Rule{
+				Table: m.table,
+				Chain: chain,
+				Exprs: append(hairpinExpressions(f), &expr.Masq{}),
+			})
+		}
+	}
+
+	// Excluded destinations leave the chain before any other masquerade
+	// rule
+	if len(masq.ExcludeDestinations) > 0 {
+		v4, v6, err := m.addressRanges(masq.ExcludeDestinations)
+		if err != nil {
+			return fmt.Errorf("invalid masquerade exclusion: %w", err)
+		}
+		for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+			name, ranges := masqueradeExcludeName, v4
+			if family == familyIPv6 {
+				name, ranges = masqueradeExclude6Name, v6
+			}
+			set, err := m.addRangeSet(name, family, ranges)
+			if err != nil {
+				return fmt.Errorf("failed to create %s masquerade exclusion set: %w", family.name, err)
+			}
+			if !m.carries(family) {
+				continue
+			}
+			m.conn.AddRule(&nftables.Rule{
+				Table: m.table,
+				Chain: chain,
+				Exprs: []expr.Any{
+					&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseNetworkHeader,
+						Offset:       family.daddrOffset,
+						Len:          family.addrLen,
+					},
+					&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+					&expr.Verdict{Kind: expr.VerdictReturn},
+				},
+			})
+		}
+	}
+
+	if len(masq.Interfaces) == 0 {
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: []expr.Any{&expr.Masq{}},
+		})
+		return nil
+	}
+	for _, name := range masq.Interfaces {
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+				&expr.Masq{},
+			},
+		})
+	}
+	return nil
+}
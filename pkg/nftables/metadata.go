@@ -0,0 +1,142 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	metadataChainName      = "metadata_protection"
+	metadataSetName        = "metadata"         // IPv4 metadata destinations
+	metadata6SetName       = "metadata6"        // IPv6 metadata destinations
+	metadataExemptSetName  = "metadata_exempt"  // IPv4 exempt sources
+	metadataExempt6SetName = "metadata_exempt6" // IPv6 exempt sources
+)
+
+// SetupMetadataProtection drops traffic to the instance metadata
+// destinations from every source but the exempt ones, counting the drops.
+// It has a base chain of its own: exempt traffic returns to the policy,
+// everything else is dropped whatever the rules allow.
+func (m *Manager) SetupMetadataProtection(destinations, exempt []string) error {
+	// The running table keeps protecting the metadata service for all
+	// sources during a rollout
+	if m.canary {
+		return nil
+	}
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     metadataChainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  m.hook(),
+		Priority: m.metadataPriority(),
+	})
+
+	dst4, dst6, err := m.addressRanges(destinations)
+	if err != nil {
+		return fmt.Errorf("invalid metadata address: %w", err)
+	}
+	src4, src6, err := m.addressRanges(exempt)
+	if err != nil {
+		return fmt.Errorf("invalid metadata exemption: %w", err)
+	}
+
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		dstName, srcName, dstRanges, srcRanges := metadataSetName, metadataExemptSetName, dst4, src4
+		if family == familyIPv6 {
+			dstName, srcName, dstRanges, srcRanges = metadata6SetName, metadataExempt6SetName, dst6, src6
+		}
+		dst, err := m.addRangeSet(dstName, family, dstRanges)
+		if err != nil {
+			return fmt.Errorf("failed to create %s metadata set: %w", family.name, err)
+		}
+		src, err := m.addRangeSet(srcName, family, srcRanges)
+		if err != nil {
+			return fmt.Errorf("failed to create %s exempt set: %w", family.name, err)
+		}
+		if !m.carries(family) {
+			continue
+		}
+
+		match := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       family.daddrOffset,
+				Len:          family.addrLen,
+			},
+			&expr.Lookup{SourceRegister: 1, SetName: dst.Name, SetID: dst.ID},
+		}
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: append(append([]expr.Any(nil), match...),
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       family.saddrOffset,
+					Len:          family.addrLen,
+				},
+				&expr.Lookup{SourceRegister: 1, SetName: src.Name, SetID: src.ID},
+				&expr.Verdict{Kind: expr.VerdictReturn},
+			),
+		})
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: append(match,
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			),
+		})
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set up metadata protection: %w", err)
+	}
+	m.metadataChain = chain
+	log.Printf("Blocking instance metadata: %d destinations, %d exempt sources", len(destinations), len(exempt))
+	return nil
+}
+
+// addRangeSet creates an interval set of a family holding ranges
+func (m *Manager) addRangeSet(name string, family addrFamily, ranges []ipRange) (*nftables.Set, error) {
+	set := &nftables.Set{
+		Table:    m.table,
+		Name:     name,
+		KeyType:  family.keyType,
+		Interval: true,
+	}
+	if err := m.conn.AddSet(set, nil); err != nil {
+		return nil, err
+	}
+	if err := m.addRanges(set, ranges); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// MetadataDrops returns the number of packets dropped on their way to the
+// metadata service, or 0 if protection is not set up
+func (m *Manager) MetadataDrops() (uint64, error) {
+	if m.metadataChain == nil {
+		return 0, nil
+	}
+	rules, err := m.conn.GetRules(m.table, m.metadataChain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read metadata counters: %w", err)
+	}
+	var packets uint64
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				packets += counter.Packets
+			}
+		}
+	}
+	return packets, nil
+}
@@ -0,0 +1,76 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// InNamespace programs the ruleset in the network namespace of netnsFd,
+// such as a pod's, instead of the router's own. The namespace's processes
+// originate the traffic, so it is filtered on output rather than forward,
+// and nothing is masqueraded.
+func InNamespace(netnsFd int) Option {
+	return func(m *Manager) {
+		m.netnsFd = netnsFd
+	}
+}
+
+// local reports whether the manager filters the traffic originating in a
+// target namespace
+func (m *Manager) local() bool {
+	return m.netnsFd != 0
+}
+
+// setupLocal accepts loopback traffic and replies on established
+// connections ahead of the policy: on output the chain also sees the
+// namespace's traffic to itself and its responses to inbound connections
+func (m *Manager) setupLocal() {
+	m.conn.InsertRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chain,
+		Exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+	m.conn.InsertRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname("lo")},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+}
+
+// Remove deletes the table, whether or not this manager set it up, e.g.
+// when a pod's namespace is torn down
+func (m *Manager) Remove() error {
+	table := &nftables.Table{
+		Family: m.tableFamily(),
+		Name:   m.name,
+	}
+	// Adding the table first makes the delete succeed if there is none
+	m.conn.AddTable(table)
+	m.conn.DelTable(table)
+	m.table = nil
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to remove table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package nftables
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// metadataPriorityOffset runs the metadata chain ahead of the policy chain,
+// so that neither rules nor grants can open the metadata service
+const metadataPriorityOffset = -10
+
+// hardeningPriorityOffset runs the hardening chain ahead of the metadata
+// chain, so that spoofed packets are dropped first
+const hardeningPriorityOffset = -20
+
+// rateLimitPriorityOffset runs the rate limit chain between the hardening
+// and metadata chains, so that spoofed packets don't use up the rates
+const rateLimitPriorityOffset = -15
+
+// banPriorityOffset runs the ban chain ahead of all others, so that banned
+// sources are dropped first
+const banPriorityOffset = -25
+
+// Placement is where the ruleset hooks into netfilter, e.g. to slot it
+// ahead of or behind the chains of other firewall managers
+type Placement struct {
+	// Family of the table; zero is inet. An ip or ip6 table only sees the
+	// traffic of its own address family.
+	Family nftables.TableFamily
+	// Hook of the policy chain and the chains ahead of it; nil is forward,
+	// or output in a target namespace
+	Hook *nftables.ChainHook
+	// Priority of the policy chain; nil is the filter priority
+	Priority *nftables.ChainPriority
+}
+
+// ParsePlacement parses a table family, hook and priority as named in the
+// config; empty values keep the defaults
+func ParsePlacement(family, hook string, priority *int) (Placement, error) {
+	var p Placement
+	switch family {
+	case "", "inet":
+	case "ip":
+		p.Family = nftables.TableFamilyIPv4
+	case "ip6":
+		p.Family = nftables.TableFamilyIPv6
+	default:
+		return Placement{}, fmt.Errorf("unsupported table family %q", family)
+	}
+	switch hook {
+	case "":
+	case "forward":
+		p.Hook = nftables.ChainHookForward
+	case "output":
+		p.Hook = nftables.ChainHookOutput
+	case "prerouting":
+		p.Hook = nftables.ChainHookPrerouting
+	default:
+		return Placement{}, fmt.Errorf("unsupported hook %q", hook)
+	}
+	if priority != nil {
+		if *priority < math.MinInt32-banPriorityOffset || *priority > math.MaxInt32 {
+			return Placement{}, fmt.Errorf("priority %d is out of range", *priority)
+		}
+		p.Priority = nftables.ChainPriorityRef(nftables.ChainPriority(*priority))
+	}
+	return p, nil
+}
+
+// SetPlacement places the ruleset the next Setup creates
+func (m *Manager) SetPlacement(p Placement) {
+	m.placement = p
+}
+
+// tableFamily returns the family of the table
+func (m *Manager) tableFamily() nftables.TableFamily {
+	if m.placement.Family == nftables.TableFamilyUnspecified {
+		return nftables.TableFamilyINet
+	}
+	return m.placement.Family
+}
+
+// hook returns the hook of the policy chain and the chains ahead of it
+func (m *Manager) hook() *nftables.ChainHook {
+	switch {
+	case m.placement.Hook != nil:
+		return m.placement.Hook
+	case m.local():
+		return nftables.ChainHookOutput
+	default:
+		return nftables.ChainHookForward
+	}
+}
+
+// priority returns the priority of the policy chain
+func (m *Manager) priority() *nftables.ChainPriority {
+	if m.placement.Priority == nil {
+		return nftables.ChainPriorityFilter
+	}
+	return m.placement.Priority
+}
+
+// metadataPriority returns the priority of the metadata chain
+func (m *Manager) metadataPriority() *nftables.ChainPriority {
+	return nftables.ChainPriorityRef(*m.priority() + metadataPriorityOffset)
+}
+
+// rateLimitPriority returns the priority of the rate limit chain
+func (m *Manager) rateLimitPriority() *nftables.ChainPriority {
+	return nftables.ChainPriorityRef(*m.priority() + rateLimitPriorityOffset)
+}
+
+// hardeningPriority returns the priority of the hardening chain
+func (m *Manager) hardeningPriority() *nftables.ChainPriority {
+	return nftables.ChainPriorityRef(*m.priority() + hardeningPriorityOffset)
+}
+
+// banPriority returns the priority of the ban chain
+func (m *Manager) banPriority() *nftables.ChainPriority {
+	return nftables.ChainPriorityRef(*m.priority() + banPriorityOffset)
+}
+
+// carries reports whether the table sees the traffic of an address family;
+// rules matching a family it doesn't are left out
+func (m *Manager) carries(family addrFamily) bool {
+	switch m.tableFamily() {
+	case nftables.TableFamilyIPv4:
+		return family.nfproto != unix.NFPROTO_IPV6
+	case nftables.TableFamilyIPv6:
+		return family.nfproto != unix.NFPROTO_IPV4
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package nftables
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestPlacement tests placing the table and base chains, and leaving out
+// the rules of the address family a table doesn't see
+func TestPlacement(t *testing.T) {
+	priority := -150
+	outOfRange := -1 << 31
+
+	testCases := []struct {
+		name     string
+		family   string
+		hook     string
+		priority *int
+		want     []string
+		wantNot  []string
+		// Whether an IPv6 packet to the metadata service is dropped
+		wantV6Drop bool
+		wantErr    bool
+	}{
+		{
+			name: "default",
+			want: []string{
+				"table inet legion_filter",
+				"type filter hook forward priority 0; policy accept;",
+				"type filter hook forward priority -10; policy accept;",
+			},
+			wantV6Drop: true,
+		},
+		{
+			name:     "prerouting",
+			hook:     "prerouting",
+			priority: &priority,
+			want: []string{
+				"type filter hook prerouting priority -150; policy accept;",
+				"type filter hook prerouting priority -160; policy accept;",
+			},
+			wantV6Drop: true,
+		},
+		{
+			name:   "ip",
+			family: "ip",
+			want: []string{
+				"table ip legion_filter",
+				"meta nfproto ipv4 ip daddr @ips_web counter accept",
+			},
+			wantNot: []string{"ip6 daddr"},
+		},
+		{
+			name:    "unknown family",
+			family:  "bridge",
+			wantErr: true,
+		},
+		{
+			name:    "unknown hook",
+			hook:    "input",
+			wantErr: true,
+		},
+		{
+			name:     "priority out of range",
+			priority: &outOfRange,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParsePlacement(tc.family, tc.hook, tc.priority)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParsePlacement() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			m := NewScriptManager()
+			m.SetPlacement(p)
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			if err := m.SetupMetadataProtection([]string{"169.254.169.254", "fd00:ec2::254"}, nil); err != nil {
+				t.Fatalf("Failed to set up metadata protection: %v", err)
+			}
+			if err := m.AddRule(Rule{Name: "web", Action: "allow", IPs: []string{"0.0.0.0/0", "::/0"}}); err != nil {
+				t.Fatalf("Failed to add rule: %v", err)
+			}
+
+			text, err := m.RenderText()
+			if err != nil {
+				t.Fatalf("RenderText() error = %v", err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(text, want) {
+					t.Errorf("Expected %q in:\n%s", want, text)
+				}
+			}
+			for _, unwanted := range tc.wantNot {
+				if strings.Contains(text, unwanted) {
+					t.Errorf("Expected no %q in:\n%s", unwanted, text)
+				}
+			}
+
+			v, err := m.Evaluate(Packet{
+				Source:      net.IPv6unspecified,
+				Destination: net.ParseIP("fd00:ec2::254"),
+				Protocol:    "tcp",
+				Port:        80,
+			})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if v.Accept == tc.wantV6Drop {
+				t.Errorf("Expected drop %v, got %+v", tc.wantV6Drop, v)
+			}
+		})
+	}
+}
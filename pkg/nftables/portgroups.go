@@ -0,0 +1,51 @@
+package nftables
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// portGroupSetNameFmt names the set of a port group
+const portGroupSetNameFmt = "ports_%s"
+
+// SetPortGroups shares the ports of each named group, from the next Setup,
+// between the rules naming it in PortGroup: a group of several ranges is
+// held in one set rather than in a set per rule
+func (m *Manager) SetPortGroups(groups map[string][]string) {
+	m.portGroups = groups
+}
+
+// setupPortGroups creates the sets of the port groups of several ranges;
+// rules of groups of a single range compare it directly
+func (m *Manager) setupPortGroups() error {
+	m.portGroupSets = make(map[string]*nftables.Set)
+	names := make([]string, 0, len(m.portGroups))
+	for name := range m.portGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ranges, err := m.portRanges(m.portGroups[name])
+		if err != nil {
+			return fmt.Errorf("port group %s: %w", name, err)
+		}
+		if len(ranges) < 2 {
+			continue
+		}
+		set := &nftables.Set{
+			Table:    m.table,
+			Name:     fmt.Sprintf(portGroupSetNameFmt, sanitizeName(name)),
+			Constant: true,
+			Interval: true,
+			KeyType:  nftables.TypeInetService,
+		}
+		if err := m.conn.AddSet(set, portSetElements(ranges)); err != nil {
+			return fmt.Errorf("failed to create set of port group %s: %w", name, err)
+		}
+		m.portGroupSets[name] = set
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	profileChainNameFmt = "egress_profile_%s" // Per-profile rule chains
+	srcSetNameFmt       = "src_%s"            // IPv4 profile sources
+	src6SetNameFmt      = "src6_%s"           // IPv6 profile sources
+)
+
+// profile holds the chain of the rules scoped to a profile and the sets of
+// source addresses, such as container addresses, the profile applies to
+type profile struct {
+	chain   *nftables.Chain
+	sources *ruleSets
+}
+
+// profile returns a profile, creating its chain and source sets on first
+// use. Traffic from the profile's sources jumps to the chain ahead of the
+// shared rules; traffic the profile's rules don't decide returns to the
+// shared chain.
+func (m *Manager) profile(name string) (*profile, error) {
+	if p, ok := m.profiles[name]; ok {
+		return p, nil
+	}
+
+	p := &profile{
+		chain: m.conn.AddChain(&nftables.Chain{
+			Name:  fmt.Sprintf(profileChainNameFmt, sanitizeName(name)),
+			Table: m.table,
+		}),
+		sources: &ruleSets{},
+	}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		nameFmt := srcSetNameFmt
+		if family == familyIPv6 {
+			nameFmt = src6SetNameFmt
+		}
+		set := &nftables.Set{
+			Table:    m.table,
+			Name:     fmt.Sprintf(nameFmt, sanitizeName(name)),
+			KeyType:  family.keyType,
+			Interval: true,
+		}
+		if err := m.conn.AddSet(set, nil); err != nil {
+			return nil, fmt.Errorf("failed to create %s source set: %w", family.name, err)
+		}
+		p.sources.set(family, set)
+		if !m.carries(family) {
+			continue
+		}
+
+		m.conn.InsertRule(&nftables.Rule{
+			Table: m.table,
+			Chain: m.chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       family.saddrOffset,
+					Len:          family.addrLen,
+				},
+				&expr.Lookup{
+					SourceRegister: 1,
+					SetName:        set.Name,
+					SetID:          set.ID,
+				},
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: p.chain.Name},
+			},
+		})
+	}
+	m.profiles[name] = p
+	return p, nil
+}
+
+// SetProfileSources replaces the source addresses a profile applies to
+// Only the difference is applied, so that containers starting and stopping
+// don't disturb the others
+func (m *Manager) SetProfileSources(name string, addrs []string) error {
+	p, err := m.profile(name)
+	if err != nil {
+		return err
+	}
+	changes, err := m.replaceRanges(p.sources, addrs)
+	if err != nil {
+		return err
+	}
+	if changes == "" {
+		// The profile may just have been created
+		if err := m.conn.Flush(); err != nil {
+			return fmt.Errorf("failed to create profile %s: %w", name, err)
+		}
+		return nil
+	}
+	log.Printf("Updated sources of profile %s: %s", name, changes)
+	return nil
+}
+
+// ProfileContains reports whether ip is one of a profile's sources
+func (m *Manager) ProfileContains(name string, ip net.IP) bool {
+	p, ok := m.profiles[name]
+	if !ok || ip == nil {
+		return false
+	}
+
+	ranges := p.sources.ranges6
+	if v4 := ip.To4(); v4 != nil {
+		ip, ranges = v4, p.sources.ranges4
+	}
+	for _, r := range ranges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package nftables
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rateLimitChainName       = "rate_limit"
+	rateLimitSourcesSetName  = "rate_limit_sources"  // IPv4 sources and their rates
+	rateLimitSources6SetName = "rate_limit_sources6" // IPv6 sources and their rates
+	rateLimitExemptSetName   = "rate_limit_exempt"   // IPv4 exempt sources
+	rateLimitExempt6SetName  = "rate_limit_exempt6"  // IPv6 exempt sources
+)
+
+// Rate is a number of new connections per period; zero is no limit
+type Rate struct {
+	Count uint64
+	Per   time.Duration
+}
+
+// limit returns the expression matching packets beyond the rate
+func (r Rate) limit(burst uint32) *expr.Limit {
+	return &expr.Limit{
+		Type:  expr.LimitTypePkts,
+		Rate:  r.Count,
+		Over:  true,
+		Unit:  expr.LimitTime(r.Per / time.Second),
+		Burst: burst,
+	}
+}
+
+// RateLimits are the limits SetupRateLimits installs
+type RateLimits struct {
+	Global    Rate
+	PerSource Rate
+	// Burst is the number of connections allowed beyond the rate at once
+	Burst uint32
+	// Exempt sources are not limited (IPs or CIDRs)
+	Exempt []string
+}
+
+// SetupRateLimits drops new connections beyond the rate of all sources
+// together or of each source, counting the drops. It has a base chain of
+// its own ahead of the metadata and policy chains, so that no rule or grant
+// opens the way for a flood.
+func (m *Manager) SetupRateLimits(limits RateLimits) error {
+	// The running table keeps limiting all sources during a rollout
+	if m.canary {
+		return nil
+	}
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:     rateLimitChainName,
+		Table:    m.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  m.hook(),
+		Priority: m.rateLimitPriority(),
+	})
+	newConn, err := ctStateExpressions([]string{"new"})
+	if err != nil {
+		return err
+	}
+
+	src4, src6, err := m.addressRanges(limits.Exempt)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit exemption: %w", err)
+	}
+	for _, family := range []addrFamily{familyIPv4, familyIPv6} {
+		exemptName, sourcesName, exemptRanges := rateLimitExemptSetName, rateLimitSourcesSetName, src4
+		if family == familyIPv6 {
+			exemptName, sourcesName, exemptRanges = rateLimitExempt6SetName, rateLimitSources6SetName, src6
+		}
+		if !m.carries(family) {
+			continue
+		}
+		saddr := &expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       family.saddrOffset,
+			Len:          family.addrLen,
+		}
+		match := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+			saddr,
+		}
+		if len(exemptRanges) > 0 {
+			exempt, err := m.addRangeSet(exemptName, family, exemptRanges)
+			if err != nil {
+				return fmt.Errorf("failed to create %s exempt set: %w", family.name, err)
+			}
+			m.conn.AddRule(&nftables.Rule{
+				Table: m.table,
+				Chain: chain,
+				Exprs: append(append([]expr.Any(nil), match...),
+					&expr.Lookup{SourceRegister: 1, SetName: exempt.Name, SetID: exempt.ID},
+					&expr.Verdict{Kind: expr.VerdictReturn},
+				),
+			})
+		}
+
+		if limits.PerSource.Count == 0 {
+			continue
+		}
+		// A source's rate is forgotten once it is idle for a period, by
+		// when its bucket would have refilled anyway
+		timeout := limits.PerSource.Per
+		if timeout < time.Minute {
+			timeout = time.Minute
+		}
+		sources := &nftables.Set{
+			Table:      m.table,
+			Name:       sourcesName,
+			KeyType:    family.keyType,
+			HasTimeout: true,
+			Timeout:    timeout,
+			Dynamic:    true,
+		}
+		if err := m.conn.AddSet(sources, nil); err != nil {
+			return fmt.Errorf("failed to create %s rate limit set: %w", family.name, err)
+		}
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: append(append(append([]expr.Any(nil), newConn...), match...),
+				&expr.Dynset{
+					SrcRegKey: 1,
+					SetName:   sources.Name,
+					SetID:     sources.ID,
+					Operation: unix.NFT_DYNSET_OP_UPDATE,
+					Exprs:     []expr.Any{limits.PerSource.limit(limits.Burst)},
+				},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			),
+		})
+	}
+
+	if limits.Global.Count > 0 {
+		m.conn.AddRule(&nftables.Rule{
+			Table: m.table,
+			Chain: chain,
+			Exprs: append(append([]expr.Any(nil), newConn...),
+				limits.Global.limit(limits.Burst),
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			),
+		})
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set up rate limits: %w", err)
+	}
+	m.rateLimitChain = chain
+	log.Printf("Limiting new connections: %s globally, %s per source, %d exempt sources",
+		formatRate(limits.Global), formatRate(limits.PerSource), len(limits.Exempt))
+	return nil
+}
+
+// formatRate renders a rate as nft does, e.g. 100/second
+func formatRate(r Rate) string {
+	if r.Count == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", r.Count, limitUnit(expr.LimitTime(r.Per/time.Second)))
+}
+
+// limitUnit returns the name of the period of a limit
+func limitUnit(unit expr.LimitTime) string {
+	switch unit {
+	case expr.LimitTimeSecond:
+		return "second"
+	case expr.LimitTimeMinute:
+		return "minute"
+	case expr.LimitTimeHour:
+		return "hour"
+	case expr.LimitTimeDay:
+		return "day"
+	case expr.LimitTimeWeek:
+		return "week"
+	}
+	return fmt.Sprintf("%d seconds", unit)
+}
+
+// RateLimitDrops returns the number of new connections dropped beyond
+// their rate, or 0 if rate limits are not set up
+func (m *Manager) RateLimitDrops() (uint64, error) {
+	if m.rateLimitChain == nil {
+		return 0, nil
+	}
+	rules, err := m.conn.GetRules(m.table, m.rateLimitChain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rate limit counters: %w", err)
+	}
+	var packets uint64
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				packets += counter.Packets
+			}
+		}
+	}
+	return packets, nil
+}
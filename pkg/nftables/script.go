@@ -0,0 +1,1202 @@
+package nftables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// scriptConn records the ruleset instead of programming the kernel, so that
+// it can be written as an nft script
+type scriptConn struct {
+	tables []*scriptTable
+	setID  uint32
+	handle uint64
+}
+
+// scriptTable is a recorded table with its sets and chains in the order they
+// were added
+type scriptTable struct {
+	table  *nftables.Table
+	sets   []*scriptSet
+	chains []*scriptChain
+}
+
+type scriptSet struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+}
+
+type scriptChain struct {
+	chain *nftables.Chain
+	rules []*nftables.Rule
+}
+
+// NewScriptManager creates a manager that records the ruleset for
+// WriteScript instead of programming it
+func NewScriptManager(opts ...Option) *Manager {
+	m := &Manager{
+		conn:         &scriptConn{},
+		name:         tableName,
+		sets:         make(map[string]*ruleSets),
+		excludedSets: make(map[string]*ruleSets),
+		vrfChains:    make(map[string]*nftables.Chain),
+		profiles:     make(map[string]*profile),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// WriteScript writes the recorded ruleset as an `nft -f` script. The script
+// replaces the table, so it can be applied repeatedly.
+func (m *Manager) WriteScript(w io.Writer) error {
+	c, ok := m.conn.(*scriptConn)
+	if !ok {
+		return fmt.Errorf("the ruleset is programmed, not recorded")
+	}
+
+	var b strings.Builder
+	b.WriteString("#!/usr/sbin/nft -f\n")
+	for _, t := range c.tables {
+		if err := t.write(&b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// RenderText returns the recorded ruleset in nft syntax, as `nft list
+// ruleset` would list it. Sets, chains and set elements are sorted, so the
+// text depends only on the ruleset and not on the order it was built in,
+// which makes it suitable for golden file tests.
+func (m *Manager) RenderText() (string, error) {
+	c, ok := m.conn.(*scriptConn)
+	if !ok {
+		return "", fmt.Errorf("the ruleset is programmed, not recorded")
+	}
+
+	tables := append([]*scriptTable(nil), c.tables...)
+	sort.Slice(tables, func(i, j int) bool { return tables[i].table.Name < tables[j].table.Name })
+	var b strings.Builder
+	for i, t := range tables {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		if err := t.sorted().writeTable(&b); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// RuleText returns the recorded nftables rules built from a rule, in nft
+// syntax and prefixed with their chain: the jump to the rule's chain, then
+// the rules in it
+func (m *Manager) RuleText(ruleName string) ([]string, error) {
+	c, ok := m.conn.(*scriptConn)
+	if !ok {
+		return nil, fmt.Errorf("the ruleset is programmed, not recorded")
+	}
+	t := c.table(m.table)
+	sub := m.ruleChains[ruleName]
+	if t == nil || sub == nil {
+		return nil, fmt.Errorf("no rules recorded for %s", ruleName)
+	}
+
+	var text []string
+	add := func(cr *chainRules) error {
+		sc := c.chain(m.table, cr.chain)
+		for i, owner := range cr.owners {
+			if owner != ruleName || sc == nil || i >= len(sc.rules) {
+				continue
+			}
+			rule, err := t.ruleText(sc.rules[i])
+			if err != nil {
+				return fmt.Errorf("failed to render rule in chain %s: %w", cr.chain.Name, err)
+			}
+			text = append(text, fmt.Sprintf("chain %s: %s", cr.chain.Name, rule))
+		}
+		return nil
+	}
+	for name, cr := range m.chainRules {
+		if name == sub.Name {
+			continue
+		}
+		if err := add(cr); err != nil {
+			return nil, err
+		}
+	}
+	if cr, ok := m.chainRules[sub.Name]; ok {
+		if err := add(cr); err != nil {
+			return nil, err
+		}
+	}
+	return text, nil
+}
+
+func (c *scriptConn) AddTable(t *nftables.Table) *nftables.Table {
+	c.tables = append(c.tables, &scriptTable{table: t})
+	return t
+}
+
+func (c *scriptConn) DelTable(t *nftables.Table) {
+	for i, st := range c.tables {
+		if st.table.Name == t.Name && st.table.Family == t.Family {
+			c.tables = append(c.tables[:i], c.tables[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *scriptConn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	if t := c.table(ch.Table); t != nil {
+		t.chains = append(t.chains, &scriptChain{chain: ch})
+	}
+	return ch
+}
+
+func (c *scriptConn) DelChain(ch *nftables.Chain) {
+	t := c.table(ch.Table)
+	if t == nil {
+		return
+	}
+	for i, sc := range t.chains {
+		if sc.chain == ch {
+			t.chains = append(t.chains[:i], t.chains[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *scriptConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	if ch := c.chain(r.Table, r.Chain); ch != nil {
+		r.Handle = c.nextHandle()
+		ch.rules = append(ch.rules, r)
+	}
+	return r
+}
+
+// InsertRule inserts a rule at the top of its chain, or before the rule
+// whose handle is its position as the kernel does
+func (c *scriptConn) InsertRule(r *nftables.Rule) *nftables.Rule {
+	ch := c.chain(r.Table, r.Chain)
+	if ch == nil {
+		return r
+	}
+	i := 0
+	if r.Position != 0 {
+		i = ch.index(r.Position)
+		if i < 0 {
+			return r
+		}
+	}
+	r.Handle = c.nextHandle()
+	ch.rules = append(ch.rules[:i], append([]*nftables.Rule{r}, ch.rules[i:]...)...)
+	return r
+}
+
+func (c *scriptConn) DelRule(r *nftables.Rule) error {
+	ch := c.chain(r.Table, r.Chain)
+	if ch == nil {
+		return fmt.Errorf("chain %s does not exist", r.Chain.Name)
+	}
+	i := ch.index(r.Handle)
+	if i < 0 {
+		return fmt.Errorf("rule handle %d does not exist in chain %s", r.Handle, r.Chain.Name)
+	}
+	ch.rules = append(ch.rules[:i], ch.rules[i+1:]...)
+	return nil
+}
+
+// nextHandle assigns rule handles as the kernel does, unique in the table
+// and never reused
+func (c *scriptConn) nextHandle() uint64 {
+	c.handle++
+	return c.handle
+}
+
+func (c *scriptConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	t := c.table(s.Table)
+	if t == nil {
+		return fmt.Errorf("table %s does not exist", s.Table.Name)
+	}
+	// Assign IDs and anonymous set names as the netlink connection does,
+	// since lookups refer to them
+	if s.ID == 0 {
+		c.setID++
+		s.ID = c.setID
+		if s.Anonymous {
+			s.Name = fmt.Sprintf("__set%d", s.ID)
+		}
+	}
+	t.sets = append(t.sets, &scriptSet{set: s, elements: append([]nftables.SetElement(nil), vals...)})
+	return nil
+}
+
+func (c *scriptConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	set := c.set(s)
+	if set == nil {
+		return fmt.Errorf("set %s does not exist", s.Name)
+	}
+	set.elements = append(set.elements, vals...)
+	return nil
+}
+
+func (c *scriptConn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	set := c.set(s)
+	if set == nil {
+		return fmt.Errorf("set %s does not exist", s.Name)
+	}
+	type elementKey struct {
+		key         string
+		intervalEnd bool
+	}
+	deleted := make(map[elementKey]bool, len(vals))
+	for _, val := range vals {
+		deleted[elementKey{string(val.Key), val.IntervalEnd}] = true
+	}
+	kept := set.elements[:0]
+	for _, element := range set.elements {
+		if !deleted[elementKey{string(element.Key), element.IntervalEnd}] {
+			kept = append(kept, element)
+		}
+	}
+	set.elements = kept
+	return nil
+}
+
+func (c *scriptConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	set := c.set(s)
+	if set == nil {
+		return nil, fmt.Errorf("set %s does not exist", s.Name)
+	}
+	return append([]nftables.SetElement(nil), set.elements...), nil
+}
+
+func (c *scriptConn) DelSet(s *nftables.Set) {
+	t := c.table(s.Table)
+	if t == nil {
+		return
+	}
+	for i, ss := range t.sets {
+		if ss.set == s {
+			t.sets = append(t.sets[:i], t.sets[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *scriptConn) FlushSet(s *nftables.Set) {
+	if set := c.set(s); set != nil {
+		set.elements = nil
+	}
+}
+
+func (c *scriptConn) GetRules(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	sc := c.chain(t, ch)
+	if sc == nil {
+		return nil, fmt.Errorf("chain %s does not exist", ch.Name)
+	}
+	rules := make([]*nftables.Rule, len(sc.rules))
+	for i, r := range sc.rules {
+		rules[i] = &nftables.Rule{Table: t, Chain: ch, Handle: r.Handle, Exprs: r.Exprs, UserData: r.UserData}
+	}
+	return rules, nil
+}
+
+func (c *scriptConn) ListChains() ([]*nftables.Chain, error) {
+	var chains []*nftables.Chain
+	for _, t := range c.tables {
+		for _, sc := range t.chains {
+			chains = append(chains, sc.chain)
+		}
+	}
+	return chains, nil
+}
+
+func (c *scriptConn) Flush() error {
+	return nil
+}
+
+func (c *scriptConn) table(t *nftables.Table) *scriptTable {
+	for _, st := range c.tables {
+		if st.table == t {
+			return st
+		}
+	}
+	return nil
+}
+
+func (c *scriptConn) chain(t *nftables.Table, ch *nftables.Chain) *scriptChain {
+	if st := c.table(t); st != nil {
+		for _, sc := range st.chains {
+			if sc.chain == ch {
+				return sc
+			}
+		}
+	}
+	return nil
+}
+
+// chainNamed returns a chain of the table
+func (t *scriptTable) chainNamed(name string) *scriptChain {
+	for _, sc := range t.chains {
+		if sc.chain.Name == name {
+			return sc
+		}
+	}
+	return nil
+}
+
+// index returns the position of the rule with a handle, or -1
+func (ch *scriptChain) index(handle uint64) int {
+	for i, r := range ch.rules {
+		if r.Handle == handle {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *scriptConn) set(s *nftables.Set) *scriptSet {
+	if st := c.table(s.Table); st != nil {
+		for _, ss := range st.sets {
+			if ss.set == s {
+				return ss
+			}
+		}
+	}
+	return nil
+}
+
+// write writes the table, deleting any previous version first
+func (t *scriptTable) write(b *strings.Builder) error {
+	family, err := familyName(t.table.Family)
+	if err != nil {
+		return err
+	}
+	name := family + " " + t.table.Name
+	// Adding the table first makes the delete succeed if it does not exist
+	fmt.Fprintf(b, "\ntable %s\ndelete table %s\n\n", name, name)
+	return t.writeTable(b)
+}
+
+// sorted returns a copy of the table with named sets by name, base chains
+// by priority ahead of the other chains by name, and the elements of sets
+// without intervals, which are rendered sorted already, in key order
+func (t *scriptTable) sorted() *scriptTable {
+	sorted := &scriptTable{
+		table:  t.table,
+		sets:   make([]*scriptSet, len(t.sets)),
+		chains: append([]*scriptChain(nil), t.chains...),
+	}
+	for i, s := range t.sets {
+		elements := append([]nftables.SetElement(nil), s.elements...)
+		if !s.set.Interval {
+			sort.Slice(elements, func(i, j int) bool { return bytes.Compare(elements[i].Key, elements[j].Key) < 0 })
+		}
+		sorted.sets[i] = &scriptSet{set: s.set, elements: elements}
+	}
+	sort.SliceStable(sorted.sets, func(i, j int) bool { return sorted.sets[i].set.Name < sorted.sets[j].set.Name })
+	sort.SliceStable(sorted.chains, func(i, j int) bool {
+		a, b := sorted.chains[i].chain, sorted.chains[j].chain
+		switch {
+		case (a.Hooknum != nil) != (b.Hooknum != nil):
+			return a.Hooknum != nil
+		case a.Hooknum != nil && *a.Priority != *b.Priority:
+			return *a.Priority < *b.Priority
+		}
+		return a.Name < b.Name
+	})
+	return sorted
+}
+
+// writeTable writes the table with its sets and chains
+func (t *scriptTable) writeTable(b *strings.Builder) error {
+	family, err := familyName(t.table.Family)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b, "table %s %s {\n", family, t.table.Name)
+
+	for _, s := range t.sets {
+		if s.set.Anonymous {
+			continue
+		}
+		kind, typ := "set", s.set.KeyType.Name
+		if s.set.IsMap {
+			kind, typ = "map", typ+" : "+s.set.DataType.Name
+		}
+		fmt.Fprintf(b, "\t%s %s {\n\t\ttype %s\n", kind, s.set.Name, typ)
+		var flags []string
+		if s.set.Dynamic {
+			flags = append(flags, "dynamic")
+		}
+		if s.set.Interval {
+			flags = append(flags, "interval")
+		}
+		if s.set.HasTimeout {
+			flags = append(flags, "timeout")
+		}
+		if len(flags) > 0 {
+			fmt.Fprintf(b, "\t\tflags %s\n", strings.Join(flags, ","))
+		}
+		if s.set.Timeout > 0 {
+			fmt.Fprintf(b, "\t\ttimeout %s\n", formatTimeout(s.set.Timeout))
+		}
+		if elements := setElements(s.set, s.elements); len(elements) > 0 {
+			fmt.Fprintf(b, "\t\telements = { %s }\n", strings.Join(elements, ", "))
+		}
+		b.WriteString("\t}\n\n")
+	}
+
+	for i, c := range t.chains {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(b, "\tchain %s {\n", c.chain.Name)
+		if c.chain.Hooknum != nil {
+			fmt.Fprintf(b, "\t\ttype %s hook %s priority %d; policy accept;\n",
+				c.chain.Type, hookName(*c.chain.Hooknum), *c.chain.Priority)
+		}
+		for _, r := range c.rules {
+			rule, err := t.ruleText(r)
+			if err != nil {
+				return fmt.Errorf("failed to render rule in chain %s: %w", c.chain.Name, err)
+			}
+			fmt.Fprintf(b, "\t\t%s\n", rule)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return nil
+}
+
+// loaded is a value loaded into a register, waiting for the expression
+// comparing it
+type loaded struct {
+	register uint32
+	selector string // e.g. "meta l4proto"
+	format   func([]byte) string
+	mask     []byte // Set by a bitwise and, for flag tests
+}
+
+// ruleText renders a rule in nft syntax, with its comment
+func (t *scriptTable) ruleText(r *nftables.Rule) (string, error) {
+	text, err := t.rule(r.Exprs)
+	if err != nil {
+		return "", err
+	}
+	if comment, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok {
+		text += fmt.Sprintf(" comment \"%s\"", comment)
+	}
+	return text, nil
+}
+
+// rule renders the expressions of a rule in nft syntax
+func (t *scriptTable) rule(exprs []expr.Any) (string, error) {
+	var (
+		words   []string
+		pending []loaded
+		// Immediate values waiting to be stored in the mark or translated to
+		immediates = make(map[uint32][]byte)
+		// Map lookups waiting to be translated to
+		mapped = make(map[uint32]string)
+	)
+	take := func(register uint32) (loaded, error) {
+		for i := len(pending) - 1; i >= 0; i-- {
+			if pending[i].register == register {
+				l := pending[i]
+				pending = nil
+				return l, nil
+			}
+		}
+		return loaded{}, fmt.Errorf("register %d is not loaded", register)
+	}
+
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			if e.SourceRegister {
+				mark, ok := immediates[e.Register]
+				if e.Key != expr.MetaKeyMARK || !ok {
+					return "", fmt.Errorf("unsupported meta statement %d", e.Key)
+				}
+				words = append(words, fmt.Sprintf("meta mark set 0x%08x", binaryutil.NativeEndian.Uint32(mark)))
+				delete(immediates, e.Register)
+				continue
+			}
+			l, err := metaSelector(e)
+			if err != nil {
+				return "", err
+			}
+			pending = append(pending, l)
+		case *expr.Ct:
+			switch e.Key {
+			case expr.CtKeySTATE:
+				pending = append(pending, loaded{register: e.Register, selector: "ct state", format: formatCtState})
+			case expr.CtKeySTATUS:
+				pending = append(pending, loaded{register: e.Register, selector: "ct status", format: formatCtStatus})
+			default:
+				return "", fmt.Errorf("unsupported ct key %d", e.Key)
+			}
+		case *expr.Fib:
+			switch {
+			case e.FlagDADDR && e.ResultADDRTYPE:
+				pending = append(pending, loaded{register: e.Register, selector: "fib daddr type", format: formatAddrType})
+			case e.FlagSADDR && e.FlagIIF && e.ResultOIF:
+				pending = append(pending, loaded{register: e.Register, selector: "fib saddr . iif oif", format: formatOIF})
+			default:
+				return "", fmt.Errorf("unsupported fib lookup")
+			}
+		case *expr.Payload:
+			l, err := payloadSelector(e)
+			if err != nil {
+				return "", err
+			}
+			pending = append(pending, l)
+		case *expr.Hash:
+			l, err := take(e.SourceRegister)
+			if err != nil {
+				return "", err
+			}
+			if e.Type != expr.HashTypeJenkins {
+				return "", fmt.Errorf("unsupported hash type %d", e.Type)
+			}
+			pending = append(pending, loaded{
+				register: e.DestRegister,
+				selector: fmt.Sprintf("jhash %s mod %d seed 0x%x", l.selector, e.Modulus, e.Seed),
+				format:   formatInteger,
+			})
+		case *expr.Byteorder:
+			// Only the loaded length is converted, which its format expects
+			if len(pending) == 0 || pending[len(pending)-1].register != e.SourceRegister {
+				return "", fmt.Errorf("register %d is not loaded", e.SourceRegister)
+			}
+		case *expr.Bitwise:
+			if len(pending) == 0 || pending[len(pending)-1].register != e.SourceRegister {
+				return "", fmt.Errorf("register %d is not loaded", e.SourceRegister)
+			}
+			pending[len(pending)-1].mask = e.Mask
+		case *expr.Cmp:
+			l, err := take(e.Register)
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case e.Op == expr.CmpOpEq && l.mask == nil:
+				words = append(words, l.selector+" "+l.format(e.Data))
+			case e.Op == expr.CmpOpNeq && l.mask == nil:
+				words = append(words, l.selector+" != "+l.format(e.Data))
+			case e.Op == expr.CmpOpLt && l.mask == nil:
+				words = append(words, l.selector+" < "+l.format(e.Data))
+			case e.Op == expr.CmpOpGt && l.mask == nil:
+				words = append(words, l.selector+" > "+l.format(e.Data))
+			case e.Op == expr.CmpOpNeq && l.mask != nil && !bytes.ContainsFunc(e.Data, func(r rune) bool { return r != 0 }):
+				// Any of the masked flags is set
+				words = append(words, l.selector+" "+l.format(l.mask))
+			case e.Op == expr.CmpOpEq && l.mask != nil:
+				words = append(words, fmt.Sprintf("%s & (%s) == %s", l.selector, l.format(l.mask), l.format(e.Data)))
+			case e.Op == expr.CmpOpNeq && l.mask != nil:
+				words = append(words, fmt.Sprintf("%s & (%s) != %s", l.selector, l.format(l.mask), l.format(e.Data)))
+			default:
+				return "", fmt.Errorf("unsupported comparison %d", e.Op)
+			}
+		case *expr.Range:
+			l, err := take(e.Register)
+			if err != nil {
+				return "", err
+			}
+			op := ""
+			if e.Op == expr.CmpOpNeq {
+				op = "!= "
+			}
+			words = append(words, fmt.Sprintf("%s %s%s-%s", l.selector, op, l.format(e.FromData), l.format(e.ToData)))
+		case *expr.Lookup:
+			word, err := t.lookup(e, pending)
+			if err != nil {
+				return "", err
+			}
+			pending = nil
+			if e.IsDestRegSet {
+				mapped[e.DestRegister] = word
+				continue
+			}
+			words = append(words, word)
+		case *expr.Dynset:
+			word, err := t.dynset(e, pending)
+			if err != nil {
+				return "", err
+			}
+			pending = nil
+			words = append(words, word)
+		case *expr.Immediate:
+			immediates[e.Register] = e.Data
+		case *expr.Redir:
+			port, ok := immediates[e.RegisterProtoMin]
+			if !ok || e.RegisterProtoMax != 0 {
+				return "", fmt.Errorf("unsupported redirect")
+			}
+			delete(immediates, e.RegisterProtoMin)
+			words = append(words, "redirect to :"+formatPort(port))
+		case *expr.NAT:
+			word, err := natStatement(e, immediates, mapped)
+			if err != nil {
+				return "", err
+			}
+			words = append(words, word)
+		case *expr.Queue:
+			words = append(words, fmt.Sprintf("queue num %d", e.Num))
+		case *expr.Reject:
+			switch e.Type {
+			case unix.NFT_REJECT_ICMPX_UNREACH:
+				words = append(words, "reject with icmpx type "+icmpxCode(e.Code))
+			case unix.NFT_REJECT_TCP_RST:
+				words = append(words, "reject with tcp reset")
+			default:
+				return "", fmt.Errorf("unsupported reject type %d", e.Type)
+			}
+		case *expr.Masq:
+			words = append(words, "masquerade")
+		case *expr.Limit:
+			word, err := limitStatement(e)
+			if err != nil {
+				return "", err
+			}
+			words = append(words, word)
+		case *expr.Counter:
+			words = append(words, "counter")
+		case *expr.Log:
+			word := fmt.Sprintf("log prefix %q", e.Data)
+			if e.Key&(1<<unix.NFTA_LOG_GROUP) != 0 {
+				word += fmt.Sprintf(" group %d", e.Group)
+			}
+			words = append(words, word)
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				words = append(words, "accept")
+			case expr.VerdictDrop:
+				words = append(words, "drop")
+			case expr.VerdictJump:
+				words = append(words, "jump "+e.Chain)
+			case expr.VerdictGoto:
+				words = append(words, "goto "+e.Chain)
+			case expr.VerdictReturn:
+				words = append(words, "return")
+			default:
+				return "", fmt.Errorf("unsupported verdict %d", e.Kind)
+			}
+		default:
+			return "", fmt.Errorf("unsupported expression %T", e)
+		}
+	}
+	if len(pending) > 0 || len(immediates) > 0 || len(mapped) > 0 {
+		return "", fmt.Errorf("loaded value is never used")
+	}
+	return strings.Join(words, " "), nil
+}
+
+// natStatement renders a destination NAT to the address and port loaded
+// into its registers, or looked up in a map, consuming them
+func natStatement(e *expr.NAT, immediates map[uint32][]byte, mapped map[uint32]string) (string, error) {
+	if e.Type != expr.NATTypeDestNAT || e.RegAddrMax != 0 || e.RegProtoMax != 0 {
+		return "", fmt.Errorf("unsupported nat statement")
+	}
+	family := "ip"
+	if e.Family == unix.NFPROTO_IPV6 {
+		family = "ip6"
+	}
+	// A concatenated address . port fills both registers
+	if lookup, ok := mapped[e.RegAddrMin]; ok {
+		delete(mapped, e.RegAddrMin)
+		return fmt.Sprintf("dnat %s to %s", family, lookup), nil
+	}
+	addr, okAddr := immediates[e.RegAddrMin]
+	port, okPort := immediates[e.RegProtoMin]
+	if !okAddr || !okPort {
+		return "", fmt.Errorf("unsupported nat statement")
+	}
+	delete(immediates, e.RegAddrMin)
+	delete(immediates, e.RegProtoMin)
+	return fmt.Sprintf("dnat %s to %s", family, net.JoinHostPort(formatAddress(addr), formatPort(port))), nil
+}
+
+// lookup renders a set lookup of the pending values; concatenated sets
+// look up all of them
+func (t *scriptTable) lookup(e *expr.Lookup, pending []loaded) (string, error) {
+	var set *scriptSet
+	for _, s := range t.sets {
+		if s.set.Name == e.SetName {
+			set = s
+		}
+	}
+	if set == nil {
+		return "", fmt.Errorf("set %s does not exist", e.SetName)
+	}
+	if len(pending) == 0 {
+		return "", fmt.Errorf("lookup in %s without a value", e.SetName)
+	}
+
+	selectors := make([]string, len(pending))
+	for i, l := range pending {
+		selectors[i] = l.selector
+	}
+	if !set.set.Concatenation {
+		selectors = selectors[len(selectors)-1:]
+	}
+	selector := strings.Join(selectors, " . ")
+
+	if set.set.IsMap {
+		return selector + " map @" + set.set.Name, nil
+	}
+	if e.Invert {
+		selector += " !="
+	}
+	if !set.set.Anonymous {
+		return selector + " @" + set.set.Name, nil
+	}
+	format := pending[len(pending)-1].format
+	var values []string
+	ends := intervalEnds(set.elements)
+	for _, element := range set.elements {
+		switch {
+		case !set.set.Interval:
+			values = append(values, format(element.Key))
+		case !element.IntervalEnd:
+			value := format(element.Key)
+			if end := intervalEnd(element.Key, ends); !bytes.Equal(end, element.Key) {
+				value += "-" + format(end)
+			}
+			values = append(values, value)
+		}
+	}
+	return fmt.Sprintf("%s { %s }", selector, strings.Join(values, ", ")), nil
+}
+
+// dynset renders the update of a set, or the addition to it, with the
+// pending values from the packet path
+func (t *scriptTable) dynset(e *expr.Dynset, pending []loaded) (string, error) {
+	op := "update"
+	switch {
+	case e.Operation == unix.NFT_DYNSET_OP_ADD && len(e.Exprs) == 0:
+		op = "add"
+	case e.Operation != unix.NFT_DYNSET_OP_UPDATE:
+		return "", fmt.Errorf("unsupported set update of %s", e.SetName)
+	}
+	if e.SrcRegData != 0 || len(e.Exprs) > 1 {
+		return "", fmt.Errorf("unsupported set update of %s", e.SetName)
+	}
+	var set *scriptSet
+	for _, s := range t.sets {
+		if s.set.Name == e.SetName {
+			set = s
+		}
+	}
+	if set == nil {
+		return "", fmt.Errorf("set %s does not exist", e.SetName)
+	}
+	if len(pending) == 0 {
+		return "", fmt.Errorf("%s of %s without a value", op, e.SetName)
+	}
+
+	selectors := make([]string, len(pending))
+	for i, l := range pending {
+		selectors[i] = l.selector
+	}
+	if !set.set.Concatenation {
+		selectors = selectors[len(selectors)-1:]
+	}
+	// A limit per element, as `update @sources { ip saddr limit rate 10/second }`
+	statement := ""
+	if len(e.Exprs) == 1 {
+		limit, ok := e.Exprs[0].(*expr.Limit)
+		if !ok {
+			return "", fmt.Errorf("unsupported set update of %s", e.SetName)
+		}
+		word, err := limitStatement(limit)
+		if err != nil {
+			return "", err
+		}
+		statement = " " + word
+	}
+	return fmt.Sprintf("%s @%s { %s%s }", op, set.set.Name, strings.Join(selectors, " . "), statement), nil
+}
+
+// limitStatement renders a packet rate limit
+func limitStatement(e *expr.Limit) (string, error) {
+	if e.Type != expr.LimitTypePkts {
+		return "", fmt.Errorf("unsupported limit type %d", e.Type)
+	}
+	word := "limit rate "
+	if e.Over {
+		word += "over "
+	}
+	word += fmt.Sprintf("%d/%s", e.Rate, limitUnit(e.Unit))
+	if e.Burst > 0 {
+		word += fmt.Sprintf(" burst %d packets", e.Burst)
+	}
+	return word, nil
+}
+
+// metaSelector returns the selector loading a meta key
+func metaSelector(e *expr.Meta) (loaded, error) {
+	l := loaded{register: e.Register}
+	switch e.Key {
+	case expr.MetaKeyNFPROTO:
+		l.selector, l.format = "meta nfproto", formatNFProto
+	case expr.MetaKeyL4PROTO:
+		l.selector, l.format = "meta l4proto", formatL4Proto
+	case expr.MetaKeyIIFNAME:
+		l.selector, l.format = "iifname", formatIfname
+	case expr.MetaKeyOIFNAME:
+		l.selector, l.format = "oifname", formatIfname
+	case expr.MetaKeyLEN:
+		// Compared in network byte order, see lengthExpressions
+		l.selector, l.format = "meta length", formatLength
+	default:
+		return l, fmt.Errorf("unsupported meta key %d", e.Key)
+	}
+	return l, nil
+}
+
+// payloadSelector returns the selector loading header fields the manager
+// matches: addresses and destination ports
+func payloadSelector(e *expr.Payload) (loaded, error) {
+	l := loaded{register: e.DestRegister}
+	switch {
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == familyIPv4.saddrOffset && e.Len == familyIPv4.addrLen:
+		l.selector, l.format = "ip saddr", formatAddress
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == familyIPv6.saddrOffset && e.Len == familyIPv6.addrLen:
+		l.selector, l.format = "ip6 saddr", formatAddress
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == familyIPv4.daddrOffset && e.Len == familyIPv4.addrLen:
+		l.selector, l.format = "ip daddr", formatAddress
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == familyIPv6.daddrOffset && e.Len == familyIPv6.addrLen:
+		l.selector, l.format = "ip6 daddr", formatAddress
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == familyIPv4.ttlOffset && e.Len == 1:
+		l.selector, l.format = "ip ttl", formatByte
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == familyIPv6.ttlOffset && e.Len == 1:
+		l.selector, l.format = "ip6 hoplimit", formatByte
+	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 0 && e.Len == 2:
+		l.selector, l.format = "th sport", formatPort
+	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 2 && e.Len == 2:
+		l.selector, l.format = "th dport", formatPort
+	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == tcpFlagsOffset && e.Len == 1:
+		l.selector, l.format = "tcp flags", formatTCPFlags
+	default:
+		return l, fmt.Errorf("unsupported payload at offset %d", e.Offset)
+	}
+	return l, nil
+}
+
+// setElements renders the elements of a set: address or port ranges of
+// interval sets, or concatenations such as address . port grants with their timeout
+// and, in maps, value
+func setElements(set *nftables.Set, elements []nftables.SetElement) []string {
+	var values []string
+	if set.Interval {
+		starts := make([]net.IP, 0, len(elements))
+		ends := make(map[string]net.IP)
+		for _, element := range elements {
+			if !element.IntervalEnd {
+				starts = append(starts, net.IP(element.Key))
+			}
+		}
+		sort.Slice(starts, func(i, j int) bool { return bytes.Compare(starts[i], starts[j]) < 0 })
+		for _, element := range elements {
+			if element.IntervalEnd {
+				ends[string(element.Key)] = net.IP(element.Key)
+			}
+		}
+		for _, start := range starts {
+			end := intervalEnd(start, ends)
+			switch {
+			case set.KeyType.Name != nftables.TypeInetService.Name:
+				values = append(values, formatRange(start, end))
+			case bytes.Equal(start, end):
+				values = append(values, formatPort(start))
+			default:
+				values = append(values, formatPort(start)+"-"+formatPort(end))
+			}
+		}
+		return values
+	}
+
+	for _, element := range elements {
+		if !set.Concatenation {
+			continue
+		}
+		value := formatConcatenation(set.KeyType, element.Key)
+		if element.Timeout > 0 {
+			value += " timeout " + formatTimeout(element.Timeout)
+		}
+		if set.IsMap {
+			value += " : " + formatConcatenation(set.DataType, element.Val)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// formatConcatenation renders the fields of a concatenated key or value,
+// each padded to a multiple of four bytes
+func formatConcatenation(t nftables.SetDatatype, data []byte) string {
+	var fields []string
+	for _, field := range nftables.ConcatSetTypeElements(t) {
+		n := int(field.Bytes)
+		padded := (n + 3) / 4 * 4
+		if n == 0 || len(data) < padded {
+			break
+		}
+		switch field.Name {
+		case nftables.TypeInetProto.Name:
+			fields = append(fields, formatL4Proto(data[:n]))
+		case nftables.TypeInetService.Name:
+			fields = append(fields, formatPort(data[:n]))
+		default:
+			fields = append(fields, formatAddress(data[:n]))
+		}
+		data = data[padded:]
+	}
+	return strings.Join(fields, " . ")
+}
+
+// intervalEnd returns the inclusive end of the interval starting at start:
+// the address before the nearest end element, or the end of the address
+// space if there is none
+func intervalEnd(start net.IP, ends map[string]net.IP) net.IP {
+	var nearest net.IP
+	for _, end := range ends {
+		if bytes.Compare(end, start) > 0 && (nearest == nil || bytes.Compare(end, nearest) < 0) {
+			nearest = end
+		}
+	}
+	if nearest == nil {
+		last := make(net.IP, len(start))
+		for i := range last {
+			last[i] = 0xff
+		}
+		return last
+	}
+	last := make(net.IP, len(nearest))
+	copy(last, nearest)
+	for i := len(last) - 1; i >= 0; i-- {
+		last[i]--
+		if last[i] != 0xff {
+			break
+		}
+	}
+	return last
+}
+
+// formatRange renders a range as an address, a prefix if it is one, or
+// start-end
+func formatRange(start, end net.IP) string {
+	if start.Equal(end) {
+		return start.String()
+	}
+	bits := len(start) * 8
+	for ones := 0; ones <= bits; ones++ {
+		mask := net.CIDRMask(ones, bits)
+		if start.Mask(mask).Equal(start) && lastAddress(start, mask).Equal(end) {
+			return fmt.Sprintf("%s/%d", start, ones)
+		}
+	}
+	return fmt.Sprintf("%s-%s", start, end)
+}
+
+// lastAddress returns the last address of the network of ip and mask
+func lastAddress(ip net.IP, mask net.IPMask) net.IP {
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^mask[i]
+	}
+	return last
+}
+
+func formatNFProto(data []byte) string {
+	switch data[0] {
+	case unix.NFPROTO_IPV4:
+		return "ipv4"
+	case unix.NFPROTO_IPV6:
+		return "ipv6"
+	}
+	return fmt.Sprint(data[0])
+}
+
+func formatL4Proto(data []byte) string {
+	switch data[0] {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_ICMP:
+		return "icmp"
+	}
+	return fmt.Sprint(data[0])
+}
+
+func formatCtState(data []byte) string {
+	state := binaryutil.NativeEndian.Uint32(data)
+	var names []string
+	for _, bit := range []struct {
+		bit  uint32
+		name string
+	}{
+		{expr.CtStateBitINVALID, "invalid"},
+		{expr.CtStateBitESTABLISHED, "established"},
+		{expr.CtStateBitRELATED, "related"},
+		{expr.CtStateBitNEW, "new"},
+		{expr.CtStateBitUNTRACKED, "untracked"},
+	} {
+		if state&bit.bit != 0 {
+			names = append(names, bit.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func formatCtStatus(data []byte) string {
+	if binaryutil.NativeEndian.Uint32(data) == ctStatusDNAT {
+		return "dnat"
+	}
+	return fmt.Sprintf("0x%x", binaryutil.NativeEndian.Uint32(data))
+}
+
+func formatAddrType(data []byte) string {
+	if binaryutil.NativeEndian.Uint32(data) == unix.RTN_LOCAL {
+		return "local"
+	}
+	return fmt.Sprint(binaryutil.NativeEndian.Uint32(data))
+}
+
+// formatOIF renders an output interface index, missing if there is no
+// route
+func formatOIF(data []byte) string {
+	if binaryutil.NativeEndian.Uint32(data) == 0 {
+		return "missing"
+	}
+	return formatInteger(data)
+}
+
+func formatTCPFlags(data []byte) string {
+	var names []string
+	for _, flag := range []struct {
+		bit  byte
+		name string
+	}{
+		{tcpFlagFIN, "fin"},
+		{tcpFlagSYN, "syn"},
+		{tcpFlagRST, "rst"},
+		{tcpFlagPSH, "psh"},
+		{tcpFlagACK, "ack"},
+		{tcpFlagURG, "urg"},
+	} {
+		if data[0]&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("0x%x", data[0])
+	}
+	return strings.Join(names, "|")
+}
+
+func formatIfname(data []byte) string {
+	return fmt.Sprintf("%q", string(bytes.TrimRight(data, "\x00")))
+}
+
+func formatAddress(data []byte) string {
+	return net.IP(data).String()
+}
+
+func formatInteger(data []byte) string {
+	return fmt.Sprint(binaryutil.NativeEndian.Uint32(data))
+}
+
+func formatByte(data []byte) string {
+	return fmt.Sprint(data[0])
+}
+
+func formatLength(data []byte) string {
+	return fmt.Sprint(binary.BigEndian.Uint32(data))
+}
+
+func formatPort(data []byte) string {
+	return fmt.Sprint(binary.BigEndian.Uint16(data))
+}
+
+// formatTimeout renders a timeout in nft's 1h2m3s format
+func formatTimeout(d time.Duration) string {
+	d = d.Round(time.Second)
+	var b strings.Builder
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if n := d / unit.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, unit.suffix)
+			d -= n * unit.d
+		}
+	}
+	if b.Len() == 0 {
+		return "1s"
+	}
+	return b.String()
+}
+
+func familyName(family nftables.TableFamily) (string, error) {
+	switch family {
+	case nftables.TableFamilyINet:
+		return "inet", nil
+	case nftables.TableFamilyIPv4:
+		return "ip", nil
+	case nftables.TableFamilyIPv6:
+		return "ip6", nil
+	}
+	return "", fmt.Errorf("unsupported table family %d", family)
+}
+
+func hookName(hook nftables.ChainHook) string {
+	switch hook {
+	case *nftables.ChainHookPrerouting:
+		return "prerouting"
+	case *nftables.ChainHookInput:
+		return "input"
+	case *nftables.ChainHookForward:
+		return "forward"
+	case *nftables.ChainHookOutput:
+		return "output"
+	case *nftables.ChainHookPostrouting:
+		return "postrouting"
+	}
+	return fmt.Sprint(hook)
+}
+
+func icmpxCode(code uint8) string {
+	switch code {
+	case unix.NFT_REJECT_ICMPX_NO_ROUTE:
+		return "no-route"
+	case unix.NFT_REJECT_ICMPX_PORT_UNREACH:
+		return "port-unreachable"
+	case unix.NFT_REJECT_ICMPX_HOST_UNREACH:
+		return "host-unreachable"
+	case unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED:
+		return "admin-prohibited"
+	}
+	return fmt.Sprint(code)
+}
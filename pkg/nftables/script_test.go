@@ -0,0 +1,609 @@
+package nftables
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// TestWriteScript tests that recorded rules render as nft statements
+func TestWriteScript(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule Rule
+		want []string
+	}{
+		{
+			name: "addresses",
+			rule: Rule{Name: "internal", Action: "deny", IPs: []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.1", "2001:db8::/32"}},
+			want: []string{
+				"elements = { 10.0.0.0/8, 192.0.2.1 }",
+				"elements = { 2001:db8::/32 }",
+				"meta nfproto ipv4 ip daddr @ips_internal counter drop",
+				"meta nfproto ipv6 ip6 daddr @ips6_internal counter drop",
+			},
+		},
+		{
+			name: "protocol and ports",
+			rule: Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443", "8000-8080"}},
+			want: []string{"meta l4proto tcp th dport { 443, 8000-8080 } counter accept"},
+		},
+		{
+			name: "protocols and overlapping ports",
+			rule: Rule{Name: "dns", Action: "allow", Protocols: []string{"udp", "tcp", "udp"}, Ports: []string{"53", "50-60", "65000-65535"}},
+			want: []string{"meta l4proto { udp, tcp } th dport { 50-60, 65000-65535 } counter accept"},
+		},
+		{
+			name: "comment",
+			rule: Rule{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Comment: "config=0a1b2c3d4e5f rule=web"},
+			want: []string{`meta l4proto tcp counter accept comment "config=0a1b2c3d4e5f rule=web"`},
+		},
+		{
+			name: "interface",
+			rule: Rule{Name: "guests", Action: "allow", Protocols: []string{"icmp"}, InputInterface: "eth1.100"},
+			want: []string{`iifname "eth1.100" meta l4proto icmp counter accept`},
+		},
+		{
+			name: "vrf",
+			rule: Rule{Name: "blue", Action: "allow", Protocols: []string{"udp"}, VRF: "blue"},
+			want: []string{
+				`iifname "blue" jump egress_vrf_blue`,
+				"chain egress_vrf_blue {\n\t\tjump rule_blue",
+				"chain rule_blue {\n\t\tmeta l4proto udp counter accept",
+			},
+		},
+		{
+			name: "inspection",
+			rule: Rule{Name: "ssh", Action: "allow", Inspect: true, Queue: 100, Mark: 7},
+			want: []string{"meta l4proto { tcp, udp } meta mark set 0x00000007 queue num 100"},
+		},
+		{
+			name: "block quic",
+			rule: Rule{Name: "video", Action: "allow", DestinationSet: true, BlockQUIC: true},
+			want: []string{"meta nfproto ipv4 meta l4proto udp th dport 443 ip daddr @ips_video reject with icmpx type port-unreachable"},
+		},
+		{
+			name: "reject",
+			rule: Rule{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Ports: []string{"25"}, DenyBehavior: DenyReject},
+			want: []string{"meta l4proto tcp th dport 25 counter reject with icmpx type port-unreachable"},
+		},
+		{
+			name: "logged admin prohibited",
+			rule: Rule{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Ports: []string{"25"}, DenyBehavior: DenyReject, RejectWith: RejectAdminProhibited, Log: true},
+			want: []string{`meta l4proto tcp th dport 25 counter log prefix "legion deny smtp: " reject with icmpx type admin-prohibited`},
+		},
+		{
+			name: "logged drop",
+			rule: Rule{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Log: true},
+			want: []string{`meta l4proto tcp counter log prefix "legion deny smtp: " drop`},
+		},
+		{
+			name: "reset tcp",
+			rule: Rule{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Ports: []string{"25"}, DenyBehavior: DenyRejectTCPRST},
+			want: []string{"chain rule_smtp {\n\t\tmeta l4proto tcp th dport 25 counter reject with tcp reset\n\t}"},
+		},
+		{
+			name: "reset tcp and reject others",
+			rule: Rule{Name: "internal", Action: "deny", IPs: []string{"10.0.0.0/8"}, DenyBehavior: DenyRejectTCPRST},
+			want: []string{
+				"meta nfproto ipv4 meta l4proto tcp ip daddr @ips_internal counter reject with tcp reset",
+				"meta nfproto ipv4 ip daddr @ips_internal counter reject with icmpx type port-unreachable",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager()
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			if err := m.AddRule(tc.rule); err != nil {
+				t.Fatalf("Failed to add rule: %v", err)
+			}
+
+			var b strings.Builder
+			if err := m.WriteScript(&b); err != nil {
+				t.Fatalf("Failed to write script: %v", err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
+
+// TestWriteScriptUpdates tests that the script reflects set updates and
+// grants made after the rules
+func TestWriteScriptUpdates(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "cdn", Action: "allow", IPs: []string{"192.0.2.1", "192.0.2.2"}}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+	if err := m.UpdateIPs("cdn", []string{"192.0.2.2", "198.51.100.0/24"}); err != nil {
+		t.Fatalf("Failed to update IPs: %v", err)
+	}
+	if err := m.AddGrant(nil, net.ParseIP("203.0.113.10"), 22, 15*time.Minute); err != nil {
+		t.Fatalf("Failed to add grant: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"elements = { 192.0.2.2, 198.51.100.0/24 }",
+		"elements = { 203.0.113.10 . 22 timeout 15m }",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+// TestWriteScriptInNamespace tests that a target namespace is filtered on
+// output, without NAT
+func TestWriteScriptInNamespace(t *testing.T) {
+	m := NewScriptManager(InNamespace(3))
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"type filter hook output priority 0; policy accept;\n\t\toifname \"lo\" accept\n\t\tct state established,related accept\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "masquerade") {
+		t.Errorf("Expected no NAT in a target namespace:\n%s", b.String())
+	}
+}
+
+// TestWriteScriptProfiles tests that profile rules are only reached from
+// the profile's sources
+func TestWriteScriptProfiles(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "ci-registry", Action: "allow", IPs: []string{"192.0.2.1"}, Profile: "ci-runner"}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+	if err := m.SetProfileSources("ci-runner", []string{"172.17.0.2", "172.17.0.3"}); err != nil {
+		t.Fatalf("Failed to set sources: %v", err)
+	}
+	if err := m.SetProfileSources("ci-runner", []string{"172.17.0.3"}); err != nil {
+		t.Fatalf("Failed to set sources: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"meta nfproto ipv4 ip saddr @src_ci_runner jump egress_profile_ci_runner",
+		"meta nfproto ipv6 ip6 saddr @src6_ci_runner jump egress_profile_ci_runner",
+		"elements = { 172.17.0.3 }",
+		"chain egress_profile_ci_runner {\n\t\tjump rule_ci_registry",
+		"chain rule_ci_registry {\n\t\tmeta nfproto ipv4 ip daddr @ips_ci_registry counter accept",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	if !m.ProfileContains("ci-runner", net.ParseIP("172.17.0.3")) || m.ProfileContains("ci-runner", net.ParseIP("172.17.0.2")) {
+		t.Error("Expected only 172.17.0.3 in the profile")
+	}
+}
+
+// TestWriteScriptMetadataProtection tests that metadata traffic is dropped
+// ahead of the policy chain unless its source is exempt
+func TestWriteScriptMetadataProtection(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.SetupMetadataProtection([]string{"169.254.0.0/16", "fd00:ec2::254"}, []string{"10.0.0.5"}); err != nil {
+		t.Fatalf("Failed to set up metadata protection: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"type filter hook forward priority -10; policy accept;",
+		"elements = { 169.254.0.0/16 }",
+		"elements = { fd00:ec2::254 }",
+		"meta nfproto ipv4 ip daddr @metadata ip saddr @metadata_exempt return\n\t\tmeta nfproto ipv4 ip daddr @metadata counter drop",
+		"meta nfproto ipv6 ip6 daddr @metadata6 counter drop",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	if drops, err := m.MetadataDrops(); err != nil || drops != 0 {
+		t.Errorf("Expected no drops, got %d (%v)", drops, err)
+	}
+}
+
+// TestWriteScriptRateLimits tests that new connections are limited per
+// source and globally ahead of the policy chain unless their source is
+// exempt
+func TestWriteScriptRateLimits(t *testing.T) {
+	m := NewScriptManager()
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	err := m.SetupRateLimits(RateLimits{
+		Global:    Rate{Count: 2000, Per: time.Second},
+		PerSource: Rate{Count: 30, Per: time.Minute},
+		Burst:     10,
+		Exempt:    []string{"10.0.5.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up rate limits: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"type filter hook forward priority -15; policy accept;",
+		"set rate_limit_sources {\n\t\ttype ipv4_addr\n\t\tflags dynamic,timeout\n\t\ttimeout 1m\n",
+		"meta nfproto ipv4 ip saddr @rate_limit_exempt return\n",
+		"ct state new meta nfproto ipv4 update @rate_limit_sources { ip saddr limit rate over 30/minute burst 10 packets } counter drop",
+		"ct state new meta nfproto ipv6 update @rate_limit_sources6 { ip6 saddr limit rate over 30/minute burst 10 packets } counter drop",
+		"ct state new limit rate over 2000/second burst 10 packets counter drop",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "rate_limit_exempt6") {
+		t.Errorf("Expected no IPv6 exempt set without IPv6 exempt sources:\n%s", b.String())
+	}
+	if drops, err := m.RateLimitDrops(); err != nil || drops != 0 {
+		t.Errorf("Expected no drops, got %d (%v)", drops, err)
+	}
+}
+
+func TestWriteScriptBan(t *testing.T) {
+	m := NewScriptManager()
+	m.SetBan(&Ban{Threshold: 20, Window: 10 * time.Minute, Duration: time.Hour, Exempt: []string{"10.0.9.0/24"}})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Ports: []string{"25"}}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"type filter hook forward priority -25; policy accept;",
+		"set banned {\n\t\ttype ipv4_addr\n\t\tflags dynamic,timeout\n\t\ttimeout 1h\n",
+		"meta nfproto ipv4 ip saddr @banned counter drop\n",
+		"meta nfproto ipv4 ip saddr != @ban_exempt update @ban_offenders { ip saddr limit rate over 2/minute burst 20 packets } add @banned { ip saddr }\n",
+		"counter goto ban_drop",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	// Unmatched packets don't count towards a ban
+	if n := strings.Count(b.String(), "goto ban_drop"); n != 1 {
+		t.Errorf("Expected only the deny rule to go to the ban chain, got %d:\n%s", n, b.String())
+	}
+
+	ip := net.ParseIP("192.0.2.7")
+	if err := m.RestoreBans([]BannedSource{{IP: ip, Expires: time.Minute}}); err != nil {
+		t.Fatalf("Failed to restore bans: %v", err)
+	}
+	banned, err := m.BannedSources()
+	if err != nil || len(banned) != 1 || !banned[0].IP.Equal(ip) {
+		t.Fatalf("Expected %s banned, got %v (%v)", ip, banned, err)
+	}
+	if err := m.Unban(ip); err != nil {
+		t.Fatalf("Failed to unban: %v", err)
+	}
+	if err := m.Unban(ip); err == nil {
+		t.Errorf("Expected unbanning a source not banned to fail")
+	}
+}
+
+func TestWriteScriptHoneypot(t *testing.T) {
+	m := NewScriptManager()
+	m.SetHoneypot(&Honeypot{Port: 8082, Targets: []string{"169.254.169.254"}, Ports: []string{"80"}, Exempt: []string{"10.0.9.0/24"}})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"type nat hook prerouting priority -100; policy accept;",
+		"set honeypot_targets {\n\t\ttype ipv4_addr\n\t\tflags interval\n",
+		"meta nfproto ipv4 ip saddr != @honeypot_exempt meta l4proto tcp th dport 80 ip daddr @honeypot_targets counter redirect to :8082\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	// No IPv6 targets, no IPv6 redirect
+	if strings.Contains(b.String(), "honeypot_targets6") {
+		t.Errorf("Expected no IPv6 honeypot set:\n%s", b.String())
+	}
+}
+
+func TestWriteScriptConnectionLog(t *testing.T) {
+	m := NewScriptManager()
+	m.SetConnectionLog(&ConnectionLog{Group: 100, Unmatched: true, DNS: true})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	for _, rule := range []Rule{
+		{Name: "web", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"443"}, LogConnections: true},
+		{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Ports: []string{"25"}, LogConnections: true},
+		{Name: "ssh", Action: "allow", Protocols: []string{"tcp"}, Ports: []string{"22"}},
+	} {
+		if err := m.AddRule(rule); err != nil {
+			t.Fatalf("Failed to add rule %s: %v", rule.Name, err)
+		}
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"policy accept;\n\t\tmeta l4proto udp th sport 53 log prefix \"dns\" group 100\n",
+		"jump egress_rules\n\t\tct state new log prefix \"deny\" group 100\n\t\tcounter drop",
+		"meta l4proto tcp th dport 443 ct state new log prefix \"allow web\" group 100\n\t\tmeta l4proto tcp th dport 443 counter accept",
+		"meta l4proto tcp th dport 25 ct state new log prefix \"deny smtp\" group 100\n\t\tmeta l4proto tcp th dport 25 counter drop",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), `"allow ssh"`) {
+		t.Errorf("Expected rule ssh not to be logged:\n%s", b.String())
+	}
+}
+
+// TestWriteScriptMasquerade tests that masquerading skips the excluded
+// destinations and applies only to the configured interfaces
+func TestWriteScriptMasquerade(t *testing.T) {
+	m := NewScriptManager()
+	m.SetMasquerade(&Masquerade{
+		Interfaces:          []string{"eth0", "wan0"},
+		ExcludeDestinations: []string{"10.0.0.0/8", "192.168.0.0/16", "fd00::/8"},
+	})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"elements = { 10.0.0.0/8, 192.168.0.0/16 }",
+		"policy accept;\n\t\tmeta nfproto ipv4 ip daddr @masquerade_exclude return\n\t\tmeta nfproto ipv6 ip6 daddr @masquerade_exclude6 return\n\t\toifname \"eth0\" masquerade\n\t\toifname \"wan0\" masquerade\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+// TestWriteScriptForwards tests port forwards and the masquerading of
+// hairpinned connections
+func TestWriteScriptForwards(t *testing.T) {
+	m := NewScriptManager()
+	m.SetMasquerade(&Masquerade{Interfaces: []string{"eth0"}})
+	m.SetForwards([]Forward{
+		{Protocol: "tcp", Port: 443, Interface: "eth0", To: net.ParseIP("10.0.0.5"), ToPort: 8443, Hairpin: true},
+		{Protocol: "udp", Port: 51820, Address: net.ParseIP("2001:db8::1"), Interface: "eth0", To: net.ParseIP("fd00::7"), ToPort: 51820},
+	})
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"type nat hook prerouting priority -100; policy accept;\n" +
+			"\t\tmeta nfproto ipv4 fib daddr type local meta l4proto tcp th dport 443 dnat ip to 10.0.0.5:8443\n" +
+			"\t\tiifname \"eth0\" meta nfproto ipv6 ip6 daddr 2001:db8::1 meta l4proto udp th dport 51820 dnat ip6 to [fd00::7]:51820\n",
+		"type nat hook postrouting priority 100; policy accept;\n" +
+			"\t\tiifname != \"eth0\" meta nfproto ipv4 ct status dnat ip daddr 10.0.0.5 meta l4proto tcp th dport 8443 masquerade\n" +
+			"\t\toifname \"eth0\" masquerade\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+// TestWriteScriptPortMappings tests that port mappings translate through
+// the timed map and that their targets are accepted
+func TestWriteScriptPortMappings(t *testing.T) {
+	m := NewScriptManager()
+	m.SetPortMappings("eth0")
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddPortMapping("udp", 3074, net.ParseIP("192.168.1.20"), 3075, time.Hour); err != nil {
+		t.Fatalf("Failed to add port mapping: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"map upnp {\n\t\ttype inet_proto . inet_service : ipv4_addr . inet_service\n\t\tflags timeout\n" +
+			"\t\telements = { udp . 3074 timeout 1h : 192.168.1.20 . 3075 }\n",
+		"set upnp_targets {\n\t\ttype ipv4_addr . inet_proto . inet_service\n\t\tflags timeout\n" +
+			"\t\telements = { 192.168.1.20 . udp . 3075 timeout 1h }\n",
+		"iifname \"eth0\" meta nfproto ipv4 fib daddr type local dnat ip to meta l4proto . th dport map @upnp\n",
+		"meta nfproto ipv4 ct status dnat ip daddr . meta l4proto . th dport @upnp_targets accept\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+
+	if err := m.DeletePortMapping("udp", 3074, net.ParseIP("192.168.1.20"), 3075); err != nil {
+		t.Fatalf("Failed to delete port mapping: %v", err)
+	}
+	b.Reset()
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	if strings.Contains(b.String(), "192.168.1.20") {
+		t.Errorf("Expected the mapping to be deleted:\n%s", b.String())
+	}
+}
+
+// TestWriteScriptBlockPage tests that denies record HTTP connections for
+// the redirect to the block page, and that a grant clears them
+func TestWriteScriptBlockPage(t *testing.T) {
+	m := NewScriptManager()
+	m.SetBlockPage(8081)
+	if err := m.Setup(); err != nil {
+		t.Fatalf("Failed to set up: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "smtp", Action: "deny", Protocols: []string{"tcp"}, Ports: []string{"25"}, DenyBehavior: DenyReject}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+
+	var b strings.Builder
+	if err := m.WriteScript(&b); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	for _, want := range []string{
+		"set blockpage {\n\t\ttype ipv4_addr . ipv4_addr\n\t\tflags dynamic,timeout\n\t\ttimeout 1m\n",
+		"meta nfproto ipv4 meta l4proto tcp th dport 80 ip saddr . ip daddr @blockpage redirect to :8081\n",
+		"meta nfproto ipv6 meta l4proto tcp th dport 80 ip6 saddr . ip6 daddr @blockpage6 redirect to :8081\n",
+		"counter goto blockpage_drop\n",
+		"chain blockpage_reject {\n" +
+			"\t\tmeta nfproto ipv4 meta l4proto tcp th dport 80 update @blockpage { ip saddr . ip daddr } drop\n" +
+			"\t\tmeta nfproto ipv6 meta l4proto tcp th dport 80 update @blockpage6 { ip6 saddr . ip6 daddr } drop\n" +
+			"\t\treject with icmpx type port-unreachable\n",
+		"meta l4proto tcp th dport 25 counter goto blockpage_reject",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+		}
+	}
+
+	// The kernel adds the elements; stand in for it
+	c := m.conn.(*scriptConn)
+	key := append(net.ParseIP("10.0.0.2").To4(), net.ParseIP("192.0.2.1").To4()...)
+	if err := c.SetAddElements(m.blockPageSets.v4, []nftables.SetElement{{Key: key}}); err != nil {
+		t.Fatalf("Failed to add element: %v", err)
+	}
+	if err := m.AddGrant(nil, net.ParseIP("192.0.2.1"), 80, time.Hour); err != nil {
+		t.Fatalf("Failed to add grant: %v", err)
+	}
+	if set := c.set(m.blockPageSets.v4); len(set.elements) != 0 {
+		t.Errorf("Expected the grant to clear the block page set, got %d elements", len(set.elements))
+	}
+}
+
+// TestWriteScriptCanary tests that the running and canary tables split the
+// sources between them, and that a log-only canary never drops
+func TestWriteScriptCanary(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts []Option
+		want []string
+		skip []string
+	}{
+		{
+			name: "running",
+			want: []string{
+				"table inet legion_filter {",
+				"meta nfproto ipv4 jhash ip saddr mod 100 seed 0x6c656769 { 0, 1, 2, 3, 4 } accept",
+				"ip daddr @ips_internal counter drop",
+				"counter drop",
+				"masquerade",
+			},
+		},
+		{
+			name: "canary",
+			opts: []Option{Canary(false)},
+			want: []string{
+				"table inet legion_canary {",
+				"meta nfproto ipv6 jhash ip6 saddr mod 100 seed 0x6c656769 { 5, 6, 7,",
+				"ip daddr @ips_internal counter drop",
+				"counter drop",
+			},
+			skip: []string{"masquerade", "{ 0, 1"},
+		},
+		{
+			name: "log only",
+			opts: []Option{Canary(true)},
+			want: []string{
+				`ip daddr @ips_internal counter log prefix "legion-canary deny: " accept`,
+				`counter log prefix "legion-canary deny: " accept`,
+			},
+			skip: []string{"drop", "jhash"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewScriptManager(tc.opts...)
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Failed to set up: %v", err)
+			}
+			if err := m.AddRule(Rule{Name: "internal", Action: "deny", IPs: []string{"10.0.0.0/8"}}); err != nil {
+				t.Fatalf("Failed to add rule: %v", err)
+			}
+			if !m.logOnly {
+				if err := m.SplitSources(5); err != nil {
+					t.Fatalf("Failed to split sources: %v", err)
+				}
+			}
+
+			var b strings.Builder
+			if err := m.WriteScript(&b); err != nil {
+				t.Fatalf("Failed to write script: %v", err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("Expected script to contain %q:\n%s", want, b.String())
+				}
+			}
+			for _, skip := range tc.skip {
+				if strings.Contains(b.String(), skip) {
+					t.Errorf("Expected script not to contain %q:\n%s", skip, b.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package nftables
+
+import (
+	"github.com/google/nftables/expr"
+)
+
+// matchesTTL reports whether a rule matches the TTL or hop limit of
+// packets, which is matched per family
+func (r Rule) matchesTTL() bool {
+	return r.TTLLessThan != 0 || r.TTLEqual != 0
+}
+
+// ttlExpressions returns the expressions matching the IPv4 TTL or IPv6 hop
+// limit of a rule of family, as `ip ttl < 2` or `ip6 hoplimit 64`; nothing
+// unless the rule matches them
+func ttlExpressions(rule Rule, family addrFamily) []expr.Any {
+	if !rule.matchesTTL() || family.nfproto == 0 {
+		return nil
+	}
+	op, value := expr.CmpOpEq, rule.TTLEqual
+	if rule.TTLLessThan != 0 {
+		op, value = expr.CmpOpLt, rule.TTLLessThan
+	}
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       family.ttlOffset,
+			Len:          1,
+		},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte{value}},
+	}
+}
@@ -0,0 +1,186 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mappingMapName = "upnp"         // protocol . external port -> internal address . port
+	mappingSetName = "upnp_targets" // internal address . protocol . port
+)
+
+// SetPortMappings enables the port mappings of UPnP and NAT-PMP clients in
+// the next Setup, forwarding connections that arrive on iface; "" disables
+// them
+func (m *Manager) SetPortMappings(iface string) {
+	m.mappingInterface = iface
+}
+
+// setupPortMappings creates the timed map translating the destination of
+// mapped connections and the set of their targets, which are accepted ahead
+// of every policy rule. Only the running table translates; a canary table
+// accepts the connections it translated.
+func (m *Manager) setupPortMappings(prerouting *nftables.Chain) error {
+	if m.mappingInterface == "" {
+		return nil
+	}
+	targets := &nftables.Set{
+		Table:         m.table,
+		Name:          mappingSetName,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService),
+		Concatenation: true,
+		HasTimeout:    true,
+	}
+	if err := m.conn.AddSet(targets, nil); err != nil {
+		return fmt.Errorf("failed to create port mapping set: %w", err)
+	}
+	m.mappingTargets = targets
+	if !m.carries(familyIPv4) {
+		return nil
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+	}
+	exprs = append(exprs, dnatExpressions()...)
+	exprs = append(exprs,
+		// Address, protocol and port are concatenated in adjacent registers
+		// for the lookup
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       familyIPv4.daddrOffset,
+			Len:          familyIPv4.addrLen,
+		},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 9},
+		&expr.Payload{
+			DestRegister: 10,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // Destination port offset
+			Len:          2, // Port length
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: targets.Name, SetID: targets.ID},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+	m.conn.InsertRule(&nftables.Rule{Table: m.table, Chain: m.chain, Exprs: exprs})
+
+	if prerouting == nil {
+		return nil
+	}
+	mappings := &nftables.Set{
+		Table:         m.table,
+		Name:          mappingMapName,
+		IsMap:         true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService),
+		DataType:      nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService),
+		Concatenation: true,
+		HasTimeout:    true,
+	}
+	if err := m.conn.AddSet(mappings, nil); err != nil {
+		return fmt.Errorf("failed to create port mapping map: %w", err)
+	}
+	m.mappings = mappings
+
+	exprs = interfaceExpressions(m.mappingInterface)
+	exprs = append(exprs,
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Payload{
+			DestRegister: 9,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // Destination port offset
+			Len:          2, // Port length
+		},
+		// The address and port looked up land in the registers the NAT
+		// reads
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        mappings.Name,
+			SetID:          mappings.ID,
+			DestRegister:   1,
+			IsDestRegSet:   true,
+		},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 9,
+		},
+	)
+	m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: prerouting, Exprs: exprs})
+	return nil
+}
+
+// AddPortMapping forwards connections of protocol to port of the external
+// interface to an internal address and port until ttl elapses. The kernel
+// removes the mapping when it expires; an existing one must be deleted first
+// to change its timeout.
+func (m *Manager) AddPortMapping(protocol string, port uint16, to net.IP, toPort uint16, ttl time.Duration) error {
+	key, target, value, err := m.mappingElements(protocol, port, to, toPort)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.SetAddElements(m.mappingTargets, []nftables.SetElement{{Key: target, Timeout: ttl}}); err != nil {
+		return fmt.Errorf("failed to add port mapping: %w", err)
+	}
+	if m.mappings != nil {
+		if err := m.conn.SetAddElements(m.mappings, []nftables.SetElement{{Key: key, Val: value, Timeout: ttl}}); err != nil {
+			return fmt.Errorf("failed to add port mapping: %w", err)
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add port mapping: %w", err)
+	}
+	return nil
+}
+
+// DeletePortMapping removes a port mapping before it expires
+func (m *Manager) DeletePortMapping(protocol string, port uint16, to net.IP, toPort uint16) error {
+	key, target, _, err := m.mappingElements(protocol, port, to, toPort)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.SetDeleteElements(m.mappingTargets, []nftables.SetElement{{Key: target}}); err != nil {
+		return fmt.Errorf("failed to delete port mapping: %w", err)
+	}
+	if m.mappings != nil {
+		if err := m.conn.SetDeleteElements(m.mappings, []nftables.SetElement{{Key: key}}); err != nil {
+			return fmt.Errorf("failed to delete port mapping: %w", err)
+		}
+	}
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete port mapping: %w", err)
+	}
+	return nil
+}
+
+// mappingElements returns the map key and value and the target set key of
+// a port mapping
+func (m *Manager) mappingElements(protocol string, port uint16, to net.IP, toPort uint16) (key, target, value []byte, err error) {
+	if m.mappingTargets == nil {
+		return nil, nil, nil, fmt.Errorf("port mappings are not set up")
+	}
+	proto := protocolToNum(protocol)
+	if proto != unix.IPPROTO_TCP && proto != unix.IPPROTO_UDP {
+		return nil, nil, nil, fmt.Errorf("invalid port mapping protocol: %s", protocol)
+	}
+	v4 := to.To4()
+	if v4 == nil {
+		return nil, nil, nil, fmt.Errorf("invalid IPv4 address: %s", to)
+	}
+	key = []byte{proto, 0, 0, 0, byte(port >> 8), byte(port & 0xff), 0, 0}
+	value = grantKey(v4, toPort)
+	target = append(append([]byte(nil), v4...), proto, 0, 0, 0, byte(toPort>>8), byte(toPort&0xff), 0, 0)
+	return key, target, value, nil
+}
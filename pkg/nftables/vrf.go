@@ -0,0 +1,88 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	vrfChainNameFmt  = "egress_vrf_%s" // Per-VRF rule chains
+	ruleChainNameFmt = "rule_%s"       // Per-rule chains
+)
+
+// vrfChain returns the chain holding the rules of a VRF, creating it on
+// first use. Traffic whose input device is the VRF jumps to the chain ahead
+// of the shared rules; traffic the VRF's rules don't decide returns to the
+// shared chain.
+func (m *Manager) vrfChain(vrf string) *nftables.Chain {
+	if chain, ok := m.vrfChains[vrf]; ok {
+		return chain
+	}
+
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:  vrfChainName(vrf),
+		Table: m.table,
+	})
+	m.conn.InsertRule(&nftables.Rule{
+		Table: m.table,
+		Chain: m.chain,
+		Exprs: append(interfaceExpressions(vrf),
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name},
+		),
+	})
+	m.vrfChains[vrf] = chain
+	return chain
+}
+
+// subChain returns the chain holding a rule's rules, creating it on first
+// use with a jump to it from the chain the rule is placed in. Traffic the
+// rule doesn't decide returns to that chain for the next rule.
+func (m *Manager) subChain(rule Rule) (*nftables.Chain, error) {
+	if chain, ok := m.ruleChains[rule.Name]; ok {
+		return chain, nil
+	}
+	parent, err := m.ruleChain(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := m.conn.AddChain(&nftables.Chain{
+		Name:  fmt.Sprintf(ruleChainNameFmt, sanitizeName(rule.Name)),
+		Table: m.table,
+	})
+	m.conn.AddRule(&nftables.Rule{
+		Table:    m.table,
+		Chain:    parent,
+		Exprs:    []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name}},
+		UserData: commentUserData(rule.Comment),
+	})
+	m.track(parent, rule.Name)
+	if m.ruleChains == nil {
+		m.ruleChains = make(map[string]*nftables.Chain)
+	}
+	m.ruleChains[rule.Name] = chain
+	return chain, nil
+}
+
+// ruleChain returns the chain a rule is placed in
+func (m *Manager) ruleChain(rule Rule) (*nftables.Chain, error) {
+	switch {
+	case rule.VRF != "":
+		return m.vrfChain(rule.VRF), nil
+	case rule.Profile != "":
+		p, err := m.profile(rule.Profile)
+		if err != nil {
+			return nil, err
+		}
+		return p.chain, nil
+	default:
+		return m.rules, nil
+	}
+}
+
+// vrfChainName returns the name of a VRF's chain
+func vrfChainName(vrf string) string {
+	return fmt.Sprintf(vrfChainNameFmt, sanitizeName(vrf))
+}
@@ -0,0 +1,120 @@
+// Package policy compiles a policy's matchers into an in-memory index, so
+// that decisions taken in userspace, such as for connections queued for
+// inspection, don't scan every rule
+package policy
+
+import (
+	"net"
+	"sort"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+// Index finds the rules of a policy matching a connection: a trie of IP
+// prefixes for destination addresses, a trie of labels for domains, and
+// interval sets for ports. Rules are identified by their position in the
+// policy, and lookups return them in policy order.
+type Index struct {
+	ips      ipTrie
+	domains  domainTrie
+	ports    []PortSet
+	notPorts []PortSet // Empty for rules excluding no ports
+}
+
+// New compiles the matchers of rules. Addresses that aren't literal, such
+// as IP groups, and ports that don't parse are left out; the kernel
+// ruleset holds the complete sets. Compound rules match the domains of all
+// their branches, and only the ports and addresses the branches share, so
+// callers check which branch matches.
+func New(rules []config.Rule) *Index {
+	x := &Index{ports: make([]PortSet, len(rules)), notPorts: make([]PortSet, len(rules))}
+	for i, rule := range rules {
+		for _, ip := range rule.Egress.IPs {
+			x.ips.insert(ip, i)
+		}
+		for _, domain := range rule.Egress.AllDomains() {
+			x.domains.insert(domain, i)
+		}
+		x.ports[i] = NewPortSet(rule.Egress.Ports)
+		if len(rule.Egress.NotPorts) > 0 {
+			x.notPorts[i] = NewPortSet(rule.Egress.NotPorts)
+		}
+	}
+	return x
+}
+
+// MatchIP returns the rules with a literal destination containing ip
+func (x *Index) MatchIP(ip net.IP) []int {
+	return x.ips.lookup(ip)
+}
+
+// MatchDomain returns the rules with a domain or wildcard matching name
+func (x *Index) MatchDomain(name string) []int {
+	return x.domains.lookup(name)
+}
+
+// PortMatches reports whether port is one of a rule's ports; a rule
+// without ports matches every port
+func (x *Index) PortMatches(rule int, port uint16) bool {
+	if rule < 0 || rule >= len(x.ports) {
+		return false
+	}
+	return x.ports[rule].Contains(port)
+}
+
+// PortExcluded reports whether port is one of the ports a rule excludes
+func (x *Index) PortExcluded(rule int, port uint16) bool {
+	if rule < 0 || rule >= len(x.notPorts) {
+		return false
+	}
+	return x.notPorts[rule].Contains(port)
+}
+
+// PortSet is a set of ports as sorted, disjoint intervals
+type PortSet struct {
+	starts, ends []uint16
+	all          bool // No ports were given
+}
+
+// NewPortSet builds the set of egress ports, single ports or ranges such as
+// 8000-9000; no ports match every port. Ports that don't parse are left
+// out, so ports that all fail to parse match none.
+func NewPortSet(ports []string) PortSet {
+	if len(ports) == 0 {
+		return PortSet{all: true}
+	}
+	type interval struct{ start, end uint16 }
+	var intervals []interval
+	for _, p := range ports {
+		start, end, err := config.ParsePortRange(p)
+		if err != nil {
+			continue
+		}
+		intervals = append(intervals, interval{start, end})
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start < intervals[j].start })
+
+	var s PortSet
+	for _, iv := range intervals {
+		n := len(s.ends)
+		if n > 0 && uint32(iv.start) <= uint32(s.ends[n-1])+1 {
+			if iv.end > s.ends[n-1] {
+				s.ends[n-1] = iv.end
+			}
+			continue
+		}
+		s.starts = append(s.starts, iv.start)
+		s.ends = append(s.ends, iv.end)
+	}
+	return s
+}
+
+// Contains reports whether port is in the set
+func (s PortSet) Contains(port uint16) bool {
+	if s.all {
+		return true
+	}
+	// The last interval starting at or below port
+	i := sort.Search(len(s.starts), func(i int) bool { return s.starts[i] > port }) - 1
+	return i >= 0 && port <= s.ends[i]
+}
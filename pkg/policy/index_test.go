@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/skaegi/legion-router/pkg/config"
+)
+
+var testRules = []config.Rule{
+	{Name: "internal", Egress: config.Egress{IPs: []string{"10.0.0.0/8", "fd00::/8"}}},
+	{Name: "host", Egress: config.Egress{IPs: []string{"10.1.2.3", "::ffff:192.0.2.0/120"}, Ports: []string{"443", "8000-8080", "8081"}}},
+	{Name: "github", Egress: config.Egress{Domains: []string{"*.github.com", "github.com"}}},
+	{Name: "api", Egress: config.Egress{Domains: []string{"API.GitHub.com."}, Ports: []string{"443x"}}},
+	{Name: "any", Egress: config.Egress{IPs: []string{"0.0.0.0/0", "@aws"}}},
+	{Name: "low", Egress: config.Egress{Ports: []string{"1-1024"}, NotPorts: []string{"25", "135-139"}}},
+}
+
+// TestMatchIP tests finding the rules whose destinations contain an address
+func TestMatchIP(t *testing.T) {
+	x := New(testRules)
+	testCases := []struct {
+		ip   string
+		want []int
+	}{
+		{"10.1.2.3", []int{0, 1, 4}},
+		{"10.1.2.4", []int{0, 4}},
+		{"192.0.2.77", []int{1, 4}},
+		{"198.51.100.1", []int{4}},
+		{"fd00::1", []int{0}},
+		{"2001:db8::1", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			if got := x.MatchIP(net.ParseIP(tc.ip)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestMatchDomain tests finding the rules whose domains match a name, as
+// MatchWildcard does
+func TestMatchDomain(t *testing.T) {
+	x := New(testRules)
+	testCases := []struct {
+		name string
+		want []int
+	}{
+		{"github.com", []int{2}},
+		{"api.github.com", []int{2, 3}},
+		{"API.github.com.", []int{2, 3}},
+		{"codeload.eu.github.com", []int{2}},
+		{"notgithub.com", nil},
+		{"com", nil},
+		{"", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := x.MatchDomain(tc.name); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestPortMatches tests port interval sets
+func TestPortMatches(t *testing.T) {
+	x := New(testRules)
+	testCases := []struct {
+		rule int
+		port uint16
+		want bool
+	}{
+		{rule: 0, port: 22, want: true},
+		{rule: 1, port: 443, want: true},
+		{rule: 1, port: 444},
+		{rule: 1, port: 8000, want: true},
+		{rule: 1, port: 8081, want: true},
+		{rule: 1, port: 8082},
+		{rule: 1, port: 80},
+		{rule: 3, port: 443},
+		{rule: 9, port: 443},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d/%d", tc.rule, tc.port), func(t *testing.T) {
+			if got := x.PortMatches(tc.rule, tc.port); got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestPortExcluded tests finding the ports a rule excludes
+func TestPortExcluded(t *testing.T) {
+	x := New(testRules)
+	testCases := []struct {
+		rule int
+		port uint16
+		want bool
+	}{
+		{rule: 5, port: 25, want: true},
+		{rule: 5, port: 137, want: true},
+		{rule: 5, port: 443},
+		{rule: 0, port: 25},
+		{rule: 9, port: 25},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d/%d", tc.rule, tc.port), func(t *testing.T) {
+			if got := x.PortExcluded(tc.rule, tc.port); got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// benchmarkRules returns a policy of n rules with an address, a domain and
+// ports each
+func benchmarkRules(n int) []config.Rule {
+	rules := make([]config.Rule, n)
+	for i := range rules {
+		rules[i] = config.Rule{
+			Name: fmt.Sprintf("rule-%d", i),
+			Egress: config.Egress{
+				IPs:     []string{fmt.Sprintf("10.%d.%d.0/24", i/256%256, i%256)},
+				Domains: []string{fmt.Sprintf("*.service-%d.example.com", i)},
+				Ports:   []string{"443", fmt.Sprintf("%d-%d", 10000+i, 10010+i)},
+			},
+		}
+	}
+	return rules
+}
+
+func BenchmarkMatchIP(b *testing.B) {
+	x := New(benchmarkRules(10000))
+	ip := net.ParseIP("10.39.15.7").To4()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.MatchIP(ip)
+	}
+}
+
+func BenchmarkMatchDomain(b *testing.B) {
+	x := New(benchmarkRules(10000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.MatchDomain("api.service-9999.example.com")
+	}
+}
+
+func BenchmarkPortMatches(b *testing.B) {
+	x := New(benchmarkRules(10000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.PortMatches(9999, 20005)
+	}
+}
@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipTrie is a binary trie of address prefixes, one per family, finding
+// every prefix containing an address in one walk of its bits
+type ipTrie struct {
+	v4, v6 *ipNode
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	values   []int
+}
+
+// insert adds value under the prefix of a CIDR or a single address, and
+// reports whether s parsed
+func (t *ipTrie) insert(s string, value int) bool {
+	var ip net.IP
+	var bits int
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		ip = ipNet.IP
+		ones, size := ipNet.Mask.Size()
+		// IPv4-mapped IPv6 networks have a 16 byte mask for 4 byte addresses
+		bits = ones - (size - 8*len(family(ip)))
+	} else if ip = net.ParseIP(s); ip != nil {
+		bits = 8 * len(family(ip))
+	} else {
+		return false
+	}
+
+	ip = family(ip)
+	root := &t.v6
+	if len(ip) == net.IPv4len {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &ipNode{}
+	}
+	n := *root
+	for i := 0; i < bits; i++ {
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &ipNode{}
+		}
+		n = n.children[b]
+	}
+	n.values = append(n.values, value)
+	return true
+}
+
+// lookup returns the values of every prefix containing ip, ascending
+func (t *ipTrie) lookup(ip net.IP) []int {
+	ip = family(ip)
+	n := t.v6
+	if len(ip) == net.IPv4len {
+		n = t.v4
+	}
+	var values []int
+	for i := 0; n != nil; i++ {
+		values = append(values, n.values...)
+		if i == 8*len(ip) {
+			break
+		}
+		n = n.children[bit(ip, i)]
+	}
+	return sortedUnique(values)
+}
+
+// family returns ip as 4 bytes if it is an IPv4 address, else 16
+func family(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// bit returns bit i of ip, counting from the most significant
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-i%8)) & 1
+}
+
+// domainTrie is a trie of domain labels from the top level down, holding
+// exact names and *.suffix wildcards, which match the suffix and every name
+// below it
+type domainTrie struct {
+	root domainNode
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	exact    []int
+	wildcard []int
+}
+
+// insert adds value under a domain pattern
+func (t *domainTrie) insert(pattern string, value int) {
+	pattern = normalizeDomain(pattern)
+	wildcard := strings.HasPrefix(pattern, "*.")
+	if wildcard {
+		pattern = pattern[2:]
+	}
+
+	n := &t.root
+	for _, label := range reversedLabels(pattern) {
+		child, ok := n.children[label]
+		if !ok {
+			child = &domainNode{}
+			if n.children == nil {
+				n.children = make(map[string]*domainNode)
+			}
+			n.children[label] = child
+		}
+		n = child
+	}
+	if wildcard {
+		n.wildcard = append(n.wildcard, value)
+	} else {
+		n.exact = append(n.exact, value)
+	}
+}
+
+// lookup returns the values of every pattern matching name, ascending
+func (t *domainTrie) lookup(name string) []int {
+	var values []int
+	n := &t.root
+	for _, label := range reversedLabels(normalizeDomain(name)) {
+		if n = n.children[label]; n == nil {
+			return sortedUnique(values)
+		}
+		values = append(values, n.wildcard...)
+	}
+	return sortedUnique(append(values, n.exact...))
+}
+
+// normalizeDomain lowercases a name and drops its trailing dot
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// reversedLabels splits a name into its labels, top level first
+func reversedLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// sortedUnique sorts values and drops duplicates, in place
+func sortedUnique(values []int) []int {
+	if len(values) < 2 {
+		return values
+	}
+	sort.Ints(values)
+	unique := values[:1]
+	for _, v := range values[1:] {
+		if v != unique[len(unique)-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
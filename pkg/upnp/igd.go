@@ -0,0 +1,471 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/skaegi/legion-router/pkg/version"
+)
+
+const (
+	ssdpGroup = "239.255.255.250:1900"
+
+	deviceType     = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	wanIPService   = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	descriptionURL = "/rootDesc.xml"
+	serviceURL     = "/WANIPCn.xml"
+	controlURL     = "/ctl/IPConn"
+)
+
+// searchTargets are the M-SEARCH targets answered, with the target replied
+var searchTargets = map[string]string{
+	"ssdp:all":        deviceType,
+	"upnp:rootdevice": "upnp:rootdevice",
+	deviceType:        deviceType,
+	"urn:schemas-upnp-org:device:WANDevice:1":           "urn:schemas-upnp-org:device:WANDevice:1",
+	"urn:schemas-upnp-org:device:WANConnectionDevice:1": "urn:schemas-upnp-org:device:WANConnectionDevice:1",
+	wanIPService: wanIPService,
+}
+
+// startIGD serves the device description and control URL on each internal
+// interface and answers SSDP searches
+// Must be called with mu held
+func (s *Server) startIGD() error {
+	group, err := net.ResolveUDPAddr("udp4", ssdpGroup)
+	if err != nil {
+		return err
+	}
+	s.http = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	for _, iface := range s.interfaces {
+		listener, err := net.Listen("tcp4", net.JoinHostPort(iface.network.IP.String(), "0"))
+		if err != nil {
+			return fmt.Errorf("failed to serve UPnP on %s: %w", iface.name, err)
+		}
+		iface.location = fmt.Sprintf("http://%s%s", listener.Addr(), descriptionURL)
+		go s.http.Serve(listener)
+
+		netIface, err := net.InterfaceByName(iface.name)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s: %w", iface.name, err)
+		}
+		conn, err := net.ListenMulticastUDP("udp4", netIface, group)
+		if err != nil {
+			return fmt.Errorf("failed to listen for SSDP on %s: %w", iface.name, err)
+		}
+		s.conns = append(s.conns, conn)
+		go s.receiveSSDP(conn, iface)
+	}
+	return nil
+}
+
+// receiveSSDP answers the searches from the subnet of iface arriving on conn
+// until it is closed. Every socket joined to the group may receive searches
+// from any interface; each answers those of its own.
+func (s *Server) receiveSSDP(conn *net.UDPConn, iface *internalInterface) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !iface.network.Contains(addr.IP) {
+			continue
+		}
+		if resp := s.searchResponse(buf[:n], iface.location); resp != nil {
+			conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// searchResponse returns the response to an M-SEARCH for the gateway, nil
+// for other messages
+func (s *Server) searchResponse(msg []byte, location string) []byte {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+		return nil
+	}
+	target, ok := searchTargets[req.Header.Get("St")]
+	if !ok {
+		return nil
+	}
+	usn := "uuid:" + s.uuid + "::" + target
+	return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+		"CACHE-CONTROL: max-age=1800\r\n"+
+		"EXT:\r\n"+
+		"LOCATION: %s\r\n"+
+		"SERVER: Linux UPnP/1.1 legion-router/%s\r\n"+
+		"ST: %s\r\n"+
+		"USN: %s\r\n\r\n", location, version.Version, target, usn))
+}
+
+// Handler returns the HTTP handler of the device description and control
+// URL
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(descriptionURL, s.handleDescription)
+	mux.HandleFunc(serviceURL, handleServiceDescription)
+	mux.HandleFunc(controlURL, s.handleControl)
+	return mux
+}
+
+// handleDescription serves the device description
+func (s *Server) handleDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, deviceDescription, s.uuid)
+}
+
+// handleServiceDescription serves the description of the WANIPConnection
+// service, listing the actions implemented
+func handleServiceDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, serviceDescription)
+}
+
+// soapArgs are the arguments of a SOAP action by name
+type soapArgs map[string]string
+
+// soapEnvelope decodes the arguments of an action
+type soapEnvelope struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// soapError is a UPnP error returned as a SOAP fault
+type soapError struct {
+	code        int
+	description string
+}
+
+// UPnP errors of the WANIPConnection service
+var (
+	errInvalidArgs       = soapError{402, "Invalid Args"}
+	errActionFailed      = soapError{501, "Action Failed"}
+	errNotAuthorized     = soapError{606, "Action not authorized"}
+	errInvalidIndex      = soapError{713, "SpecifiedArrayIndexInvalid"}
+	errNoSuchEntry       = soapError{714, "NoSuchEntryInArray"}
+	errWildcardExtPort   = soapError{716, "WildCardNotPermittedInExtPort"}
+	errConflict          = soapError{718, "ConflictInMappingEntry"}
+	errWildcardOnly      = soapError{726, "RemoteHostOnlySupportsWildcard"}
+	errInvalidActionName = soapError{401, "Invalid Action"}
+)
+
+// handleControl runs a SOAP action of the WANIPConnection service
+func (s *Server) handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	client := net.ParseIP(host).To4()
+	if err != nil || client == nil {
+		http.Error(w, "IPv4 clients only", http.StatusForbidden)
+		return
+	}
+	var envelope soapEnvelope
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&envelope); err != nil {
+		writeSOAPError(w, errInvalidArgs)
+		return
+	}
+	action := envelope.Body.Action.XMLName.Local
+	args := soapArgs{}
+	for _, arg := range envelope.Body.Action.Args {
+		args[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+
+	result, serr := s.runAction(action, client, args)
+	if serr != nil {
+		writeSOAPError(w, *serr)
+		return
+	}
+	var body strings.Builder
+	for _, arg := range result {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arg[0], html.EscapeString(arg[1]), arg[0])
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, wanIPService, body.String(), action)
+}
+
+// runAction runs a SOAP action for client, returning its output arguments
+// in order
+func (s *Server) runAction(action string, client net.IP, args soapArgs) ([][2]string, *soapError) {
+	switch action {
+	case "GetExternalIPAddress":
+		ip, err := s.externalAddress()
+		if err != nil {
+			return nil, &errActionFailed
+		}
+		return [][2]string{{"NewExternalIPAddress", ip.String()}}, nil
+	case "GetStatusInfo":
+		uptime := strconv.Itoa(int(time.Since(s.started) / time.Second))
+		return [][2]string{{"NewConnectionStatus", "Connected"}, {"NewLastConnectionError", "ERROR_NONE"}, {"NewUptime", uptime}}, nil
+	case "GetConnectionTypeInfo":
+		return [][2]string{{"NewConnectionType", "IP_Routed"}, {"NewPossibleConnectionTypes", "IP_Routed"}}, nil
+	case "AddPortMapping":
+		return nil, s.addPortMapping(client, args)
+	case "DeletePortMapping":
+		protocol, externalPort, serr := mappingKey(args)
+		if serr != nil {
+			return nil, serr
+		}
+		if err := s.deleteMapping("UPnP", client, protocol, externalPort); err != nil {
+			return nil, &errNoSuchEntry
+		}
+		return nil, nil
+	case "GetSpecificPortMappingEntry":
+		protocol, externalPort, serr := mappingKey(args)
+		if serr != nil {
+			return nil, serr
+		}
+		for _, mapping := range s.backend.PortMappings() {
+			if mapping.Protocol == protocol && mapping.ExternalPort == externalPort {
+				return mappingEntry(mapping)[3:], nil
+			}
+		}
+		return nil, &errNoSuchEntry
+	case "GetGenericPortMappingEntry":
+		index, err := strconv.Atoi(args["NewPortMappingIndex"])
+		mappings := s.backend.PortMappings()
+		if err != nil || index < 0 || index >= len(mappings) {
+			return nil, &errInvalidIndex
+		}
+		return mappingEntry(mappings[index]), nil
+	default:
+		return nil, &errInvalidActionName
+	}
+}
+
+// addPortMapping runs AddPortMapping: clients may only map ports to
+// themselves, for any remote host
+func (s *Server) addPortMapping(client net.IP, args soapArgs) *soapError {
+	protocol, externalPort, serr := mappingKey(args)
+	if serr != nil {
+		return serr
+	}
+	if args["NewRemoteHost"] != "" {
+		return &errWildcardOnly
+	}
+	internalPort, err := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+	if err != nil || internalPort == 0 {
+		return &errInvalidArgs
+	}
+	if !client.Equal(net.ParseIP(args["NewInternalClient"])) {
+		return &errNotAuthorized
+	}
+	lease, err := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+	if err != nil {
+		return &errInvalidArgs
+	}
+	if enabled := args["NewEnabled"]; enabled == "0" || enabled == "false" {
+		// A disabled mapping forwards nothing
+		s.deleteMapping("UPnP", client, protocol, externalPort)
+		return nil
+	}
+
+	_, err = s.addMapping("UPnP", client, protocol, externalPort, uint16(internalPort),
+		time.Duration(lease)*time.Second, args["NewPortMappingDescription"])
+	switch {
+	case errors.Is(err, filter.ErrPortMappingRefused):
+		return &errNotAuthorized
+	case errors.Is(err, filter.ErrPortMappingConflict):
+		return &errConflict
+	case err != nil:
+		return &errActionFailed
+	}
+	return nil
+}
+
+// mappingKey returns the protocol and external port of a mapping action
+func mappingKey(args soapArgs) (string, uint16, *soapError) {
+	protocol := strings.ToLower(args["NewProtocol"])
+	if protocol != "tcp" && protocol != "udp" {
+		return "", 0, &errInvalidArgs
+	}
+	port, err := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+	if err != nil {
+		return "", 0, &errInvalidArgs
+	}
+	if port == 0 {
+		return "", 0, &errWildcardExtPort
+	}
+	return protocol, uint16(port), nil
+}
+
+// mappingEntry returns the arguments describing a mapping in
+// GetGenericPortMappingEntry
+func mappingEntry(mapping filter.PortMapping) [][2]string {
+	lease := time.Until(mapping.Expires).Round(time.Second) / time.Second
+	return [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(mapping.ExternalPort))},
+		{"NewProtocol", strings.ToUpper(mapping.Protocol)},
+		{"NewInternalPort", strconv.Itoa(int(mapping.InternalPort))},
+		{"NewInternalClient", mapping.Internal},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", mapping.Description},
+		{"NewLeaseDuration", strconv.Itoa(int(lease))},
+	}
+}
+
+// writeSOAPError writes a UPnP error as a SOAP fault
+func writeSOAPError(w http.ResponseWriter, serr soapError) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, serr.code, serr.description)
+}
+
+// newUUID returns a random UUID identifying the device until restart
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Warning: failed to generate the UPnP device UUID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// deviceDescription is the IGD device tree down to the WANIPConnection
+// service, formatted with the device UUID
+const deviceDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>Legion Router</friendlyName>
+<manufacturer>Legion Router</manufacturer>
+<modelName>legion-router</modelName>
+<UDN>uuid:%[1]s</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<friendlyName>WAN Device</friendlyName>
+<manufacturer>Legion Router</manufacturer>
+<modelName>legion-router</modelName>
+<UDN>uuid:%[1]s-wan</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<friendlyName>WAN Connection Device</friendlyName>
+<manufacturer>Legion Router</manufacturer>
+<modelName>legion-router</modelName>
+<UDN>uuid:%[1]s-conn</UDN>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<SCPDURL>/WANIPCn.xml</SCPDURL>
+<controlURL>/ctl/IPConn</controlURL>
+<eventSubURL>/evt/IPConn</eventSubURL>
+</service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>
+`
+
+// serviceDescription lists the WANIPConnection actions implemented
+const serviceDescription = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetExternalIPAddress</name><argumentList>
+<argument><name>NewExternalIPAddress</name><direction>out</direction><relatedStateVariable>ExternalIPAddress</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetStatusInfo</name><argumentList>
+<argument><name>NewConnectionStatus</name><direction>out</direction><relatedStateVariable>ConnectionStatus</relatedStateVariable></argument>
+<argument><name>NewLastConnectionError</name><direction>out</direction><relatedStateVariable>LastConnectionError</relatedStateVariable></argument>
+<argument><name>NewUptime</name><direction>out</direction><relatedStateVariable>Uptime</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetConnectionTypeInfo</name><argumentList>
+<argument><name>NewConnectionType</name><direction>out</direction><relatedStateVariable>ConnectionType</relatedStateVariable></argument>
+<argument><name>NewPossibleConnectionTypes</name><direction>out</direction><relatedStateVariable>PossibleConnectionTypes</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>AddPortMapping</name><argumentList>
+<argument><name>NewRemoteHost</name><direction>in</direction><relatedStateVariable>RemoteHost</relatedStateVariable></argument>
+<argument><name>NewExternalPort</name><direction>in</direction><relatedStateVariable>ExternalPort</relatedStateVariable></argument>
+<argument><name>NewProtocol</name><direction>in</direction><relatedStateVariable>PortMappingProtocol</relatedStateVariable></argument>
+<argument><name>NewInternalPort</name><direction>in</direction><relatedStateVariable>InternalPort</relatedStateVariable></argument>
+<argument><name>NewInternalClient</name><direction>in</direction><relatedStateVariable>InternalClient</relatedStateVariable></argument>
+<argument><name>NewEnabled</name><direction>in</direction><relatedStateVariable>PortMappingEnabled</relatedStateVariable></argument>
+<argument><name>NewPortMappingDescription</name><direction>in</direction><relatedStateVariable>PortMappingDescription</relatedStateVariable></argument>
+<argument><name>NewLeaseDuration</name><direction>in</direction><relatedStateVariable>PortMappingLeaseDuration</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>DeletePortMapping</name><argumentList>
+<argument><name>NewRemoteHost</name><direction>in</direction><relatedStateVariable>RemoteHost</relatedStateVariable></argument>
+<argument><name>NewExternalPort</name><direction>in</direction><relatedStateVariable>ExternalPort</relatedStateVariable></argument>
+<argument><name>NewProtocol</name><direction>in</direction><relatedStateVariable>PortMappingProtocol</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSpecificPortMappingEntry</name><argumentList>
+<argument><name>NewRemoteHost</name><direction>in</direction><relatedStateVariable>RemoteHost</relatedStateVariable></argument>
+<argument><name>NewExternalPort</name><direction>in</direction><relatedStateVariable>ExternalPort</relatedStateVariable></argument>
+<argument><name>NewProtocol</name><direction>in</direction><relatedStateVariable>PortMappingProtocol</relatedStateVariable></argument>
+<argument><name>NewInternalPort</name><direction>out</direction><relatedStateVariable>InternalPort</relatedStateVariable></argument>
+<argument><name>NewInternalClient</name><direction>out</direction><relatedStateVariable>InternalClient</relatedStateVariable></argument>
+<argument><name>NewEnabled</name><direction>out</direction><relatedStateVariable>PortMappingEnabled</relatedStateVariable></argument>
+<argument><name>NewPortMappingDescription</name><direction>out</direction><relatedStateVariable>PortMappingDescription</relatedStateVariable></argument>
+<argument><name>NewLeaseDuration</name><direction>out</direction><relatedStateVariable>PortMappingLeaseDuration</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetGenericPortMappingEntry</name><argumentList>
+<argument><name>NewPortMappingIndex</name><direction>in</direction><relatedStateVariable>PortMappingNumberOfEntries</relatedStateVariable></argument>
+<argument><name>NewRemoteHost</name><direction>out</direction><relatedStateVariable>RemoteHost</relatedStateVariable></argument>
+<argument><name>NewExternalPort</name><direction>out</direction><relatedStateVariable>ExternalPort</relatedStateVariable></argument>
+<argument><name>NewProtocol</name><direction>out</direction><relatedStateVariable>PortMappingProtocol</relatedStateVariable></argument>
+<argument><name>NewInternalPort</name><direction>out</direction><relatedStateVariable>InternalPort</relatedStateVariable></argument>
+<argument><name>NewInternalClient</name><direction>out</direction><relatedStateVariable>InternalClient</relatedStateVariable></argument>
+<argument><name>NewEnabled</name><direction>out</direction><relatedStateVariable>PortMappingEnabled</relatedStateVariable></argument>
+<argument><name>NewPortMappingDescription</name><direction>out</direction><relatedStateVariable>PortMappingDescription</relatedStateVariable></argument>
+<argument><name>NewLeaseDuration</name><direction>out</direction><relatedStateVariable>PortMappingLeaseDuration</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="no"><name>ConnectionType</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>PossibleConnectionTypes</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>ConnectionStatus</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>Uptime</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>LastConnectionError</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>ExternalIPAddress</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>RemoteHost</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>ExternalPort</name><dataType>ui2</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>InternalPort</name><dataType>ui2</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingProtocol</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>InternalClient</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingDescription</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingEnabled</name><dataType>boolean</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingLeaseDuration</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>PortMappingNumberOfEntries</name><dataType>ui2</dataType></stateVariable>
+</serviceStateTable>
+</scpd>
+`
@@ -0,0 +1,135 @@
+package upnp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+const natPMPPort = 5351
+
+// NAT-PMP opcodes and result codes (RFC 6886)
+const (
+	natPMPOpAddress = 0
+	natPMPOpMapUDP  = 1
+	natPMPOpMapTCP  = 2
+	natPMPResponse  = 128
+
+	natPMPSuccess            = 0
+	natPMPUnsupportedVersion = 1
+	natPMPNotAuthorized      = 2
+	natPMPNetworkFailure     = 3
+	natPMPOutOfResources     = 4
+	natPMPUnsupportedOpcode  = 5
+)
+
+// receiveNATPMP answers the requests arriving on conn until it is closed
+func (s *Server) receiveNATPMP(conn *net.UDPConn) {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.handleNATPMP(addr.IP, buf[:n]); resp != nil {
+			conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// handleNATPMP returns the response to a request from client, nil for
+// packets that aren't requests
+func (s *Server) handleNATPMP(client net.IP, req []byte) []byte {
+	if len(req) < 2 || req[1] >= natPMPResponse {
+		return nil
+	}
+	op := req[1]
+	if req[0] != 0 {
+		return s.natPMPHeader(op, natPMPUnsupportedVersion)
+	}
+
+	switch op {
+	case natPMPOpAddress:
+		ip, err := s.externalAddress()
+		if err != nil {
+			return s.natPMPHeader(op, natPMPNetworkFailure)
+		}
+		return append(s.natPMPHeader(op, natPMPSuccess), ip.To4()...)
+	case natPMPOpMapUDP, natPMPOpMapTCP:
+		if len(req) < 12 {
+			return nil
+		}
+		protocol := "udp"
+		if op == natPMPOpMapTCP {
+			protocol = "tcp"
+		}
+		internalPort := binary.BigEndian.Uint16(req[4:6])
+		externalPort := binary.BigEndian.Uint16(req[6:8])
+		lifetime := binary.BigEndian.Uint32(req[8:12])
+		failed := func(result uint16) []byte {
+			return natPMPMapping(s.natPMPHeader(op, result), internalPort, 0, 0)
+		}
+		if lifetime == 0 {
+			s.unmapNATPMP(client, protocol, internalPort)
+			return natPMPMapping(s.natPMPHeader(op, natPMPSuccess), internalPort, 0, 0)
+		}
+		if internalPort == 0 {
+			return failed(natPMPNotAuthorized)
+		}
+
+		// A client renewing a mapping may suggest another port
+		for _, existing := range s.backend.PortMappings() {
+			if existing.Protocol == protocol && existing.InternalPort == internalPort && net.ParseIP(existing.Internal).Equal(client) {
+				externalPort = existing.ExternalPort
+			}
+		}
+		if externalPort == 0 {
+			externalPort = internalPort
+		}
+		mapping, err := s.addMapping("NAT-PMP", client, protocol, externalPort, internalPort,
+			time.Duration(lifetime)*time.Second, "NAT-PMP")
+		switch {
+		case errors.Is(err, filter.ErrPortMappingRefused):
+			return failed(natPMPNotAuthorized)
+		case errors.Is(err, filter.ErrPortMappingConflict):
+			return failed(natPMPOutOfResources)
+		case err != nil:
+			return failed(natPMPNetworkFailure)
+		}
+		granted := uint32(time.Until(mapping.Expires).Round(time.Second) / time.Second)
+		return natPMPMapping(s.natPMPHeader(op, natPMPSuccess), internalPort, mapping.ExternalPort, granted)
+	default:
+		return s.natPMPHeader(op, natPMPUnsupportedOpcode)
+	}
+}
+
+// unmapNATPMP removes the mapping of internalPort on client, or all of the
+// client's mappings of protocol for port 0
+func (s *Server) unmapNATPMP(client net.IP, protocol string, internalPort uint16) {
+	for _, mapping := range s.backend.PortMappings() {
+		if mapping.Protocol != protocol || !net.ParseIP(mapping.Internal).Equal(client) {
+			continue
+		}
+		if internalPort == 0 || mapping.InternalPort == internalPort {
+			s.deleteMapping("NAT-PMP", client, protocol, mapping.ExternalPort)
+		}
+	}
+}
+
+// natPMPHeader returns the start of a response: version, opcode, result
+// and seconds since the epoch
+func (s *Server) natPMPHeader(op byte, result uint16) []byte {
+	resp := []byte{0, natPMPResponse + op}
+	resp = binary.BigEndian.AppendUint16(resp, result)
+	return binary.BigEndian.AppendUint32(resp, uint32(time.Since(s.started)/time.Second))
+}
+
+// natPMPMapping appends the ports and lifetime of a mapping to a response
+func natPMPMapping(resp []byte, internalPort, externalPort uint16, lifetime uint32) []byte {
+	resp = binary.BigEndian.AppendUint16(resp, internalPort)
+	resp = binary.BigEndian.AppendUint16(resp, externalPort)
+	return binary.BigEndian.AppendUint32(resp, lifetime)
+}
@@ -0,0 +1,188 @@
+// Package upnp answers UPnP IGD and NAT-PMP clients on the internal
+// interfaces, forwarding ports of the external interface to the hosts
+// asking for them when the policy's upnp settings permit it.
+package upnp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// Backend holds the port mappings
+type Backend interface {
+	AddPortMapping(mapping filter.PortMapping, ttl time.Duration) (filter.PortMapping, error)
+	DeletePortMapping(protocol string, externalPort uint16, internal string) (filter.PortMapping, error)
+	PortMappings() []filter.PortMapping
+}
+
+// Server answers UPnP IGD and NAT-PMP requests
+type Server struct {
+	config  *config.UPnPConfig
+	backend Backend
+	audit   *admin.Auditor
+	// Start of the NAT-PMP epoch; clients map their ports again when it
+	// goes back
+	started time.Time
+	uuid    string
+
+	mu         sync.Mutex
+	interfaces []*internalInterface
+	conns      []*net.UDPConn
+	http       *http.Server
+}
+
+// internalInterface is an interface clients are served on
+type internalInterface struct {
+	name    string
+	network *net.IPNet // Address and subnet of the router on it
+	// Location of the device description, for SSDP responses
+	location string
+}
+
+// NewServer creates a responder for cfg, recording mappings to audit
+func NewServer(cfg *config.UPnPConfig, backend Backend, audit *admin.Auditor) *Server {
+	return &Server{
+		config:  cfg,
+		backend: backend,
+		audit:   audit,
+		started: time.Now(),
+		uuid:    newUUID(),
+	}
+}
+
+// Start listens on the internal interfaces
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range s.config.Interfaces {
+		network, err := interfaceNetwork(name)
+		if err != nil {
+			s.stopLocked()
+			return err
+		}
+		s.interfaces = append(s.interfaces, &internalInterface{name: name, network: network})
+	}
+
+	if s.config.Serves(config.UPnPProtocolNATPMP) {
+		for _, iface := range s.interfaces {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: iface.network.IP, Port: natPMPPort})
+			if err != nil {
+				s.stopLocked()
+				return fmt.Errorf("failed to listen for NAT-PMP on %s: %w", iface.name, err)
+			}
+			s.conns = append(s.conns, conn)
+			go s.receiveNATPMP(conn)
+		}
+	}
+	if s.config.Serves(config.UPnPProtocolIGD) {
+		if err := s.startIGD(); err != nil {
+			s.stopLocked()
+			return err
+		}
+	}
+
+	log.Printf("Answering port mapping requests on %s for %s", strings.Join(s.config.Interfaces, ", "), s.config.ExternalInterface)
+	return nil
+}
+
+// Stop closes the listeners
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopLocked()
+}
+
+// stopLocked closes the listeners
+// Must be called with mu held
+func (s *Server) stopLocked() error {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.interfaces = nil
+	if s.http == nil {
+		return nil
+	}
+	err := s.http.Close()
+	s.http = nil
+	return err
+}
+
+// addMapping maps externalPort to internalPort on client for lease, or the
+// longest lease allowed if 0, and records it
+func (s *Server) addMapping(via string, client net.IP, protocol string, externalPort, internalPort uint16, lease time.Duration, description string) (filter.PortMapping, error) {
+	mapping, err := s.backend.AddPortMapping(filter.PortMapping{
+		Protocol:     protocol,
+		ExternalPort: externalPort,
+		Internal:     client.String(),
+		InternalPort: internalPort,
+		Description:  description,
+	}, lease)
+	if err != nil {
+		log.Printf("Refused %s mapping of %s port %d to %s:%d: %v", via, protocol, externalPort, client, internalPort, err)
+		return filter.PortMapping{}, err
+	}
+	s.audit.Record(admin.AuditEvent{
+		Action:      "mapped",
+		Destination: mapping.Internal,
+		Port:        mapping.InternalPort,
+		TTL:         time.Until(mapping.Expires).Round(time.Second).String(),
+		Reason:      fmt.Sprintf("%s %s port %d: %s", via, protocol, externalPort, description),
+		RequestedBy: client.String(),
+	})
+	return mapping, nil
+}
+
+// deleteMapping removes the mapping of externalPort to client and records it
+func (s *Server) deleteMapping(via string, client net.IP, protocol string, externalPort uint16) error {
+	mapping, err := s.backend.DeletePortMapping(protocol, externalPort, client.String())
+	if err != nil {
+		return err
+	}
+	s.audit.Record(admin.AuditEvent{
+		Action:      "unmapped",
+		Destination: mapping.Internal,
+		Port:        mapping.InternalPort,
+		Reason:      fmt.Sprintf("%s %s port %d", via, protocol, externalPort),
+		RequestedBy: client.String(),
+	})
+	return nil
+}
+
+// externalAddress returns the IPv4 address of the external interface
+func (s *Server) externalAddress() (net.IP, error) {
+	network, err := interfaceNetwork(s.config.ExternalInterface)
+	if err != nil {
+		return nil, err
+	}
+	return network.IP, nil
+}
+
+// interfaceNetwork returns the first IPv4 address of an interface with its
+// subnet
+func interfaceNetwork(name string) (*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %s: %w", name, err)
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.To4() != nil {
+			return &net.IPNet{IP: network.IP.To4(), Mask: network.Mask}, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
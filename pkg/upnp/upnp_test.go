@@ -0,0 +1,200 @@
+package upnp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+)
+
+// fakeBackend holds mappings the way the filter does
+type fakeBackend struct {
+	config   *config.UPnPConfig
+	mappings map[string]filter.PortMapping
+}
+
+func (b *fakeBackend) AddPortMapping(m filter.PortMapping, ttl time.Duration) (filter.PortMapping, error) {
+	if !b.config.Permits(net.ParseIP(m.Internal), m.ExternalPort, m.InternalPort) {
+		return filter.PortMapping{}, filter.ErrPortMappingRefused
+	}
+	key := fmt.Sprintf("%s/%d", m.Protocol, m.ExternalPort)
+	if existing, ok := b.mappings[key]; ok && existing.Internal != m.Internal {
+		return filter.PortMapping{}, filter.ErrPortMappingConflict
+	}
+	if ttl <= 0 || ttl > b.config.EffectiveMaxLease() {
+		ttl = b.config.EffectiveMaxLease()
+	}
+	m.Expires = time.Now().Add(ttl)
+	b.mappings[key] = m
+	return m, nil
+}
+
+func (b *fakeBackend) DeletePortMapping(protocol string, port uint16, internal string) (filter.PortMapping, error) {
+	key := fmt.Sprintf("%s/%d", protocol, port)
+	m, ok := b.mappings[key]
+	if !ok || m.Internal != internal {
+		return filter.PortMapping{}, filter.ErrPortMappingRefused
+	}
+	delete(b.mappings, key)
+	return m, nil
+}
+
+func (b *fakeBackend) PortMappings() []filter.PortMapping {
+	var mappings []filter.PortMapping
+	for _, m := range b.mappings {
+		mappings = append(mappings, m)
+	}
+	return mappings
+}
+
+func newTestServer() (*Server, *fakeBackend) {
+	cfg := &config.UPnPConfig{
+		ExternalInterface: "eth0",
+		Interfaces:        []string{"eth1"},
+		AllowedHosts:      []string{"192.168.1.0/24"},
+		Ports:             []string{"1024-65535"},
+		MaxLease:          config.Duration(time.Hour),
+	}
+	backend := &fakeBackend{config: cfg, mappings: make(map[string]filter.PortMapping)}
+	return NewServer(cfg, backend, admin.NewAuditor("")), backend
+}
+
+// TestNATPMP tests that mapping requests within the policy are granted and
+// others refused with the NAT-PMP result codes
+func TestNATPMP(t *testing.T) {
+	testCases := []struct {
+		name         string
+		client       string
+		op           byte
+		internalPort uint16
+		externalPort uint16
+		lifetime     uint32
+		wantResult   uint16
+		wantExternal uint16
+		wantLifetime uint32
+	}{
+		{
+			name:   "map udp",
+			client: "192.168.1.20", op: natPMPOpMapUDP, internalPort: 3074, externalPort: 3074, lifetime: 7200,
+			wantResult: natPMPSuccess, wantExternal: 3074, wantLifetime: 3600,
+		},
+		{
+			name:   "map tcp on the internal port",
+			client: "192.168.1.20", op: natPMPOpMapTCP, internalPort: 8080, lifetime: 60,
+			wantResult: natPMPSuccess, wantExternal: 8080, wantLifetime: 60,
+		},
+		{
+			name:   "host not allowed",
+			client: "10.0.0.5", op: natPMPOpMapTCP, internalPort: 8080, externalPort: 8080, lifetime: 60,
+			wantResult: natPMPNotAuthorized,
+		},
+		{
+			name:   "port not allowed",
+			client: "192.168.1.20", op: natPMPOpMapTCP, internalPort: 22, externalPort: 22, lifetime: 60,
+			wantResult: natPMPNotAuthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			req := []byte{0, tc.op, 0, 0}
+			req = binary.BigEndian.AppendUint16(req, tc.internalPort)
+			req = binary.BigEndian.AppendUint16(req, tc.externalPort)
+			req = binary.BigEndian.AppendUint32(req, tc.lifetime)
+
+			resp := s.handleNATPMP(net.ParseIP(tc.client), req)
+			if len(resp) != 16 || resp[1] != natPMPResponse+tc.op {
+				t.Fatalf("Expected a 16 byte response to opcode %d, got %v", tc.op, resp)
+			}
+			if result := binary.BigEndian.Uint16(resp[2:4]); result != tc.wantResult {
+				t.Fatalf("Expected result %d, got %d", tc.wantResult, result)
+			}
+			if external := binary.BigEndian.Uint16(resp[10:12]); external != tc.wantExternal {
+				t.Errorf("Expected external port %d, got %d", tc.wantExternal, external)
+			}
+			if lifetime := binary.BigEndian.Uint32(resp[12:16]); lifetime != tc.wantLifetime {
+				t.Errorf("Expected lifetime %d, got %d", tc.wantLifetime, lifetime)
+			}
+		})
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		s, backend := newTestServer()
+		client := net.ParseIP("192.168.1.20")
+		map8080 := []byte{0, natPMPOpMapTCP, 0, 0, 0x1f, 0x90, 0x1f, 0x90, 0, 0, 0, 60}
+		s.handleNATPMP(client, map8080)
+		if len(backend.mappings) != 1 {
+			t.Fatalf("Expected a mapping, got %v", backend.mappings)
+		}
+		// Other hosts can't remove it
+		unmap := []byte{0, natPMPOpMapTCP, 0, 0, 0x1f, 0x90, 0, 0, 0, 0, 0, 0}
+		s.handleNATPMP(net.ParseIP("192.168.1.21"), unmap)
+		if len(backend.mappings) != 1 {
+			t.Fatalf("Expected the mapping to be kept, got %v", backend.mappings)
+		}
+		s.handleNATPMP(client, unmap)
+		if len(backend.mappings) != 0 {
+			t.Errorf("Expected the mapping to be deleted, got %v", backend.mappings)
+		}
+	})
+}
+
+// TestIGDAddPortMapping tests that UPnP clients may only map permitted
+// ports to themselves
+func TestIGDAddPortMapping(t *testing.T) {
+	testCases := []struct {
+		name     string
+		client   string
+		internal string
+		port     string
+		wantCode string // UPnP error code, "" for success
+	}{
+		{name: "own address", client: "192.168.1.20", internal: "192.168.1.20", port: "25565"},
+		{name: "other host", client: "192.168.1.20", internal: "192.168.1.30", port: "25565", wantCode: "606"},
+		{name: "host not allowed", client: "10.0.0.5", internal: "10.0.0.5", port: "25565", wantCode: "606"},
+		{name: "port not allowed", client: "192.168.1.20", internal: "192.168.1.20", port: "443", wantCode: "606"},
+		{name: "wildcard port", client: "192.168.1.20", internal: "192.168.1.20", port: "0", wantCode: "716"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, backend := newTestServer()
+			body := `<?xml version="1.0"?>` +
+				`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+				`<u:AddPortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">` +
+				`<NewRemoteHost></NewRemoteHost><NewExternalPort>` + tc.port + `</NewExternalPort><NewProtocol>TCP</NewProtocol>` +
+				`<NewInternalPort>` + tc.port + `</NewInternalPort><NewInternalClient>` + tc.internal + `</NewInternalClient>` +
+				`<NewEnabled>1</NewEnabled><NewPortMappingDescription>game server</NewPortMappingDescription><NewLeaseDuration>0</NewLeaseDuration>` +
+				`</u:AddPortMapping></s:Body></s:Envelope>`
+			req := httptest.NewRequest(http.MethodPost, controlURL, strings.NewReader(body))
+			req.RemoteAddr = tc.client + ":49000"
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+
+			if tc.wantCode == "" {
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "AddPortMappingResponse") {
+					t.Fatalf("Expected the mapping to be added, got %d: %s", w.Code, w.Body.String())
+				}
+				if len(backend.mappings) != 1 {
+					t.Errorf("Expected a mapping, got %v", backend.mappings)
+				}
+				return
+			}
+			if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "<errorCode>"+tc.wantCode+"</errorCode>") {
+				t.Errorf("Expected UPnP error %s, got %d: %s", tc.wantCode, w.Code, w.Body.String())
+			}
+			if len(backend.mappings) != 0 {
+				t.Errorf("Expected no mapping, got %v", backend.mappings)
+			}
+		})
+	}
+}
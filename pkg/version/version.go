@@ -0,0 +1,60 @@
+// Package version identifies the build of the router
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with
+//
+//	-ldflags "-X github.com/skaegi/legion-router/pkg/version.Version=v1.2.0 ..."
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes a build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build of the running binary. The commit and date come
+// from the VCS information Go embeds when they weren't set at build time.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// String describes a build on one line, e.g. v1.2.0 (commit 3f2a9c1, built
+// 2024-05-01T10:00:00Z, go1.21.5)
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		s += fmt.Sprintf("commit %.7s, ", i.Commit)
+	}
+	if i.Date != "" {
+		s += fmt.Sprintf("built %s, ", i.Date)
+	}
+	return s + i.GoVersion + ")"
+}
@@ -0,0 +1,31 @@
+package version
+
+import "testing"
+
+// TestString tests describing builds with and without ldflags
+func TestString(t *testing.T) {
+	testCases := []struct {
+		name string
+		info Info
+		want string
+	}{
+		{
+			name: "release",
+			info: Info{Version: "v1.2.0", Commit: "3f2a9c1e8b7d", Date: "2024-05-01T10:00:00Z", GoVersion: "go1.21.5"},
+			want: "v1.2.0 (commit 3f2a9c1, built 2024-05-01T10:00:00Z, go1.21.5)",
+		},
+		{
+			name: "dev",
+			info: Info{Version: "dev", GoVersion: "go1.21.5"},
+			want: "dev (go1.21.5)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.info.String(); got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
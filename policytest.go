@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
+)
+
+// newTestCmd returns the command checking the policy tests of a config, or
+// of a separate file, against the ruleset the config compiles to, failing
+// if any test does:
+//
+//	legion-router test --config config.yaml [--tests tests.yaml]
+func newTestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test",
+		Short: "Run the policy tests of a config",
+		Args:  cobra.NoArgs,
+	}
+	configPath := cmd.Flags().String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
+	testsPath := cmd.Flags().String("tests", "", "File of tests to run instead of the config's")
+	verbose := cmd.Flags().BoolP("verbose", "v", false, "Print passing tests too")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runTest(*configPath, *testsPath, *verbose)
+	}
+	return cmd
+}
+
+// runTest runs the tests of the config at configPath, or of the file at
+// testsPath if set
+func runTest(configPath, testsPath string, verbose bool) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	tests := cfg.Tests
+	if testsPath != "" {
+		if tests, err = config.LoadTests(testsPath); err != nil {
+			return err
+		}
+	}
+	if len(tests) == 0 {
+		return fmt.Errorf("no tests to run")
+	}
+
+	resolver, err := dns.NewResolver(cfg.DNS.Servers)
+	if err != nil {
+		return err
+	}
+	results, err := filter.RunTests(cfg, resolver, tests)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		name := result.Test.Name
+		if name == "" {
+			name = testName(result.Test)
+		}
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", name, result.Err)
+		case !result.Passed():
+			failed++
+			fmt.Printf("FAIL %s: expected %s, got %s (%s)\n", name, result.Test.Expect, result.Verdict, result.Reason)
+		case verbose:
+			fmt.Printf("ok   %s: %s (%s)\n", name, result.Verdict, result.Reason)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(results))
+	}
+	fmt.Printf("%d tests passed\n", len(results))
+	return nil
+}
+
+// testName describes a test without a name, e.g. 10.0.0.5 -> github.com tcp/443
+func testName(test config.PolicyTest) string {
+	src := test.Source
+	if src == "" {
+		src = "*"
+	}
+	dst := test.Destination
+	if test.Domain != "" {
+		if dst != "" {
+			dst += " "
+		}
+		dst += test.Domain
+	}
+	if test.Protocol == config.ProtocolICMP {
+		return fmt.Sprintf("%s -> %s icmp", src, dst)
+	}
+	return fmt.Sprintf("%s -> %s %s/%d", src, dst, test.Protocol, test.Port)
+}
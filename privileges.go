@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// forwardingSysctls are the sysctls enabling forwarding, by /proc/sys path
+var forwardingSysctls = []struct {
+	path     string
+	name     string
+	optional bool // IPv6 may be disabled on the host; IPv4 is enough then
+}{
+	{path: "/proc/sys/net/ipv4/ip_forward", name: "net.ipv4.ip_forward"},
+	{path: "/proc/sys/net/ipv6/conf/all/forwarding", name: "net.ipv6.conf.all.forwarding", optional: true},
+}
+
+// checkCapabilities fails early, with a hint, if the process can't program
+// nftables and network interfaces, rather than midway through applying
+func checkCapabilities() error {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return fmt.Errorf("failed to read capabilities: %w", err)
+	}
+	defer f.Close()
+
+	ok, err := hasCapability(f, unix.CAP_NET_ADMIN)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("CAP_NET_ADMIN is required to program nftables and network interfaces: " +
+			"run as root, grant it with `setcap cap_net_admin+ep legion-router`, or run the container with --cap-add NET_ADMIN")
+	}
+	return nil
+}
+
+// hasCapability reports whether the effective capabilities in a
+// /proc/<pid>/status file include capability
+func hasCapability(status io.Reader, capability uint) (bool, error) {
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid effective capabilities %q: %w", value, err)
+		}
+		return caps&(1<<capability) != 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read capabilities: %w", err)
+	}
+	return false, fmt.Errorf("no effective capabilities in process status")
+}
+
+// enableIPForwarding enables IPv4 and IPv6 forwarding on Linux. Sysctls that
+// are already set are left alone, so that no privileges beyond
+// CAP_NET_ADMIN are needed when the host enables forwarding; otherwise they
+// are written directly, or through helper if that is not permitted.
+func enableIPForwarding(helper string) error {
+	for _, sysctl := range forwardingSysctls {
+		current, err := os.ReadFile(sysctl.path)
+		if os.IsNotExist(err) && sysctl.optional {
+			continue
+		}
+		if err == nil && strings.TrimSpace(string(current)) == "1" {
+			continue
+		}
+
+		err = os.WriteFile(sysctl.path, []byte("1\n"), 0644)
+		if errors.Is(err, os.ErrPermission) && helper != "" {
+			err = runSysctlHelper(helper, sysctl.name+"=1")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set %s=1 (set it on the host, or use --sysctl-helper): %w", sysctl.name, err)
+		}
+	}
+	return nil
+}
+
+// runSysctlHelper runs a privileged helper command, such as
+// "sudo -n sysctl -w", with a name=value assignment
+func runSysctlHelper(helper, assignment string) error {
+	args := append(strings.Fields(helper), assignment)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", helper, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
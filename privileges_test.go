@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestHasCapability tests reading effective capabilities from a process
+// status file
+func TestHasCapability(t *testing.T) {
+	testCases := []struct {
+		name    string
+		status  string
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:   "root",
+			status: "Name:\tlegion-router\nCapPrm:\t000001ffffffffff\nCapEff:\t000001ffffffffff\n",
+			want:   true,
+		},
+		{
+			name:   "net admin only",
+			status: "CapEff:\t0000000000001000\n",
+			want:   true,
+		},
+		{
+			name:   "unprivileged",
+			status: "CapPrm:\t0000000000001000\nCapEff:\t0000000000000000\n",
+			want:   false,
+		},
+		{
+			name:    "missing",
+			status:  "Name:\tlegion-router\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			status:  "CapEff:\tzz\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := hasCapability(strings.NewReader(tc.status), unix.CAP_NET_ADMIN)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("hasCapability() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/events"
+	"github.com/spf13/cobra"
+)
+
+// newQueryCmd returns the command printing the stored events of a running
+// router from the admin API, or of a stopped one from its database:
+//
+//	legion-router query [--since 1h] [--until 2026-10-01T12:00:00Z] [--type deny] [--rule block-metadata] [--src 10.0.0.0/24] [--dst 169.254.169.254] [--port 80] [--domain github]
+//	legion-router query --db /var/lib/legion-router/events.db --since 24h
+func newQueryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "query",
+		Short: "Show the allowed and denied connections and reloads a router stored",
+		Args:  cobra.NoArgs,
+	}
+	fs := cmd.Flags()
+	since := fs.String("since", "", "Only events since this time, RFC 3339 or a duration ago such as 1h")
+	until := fs.String("until", "", "Only events before this time, RFC 3339 or a duration ago")
+	types := fs.String("type", "", "Only events of these comma-separated types: allow, deny, reload or honeypot")
+	rule := fs.String("rule", "", "Only connections decided by this rule")
+	src := fs.String("src", "", "Only connections from this address or network")
+	dst := fs.String("dst", "", "Only connections to this address or network")
+	port := fs.Uint("port", 0, "Only connections to this port")
+	domain := fs.String("domain", "", "Only connections to a domain containing this")
+	limit := fs.Int("limit", 100, "Latest events to print")
+	db := fs.String("db", "", "Read the event store file of a stopped router instead of the admin API")
+	asJSON := fs.Bool("json", false, "Print the events as JSON")
+	client := adminClientFlags(fs)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		query, err := eventQuery(time.Now(), *since, *until, *types, *src, *dst)
+		if err != nil {
+			return err
+		}
+		if *port > 65535 {
+			return fmt.Errorf("invalid port %d", *port)
+		}
+		query.Rule, query.Port, query.Domain, query.Limit = *rule, uint16(*port), *domain, *limit
+
+		var found []events.Event
+		if *db != "" {
+			store, err := events.OpenReadOnly(*db)
+			if err != nil {
+				return fmt.Errorf("%w; query a running router through its admin API", err)
+			}
+			defer store.Close()
+			if found, err = store.Query(query); err != nil {
+				return err
+			}
+		} else if found, err = client().Events(query); err != nil {
+			return err
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(found)
+		}
+		for _, event := range found {
+			fmt.Printf("%s %s\n", event.Time.Format(time.RFC3339), event)
+		}
+		return nil
+	}
+	return cmd
+}
+
+// eventQuery builds the time range, types and networks of a query from the
+// flags
+func eventQuery(now time.Time, since, until, types, src, dst string) (events.Query, error) {
+	var query events.Query
+	var err error
+	if query.Since, err = parseQueryTime(now, since); err != nil {
+		return query, fmt.Errorf("invalid --since: %w", err)
+	}
+	if query.Until, err = parseQueryTime(now, until); err != nil {
+		return query, fmt.Errorf("invalid --until: %w", err)
+	}
+	if types != "" {
+		for _, t := range strings.Split(types, ",") {
+			switch t {
+			case events.TypeAllow, events.TypeDeny, events.TypeReload, events.TypeHoneypot:
+			default:
+				return query, fmt.Errorf("invalid --type %q: allow, deny, reload or honeypot is required", t)
+			}
+			query.Types = append(query.Types, t)
+		}
+	}
+	if src != "" {
+		if query.Source, err = events.ParseNetwork(src); err != nil {
+			return query, fmt.Errorf("invalid --src: %w", err)
+		}
+	}
+	if dst != "" {
+		if query.Destination, err = events.ParseNetwork(dst); err != nil {
+			return query, fmt.Errorf("invalid --dst: %w", err)
+		}
+	}
+	return query, nil
+}
+
+// parseQueryTime parses a time as RFC 3339 or as a duration before now; ""
+// is the zero time
+func parseQueryTime(now time.Time, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", s)
+	}
+	return t, nil
+}
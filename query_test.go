@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseQueryTime tests reading query times as RFC 3339 or a duration
+// ago
+func TestParseQueryTime(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:  "duration ago",
+			value: "90m",
+			want:  now.Add(-90 * time.Minute),
+		},
+		{
+			name:  "rfc3339",
+			value: "2026-09-30T08:00:00Z",
+			want:  time.Date(2026, 9, 30, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "date only",
+			value:   "2026-09-30",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseQueryTime(now, tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got %v", tc.wantErr, err)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// newReloadCmd returns the command signalling the running instance to
+// reload its config now, for when changes to the file or key aren't noticed
+// or watching is unwanted:
+//
+//	legion-router reload [--pid-file /run/legion-router.pid]
+func newReloadCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reload",
+		Short: "Make a running router reload its config",
+		Args:  cobra.NoArgs,
+	}
+	pidFile := cmd.Flags().String("pid-file", defaultPIDFile, "PID file of the instance to reload")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runReload(*pidFile)
+	}
+	return cmd
+}
+
+// runReload sends SIGHUP to the instance whose PID is in pidFile
+func runReload(pidFile string) error {
+	file, err := os.Open(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to open PID file: %w", err)
+	}
+	pid := readPID(file)
+	file.Close()
+	if pid <= 0 {
+		return fmt.Errorf("no PID in %s", pidFile)
+	}
+
+	if err := unix.Kill(pid, unix.SIGHUP); err != nil {
+		return fmt.Errorf("failed to signal the running instance (pid %d): %w", pid, err)
+	}
+	fmt.Printf("Asked pid %d to reload its config; see its log for the outcome\n", pid)
+	return nil
+}
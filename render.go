@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
+)
+
+// newRenderCmd returns the command printing the nft script the router
+// would program for a config, for review or for applying with `nft -f`
+// where the daemon can't run:
+//
+//	legion-router render --config config.yaml > ruleset.nft
+func newRenderCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Print the nft script a config compiles to",
+		Args:  cobra.NoArgs,
+	}
+	configPath := cmd.Flags().String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runRender(*configPath)
+	}
+	return cmd
+}
+
+// runRender prints the nft script of the config at configPath
+func runRender(configPath string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	resolver, err := dns.NewResolver(cfg.DNS.Servers)
+	if err != nil {
+		return err
+	}
+	return filter.Render(cfg, resolver, os.Stdout)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
+)
+
+// newRulesCmd returns the command listing the rules of the running policy
+// from the admin API, showing one as programmed, or enabling or disabling
+// one:
+//
+//	legion-router rules [--action deny] [--destination 203.0.113.10] [--domain github] [--tag payments]
+//	legion-router rules <name>
+//	legion-router rules enable|disable <name>
+func newRulesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rules [name]",
+		Short: "List the rules of a running router, show one as programmed, or enable or disable one",
+		Args:  cobra.MaximumNArgs(1),
+	}
+	fs := cmd.Flags()
+	action := fs.String("action", "", "Only rules with this action: allow or deny")
+	destination := fs.String("destination", "", "Only rules whose destinations contain this address")
+	domain := fs.String("domain", "", "Only rules with a domain containing this")
+	tag := fs.String("tag", "", "Only rules carrying this tag")
+	offset := fs.Int("offset", 0, "Rules to skip")
+	limit := fs.Int("limit", 0, "Rules to list (default 100)")
+	client := adminClientFlags(cmd.PersistentFlags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		var name string
+		if len(args) > 0 {
+			name = args[0]
+		}
+		if name != "" {
+			rule, err := client().ExpandRule(name)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(rule)
+		}
+
+		query := filter.RuleQuery{
+			Action: config.Action(*action),
+			Domain: *domain,
+			Tag:    *tag,
+			Offset: *offset,
+			Limit:  *limit,
+		}
+		if *destination != "" {
+			if query.Destination = net.ParseIP(*destination); query.Destination == nil {
+				return fmt.Errorf("invalid destination %q: an address is required", *destination)
+			}
+		}
+		page, err := client().Rules(query)
+		if err != nil {
+			return err
+		}
+		disabled := make(map[string]bool, len(page.Disabled))
+		for _, name := range page.Disabled {
+			disabled[name] = true
+		}
+		for _, rule := range page.Rules {
+			line := fmt.Sprintf("%-6d %-5s %s %s", rule.Order, rule.Action, rule.Name, ruleDestinations(rule))
+			if disabled[rule.Name] {
+				line += " (disabled)"
+			}
+			if rule.Description != "" {
+				line += "  # " + rule.Description
+			}
+			if rule.Reference != "" {
+				line += " <" + rule.Reference + ">"
+			}
+			fmt.Println(line)
+		}
+		if shown := page.Offset + len(page.Rules); shown < page.Total {
+			fmt.Printf("... %d more, see --offset %d\n", page.Total-shown, shown)
+		}
+		return nil
+	}
+	cmd.AddCommand(newRuleToggleCmd("enable", client), newRuleToggleCmd("disable", client))
+	return cmd
+}
+
+// newRuleToggleCmd returns the command enabling or disabling a rule, as op
+// is enable or disable
+func newRuleToggleCmd(op string, client func() *admin.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   op + " <name>",
+		Short: strings.ToUpper(op[:1]) + op[1:] + " a rule",
+		Args:  cobra.ExactArgs(1),
+	}
+	user := cmd.Flags().String("user", os.Getenv("USER"), "Name recorded in the audit log")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if _, err := client().SetRuleEnabled(args[0], op == "enable", *user); err != nil {
+			return err
+		}
+		fmt.Printf("Rule %s %sd\n", args[0], op)
+		return nil
+	}
+	return cmd
+}
+
+// ruleDestinations summarizes the destinations of a rule
+func ruleDestinations(rule config.Rule) string {
+	destinations := append(append([]string(nil), rule.Egress.Domains...), rule.Egress.IPs...)
+	if len(destinations) == 0 {
+		return "*"
+	}
+	return strings.Join(destinations, ",")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/skaegi/legion-router/pkg/cluster"
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/dns"
+	"github.com/skaegi/legion-router/pkg/docker"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/skaegi/legion-router/pkg/ha"
+	"github.com/skaegi/legion-router/pkg/network"
+	"github.com/skaegi/legion-router/pkg/upnp"
+	"github.com/skaegi/legion-router/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+// daemonOptions are the flags of the daemon
+type daemonOptions struct {
+	configPath   string
+	oneshot      bool
+	sysctlHelper string
+	netnsPath    string
+	targetPID    int
+	force        bool
+	pidFile      string
+	replace      bool
+}
+
+// newRunCmd returns the command running the router until it is signalled
+// to stop:
+//
+//	legion-router run --config config.yaml
+func newRunCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run",
+		Short: "Run the router (the default)",
+	}
+	daemonFlags(cmd)
+	return cmd
+}
+
+// daemonFlags registers the flags of the daemon on cmd and makes it run
+// the daemon, which the root command does too
+func daemonFlags(cmd *cobra.Command) {
+	var opts daemonOptions
+	fs := cmd.Flags()
+	fs.StringVar(&opts.configPath, "config", "/etc/legion-router/config.yaml", "Path to configuration file, or a consul:// or etcd:// key")
+	fs.BoolVar(&opts.oneshot, "oneshot", false, "Apply the ruleset once and exit, leaving it in place")
+	fs.StringVar(&opts.sysctlHelper, "sysctl-helper", "", "Command setting sysctls when not running as root, e.g. \"sudo -n sysctl -w\"")
+	fs.StringVar(&opts.netnsPath, "netns", "", "Filter the traffic originating in this network namespace instead of forwarded traffic")
+	fs.IntVar(&opts.targetPID, "target-pid", 0, "Filter the traffic originating in the network namespace of this process")
+	fs.BoolVar(&opts.force, "force", false, "Start even if the config refuses to run alongside other firewall managers found")
+	fs.StringVar(&opts.pidFile, "pid-file", "", "PID file locked while running (default /run/legion-router.pid, or one per --netns)")
+	fs.BoolVar(&opts.replace, "replace", false, "Take over from a running instance, which exits leaving its ruleset for this one to replace")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return runDaemon(&opts)
+	}
+}
+
+// runDaemon runs the router until it is signalled to stop
+func runDaemon(opts *daemonOptions) error {
+	log.Printf("Starting legion-router %s", version.Get())
+
+	if err := checkCapabilities(); err != nil {
+		return fmt.Errorf("insufficient privileges: %w", err)
+	}
+
+	// As a sidecar or CNI plugin, the ruleset goes into a pod's namespace
+	if opts.targetPID != 0 {
+		if opts.netnsPath != "" {
+			return fmt.Errorf("only one of --netns and --target-pid can be given")
+		}
+		opts.netnsPath = network.NetNSPath(opts.targetPID)
+	}
+	var netns *os.File
+	if opts.netnsPath != "" {
+		var err error
+		if netns, err = network.OpenNetNS(opts.netnsPath); err != nil {
+			return fmt.Errorf("failed to open target namespace: %w", err)
+		}
+		defer netns.Close()
+		log.Printf("Filtering traffic originating in network namespace %s", opts.netnsPath)
+	} else if err := enableIPForwarding(opts.sysctlHelper); err != nil {
+		// Forwarded traffic is only filtered in the router's own namespace
+		log.Printf("Warning: failed to enable IP forwarding: %v", err)
+	}
+
+	// Two instances would fight over the same table and sets
+	if opts.pidFile == "" {
+		path, err := pidFilePath(netns)
+		if err != nil {
+			return fmt.Errorf("failed to lock instance: %w", err)
+		}
+		opts.pidFile = path
+	}
+	lock, err := lockInstance(opts.pidFile, opts.replace)
+	if err != nil {
+		return fmt.Errorf("failed to lock instance: %w", err)
+	}
+	defer lock.Close()
+
+	// Load configuration from a file or a key-value store
+	source, err := config.OpenSource(opts.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	var cfg *config.Config
+	var revision uint64
+	if source != nil {
+		cfg, revision, err = config.LoadSource(context.Background(), source)
+	} else {
+		cfg, err = config.Load(opts.configPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	log.Printf("Loaded configuration version %s with %d rules (policy %s)", cfg.Version, len(cfg.Rules), cfg.Hash())
+
+	// Create DNS resolver
+	resolver, err := dns.NewResolver(cfg.DNS.Servers)
+	if err != nil {
+		return fmt.Errorf("failed to create DNS resolver: %w", err)
+	}
+
+	// Create and start the filter
+	f, err := filter.New(cfg, opts.configPath, resolver)
+	if err != nil {
+		return fmt.Errorf("failed to create filter: %w", err)
+	}
+	if source != nil {
+		f.SetSource(source, revision)
+	}
+	f.SetForce(opts.force)
+	if netns != nil {
+		if err := f.SetNetNS(int(netns.Fd())); err != nil {
+			return fmt.Errorf("failed to target network namespace: %w", err)
+		}
+	}
+
+	// For immutable images, where a timer re-runs the router to follow DNS
+	// changes instead of the daemon loop
+	if opts.oneshot {
+		if err := f.ApplyOnce(); err != nil {
+			return fmt.Errorf("failed to apply ruleset: %w", err)
+		}
+		log.Println("Ruleset applied, exiting")
+		return nil
+	}
+
+	if err := f.Start(); err != nil {
+		return fmt.Errorf("failed to start filter: %w", err)
+	}
+
+	// What started is stopped again if the rest fails to, so that a failed
+	// start doesn't leave servers and the ruleset of this instance behind
+	var (
+		adminServer *admin.Server
+		upnpServer  *upnp.Server
+		agent       *cluster.Agent
+		haNode      *ha.Node
+		started     bool
+	)
+	defer func() {
+		if started {
+			return
+		}
+		if haNode != nil {
+			if err := haNode.Stop(); err != nil {
+				log.Printf("Error stopping HA: %v", err)
+			}
+		}
+		if agent != nil {
+			if err := agent.Stop(); err != nil {
+				log.Printf("Error stopping cluster agent: %v", err)
+			}
+		}
+		if upnpServer != nil {
+			if err := upnpServer.Stop(); err != nil {
+				log.Printf("Error stopping UPnP: %v", err)
+			}
+		}
+		if adminServer != nil {
+			if err := adminServer.Stop(); err != nil {
+				log.Printf("Error stopping admin API: %v", err)
+			}
+		}
+		if err := f.Stop(); err != nil {
+			log.Printf("Error stopping filter: %v", err)
+		}
+	}()
+
+	// Start the admin API, if configured
+	if cfg.Admin != nil {
+		server := admin.NewServer(cfg.Admin, f)
+		if err := server.Start(); err != nil {
+			return fmt.Errorf("failed to start admin API: %w", err)
+		}
+		adminServer = server
+	}
+
+	// Answer UPnP and NAT-PMP clients, if configured, recording their
+	// mappings in the admin API's audit log
+	if cfg.UPnP != nil {
+		auditLog := ""
+		if cfg.Admin != nil {
+			auditLog = cfg.Admin.AuditLog
+		}
+		server := upnp.NewServer(cfg.UPnP, f, admin.NewAuditor(auditLog))
+		if err := server.Start(); err != nil {
+			return fmt.Errorf("failed to start UPnP: %w", err)
+		}
+		upnpServer = server
+	}
+
+	// Follow the cluster controller, if configured
+	if cfg.Cluster != nil {
+		if agent, err = cluster.NewAgent(cfg, f); err != nil {
+			return fmt.Errorf("failed to create cluster agent: %w", err)
+		}
+		agent.Start()
+	}
+
+	// Join the HA pair, if configured
+	if cfg.HA != nil {
+		node := ha.NewNode(cfg.HA, f)
+		if err := node.Start(); err != nil {
+			return fmt.Errorf("failed to start HA: %w", err)
+		}
+		haNode = node
+	}
+
+	// Assign Docker containers to profiles, if configured
+	var dockerWatcher *docker.Watcher
+	if cfg.Docker != nil {
+		dockerWatcher = docker.NewWatcher(cfg.Docker, f)
+		dockerWatcher.Start()
+	}
+
+	started = true
+	log.Println("Legion Router started successfully")
+
+	// Wait for shutdown signal, or for an instance started with --replace
+	// to take over, reloading the config on SIGHUP
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, handoverSignal)
+	sig := <-sigChan
+	for sig == syscall.SIGHUP {
+		log.Println("Reloading config on SIGHUP")
+		if err := f.ReloadNow(); err != nil {
+			log.Printf("Error reloading config: %v", err)
+		} else {
+			log.Println("Config reloaded successfully")
+		}
+		sig = <-sigChan
+	}
+
+	if sig == handoverSignal {
+		log.Println("Handing over to a new instance...")
+	} else {
+		log.Println("Shutting down...")
+	}
+	if dockerWatcher != nil {
+		if err := dockerWatcher.Stop(); err != nil {
+			log.Printf("Error stopping Docker watcher: %v", err)
+		}
+	}
+	if agent != nil {
+		if err := agent.Stop(); err != nil {
+			log.Printf("Error stopping cluster agent: %v", err)
+		}
+	}
+	if haNode != nil {
+		if err := haNode.Stop(); err != nil {
+			log.Printf("Error stopping HA: %v", err)
+		}
+	}
+	if upnpServer != nil {
+		if err := upnpServer.Stop(); err != nil {
+			log.Printf("Error stopping UPnP: %v", err)
+		}
+	}
+	if adminServer != nil {
+		if err := adminServer.Stop(); err != nil {
+			log.Printf("Error stopping admin API: %v", err)
+		}
+	}
+	stop := f.Stop
+	if sig == handoverSignal {
+		stop = f.Handover
+	}
+	if err := stop(); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
+	return nil
+}
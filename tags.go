@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/skaegi/legion-router/pkg/admin"
+	"github.com/spf13/cobra"
+)
+
+// newTagsCmd returns the command listing the tags of the running policy
+// with their hits, or enabling or disabling the rules carrying one, through
+// the admin API:
+//
+//	legion-router tags
+//	legion-router tags enable|disable <tag>
+func newTagsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tags",
+		Short: "Report hits by tag, or enable or disable the rules carrying a tag",
+		Args:  cobra.NoArgs,
+	}
+	client := adminClientFlags(cmd.PersistentFlags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		tags, err := client().Tags()
+		if err != nil {
+			return err
+		}
+		for _, status := range tags {
+			fmt.Printf("%-20s %4d rules %4d disabled %12d hits\n", status.Tag, len(status.Rules), len(status.Disabled), status.Hits)
+		}
+		return nil
+	}
+	cmd.AddCommand(newTagToggleCmd("enable", client), newTagToggleCmd("disable", client))
+	return cmd
+}
+
+// newTagToggleCmd returns the command enabling or disabling the rules
+// carrying a tag, as op is enable or disable
+func newTagToggleCmd(op string, client func() *admin.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   op + " <tag>",
+		Short: strings.ToUpper(op[:1]) + op[1:] + " the rules carrying a tag",
+		Args:  cobra.ExactArgs(1),
+	}
+	user := cmd.Flags().String("user", os.Getenv("USER"), "Name recorded in the audit log")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		tag := args[0]
+		change, err := client().SetTagEnabled(tag, op == "enable", *user)
+		if err != nil {
+			return err
+		}
+		verb := "Disabled"
+		if change.Enabled {
+			verb = "Enabled"
+		}
+		fmt.Printf("%s %d rule(s) tagged %s: %s\n", verb, len(change.Rules), tag, strings.Join(change.Rules, ", "))
+		return nil
+	}
+	return cmd
+}
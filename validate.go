@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/skaegi/legion-router/pkg/config"
+	"github.com/skaegi/legion-router/pkg/filter"
+	"github.com/spf13/cobra"
+)
+
+// newValidateCmd returns the command checking that a config parses, is
+// valid and has rules that build, without resolving or applying anything,
+// e.g. before deploying it:
+//
+//	legion-router validate --config config.yaml
+func newValidateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check a config without applying it",
+		Args:  cobra.NoArgs,
+	}
+	fs := cmd.Flags()
+	configPath := fs.String("config", "/etc/legion-router/config.yaml", "Path to configuration file")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := filter.Check(cfg); err != nil {
+			return err
+		}
+		// Expired rules are valid but applied as if removed, so they are left
+		// for someone to clean up
+		now := time.Now()
+		expired := 0
+		for _, rule := range cfg.Rules {
+			if rule.Expired(now) {
+				fmt.Printf("Warning: rule %s expired on %s and is skipped\n", rule.Name, rule.Expires.Format(time.RFC3339))
+				expired++
+			}
+		}
+		if expired > 0 {
+			fmt.Printf("%s: valid, %d rules, %d expired\n", *configPath, len(cfg.Rules), expired)
+			return nil
+		}
+		fmt.Printf("%s: valid, %d rules\n", *configPath, len(cfg.Rules))
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/skaegi/legion-router/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+// newVersionCmd returns the command printing the build of the binary and,
+// with --running, that of the running instance and the hash of the policy
+// it applied:
+//
+//	legion-router version [--running]
+func newVersionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+	}
+	fs := cmd.Flags()
+	running := fs.Bool("running", false, "Also print the build and policy hash of the running instance, from the admin API")
+	client := adminClientFlags(fs)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		fmt.Printf("legion-router %s\n", version.Get())
+		if !*running {
+			return nil
+		}
+
+		status, err := client().Status()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("running: legion-router %s, policy %s\n", status.Build, status.ConfigHash)
+		return nil
+	}
+	return cmd
+}